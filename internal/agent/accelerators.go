@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"github.com/kairos-io/kairos-agent/v2/internal/i18n"
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	internalutils "github.com/kairos-io/kairos-agent/v2/pkg/utils"
+)
+
+// The reasons recorded for the accelerator decisions
+const (
+	acceleratorAuto       = "auto"
+	acceleratorAccepted   = "accepted"
+	acceleratorDeclined   = "declined"
+	acceleratorUnattended = "unattended"
+	acceleratorNoBundle   = "no-bundle"
+)
+
+// offerAcceleratorBundles detects the GPUs and accelerators of the machine and adds the driver bundles of the
+// catalog matching them to the install bundles, asking for each of them unless install.accelerators.auto is set.
+// Unattended installs, when ask is false or there is no terminal, only add them with auto, so they never block on
+// the question. The decisions are recorded on the OEM partition after the install.
+func offerAcceleratorBundles(c *config.Config, ask bool) error {
+	if c.Install == nil || c.Install.Accelerators == nil {
+		return nil
+	}
+	if internalutils.IsUkiWithFs(c.Fs) {
+		c.Logger.Warnf("Driver bundles are not installed on trusted boot, install the driver sysexts instead")
+		return nil
+	}
+	accelerators := c.Install.Accelerators
+	accelerators.Decisions = nil
+	// Several devices can share a bundle, it's offered and installed once
+	reasons := map[string]string{}
+	for _, a := range internalutils.DetectAccelerators(c.Fs) {
+		decision := config.AcceleratorDecision{Address: a.Address, Vendor: a.Vendor, Device: a.Device, Reason: acceleratorNoBundle}
+		if bundle := accelerators.Match(a.Vendor, a.Device); bundle != nil {
+			decision.Bundle = bundle.String()
+			reason, decided := reasons[decision.Bundle]
+			if !decided {
+				var err error
+				if reason, err = acceleratorDecision(accelerators.Auto, ask, bundle.String(), a.String()); err != nil {
+					return err
+				}
+				reasons[decision.Bundle] = reason
+				if reason == acceleratorAuto || reason == acceleratorAccepted {
+					c.Install.Bundles = append(c.Install.Bundles, bundle.Bundle)
+				}
+			}
+			decision.Reason = reason
+			decision.Installed = reason == acceleratorAuto || reason == acceleratorAccepted
+		}
+		c.Logger.Infof("Accelerator %s: bundle %q, installed %t (%s)", a, decision.Bundle, decision.Installed, decision.Reason)
+		accelerators.Decisions = append(accelerators.Decisions, decision)
+	}
+	return nil
+}
+
+func acceleratorDecision(auto, ask bool, bundle, accelerator string) (string, error) {
+	if auto {
+		return acceleratorAuto, nil
+	}
+	if !ask || !interactive() {
+		return acceleratorUnattended, nil
+	}
+	ok, err := askYesNo(i18n.T("accelerators.offer", accelerator, bundle))
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return acceleratorAccepted, nil
+	}
+	return acceleratorDeclined, nil
+}
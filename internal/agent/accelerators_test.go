@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v5/vfst"
+)
+
+var _ = Describe("Accelerator bundles", func() {
+	var c *config.Config
+	var out *bytes.Buffer
+	var cleanup func()
+	isInteractive := interactive
+
+	BeforeEach(func() {
+		fs, clean, err := vfst.NewTestFS(map[string]interface{}{})
+		Expect(err).ToNot(HaveOccurred())
+		cleanup = clean
+		for addr, ids := range map[string][]string{
+			"0000:01:00.0": {"0x10de", "0x2204"},
+			"0000:02:00.0": {"0x10de", "0x2204"},
+			"0000:00:02.0": {"0x8086", "0x46a6"},
+		} {
+			dir := filepath.Join(utils.PCIDevicesDir, addr)
+			Expect(fsutils.MkdirAll(fs, dir, constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile(filepath.Join(dir, "class"), []byte("0x030000\n"), constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile(filepath.Join(dir, "vendor"), []byte(ids[0]+"\n"), constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile(filepath.Join(dir, "device"), []byte(ids[1]+"\n"), constants.FilePerm)).To(Succeed())
+		}
+		c = config.NewConfig(config.WithFs(fs), config.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})))
+		c.Install = &config.Install{Accelerators: &config.Accelerators{Catalog: []config.AcceleratorBundle{
+			{Name: "nvidia-550", Vendor: "nvidia", Devices: []string{"10de:22*"}, Bundle: config.Bundle{Targets: []string{"run://quay.io/example/nvidia:550"}}},
+		}}}
+		out = &bytes.Buffer{}
+		confirmOut = out
+		interactive = func() bool { return true }
+	})
+
+	AfterEach(func() {
+		cleanup()
+		confirmIn = os.Stdin
+		confirmOut = os.Stdout
+		interactive = isInteractive
+	})
+
+	It("installs the matching bundle once if accepted", func() {
+		confirmIn = strings.NewReader("y\n")
+		Expect(offerAcceleratorBundles(c, true)).To(Succeed())
+		Expect(strings.Count(out.String(), "nvidia-550")).To(Equal(1))
+		Expect(c.Install.Bundles).To(Equal(config.Bundles{{Targets: []string{"run://quay.io/example/nvidia:550"}}}))
+		Expect(c.Install.Accelerators.Decisions).To(Equal([]config.AcceleratorDecision{
+			{Address: "0000:00:02.0", Vendor: "intel", Device: "8086:46a6", Reason: "no-bundle"},
+			{Address: "0000:01:00.0", Vendor: "nvidia", Device: "10de:2204", Bundle: "nvidia-550", Installed: true, Reason: "accepted"},
+			{Address: "0000:02:00.0", Vendor: "nvidia", Device: "10de:2204", Bundle: "nvidia-550", Installed: true, Reason: "accepted"},
+		}))
+	})
+
+	It("records the declined bundles", func() {
+		confirmIn = strings.NewReader("n\n")
+		Expect(offerAcceleratorBundles(c, true)).To(Succeed())
+		Expect(c.Install.Bundles).To(BeEmpty())
+		Expect(c.Install.Accelerators.Decisions[1].Reason).To(Equal("declined"))
+	})
+
+	It("does not ask on unattended installs", func() {
+		Expect(offerAcceleratorBundles(c, false)).To(Succeed())
+		Expect(out.String()).To(BeEmpty())
+		Expect(c.Install.Bundles).To(BeEmpty())
+		Expect(c.Install.Accelerators.Decisions[1].Reason).To(Equal("unattended"))
+
+		c.Install.Accelerators.Auto = true
+		Expect(offerAcceleratorBundles(c, false)).To(Succeed())
+		Expect(c.Install.Bundles).To(HaveLen(1))
+		Expect(c.Install.Accelerators.Decisions[1]).To(Equal(config.AcceleratorDecision{
+			Address: "0000:01:00.0", Vendor: "nvidia", Device: "10de:2204", Bundle: "nvidia-550", Installed: true, Reason: "auto",
+		}))
+	})
+})
@@ -3,14 +3,18 @@ package agent
 import (
 	"fmt"
 	"os"
+	"time"
 
 	hook "github.com/kairos-io/kairos-agent/v2/internal/agent/hooks"
 	"github.com/kairos-io/kairos-agent/v2/internal/bus"
+	"github.com/kairos-io/kairos-agent/v2/pkg/action"
 	config "github.com/kairos-io/kairos-agent/v2/pkg/config"
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/kairos-io/kairos-agent/v2/pkg/uki"
 	events "github.com/kairos-io/kairos-sdk/bus"
 	"github.com/kairos-io/kairos-sdk/collector"
 	"github.com/kairos-io/kairos-sdk/machine"
+	"github.com/kairos-io/kairos-sdk/state"
 	"github.com/kairos-io/kairos-sdk/utils"
 )
 
@@ -58,6 +62,10 @@ func Run(opts ...Option) error {
 			return err
 		}
 	}
+	reportBootDegradations(c)
+	assessBootloaderUpgrade(c)
+	rollbackFailedActive(c)
+
 	configStr, err := c.Config.String()
 	if err != nil {
 		panic(err)
@@ -70,3 +78,55 @@ func Run(opts ...Option) error {
 	}
 	return err
 }
+
+// reportBootDegradations warns about the known degradations of the current boot and publishes them, so providers
+// can alert about a system running without its persistent data
+func reportBootDegradations(c *config.Config) {
+	runtime, err := state.NewRuntimeWithLogger(c.Logger.Logger)
+	if err != nil {
+		c.Logger.Warnf("Could not read the runtime state to check the boot: %s", err)
+		return
+	}
+	degradations := action.DetectBootDegradations(c, runtime)
+	if len(degradations) == 0 {
+		return
+	}
+	for _, d := range degradations {
+		c.Logger.Warnf("Boot degraded (%s): %s [%s]", d.Kind, d.Message, d.Source)
+	}
+	if _, err := bus.Manager.Publish(bus.EventBootDegraded, degradations); err != nil {
+		c.Logger.Warnf("Could not publish the boot degradations: %s", err)
+	}
+}
+
+// assessBootloaderUpgrade marks the pending bootloader upgrade good or rolls it back depending on the current boot
+func assessBootloaderUpgrade(c *config.Config) {
+	upgrade, err := uki.AssessBootloaderUpgradeFromESP(c)
+	if err != nil {
+		c.Logger.Warnf("Could not assess the bootloader upgrade: %s", err)
+		return
+	}
+	if upgrade != nil && upgrade.Status == uki.BootloaderUpgradeRolledBack {
+		c.Logger.Warnf("Rolled back the bootloader upgrade of %s, the active entry failed its boot assessment", upgrade.Time.Format(time.RFC3339))
+	}
+}
+
+// rollbackFailedActive promotes passive to active if the active entry failed its boot assessment and publishes the
+// rollback, so providers can alert about the failed upgrade
+func rollbackFailedActive(c *config.Config) {
+	rollback, err := uki.RollbackFailedActive(c)
+	if err != nil {
+		c.Logger.Warnf("Could not roll back the failed active entry: %s", err)
+		return
+	}
+	if rollback == nil {
+		return
+	}
+	c.Logger.Warnf("Rolled back to the previous image, the active entry failed %d boots", rollback.FailedBoots)
+	if err := action.FailWatchdog(c, fmt.Sprintf("the active entry failed %d boots", rollback.FailedBoots)); err != nil {
+		c.Logger.Warnf("Could not record the failed active entry in the watchdog: %s", err)
+	}
+	if _, err := bus.Manager.Publish(bus.EventBootRollback, rollback); err != nil {
+		c.Logger.Warnf("Could not publish the rollback: %s", err)
+	}
+}
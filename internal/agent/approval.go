@@ -0,0 +1,240 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/kairos-agent/v2/internal/i18n"
+	config "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	"github.com/kairos-io/kairos-sdk/utils"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultApprovalTimeout = 30 * time.Second
+
+// Sources of an UpgradeDecision
+const (
+	DecisionFromEndpoint = "endpoint"
+	DecisionFromCache    = "cache"
+	DecisionFromOffline  = "offline"
+)
+
+// UpgradeApprovalRequest is POSTed to the approval endpoint
+type UpgradeApprovalRequest struct {
+	Hostname  string `json:"hostname"`
+	MachineID string `json:"machine-id,omitempty"`
+	Version   string `json:"version,omitempty"`
+	// Target is the image the node upgrades to
+	Target string `json:"target"`
+	Entry  string `json:"entry,omitempty"`
+}
+
+// UpgradeApprovalResponse is the answer of the approval endpoint
+type UpgradeApprovalResponse struct {
+	Approved bool   `json:"approved"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// UpgradeDecision is whether an upgrade to Target was approved, and where the decision came from
+type UpgradeDecision struct {
+	Target   string    `yaml:"target"`
+	Approved bool      `yaml:"approved"`
+	Reason   string    `yaml:"reason,omitempty"`
+	Time     time.Time `yaml:"time"`
+	From     string    `yaml:"-"`
+}
+
+// UpgradeApprover asks the approval endpoint in the config whether the node can upgrade
+type UpgradeApprover struct {
+	cfg       *config.Config
+	approval  config.UpgradeApproval
+	cacheFile string
+	Client    *http.Client
+}
+
+// NewUpgradeApprover returns an UpgradeApprover for the upgrade approval in the config
+func NewUpgradeApprover(c *config.Config) *UpgradeApprover {
+	a := &UpgradeApprover{cfg: c, cacheFile: constants.UpgradeApprovalCacheFile}
+	if c.UpgradeApproval != nil {
+		a.approval = *c.UpgradeApproval
+	}
+	if a.approval.Timeout == 0 {
+		a.approval.Timeout = defaultApprovalTimeout
+	}
+	a.Client = &http.Client{Timeout: a.approval.Timeout, Transport: c.HTTPTransport()}
+	return a
+}
+
+// Approve returns the decision on upgrading to target. Upgrades are always approved if no endpoint is configured.
+// A cached decision is reused until it expires, and if the endpoint can't be reached the offline policy decides.
+func (a *UpgradeApprover) Approve(target, entry string) (UpgradeDecision, error) {
+	if a.approval.URL == "" {
+		return UpgradeDecision{Target: target, Approved: true, Time: time.Now()}, nil
+	}
+	switch a.approval.Offline {
+	case "", constants.UpgradeApprovalOfflineDeny, constants.UpgradeApprovalOfflineAllow:
+	default:
+		return UpgradeDecision{}, fmt.Errorf("invalid upgrade_approval offline policy %q, expected %s or %s", a.approval.Offline, constants.UpgradeApprovalOfflineDeny, constants.UpgradeApprovalOfflineAllow)
+	}
+
+	cache := a.readCache()
+	if d, ok := cache[target]; ok && a.approval.Cache > 0 && time.Since(d.Time) < a.approval.Cache {
+		d.From = DecisionFromCache
+		return d, nil
+	}
+
+	resp, err := a.ask(target, entry)
+	if err != nil {
+		a.cfg.Logger.Warnf("Could not reach the upgrade approval endpoint: %s", err)
+		d := UpgradeDecision{
+			Target:   target,
+			Approved: a.approval.Offline == constants.UpgradeApprovalOfflineAllow,
+			Reason:   fmt.Sprintf("approval endpoint unreachable, offline policy is %s", a.offlinePolicy()),
+			Time:     time.Now(),
+			From:     DecisionFromOffline,
+		}
+		return d, nil
+	}
+	d := UpgradeDecision{Target: target, Approved: resp.Approved, Reason: resp.Reason, Time: time.Now(), From: DecisionFromEndpoint}
+	if a.approval.Cache > 0 {
+		cache[target] = d
+		if err = a.writeCache(cache); err != nil {
+			a.cfg.Logger.Warnf("Could not cache the upgrade decision: %s", err)
+		}
+	}
+	return d, nil
+}
+
+// ask POSTs the node identity and target to the endpoint. Denials are answers too, only failing to get one is an error.
+func (a *UpgradeApprover) ask(target, entry string) (*UpgradeApprovalResponse, error) {
+	body, err := json.Marshal(upgradeApprovalRequest(a.cfg, target, entry))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, a.approval.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.approval.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.approval.Token)
+	}
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		return &UpgradeApprovalResponse{Reason: strings.TrimSpace(string(data))}, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	answer := &UpgradeApprovalResponse{}
+	if err = json.Unmarshal(data, answer); err != nil {
+		return nil, fmt.Errorf("parsing the approval: %w", err)
+	}
+	return answer, nil
+}
+
+func (a *UpgradeApprover) offlinePolicy() string {
+	if a.approval.Offline == "" {
+		return constants.UpgradeApprovalOfflineDeny
+	}
+	return a.approval.Offline
+}
+
+func (a *UpgradeApprover) readCache() map[string]UpgradeDecision {
+	cache := map[string]UpgradeDecision{}
+	data, err := a.cfg.Fs.ReadFile(a.cacheFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			a.cfg.Logger.Warnf("Could not read the cached upgrade decisions: %s", err)
+		}
+		return cache
+	}
+	if err = yaml.Unmarshal(data, &cache); err != nil {
+		a.cfg.Logger.Warnf("Ignoring the cached upgrade decisions in %s: %s", a.cacheFile, err)
+		return map[string]UpgradeDecision{}
+	}
+	return cache
+}
+
+func (a *UpgradeApprover) writeCache(cache map[string]UpgradeDecision) error {
+	// Expired decisions are useless, drop them so the cache does not grow with every target
+	for target, d := range cache {
+		if time.Since(d.Time) >= a.approval.Cache {
+			delete(cache, target)
+		}
+	}
+	data, err := yaml.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	if err = fsutils.MkdirAll(a.cfg.Fs, filepath.Dir(a.cacheFile), constants.DirPerm); err != nil {
+		return err
+	}
+	return fsutils.AtomicWriteFile(a.cfg.Fs, a.cacheFile, data, constants.FilePerm)
+}
+
+// upgradeApprovalRequest collects the identity of the node for the approval request
+func upgradeApprovalRequest(c *config.Config, target, entry string) UpgradeApprovalRequest {
+	req := UpgradeApprovalRequest{Target: target, Entry: entry}
+	req.Hostname, _ = os.Hostname()
+	if id, err := c.Fs.ReadFile("/etc/machine-id"); err == nil {
+		req.MachineID = strings.TrimSpace(string(id))
+	}
+	req.Version, _ = utils.OSRelease("VERSION")
+	return req
+}
+
+// UpgradeNotApprovedError is returned when the upgrade to Target is denied, by the approval endpoint or the offline
+// policy
+type UpgradeNotApprovedError struct {
+	Target string
+	Reason string
+}
+
+func (e *UpgradeNotApprovedError) Error() string {
+	return i18n.T("upgrade.not-approved", e.Target, e.Reason)
+}
+
+// Check returns an UpgradeNotApprovedError if the upgrade to target is not approved
+func (a *UpgradeApprover) Check(target, entry string) error {
+	d, err := a.Approve(target, entry)
+	if err != nil {
+		return err
+	}
+	if !d.Approved {
+		reason := d.Reason
+		if reason == "" {
+			reason = i18n.T("upgrade.denied")
+		}
+		return &UpgradeNotApprovedError{Target: target, Reason: reason}
+	}
+	a.cfg.Logger.Infof("Upgrade to %s approved, %s decision", target, d.From)
+	return nil
+}
+
+// checkUpgradeApproval asks for the upgrade approval unless skipped
+func checkUpgradeApproval(c *config.Config, source *v1.ImageSource, entry string, skip bool) error {
+	if skip || c.UpgradeApproval == nil || source == nil {
+		return nil
+	}
+	return NewUpgradeApprover(c).Check(source.String(), entry)
+}
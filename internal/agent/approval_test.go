@@ -0,0 +1,133 @@
+package agent_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/kairos-io/kairos-agent/v2/internal/agent"
+	config "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	"github.com/kairos-io/kairos-sdk/collector"
+	"github.com/twpayne/go-vfs/v5/vfst"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("UpgradeApprover", func() {
+	var server *httptest.Server
+	var requests []UpgradeApprovalRequest
+	var auth string
+	var status int
+	var answer string
+
+	BeforeEach(func() {
+		requests, auth, status, answer = nil, "", http.StatusOK, `{"approved": true}`
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			req := UpgradeApprovalRequest{}
+			_ = json.Unmarshal(body, &req)
+			requests = append(requests, req)
+			auth = r.Header.Get("Authorization")
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(answer))
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	newApprover := func(extra string) (*UpgradeApprover, *config.Config) {
+		c, err := config.ScanNoLogs(collector.Readers(strings.NewReader(fmt.Sprintf(`#cloud-config
+upgrade_approval:
+  url: %s/approve
+  token: secret
+%s`, server.URL, extra))))
+		Expect(err).ToNot(HaveOccurred())
+		fs, cleanup, err := vfst.NewTestFS(map[string]interface{}{"/etc/machine-id": "1234\n"})
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(cleanup)
+		c.Fs = fs
+		return NewUpgradeApprover(c), c
+	}
+
+	It("asks the endpoint with the node identity and target", func() {
+		a, _ := newApprover("")
+		d, err := a.Approve("oci://quay.io/kairos/ubuntu:v3.2.0", "active")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(d.Approved).To(BeTrue())
+		Expect(d.From).To(Equal(DecisionFromEndpoint))
+		Expect(auth).To(Equal("Bearer secret"))
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].Target).To(Equal("oci://quay.io/kairos/ubuntu:v3.2.0"))
+		Expect(requests[0].Entry).To(Equal("active"))
+		Expect(requests[0].MachineID).To(Equal("1234"))
+		Expect(requests[0].Hostname).ToNot(BeEmpty())
+	})
+
+	It("is denied by a forbidden answer or approved false", func() {
+		a, _ := newApprover("")
+		answer = `{"approved": false, "reason": "wave 2 starts tomorrow"}`
+		d, err := a.Approve("oci://quay.io/kairos/ubuntu:v3.2.0", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(d.Approved).To(BeFalse())
+		Expect(d.Reason).To(Equal("wave 2 starts tomorrow"))
+
+		status, answer = http.StatusForbidden, "not in the canary group"
+		d, err = a.Approve("oci://quay.io/kairos/ubuntu:v3.2.0", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(d.Approved).To(BeFalse())
+		Expect(d.Reason).To(Equal("not in the canary group"))
+	})
+
+	It("fails the check of a denied upgrade with the reason", func() {
+		a, _ := newApprover("")
+		Expect(a.Check("oci://quay.io/kairos/ubuntu:v3.2.0", "")).To(Succeed())
+
+		answer = `{"approved": false, "reason": "wave 2 starts tomorrow"}`
+		err := a.Check("oci://quay.io/kairos/ubuntu:v3.2.0", "")
+		var denied *UpgradeNotApprovedError
+		Expect(errors.As(err, &denied)).To(BeTrue())
+		Expect(denied.Target).To(Equal("oci://quay.io/kairos/ubuntu:v3.2.0"))
+		Expect(denied.Reason).To(Equal("wave 2 starts tomorrow"))
+	})
+
+	It("reuses the cached decision for the same target", func() {
+		a, c := newApprover("  cache: 1h")
+		_, err := a.Approve("oci://quay.io/kairos/ubuntu:v3.2.0", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.Fs.ReadFile(constants.UpgradeApprovalCacheFile)).To(ContainSubstring("oci://quay.io/kairos/ubuntu:v3.2.0"))
+
+		server.Close()
+		d, err := NewUpgradeApprover(c).Approve("oci://quay.io/kairos/ubuntu:v3.2.0", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(d.Approved).To(BeTrue())
+		Expect(d.From).To(Equal(DecisionFromCache))
+		Expect(requests).To(HaveLen(1))
+
+		// Other targets are not covered by the cache, offline denies by default
+		d, err = NewUpgradeApprover(c).Approve("oci://quay.io/kairos/ubuntu:v3.3.0", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(d.Approved).To(BeFalse())
+		Expect(d.From).To(Equal(DecisionFromOffline))
+	})
+
+	It("applies the offline policy when the endpoint fails", func() {
+		status = http.StatusInternalServerError
+		a, _ := newApprover("  offline: allow")
+		d, err := a.Approve("oci://quay.io/kairos/ubuntu:v3.2.0", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(d.Approved).To(BeTrue())
+		Expect(d.From).To(Equal(DecisionFromOffline))
+
+		a, _ = newApprover("  offline: maybe")
+		_, err = a.Approve("oci://quay.io/kairos/ubuntu:v3.2.0", "")
+		Expect(err).To(MatchError(ContainSubstring("invalid upgrade_approval offline policy")))
+	})
+})
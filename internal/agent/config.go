@@ -4,6 +4,7 @@ import (
 	"os"
 
 	"github.com/kairos-io/kairos-agent/v2/internal/kairos"
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
 	"gopkg.in/yaml.v3"
 )
 
@@ -13,19 +14,16 @@ type BrandingText struct {
 	Reset              string `yaml:"reset"`
 	Recovery           string `yaml:"recovery"`
 }
-type WebUI struct {
-	Disable       bool   `yaml:"disable"`
-	ListenAddress string `yaml:"listen_address"`
-}
 
-func (w WebUI) HasAddress() bool {
-	return w.ListenAddress != ""
-}
+// WebUI is the webui config, the cloud config `webui` block overrides it
+type WebUI = config.WebUI
 
 type Config struct {
 	Fast     bool         `yaml:"fast,omitempty"`
 	WebUI    WebUI        `yaml:"webui"`
 	Branding BrandingText `yaml:"branding"`
+	// StrictCLI turns the usage of deprecated flags and commands into errors
+	StrictCLI bool `yaml:"strict_cli,omitempty"`
 }
 
 func LoadConfig(path ...string) (*Config, error) {
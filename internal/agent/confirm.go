@@ -0,0 +1,56 @@
+package agent
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/kairos-io/kairos-agent/v2/internal/i18n"
+)
+
+// ErrNotConfirmed is returned when the user does not confirm a destructive action
+var ErrNotConfirmed error = i18n.NewError("confirm.aborted")
+
+// confirmIn and confirmOut are the terminal the confirmations are asked on
+var (
+	confirmIn  io.Reader = os.Stdin
+	confirmOut io.Writer = os.Stdout
+)
+
+// interactive reports if there is a user to ask, stdin being a terminal
+var interactive = func() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Confirm asks the user to confirm a destructive action, i.e. install or reset, before running it.
+// This is the single place destructive commands ask for confirmation, with the same semantics for all of them:
+//   - yes (the --yes flag) skips the confirmation
+//   - it's only asked when running on a terminal, so automation and the boot services are not blocked
+//   - --force never skips it, force only overrides the safety checks of each command
+func Confirm(yes bool, action string) error {
+	if yes || !interactive() {
+		return nil
+	}
+	ok, err := askYesNo(fmt.Sprintf("%s\n%s", action, i18n.T("confirm.continue")))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotConfirmed
+	}
+	return nil
+}
+
+// askYesNo asks the question on the terminal, anything but yes is a no
+func askYesNo(question string) (bool, error) {
+	fmt.Fprint(confirmOut, question)
+	answer, err := bufio.NewReader(confirmIn).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+	return isYes(strings.TrimSpace(answer)), nil
+}
@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Confirm", func() {
+	var out *bytes.Buffer
+	var tty bool
+	isInteractive := interactive
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		tty = true
+		confirmOut = out
+		interactive = func() bool { return tty }
+	})
+
+	AfterEach(func() {
+		confirmIn = os.Stdin
+		confirmOut = os.Stdout
+		interactive = isInteractive
+	})
+
+	It("asks on a terminal", func() {
+		confirmIn = strings.NewReader("y\n")
+		Expect(Confirm(false, "Installing will erase all the data on /dev/sda.")).To(Succeed())
+		Expect(out.String()).To(Equal("Installing will erase all the data on /dev/sda.\nContinue? [y/N]: "))
+
+		confirmIn = strings.NewReader("YES\n")
+		Expect(Confirm(false, "Reset?")).To(Succeed())
+	})
+
+	It("aborts unless confirmed", func() {
+		for _, answer := range []string{"n\n", "\n", "nope\n", ""} {
+			confirmIn = strings.NewReader(answer)
+			Expect(Confirm(false, "Reset?")).To(MatchError(ErrNotConfirmed))
+		}
+	})
+
+	It("does not ask with yes or without a terminal", func() {
+		confirmIn = io.MultiReader()
+		Expect(Confirm(true, "Reset?")).To(Succeed())
+		tty = false
+		Expect(Confirm(false, "Reset?")).To(Succeed())
+		Expect(out.String()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	config "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-sdk/collector"
+	"github.com/kairos-io/kairos-sdk/utils"
+)
+
+// Daemon runs the long lived agent modules, the reset button watcher, the heartbeat and the upgrade scheduler,
+// until it is stopped with SIGTERM or SIGINT. It's run from its own service, so the bootstrap done by Run stays a
+// oneshot.
+func Daemon(opts ...Option) error {
+	o := &Options{}
+	if err := o.Apply(opts...); err != nil {
+		return err
+	}
+
+	c, err := config.Scan(collector.Directories(o.Dir...))
+	if err != nil {
+		return err
+	}
+	utils.SetEnv(c.Env)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-signals:
+			close(stop)
+		case <-done:
+		}
+	}()
+
+	return RunModules(c, o.Dir, stop)
+}
+
+// agentModule is a long lived part of the agent, running until stop is closed
+type agentModule struct {
+	name string
+	run  func(stop <-chan struct{}) error
+}
+
+// RunModules runs the agent modules enabled in the config until stop is closed, reloading the config on SIGHUP.
+// It only returns once all of them stopped, with the errors of the ones that failed.
+func RunModules(c *config.Config, dirs []string, stop <-chan struct{}) error {
+	reloader := NewConfigReloader(c, dirs...)
+	stopReload := reloader.Watch()
+	defer stopReload()
+
+	var modules []agentModule
+	if c.ResetButton != nil {
+		modules = append(modules, agentModule{"reset button watcher", NewResetButtonWatcher(c).Follow(reloader).Run})
+	}
+	if c.Heartbeat != nil {
+		modules = append(modules, agentModule{"heartbeat", NewHeartbeat(c).Follow(reloader).Run})
+	}
+	if c.Upgrade != nil && c.Upgrade.Window != nil {
+		modules = append(modules, agentModule{"upgrade scheduler", NewUpgradeScheduler(c, dirs).Follow(reloader).Run})
+	}
+	if len(modules) == 0 {
+		c.Logger.Infof("Neither reset_button, heartbeat nor upgrade.window are configured, nothing to run")
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	for _, m := range modules {
+		wg.Add(1)
+		go func(m agentModule) {
+			defer wg.Done()
+			if err := m.run(stop); err != nil {
+				reloader.Config().Logger.Errorf("Stopped the %s: %s", m.name, err)
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", m.name, err))
+				mu.Unlock()
+			}
+		}(m)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
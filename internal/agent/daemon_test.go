@@ -0,0 +1,58 @@
+package agent_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+
+	. "github.com/kairos-io/kairos-agent/v2/internal/agent"
+	config "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-sdk/collector"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Daemon", func() {
+	var server *httptest.Server
+	var reports atomic.Int32
+
+	BeforeEach(func() {
+		reports.Store(0)
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reports.Add(1)
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	scan := func(cloudConfig string) *config.Config {
+		c, err := config.ScanNoLogs(collector.Readers(strings.NewReader(cloudConfig)))
+		Expect(err).ToNot(HaveOccurred())
+		return c
+	}
+
+	It("runs the configured modules until stopped and waits for them", func() {
+		c := scan(fmt.Sprintf("#cloud-config\nheartbeat:\n  url: %s/status\n  interval: 1h\n", server.URL))
+		stop := make(chan struct{})
+		done := make(chan error, 1)
+		go func() { done <- RunModules(c, nil, stop) }()
+		Eventually(reports.Load).Should(BeNumerically(">=", 1))
+		Consistently(done).ShouldNot(Receive())
+		close(stop)
+		Eventually(done).Should(Receive(BeNil()))
+	})
+
+	It("returns right away without modules", func() {
+		Expect(RunModules(scan("#cloud-config\n"), nil, make(chan struct{}))).To(Succeed())
+	})
+
+	It("returns the errors of the failed modules", func() {
+		c := scan("#cloud-config\nheartbeat:\n  interval: 1m\n")
+		Expect(RunModules(c, nil, make(chan struct{}))).To(MatchError(ContainSubstring("heartbeat: heartbeat needs an url")))
+	})
+})
@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Deprecation describes a deprecated CLI surface of the agent
+type Deprecation struct {
+	ID          string `json:"id" yaml:"id"`
+	Kind        string `json:"kind" yaml:"kind"`
+	Usage       string `json:"usage" yaml:"usage"`
+	Replacement string `json:"replacement" yaml:"replacement"`
+	Message     string `json:"message" yaml:"message"`
+}
+
+var (
+	DeprecatedUpgradeImageFlag = Deprecation{
+		ID:          "upgrade-image-flag",
+		Kind:        "flag",
+		Usage:       "upgrade --image",
+		Replacement: "upgrade --source oci:<image>",
+		Message:     "--image flag is deprecated, please use --source",
+	}
+	DeprecatedUpgradePositional = Deprecation{
+		ID:          "upgrade-positional-source",
+		Kind:        "argument",
+		Usage:       "upgrade <version>",
+		Replacement: "upgrade --source <source>",
+		Message:     "Warning: Passing a version as a positional argument is deprecated. Use --source flag instead.",
+	}
+	DeprecatedConfigShow = Deprecation{
+		ID:          "config-show",
+		Kind:        "command",
+		Usage:       "config show",
+		Replacement: "config",
+		Message:     "Warning: 'config show' is deprecated and will be removed in v3.2.0. Use 'config' without a subcommand instead.",
+	}
+	DeprecatedStartForce = Deprecation{
+		ID:          "start-force-flag",
+		Kind:        "flag",
+		Usage:       "start --force",
+		Replacement: "start",
+		Message:     "Warning: --force has no effect on start and will be removed, --force is kept for overriding safety checks.",
+	}
+)
+
+// Deprecations returns all the known deprecated CLI surfaces
+func Deprecations() []Deprecation {
+	return []Deprecation{DeprecatedUpgradeImageFlag, DeprecatedUpgradePositional, DeprecatedConfigShow, DeprecatedStartForce}
+}
+
+// Deprecated is called when a deprecated CLI surface is used. If the agent config has strict_cli enabled it returns
+// an error, otherwise it prints the human readable warning to stdout and a machine-readable one to stderr.
+func Deprecated(d Deprecation) error {
+	agentConfig, err := LoadConfig()
+	if err == nil && agentConfig.StrictCLI {
+		return fmt.Errorf("'%s' is deprecated and strict_cli is enabled, use '%s' instead", d.Usage, d.Replacement)
+	}
+
+	fmt.Println(d.Message)
+	if out, err := json.Marshal(map[string]Deprecation{"deprecation": d}); err == nil {
+		fmt.Fprintln(os.Stderr, string(out))
+	}
+	return nil
+}
+
+// FindDeprecations returns the deprecated CLI surfaces used by the given invocation arguments,
+// e.g. []string{"upgrade", "--image", "quay.io/kairos/opensuse:latest"}
+func FindDeprecations(args []string) []Deprecation {
+	var found []Deprecation
+	// Skip global flags until we reach the command
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return found
+	}
+
+	switch args[0] {
+	case "upgrade":
+		// Flags that take a value, so we dont report their values as positional arguments
+		valueFlags := map[string]bool{"--image": true, "--source": true, "--boot-entry": true}
+		rest := args[1:]
+		if len(rest) > 0 && rest[0] == "list-releases" {
+			return found
+		}
+		positional := false
+		for i := 0; i < len(rest); i++ {
+			arg := rest[i]
+			name := strings.SplitN(arg, "=", 2)[0]
+			if name == "--image" || name == "-image" {
+				found = append(found, DeprecatedUpgradeImageFlag)
+			}
+			if strings.HasPrefix(arg, "-") {
+				if valueFlags["--"+strings.TrimLeft(name, "-")] && !strings.Contains(arg, "=") {
+					i++
+				}
+				continue
+			}
+			positional = true
+		}
+		if positional {
+			found = append(found, DeprecatedUpgradePositional)
+		}
+	case "config", "c":
+		if len(args) > 1 && args[1] == "show" {
+			found = append(found, DeprecatedConfigShow)
+		}
+	case "start", "s":
+		for _, arg := range args[1:] {
+			if arg == "--force" || arg == "-force" {
+				found = append(found, DeprecatedStartForce)
+			}
+		}
+	}
+	return found
+}
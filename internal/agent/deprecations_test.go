@@ -0,0 +1,27 @@
+package agent_test
+
+import (
+	. "github.com/kairos-io/kairos-agent/v2/internal/agent"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FindDeprecations", func() {
+	It("finds the deprecated upgrade flags and arguments", func() {
+		found := FindDeprecations([]string{"--debug", "upgrade", "--image", "quay.io/kairos/opensuse:latest", "v3.0.0"})
+		Expect(found).To(Equal([]Deprecation{DeprecatedUpgradeImageFlag, DeprecatedUpgradePositional}))
+	})
+	It("does not report flag values as positional arguments", func() {
+		Expect(FindDeprecations([]string{"upgrade", "--source", "oci:quay.io/kairos/opensuse:latest", "--recovery"})).To(BeEmpty())
+		Expect(FindDeprecations([]string{"upgrade", "list-releases", "--all"})).To(BeEmpty())
+	})
+	It("finds deprecated commands", func() {
+		Expect(FindDeprecations([]string{"config", "show"})).To(Equal([]Deprecation{DeprecatedConfigShow}))
+		Expect(FindDeprecations([]string{"config", "get", "install"})).To(BeEmpty())
+	})
+	It("finds the no-op start --force flag", func() {
+		Expect(FindDeprecations([]string{"start", "--force", "/oem"})).To(Equal([]Deprecation{DeprecatedStartForce}))
+		Expect(FindDeprecations([]string{"manual-install", "--force", "config.yaml"})).To(BeEmpty())
+	})
+})
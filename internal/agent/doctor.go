@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"fmt"
+
+	"github.com/kairos-io/kairos-agent/v2/internal/bus"
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/kairos-io/kairos-sdk/collector"
+	"gopkg.in/yaml.v3"
+)
+
+// doctorExcludes are the pseudo and scratch filesystems of the running system the permissions audit does not descend into
+var doctorExcludes = []string{"/mnt", "/proc", "/sys", "/dev", "/tmp", "/host", "/run"}
+
+// DoctorReport is the outcome of the `doctor` checks
+type DoctorReport struct {
+	// Permissions is the permissions audit of the running system
+	Permissions *v1.PermissionsReport `json:"permissions" yaml:"permissions"`
+	// Deployments are the permissions audits of the last deployed images, by image label
+	Deployments map[string]*v1.PermissionsReport `json:"deployments,omitempty" yaml:"deployments,omitempty"`
+	// Media are the SD cards and eMMC devices of the system with their wear
+	Media []*v1.FlashMedia `json:"media,omitempty" yaml:"media,omitempty"`
+	// Warnings are the problems found with the expected lifetime of the media
+	Warnings []string `json:"warnings,omitempty" yaml:"warnings,omitempty"`
+}
+
+// Doctor audits the permissions of the running system and publishes the report on the bus, for compliance scanners
+func Doctor(dirs []string) (*DoctorReport, error) {
+	bus.Manager.Initialize()
+
+	cfg, err := config.Scan(collector.Directories(dirs...), collector.NoLogs)
+	if err != nil {
+		return nil, err
+	}
+	audit := v1.PermissionsAudit{}
+	if cfg.PermissionsAudit != nil {
+		audit = *cfg.PermissionsAudit
+	}
+	permissions, err := audit.Audit(cfg.Fs, "/", doctorExcludes...)
+	if err != nil {
+		return nil, fmt.Errorf("auditing the permissions: %w", err)
+	}
+	report := &DoctorReport{Permissions: permissions}
+	if data, err := cfg.Fs.ReadFile(constants.PermissionsAuditFile); err == nil {
+		if err = yaml.Unmarshal(data, &report.Deployments); err != nil {
+			cfg.Logger.Warnf("Could not read the deployments permissions audit: %s", err)
+		}
+	}
+
+	report.Media, report.Warnings = flashMedia(cfg)
+
+	if _, err = bus.Manager.Publish(bus.EventPermissionsAudit, permissions); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// flashMedia finds the SD cards and eMMC devices of the system and the warnings about their expected lifetime
+func flashMedia(cfg *config.Config) ([]*v1.FlashMedia, []string) {
+	var media []*v1.FlashMedia
+	var warnings []string
+	disks, err := cfg.Fs.ReadDir("/sys/block")
+	if err != nil {
+		return nil, nil
+	}
+	for _, d := range disks {
+		if m := v1.DetectFlashMedia(cfg.Fs, d.Name()); m != nil {
+			media = append(media, m)
+			warnings = append(warnings, m.Warnings()...)
+		}
+	}
+	return media, warnings
+}
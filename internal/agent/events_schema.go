@@ -0,0 +1,184 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/kairos-io/kairos-agent/v2/internal/bus"
+	"github.com/kairos-io/kairos-agent/v2/pkg/action"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/kairos-io/kairos-agent/v2/pkg/uki"
+	events "github.com/kairos-io/kairos-sdk/bus"
+	"github.com/mudler/go-pluggable"
+	jsonschemago "github.com/swaggest/jsonschema-go"
+)
+
+// EventSchemaVersion is the version of the contract of the event payloads, bumped on any breaking change to them
+const EventSchemaVersion = "events.kairos.io/v1"
+
+// eventContract describes an event the agent publishes. The payload is sent json encoded in the event data.
+type eventContract struct {
+	event       pluggable.EventType
+	description string
+	payload     interface{}
+	// config is the yaml document sent in the config field of the payload, if it's not the cloud config
+	config interface{}
+	// response is the json document expected in the data of the provider responses, if any
+	response interface{}
+}
+
+var eventContracts = []eventContract{
+	{
+		event:       events.EventChallenge,
+		description: "Published before an automatic install to gather how the device should be provisioned. The config is the cloud config found so far",
+		payload:     events.EventPayload{},
+	},
+	{
+		event:       events.EventInstall,
+		description: "Published before an automatic install with the pairing token and the cloud config",
+		payload:     events.InstallPayload{},
+	},
+	{
+		event:       events.EventInteractiveInstall,
+		description: "Published when the interactive installer starts, with an empty config",
+		payload:     events.EventPayload{},
+	},
+	{
+		event:       events.EventBootstrap,
+		description: "Published by the agent on boot to run the initial cluster configuration",
+		payload:     events.BootstrapPayload{},
+	},
+	{
+		event:       events.EventRecovery,
+		description: "Published when booting into recovery, with an empty config",
+		payload:     events.EventPayload{},
+	},
+	{
+		event:       events.EventRecoveryStop,
+		description: "Published when leaving the recovery mode, with an empty config",
+		payload:     events.EventPayload{},
+	},
+	{
+		event:       events.EventBeforeReset,
+		description: "Published before a reset, with an empty config",
+		payload:     events.EventPayload{},
+	},
+	{
+		event:       events.EventAfterReset,
+		description: "Published after a reset, with an empty config",
+		payload:     events.EventPayload{},
+	},
+	{
+		event:       bus.EventResetCompleted,
+		description: "Published after a successful reset with the machine state, so providers can re-enroll the node",
+		payload:     ResetState{},
+	},
+	{
+		event:       events.EventAvailableReleases,
+		description: "Published to ask the providers for the releases to upgrade to, with the request as yaml in the config",
+		payload:     events.EventPayload{},
+		config:      ReleasesRequest{},
+		response:    ReleasesResponse{},
+	},
+	{
+		event:       bus.EventPermissionsAudit,
+		description: "Published by doctor with the permissions audit report of the running system",
+		payload:     v1.PermissionsReport{},
+	},
+	{
+		event:       bus.EventBootDegraded,
+		description: "Published on start with the known degradations found in the current boot",
+		payload:     []action.BootDegradation{},
+	},
+	{
+		event:       bus.EventBootRollback,
+		description: "Published on start when passive was promoted to active after the active entry exhausted its boot tries",
+		payload:     uki.Rollback{},
+	},
+	{
+		event:       bus.EventUpgradeProgress,
+		description: "Published when an upgrade enters a phase and periodically during it, with the bytes pulled so far",
+		payload:     UpgradeProgress{},
+	},
+	{
+		event:       bus.EventUpgradeVerified,
+		description: "Published by upgrade verify when the system booted after an upgrade transaction is the upgraded one",
+		payload:     action.UpgradeVerification{},
+	},
+}
+
+// EventNames returns the events with a published schema, sorted
+func EventNames() []string {
+	names := make([]string, 0, len(eventContracts))
+	for _, c := range eventContracts {
+		names = append(names, string(c.event))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// EventSchema returns the JSON schema of the payloads of all the events the agent publishes, as definitions named
+// after the events, or only the one of the given event. The yaml config of a payload is defined as <event>.config
+// and the data of the provider responses as <event>.response.
+func EventSchema(event string) (string, error) {
+	definitions := map[string]jsonschemago.Schema{}
+	found := false
+	for _, c := range eventContracts {
+		if event != "" && string(c.event) != event {
+			continue
+		}
+		found = true
+		name := string(c.event)
+		payload, err := reflectEventSchema(c.payload, "json", c.description)
+		if err != nil {
+			return "", fmt.Errorf("generating the %s schema: %w", name, err)
+		}
+		definitions[name] = payload
+		if c.config != nil {
+			config, err := reflectEventSchema(c.config, "yaml", fmt.Sprintf("The yaml document in the config of the %s payload", name))
+			if err != nil {
+				return "", fmt.Errorf("generating the %s config schema: %w", name, err)
+			}
+			definitions[name+".config"] = config
+		}
+		if c.response != nil {
+			response, err := reflectEventSchema(c.response, "json", fmt.Sprintf("The json document expected in the data of the %s responses", name))
+			if err != nil {
+				return "", fmt.Errorf("generating the %s response schema: %w", name, err)
+			}
+			definitions[name+".response"] = response
+		}
+	}
+	if !found {
+		return "", fmt.Errorf("unknown event %s, the events with a schema are: %v", event, EventNames())
+	}
+
+	var doc interface{}
+	if event != "" && len(definitions) == 1 {
+		s := definitions[event]
+		doc = s.WithSchema("http://json-schema.org/draft-07/schema#").WithID(EventSchemaVersion + "/" + event).WithTitle(event)
+	} else {
+		doc = map[string]interface{}{
+			"$schema":     "http://json-schema.org/draft-07/schema#",
+			"$id":         EventSchemaVersion,
+			"title":       "Kairos agent events",
+			"description": "The payloads of the events published by the agent, sent json encoded in the data of the events",
+			"definitions": definitions,
+		}
+	}
+	out, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+func reflectEventSchema(v interface{}, tag, description string) (jsonschemago.Schema, error) {
+	reflector := jsonschemago.Reflector{}
+	s, err := reflector.Reflect(v, jsonschemago.InlineRefs, jsonschemago.PropertyNameTag(tag))
+	if err != nil {
+		return s, err
+	}
+	return *s.WithDescription(description), nil
+}
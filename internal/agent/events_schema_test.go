@@ -0,0 +1,38 @@
+package agent_test
+
+import (
+	"encoding/json"
+
+	. "github.com/kairos-io/kairos-agent/v2/internal/agent"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("EventSchema", func() {
+	It("defines the payloads of all the events", func() {
+		out, err := EventSchema("")
+		Expect(err).ToNot(HaveOccurred())
+		doc := map[string]interface{}{}
+		Expect(json.Unmarshal([]byte(out), &doc)).To(Succeed())
+		Expect(doc["$id"]).To(Equal(EventSchemaVersion))
+		definitions := doc["definitions"].(map[string]interface{})
+		for _, e := range EventNames() {
+			Expect(definitions).To(HaveKey(e))
+		}
+		Expect(definitions).To(HaveKey("agent.available_releases.config"))
+		Expect(definitions).To(HaveKey("agent.available_releases.response"))
+	})
+
+	It("prints the schema of a single event", func() {
+		out, err := EventSchema("agent.reset.completed")
+		Expect(err).ToNot(HaveOccurred())
+		doc := map[string]interface{}{}
+		Expect(json.Unmarshal([]byte(out), &doc)).To(Succeed())
+		Expect(doc["$id"]).To(Equal(EventSchemaVersion + "/agent.reset.completed"))
+		Expect(doc["properties"]).To(HaveKey("reset-persistent"))
+
+		_, err = EventSchema("agent.unknown")
+		Expect(err).To(MatchError(ContainSubstring("unknown event agent.unknown")))
+	})
+})
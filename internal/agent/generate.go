@@ -0,0 +1,194 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kairos-io/kairos-agent/v2/internal/i18n"
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-sdk/schema"
+	"gopkg.in/yaml.v3"
+)
+
+// k3s roles of GenerateOptions
+const (
+	K3sRoleServer = "server"
+	K3sRoleAgent  = "agent"
+)
+
+// GenerateOptions are the answers the config generate command builds a cloud config from
+type GenerateOptions struct {
+	User     string
+	Password string
+	SSHKeys  []string
+	Admin    bool
+	// Device is the install device, auto picks the biggest disk. Empty leaves the install block out
+	Device string
+	// Auto installs on boot from the live media without any interaction, rebooting once done
+	Auto bool
+	// K3sRole is server or agent, empty to not run k3s. Agents join the K3sServer url with the K3sToken
+	K3sRole   string
+	K3sServer string
+	K3sToken  string
+	// UpgradeSource is the image the system upgrades from, i.e. oci:quay.io/kairos/ubuntu:24.04-standard-amd64-generic
+	UpgradeSource string
+}
+
+type generatedUser struct {
+	Name              string   `yaml:"name"`
+	Passwd            string   `yaml:"passwd,omitempty"`
+	Groups            []string `yaml:"groups,omitempty"`
+	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys,omitempty"`
+}
+
+type generatedInstall struct {
+	Device string `yaml:"device"`
+	Auto   bool   `yaml:"auto,omitempty"`
+	Reboot bool   `yaml:"reboot,omitempty"`
+}
+
+type generatedK3s struct {
+	Enabled bool              `yaml:"enabled"`
+	Env     map[string]string `yaml:"env,omitempty"`
+}
+
+type generatedUpgrade struct {
+	System struct {
+		URI string `yaml:"uri"`
+	} `yaml:"system"`
+}
+
+type generatedConfig struct {
+	Users    []generatedUser   `yaml:"users"`
+	Install  *generatedInstall `yaml:"install,omitempty"`
+	Upgrade  *generatedUpgrade `yaml:"upgrade,omitempty"`
+	K3s      *generatedK3s     `yaml:"k3s,omitempty"`
+	K3sAgent *generatedK3s     `yaml:"k3s-agent,omitempty"`
+}
+
+// GenerateConfig builds a cloud config out of the options and validates it against the config schema
+func GenerateConfig(o GenerateOptions) (string, error) {
+	if o.User == "" {
+		return "", fmt.Errorf("a user is required, otherwise the system is not accessible via terminal or ssh")
+	}
+	user := generatedUser{Name: o.User, Passwd: o.Password}
+	for _, key := range o.SSHKeys {
+		if key = strings.TrimSpace(key); key != "" {
+			user.SSHAuthorizedKeys = append(user.SSHAuthorizedKeys, key)
+		}
+	}
+	if o.Admin {
+		user.Groups = []string{"admin"}
+	}
+	if user.Passwd == "" && len(user.SSHAuthorizedKeys) == 0 {
+		return "", fmt.Errorf("user %s needs a password or an ssh key to log in", o.User)
+	}
+	gen := generatedConfig{Users: []generatedUser{user}}
+
+	if o.Device != "" {
+		gen.Install = &generatedInstall{Device: o.Device, Auto: o.Auto, Reboot: o.Auto}
+	} else if o.Auto {
+		return "", fmt.Errorf("automatic installs need an install device")
+	}
+	if o.UpgradeSource != "" {
+		gen.Upgrade = &generatedUpgrade{}
+		gen.Upgrade.System.URI = o.UpgradeSource
+	}
+
+	switch o.K3sRole {
+	case "":
+	case K3sRoleServer:
+		gen.K3s = &generatedK3s{Enabled: true}
+		if o.K3sToken != "" {
+			gen.K3s.Env = map[string]string{"K3S_TOKEN": o.K3sToken}
+		}
+	case K3sRoleAgent:
+		if o.K3sServer == "" || o.K3sToken == "" {
+			return "", fmt.Errorf("k3s agents need the server url and token to join")
+		}
+		gen.K3sAgent = &generatedK3s{Enabled: true, Env: map[string]string{"K3S_URL": o.K3sServer, "K3S_TOKEN": o.K3sToken}}
+	default:
+		return "", fmt.Errorf("invalid k3s role %q, expected %s or %s", o.K3sRole, K3sRoleServer, K3sRoleAgent)
+	}
+
+	dat, err := yaml.Marshal(gen)
+	if err != nil {
+		return "", err
+	}
+	cc := config.AddHeader("#cloud-config", string(dat))
+
+	kc, err := schema.NewConfigFromYAML(cc, config.Schema{})
+	if err != nil {
+		return "", err
+	}
+	if !kc.IsValid() {
+		return "", fmt.Errorf("the generated config is not valid: %w", kc.ValidationError)
+	}
+	return cc, nil
+}
+
+// PromptGenerateOptions asks for the config generate options, with the given ones as the defaults
+func PromptGenerateOptions(o *GenerateOptions) error {
+	var err error
+	if o.User, err = prompt(i18n.T("interactive.user"), defaultString(o.User, "kairos"), i18n.T("interactive.not-empty"), false, false); err != nil {
+		return err
+	}
+	if o.Password, err = prompt(i18n.T("interactive.password"), o.Password, i18n.T("interactive.unset"), true, true); err != nil {
+		return err
+	}
+	keys, err := prompt(i18n.T("interactive.ssh"), strings.Join(o.SSHKeys, ","), i18n.T("interactive.unset"), true, false)
+	if err != nil {
+		return err
+	}
+	o.SSHKeys = nil
+	if keys != "" {
+		o.SSHKeys = strings.Split(keys, ",")
+	}
+	admin, err := prompt(i18n.T("interactive.admin"), yesOrNo(o.Admin), i18n.T("interactive.yes-no"), true, false)
+	if err != nil {
+		return err
+	}
+	o.Admin = isYes(admin)
+
+	if o.Device, err = prompt(i18n.T("generate.device"), defaultString(o.Device, "auto"), i18n.T("interactive.unset"), true, false); err != nil {
+		return err
+	}
+	if o.Device != "" {
+		auto, err := prompt(i18n.T("generate.auto"), yesOrNo(o.Auto), i18n.T("interactive.yes-no"), true, false)
+		if err != nil {
+			return err
+		}
+		o.Auto = isYes(auto)
+	}
+
+	if o.K3sRole, err = prompt(i18n.T("generate.k3s-role"), o.K3sRole, i18n.T("interactive.unset"), true, false); err != nil {
+		return err
+	}
+	if o.K3sRole == K3sRoleAgent {
+		if o.K3sServer, err = prompt(i18n.T("generate.k3s-server"), o.K3sServer, i18n.T("interactive.not-empty"), false, false); err != nil {
+			return err
+		}
+	}
+	if o.K3sRole != "" {
+		if o.K3sToken, err = prompt(i18n.T("generate.k3s-token"), o.K3sToken, i18n.T("interactive.unset"), o.K3sRole == K3sRoleServer, true); err != nil {
+			return err
+		}
+	}
+
+	o.UpgradeSource, err = prompt(i18n.T("generate.upgrade-source"), o.UpgradeSource, i18n.T("interactive.unset"), true, false)
+	return err
+}
+
+func defaultString(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+func yesOrNo(b bool) string {
+	if b {
+		return "y"
+	}
+	return "n"
+}
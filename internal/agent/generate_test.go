@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-sdk/schema"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gopkg.in/yaml.v3"
+)
+
+var _ = Describe("GenerateConfig", func() {
+	It("generates a valid config for a k3s server", func() {
+		cc, err := GenerateConfig(GenerateOptions{
+			User:          "kairos",
+			SSHKeys:       []string{"github:someuser", " "},
+			Admin:         true,
+			Device:        "auto",
+			Auto:          true,
+			K3sRole:       K3sRoleServer,
+			UpgradeSource: "oci:quay.io/kairos/ubuntu:24.04",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cc).To(HavePrefix("#cloud-config\n"))
+		Expect(schema.Validate(cc)).To(Succeed())
+
+		values := map[string]interface{}{}
+		Expect(yaml.Unmarshal([]byte(cc), &values)).To(Succeed())
+		Expect(values["users"]).To(Equal([]interface{}{map[string]interface{}{
+			"name":                "kairos",
+			"groups":              []interface{}{"admin"},
+			"ssh_authorized_keys": []interface{}{"github:someuser"},
+		}}))
+		Expect(values["install"]).To(Equal(map[string]interface{}{"device": "auto", "auto": true, "reboot": true}))
+		Expect(values["k3s"]).To(Equal(map[string]interface{}{"enabled": true}))
+		Expect(values).ToNot(HaveKey("k3s-agent"))
+
+		c := &config.Config{}
+		Expect(yaml.Unmarshal([]byte(cc), c)).To(Succeed())
+		Expect(c.Install.Device).To(Equal("auto"))
+	})
+
+	It("joins k3s agents to the server", func() {
+		cc, err := GenerateConfig(GenerateOptions{User: "kairos", Password: "kairos", K3sRole: K3sRoleAgent, K3sServer: "https://10.0.0.1:6443", K3sToken: "secret"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cc).To(ContainSubstring("k3s-agent:\n    enabled: true\n    env:\n        K3S_TOKEN: secret\n        K3S_URL: https://10.0.0.1:6443\n"))
+		Expect(cc).ToNot(ContainSubstring("install:"))
+
+		_, err = GenerateConfig(GenerateOptions{User: "kairos", Password: "kairos", K3sRole: K3sRoleAgent})
+		Expect(err).To(MatchError(ContainSubstring("server url and token")))
+	})
+
+	It("refuses configs the system can't be used with", func() {
+		_, err := GenerateConfig(GenerateOptions{Password: "kairos"})
+		Expect(err).To(MatchError(ContainSubstring("a user is required")))
+		_, err = GenerateConfig(GenerateOptions{User: "kairos"})
+		Expect(err).To(MatchError(ContainSubstring("needs a password or an ssh key")))
+		_, err = GenerateConfig(GenerateOptions{User: "kairos", Password: "kairos", Auto: true})
+		Expect(err).To(MatchError(ContainSubstring("need an install device")))
+		_, err = GenerateConfig(GenerateOptions{User: "kairos", Password: "kairos", K3sRole: "worker"})
+		Expect(err).To(MatchError(ContainSubstring("invalid k3s role")))
+	})
+
+	It("validates the config against the schema", func() {
+		_, err := GenerateConfig(GenerateOptions{User: "kairos", Password: "kairos", Device: "sda"})
+		Expect(err).To(MatchError(ContainSubstring("not valid")))
+	})
+})
@@ -0,0 +1,264 @@
+package agent
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/action"
+	config "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-sdk/state"
+	"github.com/kairos-io/kairos-sdk/utils"
+)
+
+const (
+	// HeartbeatSignatureHeader holds the base64 encoded signature of the status document
+	HeartbeatSignatureHeader = "X-Kairos-Signature"
+
+	defaultHeartbeatInterval = 5 * time.Minute
+	heartbeatMinBackoff      = 10 * time.Second
+	heartbeatTimeout         = 30 * time.Second
+)
+
+// HeartbeatStatus is the status document reported to the fleet backend
+type HeartbeatStatus struct {
+	Time      time.Time `json:"time"`
+	Hostname  string    `json:"hostname"`
+	MachineID string    `json:"machine-id,omitempty"`
+	Version   string    `json:"version,omitempty"`
+	// Boot is the entry the node booted from: active, passive, recovery...
+	Boot string `json:"boot"`
+	// Upgrade is the result of the checks of the last upgrade, if any
+	Upgrade *HeartbeatUpgrade `json:"upgrade,omitempty"`
+	// Health is the overall systemd state: running, degraded...
+	Health string `json:"health"`
+}
+
+// HeartbeatUpgrade is the status of the last upgrade, from its smoke tests
+type HeartbeatUpgrade struct {
+	Status    string     `json:"status"`
+	Scheduled time.Time  `json:"scheduled"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// Heartbeat periodically POSTs the node status to the configured fleet backend
+type Heartbeat struct {
+	cfg       *config.Config
+	heartbeat config.Heartbeat
+	// reloader is the reloader of the running config, if the heartbeat follows it
+	reloader *ConfigReloader
+	Client   *http.Client
+	// Status collects the status document, by default from the running system
+	Status func() HeartbeatStatus
+	// MinBackoff is the first retry delay after a failed report, it doubles up to the interval
+	MinBackoff time.Duration
+}
+
+// NewHeartbeat returns a Heartbeat for the heartbeat in the config
+func NewHeartbeat(c *config.Config) *Heartbeat {
+	h := &Heartbeat{cfg: c, Client: &http.Client{Timeout: heartbeatTimeout, Transport: c.HTTPTransport()}, MinBackoff: heartbeatMinBackoff}
+	h.heartbeat = heartbeatSettings(c)
+	h.Status = h.systemStatus
+	return h
+}
+
+// heartbeatSettings returns the heartbeat in the config, with the default interval if unset
+func heartbeatSettings(c *config.Config) config.Heartbeat {
+	var heartbeat config.Heartbeat
+	if c.Heartbeat != nil {
+		heartbeat = *c.Heartbeat
+	}
+	if heartbeat.Interval == 0 {
+		heartbeat.Interval = defaultHeartbeatInterval
+	}
+	return heartbeat
+}
+
+// Follow makes the heartbeat report with the reloads of the running config, from the next report on
+func (h *Heartbeat) Follow(r *ConfigReloader) *Heartbeat {
+	h.reloader = r
+	return h
+}
+
+// running returns the running config, reloaded if the heartbeat follows a reloader
+func (h *Heartbeat) running() *config.Config {
+	if h.reloader != nil {
+		return h.reloader.Config()
+	}
+	return h.cfg
+}
+
+// reload picks up the heartbeat of the reloaded config, returning whether it changed
+func (h *Heartbeat) reload() bool {
+	c := h.running()
+	if c.Heartbeat == nil {
+		return false
+	}
+	heartbeat := heartbeatSettings(c)
+	if heartbeat == h.heartbeat {
+		return false
+	}
+	h.heartbeat = heartbeat
+	return true
+}
+
+// Run reports the status until stop is closed. It only returns early if the heartbeat is misconfigured.
+func (h *Heartbeat) Run(stop <-chan struct{}) error {
+	if h.heartbeat.URL == "" {
+		return fmt.Errorf("heartbeat needs an url")
+	}
+	signer, err := h.signer()
+	if err != nil {
+		return err
+	}
+
+	var backoff time.Duration
+	for {
+		if h.reload() {
+			if s, err := h.signer(); err != nil {
+				h.running().Logger.Warnf("Keeping the previous heartbeat signing key: %s", err)
+			} else {
+				signer = s
+			}
+		}
+		wait := h.heartbeat.Interval
+		if err := h.send(signer); err != nil {
+			backoff = h.nextBackoff(backoff)
+			wait = backoff
+			h.running().Logger.Warnf("Heartbeat to %s failed, retrying in %s: %s", h.heartbeat.URL, wait, err)
+		} else {
+			backoff = 0
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (h *Heartbeat) nextBackoff(backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		backoff = h.MinBackoff
+	} else {
+		backoff *= 2
+	}
+	if backoff > h.heartbeat.Interval {
+		backoff = h.heartbeat.Interval
+	}
+	return backoff
+}
+
+// send POSTs the current status document, signed if there is a signer
+func (h *Heartbeat) send(signer crypto.Signer) error {
+	body, err := json.Marshal(h.Status())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, h.heartbeat.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.heartbeat.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.heartbeat.Token)
+	}
+	if signer != nil {
+		sig, err := signStatus(signer, body)
+		if err != nil {
+			return fmt.Errorf("signing the status: %w", err)
+		}
+		req.Header.Set(HeartbeatSignatureHeader, base64.StdEncoding.EncodeToString(sig))
+	}
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// signer loads the private key the status document is signed with, if any
+func (h *Heartbeat) signer() (crypto.Signer, error) {
+	if h.heartbeat.SigningKey == "" {
+		return nil, nil
+	}
+	data, err := h.running().Fs.ReadFile(h.heartbeat.SigningKey)
+	if err != nil {
+		return nil, fmt.Errorf("reading the heartbeat signing key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", h.heartbeat.SigningKey)
+	}
+	var key interface{}
+	if key, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+		if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing the heartbeat signing key %s: %w", h.heartbeat.SigningKey, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported heartbeat signing key type %T", key)
+	}
+	return signer, nil
+}
+
+// signStatus signs the status document. ECDSA and RSA keys sign its sha256 digest, as `cosign sign-blob` does.
+func signStatus(signer crypto.Signer, body []byte) ([]byte, error) {
+	switch signer.(type) {
+	case ed25519.PrivateKey:
+		return signer.Sign(rand.Reader, body, crypto.Hash(0))
+	case *ecdsa.PrivateKey, *rsa.PrivateKey:
+		digest := sha256.Sum256(body)
+		return signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", signer)
+	}
+}
+
+// systemStatus collects the status of the running system
+func (h *Heartbeat) systemStatus() HeartbeatStatus {
+	status := HeartbeatStatus{Time: time.Now().UTC()}
+	status.Hostname, _ = os.Hostname()
+	if id, err := h.running().Fs.ReadFile("/etc/machine-id"); err == nil {
+		status.MachineID = strings.TrimSpace(string(id))
+	}
+	status.Version, _ = utils.OSRelease("VERSION")
+	if boot, err := state.DetectBootWithVFS(h.running().Fs); err == nil {
+		status.Boot = string(boot)
+	}
+	if run, err := action.ReadSmokeTests(h.running().Fs); err == nil && run != nil {
+		status.Upgrade = &HeartbeatUpgrade{Status: run.Status, Scheduled: run.Scheduled, Finished: run.Finished, Error: run.Error}
+	}
+	// is-system-running exits non zero unless the system is running, the state is printed anyway
+	out, _ := h.running().Runner.Run("systemctl", "is-system-running")
+	status.Health = strings.TrimSpace(string(out))
+	if status.Health == "" {
+		status.Health = "unknown"
+	}
+	return status
+}
@@ -0,0 +1,124 @@
+package agent_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/kairos-io/kairos-agent/v2/internal/agent"
+	config "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-sdk/collector"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Heartbeat", func() {
+	var server *httptest.Server
+	var mu sync.Mutex
+	var bodies [][]byte
+	var headers []http.Header
+	var failures int
+	var pub ed25519.PublicKey
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		bodies, headers, failures = nil, nil, 0
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			body, _ := io.ReadAll(r.Body)
+			bodies = append(bodies, body)
+			headers = append(headers, r.Header)
+			if failures > 0 {
+				failures--
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		dir, err = os.MkdirTemp("", "heartbeat")
+		Expect(err).ToNot(HaveOccurred())
+		var priv ed25519.PrivateKey
+		pub, priv, err = ed25519.GenerateKey(nil)
+		Expect(err).ToNot(HaveOccurred())
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	newHeartbeat := func(interval string) *Heartbeat {
+		c, err := config.ScanNoLogs(collector.Readers(strings.NewReader(fmt.Sprintf(`#cloud-config
+heartbeat:
+  url: %s/status
+  interval: %s
+  signing-key: %s
+  token: secret
+`, server.URL, interval, filepath.Join(dir, "key.pem")))))
+		Expect(err).ToNot(HaveOccurred())
+		h := NewHeartbeat(c)
+		h.Status = func() HeartbeatStatus {
+			return HeartbeatStatus{Hostname: "node1", Version: "v3.2.1", Boot: "active_boot", Health: "running"}
+		}
+		h.MinBackoff = 10 * time.Millisecond
+		return h
+	}
+
+	It("posts the signed status document", func() {
+		stop := make(chan struct{})
+		done := make(chan error, 1)
+		go func() { done <- newHeartbeat("1h").Run(stop) }()
+		Eventually(func() int { mu.Lock(); defer mu.Unlock(); return len(bodies) }).Should(Equal(1))
+		close(stop)
+		Eventually(done).Should(Receive(BeNil()))
+
+		mu.Lock()
+		defer mu.Unlock()
+		status := HeartbeatStatus{}
+		Expect(json.Unmarshal(bodies[0], &status)).To(Succeed())
+		Expect(status.Hostname).To(Equal("node1"))
+		Expect(status.Health).To(Equal("running"))
+		Expect(headers[0].Get("Authorization")).To(Equal("Bearer secret"))
+		sig, err := base64.StdEncoding.DecodeString(headers[0].Get(HeartbeatSignatureHeader))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ed25519.Verify(pub, bodies[0], sig)).To(BeTrue())
+		Expect(ed25519.Verify(pub, bytes.Replace(bodies[0], []byte("node1"), []byte("node2"), 1), sig)).To(BeFalse())
+	})
+
+	It("retries failed reports with backoff before the next interval", func() {
+		mu.Lock()
+		failures = 2
+		mu.Unlock()
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() { _ = newHeartbeat("1h").Run(stop) }()
+		// Two failures retried after 10ms and 20ms, then it waits for the interval
+		Eventually(func() int { mu.Lock(); defer mu.Unlock(); return len(bodies) }).Should(Equal(3))
+		Consistently(func() int { mu.Lock(); defer mu.Unlock(); return len(bodies) }, 200*time.Millisecond).Should(Equal(3))
+	})
+
+	It("fails without an url or with an invalid signing key", func() {
+		c, err := config.ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\nheartbeat:\n  interval: 1m\n")))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(NewHeartbeat(c).Run(make(chan struct{}))).To(MatchError(ContainSubstring("needs an url")))
+
+		Expect(os.WriteFile(filepath.Join(dir, "key.pem"), []byte("not a key"), 0600)).To(Succeed())
+		Expect(newHeartbeat("1m").Run(make(chan struct{}))).To(MatchError(ContainSubstring("no PEM data")))
+	})
+})
@@ -0,0 +1,41 @@
+package hook
+
+import (
+	"path/filepath"
+
+	config "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	"github.com/kairos-io/kairos-sdk/machine"
+	"gopkg.in/yaml.v3"
+)
+
+// AcceleratorDecisions records on the OEM partition the driver bundles installed, or not, for the GPUs and
+// accelerators detected on install
+type AcceleratorDecisions struct{}
+
+func (a AcceleratorDecisions) Run(c config.Config, _ v1.Spec) error {
+	if c.Install == nil || c.Install.Accelerators == nil || len(c.Install.Accelerators.Decisions) == 0 {
+		return nil
+	}
+	c.Logger.Logger.Debug().Msg("Running AcceleratorDecisions hook")
+
+	machine.Mount("COS_OEM", "/oem") //nolint:errcheck
+	defer func() {
+		machine.Umount("/oem") //nolint:errcheck
+	}()
+
+	data, err := yaml.Marshal(c.Install.Accelerators.Decisions)
+	if err == nil {
+		err = fsutils.MkdirAll(c.Fs, filepath.Dir(constants.AcceleratorsFile), constants.DirPerm)
+	}
+	if err == nil {
+		err = fsutils.AtomicWriteFile(c.Fs, constants.AcceleratorsFile, data, constants.ConfigPerm)
+	}
+	// The bundles are installed already, a missing record does not fail the install
+	if err != nil {
+		c.Logger.Warnf("could not record the accelerator driver bundles: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package hook
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	config "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	"github.com/kairos-io/kairos-agent/v2/pkg/partitioner"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	yip "github.com/mudler/yip/pkg/schema"
+	"gopkg.in/yaml.v3"
+)
+
+// DataDisk formats, if it has no filesystem nor partition table yet, and mounts the data disk set in storage.data_disk. The mount
+// unit is written to a cloud config in the OEM partition, so the disk is mounted on every boot by systemd.
+// Running it again keeps the disk data and only refreshes the mount.
+type DataDisk struct{}
+
+func (d DataDisk) Run(c config.Config, _ v1.Spec) error {
+	if c.Storage == nil || c.Storage.DataDisk == nil || c.Storage.DataDisk.Device == "" {
+		return nil
+	}
+	c.Logger.Logger.Debug().Msg("Running DataDisk hook")
+	if err := d.Setup(c, *c.Storage.DataDisk); err != nil {
+		c.Logger.Warnf("could not set up the data disk %s: %s", c.Storage.DataDisk.Device, err)
+	}
+	c.Logger.Logger.Debug().Msg("Finish DataDisk hook")
+	return nil
+}
+
+// Setup formats the disk if needed, mounts it and saves the cloud config mounting it on boot
+func (d DataDisk) Setup(c config.Config, disk config.DataDisk) error {
+	disk = dataDiskDefaults(disk)
+	if _, err := c.Fs.Stat(disk.Device); err != nil {
+		return fmt.Errorf("device not found: %w", err)
+	}
+
+	signatures, err := probeSignatures(c, disk.Device)
+	if err != nil {
+		return fmt.Errorf("probing the disk: %w", err)
+	}
+	if pt := signatures["PTTYPE"]; pt != "" {
+		return fmt.Errorf("the disk has a %s partition table, refusing to format it", pt)
+	}
+	fs := signatures["TYPE"]
+	if fs == "" {
+		if len(signatures) > 0 {
+			return fmt.Errorf("the disk has unknown signatures %v, refusing to format it", signatures)
+		}
+		c.Logger.Infof("Formatting the data disk %s as %s", disk.Device, disk.FS)
+		if err = partitioner.FormatDevice(c.Runner, disk.Device, disk.FS, disk.Label); err != nil {
+			return fmt.Errorf("formatting: %w", err)
+		}
+		fs = disk.FS
+	} else if fs != disk.FS {
+		c.Logger.Warnf("The data disk %s already has a %s filesystem, keeping it and its data", disk.Device, fs)
+	}
+	disk.FS = fs
+
+	// Probe the device directly, the udev database might not know about a just created filesystem yet
+	out, err := c.Runner.Run("blkid", "-p", "-s", "UUID", "-o", "value", disk.Device)
+	uuid := strings.TrimSpace(string(out))
+	if err != nil || uuid == "" {
+		return fmt.Errorf("reading the filesystem UUID: %v", err)
+	}
+
+	if err = fsutils.MkdirAll(c.Fs, disk.MountPoint, constants.DirPerm); err != nil {
+		return err
+	}
+	if notMnt, _ := c.Mounter.IsLikelyNotMountPoint(disk.MountPoint); notMnt {
+		if err = c.Mounter.Mount(disk.Device, disk.MountPoint, disk.FS, disk.Options); err != nil {
+			return fmt.Errorf("mounting: %w", err)
+		}
+	}
+
+	yc, err := yaml.Marshal(d.Config(disk, uuid))
+	if err != nil {
+		return err
+	}
+	return fsutils.AtomicWriteFile(c.Fs, filepath.Join(constants.OEMPath, "10_data_disk.yaml"), yc, 0400)
+}
+
+// Config returns the cloud config that mounts the disk with the given filesystem UUID on boot
+func (d DataDisk) Config(disk config.DataDisk, uuid string) yip.YipConfig {
+	disk = dataDiskDefaults(disk)
+	// A missing disk must not keep the system from booting
+	options := append([]string{"nofail"}, disk.Options...)
+	unit := mountUnitName(disk.MountPoint)
+	content := fmt.Sprintf(`[Unit]
+Description=Kairos data disk
+Before=local-fs.target
+
+[Mount]
+What=/dev/disk/by-uuid/%s
+Where=%s
+Type=%s
+Options=%s
+
+[Install]
+WantedBy=local-fs.target
+`, uuid, disk.MountPoint, disk.FS, strings.Join(options, ","))
+
+	stage := yip.Stage{
+		Name: "data_disk",
+		Files: []yip.File{{
+			Path:        filepath.Join("/etc/systemd/system", unit),
+			Permissions: 0644,
+			Content:     content,
+		}},
+	}
+	stage.Systemctl.Enable = []string{unit}
+	return yip.YipConfig{Stages: map[string][]yip.Stage{"initramfs": {stage}}}
+}
+
+// probeSignatures returns the signatures blkid finds on the device itself, such as the TYPE of a filesystem or
+// the PTTYPE of a partition table. The device is probed directly as at first boot udev might not know it yet.
+func probeSignatures(c config.Config, device string) (map[string]string, error) {
+	signatures := map[string]string{}
+	out, err := c.Runner.Run("blkid", "-p", "-o", "export", device)
+	// blkid exits with 2 when there is nothing on the device
+	if isExitCode(err, 2) {
+		return signatures, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || key == "DEVNAME" {
+			continue
+		}
+		signatures[key] = value
+	}
+	return signatures, nil
+}
+
+// isExitCode returns whether err is a command exiting with the given code
+func isExitCode(err error, code int) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && exitErr.ExitCode() == code
+}
+
+func dataDiskDefaults(disk config.DataDisk) config.DataDisk {
+	if disk.MountPoint == "" {
+		disk.MountPoint = constants.DataDiskMountPoint
+	}
+	if disk.FS == "" {
+		disk.FS = constants.LinuxFs
+	}
+	if disk.Label == "" {
+		disk.Label = constants.DataDiskLabel
+	}
+	return disk
+}
+
+// mountUnitName returns the name of the systemd mount unit for the path, escaped as systemd-escape --path does
+func mountUnitName(path string) string {
+	path = strings.Trim(filepath.Clean(path), "/")
+	if path == "" {
+		return "-.mount"
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		ch := path[i]
+		switch {
+		case ch == '/':
+			b.WriteByte('-')
+		case ch == '.' && i == 0,
+			!(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == ':' || ch == '_' || ch == '.'):
+			fmt.Fprintf(&b, `\x%02x`, ch)
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	return b.String() + ".mount"
+}
@@ -12,7 +12,10 @@ type Interface interface {
 var AfterInstall = []Interface{
 	&GrubOptions{}, // Set custom GRUB options
 	&BundlePostInstall{},
+	&AcceleratorDecisions{}, // Record the driver bundles installed for the accelerators
 	&CustomMounts{},
+	&NetworkDisk{},        // Keep the network disk attached and its mounts safe on shutdown
+	&NetworkReservation{}, // Persist the leased address and hostname if requested
 	&CopyLogs{},
 	&Lifecycle{}, // Handles poweroff/reboot by config options
 }
@@ -29,6 +32,7 @@ var AfterUpgrade = []Interface{
 var FirstBoot = []Interface{
 	&BundleFirstBoot{},
 	&GrubPostInstallOptions{},
+	&DataDisk{}, // Format and mount the storage data disk, if set
 }
 
 // AfterUkiInstall sets which Hooks to run after uki runs the install action
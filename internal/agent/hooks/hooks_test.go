@@ -4,6 +4,7 @@ import (
 	"bytes"
 	ghwMock "github.com/kairos-io/kairos-sdk/ghw/mocks"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"testing"
 
@@ -11,6 +12,8 @@ import (
 	hook "github.com/kairos-io/kairos-agent/v2/internal/agent/hooks"
 	"github.com/kairos-io/kairos-agent/v2/pkg/config"
 	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils"
 	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
 	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
 	"github.com/kairos-io/kairos-sdk/collector"
@@ -115,6 +118,11 @@ var _ = Describe("Hooks", func() {
 			Expect(err).Should(BeNil())
 			_, err = fs.Stat(filepath.Join(cnst.EfiDir, "EFI/kairos/active.efi.extra.d/", "test2.sysext.raw"))
 			Expect(err).Should(BeNil())
+			// and their origin recorded
+			origins, err := utils.ReadSysextMetadata(fs, filepath.Join(cnst.EfiDir, "EFI/kairos/passive.efi.extra.d/"))
+			Expect(err).Should(BeNil())
+			Expect(origins).To(HaveKey("test1.sysext.raw"))
+			Expect(origins["test1.sysext.raw"].Source).To(Equal("file://" + filepath.Join(cnst.LiveDir, "test1.sysext.raw")))
 		})
 		It("should ignore files without .sysext.raw extension", func() {
 			err = fsutils.MkdirAll(fs, cnst.LiveDir, os.ModeDir|os.ModePerm)
@@ -187,4 +195,147 @@ var _ = Describe("Hooks", func() {
 		})
 
 	})
+	Context("NetworkReservation", func() {
+		BeforeEach(func() {
+			memLog = &bytes.Buffer{}
+			logger = sdkTypes.NewBufferLogger(memLog)
+			fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{
+				"/proc/net/route": "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\n" +
+					"lo\t00000000\t0100A8C0\t0003\t0\t0\t100\t00000000\n",
+				"/proc/sys/kernel/hostname": "kiosk-1\n",
+				"/etc/resolv.conf":          "search lan\nnameserver 192.168.0.53\n",
+			})
+			Expect(err).Should(BeNil())
+			cfg = config.NewConfig(config.WithFs(fs), config.WithLogger(logger))
+		})
+		AfterEach(func() {
+			cleanup()
+		})
+		It("generates the static config for the default route interface", func() {
+			yc, err := hook.NetworkReservation{}.Config(*cfg)
+			Expect(err).Should(BeNil())
+			stage := yc.Stages["initramfs"][0]
+			Expect(stage.Hostname).To(Equal("kiosk-1"))
+			Expect(stage.Files).To(HaveLen(1))
+			Expect(stage.Files[0].Path).To(Equal("/etc/systemd/network/10-kairos-lo.network"))
+			Expect(stage.Files[0].Content).To(ContainSubstring("Name=lo"))
+			Expect(stage.Files[0].Content).To(ContainSubstring("Address=127.0.0.1/8"))
+			Expect(stage.Files[0].Content).To(ContainSubstring("Gateway=192.168.0.1"))
+			Expect(stage.Files[0].Content).To(ContainSubstring("DNS=192.168.0.53"))
+		})
+		It("uses the upstream nameservers instead of the systemd-resolved stub", func() {
+			Expect(fs.WriteFile("/etc/resolv.conf", []byte("nameserver 127.0.0.53\noptions edns0\n"), os.ModePerm)).To(Succeed())
+			yc, err := hook.NetworkReservation{}.Config(*cfg)
+			Expect(err).Should(BeNil())
+			Expect(yc.Stages["initramfs"][0].Files[0].Content).ToNot(ContainSubstring("DNS="))
+
+			Expect(fsutils.MkdirAll(fs, "/run/systemd/resolve", os.ModePerm)).To(Succeed())
+			Expect(fs.WriteFile("/run/systemd/resolve/resolv.conf", []byte("nameserver 192.168.0.53\nnameserver ::1\n"), os.ModePerm)).To(Succeed())
+			yc, err = hook.NetworkReservation{}.Config(*cfg)
+			Expect(err).Should(BeNil())
+			content := yc.Stages["initramfs"][0].Files[0].Content
+			Expect(content).To(ContainSubstring("DNS=192.168.0.53"))
+			Expect(content).ToNot(ContainSubstring("127.0.0.53"))
+			Expect(content).ToNot(ContainSubstring("::1"))
+		})
+		It("fails without a default route", func() {
+			Expect(fs.WriteFile("/proc/net/route", []byte("Iface\tDestination\tGateway\n"), os.ModePerm)).To(Succeed())
+			_, err := hook.NetworkReservation{}.Config(*cfg)
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+	Context("NetworkDisk", func() {
+		It("keeps the network disk mounts safe on shutdown", func() {
+			yc := hook.NetworkDisk{}.Config(&v1.NetworkDisk{Protocol: cnst.NetworkDiskISCSI})
+			stage := yc.Stages["initramfs"][0]
+			Expect(stage.Commands).To(HaveLen(1))
+			Expect(stage.Commands[0]).To(ContainSubstring("_netdev"))
+			Expect(stage.Systemctl.Enable).To(Equal([]string{"iscsid"}))
+
+			yc = hook.NetworkDisk{}.Config(&v1.NetworkDisk{Protocol: cnst.NetworkDiskNVMeoF})
+			Expect(yc.Stages["initramfs"][0].Systemctl.Enable).To(BeEmpty())
+		})
+	})
+	Context("DataDisk", func() {
+		BeforeEach(func() {
+			memLog = &bytes.Buffer{}
+			logger = sdkTypes.NewBufferLogger(memLog)
+			fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{"/dev/vdb": "", "/oem": ""})
+			Expect(err).Should(BeNil())
+			Expect(fs.RemoveAll("/oem")).To(Succeed())
+			Expect(fsutils.MkdirAll(fs, "/oem", cnst.DirPerm)).To(Succeed())
+			runner = v1mock.NewFakeRunner()
+			mounter = v1mock.NewErrorMounter()
+			cfg = config.NewConfig(config.WithFs(fs), config.WithLogger(logger), config.WithRunner(runner), config.WithMounter(mounter))
+			cfg.Storage = &config.Storage{DataDisk: &config.DataDisk{Device: "/dev/vdb", MountPoint: "/var/lib/my-data"}}
+		})
+		AfterEach(func() {
+			cleanup()
+		})
+		It("formats an empty disk and mounts it on boot", func() {
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "blkid" && args[2] == "export" {
+					// blkid exits with 2 when it finds nothing
+					return []byte{}, exec.Command("sh", "-c", "exit 2").Run()
+				}
+				if cmd == "blkid" {
+					return []byte("1234-abcd\n"), nil
+				}
+				return []byte{}, nil
+			}
+			Expect(hook.DataDisk{}.Run(*cfg, nil)).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"mkfs.ext4", "-L", "KAIROS_DATA", "/dev/vdb"}})).To(Succeed())
+			mounted, _ := mounter.List()
+			Expect(mounted).To(HaveLen(1))
+			Expect(mounted[0].Path).To(Equal("/var/lib/my-data"))
+
+			data, err := fs.ReadFile("/oem/10_data_disk.yaml")
+			Expect(err).Should(BeNil())
+			Expect(string(data)).To(ContainSubstring("/etc/systemd/system/var-lib-my\\x2ddata.mount"))
+			Expect(string(data)).To(ContainSubstring("What=/dev/disk/by-uuid/1234-abcd"))
+			Expect(string(data)).To(ContainSubstring("Options=nofail"))
+		})
+		It("keeps an existing filesystem", func() {
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "blkid" && args[2] == "export" {
+					return []byte("DEVNAME=/dev/vdb\nUUID=1234-abcd\nTYPE=xfs\n"), nil
+				}
+				if cmd == "blkid" {
+					return []byte("1234-abcd\n"), nil
+				}
+				return []byte{}, nil
+			}
+			Expect(hook.DataDisk{}.Run(*cfg, nil)).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"mkfs.ext4"}})).NotTo(Succeed())
+			data, err := fs.ReadFile("/oem/10_data_disk.yaml")
+			Expect(err).Should(BeNil())
+			Expect(string(data)).To(ContainSubstring("Type=xfs"))
+		})
+		It("does not format a partitioned disk", func() {
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "blkid" && args[2] == "export" {
+					return []byte("DEVNAME=/dev/vdb\nPTUUID=0a1b2c3d\nPTTYPE=gpt\n"), nil
+				}
+				// The whole disk has no filesystem
+				return []byte{}, nil
+			}
+			Expect(hook.DataDisk{}.Run(*cfg, nil)).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"mkfs.ext4"}})).NotTo(Succeed())
+			Expect(memLog.String()).To(ContainSubstring("gpt partition table, refusing to format it"))
+			mounted, _ := mounter.List()
+			Expect(mounted).To(BeEmpty())
+			_, err := fs.Stat("/oem/10_data_disk.yaml")
+			Expect(err).To(HaveOccurred())
+		})
+		It("does not format a disk it cannot probe", func() {
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "blkid" && args[2] == "export" {
+					return []byte{}, exec.Command("sh", "-c", "exit 4").Run()
+				}
+				return []byte{}, nil
+			}
+			Expect(hook.DataDisk{}.Run(*cfg, nil)).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"mkfs.ext4"}})).NotTo(Succeed())
+		})
+	})
 })
@@ -72,13 +72,13 @@ func (k KcryptUKI) Run(c config.Config, spec v1.Spec) error {
 	if err != nil {
 		return err
 	}
-	tmpDir, err := fsutils.TempDir(c.Fs, "", "oem-backup-xxxx")
+	tmpDir, err := fsutils.NamespacedTempDir(c.Fs, "", "oem-backup", 0)
 	if err != nil {
 		return err
 	}
 
 	// Remove everything when we finish
-	defer c.Fs.RemoveAll(tmpDir) //nolint:errcheck
+	defer fsutils.RemoveTempDir(c.Fs, tmpDir) //nolint:errcheck
 
 	err = internalutils.SyncData(c.Logger, c.Runner, c.Fs, constants.OEMDir, tmpDir, []string{}...)
 	if err != nil {
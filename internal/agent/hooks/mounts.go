@@ -3,14 +3,16 @@ package hook
 import (
 	"fmt"
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
-	"os"
 	"path/filepath"
 	"strings"
 
 	config "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
 	"github.com/kairos-io/kairos-sdk/machine"
 	"github.com/mudler/yip/pkg/schema"
 	yip "github.com/mudler/yip/pkg/schema"
+	"github.com/twpayne/go-vfs/v5"
 	"gopkg.in/yaml.v3"
 )
 
@@ -21,10 +23,11 @@ func saveCloudConfig(name config.Stage, yc yip.YipConfig) error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(filepath.Join("/oem", fmt.Sprintf("10_%s.yaml", name)), yipYAML, 0400)
+	return fsutils.AtomicWriteFile(vfs.OSFS, filepath.Join("/oem", fmt.Sprintf("10_%s.yaml", name)), yipYAML, 0400)
 }
 
-// Read the keys sections ephemeral_mounts and bind mounts from install key in the cloud config.
+// Read the keys sections ephemeral_mounts and bind mounts from install key in the cloud config, along with the
+// persistence classes of storage.var_lib.
 // If not empty write an environment file to /run/cos/custom-layout.env.
 // That env file is in turn read by /overlay/files/system/oem/11_persistency.yaml in fs.after stage.
 func (cm CustomMounts) Run(c config.Config, _ v1.Spec) error {
@@ -33,7 +36,19 @@ func (cm CustomMounts) Run(c config.Config, _ v1.Spec) error {
 	//fmt.Println(strings.Join(c.Install.BindMounts, " "))
 	//fmt.Println(strings.Join(c.Install.EphemeralMounts, " "))
 
-	if len(c.Install.BindMounts) == 0 && len(c.Install.EphemeralMounts) == 0 {
+	bindMounts, ephemeralMounts := c.Install.BindMounts, c.Install.EphemeralMounts
+	var varLib *config.VarLib
+	if c.Storage != nil && c.Storage.VarLib != nil {
+		persistent, ephemeral, err := c.Storage.VarLib.Mounts()
+		if err != nil {
+			return fmt.Errorf("storage var_lib: %w", err)
+		}
+		bindMounts = appendMissing(bindMounts, persistent...)
+		ephemeralMounts = appendMissing(ephemeralMounts, ephemeral...)
+		varLib = &config.VarLib{Persistent: persistent, Ephemeral: ephemeral}
+	}
+
+	if len(bindMounts) == 0 && len(ephemeralMounts) == 0 {
 		return nil
 	}
 	c.Logger.Logger.Debug().Msg("Running CustomMounts hook")
@@ -45,8 +60,8 @@ func (cm CustomMounts) Run(c config.Config, _ v1.Spec) error {
 
 	var mountsList = map[string]string{}
 
-	mountsList["CUSTOM_BIND_MOUNTS"] = strings.Join(c.Install.BindMounts, " ")
-	mountsList["CUSTOM_EPHEMERAL_MOUNTS"] = strings.Join(c.Install.EphemeralMounts, " ")
+	mountsList["CUSTOM_BIND_MOUNTS"] = strings.Join(bindMounts, " ")
+	mountsList["CUSTOM_EPHEMERAL_MOUNTS"] = strings.Join(ephemeralMounts, " ")
 
 	config := yip.YipConfig{Stages: map[string][]schema.Stage{
 		"rootfs": []yip.Stage{{
@@ -57,6 +72,35 @@ func (cm CustomMounts) Run(c config.Config, _ v1.Spec) error {
 	}}
 
 	saveCloudConfig("user_custom_mounts", config) //nolint:errcheck
+
+	// Record the classes, the state command reports them along with how they are mounted
+	if varLib != nil {
+		if data, err := yaml.Marshal(varLib); err == nil {
+			if err = fsutils.MkdirAll(vfs.OSFS, filepath.Dir(constants.VarLibFile), constants.DirPerm); err == nil {
+				err = fsutils.AtomicWriteFile(vfs.OSFS, constants.VarLibFile, data, constants.ConfigPerm)
+			}
+			if err != nil {
+				c.Logger.Warnf("could not record the /var/lib persistence classes: %s", err)
+			}
+		}
+	}
 	c.Logger.Logger.Debug().Msg("Finish CustomMounts hook")
 	return nil
 }
+
+// appendMissing appends the paths not in the list yet
+func appendMissing(list []string, paths ...string) []string {
+	for _, p := range paths {
+		found := false
+		for _, l := range list {
+			if filepath.Clean(l) == p {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, p)
+		}
+	}
+	return list
+}
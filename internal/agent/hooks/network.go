@@ -0,0 +1,149 @@
+package hook
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	config "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/kairos-io/kairos-sdk/machine"
+	yip "github.com/mudler/yip/pkg/schema"
+)
+
+// NetworkReservation persists the hostname and the address leased during install as static network
+// config in the installed system, so the node keeps the same address after reboot.
+// The static config is written as a systemd-networkd unit for the interface holding the default route.
+type NetworkReservation struct{}
+
+func (n NetworkReservation) Run(c config.Config, spec v1.Spec) error {
+	installSpec, ok := spec.(*v1.InstallSpec)
+	if !ok || !installSpec.ReserveNetwork {
+		return nil
+	}
+	c.Logger.Logger.Debug().Msg("Running NetworkReservation hook")
+
+	yc, err := n.Config(c)
+	if err != nil {
+		// Best effort, the system will keep using dhcp
+		c.Logger.Warnf("could not capture the current network configuration: %s", err)
+		return nil
+	}
+
+	machine.Mount("COS_OEM", "/oem") //nolint:errcheck
+	defer func() {
+		machine.Umount("/oem") //nolint:errcheck
+	}()
+
+	err = saveCloudConfig("network_reservation", yc)
+	if err != nil {
+		c.Logger.Warnf("could not save the network reservation config: %s", err)
+	}
+	c.Logger.Logger.Debug().Msg("Finish NetworkReservation hook")
+	return nil
+}
+
+// Config returns the cloud config that sets the current hostname and the address of the
+// default route interface statically.
+func (n NetworkReservation) Config(c config.Config) (yip.YipConfig, error) {
+	iface, gateway, err := defaultRoute(c)
+	if err != nil {
+		return yip.YipConfig{}, err
+	}
+
+	netIface, err := net.InterfaceByName(iface)
+	if err != nil {
+		return yip.YipConfig{}, err
+	}
+	addrs, err := netIface.Addrs()
+	if err != nil {
+		return yip.YipConfig{}, err
+	}
+
+	network := []string{"[Match]", fmt.Sprintf("Name=%s", iface), "", "[Network]"}
+	found := false
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() == nil {
+			continue
+		}
+		network = append(network, fmt.Sprintf("Address=%s", ipNet.String()))
+		found = true
+	}
+	if !found {
+		return yip.YipConfig{}, fmt.Errorf("no IPv4 address found for interface %s", iface)
+	}
+	if gateway != "" {
+		network = append(network, fmt.Sprintf("Gateway=%s", gateway))
+	}
+	for _, dns := range nameservers(c) {
+		network = append(network, fmt.Sprintf("DNS=%s", dns))
+	}
+
+	stage := yip.Stage{
+		Name: "network_reservation",
+		Files: []yip.File{{
+			Path:        fmt.Sprintf("/etc/systemd/network/10-kairos-%s.network", iface),
+			Permissions: 0644,
+			Content:     strings.Join(network, "\n") + "\n",
+		}},
+	}
+	hostname, _ := c.Fs.ReadFile("/proc/sys/kernel/hostname")
+	stage.Hostname = strings.TrimSpace(string(hostname))
+
+	return yip.YipConfig{Stages: map[string][]yip.Stage{"initramfs": {stage}}}, nil
+}
+
+// defaultRoute returns the interface and gateway of the IPv4 default route
+func defaultRoute(c config.Config) (iface, gateway string, err error) {
+	routes, err := c.Fs.ReadFile("/proc/net/route")
+	if err != nil {
+		return "", "", err
+	}
+	for _, line := range strings.Split(string(routes), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		gw, err := hex.DecodeString(fields[2])
+		if err != nil || len(gw) != 4 {
+			return fields[0], "", nil
+		}
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(gw))
+		if ip.IsUnspecified() {
+			return fields[0], "", nil
+		}
+		return fields[0], ip.String(), nil
+	}
+	return "", "", fmt.Errorf("no default route found")
+}
+
+// nameservers returns the upstream nameservers currently in use. With systemd-resolved /etc/resolv.conf points to
+// its local stub, so the servers it forwards to are read from its own resolv.conf. Loopback servers are skipped
+// either way, they are not reachable from the static config of the interface.
+func nameservers(c config.Config) []string {
+	var servers []string
+	for _, file := range []string{"/run/systemd/resolve/resolv.conf", "/etc/resolv.conf"} {
+		resolv, err := c.Fs.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(resolv), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) != 2 || fields[0] != "nameserver" {
+				continue
+			}
+			if ip := net.ParseIP(fields[1]); ip != nil && ip.IsLoopback() {
+				continue
+			}
+			servers = append(servers, fields[1])
+		}
+		if len(servers) > 0 {
+			break
+		}
+	}
+	return servers
+}
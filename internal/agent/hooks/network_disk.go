@@ -0,0 +1,50 @@
+package hook
+
+import (
+	config "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/kairos-io/kairos-sdk/machine"
+	yip "github.com/mudler/yip/pkg/schema"
+)
+
+// netdevFstab marks the fstab entries of block devices as network ones, so on shutdown they are unmounted before
+// the network goes down instead of hanging on a disk that can't be reached anymore
+const netdevFstab = `sed -i -E '/^(LABEL=|UUID=|\/dev\/)/{/_netdev/!s/^([^[:space:]]+[[:space:]]+[^[:space:]]+[[:space:]]+[^[:space:]]+[[:space:]]+[^[:space:]]+)/\1,_netdev/}' /etc/fstab`
+
+// NetworkDisk sets up the installed system to run from a disk attached over the network, the kernel arguments
+// to attach it from the initramfs are set with the grub options by the install action.
+type NetworkDisk struct{}
+
+func (n NetworkDisk) Run(c config.Config, spec v1.Spec) error {
+	installSpec, ok := spec.(*v1.InstallSpec)
+	if !ok || installSpec.NetworkDisk == nil {
+		return nil
+	}
+	c.Logger.Logger.Debug().Msg("Running NetworkDisk hook")
+
+	machine.Mount("COS_OEM", "/oem") //nolint:errcheck
+	defer func() {
+		machine.Umount("/oem") //nolint:errcheck
+	}()
+
+	err := saveCloudConfig("network_disk", n.Config(installSpec.NetworkDisk))
+	if err != nil {
+		c.Logger.Warnf("could not save the network disk config: %s", err)
+	}
+	c.Logger.Logger.Debug().Msg("Finish NetworkDisk hook")
+	return nil
+}
+
+// Config returns the cloud config that keeps the network disk attached and its mounts safe on shutdown
+func (n NetworkDisk) Config(disk *v1.NetworkDisk) yip.YipConfig {
+	stage := yip.Stage{
+		Name:     "network_disk",
+		Commands: []string{netdevFstab},
+	}
+	// iscsid recovers the session if the connection drops
+	if disk.Protocol == constants.NetworkDiskISCSI {
+		stage.Systemctl.Enable = []string{"iscsid"}
+	}
+	return yip.YipConfig{Stages: map[string][]yip.Stage{"initramfs": {stage}}}
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/kairos-io/kairos-agent/v2/pkg/config"
 	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
 	"github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils"
 	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
 	"github.com/kairos-io/kairos-agent/v2/pkg/utils/partitions"
 	"io/fs"
@@ -87,6 +88,13 @@ func (b SysExtPostInstall) Run(c config.Config, _ v1.Spec) error {
 				return nil
 			}
 			c.Logger.Debugf("copied %s to %s", path, passiveDir)
+
+			// Keep track of where the sysext comes from, for auditing
+			for _, dir := range []string{activeDir, passiveDir} {
+				if err := utils.RecordSysext(c.Fs, dir, info.Name(), "file://"+path); err != nil {
+					c.Logger.Warnf("failed to record the origin of %s in %s: %s", info.Name(), dir, err)
+				}
+			}
 		}
 		return nil
 	})
@@ -22,6 +22,7 @@ import (
 	qr "github.com/kairos-io/go-nodepair/qrcode"
 	"github.com/kairos-io/kairos-agent/v2/internal/bus"
 	"github.com/kairos-io/kairos-agent/v2/internal/cmd"
+	"github.com/kairos-io/kairos-agent/v2/internal/i18n"
 	"github.com/kairos-io/kairos-agent/v2/pkg/action"
 	"github.com/kairos-io/kairos-agent/v2/pkg/config"
 	events "github.com/kairos-io/kairos-sdk/bus"
@@ -36,7 +37,7 @@ func displayInfo(agentConfig *Config) {
 	if !agentConfig.WebUI.Disable {
 		ifaces := machine.Interfaces()
 		message := fmt.Sprintf("Interfaces: %s", strings.Join(ifaces, " "))
-		if !agentConfig.WebUI.HasAddress() {
+		if agentConfig.WebUI.Address() == config.DefaultWebUIListenAddress {
 			ips := machine.LocalIPs()
 			if len(ips) > 0 {
 				messageIps := " - WebUI installer: "
@@ -49,21 +50,24 @@ func displayInfo(agentConfig *Config) {
 				}
 				message = message + messageIps
 			}
-		} else {
+		} else if agentConfig.WebUI.HasAddress() {
 			message = message + fmt.Sprintf(" - WebUI installer: %s", agentConfig.WebUI.ListenAddress)
 		}
+		if agentConfig.WebUI.Socket != "" {
+			message = message + fmt.Sprintf(" - WebUI socket: %s", agentConfig.WebUI.Socket)
+		}
 		fmt.Println(message)
 	}
 }
 
-func ManualInstall(c, sourceImgURL, device string, reboot, poweroff, strictValidations bool) error {
+func ManualInstall(c, sourceImgURL, device string, reboot, poweroff, strictValidations, force, yes, printPlan bool) error {
 	configSource, err := prepareConfiguration(c)
 	if err != nil {
 		return err
 	}
 
 	cliConf := generateInstallConfForCLIArgs(sourceImgURL)
-	cliConfManualArgs := generateInstallConfForManualCLIArgs(device, reboot, poweroff)
+	cliConfManualArgs := generateInstallConfForManualCLIArgs(device, reboot, poweroff, force, printPlan)
 
 	cc, err := config.Scan(
 		collector.Readers(configSource, strings.NewReader(cliConf), strings.NewReader(cliConfManualArgs)),
@@ -73,6 +77,19 @@ func ManualInstall(c, sourceImgURL, device string, reboot, poweroff, strictValid
 		return err
 	}
 
+	target := cc.Install.Device
+	if target == "" || target == "auto" {
+		target = i18n.T("install.target.auto")
+	} else if !strings.HasPrefix(target, "/") {
+		target = i18n.T("install.target.selected", target)
+	}
+	if err = Confirm(yes, i18n.T("install.erase", target)); err != nil {
+		return err
+	}
+	if err = offerAcceleratorBundles(cc, !yes); err != nil {
+		return err
+	}
+
 	return RunInstall(cc)
 }
 
@@ -116,13 +133,17 @@ func Install(sourceImgURL string, dir ...string) error {
 		collector.Readers(strings.NewReader(cliConf)),
 		collector.MergeBootLine)
 	if err == nil && cc.Install != nil && cc.Install.Auto {
+		err = offerAcceleratorBundles(cc, false)
+		if err != nil {
+			return err
+		}
 		err = RunInstall(cc)
 		if err != nil {
 			return err
 		}
 
 		if !cc.Install.Reboot && !cc.Install.Poweroff {
-			pterm.DefaultInteractiveContinue.Show("Installation completed, press enter to go back to the shell.")
+			pterm.DefaultInteractiveContinue.Show(i18n.T("install.completed.shell"))
 			svc, err := machine.Getty(1)
 			if err == nil {
 				svc.Start() //nolint:errcheck
@@ -147,7 +168,7 @@ func Install(sourceImgURL string, dir ...string) error {
 	// and print information about the webUI
 	if !bus.Manager.HasRegisteredPlugins() {
 		displayInfo(agentConfig)
-		fmt.Println("No providers found, dropping to a shell. \n -- For instructions on how to install manually, see: https://kairos.io/docs/installation/manual/")
+		fmt.Println(i18n.T("install.no-providers"))
 		return utils.Shell().Run()
 	}
 
@@ -177,27 +198,30 @@ func Install(sourceImgURL string, dir ...string) error {
 
 	if len(r) == 0 {
 		// This means there is no config in the system AND no config was obtained from events
-		return errors.New("no configuration, stopping installation")
+		return errors.New(i18n.T("install.no-config"))
 	}
-	pterm.Info.Println("Starting installation")
+	pterm.Info.Println(i18n.T("install.starting"))
 
 	cc.Logger.Debugf("Runinstall with cc: %s\n", litter.Sdump(cc))
+	if err := offerAcceleratorBundles(cc, false); err != nil {
+		return err
+	}
 	if err := RunInstall(cc); err != nil {
 		return err
 	}
 
 	if cc.Install.Reboot {
-		pterm.Info.Println("Installation completed, starting reboot in 5 seconds.")
+		pterm.Info.Println(i18n.T("install.completed.reboot"))
 
 	}
 	if cc.Install.Poweroff {
-		pterm.Info.Println("Installation completed, starting power off in 5 seconds.")
+		pterm.Info.Println(i18n.T("install.completed.poweroff"))
 	}
 
 	// If neither reboot and poweroff are enabled let the user insert enter to go back to a new shell
 	// This is helpful to see the installation messages instead of just cleaning the screen with a new tty
 	if !cc.Install.Reboot && !cc.Install.Poweroff {
-		pterm.DefaultInteractiveContinue.Show("Installation completed, press enter to go back to the shell.")
+		pterm.DefaultInteractiveContinue.Show(i18n.T("install.completed.shell"))
 
 		utils.Prompt("") //nolint:errcheck
 
@@ -379,12 +403,25 @@ func generateInstallConfForCLIArgs(sourceImageURL string) string {
 }
 
 // generateInstallConfForManualCLIArgs creates a kairos configuration for flags passed via manual install
-func generateInstallConfForManualCLIArgs(device string, reboot, poweroff bool) string {
+func generateInstallConfForManualCLIArgs(device string, reboot, poweroff, force, printPlan bool) string {
 	cfg := fmt.Sprintf(`install:
   reboot: %t
   poweroff: %t
 `, reboot, poweroff)
 
+	// Only set it when given, so it does not override the config one
+	if force {
+		cfg += `
+  force: true
+`
+	}
+
+	if printPlan {
+		cfg += `
+  print-plan: true
+`
+	}
+
 	if device != "" {
 		cfg += fmt.Sprintf(`
   device: %s
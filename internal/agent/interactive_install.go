@@ -9,6 +9,7 @@ import (
 
 	"github.com/kairos-io/kairos-agent/v2/internal/bus"
 	"github.com/kairos-io/kairos-agent/v2/internal/cmd"
+	"github.com/kairos-io/kairos-agent/v2/internal/i18n"
 	"github.com/kairos-io/kairos-agent/v2/pkg/config"
 	events "github.com/kairos-io/kairos-sdk/bus"
 	"github.com/kairos-io/kairos-sdk/collector"
@@ -22,11 +23,6 @@ import (
 	"github.com/pterm/pterm"
 )
 
-const (
-	canBeEmpty = "Unset"
-	yesNo      = "[y]es/[N]o"
-)
-
 func prompt(prompt, initialValue, placeHolder string, canBeEmpty, hidden bool) (string, error) {
 	input := textinput.New(prompt)
 	input.InitialValue = initialValue
@@ -39,12 +35,9 @@ func prompt(prompt, initialValue, placeHolder string, canBeEmpty, hidden bool) (
 	return input.RunPrompt()
 }
 
+// isYes returns true if the answer is yes, in English or in the language of the messages
 func isYes(s string) bool {
-	i := strings.ToLower(s)
-	if i == "y" || i == "yes" {
-		return true
-	}
-	return false
+	return i18n.IsYes(s)
 }
 
 const (
@@ -60,7 +53,7 @@ func promptBool(p events.YAMLPrompt) (string, error) {
 	if p.Default != "" {
 		def = p.Default
 	}
-	val, err := prompt(p.Prompt, def, yesNo, true, false)
+	val, err := prompt(p.Prompt, def, i18n.T("interactive.yes-no"), true, false)
 	if err != nil {
 		return "", err
 	}
@@ -84,7 +77,7 @@ func promptText(p events.YAMLPrompt) (string, error) {
 func promptToUnstructured(p events.YAMLPrompt, unstructuredYAML map[string]interface{}) (map[string]interface{}, error) {
 	var res string
 	if p.AskFirst {
-		ask, err := prompt(p.AskPrompt, "n", yesNo, true, false)
+		ask, err := prompt(p.AskPrompt, "n", i18n.T("interactive.yes-no"), true, false)
 		if err == nil && !isYes(ask) {
 			return unstructuredYAML, nil
 		}
@@ -142,17 +135,17 @@ func InteractiveInstall(debug, spawnShell bool, sourceImgURL string) error {
 		disks = append(disks, fmt.Sprintf("/dev/%s: (%.2f GiB) ", disk.Name, float64(disk.SizeBytes)/float64(GiB)))
 	}
 
-	pterm.Info.Println("Available Disks:")
+	pterm.Info.Println(i18n.T("interactive.disks"))
 	for _, d := range disks {
 		pterm.Info.Println(" " + d)
 	}
 
-	device, err := prompt("What's the target install device?", preferedDevice, "Cannot be empty", false, false)
+	device, err := prompt(i18n.T("interactive.device"), preferedDevice, i18n.T("interactive.not-empty"), false, false)
 	if err != nil {
 		return err
 	}
 
-	createUser, err := prompt("Do you want to create any users? If not, system will not be accesible via terminal or ssh", "y", yesNo, true, false)
+	createUser, err := prompt(i18n.T("interactive.create-user"), "y", i18n.T("interactive.yes-no"), true, false)
 	if err != nil {
 		return err
 	}
@@ -160,12 +153,12 @@ func InteractiveInstall(debug, spawnShell bool, sourceImgURL string) error {
 	var userName, userPassword, sshKeys, makeAdmin string
 
 	if isYes(createUser) {
-		userName, err = prompt("User to setup", "kairos", canBeEmpty, true, false)
+		userName, err = prompt(i18n.T("interactive.user"), "kairos", i18n.T("interactive.unset"), true, false)
 		if err != nil {
 			return err
 		}
 
-		userPassword, err = prompt("Password", "", canBeEmpty, true, true)
+		userPassword, err = prompt(i18n.T("interactive.password"), "", i18n.T("interactive.unset"), true, true)
 		if err != nil {
 			return err
 		}
@@ -174,12 +167,12 @@ func InteractiveInstall(debug, spawnShell bool, sourceImgURL string) error {
 			userPassword = "!"
 		}
 
-		sshKeys, err = prompt("SSH access (rsakey, github/gitlab supported, comma-separated)", "github:someuser,github:someuser2", canBeEmpty, true, false)
+		sshKeys, err = prompt(i18n.T("interactive.ssh"), "github:someuser,github:someuser2", i18n.T("interactive.unset"), true, false)
 		if err != nil {
 			return err
 		}
 
-		makeAdmin, err = prompt("Make the user an admin (with sudo permissions)?", "y", yesNo, true, false)
+		makeAdmin, err = prompt(i18n.T("interactive.admin"), "y", i18n.T("interactive.yes-no"), true, false)
 		if err != nil {
 			return err
 		}
@@ -221,7 +214,7 @@ func InteractiveInstall(debug, spawnShell bool, sourceImgURL string) error {
 		return err
 	}
 
-	allGood, err := prompt("Are settings ok?", "n", yesNo, true, false)
+	allGood, err := prompt(i18n.T("interactive.confirm"), "n", i18n.T("interactive.yes-no"), true, false)
 	if err != nil {
 		return err
 	}
@@ -295,12 +288,15 @@ func InteractiveInstall(debug, spawnShell bool, sourceImgURL string) error {
 			collector.MergeBootLine, collector.NoLogs)
 	}
 
-	pterm.Info.Println("Starting installation")
+	pterm.Info.Println(i18n.T("install.starting"))
 	// Generate final config
 	ccString, _ := cc.String()
 	pterm.Info.Println(ccString)
 
-	err = RunInstall(cc)
+	err = offerAcceleratorBundles(cc, true)
+	if err == nil {
+		err = RunInstall(cc)
+	}
 	if err != nil {
 		pterm.Error.Println(err.Error())
 	}
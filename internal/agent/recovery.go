@@ -15,6 +15,20 @@ import (
 )
 
 func Recovery() error {
+	if err := remoteRecovery(); err != nil {
+		return err
+	}
+	// give tty1 back
+	svc, err := machine.Getty(1)
+	if err == nil {
+		svc.Start() //nolint:errcheck
+	}
+
+	return nil
+}
+
+// remoteRecovery prints the QR code to pair the machine with "kairos bridge" and waits for the user to stop it
+func remoteRecovery() error {
 	bus.Manager.Initialize()
 
 	token := ""
@@ -58,14 +72,5 @@ func Recovery() error {
 	// Wait for user input and go back to shell
 	utils.Prompt("") //nolint:errcheck
 	_, err = bus.Manager.Publish(events.EventRecoveryStop, events.EventPayload{})
-	if err != nil {
-		return err
-	}
-	// give tty1 back
-	svc, err := machine.Getty(1)
-	if err == nil {
-		svc.Start() //nolint:errcheck
-	}
-
-	return nil
+	return err
 }
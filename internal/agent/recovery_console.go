@@ -0,0 +1,213 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/erikgeiser/promptkit/selection"
+	"github.com/kairos-io/kairos-agent/v2/internal/cmd"
+	"github.com/kairos-io/kairos-agent/v2/internal/i18n"
+	"github.com/kairos-io/kairos-agent/v2/pkg/action"
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-sdk/collector"
+	"github.com/kairos-io/kairos-sdk/machine"
+	"github.com/kairos-io/kairos-sdk/state"
+	"github.com/pterm/pterm"
+)
+
+// recoveryConsoleActions are the entries of the recovery console menu, by their message key
+var recoveryConsoleActions = []string{
+	"reset",
+	"restore-oem",
+	"bootloader",
+	"logs",
+	"pairing",
+	"shell",
+	"exit",
+}
+
+// recoveryConsole is the guided repair menu shown by "kairos-agent recovery --console". The prompts and the
+// actions which can not run on a test system are fields, so the menu can be driven from the tests.
+type recoveryConsole struct {
+	cfg  *config.Config
+	dirs []string
+
+	// choose asks to pick one of the choices, returning its index
+	choose func(prompt string, choices []string) (int, error)
+	// ask asks for a free form answer, which can be empty
+	ask   func(prompt string) (string, error)
+	reset func(reboot, unattended, resetOem bool, restoreOEMBackup, oemBackupKey string, dir ...string) error
+	pair  func() error
+	shell func() error
+}
+
+// RecoveryConsole runs the guided repair menu of the recovery system until the user exits it, then gives tty1
+// back
+func RecoveryConsole(dir ...string) error {
+	cfg, err := config.Scan(collector.Directories(dir...), collector.NoLogs)
+	if err != nil {
+		return err
+	}
+	if boot, _ := state.DetectBootWithVFS(cfg.Fs); boot != state.Recovery {
+		return errors.New(i18n.T("recovery.console.not-recovery"))
+	}
+
+	cmd.PrintBranding(DefaultBanner)
+	c := &recoveryConsole{
+		cfg:    cfg,
+		dirs:   dir,
+		choose: chooseOne,
+		ask: func(p string) (string, error) {
+			return prompt(p, "", "", true, false)
+		},
+		reset: Reset,
+		pair:  remoteRecovery,
+		shell: recoveryShell,
+	}
+	if err = c.run(); err != nil {
+		return err
+	}
+
+	// give tty1 back
+	svc, err := machine.Getty(1)
+	if err == nil {
+		svc.Start() //nolint:errcheck
+	}
+	return nil
+}
+
+// run shows the menu until the user exits it. A failed action is reported and the menu shown again, so the user
+// can try a different repair.
+func (c *recoveryConsole) run() error {
+	choices := make([]string, len(recoveryConsoleActions))
+	for i, key := range recoveryConsoleActions {
+		choices[i] = i18n.T("recovery.console." + key)
+	}
+	for {
+		i, err := c.choose(i18n.T("recovery.console.prompt"), choices)
+		if err != nil {
+			return err
+		}
+		if recoveryConsoleActions[i] == "exit" {
+			return nil
+		}
+		if err = c.runAction(recoveryConsoleActions[i]); err != nil {
+			pterm.Error.Println(err.Error())
+		}
+	}
+}
+
+func (c *recoveryConsole) runAction(key string) error {
+	switch key {
+	case "reset":
+		return c.runReset()
+	case "restore-oem":
+		return c.runRestoreOEM()
+	case "bootloader":
+		if !c.confirm(i18n.T("recovery.console.bootloader.confirm")) {
+			return nil
+		}
+		if err := action.RebuildBootloader(c.cfg); err != nil {
+			return err
+		}
+		pterm.Success.Println(i18n.T("recovery.console.bootloader.done"))
+	case "logs":
+		return c.runCollectLogs()
+	case "pairing":
+		return c.pair()
+	case "shell":
+		pterm.Info.Println(i18n.T("recovery.console.shell.exit"))
+		return c.shell()
+	}
+	return nil
+}
+
+func (c *recoveryConsole) runReset() error {
+	if !c.confirm(i18n.T("recovery.console.reset.confirm")) {
+		return nil
+	}
+	resetOem := c.confirm(i18n.T("recovery.console.reset.oem"))
+	reboot := c.confirm(i18n.T("recovery.console.reset.reboot"))
+	// Already confirmed, the reset does not need to ask again
+	return c.reset(reboot, true, resetOem, "", "", c.dirs...)
+}
+
+func (c *recoveryConsole) runRestoreOEM() error {
+	file, err := c.ask(i18n.T("recovery.console.oem.file"))
+	if err != nil {
+		return err
+	}
+	keyFile, err := c.ask(i18n.T("recovery.console.oem.key"))
+	if err != nil {
+		return err
+	}
+	if err = action.RecoveryRestoreOEM(c.cfg, file, keyFile); err != nil {
+		return err
+	}
+	pterm.Success.Println(i18n.T("recovery.console.oem.done"))
+	return nil
+}
+
+func (c *recoveryConsole) runCollectLogs() error {
+	devices, err := action.USBLogsDevices(c.cfg)
+	if err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		return errors.New(i18n.T("recovery.console.logs.no-usb"))
+	}
+	choices := make([]string, len(devices))
+	for i, d := range devices {
+		choices[i] = d.String()
+	}
+	i, err := c.choose(i18n.T("recovery.console.logs.device"), choices)
+	if err != nil {
+		return err
+	}
+	bundle, err := action.CollectLogsToDevice(c.cfg, devices[i].Path)
+	if err != nil {
+		return err
+	}
+	pterm.Success.Println(i18n.T("recovery.console.logs.done", bundle, devices[i].Path))
+	return nil
+}
+
+// confirm asks a yes or no question, anything but yes is a no
+func (c *recoveryConsole) confirm(question string) bool {
+	answer, err := c.ask(fmt.Sprintf("%s %s", question, i18n.T("interactive.yes-no")))
+	return err == nil && isYes(answer)
+}
+
+// chooseOne shows a selection menu of the choices
+func chooseOne(prompt string, choices []string) (int, error) {
+	sel := selection.New(prompt, choices)
+	sel.Filter = nil
+	choice, err := sel.RunPrompt()
+	if err != nil {
+		return 0, err
+	}
+	for i := range choices {
+		if choices[i] == choice {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown choice %q", choice)
+}
+
+// recoveryShell opens an interactive shell, returning to the console once it exits
+func recoveryShell() error {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	sh := exec.Command(shell)
+	sh.Stdin, sh.Stdout, sh.Stderr = os.Stdin, os.Stdout, os.Stderr
+	// The exit status of the last command run in the shell is not an error of the console
+	var exitErr *exec.ExitError
+	if err := sh.Run(); err != nil && !errors.As(err, &exitErr) {
+		return err
+	}
+	return nil
+}
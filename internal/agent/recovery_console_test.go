@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Recovery console", func() {
+	var console *recoveryConsole
+	var picks []string
+	var answers []string
+	var prompts []string
+	var resets [][]interface{}
+	var shells int
+
+	BeforeEach(func() {
+		picks, answers, prompts, resets, shells = nil, nil, nil, nil, 0
+		runner := v1mock.NewFakeRunner()
+		runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+			if cmd == "lsblk" {
+				return []byte(`{"blockdevices": [{"name": "/dev/sda", "tran": "sata", "fstype": "ext4", "size": "100G"}]}`), nil
+			}
+			return []byte{}, nil
+		}
+		console = &recoveryConsole{
+			cfg: config.NewConfig(
+				config.WithRunner(runner),
+				config.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})),
+			),
+			dirs: []string{"/oem"},
+			choose: func(prompt string, choices []string) (int, error) {
+				prompts = append(prompts, prompt)
+				if len(picks) == 0 {
+					return 0, errors.New("interrupted")
+				}
+				pick := picks[0]
+				picks = picks[1:]
+				for i := range choices {
+					if choices[i] == pick {
+						return i, nil
+					}
+				}
+				return 0, errors.New("no such choice " + pick)
+			},
+			ask: func(prompt string) (string, error) {
+				prompts = append(prompts, prompt)
+				answer := answers[0]
+				answers = answers[1:]
+				return answer, nil
+			},
+			reset: func(reboot, unattended, resetOem bool, restoreOEMBackup, oemBackupKey string, dir ...string) error {
+				resets = append(resets, []interface{}{reboot, unattended, resetOem, dir})
+				return nil
+			},
+			shell: func() error {
+				shells++
+				return nil
+			},
+		}
+	})
+
+	It("exits from the menu", func() {
+		picks = []string{"Exit"}
+		Expect(console.run()).To(Succeed())
+		Expect(prompts).To(HaveLen(1))
+	})
+
+	It("returns an interrupted menu", func() {
+		Expect(console.run()).To(MatchError("interrupted"))
+	})
+
+	It("resets once confirmed", func() {
+		picks = []string{"Reset the system to the recovery image", "Reset the system to the recovery image", "Exit"}
+		answers = []string{"n", "y", "n", "yes"}
+		Expect(console.run()).To(Succeed())
+		Expect(resets).To(Equal([][]interface{}{{true, true, false, []string{"/oem"}}}))
+	})
+
+	It("keeps the menu after a failed action", func() {
+		picks = []string{"Collect the logs to a USB drive", "Open a shell", "Exit"}
+		Expect(console.run()).To(Succeed())
+		Expect(shells).To(Equal(1))
+		Expect(prompts).To(HaveLen(3))
+	})
+})
@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/kairos-agent/v2/internal/bus"
+	config "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	"github.com/kairos-io/kairos-sdk/utils"
+)
+
+const defaultReenrollTimeout = 2 * time.Minute
+
+// ResetState is the machine state after a reset, published on the bus and sent to the re-enrollment webhook
+type ResetState struct {
+	Time            time.Time `json:"time"`
+	Hostname        string    `json:"hostname"`
+	MachineID       string    `json:"machine-id,omitempty"`
+	Version         string    `json:"version,omitempty"`
+	ResetPersistent bool      `json:"reset-persistent"`
+	ResetOEM        bool      `json:"reset-oem"`
+}
+
+// Reenroll publishes the machine state after a reset and runs the configured re-enrollment
+type Reenroll struct {
+	cfg         *config.Config
+	reenroll    config.Reenroll
+	credentials string
+	Client      *http.Client
+}
+
+// NewReenroll returns a Reenroll for the reenroll in the config. The credentials are read right away, as
+// the reset might wipe the OEM partition they are stored in.
+func NewReenroll(c *config.Config) *Reenroll {
+	r := &Reenroll{cfg: c}
+	if c.Reenroll != nil {
+		r.reenroll = *c.Reenroll
+	}
+	if r.reenroll.Timeout == 0 {
+		r.reenroll.Timeout = defaultReenrollTimeout
+	}
+	r.Client = &http.Client{Timeout: r.reenroll.Timeout, Transport: c.HTTPTransport()}
+	if r.reenroll.URL == "" && r.reenroll.Command == "" {
+		return r
+	}
+
+	file := r.reenroll.Credentials
+	if file == "" {
+		file = constants.ReenrollCredentialsFile
+	}
+	data, err := c.Fs.ReadFile(file)
+	if err != nil && (r.reenroll.Credentials != "" || !errors.Is(err, os.ErrNotExist)) {
+		c.Logger.Warnf("Could not read the re-enrollment credentials: %s", err)
+	}
+	r.credentials = strings.TrimSpace(string(data))
+	return r
+}
+
+// Run publishes the reset state on the bus, then sends it to the webhook and runs the command, if set.
+// All of them are attempted, the errors are returned together.
+func (r *Reenroll) Run(state ResetState) error {
+	var errs []error
+	if _, err := bus.Manager.Publish(bus.EventResetCompleted, state); err != nil {
+		errs = append(errs, fmt.Errorf("publishing the reset state: %w", err))
+	}
+	body, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if r.reenroll.URL != "" {
+		r.cfg.Logger.Infof("Re-enrolling the node through %s", r.reenroll.URL)
+		if err = r.post(body); err != nil {
+			errs = append(errs, fmt.Errorf("re-enrollment webhook: %w", err))
+		}
+	}
+	if r.reenroll.Command != "" {
+		r.cfg.Logger.Infof("Running the re-enrollment command")
+		if err = r.run(body); err != nil {
+			errs = append(errs, fmt.Errorf("re-enrollment command: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Reenroll) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, r.reenroll.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.credentials != "" {
+		req.Header.Set("Authorization", "Bearer "+r.credentials)
+	}
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (r *Reenroll) run(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.reenroll.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", r.reenroll.Command)
+	cmd.Env = append(os.Environ(), "KAIROS_RESET_STATE="+string(body), "KAIROS_REENROLL_CREDENTIALS="+r.credentials)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w", strings.TrimSpace(string(out)), err)
+	}
+	r.cfg.Logger.Debugf("Re-enrollment command output: %s", out)
+	return nil
+}
+
+// resetState collects the state of the machine after a reset
+func resetState(c *config.Config, resetPersistent, resetOEM bool) ResetState {
+	state := ResetState{Time: time.Now().UTC(), ResetPersistent: resetPersistent, ResetOEM: resetOEM}
+	state.Hostname, _ = os.Hostname()
+	if id, err := c.Fs.ReadFile("/etc/machine-id"); err == nil {
+		state.MachineID = strings.TrimSpace(string(id))
+	}
+	state.Version, _ = utils.OSRelease("VERSION")
+	return state
+}
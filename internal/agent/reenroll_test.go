@@ -0,0 +1,85 @@
+package agent_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/kairos-io/kairos-agent/v2/internal/agent"
+	config "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-sdk/collector"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reenroll", func() {
+	var server *httptest.Server
+	var body []byte
+	var auth string
+	var status int
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		body, auth, status = nil, "", http.StatusOK
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ = io.ReadAll(r.Body)
+			auth = r.Header.Get("Authorization")
+			w.WriteHeader(status)
+		}))
+		dir, err = os.MkdirTemp("", "reenroll")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.WriteFile(filepath.Join(dir, "credentials"), []byte("secret\n"), 0600)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	newReenroll := func(extra string) *Reenroll {
+		c, err := config.ScanNoLogs(collector.Readers(strings.NewReader(fmt.Sprintf(`#cloud-config
+reenroll:
+  url: %s/enroll
+  credentials: %s
+%s`, server.URL, filepath.Join(dir, "credentials"), extra))))
+		Expect(err).ToNot(HaveOccurred())
+		return NewReenroll(c)
+	}
+
+	It("sends the reset state with the OEM credentials", func() {
+		r := newReenroll("")
+		// The credentials are read before the reset, it can remove them
+		Expect(os.Remove(filepath.Join(dir, "credentials"))).To(Succeed())
+		Expect(r.Run(ResetState{Hostname: "node1", ResetPersistent: true})).To(Succeed())
+
+		Expect(auth).To(Equal("Bearer secret"))
+		state := ResetState{}
+		Expect(json.Unmarshal(body, &state)).To(Succeed())
+		Expect(state.Hostname).To(Equal("node1"))
+		Expect(state.ResetPersistent).To(BeTrue())
+	})
+
+	It("runs the re-enrollment command with the state in its environment", func() {
+		out := filepath.Join(dir, "out")
+		r := newReenroll(fmt.Sprintf("  command: echo \"$KAIROS_REENROLL_CREDENTIALS $KAIROS_RESET_STATE\" > %s\n", out))
+		Expect(r.Run(ResetState{Hostname: "node1"})).To(Succeed())
+
+		data, err := os.ReadFile(out)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(HavePrefix("secret {"))
+		Expect(string(data)).To(ContainSubstring(`"hostname":"node1"`))
+	})
+
+	It("fails if the webhook rejects the node", func() {
+		status = http.StatusForbidden
+		r := newReenroll("")
+		Expect(r.Run(ResetState{Hostname: "node1"})).To(MatchError(ContainSubstring("403")))
+	})
+})
@@ -0,0 +1,284 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	events "github.com/kairos-io/kairos-sdk/bus"
+	"github.com/mudler/go-pluggable"
+	"gopkg.in/yaml.v3"
+)
+
+// Release holds the details of an image available to upgrade to, as found in the registry
+type Release struct {
+	Image       string            `json:"image" yaml:"image"`
+	Tag         string            `json:"tag" yaml:"tag"`
+	Version     string            `json:"version,omitempty" yaml:"version,omitempty"`
+	Channel     string            `json:"channel,omitempty" yaml:"channel,omitempty"`
+	Provider    string            `json:"provider,omitempty" yaml:"provider,omitempty"`
+	Digest      string            `json:"digest,omitempty" yaml:"digest,omitempty"`
+	Created     *time.Time        `json:"created,omitempty" yaml:"created,omitempty"`
+	Size        int64             `json:"size,omitempty" yaml:"size,omitempty"`
+	Arch        string            `json:"arch,omitempty" yaml:"arch,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty" yaml:"annotations,omitempty"`
+	Error       string            `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// ReleasesOutput is the structured output of the list-releases command
+type ReleasesOutput struct {
+	Current  string    `json:"current" yaml:"current"`
+	Releases []Release `json:"releases" yaml:"releases"`
+	// CachedAt is when the releases were cached, set if the registry was not queried
+	CachedAt *time.Time `json:"cached_at,omitempty" yaml:"cached_at,omitempty"`
+}
+
+// DescribeReleases gets the details of the given release images from the registry. Images whose details can't be
+// fetched are still returned with the error set, so a single failure does not hide the rest of the releases.
+func DescribeReleases(images []string) []Release {
+	releases := make([]Release, 0, len(images))
+	for _, image := range images {
+		r, err := describeRelease(image, runtime.GOARCH)
+		if err != nil {
+			r.Error = err.Error()
+		}
+		releases = append(releases, r)
+	}
+	return releases
+}
+
+// describeRelease gets the digest, creation date, size and annotations of the image for the given arch. The digest
+// is the one of the top level manifest, the one to pin the image to. The annotations are the index and manifest
+// annotations plus the image labels, the former taking precedence.
+func describeRelease(image, arch string) (Release, error) {
+	r := Release{Image: image}
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return r, err
+	}
+	r.Tag = ref.Identifier()
+
+	raw, err := crane.Manifest(image)
+	if err != nil {
+		return r, err
+	}
+	digest, _, err := v1.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		return r, err
+	}
+	r.Digest = digest.String()
+	var top struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+	if err = json.Unmarshal(raw, &top); err != nil {
+		return r, err
+	}
+
+	img, err := crane.Pull(image, crane.WithPlatform(&v1.Platform{OS: "linux", Architecture: arch}))
+	if err != nil {
+		return r, err
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return r, err
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return r, err
+	}
+
+	r.Size = manifest.Config.Size
+	for _, l := range manifest.Layers {
+		r.Size += l.Size
+	}
+	if !cfg.Created.Time.IsZero() {
+		created := cfg.Created.Time.UTC()
+		r.Created = &created
+	}
+	r.Arch = cfg.Architecture
+
+	annotations := map[string]string{}
+	for _, m := range []map[string]string{cfg.Config.Labels, manifest.Annotations, top.Annotations} {
+		for k, v := range m {
+			annotations[k] = v
+		}
+	}
+	if len(annotations) > 0 {
+		r.Annotations = annotations
+	}
+	return r, nil
+}
+
+// ReleasesAPIVersion is the version of the EventAvailableReleases contract between the agent and the providers
+const ReleasesAPIVersion = "releases.kairos.io/v1"
+
+// maxReleasesPages caps the pages requested to a provider, in case it never stops returning a continue token
+const maxReleasesPages = 100
+
+// ReleasesRequest is sent to the providers on EventAvailableReleases, as yaml in the payload config.
+// IncludePreReleases keeps its former key, so providers not aware of the versioned contract keep working.
+type ReleasesRequest struct {
+	APIVersion         string `yaml:"apiVersion"`
+	IncludePreReleases bool   `yaml:"IncludePreReleases"`
+	// Channel is the release channel asked for, i.e. stable or edge. Empty means the provider default
+	Channel string `yaml:"channel,omitempty"`
+	// Continue is the token returned by the provider on the previous page, empty for the first one
+	Continue string `yaml:"continue,omitempty"`
+}
+
+// ReleasesResponse is returned by the providers on EventAvailableReleases, as json in the response data:
+//
+//	{"apiVersion": "releases.kairos.io/v1", "releases": [{"image": "quay.io/kairos/ubuntu:v3.2.0", "version": "v3.2.0",
+//	"channel": "stable", "metadata": {"trusted-boot": "false"}}], "continue": "page-2"}
+//
+// Only image is required for each release. A continue token asks the agent for the next page, sending it back in
+// the request. Providers can still return a plain json list of images, the former contract, taken as a single page.
+type ReleasesResponse struct {
+	APIVersion string            `json:"apiVersion"`
+	Releases   []ProviderRelease `json:"releases"`
+	Continue   string            `json:"continue,omitempty"`
+}
+
+// ProviderRelease is a release as returned by a provider
+type ProviderRelease struct {
+	Image    string            `json:"image"`
+	Version  string            `json:"version,omitempty"`
+	Channel  string            `json:"channel,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// ParseReleasesResponse validates a provider response data against the releases contract
+func ParseReleasesResponse(data string) (*ReleasesResponse, error) {
+	data = strings.TrimSpace(data)
+	if strings.HasPrefix(data, "[") {
+		var images []string
+		if err := json.Unmarshal([]byte(data), &images); err != nil {
+			return nil, fmt.Errorf("invalid releases list: %w", err)
+		}
+		resp := &ReleasesResponse{APIVersion: ReleasesAPIVersion}
+		for _, image := range images {
+			resp.Releases = append(resp.Releases, ProviderRelease{Image: image})
+		}
+		return resp, validateReleases(resp.Releases)
+	}
+
+	resp := &ReleasesResponse{}
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(resp); err != nil {
+		return nil, fmt.Errorf("invalid releases response: %w", err)
+	}
+	if resp.APIVersion != ReleasesAPIVersion {
+		return nil, fmt.Errorf("unsupported releases apiVersion %q, expected %q", resp.APIVersion, ReleasesAPIVersion)
+	}
+	return resp, validateReleases(resp.Releases)
+}
+
+// validateReleases checks all the releases have a valid image reference
+func validateReleases(releases []ProviderRelease) error {
+	for i, r := range releases {
+		if r.Image == "" {
+			return fmt.Errorf("release %d has no image", i)
+		}
+		if _, err := name.ParseReference(r.Image); err != nil {
+			return fmt.Errorf("release %d has an invalid image %q: %w", i, r.Image, err)
+		}
+	}
+	return nil
+}
+
+// ProviderReleases asks the providers for the available releases as a fallback chain: providers are asked in order
+// and the first one returning a valid, non empty list of releases is used. Failing providers and invalid responses
+// are reported and skipped. It returns the provider used, or no releases if none of them returned any.
+func ProviderReleases(providers []pluggable.Plugin, req ReleasesRequest) (string, []ProviderRelease) {
+	req.APIVersion = ReleasesAPIVersion
+	for _, p := range providers {
+		releases, err := providerReleases(p, req)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warn: skipping the releases of provider %s: %s\n", p.Name, err.Error())
+			continue
+		}
+		if len(releases) > 0 {
+			return p.Name, releases
+		}
+	}
+	return "", nil
+}
+
+// providerReleases gets all the pages of releases of a single provider in the requested channel
+func providerReleases(p pluggable.Plugin, req ReleasesRequest) ([]ProviderRelease, error) {
+	var releases []ProviderRelease
+	seen := map[string]bool{}
+	for page := 0; page < maxReleasesPages; page++ {
+		config, err := yaml.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+		ev, err := pluggable.NewEvent(events.EventAvailableReleases, events.EventPayload{Config: string(config)})
+		if err != nil {
+			return nil, err
+		}
+		r, err := p.Run(*ev)
+		if err != nil {
+			return nil, err
+		}
+		if r.Errored() {
+			return nil, errors.New(r.Error)
+		}
+		if strings.TrimSpace(r.Data) == "" {
+			return releases, nil
+		}
+		resp, err := ParseReleasesResponse(r.Data)
+		if err != nil {
+			return nil, err
+		}
+		for _, rel := range resp.Releases {
+			// Providers not aware of channels return all of them
+			if req.Channel != "" && rel.Channel != "" && rel.Channel != req.Channel {
+				continue
+			}
+			releases = append(releases, rel)
+		}
+		if resp.Continue == "" {
+			return releases, nil
+		}
+		if seen[resp.Continue] {
+			return nil, fmt.Errorf("continue token %q returned twice", resp.Continue)
+		}
+		seen[resp.Continue] = true
+		req.Continue = resp.Continue
+	}
+	return nil, fmt.Errorf("more than %d pages of releases", maxReleasesPages)
+}
+
+// DescribeProviderReleases is DescribeReleases for the releases returned by a provider, keeping their version,
+// channel and metadata. The registry annotations take precedence over the provider metadata.
+func DescribeProviderReleases(provider string, releases []ProviderRelease) []Release {
+	images := make([]string, 0, len(releases))
+	for _, r := range releases {
+		images = append(images, r.Image)
+	}
+	described := DescribeReleases(images)
+	for i, r := range releases {
+		described[i].Provider = provider
+		described[i].Version = r.Version
+		described[i].Channel = r.Channel
+		if len(r.Metadata) > 0 && described[i].Annotations == nil {
+			described[i].Annotations = map[string]string{}
+		}
+		for k, v := range r.Metadata {
+			if _, ok := described[i].Annotations[k]; !ok {
+				described[i].Annotations[k] = v
+			}
+		}
+	}
+	return described
+}
@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	"github.com/kairos-io/kairos-sdk/versioneer"
+	"gopkg.in/yaml.v3"
+)
+
+type cachedTags struct {
+	Tags []string  `yaml:"tags"`
+	Time time.Time `yaml:"time"`
+}
+
+// ReleasesCache lists the release tags from the registry and caches them on disk. The cached tags are served
+// when the registry can't be reached, or always in offline mode, so listing releases works on intermittently
+// connected nodes.
+type ReleasesCache struct {
+	Inspector versioneer.RegistryInspector
+	Offline   bool
+	// CachedAt is when the served tags were cached, zero if they come from the registry
+	CachedAt time.Time
+	fs       v1.FS
+	file     string
+}
+
+// NewReleasesCache returns a ReleasesCache listing the tags with the default registry inspector
+func NewReleasesCache(fs v1.FS, offline bool) *ReleasesCache {
+	return &ReleasesCache{
+		Inspector: &versioneer.DefaultRegistryInspector{},
+		Offline:   offline,
+		fs:        fs,
+		file:      constants.ReleasesCacheFile,
+	}
+}
+
+// FromCache is true if the last listed tags were served from the cache
+func (r *ReleasesCache) FromCache() bool {
+	return !r.CachedAt.IsZero()
+}
+
+// TagList implements versioneer.RegistryInspector
+func (r *ReleasesCache) TagList(registryAndOrg string, artifact *versioneer.Artifact) (versioneer.TagList, error) {
+	repo := artifact.Repository(registryAndOrg)
+	cache := r.read()
+	r.CachedAt = time.Time{}
+
+	if !r.Offline {
+		tl, err := r.Inspector.TagList(registryAndOrg, artifact)
+		if err == nil {
+			cache[repo] = cachedTags{Tags: tl.Tags, Time: time.Now()}
+			// Failing to cache is no reason to fail listing the releases
+			_ = r.write(cache)
+			return tl, nil
+		}
+		if _, ok := cache[repo]; !ok {
+			return tl, err
+		}
+	}
+
+	cached, ok := cache[repo]
+	if !ok {
+		return versioneer.TagList{}, fmt.Errorf("no cached releases for %s, list them once online", repo)
+	}
+	r.CachedAt = cached.Time
+	return versioneer.TagList{Tags: cached.Tags, Artifact: artifact, RegistryAndOrg: registryAndOrg}, nil
+}
+
+func (r *ReleasesCache) read() map[string]cachedTags {
+	cache := map[string]cachedTags{}
+	data, err := r.fs.ReadFile(r.file)
+	if err != nil {
+		return cache
+	}
+	if err = yaml.Unmarshal(data, &cache); err != nil {
+		return map[string]cachedTags{}
+	}
+	return cache
+}
+
+func (r *ReleasesCache) write(cache map[string]cachedTags) error {
+	data, err := yaml.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	if err = fsutils.MkdirAll(r.fs, filepath.Dir(r.file), constants.DirPerm); err != nil {
+		return err
+	}
+	return fsutils.AtomicWriteFile(r.fs, r.file, data, constants.FilePerm)
+}
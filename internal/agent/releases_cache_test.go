@@ -0,0 +1,76 @@
+package agent_test
+
+import (
+	"errors"
+
+	. "github.com/kairos-io/kairos-agent/v2/internal/agent"
+	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	"github.com/kairos-io/kairos-sdk/versioneer"
+	"github.com/twpayne/go-vfs/v5/vfst"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type fakeInspector struct {
+	tags  []string
+	err   error
+	calls int
+}
+
+func (f *fakeInspector) TagList(registryAndOrg string, artifact *versioneer.Artifact) (versioneer.TagList, error) {
+	f.calls++
+	return versioneer.TagList{Tags: f.tags, Artifact: artifact, RegistryAndOrg: registryAndOrg}, f.err
+}
+
+var _ = Describe("ReleasesCache", Label("releases"), func() {
+	var cache *ReleasesCache
+	var inspector *fakeInspector
+	var fs *vfst.TestFS
+	artifact := &versioneer.Artifact{Flavor: "ubuntu"}
+
+	BeforeEach(func() {
+		var cleanup func()
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(nil)
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(cleanup)
+		inspector = &fakeInspector{tags: []string{"v3.1.0", "v3.2.0"}}
+		cache = NewReleasesCache(fs, false)
+		cache.Inspector = inspector
+	})
+
+	It("caches the tags and serves them when the registry fails", func() {
+		tl, err := cache.TagList("quay.io/kairos", artifact)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tl.Tags).To(Equal([]string{"v3.1.0", "v3.2.0"}))
+		Expect(cache.FromCache()).To(BeFalse())
+		Expect(fs.ReadFile(constants.ReleasesCacheFile)).To(ContainSubstring("quay.io/kairos/ubuntu"))
+
+		inspector.tags, inspector.err = nil, errors.New("registry unreachable")
+		tl, err = cache.TagList("quay.io/kairos", artifact)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tl.Tags).To(Equal([]string{"v3.1.0", "v3.2.0"}))
+		Expect(tl.RegistryAndOrg).To(Equal("quay.io/kairos"))
+		Expect(cache.FromCache()).To(BeTrue())
+
+		// Other repositories are not cached
+		_, err = cache.TagList("ghcr.io/kairos", artifact)
+		Expect(err).To(MatchError("registry unreachable"))
+	})
+
+	It("doesn't ask the registry in offline mode", func() {
+		_, err := cache.TagList("quay.io/kairos", artifact)
+		Expect(err).ToNot(HaveOccurred())
+
+		cache.Offline = true
+		tl, err := cache.TagList("quay.io/kairos", artifact)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tl.Tags).To(HaveLen(2))
+		Expect(inspector.calls).To(Equal(1))
+		Expect(cache.CachedAt).ToNot(BeZero())
+
+		_, err = cache.TagList("ghcr.io/kairos", artifact)
+		Expect(err).To(MatchError(ContainSubstring("no cached releases for ghcr.io/kairos/ubuntu")))
+	})
+})
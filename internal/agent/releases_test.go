@@ -0,0 +1,148 @@
+package agent_test
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	. "github.com/kairos-io/kairos-agent/v2/internal/agent"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/mudler/go-pluggable"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DescribeReleases", Label("releases"), func() {
+	var server *httptest.Server
+	var repo string
+
+	BeforeEach(func() {
+		server = httptest.NewServer(registry.New())
+		repo = strings.TrimPrefix(server.URL, "http://") + "/kairos/ubuntu"
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("gets the digest, creation date, size and annotations of each release", func() {
+		img, err := random.Image(1024, 2)
+		Expect(err).ToNot(HaveOccurred())
+		cfg, err := img.ConfigFile()
+		Expect(err).ToNot(HaveOccurred())
+		cfg.Architecture = runtime.GOARCH
+		cfg.OS = "linux"
+		cfg.Created = v1.Time{Time: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)}
+		cfg.Config.Labels = map[string]string{"io.kairos.flavor": "ubuntu", "io.kairos.trusted-boot": "false"}
+		img, err = mutate.ConfigFile(img, cfg)
+		Expect(err).ToNot(HaveOccurred())
+		img = mutate.Annotations(img, map[string]string{"io.kairos.trusted-boot": "true"}).(v1.Image)
+		Expect(crane.Push(img, repo+":v3.1.0")).To(Succeed())
+
+		digest, err := img.Digest()
+		Expect(err).ToNot(HaveOccurred())
+		manifest, err := img.Manifest()
+		Expect(err).ToNot(HaveOccurred())
+
+		releases := DescribeReleases([]string{repo + ":v3.1.0", repo + ":v3.2.0"})
+		Expect(releases).To(HaveLen(2))
+
+		r := releases[0]
+		Expect(r.Error).To(BeEmpty())
+		Expect(r.Image).To(Equal(repo + ":v3.1.0"))
+		Expect(r.Tag).To(Equal("v3.1.0"))
+		Expect(r.Digest).To(Equal(digest.String()))
+		Expect(r.Created).ToNot(BeNil())
+		Expect(r.Created.Equal(cfg.Created.Time)).To(BeTrue())
+		Expect(r.Size).To(Equal(manifest.Config.Size + manifest.Layers[0].Size + manifest.Layers[1].Size))
+		Expect(r.Arch).To(Equal(runtime.GOARCH))
+		Expect(r.Annotations).To(HaveKeyWithValue("io.kairos.flavor", "ubuntu"))
+		// Manifest annotations take precedence over the labels
+		Expect(r.Annotations).To(HaveKeyWithValue("io.kairos.trusted-boot", "true"))
+
+		// Missing releases are reported but do not hide the rest
+		Expect(releases[1].Tag).To(Equal("v3.2.0"))
+		Expect(releases[1].Digest).To(BeEmpty())
+		Expect(releases[1].Error).ToNot(BeEmpty())
+	})
+})
+
+var _ = Describe("Release providers", Label("releases"), func() {
+	var dir string
+
+	// provider writes a provider answering EventAvailableReleases with the output of the given shell snippet, which
+	// gets the event json in $event
+	provider := func(name, script string) pluggable.Plugin {
+		path := filepath.Join(dir, "agent-provider-"+name)
+		content := "#!/bin/sh\nevent=$(cat)\n" + script + "\n"
+		Expect(os.WriteFile(path, []byte(content), 0755)).To(Succeed())
+		return pluggable.Plugin{Name: name, Executable: path}
+	}
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+	})
+
+	It("parses the versioned and the former responses", func() {
+		resp, err := ParseReleasesResponse(`{"apiVersion": "releases.kairos.io/v1", "releases": [{"image": "quay.io/kairos/ubuntu:v3.2.0", "channel": "stable", "metadata": {"trusted-boot": "false"}}], "continue": "2"}`)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resp.Releases).To(HaveLen(1))
+		Expect(resp.Releases[0].Metadata).To(HaveKeyWithValue("trusted-boot", "false"))
+		Expect(resp.Continue).To(Equal("2"))
+
+		resp, err = ParseReleasesResponse(`["quay.io/kairos/ubuntu:v3.2.0", "quay.io/kairos/ubuntu:v3.1.0"]`)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resp.Releases).To(HaveLen(2))
+		Expect(resp.Releases[1].Image).To(Equal("quay.io/kairos/ubuntu:v3.1.0"))
+	})
+
+	It("rejects responses not following the contract", func() {
+		_, err := ParseReleasesResponse(`{"apiVersion": "releases.kairos.io/v2", "releases": []}`)
+		Expect(err).To(MatchError(ContainSubstring("unsupported releases apiVersion")))
+		_, err = ParseReleasesResponse(`{"apiVersion": "releases.kairos.io/v1", "releases": [{"version": "v3.2.0"}]}`)
+		Expect(err).To(MatchError(ContainSubstring("has no image")))
+		_, err = ParseReleasesResponse(`{"apiVersion": "releases.kairos.io/v1", "releases": [{"image": "Not An Image"}]}`)
+		Expect(err).To(MatchError(ContainSubstring("invalid image")))
+		_, err = ParseReleasesResponse(`{"apiVersion": "releases.kairos.io/v1", "items": []}`)
+		Expect(err).To(MatchError(ContainSubstring("unknown field")))
+	})
+
+	It("falls back to the next provider and follows the pages in the requested channel", func() {
+		broken := provider("broken", `echo '{"data": "{\"apiVersion\": \"v0\"}"}'`)
+		empty := provider("empty", `echo '{"data": ""}'`)
+		paged := provider("paged", `case "$event" in
+*continue*) echo '{"data": "{\"apiVersion\": \"releases.kairos.io/v1\", \"releases\": [{\"image\": \"quay.io/kairos/ubuntu:v3.1.0\", \"channel\": \"stable\"}]}"}' ;;
+*channel*) echo '{"data": "{\"apiVersion\": \"releases.kairos.io/v1\", \"releases\": [{\"image\": \"quay.io/kairos/ubuntu:v3.2.0\", \"channel\": \"stable\"}, {\"image\": \"quay.io/kairos/ubuntu:v3.3.0-rc1\", \"channel\": \"edge\"}], \"continue\": \"2\"}"}' ;;
+*) echo '{"data": "[]"}' ;;
+esac`)
+		unused := provider("unused", `echo '{"data": "[\"quay.io/kairos/ubuntu:v1.0.0\"]"}'`)
+
+		name, releases := ProviderReleases([]pluggable.Plugin{broken, empty, paged, unused}, ReleasesRequest{Channel: "stable"})
+		Expect(name).To(Equal("paged"))
+		Expect(releases).To(HaveLen(2))
+		Expect(releases[0].Image).To(Equal("quay.io/kairos/ubuntu:v3.2.0"))
+		Expect(releases[1].Image).To(Equal("quay.io/kairos/ubuntu:v3.1.0"))
+	})
+
+	It("supports the providers returning the former list of images", func() {
+		legacy := provider("legacy", `echo '{"data": "[\"quay.io/kairos/ubuntu:v3.2.0\"]"}'`)
+		name, releases := ProviderReleases([]pluggable.Plugin{legacy}, ReleasesRequest{IncludePreReleases: true})
+		Expect(name).To(Equal("legacy"))
+		Expect(releases).To(Equal([]ProviderRelease{{Image: "quay.io/kairos/ubuntu:v3.2.0"}}))
+	})
+
+	It("stops following providers returning the same page forever", func() {
+		loop := provider("loop", `echo '{"data": "{\"apiVersion\": \"releases.kairos.io/v1\", \"releases\": [], \"continue\": \"1\"}"}'`)
+		name, releases := ProviderReleases([]pluggable.Plugin{loop}, ReleasesRequest{})
+		Expect(name).To(BeEmpty())
+		Expect(releases).To(BeEmpty())
+	})
+})
@@ -0,0 +1,156 @@
+package agent
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	config "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-sdk/collector"
+	"github.com/kairos-io/kairos-sdk/utils"
+)
+
+// reloadableKeys are the top level config keys that can be applied to the running agent without a restart. Each
+// one applies the key of the reloaded config to c, the copy of the running config about to replace it, and returns
+// false if the change still needs a restart.
+var reloadableKeys = map[string]func(c, reloaded *config.Config) bool{
+	"debug": func(c, reloaded *config.Config) bool {
+		c.Debug = reloaded.Debug
+		if c.Debug {
+			c.Logger.SetLevel("debug")
+		} else {
+			c.Logger.SetLevel("info")
+		}
+		return true
+	},
+	"env": func(c, reloaded *config.Config) bool {
+		c.Env = reloaded.Env
+		utils.SetEnv(c.Env)
+		return true
+	},
+	// The heartbeat url, interval, token and signing key apply from the next report. Enabling or disabling the
+	// heartbeat needs a restart, it's only started along with the daemon.
+	"heartbeat": func(c, reloaded *config.Config) bool {
+		if (c.Heartbeat == nil) != (reloaded.Heartbeat == nil) {
+			return false
+		}
+		c.Heartbeat = reloaded.Heartbeat
+		return true
+	},
+}
+
+// ConfigDiff holds the top level config keys that changed on a reload
+type ConfigDiff struct {
+	// Applied are the keys applied to the running agent
+	Applied []string
+	// Pending are the keys that changed but need an agent restart to be applied
+	Pending []string
+}
+
+// ConfigReloader re-scans the config directories of a running agent and applies the safe changes. The running
+// config is never modified, the reloads replace it with an updated copy, so the agent modules following the reloader
+// can read it while it's reloaded.
+type ConfigReloader struct {
+	mu      sync.Mutex
+	dirs    []string
+	current atomic.Pointer[config.Config]
+}
+
+// NewConfigReloader returns a ConfigReloader for the given running config and its config directories
+func NewConfigReloader(c *config.Config, dirs ...string) *ConfigReloader {
+	r := &ConfigReloader{dirs: dirs}
+	r.current.Store(c)
+	return r
+}
+
+// Config returns the running config, with the changes applied by the last reload
+func (r *ConfigReloader) Config() *config.Config {
+	return r.current.Load()
+}
+
+// Reload re-scans the config directories, diffs them against the running config and applies the safe changes
+func (r *ConfigReloader) Reload() (ConfigDiff, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	diff := ConfigDiff{}
+	reloaded, err := config.ScanNoLogs(collector.Directories(r.dirs...))
+	if err != nil {
+		return diff, err
+	}
+
+	current := r.current.Load()
+	next := *current
+	next.Config.Values = collector.ConfigValues{}
+	for k, v := range current.Config.Values {
+		next.Config.Values[k] = v
+	}
+	for _, key := range changedKeys(current.Config.Values, reloaded.Config.Values) {
+		apply, ok := reloadableKeys[key]
+		if !ok || !apply(&next, reloaded) {
+			diff.Pending = append(diff.Pending, key)
+			continue
+		}
+		if v, ok := reloaded.Config.Values[key]; ok {
+			next.Config.Values[key] = v
+		} else {
+			delete(next.Config.Values, key)
+		}
+		diff.Applied = append(diff.Applied, key)
+	}
+
+	if len(diff.Applied) > 0 {
+		r.current.Store(&next)
+		next.Logger.Infof("Config reloaded, applied changes: %v", diff.Applied)
+	}
+	if len(diff.Pending) > 0 {
+		next.Logger.Warnf("Config changes that need an agent restart: %v", diff.Pending)
+	}
+	return diff, nil
+}
+
+// Watch reloads the config each time the agent receives a SIGHUP, until the returned stop function is called
+func (r *ConfigReloader) Watch() (stop func()) {
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for {
+			select {
+			case <-signals:
+				if _, err := r.Reload(); err != nil {
+					r.Config().Logger.Errorf("Failed reloading config: %s", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// changedKeys returns the sorted top level keys that differ between both config values
+func changedKeys(before, after collector.ConfigValues) []string {
+	var keys []string
+	for k, v := range after {
+		if !reflect.DeepEqual(before[k], v) {
+			keys = append(keys, k)
+		}
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,69 @@
+package agent_test
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/kairos-io/kairos-agent/v2/internal/agent"
+	config "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-sdk/collector"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ConfigReloader", func() {
+	It("applies the safe changes and reports the rest", func() {
+		dir, err := os.MkdirTemp("", "reload")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, "config.yaml")
+
+		Expect(os.WriteFile(file, []byte("#cloud-config\nstrict: false\nfoo: bar\n"), 0644)).To(Succeed())
+		c, err := config.ScanNoLogs(collector.Directories(dir))
+		Expect(err).ToNot(HaveOccurred())
+
+		reloader := NewConfigReloader(c, dir)
+		diff, err := reloader.Reload()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(diff.Applied).To(BeEmpty())
+		Expect(diff.Pending).To(BeEmpty())
+
+		Expect(os.WriteFile(file, []byte("#cloud-config\nstrict: false\nfoo: baz\ndebug: true\n"), 0644)).To(Succeed())
+		diff, err = reloader.Reload()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(diff.Applied).To(Equal([]string{"debug"}))
+		Expect(diff.Pending).To(Equal([]string{"foo"}))
+		Expect(reloader.Config().Debug).To(BeTrue())
+		Expect(reloader.Config().Logger.GetLevel().String()).To(Equal("debug"))
+		// The running config is swapped, not modified, as the agent modules may be reading it
+		Expect(c.Debug).To(BeFalse())
+	})
+	It("reloads the heartbeat settings but not enabling it", func() {
+		dir, err := os.MkdirTemp("", "reload")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, "config.yaml")
+
+		Expect(os.WriteFile(file, []byte("#cloud-config\nstrict: false\nheartbeat:\n  url: https://fleet.example.com/status\n"), 0644)).To(Succeed())
+		c, err := config.ScanNoLogs(collector.Directories(dir))
+		Expect(err).ToNot(HaveOccurred())
+
+		reloader := NewConfigReloader(c, dir)
+		Expect(os.WriteFile(file, []byte("#cloud-config\nstrict: false\nheartbeat:\n  url: https://fleet2.example.com/status\n  interval: 1m\n"), 0644)).To(Succeed())
+		diff, err := reloader.Reload()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(diff.Applied).To(Equal([]string{"heartbeat"}))
+		Expect(reloader.Config().Heartbeat.URL).To(Equal("https://fleet2.example.com/status"))
+		Expect(reloader.Config().Heartbeat.Interval).To(Equal(time.Minute))
+		Expect(c.Heartbeat.URL).To(Equal("https://fleet.example.com/status"))
+
+		Expect(os.WriteFile(file, []byte("#cloud-config\nstrict: false\n"), 0644)).To(Succeed())
+		diff, err = reloader.Reload()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(diff.Applied).To(BeEmpty())
+		Expect(diff.Pending).To(Equal([]string{"heartbeat"}))
+		Expect(reloader.Config().Heartbeat).ToNot(BeNil())
+	})
+})
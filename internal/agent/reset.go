@@ -12,6 +12,7 @@ import (
 	hook "github.com/kairos-io/kairos-agent/v2/internal/agent/hooks"
 	"github.com/kairos-io/kairos-agent/v2/internal/bus"
 	"github.com/kairos-io/kairos-agent/v2/internal/cmd"
+	"github.com/kairos-io/kairos-agent/v2/internal/i18n"
 	"github.com/kairos-io/kairos-agent/v2/pkg/action"
 	"github.com/kairos-io/kairos-agent/v2/pkg/config"
 	sdk "github.com/kairos-io/kairos-sdk/bus"
@@ -22,19 +23,22 @@ import (
 	"github.com/mudler/go-pluggable"
 )
 
-func Reset(reboot, unattended, resetOem bool, dir ...string) error {
+func Reset(reboot, unattended, resetOem bool, restoreOEMBackup, oemBackupKey string, dir ...string) error {
 	// In both cases we want
 	if internalutils.UkiBootMode() == internalutils.UkiHDD {
+		if restoreOEMBackup != "" {
+			return fmt.Errorf("restoring an OEM backup on reset is not supported on trusted boot, run 'kairos-agent oem restore' after the reset")
+		}
 		return resetUki(reboot, unattended, resetOem, dir...)
 	} else if internalutils.UkiBootMode() == internalutils.UkiRemovableMedia {
 		return fmt.Errorf("reset is not supported on removable media, please run reset from the installed system recovery entry")
 	} else {
-		return reset(reboot, unattended, resetOem, dir...)
+		return reset(reboot, unattended, resetOem, restoreOEMBackup, oemBackupKey, dir...)
 	}
 }
 
-func reset(reboot, unattended, resetOem bool, dir ...string) error {
-	cfg, err := sharedReset(reboot, unattended, resetOem, dir...)
+func reset(reboot, unattended, resetOem bool, restoreOEMBackup, oemBackupKey string, dir ...string) error {
+	cfg, err := sharedReset(reboot, unattended, resetOem, restoreOEMBackup, oemBackupKey, dir...)
 	if err != nil {
 		return err
 	}
@@ -53,6 +57,8 @@ func reset(reboot, unattended, resetOem bool, dir ...string) error {
 		return err
 	}
 
+	// Created before resetting, so the credentials are read before the OEM partition is reset
+	reenroll := NewReenroll(cfg)
 	resetAction := action.NewResetAction(cfg, resetSpec)
 	if err = resetAction.Run(); err != nil {
 		cfg.Logger.Errorf("failed to reset: %s", err)
@@ -60,12 +66,16 @@ func reset(reboot, unattended, resetOem bool, dir ...string) error {
 	}
 
 	bus.Manager.Publish(sdk.EventAfterReset, sdk.EventPayload{}) //nolint:errcheck
+	// The reset already succeeded, a failed re-enrollment does not fail it
+	if err = reenroll.Run(resetState(cfg, resetSpec.FormatPersistent, resetSpec.FormatOEM)); err != nil {
+		cfg.Logger.Warnf("Could not re-enroll the node: %s", err)
+	}
 
 	return hook.Run(*cfg, resetSpec, hook.AfterReset...)
 }
 
 func resetUki(reboot, unattended, resetOem bool, dir ...string) error {
-	cfg, err := sharedReset(reboot, unattended, resetOem, dir...)
+	cfg, err := sharedReset(reboot, unattended, resetOem, "", "", dir...)
 	if err != nil {
 		return err
 	}
@@ -84,6 +94,8 @@ func resetUki(reboot, unattended, resetOem bool, dir ...string) error {
 		return err
 	}
 
+	// Created before resetting, so the credentials are read before the OEM partition is reset
+	reenroll := NewReenroll(cfg)
 	resetAction := uki.NewResetAction(cfg, resetSpec)
 	if err = resetAction.Run(); err != nil {
 		cfg.Logger.Errorf("failed to reset uki: %s", err)
@@ -91,13 +103,17 @@ func resetUki(reboot, unattended, resetOem bool, dir ...string) error {
 	}
 
 	bus.Manager.Publish(sdk.EventAfterReset, sdk.EventPayload{}) //nolint:errcheck
+	// The reset already succeeded, a failed re-enrollment does not fail it
+	if err = reenroll.Run(resetState(cfg, resetSpec.FormatPersistent, resetSpec.FormatOEM)); err != nil {
+		cfg.Logger.Warnf("Could not re-enroll the node: %s", err)
+	}
 
 	return hook.Run(*cfg, resetSpec, hook.AfterReset...)
 }
 
 // sharedReset is the common reset code for both uki and non-uki
 // sets the config, runs the event handler, publish the envent and gets the config
-func sharedReset(reboot, unattended, resetOem bool, dir ...string) (c *config.Config, err error) {
+func sharedReset(reboot, unattended, resetOem bool, restoreOEMBackup, oemBackupKey string, dir ...string) (c *config.Config, err error) {
 	bus.Manager.Initialize()
 	var optionsFromEvent map[string]string
 
@@ -123,7 +139,7 @@ func sharedReset(reboot, unattended, resetOem bool, dir ...string) (c *config.Co
 			}
 
 			lock.Lock()
-			fmt.Println("Reset aborted")
+			fmt.Println(i18n.T("reset.aborted"))
 			panic(utils.Shell().Run())
 		}()
 
@@ -159,6 +175,9 @@ func sharedReset(reboot, unattended, resetOem bool, dir ...string) (c *config.Co
 		r.Reset.Reboot = true
 	}
 
+	r.Reset.RestoreOEMBackup = restoreOEMBackup
+	r.Reset.OEMBackupKey = oemBackupKey
+
 	// Override the config with the event options
 	// Go over the possible options sent via event
 	if len(optionsFromEvent) > 0 {
@@ -198,8 +217,10 @@ func sharedReset(reboot, unattended, resetOem bool, dir ...string) (c *config.Co
 // ExtraConfigReset is the struct that holds the reset options that come from flags and events
 type ExtraConfigReset struct {
 	Reset struct {
-		ResetOem        bool `json:"reset-oem,omitempty"`
-		ResetPersistent bool `json:"reset-persistent,omitempty"`
-		Reboot          bool `json:"reboot,omitempty"`
+		ResetOem         bool   `json:"reset-oem,omitempty"`
+		ResetPersistent  bool   `json:"reset-persistent,omitempty"`
+		Reboot           bool   `json:"reboot,omitempty"`
+		RestoreOEMBackup string `json:"restore-oem-backup,omitempty"`
+		OEMBackupKey     string `json:"oem-backup-key,omitempty"`
 	} `json:"reset"`
 }
@@ -0,0 +1,243 @@
+package agent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/action"
+	config "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils"
+)
+
+const (
+	// evKey is the EV_KEY input event type, keyRestart the KEY_RESTART key code
+	evKey      = 1
+	keyRestart = 408
+
+	defaultResetButtonHold      = 10 * time.Second
+	defaultResetButtonCountdown = 10 * time.Second
+	gpioPollInterval            = 50 * time.Millisecond
+	// inputReadTimeout is how long a read of the input event device waits before checking if it has to stop
+	inputReadTimeout = 500 * time.Millisecond
+)
+
+// inputEventSize is the size of the kernel struct input_event, which starts with a timeval
+var inputEventSize = int(unsafe.Sizeof(syscall.Timeval{})) + 8
+
+// ResetButtonWatcher triggers a staged factory reset when the configured button is held down
+type ResetButtonWatcher struct {
+	cfg    *config.Config
+	button config.ResetButton
+	// reloader is the reloader of the running config, if the watcher follows it
+	reloader *ConfigReloader
+	// Console is where the countdown is shown
+	Console io.Writer
+	// Trigger stages the factory reset, by default it sets the statereset entry for the next boot and reboots
+	Trigger func() error
+}
+
+// NewResetButtonWatcher returns a ResetButtonWatcher for the reset button in the config
+func NewResetButtonWatcher(c *config.Config) *ResetButtonWatcher {
+	w := &ResetButtonWatcher{cfg: c, Console: os.Stdout}
+	if c.ResetButton != nil {
+		w.button = *c.ResetButton
+	}
+	if w.button.Key == 0 {
+		w.button.Key = keyRestart
+	}
+	if w.button.Hold == 0 {
+		w.button.Hold = defaultResetButtonHold
+	}
+	if w.button.Countdown == 0 {
+		w.button.Countdown = defaultResetButtonCountdown
+	}
+	if console, err := os.OpenFile("/dev/console", os.O_WRONLY, 0); err == nil {
+		w.Console = io.MultiWriter(os.Stdout, console)
+	}
+	w.Trigger = w.stageFactoryReset
+	return w
+}
+
+// Follow makes the watcher log and reset with the reloads of the running config
+func (w *ResetButtonWatcher) Follow(r *ConfigReloader) *ResetButtonWatcher {
+	w.reloader = r
+	return w
+}
+
+// running returns the running config, reloaded if the watcher follows a reloader
+func (w *ResetButtonWatcher) running() *config.Config {
+	if w.reloader != nil {
+		return w.reloader.Config()
+	}
+	return w.cfg
+}
+
+// Run watches the button until stop is closed. It only returns early if the button cannot be read.
+func (w *ResetButtonWatcher) Run(stop <-chan struct{}) error {
+	states := make(chan bool)
+	errs := make(chan error, 1)
+	switch {
+	case w.button.Device != "":
+		f, err := os.Open(w.button.Device)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		go func() { errs <- w.readInputEvents(f, states, stop) }()
+	case w.button.GPIO != "":
+		go func() { errs <- w.pollGPIO(w.button.GPIO, states, stop) }()
+	default:
+		return fmt.Errorf("reset_button needs either a device or a gpio")
+	}
+
+	w.running().Logger.Infof("Watching the reset button, hold it %s to factory reset", w.button.Hold)
+	var hold <-chan time.Time
+	for {
+		select {
+		case <-stop:
+			// Give the reader the time to stop before the device is closed
+			select {
+			case <-errs:
+			case <-time.After(2 * inputReadTimeout):
+			}
+			return nil
+		case err := <-errs:
+			return err
+		case pressed := <-states:
+			if pressed {
+				hold = time.After(w.button.Hold)
+			} else {
+				hold = nil
+			}
+		case <-hold:
+			hold = nil
+			if !w.countdown(states, stop) {
+				continue
+			}
+			if err := w.Trigger(); err != nil {
+				w.running().Logger.Errorf("Failed staging the factory reset: %s", err)
+				fmt.Fprintf(w.Console, "Factory reset failed: %s\n", err)
+			}
+		}
+	}
+}
+
+// countdown shows the remaining time before the reset on the console, it returns false if the button
+// is pressed again to cancel it
+func (w *ResetButtonWatcher) countdown(states <-chan bool, stop <-chan struct{}) bool {
+	w.running().Logger.Warnf("Reset button held for %s, factory reset in %s", w.button.Hold, w.button.Countdown)
+	// Wait for the button to be released, pressing it again cancels the reset
+	released := false
+	deadline := time.Now().Add(w.button.Countdown)
+	for remaining := w.button.Countdown; remaining > 0; remaining = time.Until(deadline) {
+		fmt.Fprintf(w.Console, "Factory reset in %d seconds, press the reset button to cancel\n", int((remaining+time.Second-1)/time.Second))
+		tick := time.After(min(remaining, time.Second))
+	wait:
+		for {
+			select {
+			case <-stop:
+				return false
+			case pressed := <-states:
+				if !pressed {
+					released = true
+				} else if released {
+					fmt.Fprintln(w.Console, "Factory reset cancelled")
+					w.running().Logger.Info("Factory reset cancelled with the reset button")
+					return false
+				}
+			case <-tick:
+				break wait
+			}
+		}
+	}
+	fmt.Fprintln(w.Console, "Rebooting into factory reset")
+	return true
+}
+
+// stageFactoryReset boots the statereset entry, which resets the system, on the next boot and reboots
+func (w *ResetButtonWatcher) stageFactoryReset() error {
+	if err := action.SelectBootEntry(w.cfg, constants.StateResetImgName); err != nil {
+		return err
+	}
+	return utils.Reboot(w.running().Runner, 0)
+}
+
+// readInputEvents sends the state changes of the button key read from the input event device. Reads time out to
+// check whether to stop if the device supports deadlines, as input devices do.
+func (w *ResetButtonWatcher) readInputEvents(r io.Reader, states chan<- bool, stop <-chan struct{}) error {
+	deadline, _ := r.(interface{ SetReadDeadline(time.Time) error })
+	buf := make([]byte, inputEventSize)
+	for n := 0; ; n = 0 {
+		for n < inputEventSize {
+			if deadline != nil {
+				if err := deadline.SetReadDeadline(time.Now().Add(inputReadTimeout)); err != nil {
+					deadline = nil
+				}
+			}
+			read, err := r.Read(buf[n:])
+			n += read
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				select {
+				case <-stop:
+					return nil
+				default:
+					continue
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("reading %s: %w", w.button.Device, err)
+			}
+		}
+		ev := buf[inputEventSize-8:]
+		evType := binary.NativeEndian.Uint16(ev[0:2])
+		code := binary.NativeEndian.Uint16(ev[2:4])
+		value := int32(binary.NativeEndian.Uint32(ev[4:8]))
+		// value is 0 on release, 1 on press and 2 on autorepeat
+		if evType != evKey || code != w.button.Key || value == 2 {
+			continue
+		}
+		select {
+		case states <- value == 1:
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// pollGPIO sends the state changes of the GPIO value file
+func (w *ResetButtonWatcher) pollGPIO(path string, states chan<- bool, stop <-chan struct{}) error {
+	last := false
+	t := time.NewTicker(gpioPollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-t.C:
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		pressed := strings.TrimSpace(string(data)) == "1"
+		if w.button.ActiveLow {
+			pressed = !pressed
+		}
+		if pressed != last {
+			last = pressed
+			select {
+			case states <- pressed:
+			case <-stop:
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package agent_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	. "github.com/kairos-io/kairos-agent/v2/internal/agent"
+	config "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-sdk/collector"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// syncBuffer is a bytes.Buffer safe to write from the watcher and read from the test
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+var _ = Describe("ResetButtonWatcher", func() {
+	var gpio string
+	var watcher *ResetButtonWatcher
+	var console *syncBuffer
+	var triggered chan struct{}
+	var stop chan struct{}
+	var cleanup func()
+
+	BeforeEach(func() {
+		dir, err := os.MkdirTemp("", "reset-button")
+		Expect(err).ToNot(HaveOccurred())
+		cleanup = func() { os.RemoveAll(dir) }
+		gpio = filepath.Join(dir, "value")
+		Expect(os.WriteFile(gpio, []byte("1\n"), 0644)).To(Succeed())
+
+		c, err := config.ScanNoLogs(collector.Readers(strings.NewReader(fmt.Sprintf(`#cloud-config
+reset_button:
+  gpio: %s
+  active-low: true
+  hold: 200ms
+  countdown: 1s
+`, gpio))))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c.ResetButton.Hold).To(Equal(200 * time.Millisecond))
+
+		console = &syncBuffer{}
+		triggered = make(chan struct{}, 1)
+		watcher = NewResetButtonWatcher(c)
+		watcher.Console = console
+		watcher.Trigger = func() error {
+			triggered <- struct{}{}
+			return nil
+		}
+		stop = make(chan struct{})
+		go func() { defer GinkgoRecover(); Expect(watcher.Run(stop)).To(Succeed()) }()
+	})
+
+	AfterEach(func() {
+		close(stop)
+		cleanup()
+	})
+
+	It("stages the reset once the button is held down and the countdown ends", func() {
+		Expect(os.WriteFile(gpio, []byte("0\n"), 0644)).To(Succeed())
+		Eventually(triggered, 3*time.Second).Should(Receive())
+		Expect(console.String()).To(ContainSubstring("Factory reset in 1 seconds"))
+	})
+	It("cancels the reset when the button is pressed again during the countdown", func() {
+		Expect(os.WriteFile(gpio, []byte("0\n"), 0644)).To(Succeed())
+		Eventually(console.String, 2*time.Second).Should(ContainSubstring("Factory reset in"))
+		Expect(os.WriteFile(gpio, []byte("1\n"), 0644)).To(Succeed())
+		time.Sleep(200 * time.Millisecond)
+		Expect(os.WriteFile(gpio, []byte("0\n"), 0644)).To(Succeed())
+		Eventually(console.String, 2*time.Second).Should(ContainSubstring("Factory reset cancelled"))
+		Consistently(triggered, 1500*time.Millisecond).ShouldNot(Receive())
+	})
+	It("does not reset on a short press", func() {
+		Expect(os.WriteFile(gpio, []byte("0\n"), 0644)).To(Succeed())
+		time.Sleep(100 * time.Millisecond)
+		Expect(os.WriteFile(gpio, []byte("1\n"), 0644)).To(Succeed())
+		Consistently(triggered, 1500*time.Millisecond).ShouldNot(Receive())
+		Expect(console.String()).To(BeEmpty())
+	})
+})
+
+var _ = Describe("ResetButtonWatcher input device", func() {
+	It("reads the key events and stops reading once stopped", func() {
+		dir := GinkgoT().TempDir()
+		device := filepath.Join(dir, "event0")
+		Expect(syscall.Mkfifo(device, 0600)).To(Succeed())
+
+		c, err := config.ScanNoLogs(collector.Readers(strings.NewReader(fmt.Sprintf(`#cloud-config
+reset_button:
+  device: %s
+  hold: 100ms
+  countdown: 5s
+`, device))))
+		Expect(err).ToNot(HaveOccurred())
+		console := &syncBuffer{}
+		watcher := NewResetButtonWatcher(c)
+		watcher.Console = console
+		watcher.Trigger = func() error { return nil }
+
+		stop := make(chan struct{})
+		done := make(chan error, 1)
+		go func() { done <- watcher.Run(stop) }()
+		// Opening the writer end waits for the watcher to open the device, it's kept open so reads block
+		w, err := os.OpenFile(device, os.O_WRONLY, 0)
+		Expect(err).ToNot(HaveOccurred())
+		defer w.Close()
+
+		event := make([]byte, int(unsafe.Sizeof(syscall.Timeval{}))+8)
+		ev := event[len(event)-8:]
+		binary.NativeEndian.PutUint16(ev[0:2], 1)
+		binary.NativeEndian.PutUint16(ev[2:4], 408)
+		binary.NativeEndian.PutUint32(ev[4:8], 1)
+		_, err = w.Write(event)
+		Expect(err).ToNot(HaveOccurred())
+		Eventually(console.String, 2*time.Second).Should(ContainSubstring("Factory reset in"))
+
+		// Releasing the button cancels the countdown, then the idle device must not keep the watcher running
+		binary.NativeEndian.PutUint32(ev[4:8], 0)
+		_, err = w.Write(event)
+		Expect(err).ToNot(HaveOccurred())
+		binary.NativeEndian.PutUint32(ev[4:8], 1)
+		_, err = w.Write(event)
+		Expect(err).ToNot(HaveOccurred())
+		Eventually(console.String, 2*time.Second).Should(ContainSubstring("Factory reset cancelled"))
+
+		close(stop)
+		Eventually(done, 900*time.Millisecond).Should(Receive(BeNil()))
+	})
+})
@@ -7,18 +7,20 @@ import (
 	"strings"
 
 	hook "github.com/kairos-io/kairos-agent/v2/internal/agent/hooks"
-	"github.com/mudler/go-pluggable"
 
 	"github.com/kairos-io/kairos-agent/v2/internal/bus"
+	"github.com/kairos-io/kairos-agent/v2/internal/i18n"
 	"github.com/kairos-io/kairos-agent/v2/pkg/action"
 	config "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
 	"github.com/kairos-io/kairos-agent/v2/pkg/uki"
 	internalutils "github.com/kairos-io/kairos-agent/v2/pkg/utils"
 	k8sutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/k8s"
-	events "github.com/kairos-io/kairos-sdk/bus"
 	"github.com/kairos-io/kairos-sdk/collector"
 	"github.com/kairos-io/kairos-sdk/utils"
 	"github.com/kairos-io/kairos-sdk/versioneer"
+	"github.com/twpayne/go-vfs/v5"
 )
 
 func CurrentImage() (string, error) {
@@ -35,10 +37,12 @@ func CurrentImage() (string, error) {
 	return artifact.ContainerName(registryAndOrg)
 }
 
-func ListAllReleases(includePrereleases bool) ([]string, error) {
+// ListAllReleases lists the releases of the running artifact, using the given inspector to list the registry
+// tags. A nil inspector lists them straight from the registry.
+func ListAllReleases(includePrereleases bool, inspector versioneer.RegistryInspector) ([]string, error) {
 	var err error
 
-	tagList, err := allReleases()
+	tagList, err := allReleases(inspector)
 	if err != nil {
 		return []string{}, err
 	}
@@ -50,10 +54,11 @@ func ListAllReleases(includePrereleases bool) ([]string, error) {
 	return tagList.FullImages()
 }
 
-func ListNewerReleases(includePrereleases bool) ([]string, error) {
+// ListNewerReleases lists the releases newer than the running artifact, like ListAllReleases
+func ListNewerReleases(includePrereleases bool, inspector versioneer.RegistryInspector) ([]string, error) {
 	var err error
 
-	tagList, err := newerReleases()
+	tagList, err := newerReleases(inspector)
 	if err != nil {
 		return []string{}, err
 	}
@@ -65,49 +70,190 @@ func ListNewerReleases(includePrereleases bool) ([]string, error) {
 	return tagList.FullImages()
 }
 
-// TODO: Check where force and preReleases is being used? They dont seem to be used anywhere?
+// TODO: Check where preReleases is being used? It doesnt seem to be used anywhere?
 func Upgrade(
-	source string, force, strictValidations bool, dirs []string, upgradeEntry string, preReleases bool) error {
+	source string, force, skipApproval, strictValidations bool, dirs []string, upgradeEntry string, preReleases, deferRecovery, delta bool) error {
 	bus.Manager.Initialize()
 
+	fixedDirs, hostdir := hostConfigDirs(dirs)
+	if pinned, err := skipPinned(hostdir, force); err != nil || pinned {
+		return err
+	}
+
+	if internalutils.UkiBootMode() == internalutils.UkiHDD {
+		return upgradeUki(source, fixedDirs, upgradeEntry, strictValidations, skipApproval)
+	} else {
+		return upgrade(source, fixedDirs, upgradeEntry, strictValidations, deferRecovery, force, skipApproval, delta)
+	}
+}
+
+// UpgradeTransaction upgrades the active image as a single transaction: the bootloader state is snapshotted, the new
+// image is downloaded and applied, and the system reboots into it with the watchdog armed. If the upgraded system
+// does not report healthy and falls back, the previous image and the bootloader snapshot are restored on boot.
+func UpgradeTransaction(source string, force, skipApproval, strictValidations bool, dirs []string, deferRecovery, delta bool) error {
+	bus.Manager.Initialize()
+
+	fixedDirs, hostdir := hostConfigDirs(dirs)
+	if pinned, err := skipPinned(hostdir, force); err != nil || pinned {
+		return err
+	}
+	if internalutils.UkiBootMode() == internalutils.UkiHDD {
+		return fmt.Errorf("--rollback-on-failure is not supported in trusted boot mode, failed entries are rolled back by the boot assessment")
+	}
+
+	c, upgradeSpec, err := upgradeSpecFor(source, fixedDirs, "", strictValidations, deferRecovery, force, delta)
+	if err != nil {
+		return err
+	}
+	if err = checkUpgradeApproval(c, upgradeSpec.TargetImage().Source, upgradeSpec.Entry, skipApproval); err != nil {
+		return err
+	}
+	// The rollback relies on the watchdog, armed with its defaults if not configured
+	if c.Watchdog == nil {
+		c.Watchdog = &config.Watchdog{}
+	}
+
+	t, err := action.BeginUpgradeTransaction(c, upgradeSpec.TargetImage().Source.String(), force)
+	if err != nil {
+		return err
+	}
+	stopProgress := publishUpgradeProgress(c)
+	defer stopProgress()
+	c.Progress = t.Reporter(c, c.Progress)
+	upgradeAction := action.NewUpgradeAction(c, upgradeSpec)
+	if err = upgradeAction.Run(); err != nil {
+		return action.FailUpgradeTransaction(c, t, err)
+	}
+	deployed := upgradeAction.Deployed()
+	t.Expected = &deployed
+	// The transaction reboots on its own, the after upgrade lifecycle hooks don't apply
+	return action.RebootUpgradeTransaction(c, t)
+}
+
+// VerifyUpgrade checks the booted system is the one deployed by the last upgrade transaction and commits it,
+// publishing the verification on the bus for the orchestrators waiting on the upgrade
+func VerifyUpgrade(dirs []string) (*action.UpgradeVerification, error) {
+	bus.Manager.Initialize()
+	c, err := config.Scan(collector.Directories(dirs...), collector.NoLogs)
+	if err != nil {
+		return nil, err
+	}
+	v, err := action.VerifyUpgradeTransaction(c)
+	if err != nil {
+		return v, err
+	}
+	if _, err = bus.Manager.Publish(bus.EventUpgradeVerified, v); err != nil {
+		c.Logger.Warnf("Could not publish the upgrade verification: %s", err)
+	}
+	return v, nil
+}
+
+// RunUpgradeTransactionCheck commits or rolls back the upgrade transaction being assessed, if any
+func RunUpgradeTransactionCheck(dirs []string) error {
+	c, err := config.Scan(collector.Directories(dirs...), collector.NoLogs)
+	if err != nil {
+		return err
+	}
+	return action.CheckUpgradeTransaction(c)
+}
+
+// skipPinned returns true if the system is pinned and the upgrade is not forced, pinned systems are only upgraded
+// if forced
+func skipPinned(hostdir string, force bool) (bool, error) {
+	pin, err := action.ReadPin(vfs.OSFS, filepath.Join(hostdir, constants.PinFile))
+	if err != nil {
+		return false, err
+	}
+	if pin != nil && !force {
+		fmt.Println(i18n.T("upgrade.pinned", pin.Entry, pin.Date))
+		return true, nil
+	}
+	return false, nil
+}
+
+// hostConfigDirs fixes the config dirs if we are under k8s, so we read the actual running system configs instead of
+// only the container configs. It returns the host dir too, empty if not under k8s.
+func hostConfigDirs(dirs []string) ([]string, string) {
 	fixedDirs := make([]string, len(dirs))
-	// Check and fix dirs if we are under k8s, so we read the actual running system configs instead of only
-	// the container configs
 	// we can run it blindly as it will return an empty string if not under k8s
 	hostdir := k8sutils.GetHostDirForK8s()
 	for _, dir := range dirs {
 		fixedDirs = append(fixedDirs, filepath.Join(hostdir, dir))
 	}
+	return fixedDirs, hostdir
+}
 
+// PlanUpgrade resolves and sanitizes the upgrade spec like Upgrade does, including the image size calculations, and
+// returns what the upgrade would do without writing anything
+func PlanUpgrade(source string, force, strictValidations bool, dirs []string, upgradeEntry string, deferRecovery, delta bool) (*action.UpgradePlan, error) {
+	fixedDirs, _ := hostConfigDirs(dirs)
 	if internalutils.UkiBootMode() == internalutils.UkiHDD {
-		return upgradeUki(source, fixedDirs, upgradeEntry, strictValidations)
-	} else {
-		return upgrade(source, fixedDirs, upgradeEntry, strictValidations)
+		c, err := getConfig(source, fixedDirs, upgradeEntry, strictValidations)
+		if err != nil {
+			return nil, err
+		}
+		upgradeSpec, err := config.ReadUkiUpgradeSpecFromConfig(c)
+		if err != nil {
+			return nil, err
+		}
+		if err = upgradeSpec.Sanitize(); err != nil {
+			return nil, err
+		}
+		return action.NewUkiUpgradePlan(c, constants.UkiEfiDir, upgradeSpec)
+	}
+	c, upgradeSpec, err := upgradeSpecFor(source, fixedDirs, upgradeEntry, strictValidations, deferRecovery, force, delta)
+	if err != nil {
+		return nil, err
 	}
+	return action.NewUpgradePlan(c, upgradeSpec), nil
 }
 
-func upgrade(sourceImageURL string, dirs []string, upgradeEntry string, strictValidations bool) error {
+// upgradeSpecFor reads the config and the upgrade spec with the given overrides and sanitizes it
+func upgradeSpecFor(sourceImageURL string, dirs []string, upgradeEntry string, strictValidations, deferRecovery, force, delta bool) (*config.Config, *v1.UpgradeSpec, error) {
 	c, err := getConfig(sourceImageURL, dirs, upgradeEntry, strictValidations)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	utils.SetEnv(c.Env)
 
 	err = c.CheckForUsers()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	// Load the upgrade Config from the system
 	upgradeSpec, err := config.ReadUpgradeSpecFromConfig(c)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	if deferRecovery {
+		upgradeSpec.DeferRecovery = true
+	}
+	if force {
+		upgradeSpec.Force = true
+	}
+	if delta {
+		upgradeSpec.Delta = true
 	}
 	err = upgradeSpec.Sanitize()
 	if err != nil {
+		return nil, nil, err
+	}
+	return c, upgradeSpec, nil
+}
+
+func upgrade(sourceImageURL string, dirs []string, upgradeEntry string, strictValidations, deferRecovery, force, skipApproval, delta bool) error {
+	c, upgradeSpec, err := upgradeSpecFor(sourceImageURL, dirs, upgradeEntry, strictValidations, deferRecovery, force, delta)
+	if err != nil {
+		return err
+	}
+
+	if err = checkUpgradeApproval(c, upgradeSpec.TargetImage().Source, upgradeSpec.Entry, skipApproval); err != nil {
 		return err
 	}
 
+	stopProgress := publishUpgradeProgress(c)
+	defer stopProgress()
 	upgradeAction := action.NewUpgradeAction(c, upgradeSpec)
 
 	err = upgradeAction.Run()
@@ -118,7 +264,7 @@ func upgrade(sourceImageURL string, dirs []string, upgradeEntry string, strictVa
 	return hook.Run(*c, upgradeSpec, hook.AfterUpgrade...)
 }
 
-func upgradeUki(sourceImageURL string, dirs []string, upgradeEntry string, strictValidations bool) error {
+func upgradeUki(sourceImageURL string, dirs []string, upgradeEntry string, strictValidations, skipApproval bool) error {
 	c, err := getConfig(sourceImageURL, dirs, upgradeEntry, strictValidations)
 	if err != nil {
 		return err
@@ -141,9 +287,18 @@ func upgradeUki(sourceImageURL string, dirs []string, upgradeEntry string, stric
 		return err
 	}
 
+	if err = checkUpgradeApproval(c, upgradeSpec.Active.Source, upgradeSpec.Entry, skipApproval); err != nil {
+		return err
+	}
+
+	stopProgress := publishUpgradeProgress(c)
+	defer stopProgress()
+	// The trusted boot upgrade only reports when it starts and ends
+	progress := internalutils.NewProgress(c, "upgrade")
 	upgradeAction := uki.NewUpgradeAction(c, upgradeSpec)
 
 	err = upgradeAction.Run()
+	progress.Done(err)
 	if err != nil {
 		return err
 	}
@@ -151,6 +306,34 @@ func upgradeUki(sourceImageURL string, dirs []string, upgradeEntry string, stric
 	return hook.Run(*c, upgradeSpec, hook.AfterUpgrade...)
 }
 
+// RunRecoveryJob runs the deferred recovery rebuild, if any. Its disk IO is throttled to the idle class unless
+// other limits are configured.
+func RunRecoveryJob(dirs []string) error {
+	c, err := config.Scan(collector.Directories(dirs...), collector.NoLogs)
+	if err != nil {
+		return err
+	}
+	return action.RunRecoveryJob(c, func(source string) error {
+		rc, err := getConfig(source, dirs, constants.BootEntryRecovery, false)
+		if err != nil {
+			return err
+		}
+		upgradeSpec, err := config.ReadUpgradeSpecFromConfig(rc)
+		if err != nil {
+			return err
+		}
+		// This is the deferred rebuild itself
+		upgradeSpec.DeferRecovery = false
+		if upgradeSpec.IOLimit.Class == "" && upgradeSpec.IOLimit.Bandwidth == 0 {
+			upgradeSpec.IOLimit.Class = constants.IOClassIdle
+		}
+		if err = upgradeSpec.Sanitize(); err != nil {
+			return err
+		}
+		return action.NewUpgradeAction(rc, upgradeSpec).Run()
+	})
+}
+
 func getConfig(sourceImageURL string, dirs []string, upgradeEntry string, strictValidations bool) (*config.Config, error) {
 	cliConf, err := generateUpgradeConfForCLIArgs(sourceImageURL, upgradeEntry)
 	if err != nil {
@@ -167,11 +350,12 @@ func getConfig(sourceImageURL string, dirs []string, upgradeEntry string, strict
 
 }
 
-func allReleases() (versioneer.TagList, error) {
+func allReleases(inspector versioneer.RegistryInspector) (versioneer.TagList, error) {
 	artifact, err := versioneer.NewArtifactFromOSRelease()
 	if err != nil {
 		return versioneer.TagList{}, err
 	}
+	artifact.RegistryInspector = inspector
 
 	registryAndOrg, err := utils.OSRelease("REGISTRY_AND_ORG")
 	if err != nil {
@@ -186,11 +370,12 @@ func allReleases() (versioneer.TagList, error) {
 	return tagList.OtherAnyVersion().RSorted(), nil
 }
 
-func newerReleases() (versioneer.TagList, error) {
+func newerReleases(inspector versioneer.RegistryInspector) (versioneer.TagList, error) {
 	artifact, err := versioneer.NewArtifactFromOSRelease()
 	if err != nil {
 		return versioneer.TagList{}, err
 	}
+	artifact.RegistryInspector = inspector
 
 	registryAndOrg, err := utils.OSRelease("REGISTRY_AND_ORG")
 	if err != nil {
@@ -226,26 +411,6 @@ func generateUpgradeConfForCLIArgs(source, upgradeEntry string) (string, error)
 	return string(d), err
 }
 
-func getReleasesFromProvider(includePrereleases bool) ([]string, error) {
-	var result []string
-	bus.Manager.Response(events.EventAvailableReleases, func(p *pluggable.Plugin, r *pluggable.EventResponse) {
-		if r.Data == "" {
-			return
-		}
-		if err := json.Unmarshal([]byte(r.Data), &result); err != nil {
-			fmt.Printf("warn: failed unmarshalling data: '%s'\n", err.Error())
-		}
-	})
-
-	configYAML := "IncludePreReleases: true"
-	_, err := bus.Manager.Publish(events.EventAvailableReleases, events.EventPayload{Config: configYAML})
-	if err != nil {
-		return result, fmt.Errorf("failed publishing event: %w", err)
-	}
-
-	return result, nil
-}
-
 // ExtraConfigUpgrade is the struct that holds the upgrade options that come from flags and events
 type ExtraConfigUpgrade struct {
 	Upgrade struct {
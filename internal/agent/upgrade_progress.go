@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kairos-io/kairos-agent/v2/internal/bus"
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	internalutils "github.com/kairos-io/kairos-agent/v2/pkg/utils"
+)
+
+// upgradeProgressInterval is how often the progress of the running upgrade is published again, so the bytes
+// downloaded are updated during the long phases
+var upgradeProgressInterval = 5 * time.Second
+
+// UpgradeProgress is the payload of the upgrade progress events
+type UpgradeProgress struct {
+	// Action is upgrade or upgrade-recovery
+	Action string `json:"action"`
+	Phase  string `json:"phase"`
+	// Percent is the percent of the upgrade done when the phase started
+	Percent int `json:"percent"`
+	// Bytes are the bytes pulled from the registries so far
+	Bytes   int64  `json:"bytes"`
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// upgradeProgress publishes the progress records of the upgrade on the bus and forwards them to the next reporter
+type upgradeProgress struct {
+	cfg     *config.Config
+	next    v1.ProgressReporter
+	counter *v1.DownloadCounter
+	stop    chan struct{}
+
+	mu   sync.Mutex
+	last *v1.ProgressRecord
+	// publishing serializes the events of the ticker and the reported records
+	publishing sync.Mutex
+}
+
+// publishUpgradeProgress makes the upgrade run with the given config publish its progress on the bus, until the
+// returned function is called
+func publishUpgradeProgress(c *config.Config) func() {
+	p := &upgradeProgress{cfg: c, next: c.Progress, stop: make(chan struct{})}
+	if p.next == nil {
+		p.next = v1.NullProgress{}
+	}
+	if extractor, ok := c.ImageExtractor.(v1.OCIImageExtractor); ok {
+		p.counter = v1.NewDownloadCounter(extractor.Transport)
+		extractor.Transport = p.counter
+		c.ImageExtractor = extractor
+	}
+	c.Progress = p
+	go p.run()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(p.stop) }) }
+}
+
+func (p *upgradeProgress) Report(r v1.ProgressRecord) {
+	r.Bytes = p.bytes()
+	p.mu.Lock()
+	p.last = &r
+	p.mu.Unlock()
+	p.next.Report(r)
+	p.publish(r)
+}
+
+// run publishes the last record again on every interval while the upgrade is in a phase
+func (p *upgradeProgress) run() {
+	ticker := time.NewTicker(upgradeProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.mu.Lock()
+			last := p.last
+			p.mu.Unlock()
+			if last == nil || last.Phase == internalutils.ProgressDone || last.Phase == internalutils.ProgressFailed {
+				continue
+			}
+			r := *last
+			r.Bytes = p.bytes()
+			p.publish(r)
+		}
+	}
+}
+
+func (p *upgradeProgress) publish(r v1.ProgressRecord) {
+	p.publishing.Lock()
+	defer p.publishing.Unlock()
+	payload := UpgradeProgress{
+		Action:  r.Action,
+		Phase:   r.Phase,
+		Percent: r.Percent,
+		Bytes:   r.Bytes,
+		Message: r.Message,
+		Error:   r.Error,
+	}
+	if _, err := bus.Manager.Publish(bus.EventUpgradeProgress, payload); err != nil {
+		p.cfg.Logger.Debugf("Could not publish the upgrade progress: %s", err)
+	}
+}
+
+func (p *upgradeProgress) bytes() int64 {
+	if p.counter == nil {
+		return 0
+	}
+	return p.counter.Bytes()
+}
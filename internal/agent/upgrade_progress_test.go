@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/kairos-io/kairos-agent/v2/internal/bus"
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/go-pluggable"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Upgrade progress", Label("upgrade", "progress"), func() {
+	var mu sync.Mutex
+	var published []UpgradeProgress
+
+	BeforeEach(func() {
+		published = nil
+		bus.Manager = bus.NewBus()
+		bus.Manager.Bus.On(string(bus.EventUpgradeProgress), func(e *pluggable.Event) {
+			p := UpgradeProgress{}
+			Expect(json.Unmarshal([]byte(e.Data), &p)).To(Succeed())
+			mu.Lock()
+			published = append(published, p)
+			mu.Unlock()
+		})
+		upgradeProgressInterval = 10 * time.Millisecond
+	})
+
+	It("publishes the phases and the bytes pulled periodically", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write(make([]byte, 1024))
+		}))
+		defer server.Close()
+
+		out := &bytes.Buffer{}
+		c := config.NewConfig(config.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})), config.WithProgress(v1.NewJSONProgress(out)))
+		stop := publishUpgradeProgress(c)
+		defer stop()
+
+		c.Progress.Report(v1.ProgressRecord{Action: "upgrade", Phase: "deploy", Percent: 10})
+		extractor := c.ImageExtractor.(v1.OCIImageExtractor)
+		resp, err := (&http.Client{Transport: extractor.Transport}).Get(server.URL)
+		Expect(err).ToNot(HaveOccurred())
+		_, _ = io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		Eventually(func() int64 {
+			mu.Lock()
+			defer mu.Unlock()
+			return published[len(published)-1].Bytes
+		}).Should(Equal(int64(1024)))
+		mu.Lock()
+		defer mu.Unlock()
+		Expect(published[0].Phase).To(Equal("deploy"))
+		Expect(published[0].Percent).To(Equal(10))
+		Expect(out.String()).To(ContainSubstring(`"phase":"deploy"`))
+	})
+})
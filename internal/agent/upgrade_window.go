@@ -0,0 +1,150 @@
+package agent
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/action"
+	config "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	"github.com/kairos-io/kairos-sdk/collector"
+	"github.com/kairos-io/kairos-sdk/utils"
+	"github.com/twpayne/go-vfs/v5"
+)
+
+// UpgradeScheduler watches for newer releases and upgrades the system to the newest one only within the configured
+// maintenance window, rebooting afterwards if the window allows it
+type UpgradeScheduler struct {
+	cfg    *config.Config
+	window config.UpgradeWindow
+	// reloader is the reloader of the running config, if the scheduler follows it
+	reloader *ConfigReloader
+	// upgraded is the release already applied, so it's not applied again until the system reboots into it
+	upgraded string
+
+	// Now, NewestRelease, Upgrade and Reboot default to the running system ones
+	Now func() time.Time
+	// NewestRelease returns the newest release newer than the running one, empty if there is none
+	NewestRelease func() (string, error)
+	Upgrade       func(source string) error
+	Reboot        func()
+}
+
+// NewUpgradeScheduler returns an UpgradeScheduler for the upgrade window in the config, reading the upgrade config
+// from the given dirs
+func NewUpgradeScheduler(c *config.Config, dirs []string) *UpgradeScheduler {
+	s := &UpgradeScheduler{cfg: c, Now: time.Now, Reboot: utils.Reboot}
+	if c.Upgrade != nil && c.Upgrade.Window != nil {
+		s.window = *c.Upgrade.Window
+	}
+	s.NewestRelease = func() (string, error) {
+		releases, err := ListNewerReleases(s.window.PreReleases, NewReleasesCache(vfs.OSFS, false))
+		if err != nil || len(releases) == 0 {
+			return "", err
+		}
+		return releases[0], nil
+	}
+	s.Upgrade = func(source string) error {
+		// Upgrade skips pinned systems without failing, the release would be taken as applied
+		pin, err := action.ReadPin(vfs.OSFS, constants.PinFile)
+		if err != nil {
+			return err
+		}
+		if pin != nil {
+			return fmt.Errorf("the system is pinned to the %s boot entry", pin.Entry)
+		}
+		return Upgrade(source, false, false, false, dirs, "", s.window.PreReleases, false, false)
+	}
+	return s
+}
+
+// RunUpgradeScheduler runs the scheduler of the upgrade window in the config found in the dirs until the process
+// is stopped
+func RunUpgradeScheduler(dirs []string) error {
+	c, err := config.Scan(collector.Directories(dirs...), collector.NoLogs)
+	if err != nil {
+		return err
+	}
+	if c.Upgrade == nil || c.Upgrade.Window == nil {
+		return fmt.Errorf("no upgrade.window configured")
+	}
+	return NewUpgradeScheduler(c, dirs).Run(make(chan struct{}))
+}
+
+// Follow makes the scheduler log with the reloads of the running config
+func (s *UpgradeScheduler) Follow(r *ConfigReloader) *UpgradeScheduler {
+	s.reloader = r
+	return s
+}
+
+// running returns the running config, reloaded if the scheduler follows a reloader
+func (s *UpgradeScheduler) running() *config.Config {
+	if s.reloader != nil {
+		return s.reloader.Config()
+	}
+	return s.cfg
+}
+
+// Run checks for newer releases while the window is open until stop is closed. It only returns early if the window
+// is misconfigured.
+func (s *UpgradeScheduler) Run(stop <-chan struct{}) error {
+	if err := s.window.Validate(); err != nil {
+		return fmt.Errorf("upgrade window: %w", err)
+	}
+	for {
+		wait, err := s.check()
+		if err != nil {
+			return err
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+// check upgrades to the newest release if the window is open, returning the time to wait for the next check
+func (s *UpgradeScheduler) check() (time.Duration, error) {
+	now := s.Now()
+	open, next, err := s.window.Open(now)
+	if err != nil {
+		return 0, err
+	}
+	if !open {
+		if next.IsZero() {
+			return 0, fmt.Errorf("the upgrade window %q never opens", s.window.Schedule)
+		}
+		s.running().Logger.Infof("The upgrade window opens at %s", next.Format(time.RFC3339))
+		return next.Sub(now), nil
+	}
+
+	// Check again after the interval, or once the window opens again if it closes before
+	wait := s.window.CheckInterval
+	if closes := next.Sub(now); closes < wait {
+		wait = closes
+	}
+	release, err := s.NewestRelease()
+	if err != nil {
+		s.running().Logger.Warnf("Could not list the newer releases, retrying in %s: %s", wait, err)
+		return wait, nil
+	}
+	if release == "" || release == s.upgraded {
+		s.running().Logger.Debugf("No newer release to upgrade to within the upgrade window")
+		return wait, nil
+	}
+
+	s.running().Logger.Infof("Upgrading to %s within the upgrade window, open until %s", release, next.Format(time.RFC3339))
+	if err = s.Upgrade(release); err != nil {
+		s.running().Logger.Errorf("Upgrading to %s failed, retrying in %s: %s", release, wait, err)
+		return wait, nil
+	}
+	s.upgraded = release
+	if !s.window.Reboot {
+		s.running().Logger.Infof("Upgraded to %s, it boots on the next reboot", release)
+		return wait, nil
+	}
+	s.running().Logger.Infof("Upgraded to %s, rebooting", release)
+	s.Reboot()
+	return wait, nil
+}
@@ -0,0 +1,78 @@
+package agent_test
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	. "github.com/kairos-io/kairos-agent/v2/internal/agent"
+	config "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("UpgradeScheduler", Label("upgrade", "window"), func() {
+	var scheduler *UpgradeScheduler
+	var now time.Time
+	var release string
+	var upgraded []string
+	var upgradeErr error
+	var reboots int
+	var stopped chan struct{}
+
+	BeforeEach(func() {
+		c := config.NewConfig(config.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})))
+		c.Upgrade = &config.Upgrade{Window: &config.UpgradeWindow{Schedule: "0 2 * * 6", Duration: 2 * time.Hour, Reboot: true}}
+		upgraded, upgradeErr, reboots, release = nil, nil, 0, "quay.io/kairos/ubuntu:v3.2.0"
+		scheduler = NewUpgradeScheduler(c, nil)
+		scheduler.Now = func() time.Time { return now }
+		scheduler.NewestRelease = func() (string, error) { return release, nil }
+		scheduler.Upgrade = func(source string) error {
+			upgraded = append(upgraded, source)
+			return upgradeErr
+		}
+		scheduler.Reboot = func() { reboots++ }
+		// Each run checks once
+		stopped = make(chan struct{})
+		close(stopped)
+	})
+
+	It("does not upgrade outside of the window", func() {
+		// Friday
+		now = time.Date(2026, 10, 16, 2, 30, 0, 0, time.UTC)
+		Expect(scheduler.Run(stopped)).To(Succeed())
+		Expect(upgraded).To(BeEmpty())
+	})
+
+	It("upgrades to the newest release within the window and reboots", func() {
+		// Saturday
+		now = time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC)
+		Expect(scheduler.Run(stopped)).To(Succeed())
+		Expect(upgraded).To(Equal([]string{release}))
+		Expect(reboots).To(Equal(1))
+
+		// The applied release is not applied again
+		Expect(scheduler.Run(stopped)).To(Succeed())
+		Expect(upgraded).To(HaveLen(1))
+	})
+
+	It("retries a failed upgrade and does nothing without newer releases", func() {
+		now = time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC)
+		upgradeErr = fmt.Errorf("no space left")
+		Expect(scheduler.Run(stopped)).To(Succeed())
+		Expect(scheduler.Run(stopped)).To(Succeed())
+		Expect(upgraded).To(HaveLen(2))
+		Expect(reboots).To(BeZero())
+
+		release = ""
+		Expect(scheduler.Run(stopped)).To(Succeed())
+		Expect(upgraded).To(HaveLen(2))
+	})
+
+	It("fails on invalid schedules", func() {
+		scheduler = NewUpgradeScheduler(&config.Config{Upgrade: &config.Upgrade{Window: &config.UpgradeWindow{Schedule: "daily"}}}, nil)
+		Expect(scheduler.Run(stopped)).To(MatchError(ContainSubstring("invalid schedule")))
+	})
+})
@@ -0,0 +1,314 @@
+package agent
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/mudler/yip/pkg/schema"
+	"gopkg.in/yaml.v3"
+)
+
+const usersRemediateStage = "users-remediate"
+
+// UserDrift is the difference between a user in the cloud config and the user on the system
+type UserDrift struct {
+	Name string `json:"name" yaml:"name"`
+	// Missing is set if the user doesn't exist on the system, nothing else is checked then
+	Missing        bool     `json:"missing,omitempty" yaml:"missing,omitempty"`
+	MissingGroups  []string `json:"missing_groups,omitempty" yaml:"missing_groups,omitempty"`
+	PasswordDrift  bool     `json:"password_drift,omitempty" yaml:"password_drift,omitempty"`
+	MissingKeys    []string `json:"missing_keys,omitempty" yaml:"missing_keys,omitempty"`
+	UnexpectedKeys []string `json:"unexpected_keys,omitempty" yaml:"unexpected_keys,omitempty"`
+	Fixed          bool     `json:"fixed,omitempty" yaml:"fixed,omitempty"`
+}
+
+// Drifted is true if the user doesn't match the config
+func (d UserDrift) Drifted() bool {
+	return d.Missing || d.PasswordDrift || len(d.MissingGroups) > 0 || len(d.MissingKeys) > 0 || len(d.UnexpectedKeys) > 0
+}
+
+// UsersAudit is the result of comparing the configured users with the system
+type UsersAudit struct {
+	// Checked is the number of users in the config
+	Checked int         `json:"checked" yaml:"checked"`
+	Drift   []UserDrift `json:"drift,omitempty" yaml:"drift,omitempty"`
+}
+
+// systemUser is a user as found in /etc/passwd, /etc/shadow and /etc/group
+type systemUser struct {
+	home   string
+	hash   string
+	groups []string
+}
+
+// AuditUsers compares the users and ssh_authorized_keys in the cloud config, both the top level users and
+// the ones in the stages, with the users on the system.
+// Password hashes are only compared if the config has a hash, plain passwords can't be compared. Keys fetched
+// from a provider (github:user) can't be compared offline either, so unexpected keys are not reported for those users.
+func AuditUsers(c *config.Config) (*UsersAudit, error) {
+	configured, err := configuredUsers(c)
+	if err != nil {
+		return nil, err
+	}
+	system, err := systemUsers(c)
+	if err != nil {
+		return nil, err
+	}
+
+	audit := &UsersAudit{Checked: len(configured)}
+	names := make([]string, 0, len(configured))
+	for name := range configured {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		u := configured[name]
+		d := UserDrift{Name: name}
+		su, ok := system[name]
+		if !ok {
+			d.Missing = true
+			audit.Drift = append(audit.Drift, d)
+			continue
+		}
+		for _, g := range append([]string{u.PrimaryGroup}, u.Groups...) {
+			if g != "" && !slices.Contains(su.groups, g) {
+				d.MissingGroups = append(d.MissingGroups, g)
+			}
+		}
+		switch {
+		case u.LockPasswd:
+			d.PasswordDrift = !strings.HasPrefix(su.hash, "!")
+		case strings.HasPrefix(u.PasswordHash, "$"):
+			d.PasswordDrift = su.hash != u.PasswordHash
+		}
+
+		installed := map[string]string{}
+		if data, err := c.Fs.ReadFile(filepath.Join(su.home, ".ssh", "authorized_keys")); err == nil {
+			for _, line := range strings.Split(string(data), "\n") {
+				if k := normalizeKey(line); k != "" {
+					installed[k] = strings.TrimSpace(line)
+				}
+			}
+		}
+		remote := false
+		wanted := map[string]bool{}
+		for _, key := range u.SSHAuthorizedKeys {
+			if strings.Contains(key, ":") && !strings.Contains(key, " ") {
+				remote = true
+				continue
+			}
+			k := normalizeKey(key)
+			wanted[k] = true
+			if _, ok := installed[k]; !ok {
+				d.MissingKeys = append(d.MissingKeys, strings.TrimSpace(key))
+			}
+		}
+		if !remote {
+			for k, line := range installed {
+				if !wanted[k] {
+					d.UnexpectedKeys = append(d.UnexpectedKeys, line)
+				}
+			}
+			sort.Strings(d.UnexpectedKeys)
+		}
+		if d.Drifted() {
+			audit.Drift = append(audit.Drift, d)
+		}
+	}
+	return audit, nil
+}
+
+// RemediateUsers brings the drifted users back to the config. Missing users, passwords and keys are applied
+// with the yip users module like on boot, groups are added with usermod and unexpected keys are removed.
+func RemediateUsers(c *config.Config, audit *UsersAudit) error {
+	configured, err := configuredUsers(c)
+	if err != nil {
+		return err
+	}
+	system, err := systemUsers(c)
+	if err != nil {
+		return err
+	}
+
+	for i, d := range audit.Drift {
+		u := configured[d.Name]
+		if d.Missing || d.PasswordDrift || len(d.MissingKeys) > 0 {
+			stage := schema.YipConfig{Stages: map[string][]schema.Stage{
+				usersRemediateStage: {{Name: "Remediate user " + d.Name, Users: map[string]schema.User{d.Name: u}}},
+			}}
+			data, err := yaml.Marshal(stage)
+			if err != nil {
+				return err
+			}
+			if err = c.CloudInitRunner.Run(usersRemediateStage, string(data)); err != nil {
+				return fmt.Errorf("remediating user %s: %w", d.Name, err)
+			}
+		}
+		if len(d.MissingGroups) > 0 && !d.Missing {
+			out, err := c.Runner.Run("usermod", "-a", "-G", strings.Join(d.MissingGroups, ","), d.Name)
+			if err != nil {
+				return fmt.Errorf("adding %s to groups %s: %s: %w", d.Name, strings.Join(d.MissingGroups, ","), out, err)
+			}
+		}
+		if len(d.UnexpectedKeys) > 0 {
+			if err = removeKeys(c, filepath.Join(system[d.Name].home, ".ssh", "authorized_keys"), d.UnexpectedKeys); err != nil {
+				return fmt.Errorf("removing unexpected keys of %s: %w", d.Name, err)
+			}
+		}
+		audit.Drift[i].Fixed = true
+	}
+	return nil
+}
+
+// configuredUsers merges the users in the config stages with the top level users, by user name
+func configuredUsers(c *config.Config) (map[string]schema.User, error) {
+	configured := map[string]schema.User{}
+	merge := func(name string, u schema.User) {
+		if name == "" {
+			return
+		}
+		prev, ok := configured[name]
+		if ok {
+			u.Groups = append(prev.Groups, u.Groups...)
+			u.SSHAuthorizedKeys = append(prev.SSHAuthorizedKeys, u.SSHAuthorizedKeys...)
+			if u.PasswordHash == "" {
+				u.PasswordHash = prev.PasswordHash
+			}
+			if u.PrimaryGroup == "" {
+				u.PrimaryGroup = prev.PrimaryGroup
+			}
+			u.LockPasswd = u.LockPasswd || prev.LockPasswd
+		}
+		u.Name = name
+		configured[name] = u
+	}
+
+	if top, ok := c.Config.Values["users"]; ok {
+		data, err := yaml.Marshal(top)
+		if err != nil {
+			return nil, err
+		}
+		var users []schema.User
+		if err = yaml.Unmarshal(data, &users); err != nil {
+			return nil, fmt.Errorf("parsing the users in the config: %w", err)
+		}
+		for _, u := range users {
+			merge(u.Name, u)
+		}
+	}
+
+	cc, err := c.Config.String()
+	if err != nil {
+		return nil, err
+	}
+	var yipConfig schema.YipConfig
+	if err = yaml.Unmarshal([]byte(cc), &yipConfig); err != nil {
+		return nil, fmt.Errorf("parsing the config stages: %w", err)
+	}
+	for _, stages := range yipConfig.Stages {
+		for _, s := range stages {
+			for name, u := range s.Users {
+				merge(name, u)
+			}
+			for name, keys := range s.SSHKeys {
+				merge(name, schema.User{SSHAuthorizedKeys: keys})
+			}
+		}
+	}
+	return configured, nil
+}
+
+// systemUsers reads the users, their password hash and groups from /etc
+func systemUsers(c *config.Config) (map[string]*systemUser, error) {
+	passwd, err := c.Fs.ReadFile("/etc/passwd")
+	if err != nil {
+		return nil, err
+	}
+	users := map[string]*systemUser{}
+	primary := map[string]string{}
+	for _, fields := range etcEntries(string(passwd)) {
+		if len(fields) < 7 {
+			continue
+		}
+		users[fields[0]] = &systemUser{home: fields[5]}
+		primary[fields[0]] = fields[3]
+	}
+	if shadow, err := c.Fs.ReadFile("/etc/shadow"); err == nil {
+		for _, fields := range etcEntries(string(shadow)) {
+			if u, ok := users[fields[0]]; ok && len(fields) > 1 {
+				u.hash = fields[1]
+			}
+		}
+	}
+	if group, err := c.Fs.ReadFile("/etc/group"); err == nil {
+		for _, fields := range etcEntries(string(group)) {
+			if len(fields) < 4 {
+				continue
+			}
+			for name, u := range users {
+				if primary[name] == fields[2] || slices.Contains(strings.Split(fields[3], ","), name) {
+					u.groups = append(u.groups, fields[0])
+				}
+			}
+		}
+	}
+	return users, nil
+}
+
+func etcEntries(data string) [][]string {
+	var entries [][]string
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries
+}
+
+// normalizeKey returns the type and key of an authorized key line, ignoring the options and comment
+func normalizeKey(line string) string {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ""
+	}
+	fields := strings.Fields(line)
+	for i, f := range fields {
+		if (strings.HasPrefix(f, "ssh-") || strings.HasPrefix(f, "ecdsa-") || strings.HasPrefix(f, "sk-")) && i+1 < len(fields) {
+			return f + " " + fields[i+1]
+		}
+	}
+	return line
+}
+
+func removeKeys(c *config.Config, file string, keys []string) error {
+	data, err := c.Fs.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	info, err := c.Fs.Stat(file)
+	if err != nil {
+		return err
+	}
+	unexpected := map[string]bool{}
+	for _, k := range keys {
+		unexpected[normalizeKey(k)] = true
+	}
+	var kept []string
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		if !unexpected[normalizeKey(line)] {
+			kept = append(kept, line)
+		}
+	}
+	content := strings.Join(kept, "\n")
+	if content != "" {
+		content += "\n"
+	}
+	return c.Fs.WriteFile(file, []byte(content), info.Mode().Perm())
+}
@@ -0,0 +1,114 @@
+package agent_test
+
+import (
+	"strings"
+
+	. "github.com/kairos-io/kairos-agent/v2/internal/agent"
+	config "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	"github.com/kairos-io/kairos-sdk/collector"
+	"github.com/twpayne/go-vfs/v5/vfst"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	adminKey    = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAdmin admin@laptop"
+	intruderKey = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQIntruder someone@else"
+)
+
+var _ = Describe("AuditUsers", func() {
+	var c *config.Config
+	var runner *v1mock.FakeRunner
+	var cloudInit *v1mock.FakeCloudInitRunner
+
+	load := func(cc string, files map[string]interface{}) {
+		var err error
+		c, err = config.ScanNoLogs(collector.Readers(strings.NewReader(cc)))
+		Expect(err).ToNot(HaveOccurred())
+		fs, cleanup, err := vfst.NewTestFS(files)
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(cleanup)
+		runner = v1mock.NewFakeRunner()
+		cloudInit = &v1mock.FakeCloudInitRunner{}
+		c.Fs, c.Runner, c.CloudInitRunner = fs, runner, cloudInit
+	}
+
+	system := func() map[string]interface{} {
+		return map[string]interface{}{
+			"/etc/passwd":                       "root:x:0:0:root:/root:/bin/sh\nkairos:x:1000:1000::/home/kairos:/bin/sh\n",
+			"/etc/shadow":                       "root:!:19000::::::\nkairos:$6$salt$hash:19000::::::\n",
+			"/etc/group":                        "root:x:0:\nkairos:x:1000:\nadmin:x:900:kairos\n",
+			"/home/kairos/.ssh/authorized_keys": adminKey + "\n",
+		}
+	}
+
+	It("finds no drift when the system matches the config", func() {
+		load(`#cloud-config
+users:
+- name: kairos
+  passwd: $6$salt$hash
+  groups: [admin]
+  ssh_authorized_keys:
+  - ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAdmin other comment
+`, system())
+		audit, err := AuditUsers(c)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(audit.Checked).To(Equal(1))
+		Expect(audit.Drift).To(BeEmpty())
+	})
+
+	It("reports missing users, groups, password changes and unexpected keys", func() {
+		files := system()
+		files["/home/kairos/.ssh/authorized_keys"] = adminKey + "\n" + intruderKey + "\n"
+		load(`#cloud-config
+users:
+- name: kairos
+  passwd: $6$salt$other
+  groups: [admin, wheel]
+  ssh_authorized_keys:
+  - `+adminKey+`
+stages:
+  initramfs:
+  - users:
+      ops:
+        groups: [admin]
+`, files)
+		audit, err := AuditUsers(c)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(audit.Checked).To(Equal(2))
+		Expect(audit.Drift).To(HaveLen(2))
+		Expect(audit.Drift[0].Name).To(Equal("kairos"))
+		Expect(audit.Drift[0].MissingGroups).To(Equal([]string{"wheel"}))
+		Expect(audit.Drift[0].PasswordDrift).To(BeTrue())
+		Expect(audit.Drift[0].MissingKeys).To(BeEmpty())
+		Expect(audit.Drift[0].UnexpectedKeys).To(Equal([]string{intruderKey}))
+		Expect(audit.Drift[1]).To(Equal(UserDrift{Name: "ops", Missing: true}))
+
+		Expect(RemediateUsers(c, audit)).To(Succeed())
+		Expect(cloudInit.ExecStages).To(HaveLen(2))
+		Expect(runner.IncludesCmds([][]string{{"usermod", "-a", "-G", "wheel", "kairos"}})).To(Succeed())
+		keys, err := c.Fs.ReadFile("/home/kairos/.ssh/authorized_keys")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(keys)).To(Equal(adminKey + "\n"))
+		Expect(audit.Drift[0].Fixed).To(BeTrue())
+	})
+
+	It("doesn't report unexpected keys for users with keys from a provider", func() {
+		files := system()
+		files["/home/kairos/.ssh/authorized_keys"] = intruderKey + "\n"
+		load(`#cloud-config
+users:
+- name: kairos
+  ssh_authorized_keys:
+  - github:kairos
+  - `+adminKey+`
+`, files)
+		audit, err := AuditUsers(c)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(audit.Drift).To(HaveLen(1))
+		Expect(audit.Drift[0].MissingKeys).To(Equal([]string{adminKey}))
+		Expect(audit.Drift[0].UnexpectedKeys).To(BeEmpty())
+	})
+})
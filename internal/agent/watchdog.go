@@ -0,0 +1,19 @@
+package agent
+
+import (
+	"github.com/kairos-io/kairos-agent/v2/pkg/action"
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-sdk/collector"
+)
+
+// RunWatchdog runs the boot check of the upgrade watchdog. When the remediation is a reset it runs unattended from
+// recovery, keeping the OEM partition so the node keeps its configuration.
+func RunWatchdog(dirs []string) error {
+	c, err := config.Scan(collector.Directories(dirs...), collector.NoLogs)
+	if err != nil {
+		return err
+	}
+	return action.CheckWatchdog(c, func() error {
+		return Reset(true, true, false, "", "", dirs...)
+	})
+}
@@ -9,13 +9,34 @@ import (
 	"github.com/mudler/go-pluggable"
 )
 
+// EventPermissionsAudit is published by `kairos-agent doctor` with the permissions audit report of the running system
+const EventPermissionsAudit pluggable.EventType = "agent.permissions.audit"
+
+// EventResetCompleted is published after a successful reset with the machine state, so providers can re-enroll the node
+const EventResetCompleted pluggable.EventType = "agent.reset.completed"
+
+// EventBootDegraded is published by `kairos-agent start` with the known degradations found in the current boot
+const EventBootDegraded pluggable.EventType = "agent.boot.degraded"
+
+// EventBootRollback is published by `kairos-agent start` when passive was promoted to active after the active
+// entry failed its boot assessment
+const EventBootRollback pluggable.EventType = "agent.boot.rollback"
+
+// EventUpgradeProgress is published periodically during `kairos-agent upgrade` with the phase, percent and bytes
+// downloaded of the running upgrade
+const EventUpgradeProgress pluggable.EventType = "agent.upgrade.progress"
+
+// EventUpgradeVerified is published by `kairos-agent upgrade verify` once the system booted after an upgrade
+// transaction is verified to be the upgraded one
+const EventUpgradeVerified pluggable.EventType = "agent.upgrade.verified"
+
 // Manager is the bus instance manager, which subscribes plugins to events emitted.
 var Manager = NewBus()
 
 func NewBus() *Bus {
 	return &Bus{
 		Manager: pluggable.NewManager(
-			bus.AllEvents,
+			append(append([]pluggable.EventType{}, bus.AllEvents...), EventPermissionsAudit, EventResetCompleted, EventBootDegraded, EventBootRollback, EventUpgradeProgress, EventUpgradeVerified),
 		),
 	}
 }
@@ -47,7 +68,11 @@ func (b *Bus) Initialize() {
 	b.LoadProviders()
 	for i := range b.Manager.Events {
 		e := b.Manager.Events[i]
+		b.Manager.Bus.On(string(e), func(ev *pluggable.Event) {
+			forward(eventRecord(ev))
+		})
 		b.Manager.Response(e, func(p *pluggable.Plugin, r *pluggable.EventResponse) {
+			forward(responseRecord(e, p, r))
 			if os.Getenv("BUS_DEBUG") == "true" {
 				fmt.Println(
 					fmt.Sprintf("[provider event: %s]", e),
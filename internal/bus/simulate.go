@@ -0,0 +1,150 @@
+package bus
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/kairos-sdk/bus"
+	"github.com/mudler/go-pluggable"
+)
+
+const providerPrefix = "agent-provider-"
+
+// Sequences returns the names of the built-in event sequences that can be simulated
+func Sequences() []string {
+	names := []string{}
+	for n := range sequences {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type sequenceEvent struct {
+	event   pluggable.EventType
+	payload interface{}
+}
+
+// sequences are the events the agent publishes, in order, on each flow
+var sequences = map[string]func(config string) []sequenceEvent{
+	"install": func(config string) []sequenceEvent {
+		return []sequenceEvent{
+			{bus.EventChallenge, bus.EventPayload{Config: config}},
+			{bus.EventInstall, bus.InstallPayload{Config: config}},
+		}
+	},
+	"boot": func(config string) []sequenceEvent {
+		return []sequenceEvent{
+			{bus.EventBoot, bus.EventPayload{Config: config}},
+			{bus.EventBootstrap, bus.BootstrapPayload{APIAddress: "localhost:8080", Config: config, Logfile: "/var/log/kairos/agent-provider.log"}},
+		}
+	},
+	"upgrade": func(config string) []sequenceEvent {
+		return []sequenceEvent{
+			{bus.EventAvailableReleases, bus.EventPayload{Config: config}},
+			{bus.EventVersionImage, bus.VersionImagePayload{Version: "latest"}},
+		}
+	},
+}
+
+// Sequence returns the built-in event sequence with the given name, with config as the payload cloud config
+func Sequence(name, config string) ([]Record, error) {
+	seq, ok := sequences[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown event sequence %s, available sequences: %s", name, strings.Join(Sequences(), ", "))
+	}
+	var records []Record
+	for _, e := range seq(config) {
+		data, err := json.Marshal(e.payload)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, Record{Kind: RecordEvent, Event: string(e.event), Data: string(data)})
+	}
+	return records, nil
+}
+
+// LoadRecords reads the events recorded with `events tail --output json`. Plugin responses are skipped.
+func LoadRecords(r io.Reader) ([]Record, error) {
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		rec := Record{}
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("parsing record at line %d: %w", line, err)
+		}
+		if rec.Kind == RecordEvent {
+			records = append(records, rec)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// Simulate publishes the given events to the provider plugins found in providersDir, and only there, and
+// returns their responses. Unlike the agent bus, plugin errors do not stop the simulation.
+// Nothing but the plugins is run, so no disk is touched by the agent.
+func Simulate(providersDir string, records []Record, w io.Writer, asJSON bool) ([]Record, error) {
+	plugins, err := filepath.Glob(filepath.Join(providersDir, providerPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+	m := pluggable.NewManager(bus.AllEvents)
+	for _, p := range plugins {
+		if info, err := os.Stat(p); err != nil || info.IsDir() {
+			continue
+		}
+		m.Plugins = append(m.Plugins, pluggable.Plugin{Name: strings.TrimPrefix(filepath.Base(p), providerPrefix), Executable: p})
+	}
+	if len(m.Plugins) == 0 {
+		return nil, fmt.Errorf("no provider plugins (%s*) found in %s", providerPrefix, providersDir)
+	}
+	m.Register()
+
+	output := func(r Record) {
+		if !asJSON {
+			fmt.Fprintln(w, r.String())
+			return
+		}
+		if d, err := json.Marshal(r); err == nil {
+			fmt.Fprintln(w, string(d))
+		}
+	}
+
+	var responses []Record
+	for _, e := range m.Events {
+		e := e
+		m.Response(e, func(p *pluggable.Plugin, r *pluggable.EventResponse) {
+			rec := responseRecord(e, p, r)
+			responses = append(responses, rec)
+			output(rec)
+		})
+	}
+
+	for _, r := range records {
+		if !bus.IsEventDefined(r.Event) {
+			return responses, fmt.Errorf("unknown event %s", r.Event)
+		}
+		r.Time = time.Now()
+		r.PID = os.Getpid()
+		output(r)
+		data := json.RawMessage(r.Data)
+		if r.Data == "" {
+			data = json.RawMessage("{}")
+		}
+		if _, err := m.Publish(pluggable.EventType(r.Event), data); err != nil {
+			return responses, err
+		}
+	}
+	return responses, nil
+}
@@ -0,0 +1,98 @@
+package bus_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/kairos-io/kairos-agent/v2/internal/bus"
+	sdkBus "github.com/kairos-io/kairos-sdk/bus"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("events simulate", func() {
+	var dir string
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		// The plugin answers every event with its name as state
+		Expect(os.WriteFile(filepath.Join(dir, "agent-provider-echo"), []byte("#!/bin/sh\ncat >/dev/null\necho \"{\\\"state\\\": \\\"$1\\\"}\"\n"), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "other-plugin"), []byte("#!/bin/sh\nexit 1\n"), 0755)).To(Succeed())
+	})
+
+	It("publishes the events to the plugins in the dir and prints their responses", func() {
+		records, err := Sequence("install", "#cloud-config\n")
+		Expect(err).ToNot(HaveOccurred())
+		out := &syncBuffer{}
+		responses, err := Simulate(dir, records, out, false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(responses).To(HaveLen(2))
+		Expect(responses[0].Plugin).To(Equal("echo"))
+		Expect(responses[0].Event).To(Equal(string(sdkBus.EventChallenge)))
+		Expect(responses[0].State).To(Equal(string(sdkBus.EventChallenge)))
+		Expect(responses[1].State).To(Equal(string(sdkBus.EventInstall)))
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		Expect(lines).To(HaveLen(4))
+		Expect(lines[0]).To(ContainSubstring("event " + string(sdkBus.EventChallenge)))
+		Expect(lines[1]).To(ContainSubstring("response to " + string(sdkBus.EventChallenge) + " from echo"))
+		Expect(lines[2]).To(ContainSubstring("event " + string(sdkBus.EventInstall)))
+		Expect(lines[3]).To(ContainSubstring(`state="` + string(sdkBus.EventInstall) + `"`))
+	})
+
+	It("prints the records as JSON", func() {
+		out := &syncBuffer{}
+		_, err := Simulate(dir, []Record{{Kind: RecordEvent, Event: string(sdkBus.EventBoot)}}, out, true)
+		Expect(err).ToNot(HaveOccurred())
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		Expect(lines).To(HaveLen(2))
+		for i, kind := range []string{RecordEvent, RecordResponse} {
+			r := Record{}
+			Expect(json.Unmarshal([]byte(lines[i]), &r)).To(Succeed())
+			Expect(r.Kind).To(Equal(kind))
+			Expect(r.Event).To(Equal(string(sdkBus.EventBoot)))
+		}
+	})
+
+	It("fails without plugins or with unknown events", func() {
+		_, err := Simulate(GinkgoT().TempDir(), nil, &syncBuffer{}, false)
+		Expect(err).To(MatchError(ContainSubstring("no provider plugins")))
+
+		_, err = Simulate(dir, []Record{{Kind: RecordEvent, Event: "agent.unknown"}}, &syncBuffer{}, false)
+		Expect(err).To(MatchError(ContainSubstring("unknown event agent.unknown")))
+	})
+
+	It("returns the built-in sequences with the config as payload", func() {
+		Expect(Sequences()).To(Equal([]string{"boot", "install", "upgrade"}))
+		records, err := Sequence("install", "#cloud-config\n")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(records).To(HaveLen(2))
+		Expect(records[0].Event).To(Equal(string(sdkBus.EventChallenge)))
+		Expect(records[1].Event).To(Equal(string(sdkBus.EventInstall)))
+		payload := sdkBus.InstallPayload{}
+		Expect(json.Unmarshal([]byte(records[1].Data), &payload)).To(Succeed())
+		Expect(payload.Config).To(Equal("#cloud-config\n"))
+
+		_, err = Sequence("reboot", "")
+		Expect(err).To(MatchError(ContainSubstring("available sequences: boot, install, upgrade")))
+	})
+
+	It("loads the recorded events skipping the responses", func() {
+		records, err := LoadRecords(strings.NewReader(`{"kind":"event","event":"agent.boot","data":"{}"}
+
+{"kind":"response","event":"agent.boot","plugin":"foo"}
+{"kind":"event","event":"agent.bootstrap"}
+`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(records).To(HaveLen(2))
+		Expect(records[0].Event).To(Equal("agent.boot"))
+		Expect(records[0].Data).To(Equal("{}"))
+		Expect(records[1].Event).To(Equal("agent.bootstrap"))
+
+		_, err = LoadRecords(strings.NewReader("{\"kind\":\"event\"}\nnot json\n"))
+		Expect(err).To(MatchError(ContainSubstring("line 2")))
+	})
+})
@@ -0,0 +1,165 @@
+package bus
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mudler/go-pluggable"
+)
+
+// TailSocket is the socket `events tail` listens on. Every agent process forwards its bus
+// events and plugin responses to it, if there is a listener.
+var TailSocket = "/run/kairos/events.sock"
+
+const (
+	RecordEvent    = "event"
+	RecordResponse = "response"
+)
+
+// Record is a bus event or plugin response as seen by `events tail`
+type Record struct {
+	Time       time.Time `json:"time"`
+	Kind       string    `json:"kind"`
+	Event      string    `json:"event"`
+	PID        int       `json:"pid"`
+	Plugin     string    `json:"plugin,omitempty"`
+	Executable string    `json:"executable,omitempty"`
+	Data       string    `json:"data,omitempty"`
+	State      string    `json:"state,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Logs       string    `json:"logs,omitempty"`
+}
+
+// String returns the human-readable form of the record
+func (r Record) String() string {
+	ts := r.Time.Format(time.RFC3339)
+	if r.Kind == RecordEvent {
+		return fmt.Sprintf("%s [pid %d] event %s: %s", ts, r.PID, r.Event, r.Data)
+	}
+	s := fmt.Sprintf("%s [pid %d] response to %s from %s (%s):", ts, r.PID, r.Event, r.Plugin, r.Executable)
+	if r.State != "" {
+		s += fmt.Sprintf(" state=%q", r.State)
+	}
+	if r.Data != "" {
+		s += fmt.Sprintf(" data=%q", r.Data)
+	}
+	if r.Error != "" {
+		s += fmt.Sprintf(" error=%q", r.Error)
+	}
+	if r.Logs != "" {
+		s += fmt.Sprintf(" logs=%q", r.Logs)
+	}
+	return s
+}
+
+func eventRecord(e *pluggable.Event) Record {
+	return Record{
+		Time:  time.Now(),
+		Kind:  RecordEvent,
+		Event: string(e.Name),
+		PID:   os.Getpid(),
+		Data:  e.Data,
+	}
+}
+
+func responseRecord(e pluggable.EventType, p *pluggable.Plugin, r *pluggable.EventResponse) Record {
+	return Record{
+		Time:       time.Now(),
+		Kind:       RecordResponse,
+		Event:      string(e),
+		PID:        os.Getpid(),
+		Plugin:     p.Name,
+		Executable: p.Executable,
+		Data:       r.Data,
+		State:      r.State,
+		Error:      r.Error,
+		Logs:       r.Logs,
+	}
+}
+
+// forward sends the record to the `events tail` listener. It never fails, if nobody is
+// listening the record is dropped.
+func forward(r Record) {
+	if _, err := os.Stat(TailSocket); err != nil {
+		return
+	}
+	conn, err := net.DialTimeout("unix", TailSocket, 100*time.Millisecond)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_ = json.NewEncoder(conn).Encode(r)
+}
+
+// Tail listens for the records forwarded by the agent processes and writes them to w, one per line,
+// either as JSON or in a human-readable form, until stop is closed
+func Tail(w io.Writer, asJSON bool, stop <-chan struct{}) error {
+	if conn, err := net.DialTimeout("unix", TailSocket, 100*time.Millisecond); err == nil {
+		conn.Close()
+		return fmt.Errorf("another events tail is already listening on %s", TailSocket)
+	}
+	// Remove a socket left behind by a previous tail
+	_ = os.Remove(TailSocket)
+	if err := os.MkdirAll(filepath.Dir(TailSocket), os.ModePerm); err != nil {
+		return err
+	}
+	l, err := net.Listen("unix", TailSocket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(TailSocket)
+
+	var mu sync.Mutex
+	stopped := false
+	write := func(r Record) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if stopped {
+			return nil
+		}
+		if !asJSON {
+			_, err := fmt.Fprintln(w, r.String())
+			return err
+		}
+		d, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(d))
+		return err
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				scanner := bufio.NewScanner(c)
+				scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+				for scanner.Scan() {
+					r := Record{}
+					if json.Unmarshal(scanner.Bytes(), &r) == nil {
+						_ = write(r)
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	<-stop
+	mu.Lock()
+	stopped = true
+	mu.Unlock()
+	return l.Close()
+}
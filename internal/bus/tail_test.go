@@ -0,0 +1,80 @@
+package bus_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/kairos-io/kairos-agent/v2/internal/bus"
+	sdkBus "github.com/kairos-io/kairos-sdk/bus"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// syncBuffer is a bytes.Buffer safe to write from the tail listener and read from the test
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+var _ = Describe("events tail", func() {
+	ts := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	It("prints the events and the plugin responses", func() {
+		event := Record{Time: ts, Kind: RecordEvent, Event: "agent.install", PID: 42, Data: `{"config":""}`}
+		Expect(event.String()).To(Equal(`2024-05-01T10:00:00Z [pid 42] event agent.install: {"config":""}`))
+
+		response := Record{Time: ts, Kind: RecordResponse, Event: "agent.install", PID: 42, Plugin: "foo", Executable: "/system/providers/agent-provider-foo", State: "done", Error: "boom"}
+		Expect(response.String()).To(Equal(`2024-05-01T10:00:00Z [pid 42] response to agent.install from foo (/system/providers/agent-provider-foo): state="done" error="boom"`))
+	})
+
+	It("writes the records forwarded to its socket until stopped", func() {
+		socket := TailSocket
+		TailSocket = filepath.Join(GinkgoT().TempDir(), "events.sock")
+		defer func() { TailSocket = socket }()
+
+		out := &syncBuffer{}
+		stop := make(chan struct{})
+		done := make(chan error, 1)
+		go func() { done <- Tail(out, true, stop) }()
+
+		var conn net.Conn
+		Eventually(func() error {
+			var err error
+			conn, err = net.Dial("unix", TailSocket)
+			return err
+		}, 2*time.Second).Should(Succeed())
+		record := Record{Time: ts, Kind: RecordEvent, Event: string(sdkBus.EventBoot), PID: 42, Data: "{}"}
+		Expect(json.NewEncoder(conn).Encode(record)).To(Succeed())
+		Expect(conn.Close()).To(Succeed())
+		Eventually(out.String, 2*time.Second).ShouldNot(BeEmpty())
+
+		got := Record{}
+		Expect(json.Unmarshal([]byte(strings.TrimSpace(out.String())), &got)).To(Succeed())
+		Expect(got).To(Equal(record))
+
+		// Only one tail listens at once
+		Expect(Tail(out, false, stop)).To(MatchError(ContainSubstring("already listening")))
+
+		close(stop)
+		Eventually(done).Should(Receive(BeNil()))
+		Expect(TailSocket).ToNot(BeAnExistingFile())
+	})
+})
@@ -0,0 +1,150 @@
+// Package i18n translates the user facing messages of the CLI, like the install, upgrade and reset messages and the
+// interactive prompts. The language is detected from the environment and can be set in the config with language.
+package i18n
+
+import (
+	"embed"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultLanguage is the language of the messages missing in a catalog, and the one used when none is set
+const DefaultLanguage = "en"
+
+//go:embed locales/*.yaml
+var locales embed.FS
+
+var (
+	mu       sync.RWMutex
+	language = DefaultLanguage
+	catalogs = loadCatalogs()
+)
+
+// loadCatalogs reads the embedded catalogs, by language
+func loadCatalogs() map[string]map[string]string {
+	files, err := locales.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	all := map[string]map[string]string{}
+	for _, f := range files {
+		data, err := locales.ReadFile("locales/" + f.Name())
+		if err != nil {
+			panic(err)
+		}
+		catalog := map[string]string{}
+		if err = yaml.Unmarshal(data, &catalog); err != nil {
+			panic(fmt.Sprintf("parsing message catalog %s: %s", f.Name(), err))
+		}
+		all[strings.TrimSuffix(f.Name(), ".yaml")] = catalog
+	}
+	return all
+}
+
+// Languages returns the languages with a message catalog
+func Languages() []string {
+	var langs []string
+	for l := range catalogs {
+		langs = append(langs, l)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// Language returns the language the messages are shown in
+func Language() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return language
+}
+
+// SetLanguage shows the messages in the given language, either a code like es or a locale like es_ES.UTF-8
+func SetLanguage(lang string) error {
+	code := normalize(lang)
+	if _, ok := catalogs[code]; !ok {
+		return fmt.Errorf("unsupported language %q, available: %s", lang, strings.Join(Languages(), ", "))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	language = code
+	return nil
+}
+
+// SetLanguageFromEnv shows the messages in the language of the LC_ALL, LC_MESSAGES or LANG environment variables, the
+// first one set, like gettext does. Unsupported languages fall back to the default one.
+func SetLanguageFromEnv() {
+	for _, env := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if v := os.Getenv(env); v != "" {
+			if SetLanguage(v) != nil {
+				_ = SetLanguage(DefaultLanguage)
+			}
+			return
+		}
+	}
+}
+
+// normalize returns the language code of the locale, the C and POSIX locales being the default language
+func normalize(lang string) string {
+	code := strings.ToLower(strings.TrimSpace(lang))
+	if i := strings.IndexAny(code, "_-.@"); i >= 0 {
+		code = code[:i]
+	}
+	if code == "" || code == "c" || code == "posix" {
+		return DefaultLanguage
+	}
+	return code
+}
+
+// T returns the message with the key in the current language, formatted with the args. Messages missing in the
+// catalog are shown in the default language, unknown keys are shown as they are.
+func T(key string, args ...interface{}) string {
+	msg, ok := catalogs[Language()][key]
+	if !ok {
+		msg, ok = catalogs[DefaultLanguage][key]
+	}
+	if !ok {
+		msg = key
+	}
+	if len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
+
+// IsYes returns true if the answer is yes in the current language. The English answers are always accepted, as the
+// prompts suggest them as the default values.
+func IsYes(answer string) bool {
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	if answer == "" {
+		return false
+	}
+	for _, key := range []string{T("answer.yes"), catalogs[DefaultLanguage]["answer.yes"]} {
+		for _, yes := range strings.Split(key, ",") {
+			if answer == strings.TrimSpace(yes) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Error is an error with a translated message, translated when shown so package level errors follow the language
+// set after they are created. Errors are compared by identity, so they can be used as sentinel errors.
+type Error struct {
+	key  string
+	args []interface{}
+}
+
+// NewError returns an error with the message with the key
+func NewError(key string, args ...interface{}) *Error {
+	return &Error{key: key, args: args}
+}
+
+func (e *Error) Error() string {
+	return T(e.key, e.args...)
+}
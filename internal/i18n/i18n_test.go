@@ -0,0 +1,88 @@
+package i18n_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/kairos-io/kairos-agent/v2/internal/i18n"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gopkg.in/yaml.v3"
+)
+
+var _ = Describe("i18n", func() {
+	AfterEach(func() {
+		Expect(i18n.SetLanguage(i18n.DefaultLanguage)).To(Succeed())
+	})
+
+	It("translates the messages, falling back to English", func() {
+		Expect(i18n.T("install.erase", "/dev/sda")).To(Equal("Installing will erase all the data on /dev/sda."))
+		Expect(i18n.SetLanguage("es_ES.UTF-8")).To(Succeed())
+		Expect(i18n.Language()).To(Equal("es"))
+		Expect(i18n.T("install.erase", "/dev/sda")).To(Equal("La instalación borrará todos los datos de /dev/sda."))
+		Expect(i18n.T("no.such.key")).To(Equal("no.such.key"))
+
+		Expect(i18n.SetLanguage("de")).To(Succeed())
+		Expect(i18n.T("upgrade.pinned", "active", "today")).To(HavePrefix("Das System ist seit today auf den Booteintrag active"))
+
+		Expect(i18n.SetLanguage("C")).To(Succeed())
+		Expect(i18n.Language()).To(Equal("en"))
+		Expect(i18n.SetLanguage("tlh")).To(MatchError(ContainSubstring("unsupported language")))
+	})
+
+	It("detects the language from the environment", func() {
+		for _, env := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+			DeferCleanup(os.Setenv, env, os.Getenv(env))
+			Expect(os.Unsetenv(env)).To(Succeed())
+		}
+		os.Setenv("LANG", "de_DE.UTF-8")
+		i18n.SetLanguageFromEnv()
+		Expect(i18n.Language()).To(Equal("de"))
+
+		os.Setenv("LC_MESSAGES", "es_ES")
+		i18n.SetLanguageFromEnv()
+		Expect(i18n.Language()).To(Equal("es"))
+
+		os.Setenv("LC_ALL", "ja_JP.UTF-8")
+		i18n.SetLanguageFromEnv()
+		Expect(i18n.Language()).To(Equal("en"))
+	})
+
+	It("accepts the localized answers and translates errors when shown", func() {
+		err := i18n.NewError("confirm.aborted")
+		Expect(i18n.IsYes("Y")).To(BeTrue())
+		Expect(i18n.IsYes("s")).To(BeFalse())
+		Expect(i18n.SetLanguage("es")).To(Succeed())
+		Expect(i18n.IsYes("Sí")).To(BeTrue())
+		Expect(i18n.IsYes("yes")).To(BeTrue())
+		Expect(i18n.IsYes("no")).To(BeFalse())
+		Expect(i18n.IsYes("")).To(BeFalse())
+
+		Expect(err.Error()).To(Equal("cancelado, el usuario no lo ha confirmado"))
+		Expect(errors.Is(fmt.Errorf("install: %w", err), err)).To(BeTrue())
+	})
+
+	It("has the same messages and format verbs in every catalog", func() {
+		verbs := regexp.MustCompile(`%(\[\d+\])?[a-z]`)
+		count := func(msg string) int { return len(verbs.FindAllString(msg, -1)) }
+		en := map[string]string{}
+		data, err := os.ReadFile(filepath.Join("locales", "en.yaml"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(yaml.Unmarshal(data, &en)).To(Succeed())
+		for _, lang := range i18n.Languages() {
+			catalog := map[string]string{}
+			data, err := os.ReadFile(filepath.Join("locales", lang+".yaml"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(yaml.Unmarshal(data, &catalog)).To(Succeed())
+			for key, msg := range en {
+				Expect(catalog).To(HaveKey(key), "%s misses %s", lang, key)
+				if key != "answer.yes" {
+					Expect(count(catalog[key])).To(Equal(count(msg)), "%s has other format verbs in %s", lang, key)
+				}
+			}
+		}
+	})
+})
@@ -0,0 +1,107 @@
+package webui
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd socket activation
+const listenFdsStart = 3
+
+// activatedListeners returns the sockets passed by systemd socket activation, if the webui was started by a
+// kairos-webui.socket unit. The addresses and permissions are then set on the socket unit.
+func activatedListeners() ([]net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	// Not meant for any child process, i.e. the installer
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []net.Listener
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+		l, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("socket activation fd %d: %w", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listen opens the TCP address and the unix socket set in the webui config
+func listen(w config.WebUI) ([]net.Listener, error) {
+	var listeners []net.Listener
+	if addr := w.Address(); addr != "" {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	if w.Socket != "" {
+		l, err := listenSocket(w)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenSocket opens the unix socket with the configured permissions and group
+func listenSocket(w config.WebUI) (net.Listener, error) {
+	mode, err := w.Mode()
+	if err != nil {
+		return nil, err
+	}
+	gid := -1
+	if w.SocketGroup != "" {
+		g, err := user.LookupGroup(w.SocketGroup)
+		if err != nil {
+			return nil, fmt.Errorf("webui socket group: %w", err)
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return nil, fmt.Errorf("webui socket group %s: %w", w.SocketGroup, err)
+		}
+	}
+
+	if err = os.MkdirAll(filepath.Dir(w.Socket), 0755); err != nil {
+		return nil, err
+	}
+	// Remove a socket left behind by a previous run
+	_ = os.Remove(w.Socket)
+	l, err := net.Listen("unix", w.Socket)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(w.Socket, os.FileMode(mode)); err == nil && gid >= 0 {
+		err = os.Chown(w.Socket, -1, gid)
+	}
+	if err != nil {
+		_ = l.Close()
+		return nil, fmt.Errorf("setting the webui socket permissions: %w", err)
+	}
+	return l, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		_ = l.Close()
+	}
+}
@@ -6,15 +6,19 @@ import (
 	"io"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"text/template"
 	"time"
 
-	"github.com/kairos-io/kairos-sdk/schema"
 	"github.com/kairos-io/kairos-agent/v2/internal/agent"
 	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	"github.com/kairos-io/kairos-sdk/collector"
 	"github.com/labstack/echo/v4"
 	process "github.com/mudler/go-processmanager"
 	"github.com/nxadm/tail"
@@ -135,7 +139,6 @@ func (t *TemplateRenderer) Render(w io.Writer, name string, data interface{}, c
 func Start(ctx context.Context) error {
 
 	s := state{}
-	listen := config.DefaultWebUIListenAddress
 
 	ec := echo.New()
 	assetHandler := http.FileServer(getFileSystem())
@@ -145,16 +148,12 @@ func Start(ctx context.Context) error {
 	}
 
 	ec.Renderer = renderer
-	agentConfig, err := agent.LoadConfig()
+	webUI, err := loadConfig()
 	if err != nil {
 		return err
 	}
 
-	if agentConfig.WebUI.ListenAddress != "" {
-		listen = agentConfig.WebUI.ListenAddress
-	}
-
-	if agentConfig.WebUI.Disable {
+	if webUI.Disable {
 		log.Println("WebUI installer disabled by branding")
 		return nil
 	}
@@ -168,7 +167,7 @@ func Start(ctx context.Context) error {
 		}
 		cloudConfig := formData.CloudConfig
 
-		err := schema.Validate(cloudConfig)
+		err := config.ValidateSchema(cloudConfig)
 		if err != nil {
 			return c.String(http.StatusOK, err.Error())
 		}
@@ -239,19 +238,105 @@ func Start(ctx context.Context) error {
 
 	ec.GET("/ws", streamProcess(&s))
 
-	if err := ec.Start(listen); err != nil && err != http.ErrServerClosed {
+	// Started by a socket unit, the listeners are set there and cannot be changed from here
+	listeners, err := activatedListeners()
+	if err != nil {
 		return err
 	}
+	activated := len(listeners) > 0
+	if !activated {
+		if listeners, err = listen(webUI); err != nil {
+			return err
+		}
+	}
 
-	go func() {
-		<-ctx.Done()
-		ct, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		err := ec.Shutdown(ct)
-		if err != nil {
-			log.Printf("shutdown failed: %s", err.Error())
+	errs := make(chan error, 1)
+	srv := serve(ec, listeners, errs)
+
+	// SIGHUP rotates the listeners to the ones in the current config, without stopping a running installation
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			shutdown(srv)
+			return nil
+		case err := <-errs:
+			shutdown(srv)
+			return err
+		case <-hup:
+			if activated {
+				log.Println("WebUI listeners are managed by systemd socket activation, not rotating them")
+				continue
+			}
+			next, err := loadConfig()
+			if err != nil {
+				log.Printf("could not reload the webui config, keeping the current listeners: %s", err.Error())
+				continue
+			}
+			if next == webUI {
+				continue
+			}
+			// Close the current listeners first, the new ones might reuse the same address
+			shutdown(srv)
+			listeners, err = listen(next)
+			if err != nil {
+				log.Printf("could not listen on the new webui addresses, going back to the previous ones: %s", err.Error())
+				if listeners, err = listen(webUI); err != nil {
+					return err
+				}
+			} else {
+				webUI = next
+			}
+			srv = serve(ec, listeners, errs)
+			log.Printf("WebUI listening on %s", listenerAddrs(listeners))
 		}
-		cancel()
-	}()
+	}
+}
+
+// loadConfig returns the webui config from the agent config with the cloud config on top
+func loadConfig() (config.WebUI, error) {
+	agentConfig, err := agent.LoadConfig()
+	if err != nil {
+		return config.WebUI{}, err
+	}
+	webUI := agentConfig.WebUI
+	if cc, err := config.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs); err == nil {
+		webUI = webUI.Override(cc.WebUI)
+	}
+	return webUI, nil
+}
+
+// serve starts serving the webui on every listener, serving errors are sent to errs
+func serve(handler http.Handler, listeners []net.Listener, errs chan<- error) *http.Server {
+	srv := &http.Server{Handler: handler}
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+				select {
+				case errs <- err:
+				default:
+				}
+			}
+		}(l)
+	}
+	return srv
+}
 
-	return nil
+func shutdown(srv *http.Server) {
+	ct, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ct); err != nil {
+		log.Printf("shutdown failed: %s", err.Error())
+	}
+}
+
+func listenerAddrs(listeners []net.Listener) []string {
+	var addrs []string
+	for _, l := range listeners {
+		addrs = append(addrs, l.Addr().String())
+	}
+	return addrs
 }
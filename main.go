@@ -6,31 +6,37 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/kairos-io/kairos-agent/v2/pkg/action"
 	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
 	"github.com/kairos-io/kairos-agent/v2/pkg/utils"
-	"github.com/mudler/go-pluggable"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
 
 	"github.com/kairos-io/kairos-agent/v2/internal/agent"
 	"github.com/kairos-io/kairos-agent/v2/internal/bus"
 	"github.com/kairos-io/kairos-agent/v2/internal/common"
+	"github.com/kairos-io/kairos-agent/v2/internal/i18n"
 	"github.com/kairos-io/kairos-agent/v2/internal/webui"
 	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/kairos-io/kairos-agent/v2/pkg/uki"
 	"github.com/kairos-io/kairos-sdk/bundles"
-	events "github.com/kairos-io/kairos-sdk/bus"
 	"github.com/kairos-io/kairos-sdk/collector"
 	"github.com/kairos-io/kairos-sdk/machine"
-	"github.com/kairos-io/kairos-sdk/schema"
 	"github.com/kairos-io/kairos-sdk/state"
 	"github.com/kairos-io/kairos-sdk/versioneer"
 	"github.com/sanity-io/litter"
 	"github.com/spf13/viper"
+	"github.com/twpayne/go-vfs/v5"
 	"github.com/urfave/cli/v2"
 	"gopkg.in/yaml.v3"
 )
@@ -52,7 +58,63 @@ func ReleasesToOutput(rels []string, output string) []string {
 
 var sourceFlag = cli.StringFlag{
 	Name:  "source",
-	Usage: "Source for upgrade. Composed of `type:address`. Accepts `file:`,`dir:` or `oci:` for the type of source.\nFor example `file:/var/share/myimage.tar`, `dir:/tmp/extracted` or `oci:repo/image:tag`",
+	Usage: "Source for upgrade. Composed of `type:address`. Accepts `file:`,`dir:`, `oci:`, `containerd:`, `podman:`, `s3:`, `http:` or `https:` for the type of source.\nFor example `file:/var/share/myimage.tar`, `dir:/tmp/extracted`, `oci:repo/image:tag`, `oci:repo/image@sha256:<digest>` for an image pinned by digest, verified once pulled, `containerd:repo/image:tag` for an image in the local containerd store, `s3://bucket/myimage.img` for an image file in S3, fetched with the AWS credentials of the environment, or `https://server/rootfs.tar.zst#sha256=<checksum>` for a tarball of the system, the checksum being optional",
+}
+
+var policyFileFlag = cli.StringFlag{
+	Name:  "policy-file",
+	Usage: "Image policy file (required labels, allowed registries, max image age) the OCI source must comply with. Overrides the image-policy config",
+}
+
+var yesFlag = cli.BoolFlag{
+	Name:    "yes",
+	Aliases: []string{"y"},
+	Usage:   "Do not ask for confirmation. It's only asked when running on a terminal",
+}
+
+// setImagePolicyFile passes the --policy-file flag to the config scan
+func setImagePolicyFile(c *cli.Context) error {
+	f := c.String("policy-file")
+	if f == "" {
+		return nil
+	}
+	if _, err := os.Stat(f); err != nil {
+		return fmt.Errorf("image policy %s: %w", f, err)
+	}
+	viper.Set(agentConfig.ImagePolicyFileKey, f)
+	return nil
+}
+
+var queryFormatFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "format",
+		Usage: "Output format (yaml|template). With template, the Go template given with --template is rendered with the whole data",
+	},
+	&cli.StringFlag{
+		Name:  "template",
+		Usage: "Go template to render with --format template, e.g. '{{ .persistent.name }}'. Sprig functions are available",
+	},
+}
+
+// templateFormat returns whether the output should be rendered with a template, checking the format flags
+func templateFormat(c *cli.Context) (bool, error) {
+	switch c.String("format") {
+	case "", "yaml":
+		if c.String("template") != "" {
+			return false, fmt.Errorf("--template requires '--format template'")
+		}
+		return false, nil
+	case "template":
+		if c.String("template") == "" {
+			return false, fmt.Errorf("--format template requires a template, pass it with --template")
+		}
+		if c.Args().Present() {
+			return false, fmt.Errorf("the template is rendered with the whole data, a query cannot be used with '--format template'")
+		}
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown format %s", c.String("format"))
+	}
 }
 
 var cmds = []*cli.Command{
@@ -62,7 +124,11 @@ var cmds = []*cli.Command{
 		Flags: []cli.Flag{
 			&cli.BoolFlag{
 				Name:  "force",
-				Usage: "Force an upgrade",
+				Usage: "Force an upgrade, even if the system is pinned or the source does not look like a bootable Kairos image",
+			},
+			&cli.BoolFlag{
+				Name:  "skip-approval",
+				Usage: "Upgrade without asking the upgrade_approval endpoint",
 			},
 			&cli.StringFlag{
 				Name:  "image",
@@ -72,6 +138,13 @@ var cmds = []*cli.Command{
 			&cli.StringFlag{Name: "boot-entry", Usage: "Specify a systemd-boot entry to upgrade (other than active/passive/recovery). The value should match the name of the '.efi' file."},
 			&cli.BoolFlag{Name: "pre", Usage: "Include pre-releases (rc, beta, alpha)"},
 			&cli.BoolFlag{Name: "recovery", Usage: "Upgrade recovery"},
+			&cli.BoolFlag{Name: "defer-recovery", Usage: "Rebuild recovery in a throttled background job after the next reboot. With --recovery it's only scheduled, otherwise recovery is rebuilt from the same source as the system"},
+			&cli.BoolFlag{Name: "delta", Usage: "Only pull the layers of the OCI source the active image lacks, pulling the whole image if it's not built over it"},
+			&cli.BoolFlag{Name: "dry-run", Usage: "Resolve and validate the upgrade and print what it would do, without writing anything"},
+			&cli.StringFlag{Name: "output", Usage: "Output format of the --dry-run plan (json|yaml|terminal)"},
+			&cli.BoolFlag{Name: "rollback-on-failure", Usage: "Upgrade as a transaction: reboot into the new image and restore the previous one and the boot entry if it does not report healthy"},
+			&cli.BoolFlag{Name: "schedule", Usage: "Keep running and upgrade to the newest release only within the maintenance window set in upgrade.window"},
+			&policyFileFlag,
 		},
 		Description: `
 Manually upgrade a kairos node Active image. Does not upgrade passive or recovery images.
@@ -84,6 +157,28 @@ To retrieve all the available versions, use "kairos upgrade list-releases"
 
 $ kairos upgrade list-releases
 
+Use --dry-run to validate the config and print the resolved plan: the source, the images written with their estimated
+sizes and the partitions touched. Nothing is written, so it can be used to check cloud configs in CI.
+On trusted boot systems it prints the space used in the EFI partition by each boot entry and its sysexts and confexts,
+and what the upgrade needs on top, telling what to prune if it doesn't fit.
+
+Use --rollback-on-failure to upgrade the active image as a single transaction. The boot entry selection is
+snapshotted, the new image is fully downloaded before anything is replaced, and the system reboots into it with the
+watchdog armed, with its defaults if not configured. If the upgraded system does not report healthy and falls back,
+the previous image and boot entry are restored. Use "kairos-agent upgrade transaction --status" to follow it.
+
+Use --schedule to keep running, checking for newer releases while the maintenance window set in upgrade.window is
+open and upgrading to the newest one, rebooting afterwards if upgrade.window.reboot is set. The window opens on its
+cron style schedule and stays open for its duration:
+
+upgrade:
+  window:
+    schedule: "0 2 * * 6"
+    duration: 4h
+    reboot: true
+
+"kairos-agent daemon" schedules the upgrades the same way when upgrade.window is set.
+
 See https://kairos.io/docs/upgrade/manual/ for documentation.
 
 `,
@@ -92,10 +187,12 @@ See https://kairos.io/docs/upgrade/manual/ for documentation.
 				Flags: []cli.Flag{
 					&cli.StringFlag{
 						Name:  "output",
-						Usage: "Output format (json|yaml|terminal)",
+						Usage: "Output format (json|yaml|terminal). json and yaml include the digest, creation date, size and annotations of each release",
 					},
 					&cli.BoolFlag{Name: "pre", Usage: "Include pre-releases (rc, beta, alpha)"},
 					&cli.BoolFlag{Name: "all", Usage: "Include older releases"},
+					&cli.StringFlag{Name: "channel", Usage: "Release channel to ask the providers for, i.e. stable or edge"},
+					&cli.BoolFlag{Name: "offline", Usage: "List the releases cached by the last listing instead of asking the registry"},
 				},
 				Name:        "list-releases",
 				Description: `List all available releases versions`,
@@ -111,35 +208,71 @@ See https://kairos.io/docs/upgrade/manual/ for documentation.
 					if err != nil {
 						return err
 					}
-					fmt.Printf("Current image:\n%s\n\n", currentImage)
+
+					// Providers take precedence over the registry tags
+					bus.Manager.Initialize()
+					provider, providerReleases := agent.ProviderReleases(bus.Manager.Plugins, agent.ReleasesRequest{
+						IncludePreReleases: c.Bool("pre"),
+						Channel:            c.String("channel"),
+					})
+					fromProvider := len(providerReleases) > 0
 
 					var tags []string
-					tags, err = getReleasesFromProvider(c.Bool("pre"))
-					if err != nil {
-						return err
+					for _, r := range providerReleases {
+						tags = append(tags, r.Image)
 					}
-
-					// Provider returns tags. Print and return.
-					if len(tags) > 0 {
-						fmt.Println("Available releases from provider:")
-						for _, r := range tags {
-							fmt.Println(r)
-							return nil
+					// The registry tags are cached, so they can be listed when the registry is unreachable
+					cache := agent.NewReleasesCache(vfs.OSFS, c.Bool("offline"))
+					if !fromProvider {
+						if c.Bool("all") {
+							tags, err = agent.ListAllReleases(c.Bool("pre"), cache)
+						} else {
+							tags, err = agent.ListNewerReleases(c.Bool("pre"), cache)
 						}
-					}
-
-					if c.Bool("all") {
-						fmt.Println("Available releases (all):")
-						tags, err = agent.ListAllReleases(c.Bool("pre"))
 						if err != nil {
 							return err
 						}
-					} else {
-						fmt.Println("Available releases with higher version:")
-						tags, err = agent.ListNewerReleases(c.Bool("pre"))
+					}
+
+					output := strings.ToLower(c.String("output"))
+					if output == "json" || output == "yaml" {
+						releases := agent.ReleasesOutput{Current: currentImage}
+						switch {
+						case fromProvider:
+							releases.Releases = agent.DescribeProviderReleases(provider, providerReleases)
+						case cache.FromCache():
+							// The registry can't be asked for the details either
+							releases.CachedAt = &cache.CachedAt
+							for _, t := range tags {
+								releases.Releases = append(releases.Releases, agent.Release{Image: t})
+							}
+						default:
+							releases.Releases = agent.DescribeReleases(tags)
+						}
+						var d []byte
+						if output == "json" {
+							d, err = json.Marshal(releases)
+						} else {
+							d, err = yaml.Marshal(releases)
+						}
 						if err != nil {
 							return err
 						}
+						fmt.Println(strings.TrimSpace(string(d)))
+						return nil
+					}
+
+					fmt.Printf("Current image:\n%s\n\n", currentImage)
+					if cache.FromCache() {
+						fmt.Printf("Showing the releases cached %s ago, the registry was not reached\n\n", time.Since(cache.CachedAt).Round(time.Second))
+					}
+					switch {
+					case fromProvider:
+						fmt.Printf("Available releases from provider %s:\n", provider)
+					case c.Bool("all"):
+						fmt.Println("Available releases (all):")
+					default:
+						fmt.Println("Available releases with higher version:")
 					}
 
 					if len(tags) == 0 {
@@ -154,6 +287,265 @@ See https://kairos.io/docs/upgrade/manual/ for documentation.
 					return nil
 				},
 			},
+			{
+				Name:        "status",
+				Usage:       "Shows the status of the deferred recovery rebuild",
+				Description: "Shows the status of the recovery rebuild deferred with --defer-recovery to a background job after reboot",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "Output format (json|yaml|terminal)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+					if err != nil {
+						return err
+					}
+					job, err := action.ReadRecoveryJob(cfg.Fs)
+					if err != nil {
+						return err
+					}
+					switch strings.ToLower(c.String("output")) {
+					case "json":
+						d, err := json.Marshal(job)
+						if err != nil {
+							return err
+						}
+						fmt.Println(string(d))
+					case "yaml":
+						d, err := yaml.Marshal(job)
+						if err != nil {
+							return err
+						}
+						fmt.Print(string(d))
+					default:
+						if job == nil {
+							fmt.Println("No recovery rebuild scheduled")
+							return nil
+						}
+						fmt.Printf("Recovery rebuild from %s: %s\n", job.Source, job.Status)
+						fmt.Printf("Scheduled: %s\n", job.Scheduled.Format(time.RFC3339))
+						if job.Started != nil {
+							fmt.Printf("Started: %s\n", job.Started.Format(time.RFC3339))
+						}
+						if job.Finished != nil {
+							fmt.Printf("Finished: %s\n", job.Finished.Format(time.RFC3339))
+						}
+						fmt.Printf("Attempts: %d/%d\n", job.Attempts, action.RecoveryJobMaxAttempts)
+						if job.Error != "" {
+							fmt.Printf("Last error: %s\n", job.Error)
+						}
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "transaction",
+				Usage: "Checks the outcome of the upgrade applied with --rollback-on-failure",
+				Description: `
+Commits the upgrade transaction once the upgraded system reports healthy, or rolls it back, restoring the previous image and boot entry, if the system fell back.
+It's started in the background on boot while the transaction is assessed, there is usually no need to run it manually. Use --status to show the transaction status.`,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "status",
+						Usage: "Show the status of the last transaction instead of checking it",
+					},
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "Output format of the status (json|yaml|terminal)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if !c.Bool("status") {
+						return agent.RunUpgradeTransactionCheck(constants.GetUserConfigDirs())
+					}
+					t, err := action.ReadUpgradeTransaction(vfs.OSFS)
+					if err != nil {
+						return err
+					}
+					switch strings.ToLower(c.String("output")) {
+					case "json":
+						d, _ := json.Marshal(t)
+						fmt.Println(string(d))
+					case "yaml":
+						d, _ := yaml.Marshal(t)
+						fmt.Print(string(d))
+					default:
+						if t == nil {
+							fmt.Println("No upgrade transaction")
+							return nil
+						}
+						fmt.Printf("Upgrade transaction to %s: %s\n", t.Source, t.Status)
+						fmt.Printf("Started: %s\n", t.Started.Format(time.RFC3339))
+						if t.Finished != nil {
+							fmt.Printf("Finished: %s\n", t.Finished.Format(time.RFC3339))
+						}
+						for _, step := range t.Steps {
+							fmt.Printf("  %s %s\n", step.Time.Format(time.RFC3339), step.Name)
+						}
+						if t.Error != "" {
+							fmt.Printf("Error: %s\n", t.Error)
+						}
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "verify",
+				Usage: "Verifies the system booted the upgrade applied with --rollback-on-failure",
+				Description: fmt.Sprintf(`
+Compares the booted Kairos version and kernel with the ones of the image deployed by the last upgrade transaction and, if they match, commits the transaction without waiting for the watchdog and publishes the %s event.
+It fails if the system did not reboot into the upgraded image, so orchestrators can run it after the reboot to close the upgrade.`, bus.EventUpgradeVerified),
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "Output format of the verification (json|yaml|terminal)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					v, err := agent.VerifyUpgrade(constants.GetUserConfigDirs())
+					if v == nil {
+						return err
+					}
+					switch strings.ToLower(c.String("output")) {
+					case "json":
+						d, _ := json.Marshal(v)
+						fmt.Println(string(d))
+					case "yaml":
+						d, _ := yaml.Marshal(v)
+						fmt.Print(string(d))
+					default:
+						fmt.Printf("Upgrade to %s\n", v.Source)
+						fmt.Printf("Version: %s (expected %s)\n", v.Booted.OS, orUnknown(v.Expected.OS))
+						fmt.Printf("Kernel: %s (expected %s)\n", v.Booted.Kernel, orUnknown(v.Expected.Kernel))
+						if err == nil {
+							fmt.Println("Verified")
+						}
+					}
+					return err
+				},
+			},
+			{
+				Name:  "history",
+				Usage: "Shows the install, upgrade and reset operations applied to the system",
+				Description: fmt.Sprintf(`
+Every install, upgrade and reset records its source, the digest of the deployed image, when it ran and its result
+in a journal on the state partition (%s), so the changes applied to a machine can be audited.`, filepath.Join(constants.RunningStateDir, constants.HistoryFile)),
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "Output format (json|yaml|table)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					file := filepath.Join(constants.RunningStateDir, constants.HistoryFile)
+					entries, err := action.ReadHistory(vfs.OSFS, file)
+					if err != nil {
+						return err
+					}
+					switch strings.ToLower(c.String("output")) {
+					case "json":
+						if entries == nil {
+							entries = []action.HistoryEntry{}
+						}
+						d, err := json.Marshal(entries)
+						if err != nil {
+							return err
+						}
+						fmt.Println(string(d))
+					case "yaml":
+						d, err := yaml.Marshal(entries)
+						if err != nil {
+							return err
+						}
+						fmt.Print(string(d))
+					default:
+						if len(entries) == 0 {
+							fmt.Printf("No operations recorded in %s\n", file)
+							return nil
+						}
+						w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+						fmt.Fprintln(w, "STARTED\tOPERATION\tSOURCE\tDIGEST\tDURATION\tRESULT")
+						for _, h := range entries {
+							result := h.Result
+							if h.Error != "" {
+								result = fmt.Sprintf("%s: %s", h.Result, h.Error)
+							}
+							fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", h.Started.Format(time.RFC3339), h.Operation, h.Source, h.Digest, h.Finished.Sub(h.Started).Round(time.Second), result)
+						}
+						return w.Flush()
+					}
+					return nil
+				},
+			},
+			{
+				Name:        "recovery-job",
+				Usage:       "Runs the deferred recovery rebuild",
+				Description: "Runs the recovery rebuild deferred with --defer-recovery, if any. It's started in the background on boot, there is usually no need to run it manually",
+				Action: func(_ *cli.Context) error {
+					return agent.RunRecoveryJob(constants.GetUserConfigDirs())
+				},
+			},
+			{
+				Name:  "smoke-tests",
+				Usage: "Runs the post-upgrade smoke tests",
+				Description: `
+Runs the smoke tests set in upgrade.smoke-tests by the last upgrade, if any. If all pass the boot is marked good, otherwise the system reboots into the previous image.
+They are started in the background on the first boot after the upgrade, there is usually no need to run them manually. Use --status to show the results.`,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "status",
+						Usage: "Show the results of the last smoke tests instead of running them",
+					},
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "Output format of the status (json|yaml|terminal)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+					if err != nil {
+						return err
+					}
+					if !c.Bool("status") {
+						return action.RunSmokeTests(cfg)
+					}
+					run, err := action.ReadSmokeTests(cfg.Fs)
+					if err != nil {
+						return err
+					}
+					switch strings.ToLower(c.String("output")) {
+					case "json":
+						d, _ := json.Marshal(run)
+						fmt.Println(string(d))
+					case "yaml":
+						d, _ := yaml.Marshal(run)
+						fmt.Print(string(d))
+					default:
+						if run == nil {
+							fmt.Println("No smoke tests scheduled")
+							return nil
+						}
+						fmt.Printf("Smoke tests: %s\n", run.Status)
+						fmt.Printf("Scheduled: %s\n", run.Scheduled.Format(time.RFC3339))
+						if run.Finished != nil {
+							fmt.Printf("Finished: %s\n", run.Finished.Format(time.RFC3339))
+						}
+						for _, r := range run.Results {
+							if r.Passed {
+								fmt.Printf("[passed] %s\n", r.Name)
+							} else {
+								fmt.Printf("[failed] %s: %s\n", r.Name, r.Error)
+							}
+						}
+						if run.Error != "" {
+							fmt.Printf("Error: %s\n", run.Error)
+						}
+					}
+					return nil
+				},
+			},
 		},
 		Before: func(c *cli.Context) error {
 			if err := validateSource(c.String("source")); err != nil {
@@ -162,6 +554,9 @@ See https://kairos.io/docs/upgrade/manual/ for documentation.
 			if bootFromLiveMedia() {
 				return fmt.Errorf("cannot upgrade from live media/unknown boot state")
 			}
+			if err := setImagePolicyFile(c); err != nil {
+				return err
+			}
 
 			return checkRoot()
 		},
@@ -170,7 +565,9 @@ See https://kairos.io/docs/upgrade/manual/ for documentation.
 			var source string
 			if c.Args().Len() == 1 {
 				v = c.Args().First()
-				fmt.Println("Warning: Passing a version as a positional argument is deprecated. Use --source flag instead.")
+				if err := agent.Deprecated(agent.DeprecatedUpgradePositional); err != nil {
+					return err
+				}
 				fmt.Println("The value will be used as a value for the --source flag")
 				source = v
 			}
@@ -181,7 +578,9 @@ See https://kairos.io/docs/upgrade/manual/ for documentation.
 			}
 
 			if image != "" {
-				fmt.Println("--image flag is deprecated, please use --source")
+				if err := agent.Deprecated(agent.DeprecatedUpgradeImageFlag); err != nil {
+					return err
+				}
 				// override source with image for now until we drop it
 				source = fmt.Sprintf("oci:%s", image)
 			}
@@ -197,9 +596,37 @@ See https://kairos.io/docs/upgrade/manual/ for documentation.
 				upgradeEntry = c.String("boot-entry")
 			}
 
-			return agent.Upgrade(source, c.Bool("force"),
+			if c.Bool("schedule") {
+				if source != "" || upgradeEntry != "" {
+					return fmt.Errorf("--schedule upgrades the active image to the newest release, it takes no source nor entry")
+				}
+				return agent.RunUpgradeScheduler(constants.GetUserConfigDirs())
+			}
+
+			if c.Bool("rollback-on-failure") && !c.Bool("dry-run") {
+				if upgradeEntry != "" {
+					return fmt.Errorf("--rollback-on-failure only upgrades the active image")
+				}
+				return agent.UpgradeTransaction(source, c.Bool("force"), c.Bool("skip-approval"),
+					c.Bool("strict-validation"), constants.GetUserConfigDirs(),
+					c.Bool("defer-recovery"), c.Bool("delta"),
+				)
+			}
+
+			if c.Bool("dry-run") {
+				plan, err := agent.PlanUpgrade(source, c.Bool("force"),
+					c.Bool("strict-validation"), constants.GetUserConfigDirs(),
+					upgradeEntry, c.Bool("defer-recovery"), c.Bool("delta"),
+				)
+				if err != nil {
+					return err
+				}
+				return printUpgradePlan(plan, c.String("output"))
+			}
+
+			return agent.Upgrade(source, c.Bool("force"), c.Bool("skip-approval"),
 				c.Bool("strict-validation"), constants.GetUserConfigDirs(),
-				upgradeEntry, c.Bool("pre"),
+				upgradeEntry, c.Bool("pre"), c.Bool("defer-recovery"), c.Bool("delta"),
 			)
 		},
 	},
@@ -227,6 +654,10 @@ Sends a generic event payload with the configuration found in the scanned direct
 		UsageText: "starts the agent",
 		Description: `
 Starts the kairos agent which automatically bootstrap and advertize to the kairos network.
+It returns once bootstrapped, the long lived parts of the agent are run by "kairos-agent daemon".
+
+On trusted boot systems, if the active entry exhausted its boot tries the passive image is promoted to active and
+set as default, so the failed image is not tried again, and 'agent.boot.rollback' is published on the bus.
 `,
 		Aliases: []string{"s"},
 		Flags: []cli.Flag{
@@ -234,7 +665,8 @@ Starts the kairos agent which automatically bootstrap and advertize to the kairo
 				Name: "restart",
 			},
 			&cli.BoolFlag{
-				Name: "force",
+				Name:  "force",
+				Usage: "[DEPRECATED] Has no effect",
 			},
 			&cli.StringFlag{
 				Name:  "api",
@@ -253,6 +685,9 @@ Starts the kairos agent which automatically bootstrap and advertize to the kairo
 			}
 
 			if c.Bool("force") {
+				if err := agent.Deprecated(agent.DeprecatedStartForce); err != nil {
+					return err
+				}
 				opts = append(opts, agent.ForceAgent)
 			}
 
@@ -263,6 +698,35 @@ Starts the kairos agent which automatically bootstrap and advertize to the kairo
 			return agent.Run(opts...)
 		},
 	},
+	{
+		Name:      "daemon",
+		Usage:     "Runs the long lived parts of the kairos agent",
+		UsageText: "runs the agent daemon",
+		Description: `
+Runs the parts of the agent enabled in the config that keep running until the daemon is stopped with SIGTERM.
+It's meant to run from its own service, next to the oneshot "kairos-agent start" one, and returns right away
+if none of them is configured.
+
+When reset_button is configured, it watches the hardware reset button. Holding it down shows a countdown on the
+console and reboots into the statereset entry, pressing it again cancels the reset.
+
+When heartbeat is configured, it periodically POSTs the node status (version, boot entry, last upgrade and health)
+to the heartbeat url, signed with the heartbeat signing-key if set.
+
+When upgrade.window is configured, it upgrades to the newest release within the maintenance window, like
+"kairos-agent upgrade --schedule".
+
+Sending a SIGHUP to the daemon re-scans the config directories and applies the changes that do not need a restart
+(debug, env and the heartbeat url, interval, token and signing key).
+`,
+		Action: func(c *cli.Context) error {
+			dirs := []string{"/oem", "/usr/local/cloud-config"}
+			if c.Args().Present() {
+				dirs = c.Args().Slice()
+			}
+			return agent.Daemon(agent.WithDirectory(dirs...))
+		},
+	},
 	{
 		Name:  "install-bundle",
 		Usage: "Installs a kairos bundle",
@@ -346,6 +810,9 @@ E.g. kairos-agent install-bundle container:quay.io/kairos/kairos...
 				Description: "WARNING this command will be deprecated in v3.2.0. Use `config` without a subcommand instead.\n\n Show the runtime configuration of the machine. It will scan the machine for all the configuration and will return the config file processed and found.",
 				Aliases:     []string{},
 				Action: func(c *cli.Context) error {
+					if err := agent.Deprecated(agent.DeprecatedConfigShow); err != nil {
+						return err
+					}
 					config, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
 					if err != nil {
 						return err
@@ -371,15 +838,34 @@ true
 or
 
 $ kairos-agent config get k3s
-enabled: true`,
+enabled: true
+
+or render a Go template with the whole config:
+
+$ kairos-agent config get --format template --template '{{ if .k3s.enabled }}k3s{{ end }}'
+k3s`,
 				Description: "It allows to navigate the YAML config file by searching with 'yq' style keywords as `config get k3s` to retrieve the k3s config block",
 				Aliases:     []string{"g"},
+				Flags:       queryFormatFlags,
 				Action: func(c *cli.Context) error {
+					useTemplate, err := templateFormat(c)
+					if err != nil {
+						return err
+					}
 					config, err := agentConfig.ScanNoLogs(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs, collector.StrictValidation(c.Bool("strict-validation")))
 					if err != nil {
 						return err
 					}
 
+					if useTemplate {
+						res, err := action.RenderConfigTemplate(c.String("template"), config)
+						if err != nil {
+							return err
+						}
+						_, err = os.Stdout.Write(res)
+						return err
+					}
+
 					res, err := config.Query(c.Args().First())
 					if err != nil {
 						return err
@@ -388,60 +874,218 @@ enabled: true`,
 					return nil
 				},
 			},
-		},
-	},
-	{
-		Name:        "state",
-		Usage:       "get machine state",
-		Description: "Print machine state information, e.g. `state get uuid` returns the machine uuid",
-		Aliases:     []string{},
-		Action: func(c *cli.Context) error {
-			runtime, err := state.NewRuntime()
-			if err != nil {
-				return err
-			}
-
-			fmt.Print(runtime)
-			return err
-		},
-		Subcommands: []*cli.Command{
 			{
-				Name:        "apply",
-				Usage:       "Applies a machine state",
-				Description: "Applies machine configuration in runtimes",
-				Aliases:     []string{"a"},
-				Action: func(c *cli.Context) error {
-					// TODO
-					return nil
+				Name:  "generate",
+				Usage: "Generate a cloud config to start from",
+				UsageText: `
+Generate a config from flags:
+
+$ kairos-agent config generate --user kairos --ssh-key github:someuser --device auto --k3s-role server
+
+or answer the prompts, the flags given are the defaults:
+
+$ kairos-agent config generate --interactive --file config.yaml`,
+				Description: "Generates a cloud config with a user, the install device, the k3s role and the upgrade source, validated against the config schema. It is meant as a starting point to extend.",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "interactive", Usage: "Prompt for the options"},
+					&cli.StringFlag{Name: "file", Usage: "Write the config to this file instead of stdout"},
+					&cli.StringFlag{Name: "user", Usage: "User to create"},
+					&cli.StringFlag{Name: "password", Usage: "Password of the user"},
+					&cli.StringSliceFlag{Name: "ssh-key", Usage: "SSH key of the user, github:USER and gitlab:USER are supported. Can be repeated"},
+					&cli.BoolFlag{Name: "admin", Value: true, Usage: "Make the user an admin (with sudo permissions)"},
+					&cli.StringFlag{Name: "device", Usage: "Install device, auto picks the biggest disk"},
+					&cli.BoolFlag{Name: "auto", Usage: "Install automatically when booting the live media and reboot"},
+					&cli.StringFlag{Name: "k3s-role", Usage: "Run k3s as server or agent"},
+					&cli.StringFlag{Name: "k3s-server", Usage: "URL of the k3s server agents join"},
+					&cli.StringFlag{Name: "k3s-token", Usage: "k3s token of the cluster"},
+					&cli.StringFlag{Name: "upgrade-source", Usage: "Image to upgrade from, i.e. oci:quay.io/kairos/ubuntu:24.04-standard-amd64-generic"},
 				},
-			},
-			{
-				Name:        "get",
-				Usage:       "get specific ",
-				Description: "query state data",
-				Aliases:     []string{"g"},
 				Action: func(c *cli.Context) error {
-					runtime, err := state.NewRuntime()
+					opts := agent.GenerateOptions{
+						User:          c.String("user"),
+						Password:      c.String("password"),
+						SSHKeys:       c.StringSlice("ssh-key"),
+						Admin:         c.Bool("admin"),
+						Device:        c.String("device"),
+						Auto:          c.Bool("auto"),
+						K3sRole:       c.String("k3s-role"),
+						K3sServer:     c.String("k3s-server"),
+						K3sToken:      c.String("k3s-token"),
+						UpgradeSource: c.String("upgrade-source"),
+					}
+					if c.Bool("interactive") {
+						if err := agent.PromptGenerateOptions(&opts); err != nil {
+							return err
+						}
+					}
+					cc, err := agent.GenerateConfig(opts)
 					if err != nil {
 						return err
 					}
-
-					res, err := runtime.Query(c.Args().First())
-					fmt.Print(res)
-					return err
+					if c.String("file") == "" {
+						fmt.Print(cc)
+						return nil
+					}
+					return os.WriteFile(c.String("file"), []byte(cc), 0600)
 				},
 			},
 		},
 	},
 	{
-		Name:        "render-template",
-		Usage:       "Render a Go template",
-		Description: "Render a Go template with machine state and config as data context",
-		Flags: []cli.Flag{
-			&cli.StringFlag{
-				Name:     "file",
-				Aliases:  []string{"f"},
-				Required: true,
+		Name:  "users",
+		Usage: "Manage the users defined in the cloud config",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "audit",
+				Usage: "Compares the users and SSH keys in the cloud config with the system",
+				Description: `
+Checks that the users in the cloud config exist with their groups, password hash and ssh_authorized_keys, and that
+no other keys are authorized for them. Exits with an error if any user drifted from the config.
+
+With --fix the drifted users are brought back to the config: missing users, passwords and keys are applied like on boot,
+missing groups are added and unexpected keys are removed.`,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "fix",
+						Usage: "Remediate the drift found",
+					},
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "Output format of the audit (json|yaml|terminal)",
+					},
+					&yesFlag,
+				},
+				Before: func(c *cli.Context) error {
+					return checkRoot()
+				},
+				Action: func(c *cli.Context) error {
+					cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+					if err != nil {
+						return err
+					}
+					audit, err := agent.AuditUsers(cfg)
+					if err != nil {
+						return err
+					}
+					if c.Bool("fix") && len(audit.Drift) > 0 {
+						if err = agent.Confirm(c.Bool("yes"), fmt.Sprintf("%d users drifted from the config and will be changed.", len(audit.Drift))); err != nil {
+							return err
+						}
+						err = agent.RemediateUsers(cfg, audit)
+					}
+					switch strings.ToLower(c.String("output")) {
+					case "json":
+						d, _ := json.Marshal(audit)
+						fmt.Println(string(d))
+					case "yaml":
+						d, _ := yaml.Marshal(audit)
+						fmt.Print(string(d))
+					default:
+						fmt.Printf("%d users checked, %d drifted\n", audit.Checked, len(audit.Drift))
+						for _, d := range audit.Drift {
+							status := "drifted"
+							if d.Fixed {
+								status = "fixed"
+							}
+							fmt.Printf("%s (%s):\n", d.Name, status)
+							if d.Missing {
+								fmt.Println("  user does not exist")
+							}
+							if d.PasswordDrift {
+								fmt.Println("  password differs from the config")
+							}
+							for _, g := range d.MissingGroups {
+								fmt.Printf("  not in group %s\n", g)
+							}
+							for _, k := range d.MissingKeys {
+								fmt.Printf("  missing key %s\n", k)
+							}
+							for _, k := range d.UnexpectedKeys {
+								fmt.Printf("  unexpected key %s\n", k)
+							}
+						}
+					}
+					if err != nil {
+						return err
+					}
+					for _, d := range audit.Drift {
+						if !d.Fixed {
+							return fmt.Errorf("users drifted from the config")
+						}
+					}
+					return nil
+				},
+			},
+		},
+	},
+	{
+		Name:        "state",
+		Usage:       "get machine state",
+		Description: "Print machine state information, e.g. `state get uuid` returns the machine uuid, `state get partitions` the size, usage and mount options of the Kairos partitions",
+		Aliases:     []string{},
+		Action: func(c *cli.Context) error {
+			runtime, err := machineState()
+			if err != nil {
+				return err
+			}
+
+			fmt.Print(runtime)
+			return err
+		},
+		Subcommands: []*cli.Command{
+			{
+				Name:        "apply",
+				Usage:       "Applies a machine state",
+				Description: "Applies machine configuration in runtimes",
+				Aliases:     []string{"a"},
+				Action: func(c *cli.Context) error {
+					// TODO
+					return nil
+				},
+			},
+			{
+				Name:  "get",
+				Usage: "get specific ",
+				Description: `query state data, e.g. "state get persistent.name", or render a Go template with the whole state:
+
+$ kairos-agent state get --format template --template '{{ .persistent.name }} {{ .partitions.persistent.free_bytes }}'`,
+				Aliases: []string{"g"},
+				Flags:   queryFormatFlags,
+				Action: func(c *cli.Context) error {
+					useTemplate, err := templateFormat(c)
+					if err != nil {
+						return err
+					}
+					runtime, err := machineState()
+					if err != nil {
+						return err
+					}
+
+					if useTemplate {
+						res, err := action.RenderStateTemplate(c.String("template"), runtime)
+						if err != nil {
+							return err
+						}
+						_, err = os.Stdout.Write(res)
+						return err
+					}
+
+					res, err := runtime.Query(c.Args().First())
+					fmt.Print(res)
+					return err
+				},
+			},
+		},
+	},
+	{
+		Name:        "render-template",
+		Usage:       "Render a Go template",
+		Description: "Render a Go template with machine state and config as data context",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "file",
+				Aliases:  []string{"f"},
+				Required: true,
 			},
 		},
 		Action: func(c *cli.Context) error {
@@ -499,6 +1143,10 @@ This command is meant to be used from the boot GRUB menu, but can be also starte
 		Name:  "manual-install",
 		Usage: "Starts the manual installation",
 		Description: `
+Installs the system with the given config file.
+
+Once done, the effective install, with the device, partition sizes, source digest and users actually used, is written as cloud-config
+to /oem/.kairos-install-plan.cloud-config, leaving the passwords out, so it can be reproduced on other machines. Use --print-plan to print it as well.
 `,
 		Aliases: []string{"m"},
 		Flags: []cli.Flag{
@@ -511,12 +1159,25 @@ This command is meant to be used from the boot GRUB menu, but can be also starte
 			&cli.BoolFlag{
 				Name: "reboot",
 			},
+			&cli.BoolFlag{
+				Name:  "force",
+				Usage: "Install even over the running deployment or from a source that does not look like a bootable Kairos image",
+			},
+			&cli.BoolFlag{
+				Name:  "print-plan",
+				Usage: "Print the cloud-config of the effective install once done, to reproduce it on other machines",
+			},
+			&yesFlag,
 			&sourceFlag,
+			&policyFileFlag,
 		},
 		Before: func(c *cli.Context) error {
 			if err := validateSource(c.String("source")); err != nil {
 				return err
 			}
+			if err := setImagePolicyFile(c); err != nil {
+				return err
+			}
 
 			return checkRoot()
 		},
@@ -528,7 +1189,7 @@ This command is meant to be used from the boot GRUB menu, but can be also starte
 
 			source := c.String("source")
 
-			return agent.ManualInstall(config, source, c.String("device"), c.Bool("reboot"), c.Bool("poweroff"), c.Bool("strict-validation"))
+			return agent.ManualInstall(config, source, c.String("device"), c.Bool("reboot"), c.Bool("poweroff"), c.Bool("strict-validation"), c.Bool("force"), c.Bool("yes"), c.Bool("print-plan"))
 		},
 	},
 	{
@@ -547,11 +1208,15 @@ This command is meant to be used from the boot GRUB menu, but can be started man
 			if err := validateSource(c.String("source")); err != nil {
 				return err
 			}
+			if err := setImagePolicyFile(c); err != nil {
+				return err
+			}
 
 			return checkRoot()
 		},
 		Flags: []cli.Flag{
 			&sourceFlag,
+			&policyFileFlag,
 		},
 		Action: func(c *cli.Context) error {
 			source := c.String("source")
@@ -562,7 +1227,16 @@ This command is meant to be used from the boot GRUB menu, but can be started man
 	{
 		Name:    "recovery",
 		Aliases: []string{"r"},
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "console",
+				Usage: "Show the recovery console with guided repair actions instead of the QR code",
+			},
+		},
 		Action: func(c *cli.Context) error {
+			if c.Bool("console") {
+				return agent.RecoveryConsole(constants.GetUserConfigDirs()...)
+			}
 			return agent.Recovery()
 		},
 		Usage: "Starts kairos recovery mode",
@@ -572,6 +1246,10 @@ Starts kairos recovery mode.
 In recovery mode a QR code will be printed out on the screen which should be used in conjunction with "kairos bridge". Pass by the QR code as snapshot
 to the bridge to connect over the machine which runs the "kairos recovery" command.
 
+With --console a menu of guided repair actions is shown instead: reset the system, restore an OEM backup, rebuild
+the bootloader, collect the logs to a USB drive, open a shell or start the remote recovery with the QR code. The
+console only runs when booted into the recovery system.
+
 See also https://kairos.io/after_install/recovery_mode/ for documentation.
 
 This command is meant to be used from the boot GRUB menu, but can likely be used standalone`,
@@ -591,6 +1269,15 @@ This command is meant to be used from the boot GRUB menu, but can likely be used
 				Name:  "reset-oem",
 				Usage: "Reset the OEM partition. Warning: this will delete any persistent data on the OEM partition.",
 			},
+			&cli.StringFlag{
+				Name:  "restore-oem-backup",
+				Usage: "Restore the OEM partition contents from a backup created with 'kairos-agent oem backup'. The backup file is read before any partition is formatted.",
+			},
+			&cli.StringFlag{
+				Name:  "oem-backup-key",
+				Usage: "Key file the OEM backup was encrypted with",
+			},
+			&yesFlag,
 		},
 		Before: func(c *cli.Context) error {
 			return checkRoot()
@@ -599,8 +1286,18 @@ This command is meant to be used from the boot GRUB menu, but can likely be used
 			reboot := c.Bool("reboot")
 			unattended := c.Bool("unattended")
 			resetOem := c.Bool("reset-oem")
+			// unattended runs do not wait for the user, so they are not asked either
+			if !unattended {
+				msg := "Resetting will delete all the persistent data on the node."
+				if resetOem {
+					msg = "Resetting will delete all the persistent data and the OEM partition contents on the node."
+				}
+				if err := agent.Confirm(c.Bool("yes"), msg); err != nil {
+					return err
+				}
+			}
 
-			return agent.Reset(reboot, unattended, resetOem, constants.GetUserConfigDirs()...)
+			return agent.Reset(reboot, unattended, resetOem, c.String("restore-oem-backup"), c.String("oem-backup-key"), constants.GetUserConfigDirs()...)
 		},
 		Usage: "Starts kairos reset mode",
 		Description: `
@@ -617,7 +1314,7 @@ This command is meant to be used from the boot GRUB menu, but can likely be used
 		Name: "validate",
 		Action: func(c *cli.Context) error {
 			config := c.Args().First()
-			return schema.Validate(config)
+			return agentConfig.ValidateSchema(config)
 		},
 		Usage: "Validates a cloud config file",
 		Description: `
@@ -640,7 +1337,7 @@ The validate command expects a configuration file as its only argument. Local fi
 				version = common.VERSION
 			}
 
-			json, err := schema.JSONSchema(version)
+			json, err := agentConfig.JSONSchema(version)
 
 			if err != nil {
 				return err
@@ -653,6 +1350,38 @@ The validate command expects a configuration file as its only argument. Local fi
 		Usage:       "Print out Kairos' Cloud Configuration JSON Schema",
 		Description: `Prints out Kairos' Cloud Configuration JSON Schema`,
 	},
+	{
+		Name: "print-event-schema",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "event",
+				Usage: "Print only the schema of the given event, e.g. agent.reset.completed",
+			},
+			&cli.BoolFlag{
+				Name:  "list",
+				Usage: "List the events with a schema",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if c.Bool("list") {
+				for _, e := range agent.EventNames() {
+					fmt.Println(e)
+				}
+				return nil
+			}
+			json, err := agent.EventSchema(c.String("event"))
+			if err != nil {
+				return err
+			}
+			fmt.Println(json)
+			return nil
+		},
+		Usage: "Print out the JSON Schema of the events the agent publishes",
+		Description: `Prints out the JSON Schema of the payloads of the events the agent publishes to the providers, versioned as ` + agent.EventSchemaVersion + `.
+
+The payloads are sent json encoded in the data of the events. Payloads carrying a yaml document in their config other than the
+cloud config define it as <event>.config, and the documents expected in the data of the provider responses as <event>.response.`,
+	},
 	{
 		Name:        "run-stage",
 		Description: "Run stage from cloud-init",
@@ -672,6 +1401,14 @@ The validate command expects a configuration file as its only argument. Local fi
 				Usage:   "Only print the modules that would run in the order they would run",
 				Aliases: []string{"a"},
 			},
+			&cli.BoolFlag{
+				Name:  "report",
+				Usage: "Print the files and services changed by the stage",
+			},
+			&cli.StringFlag{
+				Name:  "output",
+				Usage: "Output format of the report (json|yaml|terminal)",
+			},
 		},
 		Before: func(c *cli.Context) error {
 			if c.Args().Len() != 1 {
@@ -700,7 +1437,38 @@ The validate command expects a configuration file as its only argument. Local fi
 			if c.Bool("analyze") {
 				return utils.RunStageAnalyze(config, stage)
 			}
-			return utils.RunStage(config, stage)
+			if !c.Bool("report") {
+				return utils.RunStage(config, stage)
+			}
+			audit, err := utils.RunStageAudit(config, stage)
+			if audit == nil {
+				return err
+			}
+			switch strings.ToLower(c.String("output")) {
+			case "json":
+				d, _ := json.Marshal(audit)
+				fmt.Println(string(d))
+			case "yaml":
+				d, _ := yaml.Marshal(audit)
+				fmt.Print(string(d))
+			default:
+				if audit.Empty() {
+					fmt.Printf("Stage %s changed nothing\n", stage)
+				}
+				for _, f := range audit.Created {
+					fmt.Printf("[created]  %s\n", f)
+				}
+				for _, f := range audit.Modified {
+					fmt.Printf("[modified] %s\n", f)
+				}
+				for _, f := range audit.Removed {
+					fmt.Printf("[removed]  %s\n", f)
+				}
+				for _, svc := range audit.Services {
+					fmt.Printf("[%s] %s\n", svc.Action, svc.Service)
+				}
+			}
+			return err
 		},
 	},
 	{
@@ -714,6 +1482,10 @@ The validate command expects a configuration file as its only argument. Local fi
 				Usage: "Platform/arch to pull image from",
 				Value: fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH),
 			},
+			&cli.IntFlag{
+				Name:  "workers",
+				Usage: "Layers to download at once while the previous ones are extracted, pull-workers from the config by default",
+			},
 		},
 		Before: func(c *cli.Context) error {
 			if c.Args().Len() != 2 {
@@ -734,9 +1506,14 @@ The validate command expects a configuration file as its only argument. Local fi
 			if err != nil {
 				return err
 			}
+			if workers := c.Int("workers"); workers > 0 {
+				if extractor, ok := config.ImageExtractor.(v1.OCIImageExtractor); ok {
+					extractor.Workers = workers
+					config.ImageExtractor = extractor
+				}
+			}
 			config.Logger.Infof("Starting download and extraction for image %s to %s\n", image, destination)
-			e := v1.OCIImageExtractor{}
-			if err = e.ExtractImage(image, destination, c.String("platform")); err != nil {
+			if err = config.ImageExtractor.ExtractImage(image, destination, c.String("platform")); err != nil {
 				return err
 			}
 			config.Logger.Infof("Image %s downloaded and extracted to %s correctly\n", image, destination)
@@ -763,6 +1540,131 @@ The validate command expects a configuration file as its only argument. Local fi
 			return nil
 		},
 	},
+	{
+		Name:  "deprecations",
+		Usage: "Lists the deprecated flags and commands used by an invocation",
+		UsageText: `
+Pass the invocation to check after '--':
+
+$ kairos-agent deprecations --output json -- upgrade --image quay.io/kairos/opensuse:latest`,
+		Description: `
+Lists the deprecated flags and commands used by the given invocation, together with their replacement.
+With no invocation, it lists all the known deprecations.
+
+Deprecated usages can be turned into errors by setting 'strict_cli: true' in the agent config (/etc/kairos/agent.yaml).`,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "output",
+				Usage: "Output format (json|yaml|terminal)",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			deprecations := agent.Deprecations()
+			if c.Args().Present() {
+				deprecations = agent.FindDeprecations(c.Args().Slice())
+			}
+
+			switch strings.ToLower(c.String("output")) {
+			case "json":
+				d, err := json.Marshal(deprecations)
+				if err != nil {
+					return err
+				}
+				fmt.Println(string(d))
+			case "yaml":
+				d, err := yaml.Marshal(deprecations)
+				if err != nil {
+					return err
+				}
+				fmt.Print(string(d))
+			default:
+				if len(deprecations) == 0 {
+					fmt.Println("No deprecated usages found")
+					return nil
+				}
+				for _, d := range deprecations {
+					fmt.Printf("%s (%s): use '%s' instead\n", d.Usage, d.Kind, d.Replacement)
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Name:  "doctor",
+		Usage: "Checks the running system for problems",
+		Description: `
+Audits the permissions of the running system, flagging world-writable files, setuid binaries not in the allowlist and
+critical files with wrong permissions. The report is also published on the bus as 'agent.permissions.audit' for compliance scanners.
+
+The audits of the last deployed images are shown too, if 'permissions_audit' is set in the config. The setuid allowlist
+can be extended with 'permissions_audit.setuid-allowlist'.
+
+SD cards and eMMC devices are listed with the wear they report, warning when their expected lifetime is running out.`,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "output",
+				Usage: "Output format (json|yaml|terminal)",
+			},
+		},
+		Before: func(c *cli.Context) error {
+			return checkRoot()
+		},
+		Action: func(c *cli.Context) error {
+			report, err := agent.Doctor(constants.GetUserConfigDirs())
+			if err != nil {
+				return err
+			}
+			switch strings.ToLower(c.String("output")) {
+			case "json":
+				d, err := json.Marshal(report)
+				if err != nil {
+					return err
+				}
+				fmt.Println(string(d))
+			case "yaml":
+				d, err := yaml.Marshal(report)
+				if err != nil {
+					return err
+				}
+				fmt.Print(string(d))
+			default:
+				printFindings := func(name string, r *v1.PermissionsReport) {
+					if len(r.Findings) == 0 {
+						fmt.Printf("%s: no permissions findings\n", name)
+						return
+					}
+					fmt.Printf("%s: %d permissions findings\n", name, len(r.Findings))
+					for _, f := range r.Findings {
+						fmt.Printf("  [%s] %s %s: %s\n", f.Kind, f.Mode, f.Path, f.Detail)
+					}
+				}
+				printFindings("Running system", report.Permissions)
+				labels := make([]string, 0, len(report.Deployments))
+				for label := range report.Deployments {
+					labels = append(labels, label)
+				}
+				sort.Strings(labels)
+				for _, label := range labels {
+					r := report.Deployments[label]
+					printFindings(fmt.Sprintf("Deployed %s (%s, %s)", label, r.Root, r.Time.Format(time.RFC3339)), r)
+				}
+				for _, m := range report.Media {
+					fmt.Printf("%s: %s", m.Device, m.Kind)
+					if m.LifeTimeUsed > 0 {
+						fmt.Printf(", up to %d%% of its estimated lifetime used", m.LifeTimeUsed)
+					}
+					if m.PreEOL != "" {
+						fmt.Printf(", reserved blocks %s", m.PreEOL)
+					}
+					fmt.Println()
+				}
+				for _, w := range report.Warnings {
+					fmt.Printf("WARNING: %s\n", w)
+				}
+			}
+			return nil
+		},
+	},
 	{
 		Name:        "versioneer",
 		Usage:       "versioneer subcommands",
@@ -771,7 +1673,7 @@ The validate command expects a configuration file as its only argument. Local fi
 	},
 	{
 		Name:        "bootentry",
-		Usage:       "bootentry [--select]",
+		Usage:       "bootentry [--select] | bootentry assess",
 		Description: "bootentry subcommands",
 		Flags: []cli.Flag{
 			&cli.StringFlag{
@@ -779,6 +1681,10 @@ The validate command expects a configuration file as its only argument. Local fi
 				Usage:   "Select the boot entry",
 				Aliases: []string{"s"},
 			},
+			&cli.BoolFlag{
+				Name:  "no-efivars",
+				Usage: "Do not read or write EFI variables, for firmwares that lock them",
+			},
 		},
 		Before: func(c *cli.Context) error {
 			return checkRoot()
@@ -788,6 +1694,9 @@ The validate command expects a configuration file as its only argument. Local fi
 			if err != nil {
 				return err
 			}
+			if c.Bool("no-efivars") {
+				cfg.NoEfivars = true
+			}
 			s := c.String("select")
 			// If we got a selection just go for it, otherwise enter an interactive mode to show entries and let user choose one
 			if s != "" {
@@ -795,44 +1704,1193 @@ The validate command expects a configuration file as its only argument. Local fi
 			}
 			return action.ListBootEntries(cfg)
 		},
+		Subcommands: []*cli.Command{
+			{
+				Name:  "assess",
+				Usage: "bootentry assess [--entry cos --simulate-failure|--reset]",
+				Description: `
+Shows the boot assessment (boot counting) state of the trusted boot entries, and simulates failed boots to validate the fallback
+to other entries works on the hardware before relying on it.
+
+--simulate-failure counts a failed boot of the entry, as the bootloader does when the entry is booted but never marked good,
+with --exhaust all its remaining tries are counted as failed so the next boot falls back to the next entry.
+--reset restarts the boot counting of the entry with --tries tries, also for entries already marked good.`,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "entry",
+						Usage: "Boot entry to simulate the failures on or reset, i.e. cos, fallback or recovery",
+					},
+					&cli.BoolFlag{
+						Name:  "simulate-failure",
+						Usage: "Count a failed boot of the entry",
+					},
+					&cli.BoolFlag{
+						Name:  "exhaust",
+						Usage: "With --simulate-failure, count all the remaining tries as failed",
+					},
+					&cli.BoolFlag{
+						Name:  "reset",
+						Usage: "Restart the boot counting of the entry",
+					},
+					&cli.IntFlag{
+						Name:  "tries",
+						Usage: "Boot tries of the entry on --reset",
+						Value: action.DefaultBootTries,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+					if err != nil {
+						return err
+					}
+					entry := c.String("entry")
+					if (c.Bool("simulate-failure") || c.Bool("reset")) && entry == "" {
+						return fmt.Errorf("--entry is required to simulate failures or reset the assessment")
+					}
+					switch {
+					case c.Bool("simulate-failure") && c.Bool("reset"):
+						return fmt.Errorf("--simulate-failure and --reset can't be used together")
+					case c.Bool("simulate-failure"):
+						a, err := action.SimulateBootFailure(cfg, entry, c.Bool("exhaust"))
+						if err != nil {
+							return err
+						}
+						fmt.Println(a.String())
+					case c.Bool("reset"):
+						a, err := action.ResetBootAssessment(cfg, entry, c.Int("tries"))
+						if err != nil {
+							return err
+						}
+						fmt.Println(a.String())
+					default:
+						assessments, err := action.ReadBootAssessments(cfg)
+						if err != nil {
+							return err
+						}
+						for _, a := range assessments {
+							if entry == "" || a.Entry == entry {
+								fmt.Println(a.String())
+							}
+						}
+					}
+					return nil
+				},
+			},
+		},
 	},
-}
-
-func main() {
-	bus.Manager.Initialize()
+	{
+		Name:  "clone-to",
+		Usage: "clone-to --device /dev/sdb",
+		Description: `
+Clones the installation disk, including partitions, images and bootloader, into the given device so it can be used as a spare boot disk.
 
-	app := &cli.App{
+The filesystem labels of the cloned disk get the "_S" suffix, so it can stay attached along with the source disk. The spare gets a
+copy of the ESP and bootloader, but the bootloader finds the partitions by label, so the spare does not boot on its own: to boot
+from it once the source disk is detached, promote it with --promote from live media. The same applies to the spare made by the
+install.mirror-device option.
+For a consistent clone run it from recovery or live media.`,
 		Flags: []cli.Flag{
-			&cli.BoolFlag{
-				Name:    "strict-validation",
-				Usage:   "Fail instead of warn on validation errors.",
-				EnvVars: []string{"STRICT_VALIDATIONS"},
+			&cli.StringFlag{
+				Name:     "device",
+				Usage:    "Device to clone the installation into",
+				Required: true,
 			},
-			&cli.BoolFlag{
-				Name:    "debug",
-				Usage:   "enable debug output",
-				EnvVars: []string{"KAIROS_AGENT_DEBUG"},
+			&cli.StringFlag{
+				Name:  "source",
+				Usage: "Device to clone from. Defaults to the disk the system booted from",
 			},
-		},
-		Name:    "kairos-agent",
-		Version: common.VERSION,
-		Authors: []*cli.Author{
-			{
-				Name: "Ettore Di Giacinto",
+			&cli.BoolFlag{
+				Name:  "promote",
+				Usage: "Promote the given spare device instead, restoring its filesystem labels so the system boots from it",
 			},
+			&yesFlag,
 		},
-		Usage: "kairos agent start",
-		Description: `
-The kairos agent is a component to abstract away node ops, providing a common feature-set across kairos variants.
-`,
-		UsageText: ``,
-		Copyright: "kairos authors",
 		Before: func(c *cli.Context) error {
-			var debug bool
-			// Get debug from env or cmdline
-			cmdline, _ := os.ReadFile("/proc/cmdline")
-			if strings.Contains(string(cmdline), "rd.kairos.debug") {
-				debug = true
+			return checkRoot()
+		},
+		Action: func(c *cli.Context) error {
+			cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+			if err != nil {
+				return err
+			}
+			if c.Bool("promote") {
+				return action.PromoteSpare(cfg, c.String("device"))
+			}
+			if err = agent.Confirm(c.Bool("yes"), fmt.Sprintf("Cloning will erase all the data on %s.", c.String("device"))); err != nil {
+				return err
+			}
+			return action.CloneTo(cfg, c.String("source"), c.String("device"))
+		},
+	},
+	{
+		Name:  "migrate-layout",
+		Usage: "migrate-layout [--device /dev/sda] [--dry-run]",
+		Description: `
+Migrates the disk layout of an older installation to the current one without reinstalling:
+converts MBR partition tables to GPT on EFI systems, adds the OEM partition if missing and grows the recovery partition to the current sizing.
+
+Each step is verified after applying it. The partition table is backed up first and restored if a step fails before a filesystem was grown.
+Steps that can't be done in place are reported with the reason and skipped.
+Run it from recovery or live media, with --backup-dir pointing to a disk other than the one being migrated.`,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "device",
+				Usage: "Device to migrate. Defaults to the disk holding the state partition",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Only show the migration plan",
+			},
+			&cli.StringFlag{
+				Name:  "backup-dir",
+				Usage: "Directory to back up the partition table to",
+				Value: constants.LayoutBackupDir,
+			},
+			&cli.StringFlag{
+				Name:  "output",
+				Usage: "Output format of the plan (json|yaml|terminal)",
+			},
+			&yesFlag,
+		},
+		Before: func(c *cli.Context) error {
+			return checkRoot()
+		},
+		Action: func(c *cli.Context) error {
+			cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+			if err != nil {
+				return err
+			}
+			plan, err := action.PlanLayoutMigration(cfg, c.String("device"))
+			if err != nil {
+				return err
+			}
+			if !c.Bool("dry-run") && len(plan.Pending()) > 0 {
+				if err = agent.Confirm(c.Bool("yes"), fmt.Sprintf("Migrating will change the partition table of %s.", plan.Device)); err != nil {
+					return err
+				}
+				err = action.MigrateLayout(cfg, plan, c.String("backup-dir"))
+			}
+			switch strings.ToLower(c.String("output")) {
+			case "json":
+				d, _ := json.Marshal(plan)
+				fmt.Println(string(d))
+			case "yaml":
+				d, _ := yaml.Marshal(plan)
+				fmt.Print(string(d))
+			default:
+				if len(plan.Steps) == 0 {
+					fmt.Printf("%s already has the current layout\n", plan.Device)
+				}
+				for _, s := range plan.Steps {
+					switch {
+					case s.Done:
+						fmt.Printf("[done]    %s\n", s.Description)
+					case s.Feasible:
+						fmt.Printf("[pending] %s\n", s.Description)
+					default:
+						fmt.Printf("[skipped] %s: %s\n", s.Description, s.Reason)
+					}
+				}
+				if plan.Backup != "" {
+					fmt.Printf("Partition table backup: %s\n", plan.Backup)
+				}
+			}
+			return err
+		},
+	},
+	{
+		Name:  "source-size",
+		Usage: "source-size --source oci:quay.io/kairos/opensuse:latest",
+		Description: `
+Estimates the size of a source the same way install and upgrade do to size the images and partitions.
+
+Shows the raw size reported by the registry or the filesystem, the adjusted image size and the partition sizes
+an install with the default partitioning would get. Useful to debug installs and upgrades running out of space.`,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "source",
+				Usage:    "Source to estimate. Composed of `type:address`. Accepts `file:`,`dir:`, `oci:`, `containerd:`, `podman:`, `s3:`, `http:` or `https:` for the type of source",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "output",
+				Usage: "Output format (json|yaml|terminal)",
+			},
+			&cli.IntFlag{
+				Name:  "workers",
+				Usage: "Directories to read at once while walking dir sources, size-workers from the config by default",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			source, err := v1.NewSrcFromURI(c.String("source"))
+			if err != nil {
+				return err
+			}
+			cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+			if err != nil {
+				return err
+			}
+			if workers := c.Int("workers"); workers > 0 {
+				cfg.SizeWorkers = workers
+			}
+			estimation, err := agentConfig.EstimateSourceSize(cfg, source)
+			if err != nil {
+				return fmt.Errorf("estimating the size of %s: %w", source.String(), err)
+			}
+			estimation.DerivePartitions()
+			switch strings.ToLower(c.String("output")) {
+			case "json":
+				d, _ := json.Marshal(estimation)
+				fmt.Println(string(d))
+			case "yaml":
+				d, _ := yaml.Marshal(estimation)
+				fmt.Print(string(d))
+			default:
+				fmt.Printf("Source:     %s\n", estimation.Source)
+				fmt.Printf("Raw size:   %d bytes\n", estimation.Raw)
+				fmt.Printf("Factor:     %.1f\n", estimation.Factor)
+				fmt.Printf("Image size: %dMb\n", estimation.Size)
+				fmt.Println("Partitions:")
+				for _, label := range []string{constants.OEMLabel, constants.RecoveryLabel, constants.StateLabel, constants.PersistentLabel} {
+					if size := estimation.Partitions[label]; size != 0 {
+						fmt.Printf("  %-15s %dMb\n", label, size)
+					} else {
+						fmt.Printf("  %-15s rest of the disk\n", label)
+					}
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Name:  "watchdog",
+		Usage: "Report the health of the upgraded system to the watchdog",
+		Description: `
+The watchdog, set with the watchdog config, remediates an upgraded system which does not report healthy within
+watchdog.max-boots boots or watchdog.timeout. The system reports healthy when the upgrade smoke tests pass or by
+running "kairos-agent watchdog healthy", i.e. from a service of the workload once it is up.
+
+The remediation (watchdog.action) is either fallback, booting the passive system, reset, resetting the system from
+recovery, or none. The watchdog.webhook, if set, is sent the watchdog state once remediated. Booting passive or
+recovery by hand, while the active system did not fail, leaves the watchdog armed.`,
+		Subcommands: []*cli.Command{
+			{
+				Name:        "healthy",
+				Usage:       "Reports the running system healthy, disarming the watchdog",
+				Description: "Reports the upgraded system healthy, so the watchdog does not remediate it",
+				Before: func(c *cli.Context) error {
+					return checkRoot()
+				},
+				Action: func(_ *cli.Context) error {
+					cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+					if err != nil {
+						return err
+					}
+					return action.MarkWatchdogHealthy(cfg)
+				},
+			},
+			{
+				Name:        "check",
+				Usage:       "Runs the watchdog boot check",
+				Description: "Counts the boot and remediates the system if it did not report healthy in time. It's started in the background on boot while the watchdog is armed, there is usually no need to run it manually",
+				Before: func(c *cli.Context) error {
+					return checkRoot()
+				},
+				Action: func(_ *cli.Context) error {
+					return agent.RunWatchdog(constants.GetUserConfigDirs())
+				},
+			},
+			{
+				Name:  "status",
+				Usage: "Shows the watchdog state",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "Output format (json|yaml|terminal)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+					if err != nil {
+						return err
+					}
+					st, err := action.ReadWatchdog(cfg.Fs)
+					if err != nil {
+						return err
+					}
+					switch strings.ToLower(c.String("output")) {
+					case "json":
+						d, _ := json.Marshal(st)
+						fmt.Println(string(d))
+					case "yaml":
+						d, _ := yaml.Marshal(st)
+						fmt.Print(string(d))
+					default:
+						if st == nil {
+							fmt.Println("The watchdog was never armed")
+							return nil
+						}
+						fmt.Printf("Watchdog: %s\n", st.Status)
+						fmt.Printf("Armed: %s\n", st.Armed.Format(time.RFC3339))
+						fmt.Printf("Boots: %d\n", st.Boots)
+						fmt.Printf("Action: %s\n", st.Action)
+						if st.Reason != "" {
+							fmt.Printf("Reason: %s\n", st.Reason)
+						}
+						if st.Remediated != nil {
+							fmt.Printf("Remediated: %s\n", st.Remediated.Format(time.RFC3339))
+						}
+					}
+					return nil
+				},
+			},
+		},
+	},
+	{
+		Name:        "image",
+		Usage:       "Manage the loopback images of the system",
+		Description: "image subcommands",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "compact",
+				Usage:     "Shrink an image to the minimal size of its filesystem",
+				UsageText: "image compact passive|recovery",
+				Description: `
+Shrinks the passive or recovery image file to the minimal size of its filesystem, giving back the free space
+accumulated inside it to the partition holding it. The filesystem is checked before and after shrinking it.
+
+The booted image can't be compacted. Run it from recovery to compact passive, or from active to compact recovery.
+Squashfs recovery images are already compact.`,
+				ArgsUsage: "passive|recovery",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "Output format (json|yaml|terminal)",
+					},
+				},
+				Before: func(c *cli.Context) error {
+					if c.Args().Len() != 1 {
+						return fmt.Errorf("expected the image to compact, passive or recovery")
+					}
+					return checkRoot()
+				},
+				Action: func(c *cli.Context) error {
+					cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+					if err != nil {
+						return err
+					}
+					compaction, err := action.CompactImage(cfg, c.Args().First())
+					if err != nil {
+						return err
+					}
+					switch strings.ToLower(c.String("output")) {
+					case "json":
+						d, _ := json.Marshal(compaction)
+						fmt.Println(string(d))
+					case "yaml":
+						d, _ := yaml.Marshal(compaction)
+						fmt.Print(string(d))
+					default:
+						fmt.Printf("Compacted %s from %dMb to %dMb, %dMb reclaimed\n", compaction.File, compaction.SizeBefore>>20, compaction.SizeAfter>>20, compaction.Reclaimed()>>20)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "verify",
+				Usage: "Check the filesystems of the images without modifying them",
+				Description: `
+Checks the filesystems of the active, passive and recovery images read-only, so a corrupted fallback image is
+found before it is needed. The booted image is skipped, as its filesystem is in use. Fails if any image has errors.
+
+Schedule it with "kairos-agent schedule add --on-calendar weekly image-verify".`,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "Output format (json|yaml|terminal)",
+					},
+				},
+				Before: func(c *cli.Context) error {
+					return checkRoot()
+				},
+				Action: func(c *cli.Context) error {
+					cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+					if err != nil {
+						return err
+					}
+					verifications, err := action.VerifyImages(cfg)
+					switch strings.ToLower(c.String("output")) {
+					case "json":
+						d, _ := json.Marshal(verifications)
+						fmt.Println(string(d))
+					case "yaml":
+						d, _ := yaml.Marshal(verifications)
+						fmt.Print(string(d))
+					default:
+						for _, v := range verifications {
+							switch {
+							case v.Skipped != "":
+								fmt.Printf("%-9s skipped (%s)\n", v.Image, v.Skipped)
+							case v.Error != "":
+								fmt.Printf("%-9s %s: %s\n", v.Image, v.File, v.Error)
+							default:
+								fmt.Printf("%-9s %s: ok\n", v.Image, v.File)
+							}
+						}
+					}
+					return err
+				},
+			},
+		},
+	},
+	{
+		Name:      "selftest",
+		Usage:     "Checks the image meets what the agent expects from it",
+		UsageText: "selftest [--source oci:my/derivative:tag] [--check install-to-loopfile]",
+		Description: fmt.Sprintf(`
+Runs the agent self test, meant for derivative builders to validate their images on a booted node or a VM:
+
+  install-to-loopfile  deploys the source into a loop file as the installer does, it has to be bootable and have
+                       a /etc/kairos-release
+  upgrade-to-self      deploys a transition image from the installed one, as an upgrade to the same image does
+  reset-dry-run        checks the state partition and the recovery image reset needs are there
+  bootentry            selects a boot entry on a copy of the grub configs and environment
+  sysext               enables, lists and disables a sysext fixture on a sandboxed EFI dir
+
+Nothing outside a temporary dir is modified. The source defaults to the live media tree or the running system.
+The command fails if any check fails, skipped checks can't run on this system. The checks are: %s`, strings.Join(action.SelftestChecks(), ", ")),
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "source", Usage: "Image to test, i.e. oci:quay.io/my/derivative:tag or dir:/path"},
+			&cli.StringSliceFlag{Name: "check", Usage: "Run only this check. Can be repeated"},
+			&cli.StringFlag{
+				Name:  "output",
+				Usage: "Output format (json|yaml|terminal)",
+			},
+		},
+		Before: func(c *cli.Context) error {
+			return checkRoot()
+		},
+		Action: func(c *cli.Context) error {
+			cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+			if err != nil {
+				return err
+			}
+			report, err := action.Selftest(cfg, c.String("source"), c.StringSlice("check"))
+			if err != nil {
+				return err
+			}
+			switch strings.ToLower(c.String("output")) {
+			case "json":
+				d, _ := json.Marshal(report)
+				fmt.Println(string(d))
+			case "yaml":
+				d, _ := yaml.Marshal(report)
+				fmt.Print(string(d))
+			default:
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(w, "CHECK\tSTATUS\tDURATION\tMESSAGE")
+				for _, r := range report.Results {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Name, r.Status, r.Duration, r.Message)
+				}
+				_ = w.Flush()
+				fmt.Printf("%d passed, %d failed, %d skipped\n", report.Passed, report.Failed, report.Skipped)
+			}
+			if report.Failed > 0 {
+				return fmt.Errorf("%d self test checks failed", report.Failed)
+			}
+			return nil
+		},
+	},
+	{
+		Name:        "bootloader",
+		Usage:       "Manage the bootloader binaries in the EFI partition",
+		Description: "bootloader subcommands",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "upgrade",
+				Usage: "bootloader upgrade --source oci:repo/image:tag",
+				Description: `
+Replaces the bootloader binaries (systemd-boot, shim, grub) in the EFI partition with the ones found under EFI/BOOT and EFI/systemd in the given source.
+All binaries must be signed with a key in the machine db before anything is replaced. Replaced binaries are kept as backup for "bootloader rollback",
+which also removes the binaries the upgrade added. Only the binaries touched by the last upgrade are rolled back.
+
+The upgrade is assessed on the next boots: it is marked good once it boots the active entry, and rolled back automatically if the active entry
+fails its boot assessment and the system falls back. A new upgrade is refused until the last one is assessed. If the bootloader itself does not
+start, run the rollback from live media.`,
+				Flags: []cli.Flag{
+					&sourceFlag,
+				},
+				Before: func(c *cli.Context) error {
+					if c.String("source") == "" {
+						return fmt.Errorf("--source is required")
+					}
+					if err := validateSource(c.String("source")); err != nil {
+						return err
+					}
+					return checkRoot()
+				},
+				Action: func(c *cli.Context) error {
+					cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+					if err != nil {
+						return err
+					}
+					return uki.UpgradeBootloaderFromSource(cfg, c.String("source"))
+				},
+			},
+			{
+				Name:        "rollback",
+				Usage:       "Restores the bootloader binaries replaced by the last bootloader upgrade",
+				Description: "Restores the bootloader binaries replaced by the last bootloader upgrade and removes the ones it added, leaving the rest untouched",
+				Before: func(c *cli.Context) error {
+					return checkRoot()
+				},
+				Action: func(c *cli.Context) error {
+					cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+					if err != nil {
+						return err
+					}
+					return uki.RollbackBootloaderFromESP(cfg)
+				},
+			},
+		},
+	},
+	{
+		Name:  "pin",
+		Usage: "Pins the currently booted image as known good",
+		Description: `
+Marks the currently booted image as known good. While pinned, upgrades are skipped unless forced with --force.
+On trusted boot systems the booted entry is also set as default and removed from boot assessment, so it never falls back to other entries.
+
+Use "kairos-agent unpin" to revert it.`,
+		Before: func(c *cli.Context) error {
+			return checkRoot()
+		},
+		Action: func(c *cli.Context) error {
+			cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+			if err != nil {
+				return err
+			}
+			return action.Pin(cfg)
+		},
+	},
+	{
+		Name:        "unpin",
+		Usage:       "Removes the pin set by the pin command",
+		Description: "Removes the pin set by the pin command so upgrades are applied again. On trusted boot systems the boot assessment of the pinned entry is restored.",
+		Before: func(c *cli.Context) error {
+			return checkRoot()
+		},
+		Action: func(c *cli.Context) error {
+			cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+			if err != nil {
+				return err
+			}
+			return action.Unpin(cfg)
+		},
+	},
+	{
+		Name:  "registry-pins",
+		Usage: "Manages the registry certificates pinned on first use",
+		Description: fmt.Sprintf(`
+The registries listed in the registry_pinning config get their TLS certificate pinned the first time
+they are reached, instead of being verified against the system CAs, and later connections fail if
+they present a different certificate. The pins are stored in %s.
+
+For example, to pin the certificate of a self-hosted registry with a self-signed certificate:
+
+registry_pinning:
+  registries:
+  - registry.lan:5000`, constants.RegistryPinsFile),
+		Subcommands: []*cli.Command{
+			{
+				Name:  "list",
+				Usage: "Lists the pinned registry certificates",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "Output format (json|yaml|table)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+					if err != nil {
+						return err
+					}
+					pins, err := agentConfig.ReadRegistryPins(cfg.Fs)
+					if err != nil {
+						return err
+					}
+					switch strings.ToLower(c.String("output")) {
+					case "json":
+						if pins == nil {
+							pins = []agentConfig.RegistryPin{}
+						}
+						d, err := json.Marshal(pins)
+						if err != nil {
+							return err
+						}
+						fmt.Println(string(d))
+					case "yaml":
+						d, err := yaml.Marshal(pins)
+						if err != nil {
+							return err
+						}
+						fmt.Print(string(d))
+					default:
+						if len(pins) == 0 {
+							fmt.Println("No registry certificates pinned")
+							return nil
+						}
+						w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+						fmt.Fprintln(w, "REGISTRY\tFINGERPRINT\tSUBJECT\tPINNED")
+						for _, p := range pins {
+							fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.Registry, p.Fingerprint, p.Subject, p.Date)
+						}
+						return w.Flush()
+					}
+					return nil
+				},
+			},
+			{
+				Name:        "remove",
+				Usage:       "Removes the pinned certificate of a registry",
+				ArgsUsage:   "REGISTRY",
+				Description: "Removes the pinned certificate of a registry, i.e. after renewing it. The next certificate the registry presents gets pinned.",
+				Before: func(c *cli.Context) error {
+					if c.Args().Len() != 1 {
+						return fmt.Errorf("the registry to remove the pin of is required")
+					}
+					return checkRoot()
+				},
+				Action: func(c *cli.Context) error {
+					cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+					if err != nil {
+						return err
+					}
+					if err = agentConfig.RemoveRegistryPin(cfg.Fs, c.Args().First()); err != nil {
+						return err
+					}
+					fmt.Printf("Removed the pinned certificate of registry %s\n", c.Args().First())
+					return nil
+				},
+			},
+		},
+	},
+	{
+		Name:  "schedule",
+		Usage: "Manages the recurring tasks of the agent",
+		Description: fmt.Sprintf(`
+Runs agent tasks on a schedule with systemd timers, like checking for upgrades, upgrading or collecting
+the logs. The timer and service units (kairos-schedule-<name>) are written by the agent and recreated on
+every boot from the OEM partition, the schedule is stored in %s.
+
+The built-in tasks are upgrade, upgrade-check, image-verify (kairos-agent image verify) and logs
+(to %s). Other tasks take the kairos-agent arguments to run after the name, for example:
+
+kairos-agent schedule add --on-calendar "Sat 02:00" --randomized-delay 30m upgrade
+kairos-agent schedule add --on-calendar monthly upgrade-recovery -- upgrade --recovery`, constants.ScheduleFile, action.ScheduledLogsBundle),
+		Subcommands: []*cli.Command{
+			{
+				Name:      "add",
+				Usage:     "Schedules a task, replacing the one with the same name",
+				ArgsUsage: "NAME [ARGS...]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "on-calendar",
+						Usage:    "When the task runs, as a systemd calendar event like hourly, daily or \"Sat 02:00\"",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "randomized-delay",
+						Usage: "Delays each run up to the given time span, like 30m, to spread the runs of many machines",
+					},
+				},
+				Before: func(c *cli.Context) error {
+					if c.Args().Len() < 1 {
+						return fmt.Errorf("the name of the task is required")
+					}
+					return checkRoot()
+				},
+				Action: func(c *cli.Context) error {
+					cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+					if err != nil {
+						return err
+					}
+					return action.AddScheduledTask(cfg, action.ScheduledTask{
+						Name:            c.Args().First(),
+						Args:            c.Args().Tail(),
+						OnCalendar:      c.String("on-calendar"),
+						RandomizedDelay: c.String("randomized-delay"),
+					})
+				},
+			},
+			{
+				Name:  "list",
+				Usage: "Lists the scheduled tasks and their next run",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "Output format (json|yaml|table)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+					if err != nil {
+						return err
+					}
+					tasks, err := action.ListScheduledTasks(cfg)
+					if err != nil {
+						return err
+					}
+					switch strings.ToLower(c.String("output")) {
+					case "json":
+						if tasks == nil {
+							tasks = []action.ScheduledTask{}
+						}
+						d, err := json.Marshal(tasks)
+						if err != nil {
+							return err
+						}
+						fmt.Println(string(d))
+					case "yaml":
+						d, err := yaml.Marshal(tasks)
+						if err != nil {
+							return err
+						}
+						fmt.Print(string(d))
+					default:
+						if len(tasks) == 0 {
+							fmt.Println("No tasks scheduled")
+							return nil
+						}
+						w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+						fmt.Fprintln(w, "NAME\tON CALENDAR\tNEXT RUN\tCOMMAND")
+						for _, t := range tasks {
+							fmt.Fprintf(w, "%s\t%s\t%s\tkairos-agent %s\n", t.Name, t.OnCalendar, t.NextRun, strings.Join(t.Args, " "))
+						}
+						return w.Flush()
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "remove",
+				Usage:     "Removes a scheduled task",
+				ArgsUsage: "NAME",
+				Before: func(c *cli.Context) error {
+					if c.Args().Len() != 1 {
+						return fmt.Errorf("the name of the task to remove is required")
+					}
+					return checkRoot()
+				},
+				Action: func(c *cli.Context) error {
+					cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+					if err != nil {
+						return err
+					}
+					return action.RemoveScheduledTask(cfg, c.Args().First())
+				},
+			},
+		},
+	},
+	{
+		Name:  "sysext",
+		Usage: "Manages the system extensions of trusted boot systems",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "list",
+				Usage: "Lists the installed sysexts per boot entry",
+				Description: fmt.Sprintf(`
+Lists the sysexts installed for each boot entry (%s/EFI/kairos/<entry>.efi.extra.d), with the source
+they were installed from, their digest and install date, so the active overlays can be audited.
+Sysexts whose file no longer matches the digest recorded on install are reported as modified.`, constants.UkiEfiDir),
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "Output format (json|yaml|table)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+					if err != nil {
+						return err
+					}
+					sysexts, err := action.ListSysexts(cfg, constants.UkiEfiDir)
+					if err != nil {
+						return err
+					}
+					switch strings.ToLower(c.String("output")) {
+					case "json":
+						if sysexts == nil {
+							sysexts = []action.Sysext{}
+						}
+						d, err := json.Marshal(sysexts)
+						if err != nil {
+							return err
+						}
+						fmt.Println(string(d))
+					case "yaml":
+						d, err := yaml.Marshal(sysexts)
+						if err != nil {
+							return err
+						}
+						fmt.Print(string(d))
+					default:
+						if len(sysexts) == 0 {
+							fmt.Println("No sysexts installed")
+							return nil
+						}
+						w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+						fmt.Fprintln(w, "NAME\tBOOT ENTRY\tSOURCE\tDIGEST\tINSTALLED")
+						for _, s := range sysexts {
+							source, installed := "unknown", "unknown"
+							if s.Source != "" {
+								source = s.Source
+							}
+							if s.Installed != nil {
+								installed = s.Installed.Format(time.RFC3339)
+							}
+							digest := s.Digest
+							if s.Modified {
+								digest += " (modified)"
+							}
+							fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", s.Name, s.BootState, source, digest, installed)
+						}
+						return w.Flush()
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "enable",
+				Usage:     "Enables a sysext from the sysext store on a boot entry",
+				ArgsUsage: "<name>",
+				Description: fmt.Sprintf(`
+Enables the sysext <name>, stored as %s/<name>.sysext.raw, on a boot entry.
+
+Sysexts can declare the sysexts they require and the ones they conflict with in the
+%s/%s metadata file, e.g.:
+
+nvidia-driver.sysext.raw:
+  source: oci://quay.io/example/nvidia-driver:550
+  requires: [kernel-modules-6.8]
+  conflicts: [nouveau]
+
+Enabling a sysext that would leave the boot entry with a broken combination is refused.`, constants.SysextStoreDir, constants.SysextStoreDir, utils.SysextMetadataFile),
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "boot-entry", Value: "active", Usage: "Boot entry to enable the sysext on (active|passive|recovery|statereset)"},
+				},
+				Before: func(c *cli.Context) error {
+					return checkRoot()
+				},
+				Action: func(c *cli.Context) error {
+					if c.Args().Len() != 1 {
+						return fmt.Errorf("a sysext name is required")
+					}
+					cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+					if err != nil {
+						return err
+					}
+					return action.EnableSysext(cfg, constants.UkiEfiDir, c.Args().First(), c.String("boot-entry"))
+				},
+			},
+			{
+				Name:        "disable",
+				Usage:       "Disables a sysext on a boot entry",
+				ArgsUsage:   "<name>",
+				Description: "Removes the sysext <name> from a boot entry. Disabling a sysext required by another one enabled on the boot entry is refused.",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "boot-entry", Value: "active", Usage: "Boot entry to disable the sysext on (active|passive|recovery|statereset)"},
+				},
+				Before: func(c *cli.Context) error {
+					return checkRoot()
+				},
+				Action: func(c *cli.Context) error {
+					if c.Args().Len() != 1 {
+						return fmt.Errorf("a sysext name is required")
+					}
+					cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+					if err != nil {
+						return err
+					}
+					return action.DisableSysext(cfg, constants.UkiEfiDir, c.Args().First(), c.String("boot-entry"))
+				},
+			},
+		},
+	},
+	{
+		Name:  "oem",
+		Usage: "Backs up and restores the OEM partition contents",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "backup",
+				Usage:     "Snapshots the OEM partition contents into a file",
+				ArgsUsage: "[file]",
+				Description: fmt.Sprintf(`
+Archives the contents of the OEM partition (%s) with some metadata into a gzipped tarball,
+%s by default. With --key-file the backup is encrypted with AES-256-GCM.
+
+The backup can be restored with "kairos-agent oem restore" or while resetting with
+"kairos-agent reset --restore-oem-backup <file>", to keep the node identity and configuration
+across re-provisioning. Keep it out of the partitions formatted by reset, or in a partition that
+is formatted afterwards, like the persistent one.`, constants.OEMPath, constants.OEMBackupFile),
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "key-file", Usage: "Encrypt the backup with the given key file"},
+				},
+				Before: func(c *cli.Context) error {
+					return checkRoot()
+				},
+				Action: func(c *cli.Context) error {
+					cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+					if err != nil {
+						return err
+					}
+					return action.OEMBackup(cfg, c.Args().First(), c.String("key-file"))
+				},
+			},
+			{
+				Name:      "restore",
+				Usage:     "Replaces the OEM partition contents with a backup",
+				ArgsUsage: "[file]",
+				Description: fmt.Sprintf(`
+Restores a backup created with "kairos-agent oem backup", %s by default, on the OEM partition (%s).
+The current contents of the OEM partition are removed.`, constants.OEMBackupFile, constants.OEMPath),
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "key-file", Usage: "Key file the backup was encrypted with"},
+				},
+				Before: func(c *cli.Context) error {
+					return checkRoot()
+				},
+				Action: func(c *cli.Context) error {
+					cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+					if err != nil {
+						return err
+					}
+					return action.OEMRestore(cfg, c.Args().First(), c.String("key-file"))
+				},
+			},
+		},
+	},
+	{
+		Name:      "logs",
+		Usage:     "Collects the Kairos logs into a support bundle",
+		ArgsUsage: "[file]",
+		Description: `
+Collects the journal of the Kairos units and the Kairos log files into a gzipped tarball, a file in the
+temporary directory by default.
+
+The journal can be narrowed down with logs.journal_args in the config or --journal-args, e.g. "--since 24h"
+or "-n 5000", and each collected log is capped to logs.max_file_size bytes (10MiB by default), keeping its
+head and its tail, so bundles from long running nodes stay small enough to upload.`,
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{Name: "journal-args", Usage: "Extra arguments passed to journalctl, e.g. --journal-args='--since 24h'"},
+			&cli.Int64Flag{Name: "max-file-size", Usage: "Size cap in bytes for each collected log, negative to disable it"},
+		},
+		Before: func(c *cli.Context) error {
+			return checkRoot()
+		},
+		Action: func(c *cli.Context) error {
+			cfg, err := agentConfig.Scan(collector.Directories(constants.GetUserConfigDirs()...), collector.NoLogs)
+			if err != nil {
+				return err
+			}
+			if cfg.Logs == nil {
+				cfg.Logs = &agentConfig.Logs{}
+			}
+			cfg.Logs.JournalArgs = append(cfg.Logs.JournalArgs, c.StringSlice("journal-args")...)
+			if c.IsSet("max-file-size") {
+				cfg.Logs.MaxFileSize = c.Int64("max-file-size")
+			}
+			dest := c.Args().First()
+			if dest == "" {
+				dest = action.DefaultLogsBundle()
+			}
+			if err = action.CollectLogs(cfg, dest); err != nil {
+				return err
+			}
+			fmt.Println(dest)
+			return nil
+		},
+	},
+	{
+		Name:  "events",
+		Usage: "Inspect the events published on the agent bus",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "tail",
+				Usage: "Prints the bus events and the plugin responses in real time",
+				Description: `
+Prints every event published on the agent bus by any kairos-agent process, together with the
+responses of the provider plugins, until interrupted.
+
+Run it in a separate terminal while running other agent commands:
+
+$ kairos-agent events tail --output json`,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "Output format (json|terminal)",
+					},
+				},
+				Before: func(c *cli.Context) error {
+					return checkRoot()
+				},
+				Action: func(c *cli.Context) error {
+					stop := make(chan struct{})
+					sig := make(chan os.Signal, 1)
+					signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+					go func() {
+						<-sig
+						close(stop)
+					}()
+					return bus.Tail(os.Stdout, strings.ToLower(c.String("output")) == "json", stop)
+				},
+			},
+			{
+				Name:  "simulate",
+				Usage: "Replays an event sequence against local provider plugins",
+				Description: `
+Loads the provider plugins (agent-provider-*) found in the given dir, and only those, and publishes
+a recorded event sequence to them, printing every event and plugin response. Only the plugins are run,
+no disk is touched, so it can be used to test a provider against the agent contract during development.
+
+Built-in sequences: install, boot and upgrade. Events recorded with "kairos-agent events tail --output json"
+can be replayed with --from-file.
+
+$ kairos-agent events simulate --providers-dir ./bin --sequence install --cloud-config config.yaml`,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "providers-dir",
+						Usage:    "Dir with the provider plugins to load",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "sequence",
+						Usage: fmt.Sprintf("Built-in event sequence to replay (%s)", strings.Join(bus.Sequences(), "|")),
+					},
+					&cli.StringFlag{
+						Name:  "from-file",
+						Usage: "Replay the events recorded with 'events tail --output json' in the given file",
+					},
+					&cli.StringFlag{
+						Name:  "cloud-config",
+						Usage: "Cloud config file sent as payload in the built-in sequences",
+					},
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "Output format (json|terminal)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					var records []bus.Record
+					var err error
+					switch {
+					case c.String("sequence") != "" && c.String("from-file") != "":
+						return fmt.Errorf("only one of '--sequence' and '--from-file' can be set")
+					case c.String("from-file") != "":
+						f, err := os.Open(c.String("from-file"))
+						if err != nil {
+							return err
+						}
+						defer f.Close()
+						records, err = bus.LoadRecords(f)
+						if err != nil {
+							return err
+						}
+					case c.String("sequence") != "":
+						config := agentConfig.DefaultHeader + "\n"
+						if c.String("cloud-config") != "" {
+							data, err := os.ReadFile(c.String("cloud-config"))
+							if err != nil {
+								return err
+							}
+							config = string(data)
+						}
+						records, err = bus.Sequence(c.String("sequence"), config)
+						if err != nil {
+							return err
+						}
+					default:
+						return fmt.Errorf("one of '--sequence' or '--from-file' is required")
+					}
+
+					responses, err := bus.Simulate(c.String("providers-dir"), records, os.Stdout, strings.ToLower(c.String("output")) == "json")
+					if err != nil {
+						return err
+					}
+					failed := 0
+					for _, r := range responses {
+						if r.Error != "" {
+							failed++
+						}
+					}
+					if failed > 0 {
+						return fmt.Errorf("%d of %d plugin responses had errors", failed, len(responses))
+					}
+					return nil
+				},
+			},
+		},
+	},
+}
+
+func main() {
+	bus.Manager.Initialize()
+
+	app := &cli.App{
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "strict-validation",
+				Usage:   "Fail instead of warn on validation errors.",
+				EnvVars: []string{"STRICT_VALIDATIONS"},
+			},
+			&cli.BoolFlag{
+				Name:    "debug",
+				Usage:   "enable debug output",
+				EnvVars: []string{"KAIROS_AGENT_DEBUG"},
+			},
+			&cli.StringSliceFlag{
+				Name:  "config",
+				Usage: "Config file to merge on top of the system configuration for this invocation only. Can be passed multiple times, later files have higher priority.",
+			},
+			&cli.StringFlag{
+				Name:    "root",
+				Usage:   "Operate on the system mounted at this directory instead of the running one, i.e. from a rescue environment. Applies to the config scan and the files the commands manage, like the boot entries, grub environment and sysexts. The EFI partition, if any, has to be mounted under it.",
+				EnvVars: []string{"KAIROS_AGENT_ROOT"},
+			},
+			&cli.BoolFlag{
+				Name:    "no-efivars",
+				Usage:   "Do not read or write EFI variables, for firmwares that lock them. The boot entries are only set in the EFI partition and the signatures are not checked against the firmware db.",
+				EnvVars: []string{"KAIROS_AGENT_NO_EFIVARS"},
+			},
+			&cli.BoolFlag{
+				Name:    "json-progress",
+				Usage:   "Stream the progress of install, upgrade and reset as newline delimited JSON records (action, phase, percent, message, error) on stdout, for management agents. The console logs are disabled, they are still written to the log files.",
+				EnvVars: []string{"KAIROS_AGENT_JSON_PROGRESS"},
+			},
+		},
+		Name:    "kairos-agent",
+		Version: common.VERSION,
+		Authors: []*cli.Author{
+			{
+				Name: "Ettore Di Giacinto",
+			},
+		},
+		Usage: "kairos agent start",
+		Description: `
+The kairos agent is a component to abstract away node ops, providing a common feature-set across kairos variants.
+`,
+		UsageText: ``,
+		Copyright: "kairos authors",
+		Before: func(c *cli.Context) error {
+			// The language set in the config, if any, overrides this one once the config is read
+			i18n.SetLanguageFromEnv()
+
+			var debug bool
+			// Get debug from env or cmdline
+			cmdline, _ := os.ReadFile("/proc/cmdline")
+			if strings.Contains(string(cmdline), "rd.kairos.debug") {
+				debug = true
 			}
 
 			if os.Getenv("KAIROS_AGENT_DEBUG") == "true" {
@@ -845,6 +2903,31 @@ The kairos agent is a component to abstract away node ops, providing a common fe
 
 			// Set debug from here already, so it's loaded by the Config unmarshall
 			viper.Set("debug", debug)
+
+			// Config overrides are merged on top of the scanned config, fail early if they are not there
+			for _, f := range c.StringSlice("config") {
+				if _, err := os.Stat(f); err != nil {
+					return fmt.Errorf("config override %s: %w", f, err)
+				}
+			}
+			viper.Set(agentConfig.ConfigOverridesKey, c.StringSlice("config"))
+			viper.Set(agentConfig.JSONProgressKey, c.Bool("json-progress"))
+			viper.Set(agentConfig.NoEfivarsKey, c.Bool("no-efivars"))
+
+			if root := c.String("root"); root != "" {
+				if info, err := os.Stat(root); err != nil || !info.IsDir() {
+					return fmt.Errorf("root %s is not a directory", root)
+				}
+				root, err := filepath.Abs(root)
+				if err != nil {
+					return err
+				}
+				constants.SetRoot(root)
+			}
+			// Temp dirs of agents which did not exit cleanly, i.e. after a crash, are only around until the next run
+			if os.Geteuid() == 0 {
+				utils.CleanStaleTempDirs(agentConfig.NewConfig())
+			}
 			if debug {
 				// Dont hide private fields, we want the full object biew
 				litter.Config.HidePrivateFields = false
@@ -857,6 +2940,7 @@ The kairos agent is a component to abstract away node ops, providing a common fe
 	}
 
 	err := app.Run(os.Args)
+	_ = fsutils.CleanupTempDirs(vfs.OSFS)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -876,17 +2960,26 @@ func validateSource(source string) error {
 		return nil
 	}
 
-	r, err := regexp.Compile(`^oci:|^dir:|^file:`)
+	r, err := regexp.Compile(`^oci:|^dir:|^file:|^containerd:|^podman:|^s3:|^https?:`)
 	if err != nil {
 		return err
 	}
 	if !r.MatchString(source) {
-		return fmt.Errorf("source %s does not match any of oci:, dir: or file: ", source)
+		return fmt.Errorf("source %s does not match any of oci:, dir:, file:, containerd:, podman:, s3:, http: or https: ", source)
 	}
 
 	return nil
 }
 
+// machineState returns the runtime state along with the usage of the Kairos partitions
+func machineState() (action.State, error) {
+	runtime, err := state.NewRuntime()
+	if err != nil {
+		return action.State{}, err
+	}
+	return action.NewState(agentConfig.NewConfig(), runtime), nil
+}
+
 // Check
 func bootFromLiveMedia() bool {
 	// Check if the system is booted from a LIVE media by checking if the file /run/cos/livecd is present
@@ -901,22 +2994,86 @@ func bootFromLiveMedia() bool {
 	return false
 }
 
-func getReleasesFromProvider(includePrereleases bool) ([]string, error) {
-	var tags []string
-	bus.Manager.Response(events.EventAvailableReleases, func(p *pluggable.Plugin, r *pluggable.EventResponse) {
-		if r.Data == "" {
-			return
+// printUpgradePlan prints the upgrade plan in the given output format
+func printUpgradePlan(plan *action.UpgradePlan, output string) error {
+	switch strings.ToLower(output) {
+	case "json":
+		d, err := json.Marshal(plan)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(d))
+	case "yaml":
+		d, err := yaml.Marshal(plan)
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(d))
+	default:
+		fmt.Printf("Upgrade %s from %s\n", plan.Entry, plan.Source)
+		for _, f := range plan.Fallbacks {
+			fmt.Printf("  falling back to %s\n", f)
+		}
+		if plan.Scheduled {
+			fmt.Println("The recovery rebuild is scheduled to run in the background after the next reboot, nothing is deployed now")
+			return nil
+		}
+		if plan.EfiSpace != nil {
+			printEfiSpace(plan.EfiSpace)
+			return nil
+		}
+		if plan.Delta {
+			fmt.Println("Pulling only the layers the active image lacks, if the source is built over it")
 		}
-		if err := json.Unmarshal([]byte(r.Data), &tags); err != nil {
-			fmt.Printf("warn: failed unmarshalling data: '%s'\n", err.Error())
+		fmt.Printf("Deploying to %s, needing %dMB\n", plan.Transition, plan.RequiredSpace)
+		fmt.Println("Images:")
+		for _, i := range plan.Images {
+			size := "unchanged size"
+			if i.Size > 0 {
+				size = fmt.Sprintf("%dMB", i.Size)
+			}
+			fmt.Printf("  [%s] %s %s (%s, %s) from %s\n", i.Action, i.Name, i.File, i.FS, size, i.From)
+		}
+		fmt.Println("Partitions:")
+		for _, p := range plan.Partitions {
+			fmt.Printf("  %s %s on %s: %s\n", p.Label, p.Device, p.MountPoint, p.Purpose)
 		}
-	})
+		if plan.DeferRecovery {
+			fmt.Println("Recovery is rebuilt from the same source in the background after the next reboot")
+		}
+	}
+	return nil
+}
 
-	configYAML := fmt.Sprintf("IncludePreReleases: %t", includePrereleases)
-	_, err := bus.Manager.Publish(events.EventAvailableReleases, events.EventPayload{Config: configYAML})
-	if err != nil {
-		return tags, fmt.Errorf("failed publishing event: %w", err)
+// printEfiSpace prints the accounting of the EFI partition space of a trusted boot upgrade plan
+func printEfiSpace(space *action.EfiSpace) {
+	mb := func(b uint64) uint64 { return (b + 1024*1024 - 1) / (1024 * 1024) }
+	fmt.Printf("EFI partition %s: %dMB free of %dMB\n", space.MountPoint, mb(space.FreeBytes), mb(space.SizeBytes))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ENTRY\tROLE\tUKI\tEXTENSIONS\tPRUNABLE")
+	for _, e := range space.Entries {
+		role := e.Role
+		if role == "" {
+			role = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%dMB\t%dMB (%d files)\t%t\n", e.Name, role, mb(e.UKIBytes()), mb(e.ExtensionBytes()), len(e.Extensions), e.Prunable)
 	}
+	fmt.Fprintf(w, "other files\t-\t%dMB\t-\t-\n", mb(space.OtherBytes))
+	_ = w.Flush()
+	fmt.Println("Writing:")
+	for _, f := range space.Planned {
+		fmt.Printf("  %s (%dMB)\n", f.Path, mb(f.SizeBytes))
+	}
+	fmt.Printf("Needing up to %dMB free while the entries are rotated\n", mb(space.NeededBytes))
+	if err := space.Check(); err != nil {
+		fmt.Printf("The upgrade would fail: %s\n", err)
+	}
+}
 
-	return tags, nil
+// orUnknown returns the value, or unknown if it is empty
+func orUnknown(v string) string {
+	if v == "" {
+		return "unknown"
+	}
+	return v
 }
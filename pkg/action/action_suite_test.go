@@ -16,8 +16,12 @@ limitations under the License.
 package action_test
 
 import (
+	"path/filepath"
 	"testing"
 
+	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 )
@@ -26,3 +30,16 @@ func TestActionSuite(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Actions test suite")
 }
+
+// createBootableTree creates the files a system tree needs to pass the bootable check under root
+func createBootableTree(fs v1.FS, root string) error {
+	for _, f := range []string{"boot/vmlinuz", "boot/initrd", "usr/lib/systemd/systemd"} {
+		if err := fsutils.MkdirAll(fs, filepath.Join(root, filepath.Dir(f)), constants.DirPerm); err != nil {
+			return err
+		}
+		if err := fs.WriteFile(filepath.Join(root, f), []byte{}, constants.FilePerm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package action
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils/partitions"
+)
+
+// DefaultBootTries is the number of boot tries a reset assessment gets, the same AddBootAssessment sets
+const DefaultBootTries = 3
+
+// assessedEntryRe matches systemd-boot entry files with the boot counting suffix, name+LEFT[-DONE].conf
+var assessedEntryRe = regexp.MustCompile(`^(.+?)(\+(\d+)(-(\d+))?)?\.conf$`)
+
+// BootAssessment is the boot counting state of a systemd-boot entry. systemd-boot decrements the tries left
+// and increments the tries done on every boot of the entry, until systemd-bless-boot marks it good by removing
+// the counter. Entries with no tries left are considered bad and booted last, falling back to the next one.
+type BootAssessment struct {
+	Entry    string `json:"entry" yaml:"entry"`
+	File     string `json:"file" yaml:"file"`
+	Counting bool   `json:"counting" yaml:"counting"`
+	Left     int    `json:"left" yaml:"left"`
+	Done     int    `json:"done" yaml:"done"`
+}
+
+// Bad reports if the entry has exhausted its boot tries
+func (a BootAssessment) Bad() bool {
+	return a.Counting && a.Left == 0
+}
+
+func (a BootAssessment) String() string {
+	switch {
+	case !a.Counting:
+		return fmt.Sprintf("%s: good, not counting boots", a.Entry)
+	case a.Bad():
+		return fmt.Sprintf("%s: bad, %d failed boots, it falls back to the next entry", a.Entry, a.Done)
+	default:
+		return fmt.Sprintf("%s: %d tries left, %d done", a.Entry, a.Left, a.Done)
+	}
+}
+
+// fileName returns the entry file name for the current counters
+func (a BootAssessment) fileName() string {
+	if !a.Counting {
+		return a.Entry + ".conf"
+	}
+	if a.Done == 0 {
+		return fmt.Sprintf("%s+%d.conf", a.Entry, a.Left)
+	}
+	return fmt.Sprintf("%s+%d-%d.conf", a.Entry, a.Left, a.Done)
+}
+
+// ReadBootAssessments returns the boot counting state of all the systemd-boot entries
+func ReadBootAssessments(cfg *config.Config) ([]BootAssessment, error) {
+	if !utils.IsUkiWithFs(cfg.Fs) {
+		return nil, fmt.Errorf("boot assessment is only available on trusted boot systems")
+	}
+	efiPartition, err := partitions.GetEfiPartition(&cfg.Logger)
+	if err != nil {
+		return nil, err
+	}
+	files, err := fsutils.GlobFs(cfg.Fs, filepath.Join(efiPartition.MountPoint, "loader/entries", "*.conf"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	var assessments []BootAssessment
+	for _, f := range files {
+		m := assessedEntryRe.FindStringSubmatch(filepath.Base(f))
+		if m == nil {
+			continue
+		}
+		a := BootAssessment{Entry: m[1], File: f, Counting: m[2] != ""}
+		a.Left, _ = strconv.Atoi(m[3])
+		a.Done, _ = strconv.Atoi(m[5])
+		assessments = append(assessments, a)
+	}
+	return assessments, nil
+}
+
+// readBootAssessment returns the boot counting state of the given entry. The cos and fallback names shown in the
+// boot menu are accepted for the active and passive entries.
+func readBootAssessment(cfg *config.Config, entry string) (*BootAssessment, error) {
+	switch {
+	case strings.HasPrefix(entry, "cos"):
+		entry = strings.Replace(entry, "cos", "active", 1)
+	case strings.HasPrefix(entry, "fallback"):
+		entry = strings.Replace(entry, "fallback", "passive", 1)
+	}
+	assessments, err := ReadBootAssessments(cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range assessments {
+		if a.Entry == entry {
+			return &a, nil
+		}
+	}
+	return nil, fmt.Errorf("boot entry %s not found", entry)
+}
+
+// SimulateBootFailure counts a failed boot of the entry as systemd-boot does when booting it without being
+// marked good afterwards, so the fallback to other entries can be tested without breaking the system.
+// With exhaust all the remaining tries are counted as failed, so the next boot already falls back.
+// This is the entrypoint for the bootentry assess --simulate-failure command
+func SimulateBootFailure(cfg *config.Config, entry string, exhaust bool) (*BootAssessment, error) {
+	a, err := readBootAssessment(cfg, entry)
+	if err != nil {
+		return nil, err
+	}
+	if !a.Counting {
+		return nil, fmt.Errorf("boot entry %s is marked good and does not count boots, reset its assessment first", a.Entry)
+	}
+	failed := 1
+	if exhaust {
+		failed = a.Left
+	}
+	if failed > a.Left {
+		failed = a.Left
+	}
+	a.Left -= failed
+	a.Done += failed
+	if err = renameAssessedEntry(cfg, a); err != nil {
+		return nil, err
+	}
+	cfg.Logger.Infof("Simulated %d failed boots of %s", failed, a.Entry)
+	return a, nil
+}
+
+// ResetBootAssessment restarts the boot counting of the entry with the given tries, also for entries already
+// marked good. This is the entrypoint for the bootentry assess --reset command
+func ResetBootAssessment(cfg *config.Config, entry string, tries int) (*BootAssessment, error) {
+	if tries < 1 {
+		return nil, fmt.Errorf("boot tries must be at least 1")
+	}
+	a, err := readBootAssessment(cfg, entry)
+	if err != nil {
+		return nil, err
+	}
+	a.Counting = true
+	a.Left = tries
+	a.Done = 0
+	if err = renameAssessedEntry(cfg, a); err != nil {
+		return nil, err
+	}
+	cfg.Logger.Infof("Reset the boot assessment of %s to %d tries", a.Entry, tries)
+	return a, nil
+}
+
+// renameAssessedEntry renames the entry file to match its counters, keeping the loader default pointing to it
+func renameAssessedEntry(cfg *config.Config, a *BootAssessment) error {
+	newFile := filepath.Join(filepath.Dir(a.File), a.fileName())
+	if newFile == a.File {
+		return nil
+	}
+	efiMount := filepath.Dir(filepath.Dir(filepath.Dir(a.File)))
+	err := cfg.Syscall.Mount("", efiMount, "", syscall.MS_REMOUNT, "")
+	if err != nil {
+		cfg.Logger.Errorf("could not remount EFI partition: %s", err)
+		return err
+	}
+	defer func() {
+		if err := cfg.Syscall.Mount("", efiMount, "", syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			cfg.Logger.Errorf("could not remount EFI partition as RO: %s", err)
+		}
+	}()
+
+	cfg.Logger.Debugf("Renaming %s to %s", a.File, newFile)
+	if err = cfg.Fs.Rename(a.File, newFile); err != nil {
+		return err
+	}
+	loaderConf := filepath.Join(efiMount, "loader/loader.conf")
+	systemdConf, err := utils.SystemdBootConfReader(cfg.Fs, loaderConf)
+	if err == nil && systemdConf["default"] == filepath.Base(a.File) {
+		systemdConf["default"] = filepath.Base(newFile)
+		if err = utils.SystemdBootConfWriter(cfg.Fs, loaderConf, systemdConf); err != nil {
+			return err
+		}
+	}
+	a.File = newFile
+	return nil
+}
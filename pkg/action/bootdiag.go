@@ -0,0 +1,130 @@
+package action
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	"github.com/kairos-io/kairos-sdk/state"
+)
+
+// Boot degradation kinds
+const (
+	DegradationPersistentNotMounted = "persistent-not-mounted"
+	DegradationOverlayFallback      = "overlay-fallback"
+	DegradationOEMNotMounted        = "oem-not-mounted"
+	DegradationEmergency            = "emergency-shell"
+	DegradationFilesystemErrors     = "filesystem-errors"
+	DegradationImageErrors          = "image-errors"
+)
+
+// BootDegradation is a known problem of the current boot which does not prevent the system from running
+type BootDegradation struct {
+	Kind    string `yaml:"kind" json:"kind"`
+	Message string `yaml:"message" json:"message"`
+	// Source is where it was found: mounts, the immucore log file or kernel
+	Source string `yaml:"source" json:"source"`
+}
+
+// bootDegradationPattern maps a log line to the degradation it reveals
+type bootDegradationPattern struct {
+	kind string
+	re   *regexp.Regexp
+}
+
+// immucorePatterns are the immucore and initramfs log lines of known degradations
+var immucorePatterns = []bootDegradationPattern{
+	{DegradationPersistentNotMounted, regexp.MustCompile(`(?i)(fail|error|could not|cannot).*(COS_PERSISTENT|persistent|/usr/local)`)},
+	{DegradationOverlayFallback, regexp.MustCompile(`(?i)overlay.*(fall(ing)? ?back|tmpfs)|(fall(ing)? ?back|tmpfs).*overlay`)},
+	{DegradationOEMNotMounted, regexp.MustCompile(`(?i)(fail|error|could not|cannot).*(COS_OEM|/oem\b)`)},
+	{DegradationEmergency, regexp.MustCompile(`(?i)emergency (shell|mode)`)},
+}
+
+// kernelPatterns are the kernel messages of known degradations
+var kernelPatterns = []bootDegradationPattern{
+	{DegradationFilesystemErrors, regexp.MustCompile(`EXT4-fs error|EXT4-fs warning.*(errors|mounting fs with errors)|XFS.*(corruption|metadata I/O error)|Buffer I/O error|blk_update_request: I/O error`)},
+	{DegradationImageErrors, regexp.MustCompile(`SQUASHFS error|loop\d+: .*(error|failed)`)},
+}
+
+// DetectBootDegradations looks for known degradations of the current boot: partitions found but not mounted, the
+// persistent overlay falling back to tmpfs and errors in the immucore logs and kernel messages.
+// Each kind is reported once, with the first message found.
+func DetectBootDegradations(cfg *config.Config, runtime state.Runtime) []BootDegradation {
+	return detectBootDegradations(cfg, runtime, readMounts(cfg))
+}
+
+func detectBootDegradations(cfg *config.Config, runtime state.Runtime, mounts []mountEntry) []BootDegradation {
+	degradations := []BootDegradation{}
+	mounted := func(mountPoint string) *mountEntry {
+		for i := range mounts {
+			if mounts[i].mountPoint == mountPoint {
+				return &mounts[i]
+			}
+		}
+		return nil
+	}
+	// Persistent and OEM are not expected to be mounted on live media nor recovery
+	if runtime.BootState == state.Active || runtime.BootState == state.Passive {
+		usrLocal := mounted("/usr/local")
+		switch {
+		case usrLocal != nil && usrLocal.fsType == "tmpfs":
+			degradations = append(degradations, BootDegradation{
+				Kind:    DegradationOverlayFallback,
+				Message: "/usr/local is a tmpfs, changes are lost on reboot",
+				Source:  "mounts",
+			})
+		case runtime.Persistent.Found && usrLocal == nil:
+			degradations = append(degradations, BootDegradation{
+				Kind:    DegradationPersistentNotMounted,
+				Message: fmt.Sprintf("persistent partition %s is not mounted on /usr/local", runtime.Persistent.Name),
+				Source:  "mounts",
+			})
+		}
+		if runtime.OEM.Found && mounted("/oem") == nil {
+			degradations = append(degradations, BootDegradation{
+				Kind:    DegradationOEMNotMounted,
+				Message: fmt.Sprintf("OEM partition %s is not mounted on /oem", runtime.OEM.Name),
+				Source:  "mounts",
+			})
+		}
+	}
+
+	logs, _ := fsutils.GlobFs(cfg.Fs, filepath.Join(cnst.ImmucoreLogDir, "*.log"))
+	sort.Strings(logs)
+	for _, log := range logs {
+		data, err := cfg.Fs.ReadFile(log)
+		if err != nil {
+			continue
+		}
+		degradations = appendDegradations(degradations, data, immucorePatterns, log)
+	}
+	if out, err := cfg.Runner.Run("dmesg"); err == nil {
+		degradations = appendDegradations(degradations, out, kernelPatterns, "kernel")
+	}
+	return degradations
+}
+
+// appendDegradations adds the degradations matched in the log lines not reported yet
+func appendDegradations(degradations []BootDegradation, data []byte, patterns []bootDegradationPattern, source string) []BootDegradation {
+	seen := map[string]bool{}
+	for _, d := range degradations {
+		seen[d.Kind] = true
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		for _, p := range patterns {
+			if !seen[p.kind] && p.re.MatchString(line) {
+				seen[p.kind] = true
+				degradations = append(degradations, BootDegradation{Kind: p.kind, Message: line, Source: source})
+			}
+		}
+	}
+	return degradations
+}
@@ -98,6 +98,13 @@ func selectBootEntrySystemd(cfg *config.Config, entry string) error {
 		return err
 	}
 
+	// A LoaderEntryDefault EFI variable (i.e. set by bootctl set-default) takes precedence over loader.conf
+	if !cfg.NoEfivars {
+		if exists, _ := fsutils.Exists(cfg.Fs, filepath.Join(cnst.EfivarsDir, cnst.LoaderEntryDefaultEfivar)); exists {
+			cfg.Logger.Warnf("The %s EFI variable is set and overrides the default entry, clear it with `bootctl set-default \"\"`", cnst.LoaderEntryDefaultEfivar)
+		}
+	}
+
 	// Mount it RW
 	err = cfg.Syscall.Mount("", efiPartition.MountPoint, "", syscall.MS_REMOUNT, "")
 	if err != nil {
@@ -3,9 +3,11 @@ package action
 import (
 	"bytes"
 	"os"
+	"path/filepath"
 	"syscall"
 
 	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
 	"github.com/kairos-io/kairos-agent/v2/pkg/utils"
 	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
 	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
@@ -98,6 +100,60 @@ var _ = Describe("Bootentries tests", Label("bootentry"), func() {
 			err = fs.WriteFile("/proc/cmdline", []byte("rd.immucore.uki"), os.ModePerm)
 			Expect(err).ToNot(HaveOccurred())
 		})
+		Context("BootAssessment", func() {
+			BeforeEach(func() {
+				Expect(fs.WriteFile("/efi/loader/loader.conf", []byte("default active+3.conf\n"), os.ModePerm)).To(Succeed())
+				Expect(fs.WriteFile("/efi/loader/entries/active+3.conf", []byte("title kairos\n"), os.ModePerm)).To(Succeed())
+				Expect(fs.WriteFile("/efi/loader/entries/passive.conf", []byte("title kairos (fallback)\n"), os.ModePerm)).To(Succeed())
+				Expect(fs.WriteFile("/efi/loader/entries/recovery+1-2.conf", []byte("title kairos recovery\n"), os.ModePerm)).To(Succeed())
+			})
+			It("reads the boot counters of all the entries", func() {
+				assessments, err := ReadBootAssessments(config)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(assessments).To(Equal([]BootAssessment{
+					{Entry: "active", File: "/efi/loader/entries/active+3.conf", Counting: true, Left: 3},
+					{Entry: "passive", File: "/efi/loader/entries/passive.conf"},
+					{Entry: "recovery", File: "/efi/loader/entries/recovery+1-2.conf", Counting: true, Left: 1, Done: 2},
+				}))
+				Expect(assessments[2].String()).To(Equal("recovery: 1 tries left, 2 done"))
+			})
+			It("simulates failed boots until the entry is bad", func() {
+				a, err := SimulateBootFailure(config, "cos", false)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(a.File).To(Equal("/efi/loader/entries/active+2-1.conf"))
+				conf, err := utils.SystemdBootConfReader(fs, "/efi/loader/loader.conf")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(conf["default"]).To(Equal("active+2-1.conf"))
+
+				a, err = SimulateBootFailure(config, "cos", true)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(a.Bad()).To(BeTrue())
+				Expect(a.String()).To(Equal("active: bad, 3 failed boots, it falls back to the next entry"))
+				_, err = fs.Stat("/efi/loader/entries/active+0-3.conf")
+				Expect(err).ToNot(HaveOccurred())
+
+				// No tries left to fail
+				a, err = SimulateBootFailure(config, "active", false)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(a.File).To(Equal("/efi/loader/entries/active+0-3.conf"))
+			})
+			It("does not simulate failures on entries marked good", func() {
+				_, err := SimulateBootFailure(config, "fallback", false)
+				Expect(err).To(MatchError(ContainSubstring("marked good")))
+				_, err = SimulateBootFailure(config, "statereset", false)
+				Expect(err).To(MatchError(ContainSubstring("not found")))
+			})
+			It("resets the boot counting", func() {
+				a, err := ResetBootAssessment(config, "recovery", DefaultBootTries)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(a.File).To(Equal("/efi/loader/entries/recovery+3.conf"))
+				a, err = ResetBootAssessment(config, "fallback", 2)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(a.File).To(Equal("/efi/loader/entries/passive+2.conf"))
+				_, err = ResetBootAssessment(config, "fallback", 0)
+				Expect(err).To(HaveOccurred())
+			})
+		})
 		Context("ListBootEntries", func() {
 			It("fails to list the boot entries when there is no loader.conf", func() {
 				err := ListBootEntries(config)
@@ -166,6 +222,33 @@ var _ = Describe("Bootentries tests", Label("bootentry"), func() {
 					"")).To(BeTrue())
 			})
 
+			It("does not write the EFI variables when selecting the boot entry", func() {
+				err := fs.WriteFile("/efi/loader/entries/active.conf", []byte("title kairos\nefi /EFI/kairos/active.efi\n"), os.ModePerm)
+				Expect(err).ToNot(HaveOccurred())
+				err = fs.WriteFile("/efi/loader/loader.conf", []byte("default active.conf"), os.ModePerm)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(fsutils.MkdirAll(fs, cnst.EfivarsDir, cnst.DirPerm)).To(Succeed())
+				efivar := filepath.Join(cnst.EfivarsDir, cnst.LoaderEntryDefaultEfivar)
+				err = fs.WriteFile(efivar, []byte("active.conf"), cnst.FilePerm)
+				Expect(err).ToNot(HaveOccurred())
+
+				err = SelectBootEntry(config, "active")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(memLog.String()).To(ContainSubstring("overrides the default entry"))
+				Expect(memLog.String()).To(ContainSubstring("Default boot entry set to active"))
+				exists, _ := fsutils.Exists(fs, efivar)
+				Expect(exists).To(BeTrue())
+				Expect(runner.IncludesCmds([][]string{{"chattr"}})).ToNot(Succeed())
+
+				// With the EFI variables disabled they are not read either
+				memLog.Reset()
+				config.NoEfivars = true
+				err = SelectBootEntry(config, "active")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(memLog.String()).ToNot(ContainSubstring("overrides the default entry"))
+				Expect(memLog.String()).To(ContainSubstring("Default boot entry set to active"))
+			})
+
 			It("selects the boot entry in a default installation", func() {
 				err := fs.WriteFile("/efi/loader/entries/active+2-1.conf", []byte("title kairos\nefi /EFI/kairos/active.efi\n"), os.ModePerm)
 				Expect(err).ToNot(HaveOccurred())
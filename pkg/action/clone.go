@@ -0,0 +1,75 @@
+package action
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	"github.com/kairos-io/kairos-agent/v2/pkg/elemental"
+	"github.com/kairos-io/kairos-sdk/ghw"
+)
+
+// CloneTo clones the disk holding the current installation (or the given source disk) into the target device
+// so it can be used as a spare boot disk.
+// This is the entrypoint for the clone-to command
+func CloneTo(cfg *config.Config, source, target string) error {
+	if source == "" {
+		var err error
+		if source, err = bootedDisk(cfg); err != nil {
+			return err
+		}
+	}
+
+	if err := checkNotMounted(cfg, target, source); err != nil {
+		return err
+	}
+
+	_, _ = cfg.Runner.Run("sync")
+	return elemental.NewElemental(cfg).CloneDisk(source, target)
+}
+
+// PromoteSpare restores the filesystem labels of a spare disk made by CloneTo, so the system boots from it
+func PromoteSpare(cfg *config.Config, device string) error {
+	if err := checkNotMounted(cfg, device, ""); err != nil {
+		return err
+	}
+	return elemental.NewElemental(cfg).PromoteSpareDisk(device)
+}
+
+// bootedDisk returns the disk the running system booted from, the one holding the partition mounted at the running
+// state dir. It's not looked up by label, as a spare disk could be holding the same ones.
+func bootedDisk(cfg *config.Config) (string, error) {
+	for _, m := range readMounts(cfg) {
+		if m.mountPoint != cnst.RunningStateDir {
+			continue
+		}
+		out, err := cfg.Runner.Run("lsblk", "-no", "PKNAME", m.device)
+		if err != nil || strings.TrimSpace(string(out)) == "" {
+			return "", fmt.Errorf("could not find the disk of the booted partition %s, please specify the source device", m.device)
+		}
+		return filepath.Join("/dev", strings.Fields(string(out))[0]), nil
+	}
+	return "", fmt.Errorf("could not find the booted installation disk, please specify the source device")
+}
+
+// checkNotMounted fails if the target device has mounted partitions, and warns about the mounted partitions of
+// the source device
+func checkNotMounted(cfg *config.Config, target, source string) error {
+	for _, disk := range ghw.GetDisks(ghw.NewPaths(""), &cfg.Logger) {
+		device := fmt.Sprintf("/dev/%s", disk.Name)
+		for _, p := range disk.Partitions {
+			if p.MountPoint == "" {
+				continue
+			}
+			if device == target {
+				return fmt.Errorf("device %s has mounted partitions, please unmount them first", target)
+			}
+			if device == source {
+				cfg.Logger.Warnf("Partition %s of %s is mounted at %s, run from recovery or live media for a consistent clone", p.Name, source, p.MountPoint)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package action
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	"github.com/kairos-io/kairos-agent/v2/pkg/elemental"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils/partitions"
+	"github.com/kairos-io/kairos-sdk/state"
+)
+
+// ImageCompaction is the result of compacting a loopback image
+type ImageCompaction struct {
+	Image string `json:"image" yaml:"image"`
+	File  string `json:"file" yaml:"file"`
+	// SizeBefore and SizeAfter are the image file sizes in bytes
+	SizeBefore int64 `json:"size_before" yaml:"size_before"`
+	SizeAfter  int64 `json:"size_after" yaml:"size_after"`
+}
+
+// Reclaimed returns the bytes given back to the partition holding the image
+func (c ImageCompaction) Reclaimed() int64 {
+	return c.SizeBefore - c.SizeAfter
+}
+
+// CompactImage shrinks the passive or recovery image file to the minimal size of its filesystem, giving the free
+// space accumulated inside it back to the partition it lives in. The image being booted can't be compacted, passive
+// is best compacted from recovery.
+// This is the entrypoint for the image compact command
+func CompactImage(cfg *config.Config, image string) (*ImageCompaction, error) {
+	var partName, label, dir, file string
+	var inUse state.Boot
+	switch image {
+	case cnst.PassiveImgName:
+		partName, label, dir, file, inUse = cnst.StatePartName, cnst.StateLabel, cnst.StateDir, cnst.PassiveImgFile, state.Passive
+	case cnst.RecoveryImgName:
+		partName, label, dir, file, inUse = cnst.RecoveryPartName, cnst.RecoveryLabel, cnst.RecoveryDir, cnst.RecoveryImgFile, state.Recovery
+	default:
+		return nil, fmt.Errorf("only the %s and %s images can be compacted, got %q", cnst.PassiveImgName, cnst.RecoveryImgName, image)
+	}
+
+	bootedFrom, err := state.DetectBootWithVFS(cfg.Fs)
+	if err != nil {
+		return nil, fmt.Errorf("detecting current boot: %w", err)
+	}
+	if bootedFrom == inUse {
+		return nil, fmt.Errorf("the %s image is in use, boot from another entry to compact it", image)
+	}
+
+	parts, err := partitions.GetAllPartitions(&cfg.Logger)
+	if err != nil {
+		return nil, err
+	}
+	part := v1.GetPartitionByNameOrLabel(partName, label, parts)
+	if part == nil {
+		return nil, fmt.Errorf("could not find the %s partition", label)
+	}
+	if part.MountPoint == "" {
+		part.MountPoint = dir
+	}
+
+	e := elemental.NewElemental(cfg)
+	umount, err := e.MountRWPartition(part)
+	if err != nil {
+		return nil, err
+	}
+	defer umount() //nolint:errcheck
+
+	imgDir := filepath.Join(part.MountPoint, "cOS")
+	if image == cnst.RecoveryImgName {
+		if squashed, _ := fsutils.Exists(cfg.Fs, filepath.Join(imgDir, cnst.RecoverySquashFile)); squashed {
+			return nil, fmt.Errorf("the recovery image is a squashfs, it is already compact")
+		}
+	}
+	compaction, err := compactImageFile(cfg, filepath.Join(imgDir, file))
+	if err != nil {
+		return nil, err
+	}
+	compaction.Image = image
+	return compaction, nil
+}
+
+// compactImageFile shrinks the ext filesystem in file to its minimal size and truncates the file to it. The
+// filesystem is checked before and after, the file is only truncated once resize2fs succeeded, so an interrupted
+// compaction leaves a bigger file than needed but never a broken image.
+func compactImageFile(cfg *config.Config, file string) (*ImageCompaction, error) {
+	info, err := cfg.Fs.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	compaction := &ImageCompaction{File: file, SizeBefore: info.Size(), SizeAfter: info.Size()}
+
+	cfg.Logger.Infof("Checking the filesystem of %s", file)
+	// e2fsck exits with 1 when it fixed errors, which is fine to continue from
+	if out, err := cfg.Runner.Run("e2fsck", "-f", "-y", file); err != nil && !isExitCode(err, 1) {
+		return nil, fmt.Errorf("e2fsck failed: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+	cfg.Logger.Infof("Shrinking %s to its minimal size", file)
+	if err = runLayoutCmd(cfg, "resize2fs", "-M", file); err != nil {
+		return nil, err
+	}
+	size, err := ext4Size(cfg, file)
+	if err != nil {
+		return nil, err
+	}
+	if size >= info.Size() {
+		cfg.Logger.Infof("%s is already at its minimal size", file)
+		return compaction, nil
+	}
+
+	f, err := cfg.Fs.OpenFile(file, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	err = f.Truncate(size)
+	closeErr := f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if closeErr != nil {
+		return nil, closeErr
+	}
+	if err = runLayoutCmd(cfg, "e2fsck", "-f", "-n", file); err != nil {
+		return nil, fmt.Errorf("verifying the compacted image: %w", err)
+	}
+	compaction.SizeAfter = size
+	return compaction, nil
+}
+
+// ext4Size returns the size in bytes of the ext filesystem in file, as reported by dumpe2fs
+func ext4Size(cfg *config.Config, file string) (int64, error) {
+	out, err := cfg.Runner.Run("dumpe2fs", "-h", file)
+	if err != nil {
+		return 0, fmt.Errorf("dumpe2fs failed: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+	var blocks, blockSize int64
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "Block count":
+			blocks, _ = strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		case "Block size":
+			blockSize, _ = strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		}
+	}
+	if blocks == 0 || blockSize == 0 {
+		return 0, fmt.Errorf("could not read the filesystem size of %s", file)
+	}
+	return blocks * blockSize, nil
+}
+
+// isExitCode returns whether err is a command exiting with the given code
+func isExitCode(err error, code int) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && exitErr.ExitCode() == code
+}
@@ -0,0 +1,76 @@
+package action
+
+import (
+	"bytes"
+	"errors"
+
+	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v5"
+	"github.com/twpayne/go-vfs/v5/vfst"
+)
+
+var _ = Describe("Image compaction tests", Label("compact"), func() {
+	var config *agentConfig.Config
+	var runner *v1mock.FakeRunner
+	var fs vfs.FS
+	var cleanup func()
+	var resizeErr error
+
+	BeforeEach(func() {
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{
+			"/state/cOS/passive.img": string(make([]byte, 8192)),
+		})
+		Expect(err).Should(BeNil())
+		runner = v1mock.NewFakeRunner()
+		config = agentConfig.NewConfig(
+			agentConfig.WithFs(fs),
+			agentConfig.WithRunner(runner),
+			agentConfig.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})),
+		)
+		resizeErr = nil
+		runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+			switch cmd {
+			case "resize2fs":
+				return nil, resizeErr
+			case "dumpe2fs":
+				return []byte("Filesystem volume name:   COS_PASSIVE\nBlock count:              3\nBlock size:               1024\n"), nil
+			}
+			return nil, nil
+		}
+	})
+	AfterEach(func() { cleanup() })
+
+	It("Truncates the image to the size of the shrunk filesystem", func() {
+		compaction, err := compactImageFile(config, "/state/cOS/passive.img")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(compaction.SizeBefore).To(Equal(int64(8192)))
+		Expect(compaction.SizeAfter).To(Equal(int64(3072)))
+		Expect(compaction.Reclaimed()).To(Equal(int64(5120)))
+		info, err := fs.Stat("/state/cOS/passive.img")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Size()).To(Equal(int64(3072)))
+		Expect(runner.CmdsMatch([][]string{
+			{"e2fsck", "-f", "-y", "/state/cOS/passive.img"},
+			{"resize2fs", "-M", "/state/cOS/passive.img"},
+			{"dumpe2fs", "-h", "/state/cOS/passive.img"},
+			{"e2fsck", "-f", "-n", "/state/cOS/passive.img"},
+		})).To(Succeed())
+	})
+	It("Leaves the image untouched if the filesystem can't be shrunk", func() {
+		resizeErr = errors.New("resize failed")
+		_, err := compactImageFile(config, "/state/cOS/passive.img")
+		Expect(err).To(MatchError(ContainSubstring("resize2fs failed")))
+		info, err := fs.Stat("/state/cOS/passive.img")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Size()).To(Equal(int64(8192)))
+	})
+	It("Refuses to compact images other than passive and recovery", func() {
+		_, err := CompactImage(config, "active")
+		Expect(err).To(MatchError(ContainSubstring("can be compacted")))
+	})
+})
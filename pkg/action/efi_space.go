@@ -0,0 +1,239 @@
+package action
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+)
+
+// efiEntryRoles are the roles of the boot entries managed by the upgrades, entries like active_<name> share the role
+// of their prefix. Norole entries are the artifacts of an upgrade being applied, left behind if it was interrupted.
+var efiEntryRoles = []string{"active", "passive", "recovery", "statereset"}
+
+const (
+	efiUnassignedRole = "norole"
+	mib               = 1024 * 1024
+)
+
+// efiAssessmentSuffix is the boot assessment counter systemd-boot keeps in the name of the loader entries
+var efiAssessmentSuffix = regexp.MustCompile(`\+\d+(-\d+)?$`)
+
+// EfiSpace accounts the space used in the EFI partition by the boot entries and their extensions, and the space an
+// upgrade needs on top, so an upgrade that doesn't fit tells what to prune
+type EfiSpace struct {
+	MountPoint string          `json:"mountpoint" yaml:"mountpoint"`
+	SizeBytes  uint64          `json:"size_bytes" yaml:"size_bytes"`
+	FreeBytes  uint64          `json:"free_bytes" yaml:"free_bytes"`
+	Entries    []EfiEntryUsage `json:"entries,omitempty" yaml:"entries,omitempty"`
+	// OtherBytes is the space used by the rest of the files, like the bootloader and the keys
+	OtherBytes uint64 `json:"other_bytes" yaml:"other_bytes"`
+	// Planned are the files the upgrade writes, the ones it replaces are freed along the way
+	Planned []EfiFileUsage `json:"planned,omitempty" yaml:"planned,omitempty"`
+	// NeededBytes is the most free space the upgrade takes at any point, while the old and new entries coexist
+	NeededBytes uint64 `json:"needed_bytes" yaml:"needed_bytes"`
+}
+
+// EfiEntryUsage is the space used by a boot entry
+type EfiEntryUsage struct {
+	Name string `json:"name" yaml:"name"`
+	Role string `json:"role" yaml:"role"`
+	// Files are the UKI and its loader entry
+	Files []EfiFileUsage `json:"files,omitempty" yaml:"files,omitempty"`
+	// Extensions are the sysexts and confexts of the entry
+	Extensions []EfiFileUsage `json:"extensions,omitempty" yaml:"extensions,omitempty"`
+	// Prunable is set for the entries no upgrade nor boot needs, like the ones left by interrupted upgrades
+	Prunable bool `json:"prunable,omitempty" yaml:"prunable,omitempty"`
+}
+
+// EfiFileUsage is the space used by a file in the EFI partition
+type EfiFileUsage struct {
+	Path      string `json:"path" yaml:"path"`
+	SizeBytes uint64 `json:"size_bytes" yaml:"size_bytes"`
+}
+
+// UKIBytes returns the space used by the UKI and loader entry
+func (e EfiEntryUsage) UKIBytes() uint64 {
+	return sumFileUsage(e.Files)
+}
+
+// ExtensionBytes returns the space used by the extensions
+func (e EfiEntryUsage) ExtensionBytes() uint64 {
+	return sumFileUsage(e.Extensions)
+}
+
+func sumFileUsage(files []EfiFileUsage) uint64 {
+	var size uint64
+	for _, f := range files {
+		size += f.SizeBytes
+	}
+	return size
+}
+
+// NewEfiSpace accounts the space of the EFI partition mounted at efiDir and the space the given upgrade needs.
+// The size of the new entries is the estimated size of the source in the spec.
+func NewEfiSpace(cfg *config.Config, efiDir string, spec *v1.UpgradeUkiSpec) (*EfiSpace, error) {
+	space := &EfiSpace{MountPoint: efiDir}
+	raw, err := cfg.Fs.RawPath(efiDir)
+	if err != nil {
+		return nil, err
+	}
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(raw, &st); err != nil {
+		return nil, fmt.Errorf("checking the space of %s: %w", efiDir, err)
+	}
+	space.SizeBytes = st.Blocks * uint64(st.Bsize)
+	space.FreeBytes = st.Bavail * uint64(st.Bsize)
+
+	entries := map[string]*EfiEntryUsage{}
+	entry := func(name string) *EfiEntryUsage {
+		if entries[name] == nil {
+			entries[name] = &EfiEntryUsage{Name: name, Role: efiEntryRole(name)}
+		}
+		return entries[name]
+	}
+	ukiDir := filepath.Join(efiDir, "EFI", "kairos")
+	confDir := filepath.Join(efiDir, "loader", "entries")
+	err = fsutils.WalkDirFs(cfg.Fs, efiDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		file := EfiFileUsage{Path: path, SizeBytes: uint64(info.Size())}
+		dir := filepath.Dir(path)
+		switch {
+		case strings.EqualFold(filepath.Dir(dir), ukiDir) && strings.HasSuffix(dir, ".efi.extra.d"):
+			e := entry(strings.TrimSuffix(filepath.Base(dir), ".efi.extra.d"))
+			e.Extensions = append(e.Extensions, file)
+		case strings.EqualFold(dir, ukiDir) && strings.HasSuffix(d.Name(), ".efi"):
+			e := entry(strings.TrimSuffix(d.Name(), ".efi"))
+			e.Files = append(e.Files, file)
+		case dir == confDir && strings.HasSuffix(d.Name(), ".conf"):
+			e := entry(efiAssessmentSuffix.ReplaceAllString(strings.TrimSuffix(d.Name(), ".conf"), ""))
+			e.Files = append(e.Files, file)
+		default:
+			space.OtherBytes += file.SizeBytes
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		e.Prunable = e.Role == efiUnassignedRole || e.Role == ""
+		space.Entries = append(space.Entries, *e)
+	}
+	sort.Slice(space.Entries, func(i, j int) bool { return space.Entries[i].Name < space.Entries[j].Name })
+
+	space.plan(spec)
+	return space, nil
+}
+
+// efiEntryRole returns the role of the entry name, empty for the entries no upgrade manages
+func efiEntryRole(name string) string {
+	for _, role := range append(efiEntryRoles, efiUnassignedRole) {
+		if name == role || strings.HasPrefix(name, role+"_") {
+			return role
+		}
+	}
+	return ""
+}
+
+// roleBytes returns the space used by the UKIs and the extensions of the entries with the role
+func (s *EfiSpace) roleBytes(role string) (uint64, uint64) {
+	var ukis, extensions uint64
+	for _, e := range s.Entries {
+		if e.Role == role {
+			ukis += e.UKIBytes()
+			extensions += e.ExtensionBytes()
+		}
+	}
+	return ukis, extensions
+}
+
+// plan sets the files the upgrade writes and the space it needs, following the steps of the upgrade
+func (s *EfiSpace) plan(spec *v1.UpgradeUkiSpec) {
+	newSet := uint64(spec.Active.Size) * mib
+	if spec.Entry != "" {
+		// Single entries are replaced in place, the new UKI is staged out of the EFI partition
+		s.Planned = []EfiFileUsage{{Path: filepath.Join(s.MountPoint, "EFI", "kairos", spec.Entry+".efi"), SizeBytes: newSet}}
+		for _, e := range s.Entries {
+			if e.Name == spec.Entry {
+				s.NeededBytes = subFloor(newSet, e.UKIBytes())
+				return
+			}
+		}
+		s.NeededBytes = newSet
+		return
+	}
+
+	active, activeExt := s.roleBytes("active")
+	passive, passiveExt := s.roleBytes("passive")
+	s.Planned = []EfiFileUsage{
+		{Path: filepath.Join(s.MountPoint, "EFI", "kairos", "active.efi"), SizeBytes: newSet},
+		{Path: filepath.Join(s.MountPoint, "EFI", "kairos", "passive.efi"), SizeBytes: active},
+	}
+	if activeExt > 0 {
+		s.Planned = append(s.Planned, EfiFileUsage{Path: filepath.Join(s.MountPoint, "EFI", "kairos", "passive.efi.extra.d"), SizeBytes: activeExt})
+	}
+	// The new set is staged next to the current entries, then the passive entries are replaced with the active ones,
+	// the active ones with the new set and the passive extensions with the active ones, before the staged set is removed
+	steps := []uint64{
+		newSet,
+		subFloor(newSet+active, passive),
+		subFloor(2*newSet, passive),
+		subFloor(2*newSet+activeExt, passive+passiveExt),
+	}
+	for _, needed := range steps {
+		if needed > s.NeededBytes {
+			s.NeededBytes = needed
+		}
+	}
+}
+
+func subFloor(a, b uint64) uint64 {
+	if b > a {
+		return 0
+	}
+	return a - b
+}
+
+// Check fails if the upgrade doesn't fit in the free space, telling what can be pruned to make room
+func (s *EfiSpace) Check() error {
+	if s.NeededBytes <= s.FreeBytes {
+		return nil
+	}
+	var prune []string
+	for _, e := range s.Entries {
+		if e.Prunable {
+			prune = append(prune, fmt.Sprintf("the %s entry left by an interrupted upgrade or installed by hand (%s)", e.Name, megabytes(e.UKIBytes()+e.ExtensionBytes())))
+		}
+	}
+	for _, e := range s.Entries {
+		for _, ext := range e.Extensions {
+			if strings.HasSuffix(ext.Path, ".raw") {
+				prune = append(prune, fmt.Sprintf("the %s extension of the %s entry (%s)", filepath.Base(ext.Path), e.Name, megabytes(ext.SizeBytes)))
+			}
+		}
+	}
+	msg := fmt.Sprintf("not enough space in the EFI partition %s: the upgrade needs %s and %s are free", s.MountPoint, megabytes(s.NeededBytes), megabytes(s.FreeBytes))
+	if len(prune) == 0 {
+		return fmt.Errorf("%s, and there are no extensions nor stale entries to prune", msg)
+	}
+	return fmt.Errorf("%s, make room for %s more by removing:\n  %s", msg, megabytes(s.NeededBytes-s.FreeBytes), strings.Join(prune, "\n  "))
+}
+
+// megabytes formats the bytes in MB, rounding up so nothing shows as 0MB
+func megabytes(b uint64) string {
+	return fmt.Sprintf("%dMB", (b+mib-1)/mib)
+}
@@ -0,0 +1,99 @@
+package action
+
+import (
+	"bytes"
+	"strings"
+
+	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v5/vfst"
+)
+
+var _ = Describe("EfiSpace", Label("efi", "uki"), func() {
+	var config *agentConfig.Config
+	var cleanup func()
+	var spec *v1.UpgradeUkiSpec
+
+	BeforeEach(func() {
+		fs, clean, err := vfst.NewTestFS(map[string]interface{}{
+			"/efi/EFI/BOOT/BOOTX64.EFI":                            strings.Repeat("b", 1000),
+			"/efi/loader/loader.conf":                              "default active.conf",
+			"/efi/EFI/kairos/active.efi":                           strings.Repeat("a", 2*mib),
+			"/efi/loader/entries/active+3.conf":                    strings.Repeat("c", 10),
+			"/efi/EFI/kairos/active.efi.extra.d/docker.sysext.raw": strings.Repeat("s", mib),
+			"/efi/EFI/kairos/passive.efi":                          strings.Repeat("p", 2*mib),
+			"/efi/loader/entries/passive+2-1.conf":                 strings.Repeat("c", 10),
+			"/efi/EFI/kairos/recovery.efi":                         strings.Repeat("r", 2*mib),
+			"/efi/EFI/kairos/norole.efi":                           strings.Repeat("n", mib),
+			"/efi/EFI/kairos/kairos-v2.4.efi":                      strings.Repeat("o", mib),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		cleanup = clean
+		config = agentConfig.NewConfig(
+			agentConfig.WithFs(fs),
+			agentConfig.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})),
+		)
+		spec = &v1.UpgradeUkiSpec{Active: v1.Image{Size: 3}}
+	})
+
+	AfterEach(func() {
+		cleanup()
+	})
+
+	It("accounts the entries, their extensions and the rest of the files", func() {
+		space, err := NewEfiSpace(config, "/efi", spec)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(space.OtherBytes).To(BeNumerically("==", 1000+len("default active.conf")))
+
+		names := []string{}
+		for _, e := range space.Entries {
+			names = append(names, e.Name)
+		}
+		Expect(names).To(Equal([]string{"active", "kairos-v2.4", "norole", "passive", "recovery"}))
+		active := space.Entries[0]
+		Expect(active.Role).To(Equal("active"))
+		Expect(active.UKIBytes()).To(BeNumerically("==", 2*mib+10))
+		Expect(active.ExtensionBytes()).To(BeNumerically("==", mib))
+		Expect(active.Prunable).To(BeFalse())
+		Expect(space.Entries[1].Role).To(BeEmpty())
+		Expect(space.Entries[1].Prunable).To(BeTrue())
+		Expect(space.Entries[2].Prunable).To(BeTrue())
+		Expect(space.Entries[3].UKIBytes()).To(BeNumerically("==", 2*mib+10))
+	})
+
+	It("needs room for the new entries while the active ones and their extensions move to passive", func() {
+		space, err := NewEfiSpace(config, "/efi", spec)
+		Expect(err).ToNot(HaveOccurred())
+		// The new set twice, while it is staged and copied to active, plus the active extensions copied to passive,
+		// minus the passive entry replaced
+		Expect(space.NeededBytes).To(BeNumerically("==", 5*mib-10))
+		Expect(space.Planned).To(HaveLen(3))
+
+		space.FreeBytes = 5 * mib
+		Expect(space.Check()).To(Succeed())
+		space.FreeBytes = 4 * mib
+		err = space.Check()
+		Expect(err).To(MatchError(ContainSubstring("the upgrade needs 5MB and 4MB are free")))
+		Expect(err.Error()).To(ContainSubstring("the norole entry"))
+		Expect(err.Error()).To(ContainSubstring("the kairos-v2.4 entry"))
+		Expect(err.Error()).To(ContainSubstring("the docker.sysext.raw extension of the active entry (1MB)"))
+	})
+
+	It("needs room for the difference when replacing a single entry", func() {
+		spec.Entry = "recovery"
+		spec.Active.Source = v1.NewDockerSrc("quay.io/kairos/ubuntu:v3.2.0-uki")
+		space, err := NewEfiSpace(config, "/efi", spec)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(space.NeededBytes).To(BeNumerically("==", mib))
+
+		plan, err := NewUkiUpgradePlan(config, "/efi", spec)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(plan.Entry).To(Equal("recovery"))
+		Expect(plan.RequiredSpace).To(BeNumerically("==", 1))
+		Expect(plan.Images).To(HaveLen(1))
+		Expect(plan.Images[0].From).To(Equal("oci://quay.io/kairos/ubuntu:v3.2.0-uki"))
+	})
+})
@@ -0,0 +1,105 @@
+package action
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+)
+
+// History entry results
+const (
+	HistorySuccess = "success"
+	HistoryFailed  = "failed"
+)
+
+// HistoryEntry is an install, upgrade or reset recorded in the history journal of the state partition
+type HistoryEntry struct {
+	Operation string `json:"operation" yaml:"operation"`
+	Source    string `json:"source,omitempty" yaml:"source,omitempty"`
+	// Digest is the digest of the deployed image, only known for OCI images
+	Digest   string    `json:"digest,omitempty" yaml:"digest,omitempty"`
+	Started  time.Time `json:"started" yaml:"started"`
+	Finished time.Time `json:"finished" yaml:"finished"`
+	Result   string    `json:"result" yaml:"result"`
+	Error    string    `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// newHistoryEntry starts the history entry of the operation
+func newHistoryEntry(operation string) *HistoryEntry {
+	return &HistoryEntry{Operation: operation, Started: time.Now()}
+}
+
+// record finishes the entry with the outcome of the operation and appends it to the journal in the given state
+// partition mount point. Failing to record it does not fail the operation.
+func (h *HistoryEntry) record(cfg *config.Config, stateDir string, src *v1.ImageSource, meta interface{}, err error) {
+	h.Finished = time.Now()
+	if src != nil && !src.IsEmpty() {
+		h.Source = src.String()
+	}
+	if m, ok := meta.(*v1.DockerImageMeta); ok {
+		h.Digest = m.Digest
+	}
+	h.Result = HistorySuccess
+	if err != nil {
+		h.Result = HistoryFailed
+		h.Error = err.Error()
+	}
+	if err = AppendHistory(cfg.Fs, filepath.Join(stateDir, cnst.HistoryFile), *h); err != nil {
+		cfg.Logger.Warnf("Could not record the %s in the history journal: %s", h.Operation, err)
+	}
+}
+
+// AppendHistory appends the entry to the journal file, one JSON document per line, so an interrupted write only
+// loses the entry being written
+func AppendHistory(fs v1.FS, file string, entry HistoryEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err = fsutils.MkdirAll(fs, filepath.Dir(file), cnst.DirPerm); err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	// Start on a new line if the last write was cut
+	if current, err := fs.ReadFile(file); err == nil && len(current) > 0 && current[len(current)-1] != '\n' {
+		data = append([]byte{'\n'}, data...)
+	}
+	f, err := fs.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, cnst.FilePerm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// ReadHistory returns the entries of the journal file, oldest first. Lines that can't be parsed, like one cut by a
+// power loss, are skipped.
+func ReadHistory(fs v1.FS, file string) ([]HistoryEntry, error) {
+	data, err := fs.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []HistoryEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		entry := HistoryEntry{}
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil && entry.Operation != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
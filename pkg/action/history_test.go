@@ -0,0 +1,71 @@
+package action
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v5"
+	"github.com/twpayne/go-vfs/v5/vfst"
+)
+
+var _ = Describe("History", Label("history"), func() {
+	var config *agentConfig.Config
+	var fs vfs.FS
+	var cleanup func()
+	const journal = "/run/cos/state/kairos-history.jsonl"
+
+	BeforeEach(func() {
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{})
+		Expect(err).Should(BeNil())
+		config = agentConfig.NewConfig(
+			agentConfig.WithFs(fs),
+			agentConfig.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})),
+		)
+	})
+
+	AfterEach(func() {
+		cleanup()
+	})
+
+	It("records the operations with the digest of the deployed image", func() {
+		newHistoryEntry("install").record(config, "/run/cos/state", v1.NewDockerSrc("quay.io/kairos/ubuntu:v3.2.0"), &v1.DockerImageMeta{Digest: "sha256:abc"}, nil)
+		newHistoryEntry("reset").record(config, "/run/cos/state", v1.NewDirSrc("/run/cos/recovery"), nil, errors.New("no space left"))
+
+		entries, err := ReadHistory(fs, journal)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(2))
+		Expect(entries[0].Operation).To(Equal("install"))
+		Expect(entries[0].Digest).To(Equal("sha256:abc"))
+		Expect(entries[0].Result).To(Equal(HistorySuccess))
+		Expect(entries[1].Source).To(Equal("dir:///run/cos/recovery"))
+		Expect(entries[1].Digest).To(BeEmpty())
+		Expect(entries[1].Result).To(Equal(HistoryFailed))
+		Expect(entries[1].Error).To(Equal("no space left"))
+	})
+
+	It("skips the entries cut by a power loss", func() {
+		Expect(AppendHistory(fs, journal, HistoryEntry{Operation: "install", Started: time.Now(), Result: HistorySuccess})).To(Succeed())
+		data, err := fs.ReadFile(journal)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fs.WriteFile(journal, append(data, []byte(`{"operation":"upgr`)...), 0644)).To(Succeed())
+		Expect(AppendHistory(fs, journal, HistoryEntry{Operation: "upgrade", Started: time.Now(), Result: HistorySuccess})).To(Succeed())
+
+		entries, err := ReadHistory(fs, journal)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(2))
+		Expect(entries[1].Operation).To(Equal("upgrade"))
+	})
+
+	It("returns no entries without a journal", func() {
+		entries, err := ReadHistory(fs, journal)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(BeEmpty())
+	})
+})
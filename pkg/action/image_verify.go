@@ -0,0 +1,122 @@
+package action
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	"github.com/kairos-io/kairos-agent/v2/pkg/elemental"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils/partitions"
+	"github.com/kairos-io/kairos-sdk/state"
+)
+
+// ImageVerification is the result of checking the filesystem of a loopback image
+type ImageVerification struct {
+	Image string `json:"image" yaml:"image"`
+	File  string `json:"file,omitempty" yaml:"file,omitempty"`
+	// Skipped is why the image was not checked, like being the booted one
+	Skipped string `json:"skipped,omitempty" yaml:"skipped,omitempty"`
+	Error   string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// verifiedImages are the images checked by VerifyImages with the partition holding them and the boot using them
+var verifiedImages = []struct {
+	image, file, partName, label, dir string
+	inUse                             state.Boot
+}{
+	{cnst.ActiveImgName, cnst.ActiveImgFile, cnst.StatePartName, cnst.StateLabel, cnst.StateDir, state.Active},
+	{cnst.PassiveImgName, cnst.PassiveImgFile, cnst.StatePartName, cnst.StateLabel, cnst.StateDir, state.Passive},
+	{cnst.RecoveryImgName, cnst.RecoveryImgFile, cnst.RecoveryPartName, cnst.RecoveryLabel, cnst.RecoveryDir, state.Recovery},
+}
+
+// VerifyImages checks the filesystems of the active, passive and recovery images without modifying them, so a
+// corrupted fallback image is found before it is needed. The booted image is skipped, its filesystem is in use.
+// It fails if any image failed the check.
+// This is the entrypoint for the image verify command
+func VerifyImages(cfg *config.Config) ([]ImageVerification, error) {
+	bootedFrom, err := state.DetectBootWithVFS(cfg.Fs)
+	if err != nil {
+		return nil, fmt.Errorf("detecting current boot: %w", err)
+	}
+	parts, err := partitions.GetAllPartitions(&cfg.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	e := elemental.NewElemental(cfg)
+	var verifications []ImageVerification
+	var failed int
+	mounted := map[string]string{}
+	for _, img := range verifiedImages {
+		v := ImageVerification{Image: img.image}
+		if bootedFrom == img.inUse {
+			v.Skipped = "booted"
+			verifications = append(verifications, v)
+			continue
+		}
+		mountPoint, ok := mounted[img.label]
+		if !ok {
+			part := v1.GetPartitionByNameOrLabel(img.partName, img.label, parts)
+			if part == nil {
+				v.Skipped = fmt.Sprintf("no %s partition", img.label)
+				verifications = append(verifications, v)
+				continue
+			}
+			if part.MountPoint == "" {
+				part.MountPoint = img.dir
+				if err = e.MountPartition(part, "ro"); err != nil {
+					return verifications, err
+				}
+				defer e.UnmountPartition(part) //nolint:errcheck
+			}
+			mountPoint = part.MountPoint
+			mounted[img.label] = mountPoint
+		}
+
+		v.File = filepath.Join(mountPoint, "cOS", img.file)
+		if img.image == cnst.RecoveryImgName {
+			squashed := filepath.Join(mountPoint, "cOS", cnst.RecoverySquashFile)
+			if exists, _ := fsutils.Exists(cfg.Fs, squashed); exists {
+				v.File = squashed
+			}
+		}
+		if exists, _ := fsutils.Exists(cfg.Fs, v.File); !exists {
+			v.Skipped = "not deployed"
+			v.File = ""
+		} else if err = verifyImageFile(cfg, v.File); err != nil {
+			v.Error = err.Error()
+			failed++
+		}
+		verifications = append(verifications, v)
+	}
+	if failed > 0 {
+		return verifications, fmt.Errorf("%d images failed the verification", failed)
+	}
+	return verifications, nil
+}
+
+// verifyImageFile checks the filesystem in file read-only, the metadata of the squashfs images and the whole ext
+// filesystem of the others
+func verifyImageFile(cfg *config.Config, file string) error {
+	cfg.Logger.Infof("Verifying the filesystem of %s", file)
+	if strings.HasSuffix(file, ".squashfs") {
+		if out, err := cfg.Runner.Run("unsquashfs", "-l", file); err != nil {
+			return fmt.Errorf("unsquashfs failed: %s: %w", lastLine(out), err)
+		}
+		return nil
+	}
+	if out, err := cfg.Runner.Run("e2fsck", "-f", "-n", file); err != nil {
+		return fmt.Errorf("e2fsck found errors: %s: %w", lastLine(out), err)
+	}
+	return nil
+}
+
+// lastLine returns the last non empty line of a command output, which has the summary of the checks
+func lastLine(out []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,41 @@
+package action
+
+import (
+	"bytes"
+	"errors"
+
+	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Image verification tests", Label("image-verify"), func() {
+	var config *agentConfig.Config
+	var runner *v1mock.FakeRunner
+
+	BeforeEach(func() {
+		runner = v1mock.NewFakeRunner()
+		config = agentConfig.NewConfig(
+			agentConfig.WithRunner(runner),
+			agentConfig.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})),
+		)
+	})
+
+	It("Checks the ext images read-only and the squashfs images by listing them", func() {
+		Expect(verifyImageFile(config, "/state/cOS/passive.img")).To(Succeed())
+		Expect(verifyImageFile(config, "/recovery/cOS/recovery.squashfs")).To(Succeed())
+		Expect(runner.CmdsMatch([][]string{
+			{"e2fsck", "-f", "-n", "/state/cOS/passive.img"},
+			{"unsquashfs", "-l", "/recovery/cOS/recovery.squashfs"},
+		})).To(Succeed())
+	})
+	It("Reports the summary of the failed checks", func() {
+		runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+			return []byte("Pass 1: Checking inodes\n\npassive.img: ********** WARNING: Filesystem still has errors **********\n"), errors.New("exit status 4")
+		}
+		err := verifyImageFile(config, "/state/cOS/passive.img")
+		Expect(err).To(MatchError(ContainSubstring("e2fsck found errors: passive.img: ********** WARNING: Filesystem still has errors **********")))
+	})
+})
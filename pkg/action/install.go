@@ -17,6 +17,7 @@ limitations under the License.
 package action
 
 import (
+	"context"
 	"fmt"
 	"path/filepath"
 	"strings"
@@ -30,6 +31,7 @@ import (
 	"github.com/kairos-io/kairos-agent/v2/pkg/elemental"
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
 	"github.com/kairos-io/kairos-agent/v2/pkg/utils"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
 )
 
 func (i *InstallAction) installHook(hook string, chroot bool) error {
@@ -120,9 +122,60 @@ func NewInstallAction(cfg *config.Config, spec *v1.InstallSpec) *InstallAction {
 	return &InstallAction{cfg: cfg, spec: spec}
 }
 
+// checkHardware reports the host storage controllers, NICs and GPUs without modules in the system tree at root,
+// failing in strict mode unless the installation is forced
+func (i *InstallAction) checkHardware(root string) error {
+	if i.spec.HardwareCheck == cnst.HardwareCheckOff {
+		return nil
+	}
+	report, err := utils.NewHardwareReport(i.cfg.Fs, root)
+	if err != nil {
+		i.cfg.Logger.Warnf("Could not check the hardware compatibility: %s", err)
+		return nil
+	}
+	for _, d := range report.Devices {
+		i.cfg.Logger.Debugf("Hardware: %s device %s (%s:%s), host driver %q, image modules %v", d.Class, d.Address, d.Vendor, d.Device, d.Driver, d.Modules)
+	}
+	missing := report.Missing()
+	for _, d := range missing {
+		i.cfg.Logger.Warnf("The image has no driver for the %s device %s (%s:%s), used by %q in this host", d.Class, d.Address, d.Vendor, d.Device, d.Driver)
+	}
+	if len(missing) > 0 && i.spec.HardwareCheck == cnst.HardwareCheckStrict && !i.spec.Force {
+		return fmt.Errorf("the image has no drivers for %d devices of this host, use `force` to install anyway", len(missing))
+	}
+	return nil
+}
+
+// flashMediaConfig keeps the journald logs in memory on the installed system, so they don't wear the flash media
+const flashMediaConfig = `name: "Flash media"
+stages:
+  initramfs:
+  - name: "Keep the journald logs in memory"
+    files:
+    - path: /etc/systemd/journald.conf.d/10-flash-media.conf
+      permissions: 0644
+      content: |
+        [Journal]
+        Storage=volatile
+        RuntimeMaxUse=64M
+`
+
+// writeFlashMediaConfig stores the flash media config in the OEM partition, before the user configs so they can override it
+func writeFlashMediaConfig(cfg *config.Config, oemDir string) error {
+	file := filepath.Join(oemDir, cnst.FlashMediaConfigFile)
+	cfg.Logger.Infof("Writing the flash media config to %s", file)
+	return cfg.Fs.WriteFile(file, []byte(flashMediaConfig), cnst.FilePerm)
+}
+
 // Run will install the system from a given configuration
 func (i InstallAction) Run() (err error) {
+	progress := utils.NewProgress(i.cfg, "install")
+	defer func() { progress.Done(err) }()
 	e := elemental.NewElemental(i.cfg)
+	e.SetDownloadTimeout(i.spec.Timeouts.Download)
+	e.SetBootableCheck(!i.spec.Force)
+	e.SetSingleSync(i.spec.Media != nil && i.spec.Media.SingleSync)
+	deadline := utils.NewDeadline(i.spec.Timeouts.Total)
 	cleanup := utils.NewCleanStack()
 	defer func() { err = cleanup.Cleanup(err) }()
 
@@ -133,17 +186,41 @@ func (i InstallAction) Run() (err error) {
 	// Set installation sources from a downloaded ISO
 
 	if i.spec.Iso != "" {
-		tmpDir, err := e.GetIso(i.spec.Iso)
+		var tmpDir string
+		err = deadline.Run(fmt.Sprintf("downloading %s", i.spec.Iso), i.spec.Timeouts.Download, func(ctx context.Context) (err error) {
+			tmpDir, err = e.WithContext(ctx).GetIso(i.spec.Iso)
+			return err
+		})
 		if err != nil {
 			return err
 		}
-		cleanup.Push(func() error { return i.cfg.Fs.RemoveAll(tmpDir) })
+		cleanup.Push(func() error { return fsutils.RemoveTempDir(i.cfg.Fs, tmpDir) })
 		err = e.UpdateSourcesFormDownloadedISO(tmpDir, &i.spec.Active, &i.spec.Recovery)
 		if err != nil {
 			return err
 		}
 	}
 
+	// Network disks are attached here, after the pre-install stage which might set up the network
+	if i.spec.NetworkDisk != nil {
+		i.spec.Target, err = AttachNetworkDisk(i.cfg, i.spec.NetworkDisk)
+		if err != nil {
+			return err
+		}
+		// The installed system attaches it again from the initramfs
+		if i.cfg.Install.GrubOptions == nil {
+			i.cfg.Install.GrubOptions = map[string]string{}
+		}
+		i.cfg.Install.GrubOptions["extra_cmdline"] = strings.TrimSpace(i.cfg.Install.GrubOptions["extra_cmdline"] + " " + NetworkDiskCmdline(i.spec.NetworkDisk))
+	}
+
+	// Directory sources, like the live media rootfs, are checked before touching the disk, the rest once deployed
+	if i.spec.Active.Source.IsDir() {
+		if err = i.checkHardware(i.spec.Active.Source.Value()); err != nil {
+			return err
+		}
+	}
+
 	if i.spec.NoFormat {
 		i.cfg.Logger.Infof("NoFormat is true, skipping format and partitioning")
 		// Check force flag against current device
@@ -169,6 +246,7 @@ func (i InstallAction) Run() (err error) {
 			return err
 		}
 		// Partition device
+		progress.Phase("partition", 5, fmt.Sprintf("Partitioning %s", i.spec.Target))
 		err = e.PartitionAndFormatDevice(i.spec)
 		if err != nil {
 			return err
@@ -182,9 +260,18 @@ func (i InstallAction) Run() (err error) {
 	cleanup.Push(func() error {
 		return e.UnmountPartitions(i.spec.Partitions.PartitionsByMountPoint(true))
 	})
+	// Recorded before the partitions are unmounted, so failures from here on are in the history too
+	var systemMeta interface{}
+	history := newHistoryEntry("install")
+	cleanup.Push(func() error {
+		history.record(i.cfg, i.spec.Partitions.State.MountPoint, i.spec.Active.Source, systemMeta, err)
+		return nil
+	})
 
 	// Before install hook happens after partitioning but before the image OS is applied
-	err = i.installHook(cnst.BeforeInstallHook, false)
+	err = deadline.Run(cnst.BeforeInstallHook, 0, func(context.Context) error {
+		return i.installHook(cnst.BeforeInstallHook, false)
+	})
 	if err != nil {
 		return err
 	}
@@ -195,23 +282,52 @@ func (i InstallAction) Run() (err error) {
 	}
 
 	// Deploy active image
-	systemMeta, err := e.DeployImage(&i.spec.Active, true)
+	progress.Phase("deploy-active", 20, fmt.Sprintf("Deploying %s", i.spec.Active.Source.Value()))
+	err = deadline.Run(fmt.Sprintf("deploying %s", i.spec.Active.Source.Value()), i.spec.Timeouts.Deploy, func(ctx context.Context) (err error) {
+		systemMeta, err = e.WithContext(ctx).DeployImage(&i.spec.Active, true)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 	cleanup.Push(func() error { return e.UnmountImage(&i.spec.Active) })
+	if !i.spec.Active.Source.IsDir() {
+		if err = i.checkHardware(i.spec.Active.MountPoint); err != nil {
+			return err
+		}
+	}
 
 	// Create extra dirs in rootfs as afterwards this will be impossible due to RO system
 	createExtraDirsInRootfs(i.cfg, i.spec.ExtraDirsRootfs, i.spec.Active.MountPoint)
 
+	// The network disk credentials go in the initramfs, the kernel command line can be read by anyone
+	if i.spec.NetworkDisk != nil {
+		if err = SetNetworkDiskCredentials(i.cfg, e, i.spec.Active.MountPoint, i.spec.NetworkDisk); err != nil {
+			return err
+		}
+	}
+
 	// Copy cloud-init if any
 	err = e.CopyCloudConfig(i.spec.CloudInit)
 	if err != nil {
 		return err
 	}
-	// Install grub
-	grub := utils.NewGrub(i.cfg)
-	err = grub.Install(
+	if i.spec.Media != nil && i.spec.Media.VolatileJournal {
+		if err = writeFlashMediaConfig(i.cfg, i.spec.Partitions.OEM.MountPoint); err != nil {
+			return err
+		}
+	}
+	// Copy all the cloud configs found in the install media if requested
+	if i.spec.MediaConfigs {
+		err = e.CopyMediaCloudConfigs(cnst.GetInstallMediaConfigDirs())
+		if err != nil {
+			return err
+		}
+	}
+	// Install the bootloader, grub unless the arch boots without it
+	progress.Phase("bootloader", 50, "Installing the bootloader")
+	bootloader := utils.NewBootloader(i.cfg, i.spec.Firmware)
+	err = bootloader.Install(
 		i.spec.Target,
 		i.spec.Active.MountPoint,
 		i.spec.Partitions.State.MountPoint,
@@ -232,14 +348,18 @@ func (i InstallAction) Run() (err error) {
 	if mnt, _ := utils.IsMounted(i.cfg, i.spec.Partitions.OEM); mnt {
 		binds[i.spec.Partitions.OEM.MountPoint] = cnst.OEMPath
 	}
-	err = utils.ChrootedCallback(
-		i.cfg, i.spec.Active.MountPoint, binds, func() error { return e.SelinuxRelabel("/", true) },
-	)
+	err = deadline.Run("selinux relabel", 0, func(context.Context) error {
+		return utils.ChrootedCallback(
+			i.cfg, i.spec.Active.MountPoint, binds, func() error { return e.SelinuxRelabel("/", true) },
+		)
+	})
 	if err != nil {
 		return err
 	}
 
-	err = i.installHook(cnst.AfterInstallChrootHook, true)
+	err = deadline.Run(cnst.AfterInstallChrootHook, 0, func(context.Context) error {
+		return i.installHook(cnst.AfterInstallChrootHook, true)
+	})
 	if err != nil {
 		return err
 	}
@@ -259,23 +379,38 @@ func (i InstallAction) Run() (err error) {
 	if err != nil {
 		return err
 	}
+	if err = e.SyncImage(&i.spec.Active); err != nil {
+		return err
+	}
 	// Install Recovery
-	recoveryMeta, err := e.DeployImage(&i.spec.Recovery, false)
+	progress.Phase("deploy-recovery", 60, "Deploying the recovery image")
+	var recoveryMeta interface{}
+	err = deadline.Run("deploying recovery", i.spec.Timeouts.Deploy, func(ctx context.Context) (err error) {
+		recoveryMeta, err = e.WithContext(ctx).DeployImage(&i.spec.Recovery, false)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 	// Install Passive
-	_, err = e.DeployImage(&i.spec.Passive, false)
+	progress.Phase("deploy-passive", 75, "Deploying the passive image")
+	err = deadline.Run("deploying passive", i.spec.Timeouts.Deploy, func(ctx context.Context) error {
+		_, err := e.WithContext(ctx).DeployImage(&i.spec.Passive, false)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
+	progress.Phase("finalize", 90, "Running the after install hooks")
 	err = hook.Run(*i.cfg, i.spec, hook.EncryptionHooks...)
 	if err != nil {
 		return err
 	}
 
-	err = i.installHook(cnst.AfterInstallHook, false)
+	err = deadline.Run(cnst.AfterInstallHook, 0, func(context.Context) error {
+		return i.installHook(cnst.AfterInstallHook, false)
+	})
 	if err != nil {
 		return err
 	}
@@ -286,12 +421,23 @@ func (i InstallAction) Run() (err error) {
 		return err
 	}
 
+	// Export the effective install to the OEM partition, to reproduce it on other machines
+	plan := i.exportPlan(systemMeta)
+
 	// Do not reboot/poweroff on cleanup errors
 	err = cleanup.Cleanup(err)
 	if err != nil {
 		return err
 	}
 
+	// Clone the installed disk into the mirror device, once everything is unmounted
+	if i.spec.MirrorDevice != "" {
+		err = e.CloneDisk(i.spec.Target, i.spec.MirrorDevice)
+		if err != nil {
+			return err
+		}
+	}
+
 	// If we want to eject the cd, create the required executable so the cd is ejected at shutdown
 	out, _ := i.cfg.Fs.ReadFile("/proc/cmdline")
 	bootedFromCD := strings.Contains(string(out), "cdroot")
@@ -304,6 +450,10 @@ func (i InstallAction) Run() (err error) {
 		}
 	}
 
+	if i.spec.PrintPlan && plan != nil {
+		fmt.Print(string(plan))
+	}
+
 	_ = utils.RunStage(i.cfg, "kairos-install.after")
 	_ = events.RunHookScript("/usr/bin/kairos-agent.install.after.hook") //nolint:errcheck
 
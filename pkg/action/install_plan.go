@@ -0,0 +1,190 @@
+package action
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/kairos-io/kairos-sdk/types"
+	yip "github.com/mudler/yip/pkg/schema"
+	"gopkg.in/yaml.v3"
+)
+
+// InstallPlan is the effective install as a cloud-config, with the choices actually taken, so the same install can
+// be reproduced on other machines. Secrets like password hashes and the ids of the created filesystems are left out.
+type InstallPlan struct {
+	Install InstallPlanSpec        `yaml:"install"`
+	Stages  map[string][]yip.Stage `yaml:"stages,omitempty"`
+}
+
+// InstallPlanSpec are the install keys of the plan
+type InstallPlanSpec struct {
+	Auto   bool   `yaml:"auto"`
+	Device string `yaml:"device,omitempty"`
+	// Source is the installed image, pinned to its digest when it is an OCI image
+	Source          string                 `yaml:"source,omitempty"`
+	Iso             string                 `yaml:"iso,omitempty"`
+	PartTable       string                 `yaml:"part-table,omitempty"`
+	Partitions      v1.ElementalPartitions `yaml:"partitions,omitempty"`
+	ExtraPartitions types.PartitionList    `yaml:"extra-partitions,omitempty"`
+	Active          *v1.Image              `yaml:"system,omitempty"`
+	Recovery        *v1.Image              `yaml:"recovery-system,omitempty"`
+	Encrypt         []string               `yaml:"encrypted_partitions,omitempty"`
+	GrubDefEntry    string                 `yaml:"grub-entry-name,omitempty"`
+	Reboot          bool                   `yaml:"reboot,omitempty"`
+	PowerOff        bool                   `yaml:"poweroff,omitempty"`
+}
+
+// NewInstallPlan returns the plan of the install of the given spec, with the metadata of the deployed system image
+func NewInstallPlan(cfg *config.Config, spec *v1.InstallSpec, systemMeta interface{}) (*InstallPlan, error) {
+	plan := &InstallPlan{
+		Install: InstallPlanSpec{
+			Auto:            true,
+			PartTable:       spec.PartTable,
+			Partitions:      planPartitions(spec.Partitions),
+			ExtraPartitions: planPartitionList(spec.ExtraPartitions),
+			Active:          planImage(spec.Active),
+			Recovery:        planImage(spec.Recovery),
+			Encrypt:         cfg.Install.Encrypt,
+			GrubDefEntry:    spec.GrubDefEntry,
+			Reboot:          spec.Reboot,
+			PowerOff:        spec.PowerOff,
+		},
+	}
+	// Network disks are attached at install time, the device they got means nothing on another machine
+	if spec.NetworkDisk == nil {
+		plan.Install.Device = spec.Target
+	}
+	if spec.Iso != "" {
+		plan.Install.Iso = spec.Iso
+	} else {
+		plan.Install.Source = planSource(spec.Active.Source, systemMeta)
+	}
+
+	users, err := planUsers(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) > 0 {
+		plan.Stages = users
+	}
+	return plan, nil
+}
+
+// Marshal returns the plan as a cloud-config
+func (p *InstallPlan) Marshal() ([]byte, error) {
+	data, err := yaml.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(config.AddHeader(config.DefaultHeader, string(data))), nil
+}
+
+// exportPlan writes the install plan to the OEM partition and returns it. Failing to export it does not fail the install.
+func (i *InstallAction) exportPlan(systemMeta interface{}) []byte {
+	plan, err := NewInstallPlan(i.cfg, i.spec, systemMeta)
+	if err != nil {
+		i.cfg.Logger.Warnf("Could not generate the install plan: %s", err)
+		return nil
+	}
+	data, err := plan.Marshal()
+	if err != nil {
+		i.cfg.Logger.Warnf("Could not generate the install plan: %s", err)
+		return nil
+	}
+	oem := i.spec.Partitions.OEM
+	if oem == nil || oem.MountPoint == "" {
+		return data
+	}
+	// The installed system doesn't load it as config, as it is no yaml file
+	file := filepath.Join(oem.MountPoint, cnst.InstallPlanFile)
+	i.cfg.Logger.Infof("Writing the install plan to %s", file)
+	if err = i.cfg.Fs.WriteFile(file, data, 0600); err != nil {
+		i.cfg.Logger.Warnf("Could not write the install plan: %s", err)
+	}
+	return data
+}
+
+// planSource returns the source URI of the image, pinned to the digest of the deployed OCI image
+func planSource(src *v1.ImageSource, systemMeta interface{}) string {
+	if src == nil || src.IsEmpty() {
+		return ""
+	}
+	if !src.IsDocker() {
+		return src.String()
+	}
+	ref := src.Value()
+	if meta, ok := systemMeta.(*v1.DockerImageMeta); ok && meta.Digest != "" && !strings.Contains(ref, "@") {
+		ref = fmt.Sprintf("%s@%s", ref, meta.Digest)
+	}
+	// The opaque form, as the digest would be taken as user info of the URI host
+	return fmt.Sprintf("oci:%s", ref)
+}
+
+// planPartition returns the reproducible settings of the partition, without the ids of the created one
+func planPartition(p *types.Partition) *types.Partition {
+	if p == nil {
+		return nil
+	}
+	return &types.Partition{FilesystemLabel: p.FilesystemLabel, Size: p.Size, FS: p.FS, Flags: p.Flags}
+}
+
+func planPartitions(parts v1.ElementalPartitions) v1.ElementalPartitions {
+	return v1.ElementalPartitions{
+		OEM:        planPartition(parts.OEM),
+		Recovery:   planPartition(parts.Recovery),
+		State:      planPartition(parts.State),
+		Persistent: planPartition(parts.Persistent),
+	}
+}
+
+func planPartitionList(parts types.PartitionList) types.PartitionList {
+	var list types.PartitionList
+	for _, p := range parts {
+		planned := planPartition(p)
+		planned.Name = p.Name
+		list = append(list, planned)
+	}
+	return list
+}
+
+// planImage returns the size and filesystem of the image, its source is the one of the plan
+func planImage(img v1.Image) *v1.Image {
+	if img.Size == 0 && img.FS == "" && img.Tuning == nil {
+		return nil
+	}
+	return &v1.Image{Label: img.Label, Size: img.Size, FS: img.FS, Tuning: img.Tuning}
+}
+
+// planUsers returns the users created by the config stages, without their password hashes
+func planUsers(cfg *config.Config) (map[string][]yip.Stage, error) {
+	cc, err := cfg.Config.String()
+	if err != nil {
+		return nil, err
+	}
+	loaded, err := yip.Load(cc, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	stages := map[string][]yip.Stage{}
+	for name, stageList := range loaded.Stages {
+		for _, stage := range stageList {
+			if len(stage.Users) == 0 {
+				continue
+			}
+			users := map[string]yip.User{}
+			for userName, user := range stage.Users {
+				if user.PasswordHash != "" {
+					cfg.Logger.Infof("Leaving the password of user %s out of the install plan", userName)
+				}
+				user.PasswordHash = ""
+				users[userName] = user
+			}
+			stages[name] = append(stages[name], yip.Stage{Name: stage.Name, Users: users})
+		}
+	}
+	return stages, nil
+}
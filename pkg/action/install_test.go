@@ -18,12 +18,14 @@ package action_test
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/diskfs/go-diskfs"
 
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 
 	"github.com/kairos-io/kairos-agent/v2/pkg/action"
 	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
@@ -40,6 +42,7 @@ import (
 	. "github.com/onsi/gomega"
 	"github.com/twpayne/go-vfs/v5"
 	"github.com/twpayne/go-vfs/v5/vfst"
+	"gopkg.in/yaml.v3"
 )
 
 var _ = Describe("Install action tests", func() {
@@ -139,6 +142,10 @@ var _ = Describe("Install action tests", func() {
 			// Need to create the IsoBaseTree, like if we are booting from iso
 			err = fsutils.MkdirAll(fs, constants.IsoBaseTree, constants.DirPerm)
 			Expect(err).To(BeNil())
+			Expect(createBootableTree(fs, constants.IsoBaseTree)).To(Succeed())
+			extractor.SideEffect = func(_, destination, _ string) error {
+				return createBootableTree(fs, destination)
+			}
 
 			spec, err = agentConfig.NewInstallSpec(config)
 			Expect(err).ToNot(HaveOccurred())
@@ -211,6 +218,88 @@ var _ = Describe("Install action tests", func() {
 			Expect(installer.Run()).To(BeNil())
 		})
 
+		It("Streams the install progress as JSON records", Label("progress"), func() {
+			out := &bytes.Buffer{}
+			config.Progress = v1.NewJSONProgress(out)
+			spec.Target = device
+			Expect(installer.Run()).To(BeNil())
+
+			var phases []string
+			for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+				record := v1.ProgressRecord{}
+				Expect(json.Unmarshal([]byte(line), &record)).To(Succeed())
+				Expect(record.Action).To(Equal("install"))
+				Expect(record.Error).To(BeEmpty())
+				phases = append(phases, record.Phase)
+			}
+			Expect(phases).To(Equal([]string{"start", "partition", "deploy-active", "bootloader", "deploy-recovery", "deploy-passive", "finalize", "done"}))
+		})
+
+		It("Reports the phase the install failed at", Label("progress"), func() {
+			out := &bytes.Buffer{}
+			config.Progress = v1.NewJSONProgress(out)
+			spec.Target = "nonexistingdisk"
+			Expect(installer.Run()).NotTo(BeNil())
+
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			record := v1.ProgressRecord{}
+			Expect(json.Unmarshal([]byte(lines[len(lines)-1]), &record)).To(Succeed())
+			Expect(record.Phase).To(Equal("failed"))
+			Expect(record.Message).To(Equal("partition"))
+			Expect(record.Error).ToNot(BeEmpty())
+		})
+
+		It("Successfully installs to a network disk", Label("network-disk"), func() {
+			link := "/dev/disk/by-path/ip-10.0.0.5:3260-iscsi-iqn.2024-01.io.kairos:disk1-lun-0"
+			Expect(fsutils.MkdirAll(fs, filepath.Dir(link), constants.DirPerm)).To(Succeed())
+			rawLink, err := fs.RawPath(link)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.Symlink(device, rawLink)).To(Succeed())
+			spec.Target = ""
+			spec.NetworkDisk = &v1.NetworkDisk{Protocol: constants.NetworkDiskISCSI, Portal: "10.0.0.5", Target: "iqn.2024-01.io.kairos:disk1", Initiator: "iqn.2024-01.io.kairos:node1"}
+
+			Expect(installer.Run()).To(BeNil())
+			Expect(spec.Target).To(Equal(device))
+			Expect(runner.IncludesCmds([][]string{{"iscsiadm", "-m", "node", "-T", "iqn.2024-01.io.kairos:disk1", "-p", "10.0.0.5:3260", "--login"}})).To(Succeed())
+			Expect(config.Install.GrubOptions["extra_cmdline"]).To(ContainSubstring("netroot=iscsi:10.0.0.5::3260:0:iqn.2024-01.io.kairos:disk1"))
+		})
+
+		It("Clones the installed disk into the mirror device as a spare to promote", Label("mirror"), func() {
+			mirror := filepath.Join(tmpdir, "mirror.img")
+			_, err = fs.Create(mirror)
+			Expect(err).ShouldNot(HaveOccurred())
+			sideEffect := runner.SideEffect
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				switch {
+				case cmd == "blockdev":
+					return []byte("2147483648"), nil
+				case cmd == "lsblk" && args[0] == "-p" && args[len(args)-1] == mirror:
+					return []byte(fmt.Sprintf(`{"blockdevices": [{"name": "%[1]s", "children": [
+						{"name": "%[1]s1", "fstype": "vfat", "label": "COS_GRUB"},
+						{"name": "%[1]s2", "fstype": "ext4", "label": "COS_STATE"}]}]}`, mirror)), nil
+				}
+				return sideEffect(cmd, args...)
+			}
+			spec.Target = device
+			spec.MirrorDevice = mirror
+			Expect(installer.Run()).To(BeNil())
+			Expect(runner.IncludesCmds([][]string{
+				{"dd", "if=" + device, "of=" + mirror, "bs=4M", "conv=fsync", "status=none"},
+				{"fatlabel", mirror + "1", "COS_GRUB_S"},
+				{"tune2fs", "-L", "COS_STATE_S", mirror + "2"},
+			})).To(Succeed())
+			Expect(memLog.String()).To(ContainSubstring("promote it to boot from it"))
+		})
+
+		It("Keeps the journald logs in memory when installing to flash media", Label("media"), func() {
+			spec.Target = device
+			spec.Media = &v1.FlashMedia{Device: "/dev/mmcblk0", Kind: v1.MediaEMMC, SingleSync: true, VolatileJournal: true}
+			Expect(installer.Run()).To(BeNil())
+			data, err := fs.ReadFile(filepath.Join(constants.OEMDir, constants.FlashMediaConfigFile))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring("Storage=volatile"))
+		})
+
 		It("Sets the executable /run/cos/ejectcd so systemd can eject the cd on restart", func() {
 			_ = fsutils.MkdirAll(fs, "/usr/lib/systemd/system-shutdown", constants.DirPerm)
 			_, err := fs.Stat("/usr/lib/systemd/system-shutdown/eject")
@@ -259,14 +348,47 @@ var _ = Describe("Install action tests", func() {
 			Expect(installer.Run()).To(BeNil())
 		})
 
+		It("Exports the effective install plan to the OEM partition", Label("plan"), func() {
+			spec.Target = device
+			spec.Active.Source = v1.NewDockerSrc("my/image:latest")
+			extractor.Layers = []string{"sha256:layer"}
+			config.Config = collector.Config{Values: collector.ConfigValues{"stages": map[string]interface{}{
+				"initramfs": []interface{}{map[string]interface{}{
+					"name": "Set user",
+					"users": map[string]interface{}{
+						"kairos": map[string]interface{}{"passwd": "secret", "groups": []interface{}{"admin"}},
+					},
+				}},
+			}}}
+			Expect(installer.Run()).To(BeNil())
+
+			data, err := fs.ReadFile(filepath.Join(constants.OEMDir, constants.InstallPlanFile))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(HavePrefix("#cloud-config"))
+			plan := action.InstallPlan{}
+			Expect(yaml.Unmarshal(data, &plan)).To(Succeed())
+			Expect(plan.Install.Device).To(Equal(device))
+			Expect(plan.Install.Source).To(Equal("oci:my/image:latest@sha256:fake"))
+			Expect(plan.Install.Partitions.State.Size).To(Equal(spec.Partitions.State.Size))
+			Expect(plan.Install.Partitions.State.UUID).To(BeEmpty())
+			Expect(plan.Stages["initramfs"][0].Users["kairos"].Groups).To(Equal([]string{"admin"}))
+			Expect(plan.Stages["initramfs"][0].Users["kairos"].PasswordHash).To(BeEmpty())
+			Expect(string(data)).ToNot(ContainSubstring("secret"))
+		})
+
 		It("Successfully installs and adds remote cloud-config", Label("cloud-config"), func() {
 			spec.Target = device
 			spec.CloudInit = []string{"http://my.config.org"}
 			fsutils.MkdirAll(fs, constants.OEMDir, constants.DirPerm)
 			_, err := fs.Create(filepath.Join(constants.OEMDir, "90_custom.yaml"))
 			Expect(err).ShouldNot(HaveOccurred())
+			cl.Fs = fs
+			cl.Data = []byte("#cloud-config\nhostname: remote\n")
 			Expect(installer.Run()).To(BeNil())
 			Expect(cl.WasGetCalledWith("http://my.config.org")).To(BeTrue())
+			data, err := fs.ReadFile(filepath.Join(constants.OEMDir, "90_custom.yaml"))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(data)).To(Equal("#cloud-config\nhostname: remote\n"))
 		})
 
 		It("Fails if disk doesn't exist", Label("disk"), func() {
@@ -295,6 +417,8 @@ var _ = Describe("Install action tests", func() {
 			fs.Create("cOS.iso")
 			spec.Iso = "http://cOS.iso"
 			spec.Target = device
+			// The fake ISO has no system tree to check
+			spec.Force = true
 			err := installer.Run()
 			Expect(err).To(BeNil())
 			Expect(spec.Active.Source.Value()).To(ContainSubstring("/rootfs"))
@@ -0,0 +1,140 @@
+package action
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+)
+
+// DefaultLogsMaxFileSize is the size each collected log is capped to unless configured otherwise
+const DefaultLogsMaxFileSize = 10 * 1024 * 1024
+
+// logsUnits are the units whose journal is always collected
+var logsUnits = []string{
+	"kairos-agent", "kairos-installer", "kairos-interactive", "kairos-recovery", "kairos-reset", "kairos-webui",
+	"cos-setup-rootfs", "cos-setup-initramfs", "cos-setup-boot", "cos-setup-fs", "cos-setup-network", "cos-setup-reconcile",
+}
+
+// logsFiles are the log files always collected
+var logsFiles = []string{"/var/log/kairos/*", "/run/immucore/*.log", "/run/kairos/*.log"}
+
+// CollectLogs gathers the journal of the Kairos units and the Kairos log files into the dest gzipped tarball,
+// capping each of them to the configured size. This is the entrypoint for the logs command
+func CollectLogs(cfg *config.Config, dest string) error {
+	logs := config.Logs{}
+	if cfg.Logs != nil {
+		logs = *cfg.Logs
+	}
+	maxSize := logs.MaxFileSize
+	if maxSize == 0 {
+		maxSize = DefaultLogsMaxFileSize
+	}
+	var journalArgs []string
+	for _, a := range logs.JournalArgs {
+		// Allow both `--since 24h` and `--since`, `24h` as separate items
+		journalArgs = append(journalArgs, strings.Fields(a)...)
+	}
+
+	if err := fsutils.MkdirAll(cfg.Fs, filepath.Dir(dest), cnst.DirPerm); err != nil {
+		return err
+	}
+	f, err := cfg.Fs.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+
+	add := func(name string, data []byte) error {
+		data = truncateLog(data, maxSize)
+		hdr := &tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+
+	for _, unit := range append(logsUnits, logs.Units...) {
+		args := append([]string{"--no-pager", "-o", "short-iso", "-u", unit}, journalArgs...)
+		out, err := cfg.Runner.Run("journalctl", args...)
+		if err != nil {
+			cfg.Logger.Debugf("Skipping the journal of %s: %s", unit, err)
+			continue
+		}
+		// journalctl succeeds for units without entries
+		if strings.HasPrefix(strings.TrimSpace(string(out)), "-- No entries --") {
+			continue
+		}
+		if err = add(filepath.Join("journal", unit+".log"), out); err != nil {
+			return err
+		}
+	}
+
+	collected := map[string]bool{}
+	for _, pattern := range append(logsFiles, logs.Files...) {
+		matches, err := fsutils.GlobFs(cfg.Fs, pattern)
+		if err != nil {
+			cfg.Logger.Warnf("Ignoring invalid log file pattern %s: %s", pattern, err)
+			continue
+		}
+		for _, path := range matches {
+			if collected[path] {
+				continue
+			}
+			info, err := cfg.Fs.Stat(path)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			data, err := cfg.Fs.ReadFile(path)
+			if err != nil {
+				cfg.Logger.Warnf("Skipping %s: %s", path, err)
+				continue
+			}
+			collected[path] = true
+			if err = add(filepath.Join("files", path), data); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	if err = gz.Close(); err != nil {
+		return err
+	}
+	cfg.Logger.Infof("Logs collected in %s", dest)
+	return nil
+}
+
+// DefaultLogsBundle returns the default path for the logs bundle
+func DefaultLogsBundle() string {
+	hostname, _ := os.Hostname()
+	return filepath.Join(os.TempDir(), fmt.Sprintf("kairos-logs-%s-%s.tar.gz", hostname, time.Now().Format("20060102-150405")))
+}
+
+// truncateLog caps data to maxSize bytes, keeping its head and its tail around a marker with the bytes left out.
+// A negative maxSize disables the cap.
+func truncateLog(data []byte, maxSize int64) []byte {
+	if maxSize < 0 || int64(len(data)) <= maxSize {
+		return data
+	}
+	head := maxSize / 2
+	tail := maxSize - head
+	marker := fmt.Sprintf("\n[... truncated %d bytes ...]\n", int64(len(data))-maxSize)
+	out := make([]byte, 0, maxSize+int64(len(marker)))
+	out = append(out, data[:head]...)
+	out = append(out, marker...)
+	return append(out, data[int64(len(data))-tail:]...)
+}
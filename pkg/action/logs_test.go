@@ -0,0 +1,110 @@
+package action
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strings"
+
+	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v5"
+	"github.com/twpayne/go-vfs/v5/vfst"
+)
+
+var _ = Describe("Logs tests", Label("logs"), func() {
+	var config *agentConfig.Config
+	var runner *v1mock.FakeRunner
+	var fs vfs.FS
+	var cleanup func()
+
+	readBundle := func(path string) map[string]string {
+		data, err := fs.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		Expect(err).ToNot(HaveOccurred())
+		tr := tar.NewReader(gz)
+		files := map[string]string{}
+		for {
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			Expect(err).ToNot(HaveOccurred())
+			content, err := io.ReadAll(tr)
+			Expect(err).ToNot(HaveOccurred())
+			files[hdr.Name] = string(content)
+		}
+		return files
+	}
+
+	BeforeEach(func() {
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{
+			"/var/log/kairos/agent-provider.log": "provider log",
+			"/var/log/kairos/big.log":            strings.Repeat("a", 50) + strings.Repeat("b", 50),
+			"/var/log/other.log":                 "other",
+		})
+		Expect(err).Should(BeNil())
+		runner = v1mock.NewFakeRunner()
+		runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+			if cmd != "journalctl" {
+				return []byte{}, nil
+			}
+			switch args[4] {
+			case "kairos-agent":
+				return []byte("agent journal"), nil
+			case "kairos-webui":
+				return nil, errors.New("journalctl failed")
+			default:
+				return []byte("-- No entries --\n"), nil
+			}
+		}
+		config = agentConfig.NewConfig(
+			agentConfig.WithFs(fs),
+			agentConfig.WithRunner(runner),
+			agentConfig.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})),
+		)
+	})
+
+	AfterEach(func() {
+		cleanup()
+	})
+
+	It("collects the journal and the log files", func() {
+		Expect(CollectLogs(config, "/tmp/logs.tar.gz")).To(Succeed())
+		files := readBundle("/tmp/logs.tar.gz")
+		Expect(files).To(HaveLen(3))
+		Expect(files).To(HaveKeyWithValue("journal/kairos-agent.log", "agent journal"))
+		Expect(files).To(HaveKeyWithValue("files/var/log/kairos/agent-provider.log", "provider log"))
+		Expect(files).To(HaveKey("files/var/log/kairos/big.log"))
+		Expect(files).ToNot(HaveKey("files/var/log/other.log"))
+	})
+
+	It("passes the journal args and caps the file sizes", func() {
+		config.Logs = &agentConfig.Logs{
+			JournalArgs: []string{"--since 24h", "-n", "5000"},
+			Files:       []string{"/var/log/other.log"},
+			MaxFileSize: 20,
+		}
+		Expect(CollectLogs(config, "/tmp/logs.tar.gz")).To(Succeed())
+		Expect(runner.IncludesCmds([][]string{
+			{"journalctl", "--no-pager", "-o", "short-iso", "-u", "kairos-agent", "--since", "24h", "-n", "5000"},
+		})).To(Succeed())
+
+		files := readBundle("/tmp/logs.tar.gz")
+		Expect(files).To(HaveKeyWithValue("files/var/log/other.log", "other"))
+		Expect(files).To(HaveKeyWithValue("files/var/log/kairos/big.log", strings.Repeat("a", 10)+"\n[... truncated 80 bytes ...]\n"+strings.Repeat("b", 10)))
+	})
+
+	It("does not cap the files with a negative size", func() {
+		Expect(truncateLog([]byte("0123456789"), -1)).To(Equal([]byte("0123456789")))
+		Expect(truncateLog([]byte("0123456789"), 10)).To(Equal([]byte("0123456789")))
+		Expect(string(truncateLog([]byte("0123456789"), 5))).To(Equal("01\n[... truncated 5 bytes ...]\n789"))
+	})
+})
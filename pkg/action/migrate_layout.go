@@ -0,0 +1,470 @@
+package action
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	"github.com/kairos-io/kairos-agent/v2/pkg/partitioner"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+)
+
+// Layout migration steps
+const (
+	MigrateMBRToGPT     = "mbr-to-gpt"
+	MigrateAddOEM       = "add-oem"
+	MigrateGrowRecovery = "grow-recovery"
+)
+
+// layoutBackupBytes is the size of the head and tail of the disk backed up before migrating, enough to hold the MBR
+// and both GPT headers and partition entries
+const layoutBackupBytes = 1024 * 1024
+
+// LayoutMigrationStep is a single change of a layout migration plan
+type LayoutMigrationStep struct {
+	Name        string `json:"name" yaml:"name"`
+	Description string `json:"description" yaml:"description"`
+	Feasible    bool   `json:"feasible" yaml:"feasible"`
+	// Reason explains why the step can't be applied in place
+	Reason string `json:"reason,omitempty" yaml:"reason,omitempty"`
+	Done   bool   `json:"done" yaml:"done"`
+}
+
+// LayoutMigrationPlan holds the steps needed to bring a legacy install to the current disk layout
+type LayoutMigrationPlan struct {
+	Device string                `json:"device" yaml:"device"`
+	Backup string                `json:"backup,omitempty" yaml:"backup,omitempty"`
+	Steps  []LayoutMigrationStep `json:"steps" yaml:"steps"`
+}
+
+// Pending returns the feasible steps not applied yet
+func (p LayoutMigrationPlan) Pending() []LayoutMigrationStep {
+	var pending []LayoutMigrationStep
+	for _, s := range p.Steps {
+		if s.Feasible && !s.Done {
+			pending = append(pending, s)
+		}
+	}
+	return pending
+}
+
+// diskTable is the partition table of a disk, as reported by sfdisk --json
+type diskTable struct {
+	Label      string          `json:"label"`
+	Device     string          `json:"device"`
+	LastLBA    uint64          `json:"lastlba"`
+	SectorSize uint64          `json:"sectorsize"`
+	Partitions []diskPartition `json:"partitions"`
+	// sectors is the size of the whole disk in sectors
+	sectors uint64
+}
+
+type diskPartition struct {
+	Node  string `json:"node"`
+	Start uint64 `json:"start"`
+	Size  uint64 `json:"size"`
+	Type  string `json:"type"`
+	UUID  string `json:"uuid"`
+	Name  string `json:"name"`
+	// label is the filesystem label
+	label string
+}
+
+func (p diskPartition) end() uint64 {
+	return p.Start + p.Size - 1
+}
+
+// number returns the partition number from its device node, i.e. 3 for /dev/sda3 or /dev/nvme0n1p3
+func (p diskPartition) number() string {
+	i := len(p.Node)
+	for i > 0 && p.Node[i-1] >= '0' && p.Node[i-1] <= '9' {
+		i--
+	}
+	return p.Node[i:]
+}
+
+func (t diskTable) byLabel(label string) (int, *diskPartition) {
+	for i := range t.Partitions {
+		if t.Partitions[i].label == label {
+			return i, &t.Partitions[i]
+		}
+	}
+	return -1, nil
+}
+
+// usableEnd returns the last sector available for partitions, leaving room for the backup GPT
+func (t diskTable) usableEnd() uint64 {
+	if t.Label == v1.GPT && t.LastLBA != 0 {
+		return t.LastLBA
+	}
+	return t.sectors - 34
+}
+
+// lastEnd returns the last sector used by a partition
+func (t diskTable) lastEnd() uint64 {
+	var end uint64
+	for _, p := range t.Partitions {
+		if p.end() > end {
+			end = p.end()
+		}
+	}
+	return end
+}
+
+func (t diskTable) mb(sectors uint64) uint64 {
+	return sectors * t.SectorSize / (1024 * 1024)
+}
+
+func (t diskTable) sectorsFor(mb uint) uint64 {
+	return uint64(mb) * 1024 * 1024 / t.SectorSize
+}
+
+// readDiskTable reads the partition table and the filesystem labels of the given disk
+func readDiskTable(cfg *config.Config, device string) (*diskTable, error) {
+	out, err := cfg.Runner.Run("sfdisk", "--json", device)
+	if err != nil {
+		return nil, fmt.Errorf("reading the partition table of %s: %s: %w", device, strings.TrimSpace(string(out)), err)
+	}
+	var data struct {
+		PartitionTable diskTable `json:"partitiontable"`
+	}
+	if err = json.Unmarshal(out, &data); err != nil {
+		return nil, fmt.Errorf("parsing the partition table of %s: %w", device, err)
+	}
+	table := &data.PartitionTable
+	if table.SectorSize == 0 {
+		table.SectorSize = 512
+	}
+	out, err = cfg.Runner.Run("blockdev", "--getsize64", device)
+	if err != nil {
+		return nil, fmt.Errorf("failed getting size of device %s: %w", device, err)
+	}
+	size, err := strconv.ParseUint(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing size of device %s: %w", device, err)
+	}
+	table.sectors = size / table.SectorSize
+	for i := range table.Partitions {
+		out, _ = cfg.Runner.Run("blkid", "-s", "LABEL", "-o", "value", table.Partitions[i].Node)
+		table.Partitions[i].label = strings.TrimSpace(string(out))
+	}
+	return table, nil
+}
+
+// installDisk finds the disk holding the state partition
+func installDisk(cfg *config.Config) (string, error) {
+	out, err := cfg.Runner.Run("blkid", "-L", cnst.StateLabel)
+	if err != nil || strings.TrimSpace(string(out)) == "" {
+		return "", fmt.Errorf("could not find the installation disk, please specify the device")
+	}
+	out, err = cfg.Runner.Run("lsblk", "-no", "PKNAME", strings.TrimSpace(string(out)))
+	if err != nil || strings.TrimSpace(string(out)) == "" {
+		return "", fmt.Errorf("could not find the installation disk, please specify the device")
+	}
+	return fmt.Sprintf("/dev/%s", strings.TrimSpace(string(out))), nil
+}
+
+// requiredRecoverySize is the recovery partition size a fresh install with the default image size gets
+func requiredRecoverySize(cfg *config.Config) uint {
+	spec := &v1.InstallSpec{Recovery: v1.Image{Size: cnst.ImgSize}}
+	return config.NewInstallElementalPartitions(cfg.Logger, spec).Recovery.Size
+}
+
+// PlanLayoutMigration checks the layout of the given disk, or the installation disk if empty, against the current
+// one and returns the steps to migrate it. Steps that can't be done in place are kept with the reason, so a
+// reinstall can be planned for them.
+func PlanLayoutMigration(cfg *config.Config, device string) (*LayoutMigrationPlan, error) {
+	var err error
+	if device == "" {
+		if device, err = installDisk(cfg); err != nil {
+			return nil, err
+		}
+	}
+	table, err := readDiskTable(cfg, device)
+	if err != nil {
+		return nil, err
+	}
+	plan := &LayoutMigrationPlan{Device: device}
+	gpt := table.Label == v1.GPT
+
+	if !gpt {
+		step := LayoutMigrationStep{Name: MigrateMBRToGPT, Description: "Convert the MBR partition table to GPT"}
+		efi, _ := fsutils.Exists(cfg.Fs, "/sys/firmware/efi")
+		switch {
+		case !efi:
+			step.Reason = "legacy BIOS installs keep the GRUB core image right after the MBR, where the GPT entries go"
+		case len(table.Partitions) > 0 && table.Partitions[0].Start < 34:
+			step.Reason = "the first partition overlaps the GPT header"
+		case table.lastEnd() > table.usableEnd():
+			step.Reason = "no room at the end of the disk for the backup GPT header"
+		default:
+			step.Feasible = true
+			gpt = true
+		}
+		plan.Steps = append(plan.Steps, step)
+	}
+
+	if _, oem := table.byLabel(cnst.OEMLabel); oem == nil {
+		step := LayoutMigrationStep{
+			Name:        MigrateAddOEM,
+			Description: fmt.Sprintf("Add a %dMb %s partition at the end of the disk", cnst.OEMSize, cnst.OEMLabel),
+		}
+		free := table.usableEnd() - table.lastEnd()
+		switch {
+		case !gpt:
+			step.Reason = "adding partitions requires a GPT partition table"
+		case free < table.sectorsFor(cnst.OEMSize):
+			step.Reason = fmt.Sprintf("not enough free space at the end of the disk (%dMb free, %dMb needed)", table.mb(free), cnst.OEMSize)
+		default:
+			step.Feasible = true
+		}
+		plan.Steps = append(plan.Steps, step)
+	}
+
+	required := requiredRecoverySize(cfg)
+	if i, recovery := table.byLabel(cnst.RecoveryLabel); recovery != nil && recovery.Size < table.sectorsFor(required) {
+		step := LayoutMigrationStep{
+			Name:        MigrateGrowRecovery,
+			Description: fmt.Sprintf("Grow the %s partition from %dMb to %dMb", cnst.RecoveryLabel, table.mb(recovery.Size), required),
+		}
+		next := table.usableEnd() + 1
+		for j, p := range table.Partitions {
+			if j != i && p.Start > recovery.Start && p.Start < next {
+				next = p.Start
+			}
+		}
+		needed := table.sectorsFor(required) - recovery.Size
+		switch {
+		case !gpt:
+			step.Reason = "resizing partitions requires a GPT partition table"
+		case next-recovery.end()-1 < needed:
+			step.Reason = fmt.Sprintf("not enough free space after the %s partition (%dMb free, %dMb needed), the partitions after it would need to be moved", cnst.RecoveryLabel, table.mb(next-recovery.end()-1), table.mb(needed))
+		case isMounted(cfg, recovery.Node):
+			step.Reason = fmt.Sprintf("the %s partition is mounted", cnst.RecoveryLabel)
+		default:
+			step.Feasible = true
+		}
+		plan.Steps = append(plan.Steps, step)
+	}
+	return plan, nil
+}
+
+// MigrateLayout applies the feasible steps of the layout migration plan. The partition table is backed up into
+// backupDir first and restored if any step fails or the result can't be verified. Once a filesystem has been grown
+// the table is not restored anymore, as it would end the partition before the filesystem does, the partial state
+// is reported instead.
+// This is the entrypoint for the migrate-layout command
+func MigrateLayout(cfg *config.Config, plan *LayoutMigrationPlan, backupDir string) error {
+	if len(plan.Pending()) == 0 {
+		cfg.Logger.Infof("Nothing to migrate on %s", plan.Device)
+		return nil
+	}
+	backup, err := backupPartitionTable(cfg, plan.Device, backupDir)
+	if err != nil {
+		return fmt.Errorf("backing up the partition table: %w", err)
+	}
+	plan.Backup = backup
+	cfg.Logger.Infof("Partition table of %s backed up to %s", plan.Device, backup)
+
+	grown := false
+	for i, step := range plan.Steps {
+		if !step.Feasible {
+			cfg.Logger.Warnf("Skipping %s: %s", step.Name, step.Reason)
+			continue
+		}
+		cfg.Logger.Infof("%s", step.Description)
+		var resized bool
+		if resized, err = applyLayoutStep(cfg, plan.Device, step.Name); err == nil {
+			err = verifyLayoutStep(cfg, plan.Device, step.Name)
+		}
+		grown = grown || resized
+		if err != nil && grown {
+			cfg.Logger.Errorf("Migration step %s failed after growing a filesystem, not restoring the partition table: %s", step.Name, err)
+			return fmt.Errorf("%s failed after growing a filesystem, the partition table was left as is to keep it intact, check it against the backup in %s: %w", step.Name, backup, err)
+		}
+		if err != nil {
+			cfg.Logger.Errorf("Migration step %s failed, restoring the partition table from %s: %s", step.Name, backup, err)
+			if rerr := restorePartitionTable(cfg, plan.Device, backup); rerr != nil {
+				return fmt.Errorf("%s failed: %w, and restoring the partition table failed: %s", step.Name, err, rerr.Error())
+			}
+			return fmt.Errorf("%s failed, partition table restored: %w", step.Name, err)
+		}
+		plan.Steps[i].Done = true
+	}
+	return nil
+}
+
+// applyLayoutStep applies the given migration step. It reports whether a filesystem was resized, even if partially.
+func applyLayoutStep(cfg *config.Config, device, name string) (bool, error) {
+	table, err := readDiskTable(cfg, device)
+	if err != nil {
+		return false, err
+	}
+	switch name {
+	case MigrateMBRToGPT:
+		if err = runLayoutCmd(cfg, "sgdisk", "-g", device); err != nil {
+			return false, err
+		}
+	case MigrateAddOEM:
+		start := table.lastEnd() + 1
+		// Keep the partitions aligned to 1Mb as on install
+		align := 1024 * 1024 / table.SectorSize
+		start = (start + align - 1) / align * align
+		end := start + table.sectorsFor(cnst.OEMSize) - 1
+		args := []string{
+			"-n", fmt.Sprintf("0:%d:%d", start, end),
+			"-c", fmt.Sprintf("0:%s", cnst.OEMPartName),
+			"-t", "0:8300",
+			device,
+		}
+		if err = runLayoutCmd(cfg, "sgdisk", args...); err != nil {
+			return false, err
+		}
+		settlePartitions(cfg, device)
+		table, err = readDiskTable(cfg, device)
+		if err != nil {
+			return false, err
+		}
+		for _, p := range table.Partitions {
+			if p.Start == start {
+				return false, partitioner.FormatDevice(cfg.Runner, p.Node, cnst.LinuxFs, cnst.OEMLabel)
+			}
+		}
+		return false, fmt.Errorf("new %s partition not found on %s", cnst.OEMLabel, device)
+	case MigrateGrowRecovery:
+		_, recovery := table.byLabel(cnst.RecoveryLabel)
+		if recovery == nil {
+			return false, fmt.Errorf("%s partition not found on %s", cnst.RecoveryLabel, device)
+		}
+		n := recovery.number()
+		end := recovery.Start + table.sectorsFor(requiredRecoverySize(cfg)) - 1
+		// Recreate the partition in the same start sector, keeping its GUID, name and type
+		args := []string{
+			"-d", n,
+			"-n", fmt.Sprintf("%s:%d:%d", n, recovery.Start, end),
+			"-c", fmt.Sprintf("%s:%s", n, recovery.Name),
+			"-t", fmt.Sprintf("%s:%s", n, recovery.Type),
+			"-u", fmt.Sprintf("%s:%s", n, recovery.UUID),
+			device,
+		}
+		if err = runLayoutCmd(cfg, "sgdisk", args...); err != nil {
+			return false, err
+		}
+		settlePartitions(cfg, device)
+		if err = runLayoutCmd(cfg, "e2fsck", "-f", "-y", recovery.Node); err != nil {
+			return false, err
+		}
+		return true, runLayoutCmd(cfg, "resize2fs", recovery.Node)
+	default:
+		return false, fmt.Errorf("unknown migration step %s", name)
+	}
+	settlePartitions(cfg, device)
+	return false, nil
+}
+
+// verifyLayoutStep re-reads the partition table and checks the step got applied
+func verifyLayoutStep(cfg *config.Config, device, name string) error {
+	table, err := readDiskTable(cfg, device)
+	if err != nil {
+		return err
+	}
+	switch name {
+	case MigrateMBRToGPT:
+		if table.Label != v1.GPT {
+			return fmt.Errorf("%s still has a %s partition table", device, table.Label)
+		}
+	case MigrateAddOEM:
+		if _, p := table.byLabel(cnst.OEMLabel); p == nil {
+			return fmt.Errorf("%s partition not found on %s", cnst.OEMLabel, device)
+		}
+	case MigrateGrowRecovery:
+		required := requiredRecoverySize(cfg)
+		if _, p := table.byLabel(cnst.RecoveryLabel); p == nil || p.Size < table.sectorsFor(required) {
+			return fmt.Errorf("%s partition is smaller than %dMb", cnst.RecoveryLabel, required)
+		}
+	}
+	return nil
+}
+
+// backupPartitionTable copies the head and the tail of the disk, holding the MBR or both GPTs, into backupDir
+func backupPartitionTable(cfg *config.Config, device, backupDir string) (string, error) {
+	size, err := deviceBytes(cfg, device)
+	if err != nil {
+		return "", err
+	}
+	if err = fsutils.MkdirAll(cfg.Fs, backupDir, cnst.DirPerm); err != nil {
+		return "", err
+	}
+	backup := filepath.Join(backupDir, fmt.Sprintf("%s-%s", filepath.Base(device), time.Now().Format("20060102150405")))
+	if err = runLayoutCmd(cfg, "dd", fmt.Sprintf("if=%s", device), fmt.Sprintf("of=%s.head", backup), "bs=512", fmt.Sprintf("count=%d", layoutBackupBytes/512), "status=none"); err != nil {
+		return "", err
+	}
+	skip := (size - layoutBackupBytes) / 512
+	if err = runLayoutCmd(cfg, "dd", fmt.Sprintf("if=%s", device), fmt.Sprintf("of=%s.tail", backup), "bs=512", fmt.Sprintf("skip=%d", skip), "status=none"); err != nil {
+		return "", err
+	}
+	// Also keep a readable copy, to restore partitions by hand with sfdisk if needed
+	if out, err := cfg.Runner.Run("sfdisk", "--dump", device); err == nil {
+		_ = fsutils.AtomicWriteFile(cfg.Fs, backup+".sfdisk", out, cnst.FilePerm)
+	}
+	return backup, nil
+}
+
+// restorePartitionTable writes back the head and tail of the disk saved by backupPartitionTable. Filesystems
+// changed by the migration are not restored.
+func restorePartitionTable(cfg *config.Config, device, backup string) error {
+	size, err := deviceBytes(cfg, device)
+	if err != nil {
+		return err
+	}
+	if err = runLayoutCmd(cfg, "dd", fmt.Sprintf("if=%s.head", backup), fmt.Sprintf("of=%s", device), "bs=512", "conv=fsync,notrunc", "status=none"); err != nil {
+		return err
+	}
+	seek := (size - layoutBackupBytes) / 512
+	if err = runLayoutCmd(cfg, "dd", fmt.Sprintf("if=%s.tail", backup), fmt.Sprintf("of=%s", device), "bs=512", fmt.Sprintf("seek=%d", seek), "conv=fsync,notrunc", "status=none"); err != nil {
+		return err
+	}
+	settlePartitions(cfg, device)
+	return nil
+}
+
+func deviceBytes(cfg *config.Config, device string) (uint64, error) {
+	out, err := cfg.Runner.Run("blockdev", "--getsize64", device)
+	if err != nil {
+		return 0, fmt.Errorf("failed getting size of device %s: %w", device, err)
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(out)), 10, 64)
+}
+
+func runLayoutCmd(cfg *config.Config, command string, args ...string) error {
+	out, err := cfg.Runner.Run(command, args...)
+	if err != nil {
+		return fmt.Errorf("%s failed: %s: %w", command, strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+// settlePartitions makes the kernel pick up the partition table changes
+func settlePartitions(cfg *config.Config, device string) {
+	_, _ = cfg.Runner.Run("partx", "-u", device)
+	_, _ = cfg.Runner.Run("udevadm", "settle")
+}
+
+func isMounted(cfg *config.Config, node string) bool {
+	mounts, err := cfg.Mounter.List()
+	if err != nil {
+		return false
+	}
+	for _, m := range mounts {
+		if m.Device == node {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,198 @@
+package action
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v5"
+	"github.com/twpayne/go-vfs/v5/vfst"
+)
+
+var _ = Describe("Layout migration tests", Label("migrate-layout"), func() {
+	var config *agentConfig.Config
+	var runner *v1mock.FakeRunner
+	var fs vfs.FS
+	var cleanup func()
+	var table map[string]interface{}
+	var partitions []map[string]interface{}
+	var labels map[string]string
+	var sgdiskErr error
+
+	BeforeEach(func() {
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{})
+		Expect(err).Should(BeNil())
+		runner = v1mock.NewFakeRunner()
+		config = agentConfig.NewConfig(
+			agentConfig.WithFs(fs),
+			agentConfig.WithRunner(runner),
+			agentConfig.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})),
+			agentConfig.WithMounter(v1mock.NewErrorMounter()),
+		)
+		sgdiskErr = nil
+
+		// A legacy 20Gb MBR install without OEM and a 4Gb recovery partition
+		partitions = []map[string]interface{}{
+			{"node": "/dev/sda1", "start": 2048, "size": 131072, "type": "ef"},
+			{"node": "/dev/sda2", "start": 133120, "size": 8388608, "type": "83"},
+			{"node": "/dev/sda3", "start": 14813184, "size": 16777216, "type": "83"},
+			{"node": "/dev/sda4", "start": 31590400, "size": 8388608, "type": "83"},
+		}
+		table = map[string]interface{}{"label": "dos", "device": "/dev/sda", "unit": "sectors", "sectorsize": 512}
+		labels = map[string]string{
+			"/dev/sda1": cnst.EfiLabel,
+			"/dev/sda2": cnst.RecoveryLabel,
+			"/dev/sda3": cnst.StateLabel,
+			"/dev/sda4": cnst.PersistentLabel,
+		}
+
+		runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+			switch cmd {
+			case "sfdisk":
+				if args[0] == "--json" {
+					table["partitions"] = partitions
+					return json.Marshal(map[string]interface{}{"partitiontable": table})
+				}
+			case "blockdev":
+				return []byte("21474836480\n"), nil
+			case "blkid":
+				if args[0] == "-L" {
+					return []byte("/dev/sda3\n"), nil
+				}
+				return []byte(labels[args[len(args)-1]]), nil
+			case "lsblk":
+				return []byte("sda\n"), nil
+			case "sgdisk":
+				if sgdiskErr != nil {
+					return []byte("could not create partition"), sgdiskErr
+				}
+				switch args[0] {
+				case "-g":
+					table["label"] = "gpt"
+					table["lastlba"] = 41943006
+				case "-n":
+					var start, end int
+					_, _ = fmt.Sscanf(args[1], "0:%d:%d", &start, &end)
+					partitions = append(partitions, map[string]interface{}{"node": "/dev/sda5", "start": start, "size": end - start + 1, "type": "8300"})
+				case "-d":
+					var n, start, end int
+					_, _ = fmt.Sscanf(args[3], "%d:%d:%d", &n, &start, &end)
+					partitions[n-1]["size"] = end - start + 1
+				}
+			case "mkfs.ext4":
+				labels[args[len(args)-1]] = args[1]
+			}
+			return []byte{}, nil
+		}
+	})
+
+	AfterEach(func() {
+		cleanup()
+	})
+
+	It("plans and applies the migration of an EFI install", func() {
+		Expect(fsutils.MkdirAll(fs, "/sys/firmware/efi", os.ModePerm)).To(Succeed())
+		plan, err := PlanLayoutMigration(config, "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(plan.Device).To(Equal("/dev/sda"))
+		Expect(plan.Pending()).To(HaveLen(3))
+		Expect(runner.IncludesCmds([][]string{{"sgdisk"}})).ToNot(Succeed())
+
+		Expect(MigrateLayout(config, plan, "/backup")).To(Succeed())
+		Expect(plan.Pending()).To(BeEmpty())
+		Expect(plan.Backup).To(HavePrefix("/backup/sda-"))
+		Expect(runner.MatchMilestones([][]string{
+			{"dd", "if=/dev/sda", "of=" + plan.Backup + ".head"},
+			{"dd", "if=/dev/sda", "of=" + plan.Backup + ".tail", "bs=512", "skip=41940992"},
+			{"sgdisk", "-g", "/dev/sda"},
+			{"sgdisk", "-n", "0:39979008:40110079", "-c", "0:oem"},
+			{"mkfs.ext4", "-L", cnst.OEMLabel, "/dev/sda5"},
+			{"sgdisk", "-d", "2", "-n", "2:133120:13125631"},
+			{"e2fsck", "-f", "-y", "/dev/sda2"},
+			{"resize2fs", "/dev/sda2"},
+		})).To(Succeed())
+		Expect(runner.IncludesCmds([][]string{{"dd", "if=" + plan.Backup}})).ToNot(Succeed())
+	})
+
+	It("skips the steps that can't be done in place", func() {
+		plan, err := PlanLayoutMigration(config, "/dev/sda")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(plan.Steps).To(HaveLen(3))
+		Expect(plan.Pending()).To(BeEmpty())
+		Expect(plan.Steps[0].Reason).To(ContainSubstring("legacy BIOS"))
+		Expect(plan.Steps[1].Reason).To(ContainSubstring("GPT"))
+
+		Expect(MigrateLayout(config, plan, "/backup")).To(Succeed())
+		Expect(runner.IncludesCmds([][]string{{"dd"}})).ToNot(Succeed())
+	})
+
+	It("reports the lack of space to grow recovery", func() {
+		Expect(fsutils.MkdirAll(fs, "/sys/firmware/efi", os.ModePerm)).To(Succeed())
+		partitions[2]["start"] = 8521728
+		plan, err := PlanLayoutMigration(config, "/dev/sda")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(plan.Steps[2].Name).To(Equal(MigrateGrowRecovery))
+		Expect(plan.Steps[2].Feasible).To(BeFalse())
+		Expect(plan.Steps[2].Reason).To(ContainSubstring("not enough free space after the COS_RECOVERY partition (0Mb free"))
+	})
+
+	It("restores the partition table if a step fails", func() {
+		Expect(fsutils.MkdirAll(fs, "/sys/firmware/efi", os.ModePerm)).To(Succeed())
+		plan, err := PlanLayoutMigration(config, "/dev/sda")
+		Expect(err).ToNot(HaveOccurred())
+		sgdiskErr = errors.New("exit status 4")
+
+		err = MigrateLayout(config, plan, "/backup")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("partition table restored"))
+		Expect(runner.MatchMilestones([][]string{
+			{"sgdisk", "-g", "/dev/sda"},
+			{"dd", "if=" + plan.Backup + ".head", "of=/dev/sda"},
+			{"dd", "if=" + plan.Backup + ".tail", "of=/dev/sda", "bs=512", "seek=41940992"},
+		})).To(Succeed())
+		Expect(plan.Steps[0].Done).To(BeFalse())
+	})
+
+	It("does not restore the partition table once recovery was grown", func() {
+		Expect(fsutils.MkdirAll(fs, "/sys/firmware/efi", os.ModePerm)).To(Succeed())
+		plan, err := PlanLayoutMigration(config, "/dev/sda")
+		Expect(err).ToNot(HaveOccurred())
+		sideEffect := runner.SideEffect
+		runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+			if cmd == "sfdisk" && args[0] == "--json" && runner.IncludesCmds([][]string{{"resize2fs"}}) == nil {
+				return nil, errors.New("exit status 1")
+			}
+			return sideEffect(cmd, args...)
+		}
+
+		err = MigrateLayout(config, plan, "/backup")
+		Expect(err).To(MatchError(ContainSubstring("left as is")))
+		Expect(runner.MatchMilestones([][]string{
+			{"sgdisk", "-d", "2", "-n", "2:133120:13125631"},
+			{"resize2fs", "/dev/sda2"},
+		})).To(Succeed())
+		Expect(runner.IncludesCmds([][]string{{"dd", "if=" + plan.Backup + ".head"}})).ToNot(Succeed())
+		Expect(plan.Steps[1].Done).To(BeTrue())
+		Expect(plan.Steps[2].Done).To(BeFalse())
+	})
+
+	It("has nothing to do on current layouts", func() {
+		table["label"] = "gpt"
+		partitions[1]["size"] = 12992512
+		partitions = append(partitions, map[string]interface{}{"node": "/dev/sda5", "start": 39979008, "size": 131072})
+		labels["/dev/sda5"] = cnst.OEMLabel
+		plan, err := PlanLayoutMigration(config, "/dev/sda")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(plan.Steps).To(BeEmpty())
+	})
+})
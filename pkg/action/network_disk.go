@@ -0,0 +1,241 @@
+package action
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	"github.com/kairos-io/kairos-agent/v2/pkg/elemental"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+)
+
+// networkDiskTimeout is how long to wait for the device of an attached network disk to show up
+var networkDiskTimeout = 30 * time.Second
+
+// networkDiskInterval is the time between checks for the device of an attached network disk
+var networkDiskInterval = time.Second
+
+// nvmeNamespaceRe matches the block devices of NVMe namespaces, i.e. nvme1n1
+var nvmeNamespaceRe = regexp.MustCompile(`^nvme\d+n\d+$`)
+
+// AttachNetworkDisk logs in to the network disk and returns its local device once it shows up. The initiator used
+// is set on the disk, so the installed system attaches it with the same one.
+func AttachNetworkDisk(cfg *config.Config, disk *v1.NetworkDisk) (string, error) {
+	var err error
+	switch disk.Protocol {
+	case cnst.NetworkDiskISCSI:
+		err = loginISCSI(cfg, disk)
+	case cnst.NetworkDiskNVMeoF:
+		err = connectNVMeoF(cfg, disk)
+	default:
+		err = fmt.Errorf("invalid network disk protocol %q", disk.Protocol)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	deadline := time.Now().Add(networkDiskTimeout)
+	for {
+		device, err := networkDiskDevice(cfg, disk)
+		if err == nil {
+			cfg.Logger.Infof("Network disk %s attached as %s", disk.Target, device)
+			return device, nil
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("network disk %s attached but its device did not show up: %w", disk.Target, err)
+		}
+		time.Sleep(networkDiskInterval)
+	}
+}
+
+func loginISCSI(cfg *config.Config, disk *v1.NetworkDisk) error {
+	if disk.Initiator != "" {
+		err := fsutils.MkdirAll(cfg.Fs, filepath.Dir(cnst.ISCSIInitiatorFile), cnst.DirPerm)
+		if err == nil {
+			err = cfg.Fs.WriteFile(cnst.ISCSIInitiatorFile, []byte(fmt.Sprintf("InitiatorName=%s\n", disk.Initiator)), cnst.FilePerm)
+		}
+		if err != nil {
+			return fmt.Errorf("setting the iSCSI initiator name: %w", err)
+		}
+		// iscsid only reads the initiator name on start
+		if out, err := cfg.Runner.Run("systemctl", "try-restart", "iscsid"); err != nil {
+			cfg.Logger.Warnf("could not restart iscsid: %s", strings.TrimSpace(string(out)))
+		}
+	} else {
+		disk.Initiator = readKeyFile(cfg, cnst.ISCSIInitiatorFile, "InitiatorName=")
+	}
+
+	host, port := disk.Address()
+	portal := net.JoinHostPort(host, port)
+	cfg.Logger.Infof("Logging in to iSCSI target %s on %s", disk.Target, portal)
+	if out, err := cfg.Runner.Run("iscsiadm", "-m", "discovery", "-t", "sendtargets", "-p", portal); err != nil {
+		return fmt.Errorf("discovering iSCSI targets on %s: %s: %w", portal, strings.TrimSpace(string(out)), err)
+	}
+	node := []string{"-m", "node", "-T", disk.Target, "-p", portal}
+	if disk.Username != "" {
+		for _, setting := range [][2]string{
+			{"node.session.auth.authmethod", "CHAP"},
+			{"node.session.auth.username", disk.Username},
+			{"node.session.auth.password", disk.Password},
+		} {
+			args := append(append([]string{}, node...), "-o", "update", "-n", setting[0], "-v", setting[1])
+			if out, err := cfg.Runner.Run("iscsiadm", args...); err != nil {
+				return fmt.Errorf("setting the iSCSI %s: %s: %w", setting[0], strings.TrimSpace(string(out)), err)
+			}
+		}
+	}
+	out, err := cfg.Runner.Run("iscsiadm", append(node, "--login")...)
+	if err != nil && !strings.Contains(string(out), "already present") {
+		return fmt.Errorf("logging in to iSCSI target %s: %s: %w", disk.Target, strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+func connectNVMeoF(cfg *config.Config, disk *v1.NetworkDisk) error {
+	if disk.Initiator == "" {
+		disk.Initiator = readKeyFile(cfg, cnst.NVMeHostNQNFile, "")
+	}
+	host, port := disk.Address()
+	args := []string{"connect", "-t", disk.Transport, "-a", host, "-s", port, "-n", disk.Target}
+	if disk.Initiator != "" {
+		args = append(args, "--hostnqn", disk.Initiator)
+	}
+	cfg.Logger.Infof("Connecting to NVMe-oF subsystem %s on %s", disk.Target, net.JoinHostPort(host, port))
+	out, err := cfg.Runner.Run("nvme", args...)
+	if err != nil && !strings.Contains(string(out), "already connected") {
+		return fmt.Errorf("connecting to NVMe-oF subsystem %s: %s: %w", disk.Target, strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+// networkDiskDevice returns the block device of the attached network disk
+func networkDiskDevice(cfg *config.Config, disk *v1.NetworkDisk) (string, error) {
+	host, port := disk.Address()
+	if disk.Protocol == cnst.NetworkDiskISCSI {
+		link := fmt.Sprintf("/dev/disk/by-path/ip-%s-iscsi-%s-lun-%d", net.JoinHostPort(host, port), disk.Target, disk.Lun)
+		target, err := cfg.Fs.Readlink(link)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(link), target)
+		}
+		return target, nil
+	}
+
+	// Controllers of the subsystem, the namespaces are below them or the subsystem with native multipath
+	controllers, _ := fsutils.GlobFs(cfg.Fs, "/sys/class/nvme/nvme*")
+	subsystems, _ := fsutils.GlobFs(cfg.Fs, "/sys/class/nvme-subsystem/nvme-subsys*")
+	for _, dir := range append(controllers, subsystems...) {
+		nqn, err := cfg.Fs.ReadFile(filepath.Join(dir, "subsysnqn"))
+		if err != nil || strings.TrimSpace(string(nqn)) != disk.Target {
+			continue
+		}
+		entries, _ := cfg.Fs.ReadDir(dir)
+		for _, e := range entries {
+			if nvmeNamespaceRe.MatchString(e.Name()) {
+				return filepath.Join("/dev", e.Name()), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no namespace found for NVMe-oF subsystem %s", disk.Target)
+}
+
+// NetworkDiskCmdline returns the kernel arguments for the initramfs to attach the network disk on boot
+func NetworkDiskCmdline(disk *v1.NetworkDisk) string {
+	host, port := disk.Address()
+	if strings.Contains(host, ":") {
+		host = fmt.Sprintf("[%s]", host)
+	}
+	args := []string{"rd.neednet=1", "ip=dhcp"}
+	switch disk.Protocol {
+	case cnst.NetworkDiskISCSI:
+		if disk.Initiator != "" {
+			args = append(args, fmt.Sprintf("rd.iscsi.initiator=%s", disk.Initiator))
+		}
+		// CHAP credentials are not set here, anyone can read the kernel command line. See SetNetworkDiskCredentials.
+		args = append(args, fmt.Sprintf("netroot=iscsi:%s::%s:%d:%s", host, port, disk.Lun, disk.Target))
+	case cnst.NetworkDiskNVMeoF:
+		if disk.Initiator != "" {
+			args = append(args, fmt.Sprintf("rd.nvmf.hostnqn=%s", disk.Initiator))
+		}
+		args = append(args, fmt.Sprintf("rd.nvmf.discover=%s,%s,,%s", disk.Transport, host, port))
+	}
+	return strings.Join(args, " ")
+}
+
+// SetNetworkDiskCredentials adds the iSCSI CHAP credentials of the disk to the initramfs of the given root tree,
+// so they are not exposed on the kernel command line. They are set in a root only dracut config, which dracut
+// adds to the initramfs command line config, and the initramfs is regenerated.
+func SetNetworkDiskCredentials(cfg *config.Config, e *elemental.Elemental, rootDir string, disk *v1.NetworkDisk) error {
+	if disk.Protocol != cnst.NetworkDiskISCSI || disk.Username == "" {
+		return nil
+	}
+	for _, value := range []string{disk.Username, disk.Password} {
+		if strings.ContainsAny(value, " \t\n'\"") {
+			return fmt.Errorf("the iSCSI CHAP credentials can't contain spaces or quotes")
+		}
+	}
+	conf := fmt.Sprintf("kernel_cmdline+=' rd.iscsi.username=%s rd.iscsi.password=%s '\n", disk.Username, disk.Password)
+	return writeNetworkDiskCredentials(cfg, e, rootDir, []byte(conf))
+}
+
+// KeepNetworkDiskCredentials copies the iSCSI CHAP credentials set in the running system, if any, into the
+// initramfs of the given root tree, i.e. of an upgrade image
+func KeepNetworkDiskCredentials(cfg *config.Config, e *elemental.Elemental, rootDir string) error {
+	conf, err := cfg.Fs.ReadFile(cnst.NetworkDiskCredentialsConf)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading the network disk credentials: %w", err)
+	}
+	return writeNetworkDiskCredentials(cfg, e, rootDir, conf)
+}
+
+func writeNetworkDiskCredentials(cfg *config.Config, e *elemental.Elemental, rootDir string, conf []byte) error {
+	if !utils.CommandExistsIn(cfg.Fs, rootDir, "dracut") {
+		return fmt.Errorf("the iSCSI CHAP credentials require dracut in the image to be added to the initramfs")
+	}
+	file := filepath.Join(rootDir, cnst.NetworkDiskCredentialsConf)
+	if err := fsutils.MkdirAll(cfg.Fs, filepath.Dir(file), cnst.DirPerm); err != nil {
+		return err
+	}
+	if err := fsutils.AtomicWriteFile(cfg.Fs, file, conf, 0600); err != nil {
+		return fmt.Errorf("writing the network disk credentials: %w", err)
+	}
+	cfg.Logger.Infof("Adding the network disk credentials to the initramfs")
+	if err := e.RegenerateInitrd(rootDir); err != nil {
+		return err
+	}
+	// The initramfs now holds the credentials
+	_, initrd, err := e.FindKernelInitrd(rootDir)
+	if err != nil {
+		return err
+	}
+	return cfg.Fs.Chmod(initrd, 0600)
+}
+
+// readKeyFile returns the value of the first line of the file with the given prefix, empty if there is none
+func readKeyFile(cfg *config.Config, file, prefix string) string {
+	data, err := cfg.Fs.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") && strings.HasPrefix(line, prefix) {
+			return strings.TrimPrefix(line, prefix)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,153 @@
+package action
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	"github.com/kairos-io/kairos-agent/v2/pkg/elemental"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v5"
+	"github.com/twpayne/go-vfs/v5/vfst"
+)
+
+var _ = Describe("Network disk tests", Label("network-disk"), func() {
+	var config *agentConfig.Config
+	var runner *v1mock.FakeRunner
+	var fs vfs.FS
+	var cleanup func()
+
+	BeforeEach(func() {
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{
+			cnst.ISCSIInitiatorFile: "## generated\nInitiatorName=iqn.2004-10.com.ubuntu:01:node1\n",
+			"/dev/disk/by-path/ip-10.0.0.5:3260-iscsi-iqn.2024-01.io.kairos:disk1-lun-0": &vfst.Symlink{Target: "../../sdb"},
+			cnst.NVMeHostNQNFile:                           "nqn.2014-08.org.nvmexpress:uuid:1234\n",
+			"/sys/class/nvme/nvme0/subsysnqn":              "nqn.2014-08.org.nvmexpress:local\n",
+			"/sys/class/nvme/nvme0/nvme0n1/size":           "100",
+			"/sys/class/nvme/nvme1/subsysnqn":              "nqn.2024-01.io.kairos:disk1\n",
+			"/sys/class/nvme/nvme1/nvme1n1/size":           "100",
+			"/sys/class/nvme/nvme1/nvme1c1n1/size":         "100",
+			"/sys/class/nvme-subsystem/nvme-subsys1/.keep": "",
+		})
+		Expect(err).Should(BeNil())
+		runner = v1mock.NewFakeRunner()
+		config = agentConfig.NewConfig(
+			agentConfig.WithFs(fs),
+			agentConfig.WithRunner(runner),
+			agentConfig.WithSyscall(&v1mock.FakeSyscall{}),
+			agentConfig.WithMounter(v1mock.NewErrorMounter()),
+			agentConfig.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})),
+		)
+		networkDiskTimeout = 50 * time.Millisecond
+		networkDiskInterval = 10 * time.Millisecond
+	})
+
+	AfterEach(func() {
+		cleanup()
+	})
+
+	It("logs in to the iSCSI target with CHAP and returns its device", func() {
+		disk := &v1.NetworkDisk{Protocol: "iscsi", Portal: "10.0.0.5", Target: "iqn.2024-01.io.kairos:disk1", Username: "kairos", Password: "secret"}
+		Expect(disk.Sanitize()).To(Succeed())
+		device, err := AttachNetworkDisk(config, disk)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(device).To(Equal("/dev/sdb"))
+		Expect(disk.Initiator).To(Equal("iqn.2004-10.com.ubuntu:01:node1"))
+		Expect(runner.CmdsMatch([][]string{
+			{"iscsiadm", "-m", "discovery", "-t", "sendtargets", "-p", "10.0.0.5:3260"},
+			{"iscsiadm", "-m", "node", "-T", "iqn.2024-01.io.kairos:disk1", "-p", "10.0.0.5:3260", "-o", "update", "-n", "node.session.auth.authmethod", "-v", "CHAP"},
+			{"iscsiadm", "-m", "node", "-T", "iqn.2024-01.io.kairos:disk1", "-p", "10.0.0.5:3260", "-o", "update", "-n", "node.session.auth.username", "-v", "kairos"},
+			{"iscsiadm", "-m", "node", "-T", "iqn.2024-01.io.kairos:disk1", "-p", "10.0.0.5:3260", "-o", "update", "-n", "node.session.auth.password", "-v", "secret"},
+			{"iscsiadm", "-m", "node", "-T", "iqn.2024-01.io.kairos:disk1", "-p", "10.0.0.5:3260", "--login"},
+		})).To(Succeed())
+		Expect(NetworkDiskCmdline(disk)).To(Equal("rd.neednet=1 ip=dhcp rd.iscsi.initiator=iqn.2004-10.com.ubuntu:01:node1 " +
+			"netroot=iscsi:10.0.0.5::3260:0:iqn.2024-01.io.kairos:disk1"))
+	})
+
+	It("adds the CHAP credentials to the initramfs instead of the kernel command line", func() {
+		for _, file := range []string{"/root/boot/vmlinuz", "/root/boot/initrd", "/root/usr/bin/dracut"} {
+			Expect(fsutils.MkdirAll(fs, filepath.Dir(file), cnst.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile(file, []byte{}, cnst.FilePerm)).To(Succeed())
+		}
+		Expect(fsutils.MkdirAll(fs, "/root/lib/modules/6.1.0-kairos", cnst.DirPerm)).To(Succeed())
+		e := elemental.NewElemental(config)
+		disk := &v1.NetworkDisk{Protocol: "iscsi", Portal: "10.0.0.5", Target: "iqn.2024-01.io.kairos:disk1", Username: "kairos", Password: "secret"}
+		Expect(disk.Sanitize()).To(Succeed())
+		Expect(NetworkDiskCmdline(disk)).ToNot(ContainSubstring("secret"))
+
+		Expect(SetNetworkDiskCredentials(config, e, "/root", disk)).To(Succeed())
+		conf := filepath.Join("/root", cnst.NetworkDiskCredentialsConf)
+		data, err := fs.ReadFile(conf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("kernel_cmdline+=' rd.iscsi.username=kairos rd.iscsi.password=secret '\n"))
+		for _, file := range []string{conf, "/root/boot/initrd"} {
+			info, err := fs.Stat(file)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		}
+		Expect(runner.IncludesCmds([][]string{{"dracut", "-f", "/boot/initrd", "6.1.0-kairos"}})).To(Succeed())
+
+		// Upgrades keep the credentials of the running system
+		Expect(fsutils.MkdirAll(fs, filepath.Dir(cnst.NetworkDiskCredentialsConf), cnst.DirPerm)).To(Succeed())
+		Expect(fs.WriteFile(cnst.NetworkDiskCredentialsConf, data, 0600)).To(Succeed())
+		Expect(fs.Remove(conf)).To(Succeed())
+		Expect(KeepNetworkDiskCredentials(config, e, "/root")).To(Succeed())
+		kept, err := fs.ReadFile(conf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(kept).To(Equal(data))
+
+		disk.Password = "my secret"
+		Expect(SetNetworkDiskCredentials(config, e, "/root", disk)).To(MatchError(ContainSubstring("spaces or quotes")))
+		disk.Password = "secret"
+		Expect(fs.Remove("/root/usr/bin/dracut")).To(Succeed())
+		Expect(SetNetworkDiskCredentials(config, e, "/root", disk)).To(MatchError(ContainSubstring("require dracut")))
+	})
+
+	It("sets the given iSCSI initiator name", func() {
+		disk := &v1.NetworkDisk{Protocol: "iscsi", Portal: "10.0.0.5:3260", Target: "iqn.2024-01.io.kairos:disk1", Initiator: "iqn.2024-01.io.kairos:node2"}
+		_, err := AttachNetworkDisk(config, disk)
+		Expect(err).ToNot(HaveOccurred())
+		initiator, err := fs.ReadFile(cnst.ISCSIInitiatorFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(initiator)).To(Equal("InitiatorName=iqn.2024-01.io.kairos:node2\n"))
+		Expect(runner.IncludesCmds([][]string{{"systemctl", "try-restart", "iscsid"}})).To(Succeed())
+	})
+
+	It("connects to the NVMe-oF subsystem and returns its namespace", func() {
+		disk := &v1.NetworkDisk{Protocol: "nvmeof", Portal: "10.0.0.6", Target: "nqn.2024-01.io.kairos:disk1"}
+		Expect(disk.Sanitize()).To(Succeed())
+		device, err := AttachNetworkDisk(config, disk)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(device).To(Equal("/dev/nvme1n1"))
+		Expect(runner.CmdsMatch([][]string{
+			{"nvme", "connect", "-t", "tcp", "-a", "10.0.0.6", "-s", "4420", "-n", "nqn.2024-01.io.kairos:disk1", "--hostnqn", "nqn.2014-08.org.nvmexpress:uuid:1234"},
+		})).To(Succeed())
+		Expect(NetworkDiskCmdline(disk)).To(Equal("rd.neednet=1 ip=dhcp rd.nvmf.hostnqn=nqn.2014-08.org.nvmexpress:uuid:1234 rd.nvmf.discover=tcp,10.0.0.6,,4420"))
+	})
+
+	It("fails if the login fails or the device does not show up", func() {
+		runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+			if cmd == "iscsiadm" && args[len(args)-1] == "--login" {
+				return []byte("iscsiadm: initiator reported error (24 - iSCSI login failed due to authorization failure)"), errors.New("exit status 24")
+			}
+			return []byte{}, nil
+		}
+		disk := &v1.NetworkDisk{Protocol: "iscsi", Portal: "10.0.0.5", Target: "iqn.2024-01.io.kairos:disk1"}
+		_, err := AttachNetworkDisk(config, disk)
+		Expect(err).To(MatchError(ContainSubstring("authorization failure")))
+
+		disk = &v1.NetworkDisk{Protocol: "nvmeof", Transport: "tcp", Portal: "10.0.0.6", Target: "nqn.2024-01.io.kairos:missing"}
+		_, err = AttachNetworkDisk(config, disk)
+		Expect(err).To(MatchError(ContainSubstring("did not show up")))
+	})
+})
@@ -0,0 +1,63 @@
+package action
+
+import (
+	"fmt"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils"
+)
+
+// OEMBackup snapshots the OEM partition contents into file, encrypted if a keyFile is given.
+// This is the entrypoint for the oem backup command
+func OEMBackup(cfg *config.Config, file, keyFile string) error {
+	if file == "" {
+		file = cnst.OEMBackupFile
+	}
+	key, err := readOEMBackupKey(cfg, keyFile)
+	if err != nil {
+		return err
+	}
+	meta, err := utils.BackupOEM(cfg, cnst.OEMPath, file, key)
+	if err != nil {
+		return fmt.Errorf("backing up %s: %w", cnst.OEMPath, err)
+	}
+	cfg.Logger.Infof("Backed up %d files (%d bytes) from %s to %s", meta.Files, meta.Size, cnst.OEMPath, file)
+	return nil
+}
+
+// OEMRestore replaces the OEM partition contents with the backup in file.
+// This is the entrypoint for the oem restore command
+func OEMRestore(cfg *config.Config, file, keyFile string) error {
+	if file == "" {
+		file = cnst.OEMBackupFile
+	}
+	key, err := readOEMBackupKey(cfg, keyFile)
+	if err != nil {
+		return err
+	}
+	data, err := utils.ReadOEMBackup(cfg, file, key)
+	if err != nil {
+		return fmt.Errorf("reading OEM backup %s: %w", file, err)
+	}
+	meta, err := utils.RestoreOEM(cfg, data, cnst.OEMPath)
+	if err != nil {
+		return fmt.Errorf("restoring OEM backup %s: %w", file, err)
+	}
+	cfg.Logger.Infof("Restored %d files in %s from the backup taken on %s from %s", meta.Files, cnst.OEMPath, meta.Created, meta.Hostname)
+	return nil
+}
+
+func readOEMBackupKey(cfg *config.Config, keyFile string) ([]byte, error) {
+	if keyFile == "" {
+		return nil, nil
+	}
+	key, err := cfg.Fs.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading OEM backup key: %w", err)
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("OEM backup key %s is empty", keyFile)
+	}
+	return key, nil
+}
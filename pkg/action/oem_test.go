@@ -0,0 +1,89 @@
+package action
+
+import (
+	"bytes"
+	"os"
+
+	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v5"
+	"github.com/twpayne/go-vfs/v5/vfst"
+)
+
+var _ = Describe("OEM backup tests", Label("oem"), func() {
+	var config *agentConfig.Config
+	var fs vfs.FS
+	var cleanup func()
+
+	BeforeEach(func() {
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{
+			"/oem/90_custom.yaml":        "#cloud-config\nhostname: node-1\n",
+			"/oem/identity/machine.key":  "secret",
+			"/usr/local/.kairos/keep.me": "",
+			"/etc/oem-backup.key":        "0123456789abcdef",
+		})
+		Expect(err).Should(BeNil())
+		Expect(fs.Chmod("/oem/identity/machine.key", 0600)).To(Succeed())
+
+		config = agentConfig.NewConfig(
+			agentConfig.WithFs(fs),
+			agentConfig.WithRunner(v1mock.NewFakeRunner()),
+			agentConfig.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})),
+			agentConfig.WithMounter(v1mock.NewErrorMounter()),
+			agentConfig.WithSyscall(&v1mock.FakeSyscall{}),
+		)
+	})
+
+	AfterEach(func() {
+		cleanup()
+	})
+
+	It("backs up and restores the OEM partition contents", func() {
+		Expect(OEMBackup(config, "", "")).To(Succeed())
+		exists, _ := fsutils.Exists(fs, cnst.OEMBackupFile)
+		Expect(exists).To(BeTrue())
+
+		Expect(fs.RemoveAll("/oem/identity")).To(Succeed())
+		Expect(fs.WriteFile("/oem/90_custom.yaml", []byte("changed"), os.ModePerm)).To(Succeed())
+		Expect(fs.WriteFile("/oem/new.yaml", []byte("new"), os.ModePerm)).To(Succeed())
+
+		Expect(OEMRestore(config, "", "")).To(Succeed())
+		data, err := fs.ReadFile("/oem/90_custom.yaml")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("#cloud-config\nhostname: node-1\n"))
+		info, err := fs.Stat("/oem/identity/machine.key")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		exists, _ = fsutils.Exists(fs, "/oem/new.yaml")
+		Expect(exists).To(BeFalse())
+	})
+	It("encrypts the backup with the given key", func() {
+		Expect(OEMBackup(config, "/backup.tar.gz", "/etc/oem-backup.key")).To(Succeed())
+		data, err := fs.ReadFile("/backup.tar.gz")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bytes.Contains(data, []byte("hostname: node-1"))).To(BeFalse())
+		// Every backup derives its key with a new random salt
+		Expect(OEMBackup(config, "/backup-2.tar.gz", "/etc/oem-backup.key")).To(Succeed())
+		other, err := fs.ReadFile("/backup-2.tar.gz")
+		Expect(err).ToNot(HaveOccurred())
+		header := len("KAIROS-OEM-SCRYPT-AES256GCM\n") + 16
+		Expect(other[:header]).ToNot(Equal(data[:header]))
+
+		Expect(OEMRestore(config, "/backup.tar.gz", "")).ToNot(Succeed())
+		Expect(fs.WriteFile("/wrong.key", []byte("wrong"), os.ModePerm)).To(Succeed())
+		Expect(OEMRestore(config, "/backup.tar.gz", "/wrong.key")).ToNot(Succeed())
+		exists, _ := fsutils.Exists(fs, "/oem/90_custom.yaml")
+		Expect(exists).To(BeTrue())
+
+		Expect(fs.RemoveAll("/oem/90_custom.yaml")).To(Succeed())
+		Expect(OEMRestore(config, "/backup.tar.gz", "/etc/oem-backup.key")).To(Succeed())
+		exists, _ = fsutils.Exists(fs, "/oem/90_custom.yaml")
+		Expect(exists).To(BeTrue())
+	})
+})
@@ -0,0 +1,202 @@
+package action
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils/partitions"
+	"github.com/kairos-io/kairos-sdk/state"
+	sdkutils "github.com/kairos-io/kairos-sdk/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// PinState is the content of the pin file, it describes the boot entry the system is pinned to
+type PinState struct {
+	Entry   string `yaml:"entry"`
+	Version string `yaml:"version,omitempty"`
+	Date    string `yaml:"date"`
+	// Counter is the boot counting suffix of the systemd-boot entry before pinning, i.e. `+2-1`, restored on unpin
+	Counter string `yaml:"counter,omitempty"`
+}
+
+// ReadPin returns the current pin state from the given pin file, or nil if the system is not pinned
+func ReadPin(fs v1.FS, path string) (*PinState, error) {
+	if exists, _ := fsutils.Exists(fs, path); !exists {
+		return nil, nil
+	}
+	data, err := fs.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pin := &PinState{}
+	err = yaml.Unmarshal(data, pin)
+	if err != nil {
+		return nil, fmt.Errorf("parsing pin file %s: %w", path, err)
+	}
+	return pin, nil
+}
+
+// Pin marks the currently booted image as known good. Upgrades are skipped while the system is pinned
+// and on trusted boot systems the boot entry is set as default and excluded from boot assessment.
+// This is the entrypoint for the pin command
+func Pin(cfg *config.Config) error {
+	bootedFrom, err := state.DetectBootWithVFS(cfg.Fs)
+	if err != nil {
+		return fmt.Errorf("detecting current boot: %w", err)
+	}
+	// entry is the systemd-boot conf name while bootEntry is the name shown to the user
+	var entry, bootEntry string
+	switch bootedFrom {
+	case state.Active:
+		entry, bootEntry = "active", "cos"
+	case state.Passive:
+		entry, bootEntry = "passive", "fallback"
+	default:
+		return fmt.Errorf("only active and passive boot entries can be pinned, currently booted from %s", bootedFrom)
+	}
+
+	previous, err := ReadPin(cfg.Fs, cnst.PinFile)
+	if err != nil {
+		return err
+	}
+
+	pin := PinState{Entry: entry, Date: time.Now().UTC().Format(time.RFC3339)}
+	if utils.IsUkiWithFs(cfg.Fs) {
+		switch {
+		case previous != nil && previous.Entry == entry:
+			// Pinning again, the entry has no counter left to save
+			pin.Counter = previous.Counter
+		case previous != nil:
+			if err = restoreSystemdEntryCounter(cfg, previous.Entry, previous.Counter); err != nil {
+				return err
+			}
+		}
+		counter, err := markSystemdEntryGood(cfg, entry)
+		if err != nil {
+			return err
+		}
+		if counter != "" {
+			pin.Counter = counter
+		}
+		err = SelectBootEntry(cfg, bootEntry)
+		if err != nil {
+			return err
+		}
+	}
+
+	pin.Version, _ = sdkutils.OSRelease("VERSION")
+	data, err := yaml.Marshal(pin)
+	if err != nil {
+		return err
+	}
+	if err = fsutils.MkdirAll(cfg.Fs, filepath.Dir(cnst.PinFile), cnst.DirPerm); err != nil {
+		return err
+	}
+	err = fsutils.AtomicWriteFile(cfg.Fs, cnst.PinFile, data, cnst.ConfigPerm)
+	if err != nil {
+		return fmt.Errorf("writing pin file: %w", err)
+	}
+	cfg.Logger.Infof("System pinned to the %s boot entry", entry)
+	return nil
+}
+
+// Unpin removes the pin from the system so upgrades are applied again, restoring the boot counter of the pinned entry
+// This is the entrypoint for the unpin command
+func Unpin(cfg *config.Config) error {
+	pin, err := ReadPin(cfg.Fs, cnst.PinFile)
+	if err != nil {
+		return err
+	}
+	if pin == nil {
+		cfg.Logger.Infof("System is not pinned")
+		return nil
+	}
+	if utils.IsUkiWithFs(cfg.Fs) {
+		if err = restoreSystemdEntryCounter(cfg, pin.Entry, pin.Counter); err != nil {
+			return err
+		}
+	}
+	err = cfg.Fs.Remove(cnst.PinFile)
+	if err != nil {
+		return fmt.Errorf("removing pin file: %w", err)
+	}
+	cfg.Logger.Infof("System unpinned from the %s boot entry", pin.Entry)
+	return nil
+}
+
+// markSystemdEntryGood removes the boot counting from the given systemd-boot entry files, so systemd-boot
+// treats them as good and never falls back to other entries. It returns the counter that was removed, if any.
+func markSystemdEntryGood(cfg *config.Config, entry string) (string, error) {
+	efiPartition, err := partitions.GetEfiPartition(&cfg.Logger)
+	if err != nil {
+		return "", err
+	}
+	files, err := fsutils.GlobFs(cfg.Fs, filepath.Join(efiPartition.MountPoint, "loader/entries", entry+"+*.conf"))
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", nil
+	}
+	counter := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(files[0]), entry), ".conf")
+
+	err = renameSystemdEntry(cfg, efiPartition.MountPoint, files[0], entry+".conf")
+	if err != nil {
+		return "", err
+	}
+	return counter, nil
+}
+
+// restoreSystemdEntryCounter puts back the boot counting removed from the given systemd-boot entry when pinning it
+func restoreSystemdEntryCounter(cfg *config.Config, entry, counter string) error {
+	if counter == "" {
+		return nil
+	}
+	efiPartition, err := partitions.GetEfiPartition(&cfg.Logger)
+	if err != nil {
+		return err
+	}
+	good := filepath.Join(efiPartition.MountPoint, "loader/entries", entry+".conf")
+	if exists, _ := fsutils.Exists(cfg.Fs, good); !exists {
+		cfg.Logger.Warnf("The %s boot entry is gone, not restoring its boot counter", entry)
+		return nil
+	}
+	cfg.Logger.Debugf("Restoring the boot counter %s of %s", counter, good)
+	return renameSystemdEntry(cfg, efiPartition.MountPoint, good, entry+counter+".conf")
+}
+
+// renameSystemdEntry renames a systemd-boot entry file, updating the loader default if it points to it
+func renameSystemdEntry(cfg *config.Config, efiDir, file, name string) error {
+	// Mount it RW
+	err := cfg.Syscall.Mount("", efiDir, "", syscall.MS_REMOUNT, "")
+	if err != nil {
+		cfg.Logger.Errorf("could not remount EFI partition: %s", err)
+		return err
+	}
+	// Remount it RO when finished
+	defer func() {
+		if err := cfg.Syscall.Mount("", efiDir, "", syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			cfg.Logger.Errorf("could not remount EFI partition as RO: %s", err)
+		}
+	}()
+
+	if err = cfg.Fs.Rename(file, filepath.Join(filepath.Dir(file), name)); err != nil {
+		return err
+	}
+	// Point the loader default to the renamed file
+	loaderConf := filepath.Join(efiDir, "loader/loader.conf")
+	systemdConf, err := utils.SystemdBootConfReader(cfg.Fs, loaderConf)
+	if err == nil && systemdConf["default"] == filepath.Base(file) {
+		systemdConf["default"] = name
+		return utils.SystemdBootConfWriter(cfg.Fs, loaderConf, systemdConf)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package action
+
+import (
+	"bytes"
+	"os"
+
+	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	ghwMock "github.com/kairos-io/kairos-sdk/ghw/mocks"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/console"
+	"github.com/mudler/yip/pkg/executor"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v5"
+	"github.com/twpayne/go-vfs/v5/vfst"
+)
+
+var _ = Describe("Pin tests", Label("pin"), func() {
+	var config *agentConfig.Config
+	var fs vfs.FS
+	var cleanup func()
+	var ghwTest ghwMock.GhwMock
+
+	BeforeEach(func() {
+		var err error
+		logger := sdkTypes.NewBufferLogger(&bytes.Buffer{})
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{})
+		Expect(err).Should(BeNil())
+		Expect(fsutils.MkdirAll(fs, "/efi/loader/entries", os.ModeDir|os.ModePerm)).To(Succeed())
+		Expect(fsutils.MkdirAll(fs, "/oem", os.ModeDir|os.ModePerm)).To(Succeed())
+		Expect(fsutils.MkdirAll(fs, "/proc", os.ModeDir|os.ModePerm)).To(Succeed())
+
+		config = agentConfig.NewConfig(
+			agentConfig.WithFs(fs),
+			agentConfig.WithRunner(v1mock.NewFakeRunner()),
+			agentConfig.WithLogger(logger),
+			agentConfig.WithMounter(v1mock.NewErrorMounter()),
+			agentConfig.WithSyscall(&v1mock.FakeSyscall{}),
+		)
+
+		ghwTest = ghwMock.GhwMock{}
+		ghwTest.AddDisk(sdkTypes.Disk{
+			Name: "device",
+			Partitions: []*sdkTypes.Partition{
+				{
+					Name:            "device1",
+					FilesystemLabel: "COS_GRUB",
+					FS:              "ext4",
+					MountPoint:      "/efi",
+				},
+			},
+		})
+		ghwTest.CreateDevices()
+	})
+
+	AfterEach(func() {
+		ghwTest.Clean()
+		cleanup()
+	})
+
+	It("pins the active entry and removes its boot assessment under uki", func() {
+		Expect(fs.WriteFile("/proc/cmdline", []byte("rd.immucore.uki root=LABEL=COS_ACTIVE"), os.ModePerm)).To(Succeed())
+		Expect(fs.WriteFile("/efi/loader/loader.conf", []byte("default active+2-1.conf\n"), os.ModePerm)).To(Succeed())
+		Expect(fs.WriteFile("/efi/loader/entries/active+2-1.conf", []byte("title kairos\nefi /EFI/kairos/active.efi\n"), os.ModePerm)).To(Succeed())
+		Expect(fs.WriteFile("/efi/loader/entries/passive+3.conf", []byte("title kairos (fallback)\nefi /EFI/kairos/passive.efi\n"), os.ModePerm)).To(Succeed())
+
+		Expect(Pin(config)).To(Succeed())
+
+		exists, _ := fsutils.Exists(fs, "/efi/loader/entries/active.conf")
+		Expect(exists).To(BeTrue())
+		exists, _ = fsutils.Exists(fs, "/efi/loader/entries/passive+3.conf")
+		Expect(exists).To(BeTrue())
+		loader, err := utils.SystemdBootConfReader(fs, "/efi/loader/loader.conf")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(loader["default"]).To(Equal("active.conf"))
+
+		pin, err := ReadPin(fs, cnst.PinFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pin).ToNot(BeNil())
+		Expect(pin.Entry).To(Equal("active"))
+		// The pin does not stop the OEM cloud-configs from loading on boot
+		_, err = executor.NewExecutor().Graph("boot", fs, console.NewStandardConsole(), "/oem")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(Unpin(config)).To(Succeed())
+		pin, err = ReadPin(fs, cnst.PinFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pin).To(BeNil())
+	})
+	It("restores the boot counter of the entry on unpin", func() {
+		Expect(fs.WriteFile("/proc/cmdline", []byte("rd.immucore.uki root=LABEL=COS_ACTIVE"), os.ModePerm)).To(Succeed())
+		Expect(fs.WriteFile("/efi/loader/loader.conf", []byte("default active+2-1.conf\n"), os.ModePerm)).To(Succeed())
+		Expect(fs.WriteFile("/efi/loader/entries/active+2-1.conf", []byte("title kairos\nefi /EFI/kairos/active.efi\n"), os.ModePerm)).To(Succeed())
+
+		Expect(Pin(config)).To(Succeed())
+		pin, err := ReadPin(fs, cnst.PinFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pin.Counter).To(Equal("+2-1"))
+		// Pinning again keeps the saved counter
+		Expect(Pin(config)).To(Succeed())
+		pin, err = ReadPin(fs, cnst.PinFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pin.Counter).To(Equal("+2-1"))
+
+		Expect(Unpin(config)).To(Succeed())
+		exists, _ := fsutils.Exists(fs, "/efi/loader/entries/active+2-1.conf")
+		Expect(exists).To(BeTrue())
+		exists, _ = fsutils.Exists(fs, "/efi/loader/entries/active.conf")
+		Expect(exists).To(BeFalse())
+		loader, err := utils.SystemdBootConfReader(fs, "/efi/loader/loader.conf")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(loader["default"]).To(Equal("active+2-1.conf"))
+	})
+	It("refuses to pin the recovery entry", func() {
+		Expect(fs.WriteFile("/proc/cmdline", []byte("root=LABEL=COS_RECOVERY"), os.ModePerm)).To(Succeed())
+		Expect(Pin(config)).ToNot(Succeed())
+		pin, err := ReadPin(fs, cnst.PinFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pin).To(BeNil())
+	})
+})
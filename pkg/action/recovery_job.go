@@ -0,0 +1,167 @@
+package action
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	"gopkg.in/yaml.v3"
+)
+
+// Recovery job statuses
+const (
+	RecoveryJobPending = "pending"
+	RecoveryJobRunning = "running"
+	RecoveryJobFailed  = "failed"
+	RecoveryJobDone    = "done"
+)
+
+// RecoveryJobMaxAttempts is the number of times a deferred recovery rebuild is tried before giving up
+const RecoveryJobMaxAttempts = 3
+
+// recoveryJobStage runs the deferred recovery rebuild in the background on every boot until it's done, niced so
+// it does not compete with the workloads. The job throttles its own disk IO.
+const recoveryJobStage = `name: "Deferred recovery rebuild"
+stages:
+  network:
+    - name: "Rebuild the recovery image in the background"
+      commands:
+        - |
+          if [ -d /run/systemd/system ]; then
+            systemd-run --unit=kairos-recovery-job --collect -p Nice=19 kairos-agent upgrade recovery-job
+          else
+            nohup nice -n 19 kairos-agent upgrade recovery-job >/dev/null 2>&1 &
+          fi
+`
+
+// RecoveryJob is a recovery image rebuild deferred to run in the background after a reboot. It's persisted so it
+// survives restarts: an interrupted job is resumed on the next boot.
+type RecoveryJob struct {
+	Source    string     `yaml:"source" json:"source"`
+	Status    string     `yaml:"status" json:"status"`
+	Scheduled time.Time  `yaml:"scheduled" json:"scheduled"`
+	Started   *time.Time `yaml:"started,omitempty" json:"started,omitempty"`
+	Finished  *time.Time `yaml:"finished,omitempty" json:"finished,omitempty"`
+	Attempts  int        `yaml:"attempts" json:"attempts"`
+	PID       int        `yaml:"pid,omitempty" json:"pid,omitempty"`
+	Error     string     `yaml:"error,omitempty" json:"error,omitempty"`
+}
+
+// ScheduleRecoveryJob defers the recovery upgrade from source to a background job run after the next reboot,
+// replacing any job scheduled before
+func ScheduleRecoveryJob(cfg *config.Config, source *v1.ImageSource) error {
+	job := &RecoveryJob{Source: source.String(), Status: RecoveryJobPending, Scheduled: time.Now()}
+	if err := writeRecoveryJob(cfg, job); err != nil {
+		return fmt.Errorf("writing the recovery job: %w", err)
+	}
+	if err := fsutils.MkdirAll(cfg.Fs, filepath.Dir(cnst.RecoveryJobStageFile), cnst.DirPerm); err != nil {
+		return err
+	}
+	if err := fsutils.AtomicWriteFile(cfg.Fs, cnst.RecoveryJobStageFile, []byte(recoveryJobStage), cnst.ConfigPerm); err != nil {
+		return fmt.Errorf("writing the recovery job stage: %w", err)
+	}
+	cfg.Logger.Infof("Recovery upgrade from %s deferred to the next boot", job.Source)
+	return nil
+}
+
+// ReadRecoveryJob returns the deferred recovery rebuild, or nil if there is none
+func ReadRecoveryJob(fs v1.FS) (*RecoveryJob, error) {
+	if exists, _ := fsutils.Exists(fs, cnst.RecoveryJobFile); !exists {
+		return nil, nil
+	}
+	data, err := fs.ReadFile(cnst.RecoveryJobFile)
+	if err != nil {
+		return nil, err
+	}
+	job := &RecoveryJob{}
+	if err = yaml.Unmarshal(data, job); err != nil {
+		return nil, fmt.Errorf("parsing recovery job file %s: %w", cnst.RecoveryJobFile, err)
+	}
+	return job, nil
+}
+
+// RunRecoveryJob runs the deferred recovery rebuild, if any, with the given upgrade function. Jobs left running by
+// an interrupted run are resumed, failed ones are retried up to RecoveryJobMaxAttempts. This is the entrypoint for
+// the upgrade recovery-job command.
+func RunRecoveryJob(cfg *config.Config, upgrade func(source string) error) error {
+	job, err := ReadRecoveryJob(cfg.Fs)
+	if err != nil {
+		return err
+	}
+	if job == nil || job.Status == RecoveryJobDone || job.Status == RecoveryJobFailed {
+		cfg.Logger.Debugf("No recovery job to run")
+		return nil
+	}
+	if job.Status == RecoveryJobRunning {
+		if job.PID != 0 && recoveryJobRunning(cfg.Fs, job.PID) {
+			cfg.Logger.Infof("Recovery job already running with pid %d", job.PID)
+			return nil
+		}
+		cfg.Logger.Infof("Resuming the interrupted recovery job from %s", job.Source)
+	}
+
+	now := time.Now()
+	job.Status = RecoveryJobRunning
+	job.Started = &now
+	job.Finished = nil
+	job.Attempts++
+	job.PID = os.Getpid()
+	if err = writeRecoveryJob(cfg, job); err != nil {
+		return err
+	}
+
+	upgradeErr := upgrade(job.Source)
+	finished := time.Now()
+	job.Finished = &finished
+	job.PID = 0
+	switch {
+	case upgradeErr == nil:
+		job.Status = RecoveryJobDone
+		job.Error = ""
+	case job.Attempts < RecoveryJobMaxAttempts:
+		job.Status = RecoveryJobPending
+		job.Error = upgradeErr.Error()
+	default:
+		job.Status = RecoveryJobFailed
+		job.Error = upgradeErr.Error()
+	}
+	if err = writeRecoveryJob(cfg, job); err != nil {
+		return err
+	}
+
+	// Nothing left to run on the next boots
+	if job.Status == RecoveryJobDone || job.Status == RecoveryJobFailed {
+		if err = cfg.Fs.Remove(cnst.RecoveryJobStageFile); err != nil && !os.IsNotExist(err) {
+			cfg.Logger.Warnf("Could not remove the recovery job stage %s: %s", cnst.RecoveryJobStageFile, err)
+		}
+	}
+	if upgradeErr != nil {
+		return fmt.Errorf("recovery job attempt %d of %d failed: %w", job.Attempts, RecoveryJobMaxAttempts, upgradeErr)
+	}
+	cfg.Logger.Infof("Recovery job from %s done", job.Source)
+	return nil
+}
+
+func writeRecoveryJob(cfg *config.Config, job *RecoveryJob) error {
+	data, err := yaml.Marshal(job)
+	if err != nil {
+		return err
+	}
+	if err = fsutils.MkdirAll(cfg.Fs, filepath.Dir(cnst.RecoveryJobFile), cnst.DirPerm); err != nil {
+		return err
+	}
+	return fsutils.AtomicWriteFile(cfg.Fs, cnst.RecoveryJobFile, data, cnst.ConfigPerm)
+}
+
+// recoveryJobRunning checks if the process with the given pid is a recovery job, pids are reused across reboots
+func recoveryJobRunning(fs v1.FS, pid int) bool {
+	cmdline, err := fs.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	return err == nil && strings.Contains(string(cmdline), "recovery-job")
+}
@@ -0,0 +1,111 @@
+package action
+
+import (
+	"bytes"
+	"errors"
+	"os"
+
+	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v5"
+	"github.com/twpayne/go-vfs/v5/vfst"
+)
+
+var _ = Describe("Recovery job tests", Label("recovery-job"), func() {
+	var config *agentConfig.Config
+	var fs vfs.FS
+	var cleanup func()
+	var upgraded []string
+
+	upgrade := func(err error) func(string) error {
+		return func(source string) error {
+			upgraded = append(upgraded, source)
+			return err
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{"/oem/.keep": ""})
+		Expect(err).Should(BeNil())
+		config = agentConfig.NewConfig(
+			agentConfig.WithFs(fs),
+			agentConfig.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})),
+		)
+		upgraded = []string{}
+		Expect(ScheduleRecoveryJob(config, v1.NewDockerSrc("quay.io/kairos/ubuntu:v3.2.0"))).To(Succeed())
+	})
+
+	AfterEach(func() {
+		cleanup()
+	})
+
+	It("schedules the job to run in the background on boot", func() {
+		job, err := ReadRecoveryJob(fs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(job.Source).To(Equal("oci://quay.io/kairos/ubuntu:v3.2.0"))
+		Expect(job.Status).To(Equal(RecoveryJobPending))
+		stage, err := fs.ReadFile(cnst.RecoveryJobStageFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(stage)).To(ContainSubstring("kairos-agent upgrade recovery-job"))
+	})
+
+	It("runs the job once and stops running it on boot", func() {
+		Expect(RunRecoveryJob(config, upgrade(nil))).To(Succeed())
+		Expect(upgraded).To(Equal([]string{"oci://quay.io/kairos/ubuntu:v3.2.0"}))
+		job, err := ReadRecoveryJob(fs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(job.Status).To(Equal(RecoveryJobDone))
+		Expect(job.Attempts).To(Equal(1))
+		Expect(job.Finished).ToNot(BeNil())
+		_, err = fs.Stat(cnst.RecoveryJobStageFile)
+		Expect(err).To(MatchError(os.ErrNotExist))
+
+		Expect(RunRecoveryJob(config, upgrade(nil))).To(Succeed())
+		Expect(upgraded).To(HaveLen(1))
+	})
+
+	It("retries failed jobs up to the max attempts", func() {
+		for i := 1; i <= RecoveryJobMaxAttempts; i++ {
+			Expect(RunRecoveryJob(config, upgrade(errors.New("no space left")))).ToNot(Succeed())
+			job, err := ReadRecoveryJob(fs)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(job.Attempts).To(Equal(i))
+			Expect(job.Error).To(Equal("no space left"))
+		}
+		job, err := ReadRecoveryJob(fs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(job.Status).To(Equal(RecoveryJobFailed))
+		Expect(RunRecoveryJob(config, upgrade(nil))).To(Succeed())
+		Expect(upgraded).To(HaveLen(RecoveryJobMaxAttempts))
+	})
+
+	It("resumes interrupted jobs but not the running ones", func() {
+		job, err := ReadRecoveryJob(fs)
+		Expect(err).ToNot(HaveOccurred())
+		job.Status = RecoveryJobRunning
+		job.PID = 4242
+		job.Attempts = 1
+		Expect(writeRecoveryJob(config, job)).To(Succeed())
+
+		Expect(fsutils.MkdirAll(fs, "/proc/4242", os.ModePerm)).To(Succeed())
+		Expect(fs.WriteFile("/proc/4242/cmdline", []byte("kairos-agent\x00upgrade\x00recovery-job"), os.ModePerm)).To(Succeed())
+		Expect(RunRecoveryJob(config, upgrade(nil))).To(Succeed())
+		Expect(upgraded).To(BeEmpty())
+
+		// After a reboot the pid belongs to some other process
+		Expect(fs.WriteFile("/proc/4242/cmdline", []byte("sshd"), os.ModePerm)).To(Succeed())
+		Expect(RunRecoveryJob(config, upgrade(nil))).To(Succeed())
+		Expect(upgraded).To(HaveLen(1))
+		job, err = ReadRecoveryJob(fs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(job.Status).To(Equal(RecoveryJobDone))
+		Expect(job.Attempts).To(Equal(2))
+		Expect(job.PID).To(BeZero())
+	})
+})
@@ -2,6 +2,7 @@ package action
 
 import (
 	"bytes"
+	"fmt"
 	"os"
 	"text/template"
 
@@ -12,9 +13,7 @@ import (
 )
 
 func RenderTemplate(path string, config *config.Config, runtime state.Runtime) ([]byte, error) {
-	// Marshal runtime to YAML then to Map so that it is consistent with the output of 'kairos-agent state'
-	var runtimeMap map[string]interface{}
-	err := yaml.Unmarshal([]byte(runtime.String()), &runtimeMap)
+	runtimeMap, err := runtimeToMap(runtime)
 	if err != nil {
 		return nil, err
 	}
@@ -24,11 +23,46 @@ func RenderTemplate(path string, config *config.Config, runtime state.Runtime) (
 		return nil, err
 	}
 
-	result := new(bytes.Buffer)
-	err = tpl.Execute(result, map[string]interface{}{
+	return executeTemplate(tpl, map[string]interface{}{
 		"Config": config.Config.Values,
 		"State":  runtimeMap,
 	})
+}
+
+// RenderStateTemplate renders the given template text with the machine state as data, like
+// `kubectl -o go-template` does, e.g. '{{ .persistent.name }}'
+func RenderStateTemplate(text string, runtime fmt.Stringer) ([]byte, error) {
+	runtimeMap, err := runtimeToMap(runtime)
+	if err != nil {
+		return nil, err
+	}
+
+	tpl, err := template.New("state").Funcs(sprig.FuncMap()).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return executeTemplate(tpl, runtimeMap)
+}
+
+// RenderConfigTemplate renders the given template text with the machine config as data, e.g. '{{ .k3s.enabled }}'
+func RenderConfigTemplate(text string, config *config.Config) ([]byte, error) {
+	tpl, err := template.New("config").Funcs(sprig.FuncMap()).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return executeTemplate(tpl, config.Config.Values)
+}
+
+// runtimeToMap marshals runtime to YAML then to Map so that it is consistent with the output of 'kairos-agent state'
+func runtimeToMap(runtime fmt.Stringer) (map[string]interface{}, error) {
+	var runtimeMap map[string]interface{}
+	err := yaml.Unmarshal([]byte(runtime.String()), &runtimeMap)
+	return runtimeMap, err
+}
+
+func executeTemplate(tpl *template.Template, data interface{}) ([]byte, error) {
+	result := new(bytes.Buffer)
+	err := tpl.Execute(result, data)
 	if err != nil {
 		return nil, err
 	}
@@ -34,4 +34,26 @@ var _ = Describe("RenderTemplate action test", func() {
 		Expect(data["stateTest"]).To(Equal("amd64"))
 	})
 
+	It("renders template text with the state or the config as data", func() {
+		config := agentConfig.NewConfig()
+		config.Config = collector.Config{
+			Values: collector.ConfigValues{
+				"k3s": map[string]interface{}{"enabled": true},
+			},
+		}
+		runtime, err := state.NewRuntime()
+		Expect(err).ToNot(HaveOccurred())
+
+		result, err := RenderStateTemplate("{{ .system.os.name | default \"unknown\" }}-{{ .system.os.architecture }}", runtime)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(result)).To(HaveSuffix("-amd64"))
+
+		result, err = RenderConfigTemplate("{{ if .k3s.enabled }}k3s{{ end }}", config)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(result)).To(Equal("k3s"))
+
+		_, err = RenderConfigTemplate("{{ .k3s.enabled ", config)
+		Expect(err).To(HaveOccurred())
+	})
+
 })
@@ -0,0 +1,172 @@
+package action
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	"github.com/kairos-io/kairos-agent/v2/pkg/elemental"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+)
+
+// The repairs below are the guided actions of the recovery console, they run from the recovery system over the
+// partitions of the installed one.
+
+// RebuildBootloader reinstalls the bootloader on the disk of the state partition, with the bootloader files of the
+// active image. It repairs systems with a broken grub or EFI partition whose images are fine.
+func RebuildBootloader(cfg *config.Config) (err error) {
+	spec, err := config.NewResetSpec(cfg)
+	if err != nil {
+		return err
+	}
+	e := elemental.NewElemental(cfg)
+	cleanup := utils.NewCleanStack()
+	defer func() { err = cleanup.Cleanup(err) }()
+
+	umount, err := e.MountRWPartition(spec.Partitions.State)
+	if err != nil {
+		return err
+	}
+	cleanup.Push(umount)
+	if spec.Efi {
+		umount, err = e.MountRWPartition(spec.Partitions.EFI)
+		if err != nil {
+			return err
+		}
+		cleanup.Push(umount)
+	}
+	if ok, _ := fsutils.Exists(cfg.Fs, spec.Active.File); !ok {
+		return fmt.Errorf("active image %s not found, reset the system instead", spec.Active.File)
+	}
+	if err = e.MountImage(&spec.Active, "ro"); err != nil {
+		return err
+	}
+	cleanup.Push(func() error { return e.UnmountImage(&spec.Active) })
+
+	cfg.Logger.Infof("Reinstalling the bootloader on %s", spec.Target)
+	bootloader := utils.NewBootloader(cfg, v1.FirmwareForArch(cfg.Arch, spec.Efi))
+	return bootloader.Install(
+		spec.Target,
+		spec.Active.MountPoint,
+		spec.Partitions.State.MountPoint,
+		spec.GrubConf,
+		spec.Tty,
+		spec.Efi,
+		spec.Partitions.State.FilesystemLabel,
+	)
+}
+
+// RecoveryRestoreOEM restores the OEM backup in file over the OEM partition. Without a file the backup kept in
+// the persistent partition is restored, as the persistent partition is not mounted in recovery.
+func RecoveryRestoreOEM(cfg *config.Config, file, keyFile string) (err error) {
+	e := elemental.NewElemental(cfg)
+	cleanup := utils.NewCleanStack()
+	defer func() { err = cleanup.Cleanup(err) }()
+
+	if file == "" {
+		persistent := &sdkTypes.Partition{FilesystemLabel: cnst.PersistentLabel}
+		persistent.MountPoint, err = utils.NewTempDir(cfg, "persistent")
+		if err != nil {
+			return err
+		}
+		cleanup.Push(func() error { return fsutils.RemoveTempDir(cfg.Fs, persistent.MountPoint) })
+		if err = e.MountPartition(persistent, "ro"); err != nil {
+			return fmt.Errorf("mounting the persistent partition: %w", err)
+		}
+		cleanup.Push(func() error { return e.UnmountPartition(persistent) })
+		rel, _ := filepath.Rel(cnst.UsrLocalPath, cnst.OEMBackupFile)
+		file = filepath.Join(persistent.MountPoint, rel)
+	}
+
+	umount, err := e.MountRWPartition(&sdkTypes.Partition{FilesystemLabel: cnst.OEMLabel, MountPoint: cnst.OEMPath})
+	if err != nil {
+		return err
+	}
+	cleanup.Push(umount)
+	return OEMRestore(cfg, file, keyFile)
+}
+
+// LogsDevice is a partition of a removable USB drive the logs can be collected to
+type LogsDevice struct {
+	Path  string `json:"name"`
+	Label string `json:"label"`
+	FS    string `json:"fstype"`
+	Size  string `json:"size"`
+}
+
+func (d LogsDevice) String() string {
+	if d.Label != "" {
+		return fmt.Sprintf("%s (%s, %s, %s)", d.Path, d.Label, d.FS, d.Size)
+	}
+	return fmt.Sprintf("%s (%s, %s)", d.Path, d.FS, d.Size)
+}
+
+// lsblkDevice is a block device in the lsblk JSON output, with its partitions as children
+type lsblkDevice struct {
+	LogsDevice
+	Tran     string        `json:"tran"`
+	Children []lsblkDevice `json:"children"`
+}
+
+// USBLogsDevices returns the partitions with a filesystem of the USB drives, or the drives themselves if they are
+// formatted without a partition table
+func USBLogsDevices(cfg *config.Config) ([]LogsDevice, error) {
+	out, err := cfg.Runner.Run("lsblk", "-p", "-J", "-o", "NAME,TRAN,FSTYPE,LABEL,SIZE")
+	if err != nil {
+		return nil, fmt.Errorf("listing the block devices: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+	var devices struct {
+		BlockDevices []lsblkDevice `json:"blockdevices"`
+	}
+	if err = json.Unmarshal(out, &devices); err != nil {
+		return nil, fmt.Errorf("parsing the block devices: %w", err)
+	}
+	var result []LogsDevice
+	for _, disk := range devices.BlockDevices {
+		if disk.Tran != "usb" {
+			continue
+		}
+		if disk.FS != "" {
+			result = append(result, disk.LogsDevice)
+		}
+		for _, part := range disk.Children {
+			if part.FS != "" {
+				result = append(result, part.LogsDevice)
+			}
+		}
+	}
+	return result, nil
+}
+
+// CollectLogsToDevice mounts the device and collects the logs bundle into it, returning the bundle name in it
+func CollectLogsToDevice(cfg *config.Config, device string) (bundle string, err error) {
+	cleanup := utils.NewCleanStack()
+	defer func() { err = cleanup.Cleanup(err) }()
+
+	dir, err := utils.NewTempDir(cfg, "usb")
+	if err != nil {
+		return "", err
+	}
+	cleanup.Push(func() error { return fsutils.RemoveTempDir(cfg.Fs, dir) })
+	if err = cfg.Mounter.Mount(device, dir, "auto", []string{"rw"}); err != nil {
+		return "", fmt.Errorf("mounting %s: %w", device, err)
+	}
+	cleanup.Push(func() error { return cfg.Mounter.Unmount(dir) })
+
+	hostname, _ := os.Hostname()
+	bundle = fmt.Sprintf("kairos-logs-%s-%s.tar.gz", hostname, time.Now().Format("20060102-150405"))
+	if err = CollectLogs(cfg, filepath.Join(dir, bundle)); err != nil {
+		return "", err
+	}
+	// Flush the bundle before unmounting, the drive is likely to be unplugged right after
+	_, _ = cfg.Runner.Run("sync")
+	return bundle, nil
+}
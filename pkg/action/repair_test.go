@@ -0,0 +1,106 @@
+package action
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+
+	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v5"
+	"github.com/twpayne/go-vfs/v5/vfst"
+)
+
+var _ = Describe("Repair tests", Label("repair"), func() {
+	var config *agentConfig.Config
+	var runner *v1mock.FakeRunner
+	var mounter *v1mock.ErrorMounter
+	var fs vfs.FS
+	var cleanup func()
+	var lsblk string
+
+	BeforeEach(func() {
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{
+			"/var/log/kairos/agent-provider.log": "provider log",
+		})
+		Expect(err).Should(BeNil())
+		lsblk = `{"blockdevices": [
+			{"name": "/dev/sda", "tran": "sata", "fstype": null, "label": null, "size": "100G", "children": [
+				{"name": "/dev/sda1", "tran": null, "fstype": "ext4", "label": "COS_STATE", "size": "8G"}
+			]},
+			{"name": "/dev/sdb", "tran": "usb", "fstype": null, "label": null, "size": "16G", "children": [
+				{"name": "/dev/sdb1", "tran": null, "fstype": "vfat", "label": "LOGS", "size": "16G"},
+				{"name": "/dev/sdb2", "tran": null, "fstype": null, "label": null, "size": "1M"}
+			]},
+			{"name": "/dev/sdc", "tran": "usb", "fstype": "exfat", "label": null, "size": "32G"}
+		]}`
+		runner = v1mock.NewFakeRunner()
+		runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+			if cmd == "lsblk" {
+				return []byte(lsblk), nil
+			}
+			return []byte{}, nil
+		}
+		mounter = v1mock.NewErrorMounter()
+		config = agentConfig.NewConfig(
+			agentConfig.WithFs(fs),
+			agentConfig.WithRunner(runner),
+			agentConfig.WithMounter(mounter),
+			agentConfig.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})),
+		)
+	})
+
+	AfterEach(func() {
+		cleanup()
+	})
+
+	It("lists the partitions of the USB drives with a filesystem", func() {
+		devices, err := USBLogsDevices(config)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(devices).To(Equal([]LogsDevice{
+			{Path: "/dev/sdb1", Label: "LOGS", FS: "vfat", Size: "16G"},
+			{Path: "/dev/sdc", FS: "exfat", Size: "32G"},
+		}))
+		Expect(devices[0].String()).To(Equal("/dev/sdb1 (LOGS, vfat, 16G)"))
+	})
+
+	It("fails on an unparseable lsblk output", func() {
+		lsblk = "not json"
+		_, err := USBLogsDevices(config)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("collects the logs into the device and unmounts it", func() {
+		var dir string
+		runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+			if cmd == "sync" {
+				mounts, _ := mounter.List()
+				Expect(mounts).To(HaveLen(1))
+				Expect(mounts[0].Device).To(Equal("/dev/sdb1"))
+				dir = mounts[0].Path
+			}
+			return []byte{}, nil
+		}
+		bundle, err := CollectLogsToDevice(config, "/dev/sdb1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(strings.HasPrefix(bundle, "kairos-logs-")).To(BeTrue())
+		Expect(strings.HasSuffix(bundle, ".tar.gz")).To(BeTrue())
+		Expect(runner.IncludesCmds([][]string{{"sync"}})).To(Succeed())
+		// The bundle is written in the mount point, which is removed once the device is unmounted
+		mounts, _ := mounter.List()
+		Expect(mounts).To(BeEmpty())
+		_, err = fs.Stat(filepath.Join(dir, bundle))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("fails if the device can not be mounted", func() {
+		mounter.ErrorOnMount = true
+		_, err := CollectLogsToDevice(config, "/dev/sdb1")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("mounting /dev/sdb1"))
+	})
+})
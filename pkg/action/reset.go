@@ -17,6 +17,7 @@ limitations under the License.
 package action
 
 import (
+	"context"
 	"fmt"
 	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
 	"path/filepath"
@@ -110,9 +111,22 @@ func (r *ResetAction) updateInstallState(e *elemental.Elemental, cleanup *utils.
 // ResetRun will reset the cos system to by following several steps
 func (r ResetAction) Run() (err error) {
 	e := elemental.NewElemental(r.cfg)
+	e.SetDownloadTimeout(r.spec.Timeouts.Download)
+	deadline := utils.NewDeadline(r.spec.Timeouts.Total)
+	progress := utils.NewProgress(r.cfg, "reset")
+	defer func() { progress.Done(err) }()
 	cleanup := utils.NewCleanStack()
 	defer func() { err = cleanup.Cleanup(err) }()
 
+	// Read the OEM backup before any partition is formatted, it might be stored in one of them
+	var oemBackup []byte
+	if r.spec.RestoreOEMBackup != "" {
+		oemBackup, err = r.readOEMBackup()
+		if err != nil {
+			return err
+		}
+	}
+
 	// Reformat state partition
 	// We should expose this under a flag, to reformat state before starting
 	// In case state fs is broken somehow
@@ -140,6 +154,7 @@ func (r ResetAction) Run() (err error) {
 		}
 	*/
 
+	progress.Phase("format", 5, "Formatting the partitions")
 	// Reformat persistent partition
 	if r.spec.FormatPersistent {
 		persistent := r.spec.Partitions.Persistent
@@ -148,7 +163,7 @@ func (r ResetAction) Run() (err error) {
 			if err != nil {
 				return err
 			}
-			err = e.FormatPartition(persistent)
+			err = e.FormatTunedPartition(persistent, r.spec.PartitionTuning[cnst.PersistentPartName])
 			if err != nil {
 				return err
 			}
@@ -164,7 +179,7 @@ func (r ResetAction) Run() (err error) {
 			if err != nil {
 				return err
 			}
-			err = e.FormatPartition(oem)
+			err = e.FormatTunedPartition(oem, r.spec.PartitionTuning[cnst.OEMPartName])
 			if err != nil {
 				return err
 			}
@@ -176,8 +191,28 @@ func (r ResetAction) Run() (err error) {
 		}
 	}
 
+	if oemBackup != nil {
+		oem := r.spec.Partitions.OEM
+		if oem == nil {
+			return fmt.Errorf("no OEM partition found to restore the OEM backup to")
+		}
+		if mnt, _ := utils.IsMounted(r.cfg, oem); !mnt {
+			err = e.MountPartition(oem)
+			if err != nil {
+				return err
+			}
+		}
+		meta, err := utils.RestoreOEM(r.cfg, oemBackup, oem.MountPoint)
+		if err != nil {
+			return fmt.Errorf("restoring OEM backup %s: %w", r.spec.RestoreOEMBackup, err)
+		}
+		r.cfg.Logger.Infof("Restored OEM backup from %s, taken on %s (%d files)", r.spec.RestoreOEMBackup, meta.Created, meta.Files)
+	}
+
 	// Before reset hook happens once partitions are aready and before deploying the OS image
-	err = r.resetHook(cnst.BeforeResetHook, false)
+	err = deadline.Run(cnst.BeforeResetHook, 0, func(context.Context) error {
+		return r.resetHook(cnst.BeforeResetHook, false)
+	})
 	if err != nil {
 		return err
 	}
@@ -188,9 +223,19 @@ func (r ResetAction) Run() (err error) {
 		return err
 	}
 	cleanup.Push(func() error { return e.UnmountPartition(r.spec.Partitions.State) })
+	var meta interface{}
+	history := newHistoryEntry("reset")
+	cleanup.Push(func() error {
+		history.record(r.cfg, r.spec.Partitions.State.MountPoint, r.spec.Active.Source, meta, err)
+		return nil
+	})
 
 	// Deploy active image
-	meta, err := e.DeployImage(&r.spec.Active, true)
+	progress.Phase("deploy-active", 20, fmt.Sprintf("Deploying %s", r.spec.Active.Source.Value()))
+	err = deadline.Run(fmt.Sprintf("deploying %s", r.spec.Active.Source.Value()), r.spec.Timeouts.Deploy, func(ctx context.Context) (err error) {
+		meta, err = e.WithContext(ctx).DeployImage(&r.spec.Active, true)
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -209,9 +254,10 @@ func (r ResetAction) Run() (err error) {
 	}
 	//TODO: does bios needs to be mounted here?
 
-	// install grub
-	grub := utils.NewGrub(r.cfg)
-	err = grub.Install(
+	// install the bootloader, grub unless the arch boots without it
+	progress.Phase("bootloader", 50, "Installing the bootloader")
+	bootloader := utils.NewBootloader(r.cfg, v1.FirmwareForArch(r.cfg.Arch, r.spec.Efi))
+	err = bootloader.Install(
 		r.spec.Target,
 		r.spec.Active.MountPoint,
 		r.spec.Partitions.State.MountPoint,
@@ -234,15 +280,19 @@ func (r ResetAction) Run() (err error) {
 	if mnt, _ := utils.IsMounted(r.cfg, r.spec.Partitions.OEM); mnt {
 		binds[r.spec.Partitions.OEM.MountPoint] = cnst.OEMPath
 	}
-	err = utils.ChrootedCallback(
-		r.cfg, r.spec.Active.MountPoint, binds,
-		func() error { return e.SelinuxRelabel("/", true) },
-	)
+	err = deadline.Run("selinux relabel", 0, func(context.Context) error {
+		return utils.ChrootedCallback(
+			r.cfg, r.spec.Active.MountPoint, binds,
+			func() error { return e.SelinuxRelabel("/", true) },
+		)
+	})
 	if err != nil {
 		return err
 	}
 
-	err = r.resetHook(cnst.AfterResetChrootHook, true)
+	err = deadline.Run(cnst.AfterResetChrootHook, 0, func(context.Context) error {
+		return r.resetHook(cnst.AfterResetChrootHook, true)
+	})
 	if err != nil {
 		return err
 	}
@@ -262,14 +312,24 @@ func (r ResetAction) Run() (err error) {
 	if err != nil {
 		return err
 	}
+	if err = e.SyncImage(&r.spec.Active); err != nil {
+		return err
+	}
 
 	// Install Passive
-	_, err = e.DeployImage(&r.spec.Passive, false)
+	progress.Phase("deploy-passive", 75, "Deploying the passive image")
+	err = deadline.Run("deploying passive", r.spec.Timeouts.Deploy, func(ctx context.Context) error {
+		_, err := e.WithContext(ctx).DeployImage(&r.spec.Passive, false)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
-	err = r.resetHook(cnst.AfterResetHook, false)
+	progress.Phase("finalize", 90, "Running the after reset hooks")
+	err = deadline.Run(cnst.AfterResetHook, 0, func(context.Context) error {
+		return r.resetHook(cnst.AfterResetHook, false)
+	})
 	if err != nil {
 		return err
 	}
@@ -287,3 +347,16 @@ func (r ResetAction) Run() (err error) {
 
 	return err
 }
+
+// readOEMBackup reads the OEM backup to restore and its encryption key, if any
+func (r ResetAction) readOEMBackup() ([]byte, error) {
+	key, err := readOEMBackupKey(r.cfg, r.spec.OEMBackupKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := utils.ReadOEMBackup(r.cfg, r.spec.RestoreOEMBackup, key)
+	if err != nil {
+		return nil, fmt.Errorf("reading OEM backup %s: %w", r.spec.RestoreOEMBackup, err)
+	}
+	return data, nil
+}
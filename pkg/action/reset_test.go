@@ -24,6 +24,7 @@ import (
 	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
 	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils"
 	"github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
 	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
 	ghwMock "github.com/kairos-io/kairos-sdk/ghw/mocks"
@@ -188,6 +189,24 @@ var _ = Describe("Reset action tests", func() {
 				spec.FormatOEM = true
 				Expect(reset.Run()).To(BeNil())
 			})
+			It("Successfully resets restoring an OEM backup", func() {
+				Expect(fsutils.MkdirAll(fs, "/backup-src", constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile("/backup-src/90_custom.yaml", []byte("#cloud-config\n"), constants.FilePerm)).To(Succeed())
+				_, err := utils.BackupOEM(config, "/backup-src", "/oem-backup.tar.gz", nil)
+				Expect(err).ToNot(HaveOccurred())
+
+				spec.FormatOEM = true
+				spec.RestoreOEMBackup = "/oem-backup.tar.gz"
+				Expect(reset.Run()).To(BeNil())
+				exists, _ := fsutils.Exists(fs, filepath.Join(spec.Partitions.OEM.MountPoint, "90_custom.yaml"))
+				Expect(exists).To(BeTrue())
+			})
+			It("Fails before formatting anything if the OEM backup cannot be read", func() {
+				spec.FormatOEM = true
+				spec.RestoreOEMBackup = "/missing-backup.tar.gz"
+				Expect(reset.Run()).NotTo(BeNil())
+				Expect(runner.IncludesCmds([][]string{{"mkfs.ext4"}})).NotTo(BeNil())
+			})
 			It("Successfully resets from a squashfs recovery image", Label("channel"), func() {
 				err := fsutils.MkdirAll(config.Fs, constants.IsoBaseTree, constants.DirPerm)
 				Expect(err).ShouldNot(HaveOccurred())
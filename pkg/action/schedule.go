@@ -0,0 +1,286 @@
+package action
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	yip "github.com/mudler/yip/pkg/schema"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	systemdUnitDir = "/etc/systemd/system"
+	// scheduleUnitPrefix prefixes the units of the scheduled tasks, so they are told apart from the hand-written ones
+	scheduleUnitPrefix = "kairos-schedule-"
+	// ScheduledLogsBundle is where the scheduled logs task leaves the support bundle
+	ScheduledLogsBundle = "/var/log/kairos/kairos-logs.tar.gz"
+)
+
+// ScheduleTasks are the built-in tasks and the kairos-agent arguments they run
+var ScheduleTasks = map[string][]string{
+	// upgrade upgrades to the configured source, or the latest release
+	"upgrade": {"upgrade"},
+	// upgrade-check resolves and validates the upgrade without applying it
+	"upgrade-check": {"upgrade", "--dry-run"},
+	// image-verify checks the filesystems of the images not booted, so a corrupted fallback is found early
+	"image-verify": {"image", "verify"},
+	"logs":         {"logs", ScheduledLogsBundle},
+}
+
+var scheduleNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// ScheduledTask is a recurring kairos-agent task run by a systemd timer
+type ScheduledTask struct {
+	Name string `yaml:"name" json:"name"`
+	// Args are the kairos-agent arguments the task runs
+	Args []string `yaml:"args" json:"args"`
+	// OnCalendar is when the task runs, as a systemd calendar event like daily or "Sat 02:00"
+	OnCalendar string `yaml:"on-calendar" json:"on-calendar"`
+	// RandomizedDelay delays each run up to the given systemd time span, like 30m, to spread the runs of a fleet
+	RandomizedDelay string    `yaml:"randomized-delay,omitempty" json:"randomized-delay,omitempty"`
+	Created         time.Time `yaml:"created" json:"created"`
+	// NextRun is when systemd runs the task next, only set when listing them
+	NextRun string `yaml:"-" json:"next-run,omitempty"`
+}
+
+// Timer is the name of the systemd timer of the task
+func (t ScheduledTask) Timer() string {
+	return scheduleUnitPrefix + t.Name + ".timer"
+}
+
+// Service is the name of the systemd service of the task
+func (t ScheduledTask) Service() string {
+	return scheduleUnitPrefix + t.Name + ".service"
+}
+
+// ReadSchedule returns the scheduled tasks, sorted by name
+func ReadSchedule(fs v1.FS) ([]ScheduledTask, error) {
+	if exists, _ := fsutils.Exists(fs, cnst.ScheduleFile); !exists {
+		return nil, nil
+	}
+	data, err := fs.ReadFile(cnst.ScheduleFile)
+	if err != nil {
+		return nil, err
+	}
+	var tasks []ScheduledTask
+	if err = yaml.Unmarshal(data, &tasks); err != nil {
+		return nil, fmt.Errorf("parsing schedule %s: %w", cnst.ScheduleFile, err)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Name < tasks[j].Name })
+	return tasks, nil
+}
+
+// ListScheduledTasks returns the scheduled tasks with their next run
+func ListScheduledTasks(cfg *config.Config) ([]ScheduledTask, error) {
+	tasks, err := ReadSchedule(cfg.Fs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range tasks {
+		out, err := cfg.Runner.Run("systemctl", "show", tasks[i].Timer(), "--property", "NextElapseUSecRealtime", "--value")
+		if err == nil {
+			tasks[i].NextRun = strings.TrimSpace(string(out))
+		}
+	}
+	return tasks, nil
+}
+
+// AddScheduledTask schedules the task, replacing the one with the same name. A task with no arguments runs the
+// built-in task of its name. The units are started right away and created again on every boot from the OEM partition.
+func AddScheduledTask(cfg *config.Config, task ScheduledTask) error {
+	if !scheduleNameRegexp.MatchString(task.Name) {
+		return fmt.Errorf("invalid task name %q, it can only have lowercase letters, digits and dashes", task.Name)
+	}
+	if len(task.Args) == 0 {
+		args, ok := ScheduleTasks[task.Name]
+		if !ok {
+			return fmt.Errorf("%s is no built-in task, the kairos-agent arguments to run are required", task.Name)
+		}
+		task.Args = args
+	}
+	if task.OnCalendar == "" {
+		return fmt.Errorf("the calendar event the task runs on is required")
+	}
+	if out, err := cfg.Runner.Run("systemd-analyze", "calendar", task.OnCalendar); err != nil {
+		return fmt.Errorf("invalid calendar event %q: %s", task.OnCalendar, strings.TrimSpace(string(out)))
+	}
+	if task.RandomizedDelay != "" {
+		if out, err := cfg.Runner.Run("systemd-analyze", "timespan", task.RandomizedDelay); err != nil {
+			return fmt.Errorf("invalid randomized delay %q: %s", task.RandomizedDelay, strings.TrimSpace(string(out)))
+		}
+	}
+	if task.Created.IsZero() {
+		task.Created = time.Now()
+	}
+
+	tasks, err := ReadSchedule(cfg.Fs)
+	if err != nil {
+		return err
+	}
+	scheduled := []ScheduledTask{task}
+	for _, t := range tasks {
+		if t.Name != task.Name {
+			scheduled = append(scheduled, t)
+		}
+	}
+	if err = writeSchedule(cfg, scheduled); err != nil {
+		return err
+	}
+
+	for unit, content := range scheduleUnits(task) {
+		if err = fsutils.MkdirAll(cfg.Fs, systemdUnitDir, cnst.DirPerm); err != nil {
+			return err
+		}
+		if err = cfg.Fs.WriteFile(filepath.Join(systemdUnitDir, unit), []byte(content), cnst.FilePerm); err != nil {
+			return err
+		}
+	}
+	if out, err := cfg.Runner.Run("systemctl", "daemon-reload"); err != nil {
+		return fmt.Errorf("reloading systemd: %s", strings.TrimSpace(string(out)))
+	}
+	if out, err := cfg.Runner.Run("systemctl", "enable", "--now", task.Timer()); err != nil {
+		return fmt.Errorf("starting %s: %s", task.Timer(), strings.TrimSpace(string(out)))
+	}
+	cfg.Logger.Infof("Scheduled %s to run kairos-agent %s on %s", task.Name, strings.Join(task.Args, " "), task.OnCalendar)
+	return nil
+}
+
+// RemoveScheduledTask stops the task and removes its units
+func RemoveScheduledTask(cfg *config.Config, name string) error {
+	tasks, err := ReadSchedule(cfg.Fs)
+	if err != nil {
+		return err
+	}
+	var task *ScheduledTask
+	var scheduled []ScheduledTask
+	for i, t := range tasks {
+		if t.Name == name {
+			task = &tasks[i]
+			continue
+		}
+		scheduled = append(scheduled, t)
+	}
+	if task == nil {
+		return fmt.Errorf("no scheduled task %s", name)
+	}
+
+	if out, err := cfg.Runner.Run("systemctl", "disable", "--now", task.Timer()); err != nil {
+		cfg.Logger.Warnf("Could not stop %s: %s", task.Timer(), strings.TrimSpace(string(out)))
+	}
+	for _, unit := range []string{task.Timer(), task.Service()} {
+		if err = cfg.Fs.Remove(filepath.Join(systemdUnitDir, unit)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err = writeSchedule(cfg, scheduled); err != nil {
+		return err
+	}
+	if out, err := cfg.Runner.Run("systemctl", "daemon-reload"); err != nil {
+		return fmt.Errorf("reloading systemd: %s", strings.TrimSpace(string(out)))
+	}
+	cfg.Logger.Infof("Removed the scheduled task %s", name)
+	return nil
+}
+
+// writeSchedule stores the tasks and the stage creating their units on boot, both are removed with no tasks left
+func writeSchedule(cfg *config.Config, tasks []ScheduledTask) error {
+	if len(tasks) == 0 {
+		for _, file := range []string{cnst.ScheduleFile, cnst.ScheduleStageFile} {
+			if err := cfg.Fs.Remove(file); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Name < tasks[j].Name })
+	data, err := yaml.Marshal(tasks)
+	if err != nil {
+		return err
+	}
+	if err = fsutils.MkdirAll(cfg.Fs, filepath.Dir(cnst.ScheduleFile), cnst.DirPerm); err != nil {
+		return err
+	}
+	if err = fsutils.AtomicWriteFile(cfg.Fs, cnst.ScheduleFile, data, cnst.ConfigPerm); err != nil {
+		return fmt.Errorf("writing the schedule: %w", err)
+	}
+	stage, err := yaml.Marshal(scheduleStage(tasks))
+	if err != nil {
+		return err
+	}
+	stage = append([]byte("#cloud-config\n"), stage...)
+	if err = fsutils.AtomicWriteFile(cfg.Fs, cnst.ScheduleStageFile, stage, cnst.ConfigPerm); err != nil {
+		return fmt.Errorf("writing the schedule stage: %w", err)
+	}
+	return nil
+}
+
+// scheduleStage returns the cloud config creating and enabling the units of the tasks on boot
+func scheduleStage(tasks []ScheduledTask) yip.YipConfig {
+	stage := yip.Stage{Name: "Kairos agent scheduled tasks"}
+	for _, t := range tasks {
+		units := scheduleUnits(t)
+		for _, unit := range []string{t.Service(), t.Timer()} {
+			stage.Files = append(stage.Files, yip.File{
+				Path:        filepath.Join(systemdUnitDir, unit),
+				Permissions: 0644,
+				Content:     units[unit],
+			})
+		}
+		stage.Systemctl.Enable = append(stage.Systemctl.Enable, t.Timer())
+	}
+	return yip.YipConfig{Name: "Kairos agent scheduled tasks", Stages: map[string][]yip.Stage{"initramfs": {stage}}}
+}
+
+// scheduleUnits returns the service and timer units of the task, by unit name
+func scheduleUnits(t ScheduledTask) map[string]string {
+	args := make([]string, 0, len(t.Args))
+	for _, a := range t.Args {
+		args = append(args, systemdQuote(a))
+	}
+	service := fmt.Sprintf(`# Managed by kairos-agent schedule, changes are lost
+[Unit]
+Description=Kairos agent scheduled task %s
+
+[Service]
+Type=oneshot
+ExecStart=/usr/bin/kairos-agent %s
+`, t.Name, strings.Join(args, " "))
+
+	timer := fmt.Sprintf(`# Managed by kairos-agent schedule, changes are lost
+[Unit]
+Description=Kairos agent scheduled task %s
+
+[Timer]
+OnCalendar=%s
+Persistent=true
+`, t.Name, t.OnCalendar)
+	if t.RandomizedDelay != "" {
+		timer += fmt.Sprintf("RandomizedDelaySec=%s\n", t.RandomizedDelay)
+	}
+	timer += `
+[Install]
+WantedBy=timers.target
+`
+	return map[string]string{t.Service(): service, t.Timer(): timer}
+}
+
+// systemdQuote quotes the argument for an ExecStart line when needed, escaping the specifier and variable characters
+func systemdQuote(arg string) string {
+	arg = strings.ReplaceAll(arg, "%", "%%")
+	arg = strings.ReplaceAll(arg, "$", "$$")
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\;") {
+		return arg
+	}
+	arg = strings.ReplaceAll(arg, `\`, `\\`)
+	arg = strings.ReplaceAll(arg, `"`, `\"`)
+	return `"` + arg + `"`
+}
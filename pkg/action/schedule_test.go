@@ -0,0 +1,136 @@
+package action
+
+import (
+	"bytes"
+	"fmt"
+
+	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	"github.com/mudler/yip/pkg/console"
+	"github.com/mudler/yip/pkg/executor"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v5"
+	"github.com/twpayne/go-vfs/v5/vfst"
+)
+
+var _ = Describe("Schedule", Label("schedule"), func() {
+	var config *agentConfig.Config
+	var runner *v1mock.FakeRunner
+	var fs vfs.FS
+	var cleanup func()
+
+	BeforeEach(func() {
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{"/oem/.keep": ""})
+		Expect(err).Should(BeNil())
+		runner = v1mock.NewFakeRunner()
+		runner.SideEffect = func(command string, args ...string) ([]byte, error) {
+			switch {
+			case command == "systemd-analyze" && args[len(args)-1] == "whenever":
+				return []byte("Failed to parse calendar specification 'whenever'"), fmt.Errorf("exit status 1")
+			case command == "systemd-analyze" && args[len(args)-1] == "soon":
+				return []byte("Failed to parse time span 'soon'"), fmt.Errorf("exit status 1")
+			case command == "systemctl" && args[0] == "show":
+				return []byte("Sat 2026-10-24 02:00:00 UTC\n"), nil
+			}
+			return nil, nil
+		}
+		config = agentConfig.NewConfig(
+			agentConfig.WithFs(fs),
+			agentConfig.WithRunner(runner),
+			agentConfig.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})),
+		)
+	})
+
+	AfterEach(func() {
+		cleanup()
+	})
+
+	It("schedules the built-in tasks and recreates their units on boot", func() {
+		Expect(AddScheduledTask(config, ScheduledTask{Name: "upgrade-check", OnCalendar: "Sat 02:00", RandomizedDelay: "30m"})).To(Succeed())
+		Expect(runner.IncludesCmds([][]string{
+			{"systemd-analyze", "calendar", "Sat 02:00"},
+			{"systemd-analyze", "timespan", "30m"},
+			{"systemctl", "daemon-reload"},
+			{"systemctl", "enable", "--now", "kairos-schedule-upgrade-check.timer"},
+		})).To(Succeed())
+
+		service, err := fs.ReadFile("/etc/systemd/system/kairos-schedule-upgrade-check.service")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(service)).To(ContainSubstring("ExecStart=/usr/bin/kairos-agent upgrade --dry-run\n"))
+		timer, err := fs.ReadFile("/etc/systemd/system/kairos-schedule-upgrade-check.timer")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(timer)).To(ContainSubstring("OnCalendar=Sat 02:00\n"))
+		Expect(string(timer)).To(ContainSubstring("RandomizedDelaySec=30m\n"))
+
+		stage, err := fs.ReadFile(cnst.ScheduleStageFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(stage)).To(HavePrefix("#cloud-config\n"))
+		Expect(string(stage)).To(ContainSubstring("/etc/systemd/system/kairos-schedule-upgrade-check.timer"))
+		Expect(string(stage)).To(ContainSubstring("kairos-agent upgrade --dry-run"))
+		// The schedule does not stop its own stage, nor the other OEM cloud-configs, from loading on boot
+		graph, err := executor.NewExecutor().Graph("initramfs", fs, console.NewStandardConsole(), "/oem")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(graph).ToNot(BeEmpty())
+
+		tasks, err := ListScheduledTasks(config)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tasks).To(HaveLen(1))
+		Expect(tasks[0].Args).To(Equal([]string{"upgrade", "--dry-run"}))
+		Expect(tasks[0].NextRun).To(Equal("Sat 2026-10-24 02:00:00 UTC"))
+	})
+
+	It("schedules custom tasks quoting their arguments and replaces them by name", func() {
+		Expect(AddScheduledTask(config, ScheduledTask{Name: "bundle", Args: []string{"logs", "/var/log/my logs.tar.gz"}, OnCalendar: "daily"})).To(Succeed())
+		Expect(AddScheduledTask(config, ScheduledTask{Name: "logs", OnCalendar: "weekly"})).To(Succeed())
+		Expect(AddScheduledTask(config, ScheduledTask{Name: "image-verify", OnCalendar: "weekly"})).To(Succeed())
+		Expect(AddScheduledTask(config, ScheduledTask{Name: "bundle", Args: []string{"logs", "/var/log/100%.tar.gz"}, OnCalendar: "hourly"})).To(Succeed())
+
+		tasks, err := ReadSchedule(fs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tasks).To(HaveLen(3))
+		Expect(tasks[0].Name).To(Equal("bundle"))
+		Expect(tasks[0].OnCalendar).To(Equal("hourly"))
+		Expect(tasks[1].Args).To(Equal([]string{"image", "verify"}))
+		Expect(tasks[2].Args).To(Equal([]string{"logs", ScheduledLogsBundle}))
+
+		service, err := fs.ReadFile("/etc/systemd/system/kairos-schedule-bundle.service")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(service)).To(ContainSubstring("ExecStart=/usr/bin/kairos-agent logs /var/log/100%%.tar.gz\n"))
+		Expect(systemdQuote("/var/log/my logs.tar.gz")).To(Equal(`"/var/log/my logs.tar.gz"`))
+	})
+
+	It("rejects invalid tasks", func() {
+		Expect(AddScheduledTask(config, ScheduledTask{Name: "Upgrade", OnCalendar: "daily"})).To(MatchError(ContainSubstring("invalid task name")))
+		Expect(AddScheduledTask(config, ScheduledTask{Name: "verify", OnCalendar: "daily"})).To(MatchError(ContainSubstring("no built-in task")))
+		Expect(AddScheduledTask(config, ScheduledTask{Name: "upgrade"})).To(MatchError(ContainSubstring("calendar event")))
+		Expect(AddScheduledTask(config, ScheduledTask{Name: "upgrade", OnCalendar: "whenever"})).To(MatchError(ContainSubstring("Failed to parse")))
+		Expect(AddScheduledTask(config, ScheduledTask{Name: "upgrade", OnCalendar: "daily", RandomizedDelay: "soon"})).To(MatchError(ContainSubstring("invalid randomized delay")))
+		_, err := fs.Stat(cnst.ScheduleFile)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("removes the tasks and the boot stage with the last one", func() {
+		Expect(AddScheduledTask(config, ScheduledTask{Name: "upgrade", OnCalendar: "daily"})).To(Succeed())
+		Expect(AddScheduledTask(config, ScheduledTask{Name: "logs", OnCalendar: "daily"})).To(Succeed())
+
+		Expect(RemoveScheduledTask(config, "upgrade")).To(Succeed())
+		Expect(runner.IncludesCmds([][]string{{"systemctl", "disable", "--now", "kairos-schedule-upgrade.timer"}})).To(Succeed())
+		_, err := fs.Stat("/etc/systemd/system/kairos-schedule-upgrade.timer")
+		Expect(err).To(HaveOccurred())
+		stage, err := fs.ReadFile(cnst.ScheduleStageFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(stage)).ToNot(ContainSubstring("kairos-schedule-upgrade"))
+
+		Expect(RemoveScheduledTask(config, "logs")).To(Succeed())
+		_, err = fs.Stat(cnst.ScheduleStageFile)
+		Expect(err).To(HaveOccurred())
+		_, err = fs.Stat(cnst.ScheduleFile)
+		Expect(err).To(HaveOccurred())
+
+		Expect(RemoveScheduledTask(config, "logs")).To(MatchError(ContainSubstring("no scheduled task")))
+	})
+})
@@ -0,0 +1,417 @@
+package action
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	"github.com/kairos-io/kairos-agent/v2/pkg/elemental"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils/partitions"
+	"github.com/kairos-io/kairos-sdk/state"
+	"github.com/twpayne/go-vfs/v5"
+)
+
+// Selftest check statuses
+const (
+	SelftestPass = "pass"
+	SelftestFail = "fail"
+	SelftestSkip = "skip"
+)
+
+// selftestLabel labels the images created by the self test, the system labels would clash with the running system
+const selftestLabel = "KAIROS_SELFTEST"
+
+// selftestSysext is the name of the sysext fixture built by the self test
+const selftestSysext = "kairos-selftest"
+
+// SelftestResult is the outcome of a single self test check
+type SelftestResult struct {
+	Name     string        `yaml:"name" json:"name"`
+	Status   string        `yaml:"status" json:"status"`
+	Duration time.Duration `yaml:"duration" json:"duration"`
+	// Message is the failure or the reason the check was skipped
+	Message string `yaml:"message,omitempty" json:"message,omitempty"`
+}
+
+// SelftestReport is the result of all the self test checks
+type SelftestReport struct {
+	Passed  int              `yaml:"passed" json:"passed"`
+	Failed  int              `yaml:"failed" json:"failed"`
+	Skipped int              `yaml:"skipped" json:"skipped"`
+	Results []SelftestResult `yaml:"results" json:"results"`
+}
+
+// selftestSkipped is returned by checks which can't run on this system
+type selftestSkipped string
+
+func (s selftestSkipped) Error() string { return string(s) }
+
+// selftest holds the state shared by the checks of a self test run
+type selftest struct {
+	cfg    *config.Config
+	dir    string
+	source *v1.ImageSource
+	// installed is the image deployed by the install check, the upgrade check deploys from it
+	installed *v1.Image
+}
+
+type selftestCheck struct {
+	name string
+	run  func(*selftest) error
+}
+
+// selftestChecks are the self test checks, in the order they run
+var selftestChecks = []selftestCheck{
+	{"install-to-loopfile", (*selftest).install},
+	{"upgrade-to-self", (*selftest).upgrade},
+	{"reset-dry-run", (*selftest).resetDryRun},
+	{"bootentry", (*selftest).bootEntry},
+	{"sysext", (*selftest).sysext},
+}
+
+// SelftestChecks returns the names of the self test checks
+func SelftestChecks() []string {
+	names := make([]string, 0, len(selftestChecks))
+	for _, c := range selftestChecks {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+// Selftest exercises what the agent expects from an image: installing the source into a loop file, upgrading from
+// it, the reset prerequisites, the boot entry selection and the sysext management. Nothing outside a temporary dir
+// is modified, so it can run on a booted node or a VM to validate derivative images. source defaults to the live
+// media tree or the running system, only limits the run to the given checks.
+// This is the entrypoint for the selftest command
+func Selftest(cfg *config.Config, source string, only []string) (*SelftestReport, error) {
+	for _, name := range only {
+		if !selftestCheckExists(name) {
+			return nil, fmt.Errorf("unknown check %s, the checks are %v", name, SelftestChecks())
+		}
+	}
+	s := &selftest{cfg: cfg}
+	var err error
+	switch {
+	case source != "":
+		s.source, err = v1.NewSrcFromURI(source)
+		if err != nil {
+			return nil, err
+		}
+	case isDir(cfg, cnst.IsoBaseTree):
+		s.source = v1.NewDirSrc(cnst.IsoBaseTree)
+	default:
+		s.source = v1.NewDirSrc("/")
+	}
+	s.dir, err = utils.NewTempDir(cfg, "selftest")
+	if err != nil {
+		return nil, err
+	}
+	defer fsutils.RemoveTempDir(cfg.Fs, s.dir) // nolint:errcheck
+
+	report := &SelftestReport{Results: []SelftestResult{}}
+	for _, check := range selftestChecks {
+		if len(only) > 0 && !slices.Contains(only, check.name) {
+			continue
+		}
+		cfg.Logger.Infof("Running self test check %s", check.name)
+		start := time.Now()
+		err := check.run(s)
+		result := SelftestResult{Name: check.name, Status: SelftestPass, Duration: time.Since(start).Round(time.Millisecond)}
+		var skipped selftestSkipped
+		switch {
+		case errors.As(err, &skipped):
+			result.Status, result.Message = SelftestSkip, skipped.Error()
+			report.Skipped++
+		case err != nil:
+			result.Status, result.Message = SelftestFail, err.Error()
+			report.Failed++
+			cfg.Logger.Errorf("Self test check %s failed: %s", check.name, err)
+		default:
+			report.Passed++
+		}
+		report.Results = append(report.Results, result)
+	}
+	return report, nil
+}
+
+// install deploys the source into a loop file as the installer does with the active image, checking it is bootable
+// and carries the Kairos release information
+func (s *selftest) install() error {
+	size, err := config.GetSourceSize(s.cfg, s.source)
+	if err != nil {
+		return fmt.Errorf("sizing the source: %w", err)
+	}
+	img := &v1.Image{
+		File:       filepath.Join(s.dir, "active.img"),
+		Label:      selftestLabel,
+		Size:       uint(size),
+		FS:         cnst.LinuxImgFs,
+		Source:     s.source,
+		MountPoint: filepath.Join(s.dir, "active"),
+	}
+	if img.Size == 0 {
+		img.Size = cnst.ImgSize
+	}
+	e := elemental.NewElemental(s.cfg)
+	e.SetBootableCheck(true)
+	if _, err = e.DeployImage(img, true); err != nil {
+		return err
+	}
+	release, err := s.cfg.Fs.ReadFile(filepath.Join(img.MountPoint, "etc/kairos-release"))
+	if umountErr := e.UnmountImage(img); umountErr != nil {
+		return umountErr
+	}
+	if err != nil {
+		return fmt.Errorf("the installed system has no /etc/kairos-release: %w", err)
+	}
+	if !bytes.Contains(release, []byte("KAIROS_VERSION")) {
+		return fmt.Errorf("the /etc/kairos-release of the installed system has no KAIROS_VERSION")
+	}
+	if out, err := s.cfg.Runner.Run("e2fsck", "-f", "-n", img.File); err != nil {
+		return fmt.Errorf("the installed image is not consistent: %s: %w", bytes.TrimSpace(out), err)
+	}
+	s.installed = img
+	return nil
+}
+
+// upgrade deploys a transition image from the installed one, as an upgrade to the same version does, and checks the
+// release information survived
+func (s *selftest) upgrade() error {
+	if s.installed == nil {
+		return selftestSkipped("needs the install-to-loopfile check to pass")
+	}
+	e := elemental.NewElemental(s.cfg)
+	if err := e.MountImage(s.installed, "ro"); err != nil {
+		return err
+	}
+	defer e.UnmountImage(s.installed) // nolint:errcheck
+
+	transition := &v1.Image{
+		File:       filepath.Join(s.dir, cnst.TransitionImgFile),
+		Label:      selftestLabel,
+		Size:       s.installed.Size,
+		FS:         cnst.LinuxImgFs,
+		Source:     v1.NewDirSrc(s.installed.MountPoint),
+		MountPoint: filepath.Join(s.dir, "transition"),
+	}
+	e.SetBootableCheck(true)
+	if _, err := e.DeployImage(transition, true); err != nil {
+		return err
+	}
+	defer e.UnmountImage(transition) // nolint:errcheck
+
+	for _, file := range []string{"etc/kairos-release", "etc/os-release"} {
+		before, _ := s.cfg.Fs.ReadFile(filepath.Join(s.installed.MountPoint, file))
+		after, err := s.cfg.Fs.ReadFile(filepath.Join(transition.MountPoint, file))
+		if err != nil {
+			return fmt.Errorf("the upgraded system has no /%s: %w", file, err)
+		}
+		if !bytes.Equal(before, after) {
+			return fmt.Errorf("/%s changed when upgrading to the same image", file)
+		}
+	}
+	return nil
+}
+
+// resetDryRun checks reset has what it needs: the state partition to reset and a recovery image to reset from.
+// From recovery the reset spec is built as the reset command does, nothing is written in any case.
+func (s *selftest) resetDryRun() error {
+	if utils.IsUkiWithFs(s.cfg.Fs) {
+		return selftestSkipped("trusted boot systems reset from their EFI entries")
+	}
+	boot, _ := state.DetectBootWithVFS(s.cfg.Fs)
+	switch boot {
+	case state.Recovery:
+		spec, err := config.NewResetSpec(s.cfg)
+		if err != nil {
+			return err
+		}
+		if err = spec.Sanitize(); err != nil {
+			return err
+		}
+		s.cfg.Logger.Infof("Reset would deploy %s into %s", spec.Active.Source.Value(), spec.Target)
+		return nil
+	case state.Active, state.Passive:
+	default:
+		return selftestSkipped("the system is not installed")
+	}
+
+	parts, err := partitions.GetAllPartitions(&s.cfg.Logger)
+	if err != nil {
+		return err
+	}
+	ep := v1.NewElementalPartitionsFromList(parts)
+	if ep.State == nil {
+		return fmt.Errorf("state partition not found")
+	}
+	if ep.Recovery == nil {
+		ep.Recovery = partitions.GetPartitionViaDM(s.cfg.Fs, cnst.RecoveryLabel)
+		if ep.Recovery == nil {
+			return fmt.Errorf("recovery partition not found")
+		}
+	}
+	if ep.Recovery.MountPoint == "" {
+		e := elemental.NewElemental(s.cfg)
+		ep.Recovery.MountPoint = filepath.Join(s.dir, "recovery")
+		if err = e.MountPartition(ep.Recovery, "ro"); err != nil {
+			return err
+		}
+		defer e.UnmountPartition(ep.Recovery) // nolint:errcheck
+	}
+	for _, file := range []string{cnst.RecoverySquashFile, cnst.RecoveryImgFile} {
+		if exists, _ := fsutils.Exists(s.cfg.Fs, filepath.Join(ep.Recovery.MountPoint, "cOS", file)); exists {
+			s.cfg.Logger.Infof("Reset would deploy the recovery %s into %s", file, ep.State.Disk)
+			return nil
+		}
+	}
+	return fmt.Errorf("the recovery partition has no image to reset from")
+}
+
+// bootEntry selects the fallback entry on copies of the grub configs and environment
+func (s *selftest) bootEntry() error {
+	if utils.IsUkiWithFs(s.cfg.Fs) {
+		return selftestSkipped("trusted boot entries live in the EFI partition, they can't be selected in a sandbox")
+	}
+	sandbox, err := s.sandbox("bootentry")
+	if err != nil {
+		return err
+	}
+	entries, err := listGrubEntries(s.cfg)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return selftestSkipped("no grub config with boot entries found")
+	}
+	for _, file := range []string{"/etc/cos/grub.cfg", "/run/initramfs/cos-state/grub/grub.cfg", "/etc/kairos/branding/grubmenu.cfg", "/run/initramfs/cos-state/grub2/grub.cfg", "/oem/grubenv"} {
+		if exists, _ := fsutils.Exists(s.cfg.Fs, file); !exists {
+			continue
+		}
+		data, err := s.cfg.Fs.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err = fsutils.MkdirAll(sandbox.Fs, filepath.Dir(file), cnst.DirPerm); err != nil {
+			return err
+		}
+		if err = sandbox.Fs.WriteFile(file, data, cnst.FilePerm); err != nil {
+			return err
+		}
+	}
+	if err = fsutils.MkdirAll(sandbox.Fs, "/oem", cnst.DirPerm); err != nil {
+		return err
+	}
+	entry := entries[0]
+	if slices.Contains(entries, "fallback") {
+		entry = "fallback"
+	}
+	if err = SelectBootEntry(sandbox, entry); err != nil {
+		return err
+	}
+	vars, err := utils.ReadPersistentVariables("/oem/grubenv", sandbox.Fs)
+	if err != nil {
+		return err
+	}
+	if vars["next_entry"] != entry {
+		return fmt.Errorf("selecting %s set next_entry to %q", entry, vars["next_entry"])
+	}
+	if err = SelectBootEntry(sandbox, "selftest-missing-entry"); err == nil {
+		return fmt.Errorf("selecting a missing entry did not fail")
+	}
+	return nil
+}
+
+// sysext builds a sysext fixture and enables, lists and disables it on a sandboxed EFI dir
+func (s *selftest) sysext() error {
+	sandbox, err := s.sandbox("sysext")
+	if err != nil {
+		return err
+	}
+	fixture := filepath.Join(s.dir, "sysext-fixture")
+	release := filepath.Join(fixture, "usr/lib/extension-release.d", "extension-release."+selftestSysext)
+	if err = fsutils.MkdirAll(s.cfg.Fs, filepath.Dir(release), cnst.DirPerm); err != nil {
+		return err
+	}
+	if err = s.cfg.Fs.WriteFile(release, []byte("ID=_any\n"), cnst.FilePerm); err != nil {
+		return err
+	}
+	if err = fsutils.MkdirAll(sandbox.Fs, cnst.SysextStoreDir, cnst.DirPerm); err != nil {
+		return err
+	}
+	rawFixture, err := s.cfg.Fs.RawPath(fixture)
+	if err != nil {
+		return err
+	}
+	rawImage, err := sandbox.Fs.RawPath(filepath.Join(cnst.SysextStoreDir, selftestSysext+utils.SysextSuffix))
+	if err != nil {
+		return err
+	}
+	if out, err := s.cfg.Runner.Run("mksquashfs", rawFixture, rawImage, "-noappend", "-quiet"); err != nil {
+		return fmt.Errorf("building the sysext fixture: %s: %w", bytes.TrimSpace(out), err)
+	}
+
+	if err = EnableSysext(sandbox, cnst.UkiEfiDir, selftestSysext, "active"); err != nil {
+		return err
+	}
+	sysexts, err := ListSysexts(sandbox, cnst.UkiEfiDir)
+	if err != nil {
+		return err
+	}
+	if len(sysexts) != 1 || sysexts[0].Name != selftestSysext || sysexts[0].Modified {
+		return fmt.Errorf("the enabled sysext is not listed as expected: %+v", sysexts)
+	}
+	if err = DisableSysext(sandbox, cnst.UkiEfiDir, selftestSysext, "active"); err != nil {
+		return err
+	}
+	if sysexts, err = ListSysexts(sandbox, cnst.UkiEfiDir); err != nil || len(sysexts) != 0 {
+		return fmt.Errorf("the disabled sysext is still listed: %+v %v", sysexts, err)
+	}
+	return nil
+}
+
+// sandbox returns a copy of the config whose filesystem is rooted in a dir of the self test, with mounts disabled,
+// so actions writing to fixed system paths can be exercised
+func (s *selftest) sandbox(name string) (*config.Config, error) {
+	root := filepath.Join(s.dir, name)
+	if err := fsutils.MkdirAll(s.cfg.Fs, root, cnst.DirPerm); err != nil {
+		return nil, err
+	}
+	// Rooted in the raw path, so the raw paths of the sandbox, used by the commands run, stay right
+	raw, err := s.cfg.Fs.RawPath(root)
+	if err != nil {
+		return nil, err
+	}
+	sandbox := *s.cfg
+	sandbox.Fs = vfs.NewPathFS(vfs.OSFS, raw)
+	sandbox.Syscall = noMountSyscall{s.cfg.Syscall}
+	return &sandbox, nil
+}
+
+// noMountSyscall ignores mounts, the sandboxed paths are not mount points
+type noMountSyscall struct {
+	v1.SyscallInterface
+}
+
+func (noMountSyscall) Mount(string, string, string, uintptr, string) error { return nil }
+
+func selftestCheckExists(name string) bool {
+	for _, c := range selftestChecks {
+		if c.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isDir(cfg *config.Config, path string) bool {
+	info, err := cfg.Fs.Stat(path)
+	return err == nil && info.IsDir()
+}
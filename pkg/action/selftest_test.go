@@ -0,0 +1,98 @@
+package action
+
+import (
+	"bytes"
+	"os"
+
+	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v5"
+	"github.com/twpayne/go-vfs/v5/vfst"
+)
+
+var _ = Describe("Selftest", Label("selftest"), func() {
+	var config *agentConfig.Config
+	var runner *v1mock.FakeRunner
+	var fs vfs.FS
+	var cleanup func()
+
+	BeforeEach(func() {
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{
+			"/tmp/.keep":        "",
+			"/etc/cos/grub.cfg": "menuentry whatever --id cos {\nmenuentry whatever --id fallback {\nmenuentry whatever --id recovery {",
+		})
+		Expect(err).Should(BeNil())
+		runner = v1mock.NewFakeRunner()
+		config = agentConfig.NewConfig(
+			agentConfig.WithFs(fs),
+			agentConfig.WithRunner(runner),
+			agentConfig.WithSyscall(&v1mock.FakeSyscall{}),
+			agentConfig.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})),
+		)
+	})
+
+	AfterEach(func() {
+		cleanup()
+	})
+
+	It("selects the boot entry on a copy of the grub environment", func() {
+		report, err := Selftest(config, "dir:/", []string{"bootentry"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(report.Results).To(HaveLen(1))
+		Expect(report.Results[0].Status).To(Equal(SelftestPass), report.Results[0].Message)
+		Expect(report.Passed).To(Equal(1))
+
+		_, err = fs.Stat("/oem/grubenv")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("enables and disables a sysext fixture on a sandboxed EFI dir", func() {
+		runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+			if cmd == "mksquashfs" {
+				return []byte{}, os.WriteFile(args[1], []byte("sysext"), 0644)
+			}
+			return []byte{}, nil
+		}
+		report, err := Selftest(config, "dir:/", []string{"sysext"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(report.Results[0].Status).To(Equal(SelftestPass), report.Results[0].Message)
+		Expect(runner.IncludesCmds([][]string{{"mksquashfs"}})).To(Succeed())
+
+		// Nothing is left behind outside the temp dir
+		_, err = fs.Stat("/efi")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+		entries, err := fs.ReadDir("/tmp")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+	})
+
+	It("fails the check when the sysext fixture can't be built", func() {
+		runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+			if cmd == "mksquashfs" {
+				return []byte("mksquashfs: not found"), os.ErrNotExist
+			}
+			return []byte{}, nil
+		}
+		report, err := Selftest(config, "dir:/", []string{"sysext"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(report.Failed).To(Equal(1))
+		Expect(report.Results[0].Message).To(ContainSubstring("building the sysext fixture"))
+	})
+
+	It("skips the checks which can't run", func() {
+		report, err := Selftest(config, "dir:/", []string{"upgrade-to-self", "reset-dry-run"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(report.Skipped).To(Equal(2))
+		Expect(report.Results[0].Message).To(ContainSubstring("install-to-loopfile"))
+		Expect(report.Results[1].Message).To(ContainSubstring("not installed"))
+	})
+
+	It("refuses unknown checks", func() {
+		_, err := Selftest(config, "", []string{"install"})
+		Expect(err).To(MatchError(ContainSubstring("unknown check install")))
+	})
+})
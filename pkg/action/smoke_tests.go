@@ -0,0 +1,242 @@
+package action
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	"github.com/kairos-io/kairos-sdk/state"
+	"gopkg.in/yaml.v3"
+)
+
+// Smoke tests statuses
+const (
+	SmokeTestsPending    = "pending"
+	SmokeTestsPassed     = "passed"
+	SmokeTestsRolledBack = "rolled-back"
+	SmokeTestsSkipped    = "skipped"
+)
+
+// DefaultSmokeTestTimeout is how long a smoke test is retried until it passes if it sets no timeout
+const DefaultSmokeTestTimeout = 5 * time.Minute
+
+// smokeTestInterval is the time between tries of a failing smoke test
+var smokeTestInterval = 5 * time.Second
+
+// smokeTestsStage runs the pending smoke tests in the background on boot, once the network is up, so the services
+// being checked are not blocked by them
+const smokeTestsStage = `name: "Post-upgrade smoke tests"
+stages:
+  network:
+    - name: "Run the post-upgrade smoke tests"
+      commands:
+        - |
+          if [ -d /run/systemd/system ]; then
+            systemd-run --unit=kairos-smoke-tests --collect kairos-agent upgrade smoke-tests
+          else
+            nohup kairos-agent upgrade smoke-tests >/dev/null 2>&1 &
+          fi
+`
+
+// SmokeTestResult is the outcome of a single smoke test
+type SmokeTestResult struct {
+	Name   string `yaml:"name" json:"name"`
+	Passed bool   `yaml:"passed" json:"passed"`
+	Error  string `yaml:"error,omitempty" json:"error,omitempty"`
+}
+
+// SmokeTests are the checks an upgrade scheduled for the first boot of the new image. They are persisted so the
+// results can be inspected after a rollback.
+type SmokeTests struct {
+	Tests     []v1.SmokeTest    `yaml:"tests" json:"tests"`
+	Status    string            `yaml:"status" json:"status"`
+	Scheduled time.Time         `yaml:"scheduled" json:"scheduled"`
+	Finished  *time.Time        `yaml:"finished,omitempty" json:"finished,omitempty"`
+	Results   []SmokeTestResult `yaml:"results,omitempty" json:"results,omitempty"`
+	Error     string            `yaml:"error,omitempty" json:"error,omitempty"`
+}
+
+// ScheduleSmokeTests sets the given checks to run on the next boot, replacing any scheduled before
+func ScheduleSmokeTests(cfg *config.Config, tests []v1.SmokeTest) error {
+	run := &SmokeTests{Tests: tests, Status: SmokeTestsPending, Scheduled: time.Now()}
+	if err := writeSmokeTests(cfg, run); err != nil {
+		return fmt.Errorf("writing the smoke tests: %w", err)
+	}
+	if err := fsutils.MkdirAll(cfg.Fs, filepath.Dir(cnst.SmokeTestsStageFile), cnst.DirPerm); err != nil {
+		return err
+	}
+	if err := fsutils.AtomicWriteFile(cfg.Fs, cnst.SmokeTestsStageFile, []byte(smokeTestsStage), cnst.ConfigPerm); err != nil {
+		return fmt.Errorf("writing the smoke tests stage: %w", err)
+	}
+	cfg.Logger.Infof("%d smoke tests scheduled for the next boot", len(tests))
+	return nil
+}
+
+// ReadSmokeTests returns the last scheduled smoke tests, or nil if there are none
+func ReadSmokeTests(fs v1.FS) (*SmokeTests, error) {
+	if exists, _ := fsutils.Exists(fs, cnst.SmokeTestsFile); !exists {
+		return nil, nil
+	}
+	data, err := fs.ReadFile(cnst.SmokeTestsFile)
+	if err != nil {
+		return nil, err
+	}
+	run := &SmokeTests{}
+	if err = yaml.Unmarshal(data, run); err != nil {
+		return nil, fmt.Errorf("parsing smoke tests file %s: %w", cnst.SmokeTestsFile, err)
+	}
+	return run, nil
+}
+
+// RunSmokeTests runs the pending smoke tests on the first boot of an upgraded system. If all pass the boot is
+// marked good, otherwise it's marked bad and the system reboots into the fallback entry, the previous image.
+// This is the entrypoint for the upgrade smoke-tests command.
+func RunSmokeTests(cfg *config.Config) error {
+	run, err := ReadSmokeTests(cfg.Fs)
+	if err != nil {
+		return err
+	}
+	if run == nil || run.Status != SmokeTestsPending {
+		cfg.Logger.Debugf("No smoke tests to run")
+		return nil
+	}
+	// Nothing to run on the next boots, whatever the outcome
+	defer func() {
+		if err := cfg.Fs.Remove(cnst.SmokeTestsStageFile); err != nil && !os.IsNotExist(err) {
+			cfg.Logger.Warnf("Could not remove the smoke tests stage %s: %s", cnst.SmokeTestsStageFile, err)
+		}
+	}()
+
+	if boot, _ := state.DetectBootWithVFS(cfg.Fs); boot == state.Passive || boot == state.Recovery {
+		run.Status = SmokeTestsSkipped
+		run.Error = fmt.Sprintf("the upgraded image was not booted, booted from %s", boot)
+		cfg.Logger.Warnf("Skipping the smoke tests, %s", run.Error)
+		return finishSmokeTests(cfg, run)
+	}
+
+	run.Results = nil
+	var failed []string
+	for _, t := range run.Tests {
+		result := SmokeTestResult{Name: smokeTestName(t), Passed: true}
+		cfg.Logger.Infof("Running smoke test %s", result.Name)
+		if err := runSmokeTest(cfg, t); err != nil {
+			cfg.Logger.Errorf("Smoke test %s failed: %s", result.Name, err)
+			result.Passed = false
+			result.Error = err.Error()
+			failed = append(failed, result.Name)
+		}
+		run.Results = append(run.Results, result)
+	}
+
+	uki := utils.IsUkiWithFs(cfg.Fs)
+	if len(failed) == 0 {
+		run.Status = SmokeTestsPassed
+		if uki {
+			if out, err := cfg.Runner.Run("systemd-bless-boot", "good"); err != nil {
+				cfg.Logger.Warnf("Could not mark the boot as good: %s: %s", strings.TrimSpace(string(out)), err)
+			}
+		}
+		cfg.Logger.Infof("All %d smoke tests passed", len(run.Tests))
+		if err := MarkWatchdogHealthy(cfg); err != nil {
+			cfg.Logger.Warnf("Could not report the system healthy to the watchdog: %s", err)
+		}
+		return finishSmokeTests(cfg, run)
+	}
+
+	run.Status = SmokeTestsRolledBack
+	run.Error = fmt.Sprintf("smoke tests failed: %s", strings.Join(failed, ", "))
+	if err = finishSmokeTests(cfg, run); err != nil {
+		return err
+	}
+	if uki {
+		if out, err := cfg.Runner.Run("systemd-bless-boot", "bad"); err != nil {
+			cfg.Logger.Warnf("Could not mark the boot as bad: %s: %s", strings.TrimSpace(string(out)), err)
+		}
+	}
+	cfg.Logger.Errorf("%s, rolling back to the previous image", run.Error)
+	if err = SelectBootEntry(cfg, "fallback"); err != nil {
+		return fmt.Errorf("%s and selecting the fallback entry failed: %w", run.Error, err)
+	}
+	return utils.Reboot(cfg.Runner, 0)
+}
+
+// runSmokeTest retries the check until it passes or its timeout expires
+func runSmokeTest(cfg *config.Config, t v1.SmokeTest) error {
+	timeout := t.Timeout
+	if timeout == 0 {
+		timeout = DefaultSmokeTestTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err := checkSmokeTest(cfg, t)
+		if err == nil || time.Now().Add(smokeTestInterval).After(deadline) {
+			return err
+		}
+		cfg.Logger.Debugf("Smoke test %s not passing yet: %s", smokeTestName(t), err)
+		time.Sleep(smokeTestInterval)
+	}
+}
+
+func checkSmokeTest(cfg *config.Config, t v1.SmokeTest) error {
+	switch t.Kind() {
+	case "unit":
+		out, err := cfg.Runner.Run("systemctl", "is-active", t.Unit)
+		if err != nil {
+			return fmt.Errorf("unit %s is %s", t.Unit, strings.TrimSpace(string(out)))
+		}
+	case "url":
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Get(t.URL)
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("%s answered with %s", t.URL, resp.Status)
+		}
+	case "script":
+		out, err := cfg.Runner.Run("sh", "-c", t.Script)
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+func smokeTestName(t v1.SmokeTest) string {
+	switch {
+	case t.Name != "":
+		return t.Name
+	case t.Unit != "":
+		return t.Unit
+	case t.URL != "":
+		return t.URL
+	default:
+		return t.Script
+	}
+}
+
+func finishSmokeTests(cfg *config.Config, run *SmokeTests) error {
+	now := time.Now()
+	run.Finished = &now
+	return writeSmokeTests(cfg, run)
+}
+
+func writeSmokeTests(cfg *config.Config, run *SmokeTests) error {
+	data, err := yaml.Marshal(run)
+	if err != nil {
+		return err
+	}
+	if err = fsutils.MkdirAll(cfg.Fs, filepath.Dir(cnst.SmokeTestsFile), cnst.DirPerm); err != nil {
+		return err
+	}
+	return fsutils.AtomicWriteFile(cfg.Fs, cnst.SmokeTestsFile, data, cnst.ConfigPerm)
+}
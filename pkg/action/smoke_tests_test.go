@@ -0,0 +1,133 @@
+package action
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v5"
+	"github.com/twpayne/go-vfs/v5/vfst"
+)
+
+var _ = Describe("Smoke tests", Label("smoke-tests"), func() {
+	var config *agentConfig.Config
+	var runner *v1mock.FakeRunner
+	var fs vfs.FS
+	var cleanup func()
+	var server *httptest.Server
+
+	BeforeEach(func() {
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{
+			"/oem/.keep":        "",
+			"/proc/cmdline":     "root=LABEL=COS_ACTIVE",
+			"/etc/cos/grub.cfg": "menuentry whatever --id cos {\nmenuentry whatever --id fallback {",
+		})
+		Expect(err).Should(BeNil())
+		runner = v1mock.NewFakeRunner()
+		config = agentConfig.NewConfig(
+			agentConfig.WithFs(fs),
+			agentConfig.WithRunner(runner),
+			agentConfig.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})),
+		)
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/healthz" {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		smokeTestInterval = 10 * time.Millisecond
+	})
+
+	AfterEach(func() {
+		server.Close()
+		cleanup()
+	})
+
+	It("schedules the smoke tests to run in the background on boot", func() {
+		Expect(ScheduleSmokeTests(config, []v1.SmokeTest{{Unit: "k3s.service"}})).To(Succeed())
+		run, err := ReadSmokeTests(fs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(run.Status).To(Equal(SmokeTestsPending))
+		Expect(run.Tests).To(HaveLen(1))
+		stage, err := fs.ReadFile(cnst.SmokeTestsStageFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(stage)).To(ContainSubstring("kairos-agent upgrade smoke-tests"))
+	})
+
+	It("keeps the upgraded image if all the smoke tests pass", func() {
+		Expect(ScheduleSmokeTests(config, []v1.SmokeTest{
+			{Unit: "k3s.service"},
+			{Name: "api", URL: server.URL + "/healthz"},
+			{Script: "test -f /etc/kairos-release"},
+		})).To(Succeed())
+		Expect(RunSmokeTests(config)).To(Succeed())
+
+		run, err := ReadSmokeTests(fs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(run.Status).To(Equal(SmokeTestsPassed))
+		Expect(run.Results).To(HaveLen(3))
+		Expect(run.Results[1].Name).To(Equal("api"))
+		Expect(run.Finished).ToNot(BeNil())
+		Expect(runner.IncludesCmds([][]string{
+			{"systemctl", "is-active", "k3s.service"},
+			{"sh", "-c", "test -f /etc/kairos-release"},
+		})).To(Succeed())
+		Expect(runner.IncludesCmds([][]string{{"reboot"}})).ToNot(Succeed())
+		_, err = fs.Stat(cnst.SmokeTestsStageFile)
+		Expect(err).To(MatchError(os.ErrNotExist))
+	})
+
+	It("rolls back to the previous image if a smoke test fails", func() {
+		runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+			if cmd == "systemctl" {
+				return []byte("failed\n"), errors.New("exit status 3")
+			}
+			return []byte{}, nil
+		}
+		Expect(ScheduleSmokeTests(config, []v1.SmokeTest{
+			{Unit: "k3s.service", Timeout: 50 * time.Millisecond},
+			{URL: server.URL + "/ready", Timeout: 50 * time.Millisecond},
+		})).To(Succeed())
+		Expect(RunSmokeTests(config)).To(Succeed())
+
+		run, err := ReadSmokeTests(fs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(run.Status).To(Equal(SmokeTestsRolledBack))
+		Expect(run.Error).To(ContainSubstring("k3s.service"))
+		Expect(run.Results[0].Error).To(Equal("unit k3s.service is failed"))
+		Expect(run.Results[1].Error).To(ContainSubstring("503"))
+		variables, err := utils.ReadPersistentVariables("/oem/grubenv", fs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(variables["next_entry"]).To(Equal("fallback"))
+		Expect(runner.IncludesCmds([][]string{{"reboot", "-f"}})).To(Succeed())
+
+		// Nothing is run again after the rollback
+		runner.ClearCmds()
+		Expect(RunSmokeTests(config)).To(Succeed())
+		Expect(runner.IncludesCmds([][]string{{"systemctl"}})).ToNot(Succeed())
+	})
+
+	It("skips the smoke tests if the upgraded image was not booted", func() {
+		Expect(fs.WriteFile("/proc/cmdline", []byte("root=LABEL=COS_PASSIVE"), cnst.FilePerm)).To(Succeed())
+		Expect(ScheduleSmokeTests(config, []v1.SmokeTest{{Unit: "k3s.service"}})).To(Succeed())
+		Expect(RunSmokeTests(config)).To(Succeed())
+
+		run, err := ReadSmokeTests(fs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(run.Status).To(Equal(SmokeTestsSkipped))
+		Expect(runner.IncludesCmds([][]string{{"systemctl"}})).ToNot(Succeed())
+		_, err = fs.Stat(cnst.SmokeTestsStageFile)
+		Expect(err).To(MatchError(os.ErrNotExist))
+	})
+})
@@ -0,0 +1,241 @@
+package action
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/itchyny/gojq"
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	"github.com/kairos-io/kairos-sdk/state"
+	"gopkg.in/yaml.v3"
+)
+
+// PartitionUsage is the filesystem usage of a mounted partition, as reported by statfs on its mountpoint
+type PartitionUsage struct {
+	Device       string   `yaml:"device" json:"device"`
+	MountPoint   string   `yaml:"mount_point" json:"mount_point"`
+	Mounted      bool     `yaml:"mounted" json:"mounted"`
+	Filesystem   string   `yaml:"filesystem,omitempty" json:"filesystem,omitempty"`
+	MountOptions []string `yaml:"mount_options,omitempty" json:"mount_options,omitempty"`
+	SizeBytes    uint64   `yaml:"size_bytes" json:"size_bytes"`
+	UsedBytes    uint64   `yaml:"used_bytes" json:"used_bytes"`
+	FreeBytes    uint64   `yaml:"free_bytes" json:"free_bytes"`
+	// UsedPercent is computed over the space available to unprivileged users, like df does
+	UsedPercent int `yaml:"used_percent" json:"used_percent"`
+}
+
+// State is the machine runtime state augmented with the usage of the Kairos partitions,
+// this is what the state command prints and queries
+type State struct {
+	state.Runtime `yaml:",inline"`
+	Partitions    map[string]PartitionUsage `yaml:"partitions" json:"partitions"`
+	// Degradations are the known problems found in the current boot
+	Degradations []BootDegradation `yaml:"degradations" json:"degradations"`
+	// VarLib are the /var/lib paths with a persistence class set at install
+	VarLib []VarLibMount `yaml:"var_lib,omitempty" json:"var_lib,omitempty"`
+}
+
+// VarLibMount is a /var/lib path declared in storage.var_lib, along with how it is mounted in the current boot
+type VarLibMount struct {
+	Path       string `yaml:"path" json:"path"`
+	Class      string `yaml:"class" json:"class"`
+	Mounted    bool   `yaml:"mounted" json:"mounted"`
+	Device     string `yaml:"device,omitempty" json:"device,omitempty"`
+	Filesystem string `yaml:"filesystem,omitempty" json:"filesystem,omitempty"`
+	// Applied is true if the path is mounted as its class expects, from a disk if persistent and over a tmpfs if
+	// ephemeral
+	Applied bool `yaml:"applied" json:"applied"`
+}
+
+// mountEntry is a line of /proc/mounts
+type mountEntry struct {
+	device, mountPoint, fsType string
+	options                    []string
+}
+
+// NewState returns the runtime state with the partitions usage
+func NewState(cfg *config.Config, runtime state.Runtime) State {
+	s := State{Runtime: runtime, Partitions: map[string]PartitionUsage{}}
+	mounts := readMounts(cfg)
+
+	parts := map[string]state.PartitionState{
+		"oem":        runtime.OEM,
+		"state":      runtime.State,
+		"persistent": runtime.Persistent,
+		"recovery":   runtime.Recovery,
+		"efi":        efiPartitionState(cfg, mounts),
+	}
+	for name, p := range parts {
+		if !p.Found {
+			continue
+		}
+		s.Partitions[name] = partitionUsage(cfg, p, mounts)
+	}
+	s.Degradations = detectBootDegradations(cfg, runtime, mounts)
+	s.VarLib = varLibMounts(cfg, mounts)
+	return s
+}
+
+// varLibMounts returns the /var/lib paths recorded with their persistence class at install, nothing if none were
+func varLibMounts(cfg *config.Config, mounts []mountEntry) []VarLibMount {
+	data, err := cfg.Fs.ReadFile(cnst.VarLibFile)
+	if err != nil {
+		return nil
+	}
+	varLib := &config.VarLib{}
+	if err = yaml.Unmarshal(data, varLib); err != nil {
+		cfg.Logger.Debugf("Could not read %s: %s", cnst.VarLibFile, err)
+		return nil
+	}
+	classes, err := varLib.Classes()
+	if err != nil {
+		cfg.Logger.Debugf("Invalid %s: %s", cnst.VarLibFile, err)
+		return nil
+	}
+	var result []VarLibMount
+	for path, class := range classes {
+		m := VarLibMount{Path: path, Class: class}
+		// The last mount on a path is the one in use
+		for _, e := range mounts {
+			if e.mountPoint == path {
+				m.Mounted, m.Device, m.Filesystem = true, e.device, e.fsType
+			}
+		}
+		tmpfs := m.Filesystem == "tmpfs" || m.Filesystem == "overlay"
+		m.Applied = m.Mounted && tmpfs == (class == cnst.VarLibEphemeral)
+		result = append(result, m)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+	return result
+}
+
+func (s State) String() string {
+	dat, err := yaml.Marshal(s)
+	if err == nil {
+		return string(dat)
+	}
+	return ""
+}
+
+// Query runs the given jq style query, without the leading dot, over the state
+func (s State) Query(q string) (res string, err error) {
+	data := map[string]interface{}{}
+	dat, err := json.Marshal(s)
+	if err != nil {
+		return res, err
+	}
+	if err = json.Unmarshal(dat, &data); err != nil {
+		return res, err
+	}
+	query, err := gojq.Parse(fmt.Sprintf(".%s", q))
+	if err != nil {
+		return res, err
+	}
+	iter := query.Run(data)
+	for {
+		v, ok := iter.Next()
+		if !ok {
+			break
+		}
+		if err, ok := v.(error); ok {
+			return res, err
+		}
+		switch v.(type) {
+		// Objects are printed as yaml, like the whole state, so `state get partitions` is readable
+		case map[string]interface{}, []interface{}:
+			out, err := yaml.Marshal(v)
+			if err != nil {
+				return res, err
+			}
+			res += string(out)
+		default:
+			res += fmt.Sprint(v)
+		}
+	}
+	return res, nil
+}
+
+// efiPartitionState finds the EFI partition by its label, the runtime state does not track it
+func efiPartitionState(cfg *config.Config, mounts []mountEntry) state.PartitionState {
+	device, err := cfg.Fs.Readlink(cnst.UkiEfiDiskByLabel)
+	if err != nil {
+		return state.PartitionState{}
+	}
+	if !filepath.IsAbs(device) {
+		device = filepath.Join(filepath.Dir(cnst.UkiEfiDiskByLabel), device)
+	}
+	p := state.PartitionState{Name: device, FilesystemLabel: cnst.EfiLabel, Found: true}
+	for _, m := range mounts {
+		if m.device == device || m.device == cnst.UkiEfiDiskByLabel {
+			p.MountPoint = m.mountPoint
+			p.Mounted = true
+			break
+		}
+	}
+	return p
+}
+
+// partitionUsage returns the usage of the given partition, only the device is set if it is not mounted
+func partitionUsage(cfg *config.Config, p state.PartitionState, mounts []mountEntry) PartitionUsage {
+	u := PartitionUsage{Device: p.Name, MountPoint: p.MountPoint, Mounted: p.Mounted && p.MountPoint != "", SizeBytes: p.SizeBytes}
+	if !u.Mounted {
+		return u
+	}
+	for _, m := range mounts {
+		if m.mountPoint == p.MountPoint {
+			u.Filesystem = m.fsType
+			u.MountOptions = m.options
+		}
+	}
+
+	path, err := cfg.Fs.RawPath(p.MountPoint)
+	if err != nil {
+		return u
+	}
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(path, &st); err != nil {
+		cfg.Logger.Debugf("Could not statfs %s: %s", p.MountPoint, err)
+		return u
+	}
+	bsize := uint64(st.Bsize)
+	u.SizeBytes = st.Blocks * bsize
+	u.FreeBytes = st.Bavail * bsize
+	u.UsedBytes = (st.Blocks - st.Bfree) * bsize
+	if avail := u.UsedBytes + u.FreeBytes; avail > 0 {
+		u.UsedPercent = int((u.UsedBytes*100 + avail - 1) / avail)
+	}
+	return u
+}
+
+// readMounts parses /proc/mounts, it returns nothing if it cannot be read
+func readMounts(cfg *config.Config) []mountEntry {
+	data, err := cfg.Fs.ReadFile("/proc/mounts")
+	if err != nil {
+		return nil
+	}
+	var mounts []mountEntry
+	for _, line := range strings.Split(string(data), "\n") {
+		// entry is `device mountpoint fstype options unused unused`
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		mounts = append(mounts, mountEntry{
+			device:     fields[0],
+			mountPoint: unescapeMount(fields[1]),
+			fsType:     fields[2],
+			options:    strings.Split(fields[3], ","),
+		})
+	}
+	return mounts
+}
+
+// unescapeMount undoes the octal escaping of spaces and tabs in the /proc/mounts paths
+func unescapeMount(s string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(s)
+}
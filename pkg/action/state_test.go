@@ -0,0 +1,166 @@
+package action
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	"github.com/kairos-io/kairos-sdk/state"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v5"
+	"github.com/twpayne/go-vfs/v5/vfst"
+)
+
+var _ = Describe("State tests", Label("state"), func() {
+	var config *agentConfig.Config
+	var fs vfs.FS
+	var runner *v1mock.FakeRunner
+	var cleanup func()
+
+	BeforeEach(func() {
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{
+			"/oem/90_custom.yaml": "#cloud-config",
+			"/efi/EFI/.keep":      "",
+			"/proc/mounts": "/dev/sda2 /oem ext4 rw,relatime 0 0\n" +
+				"/dev/sda1 /efi vfat ro,nosuid,nodev 0 0\n",
+		})
+		Expect(err).Should(BeNil())
+		Expect(fs.Mkdir("/dev", os.ModePerm)).To(Succeed())
+		Expect(fs.Mkdir("/dev/disk", os.ModePerm)).To(Succeed())
+		Expect(fs.Mkdir("/dev/disk/by-label", os.ModePerm)).To(Succeed())
+		Expect(fs.Symlink("../../sda1", cnst.UkiEfiDiskByLabel)).To(Succeed())
+		runner = v1mock.NewFakeRunner()
+		config = agentConfig.NewConfig(
+			agentConfig.WithFs(fs),
+			agentConfig.WithRunner(runner),
+			agentConfig.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})),
+		)
+	})
+
+	AfterEach(func() {
+		cleanup()
+	})
+
+	It("adds the usage and mount options of the mounted partitions", func() {
+		runtime := state.Runtime{
+			OEM:        state.PartitionState{Name: "/dev/sda2", MountPoint: "/oem", Mounted: true, Found: true},
+			Persistent: state.PartitionState{Name: "/dev/sda4", SizeBytes: 1024, Found: true},
+		}
+		s := NewState(config, runtime)
+		Expect(s.Partitions).To(HaveLen(3))
+		Expect(s.Partitions).ToNot(HaveKey("state"))
+
+		oem := s.Partitions["oem"]
+		Expect(oem.Mounted).To(BeTrue())
+		Expect(oem.Filesystem).To(Equal("ext4"))
+		Expect(oem.MountOptions).To(Equal([]string{"rw", "relatime"}))
+		Expect(oem.SizeBytes).ToNot(BeZero())
+		Expect(oem.UsedBytes + oem.FreeBytes).To(BeNumerically("<=", oem.SizeBytes))
+
+		efi := s.Partitions["efi"]
+		Expect(efi.Device).To(Equal("/dev/sda1"))
+		Expect(efi.MountPoint).To(Equal("/efi"))
+		Expect(efi.MountOptions).To(ContainElement("ro"))
+
+		persistent := s.Partitions["persistent"]
+		Expect(persistent.Mounted).To(BeFalse())
+		Expect(persistent.SizeBytes).To(Equal(uint64(1024)))
+		Expect(persistent.UsedBytes).To(BeZero())
+	})
+
+	It("can be queried and printed with the partitions", func() {
+		runtime := state.Runtime{
+			OEM: state.PartitionState{Name: "/dev/sda2", MountPoint: "/oem", Mounted: true, Found: true},
+		}
+		s := NewState(config, runtime)
+		res, err := s.Query("partitions.oem.filesystem")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(Equal("ext4"))
+		res, err = s.Query("oem.name")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(Equal("/dev/sda2"))
+		res, err = s.Query("partitions.efi")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(ContainSubstring("mount_point: /efi"))
+
+		Expect(s.String()).To(ContainSubstring("partitions:"))
+		Expect(s.String()).To(ContainSubstring("oem:\n"))
+		result, err := RenderStateTemplate("{{ .partitions.oem.device }}", s)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(result)).To(Equal("/dev/sda2"))
+	})
+
+	It("reports the persistent partition not mounted and the OEM one mounted fine", func() {
+		runtime := state.Runtime{
+			BootState:  state.Active,
+			OEM:        state.PartitionState{Name: "/dev/sda2", MountPoint: "/oem", Mounted: true, Found: true},
+			Persistent: state.PartitionState{Name: "/dev/sda4", Found: true},
+		}
+		s := NewState(config, runtime)
+		Expect(s.Degradations).To(HaveLen(1))
+		Expect(s.Degradations[0].Kind).To(Equal(DegradationPersistentNotMounted))
+		Expect(s.Degradations[0].Message).To(ContainSubstring("/dev/sda4"))
+		Expect(s.Degradations[0].Source).To(Equal("mounts"))
+	})
+
+	It("reports the overlay fallback and the immucore and kernel errors", func() {
+		Expect(fs.WriteFile("/proc/mounts", []byte("/dev/sda2 /oem ext4 rw 0 0\ntmpfs /usr/local tmpfs rw 0 0\n"), os.ModePerm)).To(Succeed())
+		Expect(vfs.MkdirAll(fs, cnst.ImmucoreLogDir, os.ModePerm)).To(Succeed())
+		Expect(fs.WriteFile(filepath.Join(cnst.ImmucoreLogDir, "immucore.log"), []byte(
+			"INF Mounting /oem\n"+
+				"ERR could not mount COS_PERSISTENT: no such device\n"+
+				"WRN falling back to tmpfs overlay for /usr/local\n"), os.ModePerm)).To(Succeed())
+		runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+			if cmd == "dmesg" {
+				return []byte("[    3.1] EXT4-fs error (device sda4): ext4_lookup: deleted inode referenced\n[    4.2] usb 1-1: new device\n"), nil
+			}
+			return []byte{}, nil
+		}
+		runtime := state.Runtime{
+			BootState:  state.Active,
+			OEM:        state.PartitionState{Name: "/dev/sda2", MountPoint: "/oem", Mounted: true, Found: true},
+			Persistent: state.PartitionState{Name: "/dev/sda4", Found: true},
+		}
+		degradations := DetectBootDegradations(config, runtime)
+		kinds := []string{}
+		for _, d := range degradations {
+			kinds = append(kinds, d.Kind)
+		}
+		// The overlay fallback is only reported once, from the mounts
+		Expect(kinds).To(Equal([]string{DegradationOverlayFallback, DegradationPersistentNotMounted, DegradationFilesystemErrors}))
+		Expect(degradations[1].Source).To(Equal(filepath.Join(cnst.ImmucoreLogDir, "immucore.log")))
+		Expect(degradations[2].Message).To(ContainSubstring("EXT4-fs error (device sda4)"))
+	})
+
+	It("reports how the /var/lib paths with a persistence class are mounted", func() {
+		Expect(fs.WriteFile("/proc/mounts", []byte("/dev/sda2 /oem ext4 rw 0 0\n"+
+			"/dev/sda4 /var/lib/containerd ext4 rw 0 0\n"+
+			"overlay /var/lib/cache overlay rw 0 0\n"+
+			"overlay /var/lib/rancher overlay rw 0 0\n"), os.ModePerm)).To(Succeed())
+		Expect(fsutils.MkdirAll(fs, filepath.Dir(cnst.VarLibFile), cnst.DirPerm)).To(Succeed())
+		Expect(fs.WriteFile(cnst.VarLibFile, []byte("persistent:\n- /var/lib/containerd\n- /var/lib/rancher\n- /var/lib/kubelet\nephemeral:\n- /var/lib/cache\n"), os.ModePerm)).To(Succeed())
+		s := NewState(config, state.Runtime{})
+		Expect(s.VarLib).To(Equal([]VarLibMount{
+			{Path: "/var/lib/cache", Class: cnst.VarLibEphemeral, Mounted: true, Device: "overlay", Filesystem: "overlay", Applied: true},
+			{Path: "/var/lib/containerd", Class: cnst.VarLibPersistent, Mounted: true, Device: "/dev/sda4", Filesystem: "ext4", Applied: true},
+			{Path: "/var/lib/kubelet", Class: cnst.VarLibPersistent},
+			{Path: "/var/lib/rancher", Class: cnst.VarLibPersistent, Mounted: true, Device: "overlay", Filesystem: "overlay"},
+		}))
+		Expect(s.Query("var_lib[1].applied")).To(Equal("true"))
+	})
+
+	It("does not report unmounted partitions out of the active and passive systems", func() {
+		runtime := state.Runtime{
+			BootState:  state.Recovery,
+			Persistent: state.PartitionState{Name: "/dev/sda4", Found: true},
+		}
+		Expect(DetectBootDegradations(config, runtime)).To(BeEmpty())
+	})
+})
@@ -0,0 +1,207 @@
+package action
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+)
+
+// sysextBootStates are the boot entries sysexts can be attached to, their sysexts are in EFI/kairos/<state>.efi.extra.d
+var sysextBootStates = []string{"active", "passive", "recovery", "statereset"}
+
+// Sysext is an installed sysext as shown by `sysext list`
+type Sysext struct {
+	Name      string     `yaml:"name" json:"name"`
+	BootState string     `yaml:"boot_state" json:"boot_state"`
+	Path      string     `yaml:"path" json:"path"`
+	Source    string     `yaml:"source,omitempty" json:"source,omitempty"`
+	Digest    string     `yaml:"digest" json:"digest"`
+	Installed *time.Time `yaml:"installed,omitempty" json:"installed,omitempty"`
+	// Modified is set when the file no longer matches the digest recorded on install
+	Modified  bool     `yaml:"modified,omitempty" json:"modified,omitempty"`
+	Requires  []string `yaml:"requires,omitempty" json:"requires,omitempty"`
+	Conflicts []string `yaml:"conflicts,omitempty" json:"conflicts,omitempty"`
+}
+
+// ListSysexts lists the sysexts installed for each boot state under the EFI mountpoint, with their recorded origin.
+// This is the entrypoint for the sysext list command
+func ListSysexts(cfg *config.Config, efiDir string) ([]Sysext, error) {
+	var sysexts []Sysext
+	for _, state := range sysextBootStates {
+		dir := utils.SysextDir(efiDir, state)
+		if exists, _ := fsutils.Exists(cfg.Fs, dir); !exists {
+			continue
+		}
+		entries, err := cfg.Fs.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		origins, err := utils.ReadSysextMetadata(cfg.Fs, dir)
+		if err != nil {
+			cfg.Logger.Warnf("Ignoring the sysext metadata in %s: %s", dir, err)
+		}
+		for _, e := range entries {
+			if e.IsDir() || !strings.HasSuffix(e.Name(), utils.SysextSuffix) {
+				continue
+			}
+			path := filepath.Join(dir, e.Name())
+			digest, err := utils.SysextDigest(cfg.Fs, path)
+			if err != nil {
+				return nil, err
+			}
+			s := Sysext{Name: strings.TrimSuffix(e.Name(), utils.SysextSuffix), BootState: state, Path: path, Digest: digest}
+			if origin, ok := origins[e.Name()]; ok {
+				installed := origin.Installed
+				s.Source = origin.Source
+				s.Installed = &installed
+				s.Modified = origin.Digest != digest
+				s.Requires = origin.Requires
+				s.Conflicts = origin.Conflicts
+			}
+			sysexts = append(sysexts, s)
+		}
+	}
+	return sysexts, nil
+}
+
+// EnableSysext enables the sysext name, from the sysext store, on the given boot entry. It refuses to do it if the
+// resulting set of sysexts breaks any of their requires or conflicts declarations.
+// This is the entrypoint for the sysext enable command
+func EnableSysext(cfg *config.Config, efiDir, name, bootState string) error {
+	if err := checkSysextBootState(bootState); err != nil {
+		return err
+	}
+	file := name + utils.SysextSuffix
+	src := filepath.Join(cnst.SysextStoreDir, file)
+	if exists, _ := fsutils.Exists(cfg.Fs, src); !exists {
+		return fmt.Errorf("sysext %s not found in %s", name, cnst.SysextStoreDir)
+	}
+	available, err := utils.ReadSysextMetadata(cfg.Fs, cnst.SysextStoreDir)
+	if err != nil {
+		return err
+	}
+	origin := available[file]
+	if origin.Source == "" {
+		origin.Source = "file://" + src
+	}
+
+	dir := utils.SysextDir(efiDir, bootState)
+	enabled, err := enabledSysexts(cfg, dir)
+	if err != nil {
+		return err
+	}
+	enabled[name] = origin
+	if err = utils.CheckSysextDependencies(enabled); err != nil {
+		return fmt.Errorf("refusing to enable %s on %s: %w", name, bootState, err)
+	}
+
+	restore, err := remountEfiRW(cfg, efiDir)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	if err = fsutils.MkdirAll(cfg.Fs, dir, cnst.DirPerm); err != nil {
+		return err
+	}
+	if err = fsutils.Copy(cfg.Fs, src, filepath.Join(dir, file)); err != nil {
+		return err
+	}
+	if err = utils.RecordSysextOrigin(cfg.Fs, dir, file, origin); err != nil {
+		return err
+	}
+	cfg.Logger.Infof("Enabled sysext %s on %s", name, bootState)
+	return nil
+}
+
+// DisableSysext removes the sysext name from the given boot entry. It refuses to do it if another sysext
+// enabled on the boot entry requires it.
+// This is the entrypoint for the sysext disable command
+func DisableSysext(cfg *config.Config, efiDir, name, bootState string) error {
+	if err := checkSysextBootState(bootState); err != nil {
+		return err
+	}
+	dir := utils.SysextDir(efiDir, bootState)
+	enabled, err := enabledSysexts(cfg, dir)
+	if err != nil {
+		return err
+	}
+	if _, ok := enabled[name]; !ok {
+		return fmt.Errorf("sysext %s is not enabled on %s", name, bootState)
+	}
+	delete(enabled, name)
+	if err = utils.CheckSysextDependencies(enabled); err != nil {
+		return fmt.Errorf("refusing to disable %s on %s: %w", name, bootState, err)
+	}
+
+	restore, err := remountEfiRW(cfg, efiDir)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	file := name + utils.SysextSuffix
+	if err = cfg.Fs.Remove(filepath.Join(dir, file)); err != nil {
+		return err
+	}
+	origins, err := utils.ReadSysextMetadata(cfg.Fs, dir)
+	if err == nil {
+		delete(origins, file)
+		err = utils.WriteSysextMetadata(cfg.Fs, dir, origins)
+	}
+	if err != nil {
+		cfg.Logger.Warnf("Could not update the sysext metadata in %s: %s", dir, err)
+	}
+	cfg.Logger.Infof("Disabled sysext %s on %s", name, bootState)
+	return nil
+}
+
+func checkSysextBootState(bootState string) error {
+	for _, s := range sysextBootStates {
+		if s == bootState {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid boot entry %s, valid ones are %s", bootState, strings.Join(sysextBootStates, ", "))
+}
+
+// enabledSysexts returns the sysexts in dir, by name, with their recorded origin if any
+func enabledSysexts(cfg *config.Config, dir string) (map[string]utils.SysextOrigin, error) {
+	enabled := map[string]utils.SysextOrigin{}
+	if exists, _ := fsutils.Exists(cfg.Fs, dir); !exists {
+		return enabled, nil
+	}
+	entries, err := cfg.Fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	origins, err := utils.ReadSysextMetadata(cfg.Fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), utils.SysextSuffix) {
+			enabled[strings.TrimSuffix(e.Name(), utils.SysextSuffix)] = origins[e.Name()]
+		}
+	}
+	return enabled, nil
+}
+
+// remountEfiRW remounts the EFI partition, read only on trusted boot systems, as read write.
+// The returned function remounts it back as read only.
+func remountEfiRW(cfg *config.Config, efiDir string) (func(), error) {
+	err := cfg.Syscall.Mount("", efiDir, "", syscall.MS_REMOUNT, "")
+	if err != nil {
+		return nil, fmt.Errorf("could not remount EFI partition: %w", err)
+	}
+	return func() {
+		if err := cfg.Syscall.Mount("", efiDir, "", syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			cfg.Logger.Errorf("could not remount EFI partition as RO: %s", err)
+		}
+	}, nil
+}
@@ -0,0 +1,115 @@
+package action
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v5"
+	"github.com/twpayne/go-vfs/v5/vfst"
+)
+
+var _ = Describe("Sysext tests", Label("sysext"), func() {
+	var config *agentConfig.Config
+	var fs vfs.FS
+	var cleanup func()
+
+	BeforeEach(func() {
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{
+			"/efi/EFI/kairos/active.efi.extra.d/k3s.sysext.raw":   "k3s",
+			"/efi/EFI/kairos/active.efi.extra.d/debug.sysext.raw": "debug",
+			"/efi/EFI/kairos/active.efi.extra.d/README":           "not a sysext",
+			"/efi/EFI/kairos/recovery.efi.extra.d/k3s.sysext.raw": "k3s",
+			"/efi/EFI/kairos/passive.efi.extra.d/.keep":           "",
+		})
+		Expect(err).Should(BeNil())
+		config = agentConfig.NewConfig(
+			agentConfig.WithFs(fs),
+			agentConfig.WithRunner(v1mock.NewFakeRunner()),
+			agentConfig.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})),
+			agentConfig.WithMounter(v1mock.NewErrorMounter()),
+			agentConfig.WithSyscall(&v1mock.FakeSyscall{}),
+		)
+	})
+
+	AfterEach(func() {
+		cleanup()
+	})
+
+	It("lists the sysexts per boot entry with their recorded origin", func() {
+		active := utils.SysextDir("/efi", "active")
+		Expect(utils.RecordSysext(fs, active, "k3s.sysext.raw", "oci://quay.io/kairos/k3s:v1.30")).To(Succeed())
+		Expect(utils.RecordSysext(fs, active, "debug.sysext.raw", "file:///run/initramfs/live/debug.sysext.raw")).To(Succeed())
+		Expect(fs.WriteFile(filepath.Join(active, "debug.sysext.raw"), []byte("tampered"), os.ModePerm)).To(Succeed())
+
+		sysexts, err := ListSysexts(config, "/efi")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sysexts).To(HaveLen(3))
+
+		Expect(sysexts[0].Name).To(Equal("debug"))
+		Expect(sysexts[0].Modified).To(BeTrue())
+		Expect(sysexts[1].Name).To(Equal("k3s"))
+		Expect(sysexts[1].BootState).To(Equal("active"))
+		Expect(sysexts[1].Source).To(Equal("oci://quay.io/kairos/k3s:v1.30"))
+		Expect(sysexts[1].Digest).To(HavePrefix("sha256:"))
+		Expect(sysexts[1].Digest).To(Equal(sysexts[2].Digest))
+		Expect(sysexts[1].Installed).ToNot(BeNil())
+		Expect(sysexts[1].Modified).To(BeFalse())
+
+		Expect(sysexts[2].BootState).To(Equal("recovery"))
+		Expect(sysexts[2].Source).To(BeEmpty())
+		Expect(sysexts[2].Installed).To(BeNil())
+	})
+	It("enables and disables sysexts honoring their requires and conflicts", func() {
+		Expect(fsutils.MkdirAll(fs, cnst.SysextStoreDir, cnst.DirPerm)).To(Succeed())
+		for _, n := range []string{"nvidia-driver", "kernel-modules", "nouveau"} {
+			Expect(fs.WriteFile(filepath.Join(cnst.SysextStoreDir, n+utils.SysextSuffix), []byte(n), os.ModePerm)).To(Succeed())
+		}
+		Expect(utils.WriteSysextMetadata(fs, cnst.SysextStoreDir, map[string]utils.SysextOrigin{
+			"nvidia-driver.sysext.raw": {Source: "oci://quay.io/example/nvidia-driver:550", Requires: []string{"kernel-modules"}, Conflicts: []string{"nouveau"}},
+		})).To(Succeed())
+
+		err := EnableSysext(config, "/efi", "nvidia-driver", "passive")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("nvidia-driver requires kernel-modules"))
+
+		Expect(EnableSysext(config, "/efi", "kernel-modules", "passive")).To(Succeed())
+		Expect(EnableSysext(config, "/efi", "nvidia-driver", "passive")).To(Succeed())
+		Expect(EnableSysext(config, "/efi", "nouveau", "passive")).ToNot(Succeed())
+		Expect(EnableSysext(config, "/efi", "missing", "passive")).ToNot(Succeed())
+		Expect(EnableSysext(config, "/efi", "nouveau", "nope")).ToNot(Succeed())
+
+		err = DisableSysext(config, "/efi", "kernel-modules", "passive")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("nvidia-driver requires kernel-modules"))
+
+		sysexts, err := ListSysexts(config, "/efi")
+		Expect(err).ToNot(HaveOccurred())
+		var passive []Sysext
+		for _, s := range sysexts {
+			if s.BootState == "passive" {
+				passive = append(passive, s)
+			}
+		}
+		Expect(passive).To(HaveLen(2))
+		Expect(passive[1].Name).To(Equal("nvidia-driver"))
+		Expect(passive[1].Source).To(Equal("oci://quay.io/example/nvidia-driver:550"))
+		Expect(passive[1].Requires).To(Equal([]string{"kernel-modules"}))
+
+		Expect(DisableSysext(config, "/efi", "nvidia-driver", "passive")).To(Succeed())
+		Expect(DisableSysext(config, "/efi", "kernel-modules", "passive")).To(Succeed())
+		Expect(DisableSysext(config, "/efi", "kernel-modules", "passive")).ToNot(Succeed())
+		origins, err := utils.ReadSysextMetadata(fs, utils.SysextDir("/efi", "passive"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(origins).To(BeEmpty())
+	})
+})
@@ -17,6 +17,7 @@ limitations under the License.
 package action
 
 import (
+	"context"
 	"fmt"
 	"path/filepath"
 	"syscall"
@@ -35,12 +36,19 @@ import (
 type UpgradeAction struct {
 	config *agentConfig.Config
 	spec   *v1.UpgradeSpec
+	// deployed is the version of the deployed image, known once it is deployed
+	deployed SystemVersion
 }
 
 func NewUpgradeAction(config *agentConfig.Config, spec *v1.UpgradeSpec) *UpgradeAction {
 	return &UpgradeAction{config: config, spec: spec}
 }
 
+// Deployed returns the version of the image deployed by the upgrade, empty until it runs
+func (u *UpgradeAction) Deployed() SystemVersion {
+	return u.deployed
+}
+
 func (u UpgradeAction) Info(s string, args ...interface{}) {
 	u.config.Logger.Infof(s, args...)
 }
@@ -119,6 +127,27 @@ func (u *UpgradeAction) upgradeInstallStateYaml(meta interface{}, img v1.Image)
 	)
 }
 
+// setDeltaBase sets the active image as the base of the delta deploy, if the layers it was deployed from are known
+func (u *UpgradeAction) setDeltaBase(e *elemental.Elemental, activeFile string) {
+	var meta *v1.DockerImageMeta
+	if u.spec.State != nil {
+		if part := u.spec.State.Partitions[constants.StatePartName]; part != nil {
+			if img := part.Images[constants.ActiveImgName]; img != nil {
+				meta, _ = img.SourceMetadata.(*v1.DockerImageMeta)
+			}
+		}
+	}
+	if meta == nil || len(meta.Layers) == 0 {
+		u.config.Logger.Warnf("The layers of the active image are unknown, the upgrade is not a delta")
+		return
+	}
+	if ok, _ := fsutils.Exists(u.config.Fs, activeFile); !ok {
+		u.config.Logger.Warnf("The active image %s was not found, the upgrade is not a delta", activeFile)
+		return
+	}
+	e.SetDeltaBase(activeFile, meta.Layers)
+}
+
 func (u *UpgradeAction) Run() (err error) {
 	var upgradeImg v1.Image
 	var finalImageFile string
@@ -133,34 +162,64 @@ func (u *UpgradeAction) Run() (err error) {
 		u.config.Logger.Warnf("error detecting boot: %s", err)
 	}
 
+	action := "upgrade"
+	if u.spec.RecoveryUpgrade() {
+		action = "upgrade-recovery"
+	}
+	progress := utils.NewProgress(u.config, action)
+	defer func() { progress.Done(err) }()
+
 	cleanup := utils.NewCleanStack()
 	defer func() { err = cleanup.Cleanup(err) }()
 
 	e := elemental.NewElemental(u.config)
+	e.SetDownloadTimeout(u.spec.Timeouts.Download)
+	e.SetBootableCheck(!u.spec.Force)
+	deadline := utils.NewDeadline(u.spec.Timeouts.Total)
 
-	if u.spec.RecoveryUpgrade() {
-		upgradeImg = u.spec.Recovery
-		if upgradeImg.FS == constants.SquashFs {
-			finalImageFile = filepath.Join(u.spec.Partitions.Recovery.MountPoint, "cOS", constants.RecoverySquashFile)
-		} else {
-			finalImageFile = filepath.Join(u.spec.Partitions.Recovery.MountPoint, "cOS", constants.RecoveryImgFile)
-		}
-	} else {
-		upgradeImg = u.spec.Active
-		finalImageFile = filepath.Join(u.spec.Partitions.State.MountPoint, "cOS", constants.ActiveImgFile)
+	// Deferred recovery upgrades are only scheduled, recovery gets rebuilt in the background after a reboot
+	if u.spec.RecoveryUpgrade() && u.spec.DeferRecovery {
+		return ScheduleRecoveryJob(u.config, u.spec.Recovery.Source)
 	}
 
+	upgradeImg = *u.spec.TargetImage()
+	finalImageFile = upgradeFinalImageFile(u.spec)
+
+	progress.Phase("mount", 5, "Mounting the state and recovery partitions")
 	umount, err := e.MountRWPartition(u.spec.Partitions.State)
 	if err != nil {
 		return err
 	}
 	cleanup.Push(umount)
+	var upgradeMeta interface{}
+	history := newHistoryEntry(action)
+	cleanup.Push(func() error {
+		history.record(u.config, u.spec.Partitions.State.MountPoint, upgradeImg.Source, upgradeMeta, err)
+		return nil
+	})
 	umount, err = e.MountRWPartition(u.spec.Partitions.Recovery)
 	if err != nil {
 		return err
 	}
 	cleanup.Push(umount)
 
+	// Limit the upgrade disk IO so it does not starve the running workloads
+	if u.spec.IOLimit.Class != "" || u.spec.IOLimit.Bandwidth > 0 {
+		target := u.spec.Partitions.State
+		if u.spec.RecoveryUpgrade() {
+			target = u.spec.Partitions.Recovery
+		}
+		restoreIO, err := utils.ApplyIOLimit(u.config, u.spec.IOLimit, target.Path)
+		if err != nil {
+			u.config.Logger.Warnf("could not limit the upgrade IO, upgrading without limits: %s", err)
+		} else {
+			cleanup.Push(restoreIO)
+		}
+	}
+
+	// Cap the download bandwidth so the pulls do not saturate an uplink shared with the running workloads
+	utils.LimitDownloadBandwidth(u.config, u.spec.MaxBandwidth)
+
 	// Cleanup transition image file before leaving
 	cleanup.Push(func() error { return u.remove(upgradeImg.File) })
 
@@ -181,21 +240,66 @@ func (u *UpgradeAction) Run() (err error) {
 		}
 	}
 
+	// Keep low memory devices from running out of memory while extracting the image
+	persistentTmp := ""
+	if persistentPart != nil {
+		if mnt, _ := utils.IsMounted(u.config, persistentPart); mnt {
+			persistentTmp = filepath.Join(persistentPart.MountPoint, "tmp")
+		}
+	}
+	restoreResources, err := utils.ApplyResourceGuard(u.config, u.spec.ResourceGuard, persistentTmp)
+	if err != nil {
+		u.config.Logger.Warnf("could not check the available resources, upgrading without the resource guard: %s", err)
+	} else {
+		cleanup.Push(restoreResources)
+	}
+
 	// before upgrade hook happens once partitions are RW mounted, just before image OS is deployed
-	err = u.upgradeHook(constants.BeforeUpgradeHook, false)
+	err = deadline.Run(constants.BeforeUpgradeHook, 0, func(context.Context) error {
+		return u.upgradeHook(constants.BeforeUpgradeHook, false)
+	})
 	if err != nil {
 		u.Error("Error while running hook before-upgrade: %s", err)
 		return err
 	}
 
-	u.Info("deploying image %s to %s", upgradeImg.Source.Value(), upgradeImg.File)
-	upgradeMeta, err := e.DeployImage(&upgradeImg, true)
-	if err != nil {
+	if u.spec.Delta && !u.spec.RecoveryUpgrade() {
+		u.setDeltaBase(e, finalImageFile)
+	}
+
+	candidates := u.spec.SourceCandidates()
+	if len(candidates) == 0 {
+		candidates = []*v1.ImageSource{upgradeImg.Source}
+	}
+	for i, src := range candidates {
+		if i > 0 {
+			// Deploying from a fallback source, start over from a clean image file sized for it
+			_ = u.remove(upgradeImg.File)
+			if size, err := agentConfig.GetSourceSize(u.config, src); err == nil && uint(size) > upgradeImg.Size {
+				upgradeImg.Size = uint(size)
+			}
+		}
+		upgradeImg.Source = src
+		u.Info("deploying image %s to %s", upgradeImg.Source.Value(), upgradeImg.File)
+		progress.Phase("deploy", 10, fmt.Sprintf("Deploying %s", upgradeImg.Source.Value()))
+		err = deadline.Run(fmt.Sprintf("deploying %s", upgradeImg.Source.Value()), u.spec.Timeouts.Deploy, func(ctx context.Context) (err error) {
+			upgradeMeta, err = e.WithContext(ctx).DeployImage(&upgradeImg, true)
+			return err
+		})
+		if err == nil {
+			break
+		}
 		u.Error("Failed deploying image to file '%s': %s", upgradeImg.File, err)
-		return err
+		if i == len(candidates)-1 {
+			return err
+		}
+		u.config.Logger.Warnf("Trying the next upgrade source %s", candidates[i+1].String())
 	}
+	// Keep the spec pointing to the deployed source, i.e. for the deferred recovery job
+	u.spec.TargetImage().Source = upgradeImg.Source
 	cleanup.Push(func() error { return e.UnmountImage(&upgradeImg) })
 
+	progress.Phase("configure", 60, "Configuring the upgraded image")
 	// Create extra dirs in rootfs as afterwards this will be impossible due to RO system
 	createExtraDirsInRootfs(u.config, u.spec.ExtraDirsRootfs, upgradeImg.MountPoint)
 
@@ -212,16 +316,43 @@ func (u *UpgradeAction) Run() (err error) {
 		if mnt, _ := utils.IsMounted(u.config, u.spec.Partitions.OEM); mnt {
 			binds[u.spec.Partitions.OEM.MountPoint] = constants.OEMPath
 		}
-		err = utils.ChrootedCallback(
-			u.config, upgradeImg.MountPoint, binds,
-			func() error { return e.SelinuxRelabel("/", true) },
-		)
+		err = deadline.Run("selinux relabel", 0, func(context.Context) error {
+			return utils.ChrootedCallback(
+				u.config, upgradeImg.MountPoint, binds,
+				func() error { return e.SelinuxRelabel("/", true) },
+			)
+		})
 		if err != nil {
 			return err
 		}
 	}
 
-	err = u.upgradeHook(constants.AfterUpgradeChrootHook, true)
+	// Keep the network disk credentials of the running system in the initramfs of the new image
+	if upgradeImg.FS != constants.SquashFs {
+		if err = KeepNetworkDiskCredentials(u.config, e, upgradeImg.MountPoint); err != nil {
+			u.Error("Error adding the network disk credentials to the initrd: %s", err)
+			return err
+		}
+	} else if exists, _ := fsutils.Exists(u.config.Fs, constants.NetworkDiskCredentialsConf); exists {
+		u.config.Logger.Warnf("Cannot add the network disk credentials to a %s image, it won't boot from the network disk", constants.SquashFs)
+	}
+
+	// Regenerate the initramfs inside the new image if requested, squashfs images are read only at this point
+	if u.spec.RegenerateInitrd {
+		if upgradeImg.FS == constants.SquashFs {
+			u.config.Logger.Warnf("Cannot regenerate initrd on a %s image, skipping", constants.SquashFs)
+		} else {
+			err = e.RegenerateInitrd(upgradeImg.MountPoint)
+			if err != nil {
+				u.Error("Error regenerating initrd: %s", err)
+				return err
+			}
+		}
+	}
+
+	err = deadline.Run(constants.AfterUpgradeChrootHook, 0, func(context.Context) error {
+		return u.upgradeHook(constants.AfterUpgradeChrootHook, true)
+	})
 	if err != nil {
 		u.Error("Error running hook after-upgrade-chroot: %s", err)
 		return err
@@ -236,12 +367,21 @@ func (u *UpgradeAction) Run() (err error) {
 		}
 	}
 
+	u.deployed = ReadSystemVersion(u.config.Fs, upgradeImg.MountPoint)
 	err = e.UnmountImage(&upgradeImg)
 	if err != nil {
 		u.Error("failed unmounting transition image")
 		return err
 	}
 
+	progress.Phase("switch", 80, "Replacing the current image")
+	// Make sure the new image is on disk before it replaces the current one
+	err = e.SyncImage(&upgradeImg)
+	if err != nil {
+		u.Error("Failed syncing the transition image: %s", err)
+		return err
+	}
+
 	// If not upgrading recovery and booting from non passive, backup active into passive
 	// We dont want to overwrite passive if we are booting from passive as it could mean that active is broken and we would
 	// be overriding a working passive with a broken/unknown  active
@@ -275,8 +415,17 @@ func (u *UpgradeAction) Run() (err error) {
 	u.Info("Finished moving %s to %s", upgradeImg.File, finalImageFile)
 
 	syscall.Sync()
+	// Sync does not report write errors, flush the final image and its rename explicitly to catch them
+	err = fsutils.SyncFile(u.config.Fs, finalImageFile)
+	if err != nil {
+		u.Error("Failed syncing %s: %s", finalImageFile, err)
+		return err
+	}
 
-	err = u.upgradeHook(constants.AfterUpgradeHook, false)
+	progress.Phase("finalize", 90, "Running the after upgrade hooks")
+	err = deadline.Run(constants.AfterUpgradeHook, 0, func(context.Context) error {
+		return u.upgradeHook(constants.AfterUpgradeHook, false)
+	})
 	if err != nil {
 		u.Error("Error running hook after-upgrade: %s", err)
 		return err
@@ -290,7 +439,25 @@ func (u *UpgradeAction) Run() (err error) {
 	}
 
 	u.Info("Upgrade completed")
+	if !u.spec.RecoveryUpgrade() && len(u.spec.SmokeTests) > 0 {
+		if err = ScheduleSmokeTests(u.config, u.spec.SmokeTests); err != nil {
+			u.config.Logger.Warnf("could not schedule the smoke tests, the upgraded image will not be checked: %s", err)
+		}
+	}
 	if !u.spec.RecoveryUpgrade() {
+		if err = ArmWatchdog(u.config); err != nil {
+			u.config.Logger.Warnf("could not arm the watchdog, the upgraded system will not be remediated: %s", err)
+		}
+	}
+	if !u.spec.RecoveryUpgrade() && u.spec.DeferRecovery {
+		source := u.spec.Recovery.Source
+		if source == nil || source.IsEmpty() {
+			source = u.spec.Active.Source
+		}
+		if err = ScheduleRecoveryJob(u.config, source); err != nil {
+			u.config.Logger.Warnf("could not defer the recovery upgrade, upgrade it with the --recovery flag: %s", err)
+		}
+	} else if !u.spec.RecoveryUpgrade() {
 		u.config.Logger.Warn("Remember that recovery is upgraded separately by passing the --recovery flag to the upgrade command!\n" +
 			"See more info about this on https://kairos.io/docs/upgrade/")
 	}
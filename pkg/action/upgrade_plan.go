@@ -0,0 +1,178 @@
+package action
+
+import (
+	"path/filepath"
+	"strings"
+
+	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/kairos-io/kairos-sdk/state"
+	"github.com/kairos-io/kairos-sdk/types"
+)
+
+// Actions of the images in an UpgradePlan
+const (
+	PlanDeploy = "deploy"
+	PlanBackup = "backup"
+)
+
+// UpgradePlan is what an upgrade would do with a resolved and sanitized spec, without writing anything
+type UpgradePlan struct {
+	Entry  string `json:"entry" yaml:"entry"`
+	Source string `json:"source" yaml:"source"`
+	// Fallbacks are the sources tried in order if deploying the source fails
+	Fallbacks []string `json:"fallbacks,omitempty" yaml:"fallbacks,omitempty"`
+	Delta     bool     `json:"delta,omitempty" yaml:"delta,omitempty"`
+	// Scheduled is set when the upgrade only schedules the deferred recovery rebuild, nothing is deployed then
+	Scheduled bool `json:"scheduled,omitempty" yaml:"scheduled,omitempty"`
+	// DeferRecovery is set when recovery is rebuilt from the same source after the next reboot
+	DeferRecovery bool `json:"defer-recovery,omitempty" yaml:"defer-recovery,omitempty"`
+	// Transition is the file the new image is deployed to before it replaces the current one
+	Transition string             `json:"transition,omitempty" yaml:"transition,omitempty"`
+	Images     []PlannedImage     `json:"images,omitempty" yaml:"images,omitempty"`
+	Partitions []PlannedPartition `json:"partitions,omitempty" yaml:"partitions,omitempty"`
+	// RequiredSpace is the estimated space in MB needed on the target partition while the transition image exists
+	RequiredSpace uint `json:"required-space,omitempty" yaml:"required-space,omitempty"`
+	// EfiSpace is the accounting of the EFI partition space of trusted boot upgrades
+	EfiSpace *EfiSpace `json:"efi-space,omitempty" yaml:"efi-space,omitempty"`
+}
+
+// PlannedImage is an image file the upgrade writes
+type PlannedImage struct {
+	Name   string `json:"name" yaml:"name"`
+	Action string `json:"action" yaml:"action"`
+	File   string `json:"file" yaml:"file"`
+	Label  string `json:"label,omitempty" yaml:"label,omitempty"`
+	FS     string `json:"fs,omitempty" yaml:"fs,omitempty"`
+	// Size is the estimated size in MB
+	Size uint `json:"size,omitempty" yaml:"size,omitempty"`
+	// From is the source deployed or the file backed up
+	From string `json:"from" yaml:"from"`
+}
+
+// PlannedPartition is a partition the upgrade mounts read-write
+type PlannedPartition struct {
+	Name       string `json:"name" yaml:"name"`
+	Label      string `json:"label,omitempty" yaml:"label,omitempty"`
+	Device     string `json:"device,omitempty" yaml:"device,omitempty"`
+	MountPoint string `json:"mountpoint" yaml:"mountpoint"`
+	// Size is the size in MB, if known
+	Size    uint   `json:"size,omitempty" yaml:"size,omitempty"`
+	Purpose string `json:"purpose" yaml:"purpose"`
+}
+
+// upgradeFinalImageFile is the path the upgraded image ends up at
+func upgradeFinalImageFile(spec *v1.UpgradeSpec) string {
+	if spec.RecoveryUpgrade() {
+		if spec.Recovery.FS == constants.SquashFs {
+			return filepath.Join(spec.Partitions.Recovery.MountPoint, "cOS", constants.RecoverySquashFile)
+		}
+		return filepath.Join(spec.Partitions.Recovery.MountPoint, "cOS", constants.RecoveryImgFile)
+	}
+	return filepath.Join(spec.Partitions.State.MountPoint, "cOS", constants.ActiveImgFile)
+}
+
+// NewUpgradePlan resolves what the upgrade action would do with the given spec on the running system, following
+// the same decisions as Run. The spec is expected to be sanitized already.
+func NewUpgradePlan(cfg *agentConfig.Config, spec *v1.UpgradeSpec) *UpgradePlan {
+	target := spec.TargetImage()
+	plan := &UpgradePlan{
+		Entry:  constants.ActiveImgName,
+		Source: target.Source.String(),
+		Delta:  spec.Delta && !spec.RecoveryUpgrade(),
+	}
+	if spec.RecoveryUpgrade() {
+		plan.Entry = constants.RecoveryImgName
+	}
+	for _, src := range spec.Sources {
+		plan.Fallbacks = append(plan.Fallbacks, src.String())
+	}
+
+	if spec.RecoveryUpgrade() && spec.DeferRecovery {
+		plan.Scheduled = true
+		return plan
+	}
+	plan.DeferRecovery = spec.DeferRecovery
+
+	plan.Transition = target.File
+	plan.RequiredSpace = target.Size
+	final := upgradeFinalImageFile(spec)
+	plan.Images = append(plan.Images, PlannedImage{
+		Name:   plan.Entry,
+		Action: PlanDeploy,
+		File:   final,
+		Label:  target.Label,
+		FS:     target.FS,
+		Size:   target.Size,
+		From:   plan.Source,
+	})
+
+	// Passive is only replaced when not booting from it, same as Run
+	bootedFrom, _ := state.DetectBootWithVFS(cfg.Fs)
+	if !spec.RecoveryUpgrade() && bootedFrom != state.Passive {
+		plan.Images = append(plan.Images, PlannedImage{
+			Name:   constants.PassiveImgName,
+			Action: PlanBackup,
+			File:   spec.Passive.File,
+			Label:  spec.Passive.Label,
+			FS:     spec.Passive.FS,
+			From:   final,
+		})
+	}
+
+	targetPart := spec.Partitions.State
+	if spec.RecoveryUpgrade() {
+		targetPart = spec.Partitions.Recovery
+	}
+	add := func(p *types.Partition, purpose string) {
+		if p == nil {
+			return
+		}
+		plan.Partitions = append(plan.Partitions, PlannedPartition{
+			Name:       p.Name,
+			Label:      p.FilesystemLabel,
+			Device:     p.Path,
+			MountPoint: p.MountPoint,
+			Size:       p.Size,
+			Purpose:    purpose,
+		})
+	}
+	add(targetPart, "holds the transition and upgraded images")
+	if spec.RecoveryUpgrade() {
+		add(spec.Partitions.State, "mounted read-write")
+	} else {
+		add(spec.Partitions.Recovery, "stores the install state")
+	}
+	add(spec.Partitions.Persistent, "temporary space while extracting the image")
+	return plan
+}
+
+// NewUkiUpgradePlan resolves what the trusted boot upgrade would do with the given spec on the running system, with
+// the accounting of the space it needs in the EFI partition
+func NewUkiUpgradePlan(cfg *agentConfig.Config, efiDir string, spec *v1.UpgradeUkiSpec) (*UpgradePlan, error) {
+	plan := &UpgradePlan{Entry: constants.ActiveImgName}
+	if spec.Active.Source != nil {
+		plan.Source = spec.Active.Source.String()
+	}
+	if spec.Entry != "" {
+		plan.Entry = spec.Entry
+	}
+	space, err := NewEfiSpace(cfg, efiDir, spec)
+	if err != nil {
+		return nil, err
+	}
+	plan.EfiSpace = space
+	plan.RequiredSpace = uint((space.NeededBytes + mib - 1) / mib)
+	for i, f := range space.Planned {
+		img := PlannedImage{Name: plan.Entry, Action: PlanDeploy, File: f.Path, Size: uint((f.SizeBytes + mib - 1) / mib), From: plan.Source}
+		// The rest of the planned files are the active entries and extensions moving to passive
+		if i > 0 {
+			img.Name = constants.PassiveImgName
+			img.Action = PlanBackup
+			img.From = filepath.Join(filepath.Dir(f.Path), strings.Replace(filepath.Base(f.Path), constants.PassiveImgName, constants.ActiveImgName, 1))
+		}
+		plan.Images = append(plan.Images, img)
+	}
+	return plan, nil
+}
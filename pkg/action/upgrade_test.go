@@ -18,17 +18,20 @@ package action_test
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/kairos-io/kairos-agent/v2/pkg/action"
 	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
 	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils"
 	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
 	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
 	ghwMock "github.com/kairos-io/kairos-sdk/ghw/mocks"
 	sdkTypes "github.com/kairos-io/kairos-sdk/types"
 	"os"
 	"path/filepath"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -99,6 +102,9 @@ var _ = Describe("Upgrade Actions test", func() {
 			memLog = &bytes.Buffer{}
 			logger = sdkTypes.NewBufferLogger(memLog)
 			extractor = v1mock.NewFakeImageExtractor(logger)
+			extractor.SideEffect = func(_, destination, _ string) error {
+				return createBootableTree(fs, destination)
+			}
 			config.Logger = logger
 			config.ImageExtractor = extractor
 			logger.SetLevel("debug")
@@ -243,6 +249,115 @@ var _ = Describe("Upgrade Actions test", func() {
 				_, err = fs.Stat(spec.Active.File)
 				Expect(err).To(HaveOccurred())
 			})
+			It("Fails and cleans up if the download times out", Label("docker", "timeout"), func() {
+				spec.Active.Source = v1.NewDockerSrc("alpine")
+				spec.Timeouts.Download = 50 * time.Millisecond
+				release := make(chan struct{})
+				defer close(release)
+				extractor.SideEffect = func(_, _, _ string) error {
+					<-release
+					return nil
+				}
+				upgrade = action.NewUpgradeAction(config, spec)
+				err := upgrade.Run()
+				Expect(err).To(HaveOccurred())
+				var timeoutErr *utils.TimeoutError
+				Expect(errors.As(err, &timeoutErr)).To(BeTrue())
+				Expect(timeoutErr.Total).To(BeFalse())
+
+				// Active is untouched and the transition image is gone
+				f, _ := fs.ReadFile(activeImg)
+				Expect(f).To(ContainSubstring("active"))
+				_, err = fs.Stat(spec.Active.File)
+				Expect(err).To(HaveOccurred())
+			})
+			It("Falls back to the next source if deploying the image fails", Label("docker"), func() {
+				spec.Active.Source = v1.NewDockerSrc("registry.invalid/kairos")
+				spec.Sources = []*v1.ImageSource{v1.NewDockerSrc("registry.invalid/kairos"), v1.NewDockerSrc("mirror.local/kairos")}
+				var pulled []string
+				extractor.SideEffect = func(imageRef, destination, _ string) error {
+					pulled = append(pulled, imageRef)
+					if imageRef == "registry.invalid/kairos" {
+						return errors.New("registry unreachable")
+					}
+					return createBootableTree(fs, destination)
+				}
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).To(Succeed())
+				Expect(pulled).To(Equal([]string{"registry.invalid/kairos", "mirror.local/kairos"}))
+				Expect(spec.Active.Source.Value()).To(Equal("mirror.local/kairos"))
+				Expect(memLog).To(ContainSubstring("Trying the next upgrade source"))
+			})
+			It("Schedules the smoke tests for the next boot", Label("docker", "smoke-tests"), func() {
+				spec.Active.Source = v1.NewDockerSrc("alpine")
+				spec.SmokeTests = []v1.SmokeTest{{Unit: "k3s.service"}}
+				extractor.SideEffect = func(_, destination, _ string) error {
+					return createBootableTree(fs, destination)
+				}
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).To(Succeed())
+				run, err := action.ReadSmokeTests(fs)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(run.Status).To(Equal(action.SmokeTestsPending))
+				Expect(run.Tests).To(Equal(spec.SmokeTests))
+				_, err = fs.Stat(constants.SmokeTestsStageFile)
+				Expect(err).ToNot(HaveOccurred())
+			})
+			It("Fails if all the sources fail", Label("docker"), func() {
+				spec.Active.Source = v1.NewDockerSrc("registry.invalid/kairos")
+				spec.Sources = []*v1.ImageSource{v1.NewDockerSrc("mirror.invalid/kairos")}
+				extractor.SideEffect = func(_, _, _ string) error {
+					return errors.New("registry unreachable")
+				}
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).ToNot(Succeed())
+
+				// Active is untouched and the transition image is gone
+				f, _ := fs.ReadFile(activeImg)
+				Expect(f).To(ContainSubstring("active"))
+				_, err := fs.Stat(spec.Active.File)
+				Expect(err).To(HaveOccurred())
+			})
+			It("Records the upgrades in the history journal", Label("docker", "history"), func() {
+				spec.Active.Source = v1.NewDockerSrc("registry.invalid/kairos")
+				extractor.SideEffect = func(imageRef, destination, _ string) error {
+					if imageRef == "registry.invalid/kairos" {
+						return errors.New("registry unreachable")
+					}
+					return createBootableTree(fs, destination)
+				}
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).ToNot(Succeed())
+				spec.Active.Source = v1.NewDockerSrc("alpine")
+				upgrade = action.NewUpgradeAction(config, spec)
+				Expect(upgrade.Run()).To(Succeed())
+
+				history, err := action.ReadHistory(fs, filepath.Join(spec.Partitions.State.MountPoint, constants.HistoryFile))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(history).To(HaveLen(2))
+				Expect(history[0].Operation).To(Equal("upgrade"))
+				Expect(history[0].Source).To(Equal("oci://registry.invalid/kairos"))
+				Expect(history[0].Result).To(Equal(action.HistoryFailed))
+				Expect(history[0].Error).To(ContainSubstring("registry unreachable"))
+				Expect(history[1].Source).To(Equal("oci://alpine"))
+				Expect(history[1].Result).To(Equal(action.HistorySuccess))
+				Expect(history[1].Finished).ToNot(BeTemporally("<", history[1].Started))
+			})
+			It("Fails if the overall deadline is exceeded", Label("docker", "timeout"), func() {
+				spec.Active.Source = v1.NewDockerSrc("alpine")
+				spec.Timeouts.Deploy = time.Hour
+				spec.Timeouts.Total = 50 * time.Millisecond
+				release := make(chan struct{})
+				defer close(release)
+				extractor.SideEffect = func(_, _, _ string) error {
+					<-release
+					return nil
+				}
+				upgrade = action.NewUpgradeAction(config, spec)
+				err := upgrade.Run()
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("overall deadline"))
+			})
 			It("Successfully reboots after upgrade from docker image", Label("docker"), func() {
 				spec.Active.Source = v1.NewDockerSrc("alpine")
 				upgrade = action.NewUpgradeAction(config, spec)
@@ -315,6 +430,7 @@ var _ = Describe("Upgrade Actions test", func() {
 				defer fs.RemoveAll(dirSrc)
 				spec.Active.Source = v1.NewDirSrc(dirSrc)
 				// create a random file on it
+				Expect(createBootableTree(fs, dirSrc)).To(Succeed())
 				err := fs.WriteFile(fmt.Sprintf("%s/file.file", dirSrc), []byte("something"), constants.FilePerm)
 				Expect(err).ToNot(HaveOccurred())
 
@@ -349,6 +465,24 @@ var _ = Describe("Upgrade Actions test", func() {
 				Expect(err).To(HaveOccurred())
 
 			})
+			It("Plans the upgrade without writing anything", Label("plan"), func() {
+				spec.Active.Source = v1.NewDockerSrc("quay.io/kairos/new:latest")
+				plan := action.NewUpgradePlan(config, spec)
+				Expect(plan.Entry).To(Equal(constants.ActiveImgName))
+				Expect(plan.Source).To(Equal("oci://quay.io/kairos/new:latest"))
+				Expect(plan.Transition).To(Equal(spec.Active.File))
+				Expect(plan.RequiredSpace).To(Equal(uint(10)))
+				Expect(plan.Images).To(HaveLen(2))
+				Expect(plan.Images[0]).To(Equal(action.PlannedImage{
+					Name: constants.ActiveImgName, Action: action.PlanDeploy, File: filepath.Join(spec.Partitions.State.MountPoint, "cOS", constants.ActiveImgFile),
+					Label: spec.Active.Label, FS: spec.Active.FS, Size: 10, From: plan.Source,
+				}))
+				Expect(plan.Images[1].Action).To(Equal(action.PlanBackup))
+				Expect(plan.Images[1].File).To(Equal(spec.Passive.File))
+				Expect(plan.Partitions[0].Label).To(Equal(constants.StateLabel))
+				_, err = fs.Stat(spec.Active.File)
+				Expect(err).To(HaveOccurred())
+			})
 		})
 		Describe(fmt.Sprintf("Booting from %s", constants.PassiveLabel), Label("passive_label"), func() {
 			var err error
@@ -435,6 +569,11 @@ var _ = Describe("Upgrade Actions test", func() {
 				Expect(err).To(HaveOccurred())
 
 			})
+			It("Plans no passive backup", Label("plan"), func() {
+				plan := action.NewUpgradePlan(config, spec)
+				Expect(plan.Images).To(HaveLen(1))
+				Expect(plan.Images[0].Action).To(Equal(action.PlanDeploy))
+			})
 		})
 		Describe(fmt.Sprintf("Booting from %s", constants.RecoveryLabel), Label("recovery_label"), func() {
 			Describe("Using squashfs", Label("squashfs"), func() {
@@ -511,6 +650,7 @@ var _ = Describe("Upgrade Actions test", func() {
 					srcDir, _ := fsutils.TempDir(fs, "", "elemental")
 					// create a random file on it
 					_ = fs.WriteFile(fmt.Sprintf("%s/file.file", srcDir), []byte("something"), constants.FilePerm)
+					Expect(createBootableTree(fs, srcDir)).To(Succeed())
 
 					spec.Recovery.Source = v1.NewDirSrc(srcDir)
 					upgrade = action.NewUpgradeAction(config, spec)
@@ -529,6 +669,24 @@ var _ = Describe("Upgrade Actions test", func() {
 					Expect(err).To(HaveOccurred())
 
 				})
+				It("Only schedules the deferred recovery upgrades", Label("docker"), func() {
+					spec.Recovery.Source = v1.NewDockerSrc("alpine")
+					spec.DeferRecovery = true
+					upgrade = action.NewUpgradeAction(config, spec)
+					Expect(upgrade.Run()).To(Succeed())
+
+					// The recovery image is untouched
+					f, _ := fs.ReadFile(recoveryImgSquash)
+					Expect(f).To(ContainSubstring("recovery"))
+					Expect(runner.IncludesCmds([][]string{{"mksquashfs"}})).ToNot(Succeed())
+
+					job, err := action.ReadRecoveryJob(fs)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(job.Source).To(Equal("oci://alpine"))
+					Expect(job.Status).To(Equal(action.RecoveryJobPending))
+					_, err = fs.Stat(constants.RecoveryJobStageFile)
+					Expect(err).ToNot(HaveOccurred())
+				})
 			})
 			Describe("Not using squashfs", Label("non-squashfs"), func() {
 				var err error
@@ -602,6 +760,7 @@ var _ = Describe("Upgrade Actions test", func() {
 					srcDir, _ := fsutils.TempDir(fs, "", "elemental")
 					// create a random file on it
 					_ = fs.WriteFile(fmt.Sprintf("%s/file.file", srcDir), []byte("something"), constants.FilePerm)
+					Expect(createBootableTree(fs, srcDir)).To(Succeed())
 
 					spec.Recovery.Source = v1.NewDirSrc(srcDir)
 
@@ -0,0 +1,297 @@
+package action
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	"github.com/kairos-io/kairos-sdk/state"
+	"gopkg.in/yaml.v3"
+)
+
+// Upgrade transaction statuses
+const (
+	TransactionApplying   = "applying"
+	TransactionAssessing  = "assessing"
+	TransactionCommitted  = "committed"
+	TransactionRolledBack = "rolled-back"
+	TransactionFailed     = "failed"
+)
+
+// transactionGrubEnv is the grub environment holding the boot entry selection
+const transactionGrubEnv = "/oem/grubenv"
+
+// transactionBootVars are the grub environment variables selecting the boot entry, the ones snapshotted before
+// the upgrade and restored on rollback
+var transactionBootVars = []string{"next_entry", "saved_entry"}
+
+// transactionStage checks the outcome of the transaction on every boot until it is committed or rolled back.
+// It runs in the background, the assessment of the new image can take a while.
+const transactionStage = `name: "Upgrade transaction"
+stages:
+  boot:
+    - name: "Check the outcome of the upgrade transaction"
+      commands:
+        - |
+          if [ -d /run/systemd/system ]; then
+            systemd-run --unit=kairos-upgrade-transaction --collect kairos-agent upgrade transaction
+          else
+            nohup kairos-agent upgrade transaction >/dev/null 2>&1 &
+          fi
+`
+
+// TransactionStep is a step the upgrade transaction went through
+type TransactionStep struct {
+	Name string    `yaml:"name" json:"name"`
+	Time time.Time `yaml:"time" json:"time"`
+}
+
+// UpgradeTransaction is an upgrade applied with --rollback-on-failure: the bootloader state is snapshotted, the new
+// image is downloaded and applied, the system reboots into it with the watchdog armed and the snapshot is restored
+// along the previous image if the new one fails its assessment. It lives in the OEM partition, so all the boot
+// entries see it.
+type UpgradeTransaction struct {
+	Source string `yaml:"source" json:"source"`
+	Status string `yaml:"status" json:"status"`
+	// Expected is the version of the deployed image, which upgrade verify compares with the booted one
+	Expected *SystemVersion `yaml:"expected,omitempty" json:"expected,omitempty"`
+	// Bootloader is the snapshot of the boot entry selection taken before upgrading
+	Bootloader map[string]string `yaml:"bootloader" json:"bootloader"`
+	Steps      []TransactionStep `yaml:"steps" json:"steps"`
+	Started    time.Time         `yaml:"started" json:"started"`
+	Finished   *time.Time        `yaml:"finished,omitempty" json:"finished,omitempty"`
+	Error      string            `yaml:"error,omitempty" json:"error,omitempty"`
+}
+
+// Step records the transaction reached the given step
+func (t *UpgradeTransaction) Step(cfg *config.Config, name string) error {
+	t.Steps = append(t.Steps, TransactionStep{Name: name, Time: time.Now()})
+	return writeTransaction(cfg, t)
+}
+
+// Reporter returns a progress reporter recording the phases of the upgrade action as transaction steps, and
+// forwarding them to the given reporter
+func (t *UpgradeTransaction) Reporter(cfg *config.Config, next v1.ProgressReporter) v1.ProgressReporter {
+	if next == nil {
+		next = v1.NullProgress{}
+	}
+	return &transactionProgress{cfg: cfg, t: t, next: next}
+}
+
+type transactionProgress struct {
+	cfg  *config.Config
+	t    *UpgradeTransaction
+	next v1.ProgressReporter
+}
+
+func (p *transactionProgress) Report(r v1.ProgressRecord) {
+	switch r.Phase {
+	case utils.ProgressStart, utils.ProgressDone, utils.ProgressFailed:
+	default:
+		if err := p.t.Step(p.cfg, r.Phase); err != nil {
+			p.cfg.Logger.Warnf("Could not record the upgrade transaction step %s: %s", r.Phase, err)
+		}
+	}
+	p.next.Report(r)
+}
+
+// ReadUpgradeTransaction returns the last upgrade transaction, or nil if there is none
+func ReadUpgradeTransaction(fs v1.FS) (*UpgradeTransaction, error) {
+	if exists, _ := fsutils.Exists(fs, cnst.UpgradeTransactionFile); !exists {
+		return nil, nil
+	}
+	data, err := fs.ReadFile(cnst.UpgradeTransactionFile)
+	if err != nil {
+		return nil, err
+	}
+	t := &UpgradeTransaction{}
+	if err = yaml.Unmarshal(data, t); err != nil {
+		return nil, fmt.Errorf("parsing upgrade transaction %s: %w", cnst.UpgradeTransactionFile, err)
+	}
+	return t, nil
+}
+
+// BeginUpgradeTransaction snapshots the bootloader state and starts a transaction upgrading to the given source.
+// Only one transaction can be in progress, unless forced.
+func BeginUpgradeTransaction(cfg *config.Config, source string, force bool) (*UpgradeTransaction, error) {
+	if utils.IsUkiWithFs(cfg.Fs) {
+		return nil, fmt.Errorf("upgrade transactions are not supported in trusted boot mode, failed entries are rolled back by the boot assessment")
+	}
+	current, err := ReadUpgradeTransaction(cfg.Fs)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil && (current.Status == TransactionApplying || current.Status == TransactionAssessing) && !force {
+		return nil, fmt.Errorf("an upgrade transaction to %s is %s since %s", current.Source, current.Status, current.Started.Format(time.RFC3339))
+	}
+
+	vars, err := utils.ReadPersistentVariables(transactionGrubEnv, cfg.Fs)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("snapshotting the bootloader state: %w", err)
+	}
+	t := &UpgradeTransaction{Source: source, Status: TransactionApplying, Bootloader: map[string]string{}, Started: time.Now()}
+	for _, k := range transactionBootVars {
+		t.Bootloader[k] = vars[k]
+	}
+	if err = t.Step(cfg, "snapshot"); err != nil {
+		return nil, fmt.Errorf("writing the upgrade transaction: %w", err)
+	}
+	cfg.Logger.Infof("Upgrade transaction to %s started", source)
+	return t, nil
+}
+
+// FailUpgradeTransaction restores the bootloader snapshot after the upgrade failed before rebooting, and returns
+// the upgrade error
+func FailUpgradeTransaction(cfg *config.Config, t *UpgradeTransaction, upgradeErr error) error {
+	if err := restoreBootloader(cfg, t); err != nil {
+		cfg.Logger.Warnf("Could not restore the bootloader state: %s", err)
+	}
+	if err := finishTransaction(cfg, t, TransactionFailed, upgradeErr.Error()); err != nil {
+		cfg.Logger.Warnf("Could not record the upgrade transaction failure: %s", err)
+	}
+	return fmt.Errorf("upgrade transaction failed: %w", upgradeErr)
+}
+
+// RebootUpgradeTransaction reboots into the applied upgrade, which is assessed on the next boots
+func RebootUpgradeTransaction(cfg *config.Config, t *UpgradeTransaction) error {
+	t.Status = TransactionAssessing
+	if err := t.Step(cfg, "reboot"); err != nil {
+		return err
+	}
+	if err := fsutils.MkdirAll(cfg.Fs, filepath.Dir(cnst.UpgradeTransactionStageFile), cnst.DirPerm); err != nil {
+		return err
+	}
+	if err := fsutils.AtomicWriteFile(cfg.Fs, cnst.UpgradeTransactionStageFile, []byte(transactionStage), cnst.ConfigPerm); err != nil {
+		return fmt.Errorf("writing the upgrade transaction stage: %w", err)
+	}
+	cfg.Logger.Infof("Rebooting into the upgraded system, it is rolled back if it does not report healthy")
+	return utils.Reboot(cfg.Runner, 0)
+}
+
+// CheckUpgradeTransaction runs on every boot while a transaction is assessed. It's committed once the upgraded
+// system reports healthy to the watchdog. Booting passive or recovery means the upgraded system failed and fell
+// back, the previous image is restored as active together with the bootloader snapshot.
+// This is the entrypoint for the upgrade transaction command
+func CheckUpgradeTransaction(cfg *config.Config) error {
+	t, err := ReadUpgradeTransaction(cfg.Fs)
+	if err != nil {
+		return err
+	}
+	if t == nil || t.Status != TransactionAssessing {
+		return removeTransactionStage(cfg)
+	}
+	boot, err := state.DetectBootWithVFS(cfg.Fs)
+	if err != nil {
+		return fmt.Errorf("detecting current boot: %w", err)
+	}
+	switch boot {
+	case state.Active:
+		return commitUpgradeTransaction(cfg)
+	case state.Passive, state.Recovery:
+		reason := fmt.Sprintf("the upgraded system fell back to %s", boot)
+		if st, _ := ReadWatchdog(cfg.Fs); st != nil && st.Reason != "" {
+			reason = st.Reason
+		}
+		cfg.Logger.Errorf("Rolling back the upgrade transaction to %s: %s", t.Source, reason)
+		if boot == state.Passive {
+			if err = restorePassiveImage(cfg); err != nil {
+				return fmt.Errorf("restoring the previous image: %w", err)
+			}
+		}
+		if err = restoreBootloader(cfg, t); err != nil {
+			return fmt.Errorf("restoring the bootloader state: %w", err)
+		}
+		return finishTransaction(cfg, t, TransactionRolledBack, reason)
+	}
+	return nil
+}
+
+// commitUpgradeTransaction commits the assessed transaction if the upgraded system reported healthy
+func commitUpgradeTransaction(cfg *config.Config) error {
+	t, err := ReadUpgradeTransaction(cfg.Fs)
+	if err != nil || t == nil || t.Status != TransactionAssessing {
+		return err
+	}
+	st, err := ReadWatchdog(cfg.Fs)
+	if err != nil {
+		return err
+	}
+	if st == nil || st.Status != WatchdogHealthy {
+		cfg.Logger.Infof("Upgrade transaction to %s waiting for the upgraded system to report healthy", t.Source)
+		return nil
+	}
+	cfg.Logger.Infof("Upgrade transaction to %s committed", t.Source)
+	return finishTransaction(cfg, t, TransactionCommitted, "")
+}
+
+// restorePassiveImage installs the passive image, the one running before the upgrade, as the active one again
+func restorePassiveImage(cfg *config.Config) error {
+	stateDir := cnst.RunningStateDir
+	if err := cfg.Syscall.Mount("", stateDir, "", syscall.MS_REMOUNT, ""); err != nil {
+		return fmt.Errorf("remounting the state partition: %w", err)
+	}
+	defer func() {
+		if err := cfg.Syscall.Mount("", stateDir, "", syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			cfg.Logger.Errorf("could not remount the state partition as RO: %s", err)
+		}
+	}()
+
+	passive := filepath.Join(stateDir, "cOS", cnst.PassiveImgFile)
+	active := filepath.Join(stateDir, "cOS", cnst.ActiveImgFile)
+	restored := active + ".rollback"
+	if err := fsutils.Copy(cfg.Fs, passive, restored); err != nil {
+		return err
+	}
+	if out, err := cfg.Runner.Run("tune2fs", "-L", cnst.ActiveLabel, restored); err != nil {
+		_ = cfg.Fs.Remove(restored)
+		return fmt.Errorf("labeling the restored image: %w: %s", err, out)
+	}
+	if err := cfg.Fs.Rename(restored, active); err != nil {
+		return err
+	}
+	return fsutils.SyncFile(cfg.Fs, active)
+}
+
+// restoreBootloader sets the boot entry selection back to the snapshot taken before the upgrade
+func restoreBootloader(cfg *config.Config, t *UpgradeTransaction) error {
+	vars := map[string]string{}
+	for _, k := range transactionBootVars {
+		vars[k] = t.Bootloader[k]
+	}
+	return utils.SetPersistentVariables(transactionGrubEnv, vars, cfg.Fs)
+}
+
+// finishTransaction stores the final status, nothing is left to run on the next boots
+func finishTransaction(cfg *config.Config, t *UpgradeTransaction, status, reason string) error {
+	now := time.Now()
+	t.Status, t.Error, t.Finished = status, reason, &now
+	if err := t.Step(cfg, status); err != nil {
+		return err
+	}
+	return removeTransactionStage(cfg)
+}
+
+func removeTransactionStage(cfg *config.Config) error {
+	if err := cfg.Fs.Remove(cnst.UpgradeTransactionStageFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func writeTransaction(cfg *config.Config, t *UpgradeTransaction) error {
+	data, err := yaml.Marshal(t)
+	if err != nil {
+		return err
+	}
+	if err = fsutils.MkdirAll(cfg.Fs, filepath.Dir(cnst.UpgradeTransactionFile), cnst.DirPerm); err != nil {
+		return err
+	}
+	return fsutils.AtomicWriteFile(cfg.Fs, cnst.UpgradeTransactionFile, data, cnst.ConfigPerm)
+}
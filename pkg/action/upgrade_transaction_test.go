@@ -0,0 +1,123 @@
+package action
+
+import (
+	"bytes"
+	"errors"
+	"os"
+
+	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v5"
+	"github.com/twpayne/go-vfs/v5/vfst"
+)
+
+var _ = Describe("Upgrade transaction", Label("upgrade", "transaction"), func() {
+	var config *agentConfig.Config
+	var runner *v1mock.FakeRunner
+	var fs vfs.FS
+	var cleanup func()
+
+	BeforeEach(func() {
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{
+			"/oem/.keep":    "",
+			"/proc/cmdline": "root=LABEL=COS_ACTIVE",
+			"/run/initramfs/cos-state/cOS/active.img":  "new",
+			"/run/initramfs/cos-state/cOS/passive.img": "previous",
+		})
+		Expect(err).Should(BeNil())
+		runner = v1mock.NewFakeRunner()
+		config = agentConfig.NewConfig(
+			agentConfig.WithFs(fs),
+			agentConfig.WithRunner(runner),
+			agentConfig.WithSyscall(&v1mock.FakeSyscall{}),
+			agentConfig.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})),
+		)
+		config.Watchdog = &agentConfig.Watchdog{}
+		Expect(utils.SetPersistentVariables("/oem/grubenv", map[string]string{"saved_entry": "cos"}, fs)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		cleanup()
+	})
+
+	It("records the upgrade phases and restores the bootloader if the upgrade fails", func() {
+		t, err := BeginUpgradeTransaction(config, "oci:kairos:v2", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t.Bootloader).To(HaveKeyWithValue("saved_entry", "cos"))
+		_, err = BeginUpgradeTransaction(config, "oci:kairos:v3", false)
+		Expect(err).To(HaveOccurred())
+
+		progress := utils.NewProgress(&agentConfig.Config{Progress: t.Reporter(config, nil)}, "upgrade")
+		progress.Phase("deploy", 10, "")
+		Expect(utils.SetPersistentVariables("/oem/grubenv", map[string]string{"next_entry": "fallback"}, fs)).To(Succeed())
+
+		Expect(FailUpgradeTransaction(config, t, errors.New("pull failed"))).To(MatchError(ContainSubstring("pull failed")))
+		vars, err := utils.ReadPersistentVariables("/oem/grubenv", fs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(vars).ToNot(HaveKey("next_entry"))
+		Expect(vars).To(HaveKeyWithValue("saved_entry", "cos"))
+
+		t, err = ReadUpgradeTransaction(fs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t.Status).To(Equal(TransactionFailed))
+		var steps []string
+		for _, s := range t.Steps {
+			steps = append(steps, s.Name)
+		}
+		Expect(steps).To(Equal([]string{"snapshot", "deploy", TransactionFailed}))
+	})
+
+	It("commits once the upgraded system reports healthy", func() {
+		t, err := BeginUpgradeTransaction(config, "oci:kairos:v2", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ArmWatchdog(config)).To(Succeed())
+		Expect(RebootUpgradeTransaction(config, t)).To(Succeed())
+		Expect(runner.IncludesCmds([][]string{{"reboot", "-f"}})).To(Succeed())
+		_, err = fs.Stat(cnst.UpgradeTransactionStageFile)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(CheckUpgradeTransaction(config)).To(Succeed())
+		t, _ = ReadUpgradeTransaction(fs)
+		Expect(t.Status).To(Equal(TransactionAssessing))
+
+		Expect(MarkWatchdogHealthy(config)).To(Succeed())
+		t, _ = ReadUpgradeTransaction(fs)
+		Expect(t.Status).To(Equal(TransactionCommitted))
+		_, err = fs.Stat(cnst.UpgradeTransactionStageFile)
+		Expect(err).To(MatchError(os.ErrNotExist))
+	})
+
+	It("restores the previous image and boot entry after falling back to passive", func() {
+		t, err := BeginUpgradeTransaction(config, "oci:kairos:v2", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(RebootUpgradeTransaction(config, t)).To(Succeed())
+
+		// The watchdog selected the fallback entry
+		Expect(utils.SetPersistentVariables("/oem/grubenv", map[string]string{"next_entry": "fallback"}, fs)).To(Succeed())
+		Expect(fs.WriteFile("/proc/cmdline", []byte("root=LABEL=COS_PASSIVE"), cnst.FilePerm)).To(Succeed())
+		Expect(CheckUpgradeTransaction(config)).To(Succeed())
+
+		data, err := fs.ReadFile("/run/initramfs/cos-state/cOS/active.img")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("previous"))
+		Expect(runner.IncludesCmds([][]string{{"tune2fs", "-L", cnst.ActiveLabel}})).To(Succeed())
+		vars, _ := utils.ReadPersistentVariables("/oem/grubenv", fs)
+		Expect(vars).ToNot(HaveKey("next_entry"))
+
+		t, _ = ReadUpgradeTransaction(fs)
+		Expect(t.Status).To(Equal(TransactionRolledBack))
+		Expect(t.Error).To(ContainSubstring("passive"))
+	})
+
+	It("is not supported in trusted boot mode", func() {
+		Expect(fs.WriteFile("/proc/cmdline", []byte("rd.immucore.uki"), cnst.FilePerm)).To(Succeed())
+		_, err := BeginUpgradeTransaction(config, "oci:kairos:v2", false)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,122 @@
+package action
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils"
+	"github.com/kairos-io/kairos-sdk/state"
+)
+
+// kernelReleaseFile is the release of the running kernel, the one uname -r returns
+const kernelReleaseFile = "/proc/sys/kernel/osrelease"
+
+// SystemVersion is the Kairos and kernel version of a system
+type SystemVersion struct {
+	OS     string `yaml:"os,omitempty" json:"os,omitempty"`
+	Kernel string `yaml:"kernel,omitempty" json:"kernel,omitempty"`
+}
+
+// ReadSystemVersion returns the version of the system tree at root, the KAIROS_VERSION of its release file and the
+// version of its kernel modules. The versions that can't be found are left empty.
+func ReadSystemVersion(fs v1.FS, root string) SystemVersion {
+	v := SystemVersion{OS: releaseVersion(fs, root)}
+	if modules, err := fs.ReadDir(filepath.Join(root, "lib/modules")); err == nil {
+		for _, m := range modules {
+			if m.IsDir() {
+				v.Kernel = m.Name()
+			}
+		}
+	}
+	return v
+}
+
+// BootedSystemVersion returns the version of the running system and of the kernel it booted
+func BootedSystemVersion(fs v1.FS) SystemVersion {
+	v := SystemVersion{OS: releaseVersion(fs, "/")}
+	if release, err := fs.ReadFile(kernelReleaseFile); err == nil {
+		v.Kernel = strings.TrimSpace(string(release))
+	}
+	return v
+}
+
+// releaseVersion returns the KAIROS_VERSION of the kairos-release file, falling back to os-release
+func releaseVersion(fs v1.FS, root string) string {
+	for _, file := range []string{"etc/kairos-release", "etc/os-release"} {
+		if env, err := utils.LoadEnvFile(fs, filepath.Join(root, file)); err == nil && env["KAIROS_VERSION"] != "" {
+			return env["KAIROS_VERSION"]
+		}
+	}
+	return ""
+}
+
+// UpgradeVerification is the outcome of checking the system booted after an upgrade transaction is the upgraded one
+type UpgradeVerification struct {
+	Source string `yaml:"source" json:"source"`
+	// Expected is the version of the deployed image, recorded by the transaction before rebooting
+	Expected SystemVersion `yaml:"expected" json:"expected"`
+	Booted   SystemVersion `yaml:"booted" json:"booted"`
+	Verified time.Time     `yaml:"verified" json:"verified"`
+}
+
+// mismatches returns the versions of the booted system that differ from the expected ones, the ones not recorded
+// are not compared
+func (v UpgradeVerification) mismatches() []string {
+	var diffs []string
+	if v.Expected.OS != "" && v.Expected.OS != v.Booted.OS {
+		diffs = append(diffs, fmt.Sprintf("booted version %q, expected %q", v.Booted.OS, v.Expected.OS))
+	}
+	if v.Expected.Kernel != "" && v.Expected.Kernel != v.Booted.Kernel {
+		diffs = append(diffs, fmt.Sprintf("booted kernel %q, expected %q", v.Booted.Kernel, v.Expected.Kernel))
+	}
+	return diffs
+}
+
+// VerifyUpgradeTransaction checks the system booted the upgrade of the last transaction, comparing the booted
+// version and kernel with the ones of the deployed image, and commits the transaction. This lets orchestrators close
+// an upgrade once the node rebooted, without waiting for the watchdog to report it healthy.
+func VerifyUpgradeTransaction(cfg *config.Config) (*UpgradeVerification, error) {
+	t, err := ReadUpgradeTransaction(cfg.Fs)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, fmt.Errorf("no upgrade transaction to verify, only the upgrades applied with --rollback-on-failure are recorded")
+	}
+	switch t.Status {
+	case TransactionApplying:
+		return nil, fmt.Errorf("the upgrade transaction to %s did not reboot into the upgraded system yet", t.Source)
+	case TransactionRolledBack, TransactionFailed:
+		return nil, fmt.Errorf("the upgrade transaction to %s %s: %s", t.Source, t.Status, t.Error)
+	}
+	boot, err := state.DetectBootWithVFS(cfg.Fs)
+	if err != nil {
+		return nil, fmt.Errorf("detecting current boot: %w", err)
+	}
+	if boot != state.Active {
+		return nil, fmt.Errorf("booted %s instead of the upgraded active system", boot)
+	}
+
+	v := &UpgradeVerification{Source: t.Source, Booted: BootedSystemVersion(cfg.Fs)}
+	if t.Expected != nil {
+		v.Expected = *t.Expected
+	}
+	if diffs := v.mismatches(); len(diffs) > 0 {
+		return v, fmt.Errorf("the booted system is not the upgrade to %s: %s", t.Source, strings.Join(diffs, ", "))
+	}
+	v.Verified = time.Now()
+	if t.Status == TransactionAssessing {
+		if err = t.Step(cfg, "verified"); err != nil {
+			return v, err
+		}
+		if err = finishTransaction(cfg, t, TransactionCommitted, ""); err != nil {
+			return v, err
+		}
+		cfg.Logger.Infof("Upgrade transaction to %s verified and committed", t.Source)
+	}
+	return v, nil
+}
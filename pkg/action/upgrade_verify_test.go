@@ -0,0 +1,90 @@
+package action
+
+import (
+	"bytes"
+
+	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v5"
+	"github.com/twpayne/go-vfs/v5/vfst"
+)
+
+var _ = Describe("Upgrade verify", Label("upgrade", "transaction", "verify"), func() {
+	var config *agentConfig.Config
+	var fs vfs.FS
+	var cleanup func()
+
+	BeforeEach(func() {
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{
+			"/oem/.keep":                 "",
+			"/proc/cmdline":              "root=LABEL=COS_ACTIVE",
+			"/proc/sys/kernel/osrelease": "6.8.0-45-generic\n",
+			"/etc/kairos-release":        "KAIROS_VERSION=\"v3.2.1\"\n",
+			"/upgraded/etc/os-release":   "KAIROS_VERSION=v3.2.1\n",
+			"/upgraded/lib/modules/6.8.0-45-generic/modules.dep": "",
+		})
+		Expect(err).Should(BeNil())
+		config = agentConfig.NewConfig(
+			agentConfig.WithFs(fs),
+			agentConfig.WithRunner(v1mock.NewFakeRunner()),
+			agentConfig.WithSyscall(&v1mock.FakeSyscall{}),
+			agentConfig.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})),
+		)
+	})
+
+	AfterEach(func() {
+		cleanup()
+	})
+
+	reboot := func() {
+		t, err := BeginUpgradeTransaction(config, "oci:kairos:v3.2.1", false)
+		Expect(err).ToNot(HaveOccurred())
+		deployed := ReadSystemVersion(fs, "/upgraded")
+		Expect(deployed).To(Equal(SystemVersion{OS: "v3.2.1", Kernel: "6.8.0-45-generic"}))
+		t.Expected = &deployed
+		Expect(RebootUpgradeTransaction(config, t)).To(Succeed())
+	}
+
+	It("commits the transaction once the booted system is the upgraded one", func() {
+		reboot()
+		v, err := VerifyUpgradeTransaction(config)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(v.Booted).To(Equal(v.Expected))
+		Expect(v.Verified.IsZero()).To(BeFalse())
+
+		t, err := ReadUpgradeTransaction(fs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t.Status).To(Equal(TransactionCommitted))
+		Expect(t.Steps[len(t.Steps)-2].Name).To(Equal("verified"))
+		_, err = fs.Stat(cnst.UpgradeTransactionStageFile)
+		Expect(err).To(HaveOccurred())
+
+		// Verifying again checks the versions without changing the transaction
+		_, err = VerifyUpgradeTransaction(config)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("fails if the booted system is not the upgraded one", func() {
+		_, err := VerifyUpgradeTransaction(config)
+		Expect(err).To(MatchError(ContainSubstring("no upgrade transaction")))
+
+		reboot()
+		Expect(fs.WriteFile("/proc/sys/kernel/osrelease", []byte("6.5.0-1-generic\n"), cnst.FilePerm)).To(Succeed())
+		v, err := VerifyUpgradeTransaction(config)
+		Expect(err).To(MatchError(ContainSubstring(`booted kernel "6.5.0-1-generic", expected "6.8.0-45-generic"`)))
+		Expect(v.Booted.OS).To(Equal("v3.2.1"))
+
+		Expect(fs.WriteFile("/proc/cmdline", []byte("root=LABEL=COS_PASSIVE"), cnst.FilePerm)).To(Succeed())
+		_, err = VerifyUpgradeTransaction(config)
+		Expect(err).To(MatchError(ContainSubstring("booted passive_boot")))
+
+		t, err := ReadUpgradeTransaction(fs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t.Status).To(Equal(TransactionAssessing))
+	})
+})
@@ -0,0 +1,332 @@
+package action
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	"github.com/kairos-io/kairos-sdk/state"
+	"gopkg.in/yaml.v3"
+)
+
+// Watchdog statuses
+const (
+	WatchdogArmed       = "armed"
+	WatchdogHealthy     = "healthy"
+	WatchdogRemediating = "remediating"
+	WatchdogRemediated  = "remediated"
+)
+
+// watchdogPollInterval is how often the watchdog checks if the system reported healthy while waiting for its timeout
+var watchdogPollInterval = 30 * time.Second
+
+// watchdogStage counts the boots and remediates on every boot until the system reports healthy. It runs in the
+// background so the boot is not held by the timeout.
+const watchdogStage = `name: "Upgrade watchdog"
+stages:
+  boot:
+    - name: "Check the upgraded system reported healthy"
+      commands:
+        - |
+          if [ -d /run/systemd/system ]; then
+            systemd-run --unit=kairos-watchdog --collect kairos-agent watchdog check
+          else
+            nohup kairos-agent watchdog check >/dev/null 2>&1 &
+          fi
+`
+
+// WatchdogState tracks the health of the system since the last upgrade. It lives in the OEM partition, so all the
+// boot entries, recovery included, see it.
+type WatchdogState struct {
+	Status string    `yaml:"status" json:"status"`
+	Armed  time.Time `yaml:"armed" json:"armed"`
+	// Boots are the boots of the active system since it was armed
+	Boots      int        `yaml:"boots" json:"boots"`
+	Action     string     `yaml:"action" json:"action"`
+	Reason     string     `yaml:"reason,omitempty" json:"reason,omitempty"`
+	Remediated *time.Time `yaml:"remediated,omitempty" json:"remediated,omitempty"`
+	Hostname   string     `yaml:"-" json:"hostname"`
+}
+
+// ArmWatchdog starts watching the health of the system after an upgrade, if the watchdog is configured
+func ArmWatchdog(cfg *config.Config) error {
+	if cfg.Watchdog == nil {
+		return nil
+	}
+	action, err := watchdogAction(cfg)
+	if err != nil {
+		return err
+	}
+	if err = writeWatchdog(cfg, &WatchdogState{Status: WatchdogArmed, Armed: time.Now(), Action: action}); err != nil {
+		return fmt.Errorf("writing the watchdog state: %w", err)
+	}
+	if err = fsutils.MkdirAll(cfg.Fs, filepath.Dir(cnst.WatchdogStageFile), cnst.DirPerm); err != nil {
+		return err
+	}
+	if err = fsutils.AtomicWriteFile(cfg.Fs, cnst.WatchdogStageFile, []byte(watchdogStage), cnst.ConfigPerm); err != nil {
+		return fmt.Errorf("writing the watchdog stage: %w", err)
+	}
+	cfg.Logger.Infof("Watchdog armed, the upgraded system has to report healthy or it will be remediated with %s", action)
+	return nil
+}
+
+// ReadWatchdog returns the watchdog state, or nil if it was never armed
+func ReadWatchdog(fs v1.FS) (*WatchdogState, error) {
+	if exists, _ := fsutils.Exists(fs, cnst.WatchdogFile); !exists {
+		return nil, nil
+	}
+	data, err := fs.ReadFile(cnst.WatchdogFile)
+	if err != nil {
+		return nil, err
+	}
+	st := &WatchdogState{}
+	if err = yaml.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("parsing watchdog state %s: %w", cnst.WatchdogFile, err)
+	}
+	return st, nil
+}
+
+// MarkWatchdogHealthy disarms the watchdog, the running system is healthy.
+// This is the entrypoint for the watchdog healthy command
+func MarkWatchdogHealthy(cfg *config.Config) error {
+	st, err := ReadWatchdog(cfg.Fs)
+	if err != nil || st == nil || st.Status != WatchdogArmed {
+		return err
+	}
+	if boot, _ := state.DetectBootWithVFS(cfg.Fs); boot != state.Active {
+		return fmt.Errorf("only the upgraded system can report healthy, booted from %s", boot)
+	}
+	st.Status = WatchdogHealthy
+	cfg.Logger.Infof("System reported healthy after %d boots", st.Boots)
+	if err = finishWatchdog(cfg, st); err != nil {
+		return err
+	}
+	return commitUpgradeTransaction(cfg)
+}
+
+// CheckWatchdog runs on every boot while the watchdog is armed. On the active system it counts the boot and
+// remediates once the boots or the timeout are exceeded without reporting healthy. Booting passive or recovery
+// after the active system failed, the watchdog remediating it or the active entry exhausting its boot counters,
+// sends the alert from there and the reset, if that is the action, is run from recovery with the given function.
+// Any other boot into passive or recovery is a manual one and leaves the watchdog armed.
+// This is the entrypoint for the watchdog check command
+func CheckWatchdog(cfg *config.Config, reset func() error) error {
+	st, err := ReadWatchdog(cfg.Fs)
+	if err != nil {
+		return err
+	}
+	if st == nil || st.Status == WatchdogHealthy || st.Status == WatchdogRemediated {
+		return removeWatchdogStage(cfg)
+	}
+	maxBoots := cnst.WatchdogDefaultMaxBoots
+	var timeout time.Duration
+	if cfg.Watchdog != nil {
+		if cfg.Watchdog.MaxBoots > 0 {
+			maxBoots = cfg.Watchdog.MaxBoots
+		}
+		timeout = cfg.Watchdog.Timeout
+	}
+
+	boot, err := state.DetectBootWithVFS(cfg.Fs)
+	if err != nil {
+		return fmt.Errorf("detecting current boot: %w", err)
+	}
+	switch boot {
+	case state.Active:
+		if st.Status == WatchdogRemediating {
+			// Booted back into active on purpose while remediating, leave it be
+			cfg.Logger.Warnf("Booted the active system while the watchdog remediates it, skipping the check")
+			return nil
+		}
+		st.Boots++
+		if st.Boots > maxBoots {
+			return remediateWatchdog(cfg, st, fmt.Sprintf("no healthy report after %d boots", maxBoots))
+		}
+		if err = writeWatchdog(cfg, st); err != nil {
+			return err
+		}
+		if timeout == 0 {
+			return nil
+		}
+		deadline := st.Armed.Add(timeout)
+		for time.Now().Before(deadline) {
+			time.Sleep(min(watchdogPollInterval, time.Until(deadline)))
+			if current, err := ReadWatchdog(cfg.Fs); err == nil && current != nil && current.Status != WatchdogArmed {
+				return nil
+			}
+		}
+		return remediateWatchdog(cfg, st, fmt.Sprintf("no healthy report %s after the upgrade", timeout))
+	case state.Passive:
+		if !activeFailed(cfg, st) {
+			cfg.Logger.Infof("Booted passive while the active system did not fail, leaving the watchdog armed")
+			return nil
+		}
+		if st.Reason == "" {
+			st.Reason = "the upgraded system fell back to passive"
+		}
+		if st.Action == cnst.WatchdogActionReset {
+			return remediateWatchdog(cfg, st, st.Reason)
+		}
+		return completeWatchdog(cfg, st, st.Reason)
+	case state.Recovery:
+		if !activeFailed(cfg, st) {
+			cfg.Logger.Infof("Booted recovery while the active system did not fail, leaving the watchdog armed")
+			return nil
+		}
+		if st.Reason == "" {
+			st.Reason = "the system fell back to recovery"
+		}
+		if st.Action != cnst.WatchdogActionReset {
+			return completeWatchdog(cfg, st, st.Reason)
+		}
+		if err = completeWatchdog(cfg, st, st.Reason); err != nil {
+			return err
+		}
+		cfg.Logger.Warnf("Resetting the system: %s", st.Reason)
+		return reset()
+	}
+	return nil
+}
+
+// FailWatchdog records that the active system failed, i.e. when its boot counters were exhausted and passive got
+// promoted, so booting passive is remediated even if the boot assessment of the active entry was reset since then
+func FailWatchdog(cfg *config.Config, reason string) error {
+	st, err := ReadWatchdog(cfg.Fs)
+	if err != nil || st == nil || st.Status != WatchdogArmed {
+		return err
+	}
+	st.Status, st.Reason = WatchdogRemediating, reason
+	return writeWatchdog(cfg, st)
+}
+
+// activeFailed reports if the active system failed, either the watchdog is remediating it or, on trusted boot,
+// the active entry exhausted its boot tries. Only trusted boot systems count boots, so without the watchdog
+// remediating a boot into passive or recovery is a manual one.
+func activeFailed(cfg *config.Config, st *WatchdogState) bool {
+	if st.Status == WatchdogRemediating {
+		return true
+	}
+	if !utils.IsUkiWithFs(cfg.Fs) {
+		return false
+	}
+	active, err := readBootAssessment(cfg, "active")
+	if err != nil {
+		cfg.Logger.Warnf("Could not read the boot assessment of the active entry: %s", err)
+		return false
+	}
+	return active.Bad()
+}
+
+// remediateWatchdog alerts and applies the remediation action from the active or passive system
+func remediateWatchdog(cfg *config.Config, st *WatchdogState, reason string) error {
+	switch st.Action {
+	case cnst.WatchdogActionNone:
+		return completeWatchdog(cfg, st, reason)
+	case cnst.WatchdogActionReset:
+		st.Status, st.Reason = WatchdogRemediating, reason
+		cfg.Logger.Errorf("%s, rebooting into recovery to reset the system", reason)
+		if err := writeWatchdog(cfg, st); err != nil {
+			return err
+		}
+		if err := SelectBootEntry(cfg, "recovery"); err != nil {
+			return fmt.Errorf("%s and selecting the recovery entry failed: %w", reason, err)
+		}
+	default:
+		// The alert is sent once passive boots, when the outcome is known
+		st.Status, st.Reason = WatchdogRemediating, reason
+		cfg.Logger.Errorf("%s, rolling back to the previous image", reason)
+		if err := writeWatchdog(cfg, st); err != nil {
+			return err
+		}
+		if utils.IsUkiWithFs(cfg.Fs) {
+			if _, err := cfg.Runner.Run("systemd-bless-boot", "bad"); err != nil {
+				cfg.Logger.Warnf("Could not mark the boot as bad: %s", err)
+			}
+		}
+		if err := SelectBootEntry(cfg, "fallback"); err != nil {
+			return fmt.Errorf("%s and selecting the fallback entry failed: %w", reason, err)
+		}
+	}
+	return utils.Reboot(cfg.Runner, 0)
+}
+
+// completeWatchdog marks the remediation done and sends the alert
+func completeWatchdog(cfg *config.Config, st *WatchdogState, reason string) error {
+	st.Status, st.Reason = WatchdogRemediated, reason
+	now := time.Now()
+	st.Remediated = &now
+	if err := finishWatchdog(cfg, st); err != nil {
+		return err
+	}
+	if err := alertWatchdog(cfg, st); err != nil {
+		cfg.Logger.Warnf("Could not send the watchdog alert: %s", err)
+	}
+	return nil
+}
+
+// alertWatchdog POSTs the watchdog state to the configured webhook, if any
+func alertWatchdog(cfg *config.Config, st *WatchdogState) error {
+	if cfg.Watchdog == nil || cfg.Watchdog.Webhook == "" {
+		return nil
+	}
+	st.Hostname, _ = os.Hostname()
+	body, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 30 * time.Second, Transport: cfg.HTTPTransport()}
+	resp, err := client.Post(cfg.Watchdog.Webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s answered with %s", cfg.Watchdog.Webhook, resp.Status)
+	}
+	return nil
+}
+
+func watchdogAction(cfg *config.Config) (string, error) {
+	switch cfg.Watchdog.Action {
+	case "":
+		return cnst.WatchdogActionFallback, nil
+	case cnst.WatchdogActionFallback, cnst.WatchdogActionReset, cnst.WatchdogActionNone:
+		return cfg.Watchdog.Action, nil
+	}
+	return "", fmt.Errorf("invalid watchdog action %s, valid ones are %s, %s and %s", cfg.Watchdog.Action, cnst.WatchdogActionFallback, cnst.WatchdogActionReset, cnst.WatchdogActionNone)
+}
+
+// finishWatchdog stores the final state, nothing is left to run on the next boots
+func finishWatchdog(cfg *config.Config, st *WatchdogState) error {
+	if err := writeWatchdog(cfg, st); err != nil {
+		return err
+	}
+	return removeWatchdogStage(cfg)
+}
+
+func removeWatchdogStage(cfg *config.Config) error {
+	if err := cfg.Fs.Remove(cnst.WatchdogStageFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func writeWatchdog(cfg *config.Config, st *WatchdogState) error {
+	data, err := yaml.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if err = fsutils.MkdirAll(cfg.Fs, filepath.Dir(cnst.WatchdogFile), cnst.DirPerm); err != nil {
+		return err
+	}
+	return fsutils.AtomicWriteFile(cfg.Fs, cnst.WatchdogFile, data, cnst.ConfigPerm)
+}
@@ -0,0 +1,168 @@
+package action
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v5"
+	"github.com/twpayne/go-vfs/v5/vfst"
+)
+
+var _ = Describe("Watchdog", Label("watchdog"), func() {
+	var config *agentConfig.Config
+	var runner *v1mock.FakeRunner
+	var fs vfs.FS
+	var cleanup func()
+	var server *httptest.Server
+	var alerts []WatchdogState
+
+	BeforeEach(func() {
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{
+			"/oem/.keep":        "",
+			"/proc/cmdline":     "root=LABEL=COS_ACTIVE",
+			"/etc/cos/grub.cfg": "menuentry whatever --id cos {\nmenuentry whatever --id fallback {\nmenuentry whatever --id recovery {",
+		})
+		Expect(err).Should(BeNil())
+		runner = v1mock.NewFakeRunner()
+		config = agentConfig.NewConfig(
+			agentConfig.WithFs(fs),
+			agentConfig.WithRunner(runner),
+			agentConfig.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})),
+		)
+		alerts = nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			st := WatchdogState{}
+			_ = json.Unmarshal(body, &st)
+			alerts = append(alerts, st)
+		}))
+		config.Watchdog = &agentConfig.Watchdog{MaxBoots: 2, Webhook: server.URL}
+		watchdogPollInterval = 10 * time.Millisecond
+	})
+
+	AfterEach(func() {
+		server.Close()
+		cleanup()
+	})
+
+	noReset := func() error {
+		Fail("the system must not be reset")
+		return nil
+	}
+
+	It("is disarmed once the system reports healthy", func() {
+		Expect(ArmWatchdog(config)).To(Succeed())
+		stage, err := fs.ReadFile(cnst.WatchdogStageFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(stage)).To(ContainSubstring("kairos-agent watchdog check"))
+
+		Expect(CheckWatchdog(config, noReset)).To(Succeed())
+		Expect(MarkWatchdogHealthy(config)).To(Succeed())
+		st, err := ReadWatchdog(fs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(st.Status).To(Equal(WatchdogHealthy))
+		Expect(st.Boots).To(Equal(1))
+		_, err = fs.Stat(cnst.WatchdogStageFile)
+		Expect(err).To(MatchError(os.ErrNotExist))
+		Expect(CheckWatchdog(config, noReset)).To(Succeed())
+		Expect(runner.IncludesCmds([][]string{{"reboot"}})).ToNot(Succeed())
+	})
+
+	It("falls back to passive after too many boots and alerts from there", func() {
+		Expect(ArmWatchdog(config)).To(Succeed())
+		Expect(CheckWatchdog(config, noReset)).To(Succeed())
+		Expect(CheckWatchdog(config, noReset)).To(Succeed())
+		Expect(runner.IncludesCmds([][]string{{"reboot"}})).ToNot(Succeed())
+		Expect(CheckWatchdog(config, noReset)).To(Succeed())
+		Expect(runner.IncludesCmds([][]string{{"reboot", "-f"}})).To(Succeed())
+		grubenv, err := fs.ReadFile("/oem/grubenv")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(grubenv)).To(ContainSubstring("next_entry=fallback"))
+		st, err := ReadWatchdog(fs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(st.Status).To(Equal(WatchdogRemediating))
+		Expect(alerts).To(BeEmpty())
+
+		Expect(fs.WriteFile("/proc/cmdline", []byte("root=LABEL=COS_PASSIVE"), 0644)).To(Succeed())
+		Expect(CheckWatchdog(config, noReset)).To(Succeed())
+		st, err = ReadWatchdog(fs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(st.Status).To(Equal(WatchdogRemediated))
+		Expect(alerts).To(HaveLen(1))
+		Expect(alerts[0].Reason).To(ContainSubstring("after 2 boots"))
+		Expect(alerts[0].Action).To(Equal(cnst.WatchdogActionFallback))
+	})
+
+	It("resets the system from recovery after the timeout", func() {
+		config.Watchdog.Action = cnst.WatchdogActionReset
+		config.Watchdog.Timeout = 50 * time.Millisecond
+		Expect(ArmWatchdog(config)).To(Succeed())
+		Expect(CheckWatchdog(config, noReset)).To(Succeed())
+		grubenv, err := fs.ReadFile("/oem/grubenv")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(grubenv)).To(ContainSubstring("next_entry=recovery"))
+
+		Expect(fs.WriteFile("/proc/cmdline", []byte("root=LABEL=COS_RECOVERY"), 0644)).To(Succeed())
+		resets := 0
+		Expect(CheckWatchdog(config, func() error {
+			resets++
+			return nil
+		})).To(Succeed())
+		Expect(resets).To(Equal(1))
+		Expect(alerts).To(HaveLen(1))
+		Expect(alerts[0].Reason).To(ContainSubstring("no healthy report"))
+		st, err := ReadWatchdog(fs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(st.Status).To(Equal(WatchdogRemediated))
+	})
+
+	It("leaves the watchdog armed on a manual boot into passive or recovery", func() {
+		config.Watchdog.Action = cnst.WatchdogActionReset
+		Expect(ArmWatchdog(config)).To(Succeed())
+		Expect(CheckWatchdog(config, noReset)).To(Succeed())
+
+		for _, cmdline := range []string{"root=LABEL=COS_PASSIVE", "root=LABEL=COS_RECOVERY"} {
+			Expect(fs.WriteFile("/proc/cmdline", []byte(cmdline), 0644)).To(Succeed())
+			Expect(CheckWatchdog(config, noReset)).To(Succeed())
+			st, err := ReadWatchdog(fs)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(st.Status).To(Equal(WatchdogArmed))
+			Expect(st.Boots).To(Equal(1))
+		}
+		Expect(runner.IncludesCmds([][]string{{"reboot"}})).ToNot(Succeed())
+		_, err := fs.Stat("/oem/grubenv")
+		Expect(err).To(MatchError(os.ErrNotExist))
+		Expect(alerts).To(BeEmpty())
+		_, err = fs.Stat(cnst.WatchdogStageFile)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("remediates from passive once the active system was recorded as failed", func() {
+		Expect(ArmWatchdog(config)).To(Succeed())
+		Expect(FailWatchdog(config, "the active entry failed 3 boots")).To(Succeed())
+		Expect(fs.WriteFile("/proc/cmdline", []byte("root=LABEL=COS_PASSIVE"), 0644)).To(Succeed())
+		Expect(CheckWatchdog(config, noReset)).To(Succeed())
+		st, err := ReadWatchdog(fs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(st.Status).To(Equal(WatchdogRemediated))
+		Expect(alerts).To(HaveLen(1))
+		Expect(alerts[0].Reason).To(Equal("the active entry failed 3 boots"))
+	})
+
+	It("rejects unknown actions", func() {
+		config.Watchdog.Action = "reinstall"
+		Expect(ArmWatchdog(config)).To(MatchError(ContainSubstring("invalid watchdog action")))
+	})
+})
@@ -0,0 +1,256 @@
+package cloudinit
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/mudler/yip/pkg/plugins"
+	"github.com/twpayne/go-vfs/v5"
+)
+
+// Audit is the summary of the changes the yip modules applied while auditing.
+// Only the changes done through the yip filesystem and console are seen, what
+// arbitrary commands do to the system is not.
+type Audit struct {
+	Created  []string        `json:"created,omitempty" yaml:"created,omitempty"`
+	Modified []string        `json:"modified,omitempty" yaml:"modified,omitempty"`
+	Removed  []string        `json:"removed,omitempty" yaml:"removed,omitempty"`
+	Services []ServiceChange `json:"services,omitempty" yaml:"services,omitempty"`
+
+	mu    sync.Mutex
+	files map[string]string
+}
+
+// ServiceChange is a service action run by the yip modules, e.g. enable sshd
+type ServiceChange struct {
+	Service string `json:"service" yaml:"service"`
+	Action  string `json:"action" yaml:"action"`
+}
+
+const (
+	auditCreated  = "created"
+	auditModified = "modified"
+	auditRemoved  = "removed"
+)
+
+func newAudit() *Audit {
+	return &Audit{files: map[string]string{}}
+}
+
+// Empty is true if no change was recorded
+func (a *Audit) Empty() bool {
+	return len(a.Created) == 0 && len(a.Modified) == 0 && len(a.Removed) == 0 && len(a.Services) == 0
+}
+
+// record classifies the change on path by whether it existed before it was first touched.
+// Paths created and removed again during the audit are not reported.
+func (a *Audit) record(path string, existed, removal bool) {
+	path = filepath.Clean(path)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	prev, seen := a.files[path]
+	if !seen {
+		prev = auditCreated
+		if existed {
+			prev = auditModified
+		}
+	}
+	switch {
+	case removal && prev == auditCreated:
+		delete(a.files, path)
+	case removal:
+		a.files[path] = auditRemoved
+	case prev == auditRemoved:
+		a.files[path] = auditModified
+	default:
+		a.files[path] = prev
+	}
+}
+
+// recordCommand records the service actions of a command run through the console
+func (a *Audit) recordCommand(command string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, line := range strings.Split(command, "\n") {
+		a.Services = append(a.Services, serviceChanges(strings.Fields(line))...)
+	}
+}
+
+// serviceChanges parses the systemctl and rc-update invocations which change services
+func serviceChanges(fields []string) []ServiceChange {
+	var changes []ServiceChange
+	if len(fields) < 3 {
+		return changes
+	}
+	switch filepath.Base(fields[0]) {
+	case "systemctl":
+		action := fields[1]
+		switch action {
+		case "enable", "disable", "mask", "unmask", "start", "stop", "restart", "reload":
+		default:
+			return changes
+		}
+		for _, svc := range fields[2:] {
+			if strings.HasPrefix(svc, "-") {
+				continue
+			}
+			changes = append(changes, ServiceChange{Service: svc, Action: action})
+		}
+	case "rc-update":
+		action := map[string]string{"add": "enable", "del": "disable", "delete": "disable"}[fields[1]]
+		if action != "" {
+			changes = append(changes, ServiceChange{Service: fields[2], Action: action})
+		}
+	}
+	return changes
+}
+
+// finish sorts the recorded paths into the report lists
+func (a *Audit) finish() *Audit {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.Created, a.Modified, a.Removed = nil, nil, nil
+	for path, change := range a.files {
+		switch change {
+		case auditCreated:
+			a.Created = append(a.Created, path)
+		case auditModified:
+			a.Modified = append(a.Modified, path)
+		case auditRemoved:
+			a.Removed = append(a.Removed, path)
+		}
+	}
+	sort.Strings(a.Created)
+	sort.Strings(a.Modified)
+	sort.Strings(a.Removed)
+	return a
+}
+
+// auditFS records the changes done through the wrapped filesystem. Changes are
+// only recorded once they succeeded.
+type auditFS struct {
+	vfs.FS
+	audit *Audit
+}
+
+func (a auditFS) exists(name string) bool {
+	_, err := a.FS.Lstat(name)
+	return err == nil
+}
+
+// change runs op on name and records it if it succeeded
+func (a auditFS) change(name string, removal bool, op func() error) error {
+	existed := a.exists(name)
+	err := op()
+	if err == nil && (existed || !removal) {
+		a.audit.record(name, existed, removal)
+	}
+	return err
+}
+
+func (a auditFS) Chmod(name string, mode fs.FileMode) error {
+	return a.change(name, false, func() error { return a.FS.Chmod(name, mode) })
+}
+
+func (a auditFS) Chown(name string, uid, gid int) error {
+	return a.change(name, false, func() error { return a.FS.Chown(name, uid, gid) })
+}
+
+func (a auditFS) Chtimes(name string, atime, mtime time.Time) error {
+	return a.change(name, false, func() error { return a.FS.Chtimes(name, atime, mtime) })
+}
+
+func (a auditFS) Create(name string) (f *os.File, err error) {
+	err = a.change(name, false, func() error {
+		f, err = a.FS.Create(name)
+		return err
+	})
+	return f, err
+}
+
+func (a auditFS) Lchown(name string, uid, gid int) error {
+	return a.change(name, false, func() error { return a.FS.Lchown(name, uid, gid) })
+}
+
+func (a auditFS) Link(oldname, newname string) error {
+	return a.change(newname, false, func() error { return a.FS.Link(oldname, newname) })
+}
+
+func (a auditFS) Mkdir(name string, perm fs.FileMode) error {
+	return a.change(name, false, func() error { return a.FS.Mkdir(name, perm) })
+}
+
+func (a auditFS) OpenFile(name string, flag int, perm fs.FileMode) (f *os.File, err error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		return a.FS.OpenFile(name, flag, perm)
+	}
+	err = a.change(name, false, func() error {
+		f, err = a.FS.OpenFile(name, flag, perm)
+		return err
+	})
+	return f, err
+}
+
+func (a auditFS) Remove(name string) error {
+	return a.change(name, true, func() error { return a.FS.Remove(name) })
+}
+
+func (a auditFS) RemoveAll(name string) error {
+	return a.change(name, true, func() error { return a.FS.RemoveAll(name) })
+}
+
+func (a auditFS) Rename(oldpath, newpath string) error {
+	existed := a.exists(newpath)
+	err := a.change(oldpath, true, func() error { return a.FS.Rename(oldpath, newpath) })
+	if err == nil {
+		a.audit.record(newpath, existed, false)
+	}
+	return err
+}
+
+func (a auditFS) Symlink(oldname, newname string) error {
+	return a.change(newname, false, func() error { return a.FS.Symlink(oldname, newname) })
+}
+
+func (a auditFS) Truncate(name string, size int64) error {
+	return a.change(name, false, func() error { return a.FS.Truncate(name, size) })
+}
+
+func (a auditFS) WriteFile(filename string, data []byte, perm fs.FileMode) error {
+	return a.change(filename, false, func() error { return a.FS.WriteFile(filename, data, perm) })
+}
+
+// auditConsole records the service actions of the commands run through the wrapped console
+type auditConsole struct {
+	plugins.Console
+	audit *Audit
+}
+
+func (a auditConsole) Run(command string, opts ...func(cmd *exec.Cmd)) (string, error) {
+	out, err := a.Console.Run(command, opts...)
+	if err == nil {
+		a.audit.recordCommand(command)
+	}
+	return out, err
+}
+
+func (a auditConsole) RunTemplate(st []string, template string) error {
+	var errs error
+	for _, s := range st {
+		// One at a time so only the commands which succeeded are recorded
+		if err := a.Console.RunTemplate([]string{s}, template); err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		a.audit.recordCommand(fmt.Sprintf(template, s))
+	}
+	return errs
+}
@@ -29,6 +29,7 @@ type YipCloudInitRunner struct {
 	exec    executor.Executor
 	fs      vfs.FS
 	console plugins.Console
+	audit   *Audit
 }
 
 // NewYipCloudInitRunner returns a default yip cloud init executor with the Elemental plugin set.
@@ -70,9 +71,27 @@ func NewYipCloudInitRunner(l sdkTypes.KairosLogger, r v1.Runner, fs vfs.FS) *Yip
 }
 
 func (ci YipCloudInitRunner) Run(stage string, args ...string) error {
+	if ci.audit != nil {
+		return ci.exec.Run(stage, auditFS{FS: ci.fs, audit: ci.audit}, auditConsole{Console: ci.console, audit: ci.audit}, args...)
+	}
 	return ci.exec.Run(stage, ci.fs, ci.console, args...)
 }
 
+// StartAudit records the changes applied by the following runs until StopAudit is called
+func (ci *YipCloudInitRunner) StartAudit() {
+	ci.audit = newAudit()
+}
+
+// StopAudit stops recording and returns the changes applied since StartAudit, nil if no audit was started
+func (ci *YipCloudInitRunner) StopAudit() *Audit {
+	if ci.audit == nil {
+		return nil
+	}
+	a := ci.audit.finish()
+	ci.audit = nil
+	return a
+}
+
 func (ci *YipCloudInitRunner) SetModifier(m schema.Modifier) {
 	ci.exec.Modifier(m)
 }
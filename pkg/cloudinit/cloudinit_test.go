@@ -293,4 +293,46 @@ stages:
 			Expect(logs.String()).To(MatchRegexp("Could not find device for the given label"))
 		})
 	})
+	Describe("auditing changes", func() {
+		It("reports the files and services changed by the modules", func() {
+			afs, cleanup, err := vfst.NewTestFS(map[string]interface{}{
+				"/etc/existing.conf": "old",
+				"/some/yip/audit.yaml": `
+stages:
+  test:
+  - files:
+    - path: /etc/new.conf
+      content: new
+    - path: /etc/existing.conf
+      content: updated
+    directories:
+    - path: /etc/newdir
+    systemctl:
+      enable:
+      - sshd
+    commands:
+    - systemctl mask --now getty@tty1
+`,
+			})
+			Expect(err).Should(BeNil())
+			defer cleanup()
+			runner := v1mock.NewFakeRunner()
+			cloudRunner := NewYipCloudInitRunner(sdkTypes.NewNullLogger(), runner, afs)
+
+			cloudRunner.StartAudit()
+			Expect(cloudRunner.Run("test", "/some/yip")).To(Succeed())
+			audit := cloudRunner.StopAudit()
+			Expect(audit.Created).To(Equal([]string{"/etc/new.conf", "/etc/newdir"}))
+			Expect(audit.Modified).To(ContainElement("/etc/existing.conf"))
+			Expect(audit.Removed).To(BeEmpty())
+			Expect(audit.Services).To(Equal([]ServiceChange{
+				{Service: "getty@tty1", Action: "mask"},
+				{Service: "sshd", Action: "enable"},
+			}))
+
+			// Nothing is recorded once the audit stopped
+			Expect(cloudRunner.Run("test", "/some/yip")).To(Succeed())
+			Expect(cloudRunner.StopAudit()).To(BeNil())
+		})
+	})
 })
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// AcceleratorVendors are the vendors of the GPUs and accelerators detected on install
+var AcceleratorVendors = []string{"nvidia", "intel", "amd", "arm"}
+
+// Accelerators are the driver bundles offered on install for the GPUs and accelerators of the machine. The
+// matching bundles are installed along with the install bundles, once accepted or automatically with auto.
+type Accelerators struct {
+	// Auto installs the matching bundles without asking, as the unattended installs do not ask
+	Auto bool `yaml:"auto,omitempty" mapstructure:"auto"`
+	// Catalog are the driver bundles available, the first one matching an accelerator is offered for it
+	Catalog []AcceleratorBundle `yaml:"catalog,omitempty" mapstructure:"catalog"`
+	// Decisions are filled on install with what was done for each of the accelerators detected
+	Decisions []AcceleratorDecision `yaml:"-" mapstructure:"-"`
+}
+
+// AcceleratorBundle is a driver bundle of the accelerators catalog
+type AcceleratorBundle struct {
+	// Name is the name the bundle is offered and recorded with, its targets if empty
+	Name string `yaml:"name,omitempty" mapstructure:"name"`
+	// Vendor is the vendor of the accelerators the bundle is for: nvidia, intel, amd or arm
+	Vendor string `yaml:"vendor" mapstructure:"vendor"`
+	// Devices narrows the bundle to these devices, as PCI `vendor:device` ids or device tree compatibles, which
+	// can be glob patterns, i.e. 10de:22*. It's for all the devices of the vendor if empty.
+	Devices []string `yaml:"devices,omitempty" mapstructure:"devices"`
+	Bundle  Bundle   `yaml:"bundle" mapstructure:"bundle"`
+}
+
+// AcceleratorDecision records what was done on install for a detected accelerator
+type AcceleratorDecision struct {
+	Address string `yaml:"address" json:"address"`
+	Vendor  string `yaml:"vendor" json:"vendor"`
+	Device  string `yaml:"device" json:"device"`
+	// Bundle is the name of the bundle of the catalog for the accelerator, empty if there is none
+	Bundle    string `yaml:"bundle,omitempty" json:"bundle,omitempty"`
+	Installed bool   `yaml:"installed" json:"installed"`
+	// Reason is why the bundle was installed or not: auto, accepted, declined, unattended or no-bundle
+	Reason string `yaml:"reason" json:"reason"`
+}
+
+// String returns the name of the bundle, or its targets if it has no name
+func (b AcceleratorBundle) String() string {
+	if b.Name != "" {
+		return b.Name
+	}
+	return strings.Join(b.Bundle.Targets, ",")
+}
+
+// Matches returns whether the bundle is for the device of the vendor
+func (b AcceleratorBundle) Matches(vendor, device string) bool {
+	if b.Vendor != vendor {
+		return false
+	}
+	if len(b.Devices) == 0 {
+		return true
+	}
+	for _, pattern := range b.Devices {
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(device)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns the first bundle of the catalog for the device of the vendor, nil if there is none
+func (a *Accelerators) Match(vendor, device string) *AcceleratorBundle {
+	for i := range a.Catalog {
+		if a.Catalog[i].Matches(vendor, device) {
+			return &a.Catalog[i]
+		}
+	}
+	return nil
+}
+
+// Validate checks the bundles of the catalog are for a known vendor and have targets to install
+func (a *Accelerators) Validate() error {
+	for i, b := range a.Catalog {
+		if !contains(AcceleratorVendors, b.Vendor) {
+			return fmt.Errorf("catalog bundle %d: unknown vendor %q, expected one of %s", i, b.Vendor, strings.Join(AcceleratorVendors, ", "))
+		}
+		if len(b.Bundle.Targets) == 0 {
+			return fmt.Errorf("catalog bundle %d: no bundle targets set", i)
+		}
+		for _, pattern := range b.Devices {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("catalog bundle %d: invalid device pattern %q: %w", i, pattern, err)
+			}
+		}
+	}
+	return nil
+}
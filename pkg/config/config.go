@@ -5,17 +5,22 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 	"unicode"
 
 	"github.com/kairos-io/kairos-sdk/state"
 
 	"github.com/joho/godotenv"
 	version "github.com/kairos-io/kairos-agent/v2/internal/common"
+	"github.com/kairos-io/kairos-agent/v2/internal/i18n"
 	"github.com/kairos-io/kairos-agent/v2/pkg/cloudinit"
 	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
 	"github.com/kairos-io/kairos-agent/v2/pkg/http"
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
 	"github.com/kairos-io/kairos-sdk/bundles"
 	"github.com/kairos-io/kairos-sdk/collector"
 	"github.com/kairos-io/kairos-sdk/schema"
@@ -31,6 +36,14 @@ import (
 const (
 	DefaultWebUIListenAddress = ":8080"
 	FilePrefix                = "file://"
+	// ConfigOverridesKey is the viper key holding the config files passed with the `--config` flag
+	ConfigOverridesKey = "config-overrides"
+	// ImagePolicyFileKey is the viper key holding the image policy file passed with the `--policy-file` flag
+	ImagePolicyFileKey = "image-policy-file"
+	// JSONProgressKey is the viper key set by the `--json-progress` flag
+	JSONProgressKey = "json-progress"
+	// NoEfivarsKey is the viper key set by the `--no-efivars` flag
+	NoEfivarsKey = "no-efivars"
 )
 
 type Install struct {
@@ -56,10 +69,14 @@ type Install struct {
 	ExtraDirsRootfs        []string               `yaml:"extra-dirs-rootfs,omitempty" mapstructure:"extra-dirs-rootfs"`
 	Force                  bool                   `yaml:"force,omitempty" mapstructure:"force"`
 	NoUsers                bool                   `yaml:"nousers,omitempty" mapstructure:"nousers"`
+	// Accelerators are the driver bundles offered for the GPUs and accelerators of the machine
+	Accelerators *Accelerators `yaml:"accelerators,omitempty" mapstructure:"accelerators"`
 }
 
 func NewConfig(opts ...GenericOptions) *Config {
-	log := sdkTypes.NewKairosLogger("agent", "info", false)
+	// With the JSON progress stream on stdout the logs only go to the log files, so the stream can be parsed
+	jsonProgress := viper.GetBool(JSONProgressKey)
+	log := sdkTypes.NewKairosLogger("agent", "info", jsonProgress)
 	// Get the viper config in case something in command line or env var has set it and set the level asap
 	if viper.GetBool("debug") {
 		log.SetLevel("debug")
@@ -85,10 +102,22 @@ func NewConfig(opts ...GenericOptions) *Config {
 		Arch:                      arch,
 		Platform:                  hostPlatform,
 		SquashFsCompressionConfig: constants.GetDefaultSquashfsCompressionOptions(),
-		ImageExtractor:            v1.OCIImageExtractor{},
+		ImageExtractor:            v1.OCIImageExtractor{Workers: constants.PullWorkers},
 		SquashFsNoCompression:     true,
 		Install:                   &Install{},
 		UkiMaxEntries:             constants.UkiMaxEntries,
+		PullWorkers:               constants.PullWorkers,
+		SizeWorkers:               constants.SizeWorkers,
+		sourceSizes:               &sourceSizeCache{},
+		Progress:                  v1.NullProgress{},
+	}
+	if jsonProgress {
+		c.Progress = v1.NewJSONProgress(os.Stdout)
+	}
+	// Operate on the system mounted at the alternative root set with the --root flag, if any
+	if constants.HasRoot() {
+		c.Fs = vfs.NewPathFS(vfs.OSFS, constants.GetRoot())
+		c.Syscall = &v1.RootedSyscall{SyscallInterface: c.Syscall, Root: constants.GetRoot()}
 	}
 	for _, o := range opts {
 		o(c)
@@ -148,15 +177,52 @@ type Config struct {
 	ImageExtractor            v1.ImageExtractor     `yaml:"-"`
 	Client                    v1.HTTPClient         `yaml:"-"`
 	Platform                  *v1.Platform          `yaml:"-"`
+	Progress                  v1.ProgressReporter   `yaml:"-"`
 	Cosign                    bool                  `yaml:"cosign,omitempty" mapstructure:"cosign"`
-	Verify                    bool                  `yaml:"verify,omitempty" mapstructure:"verify"`
+	Verify                    Verify                `yaml:"verify,omitempty" mapstructure:"verify"`
 	CosignPubKey              string                `yaml:"cosign-key,omitempty" mapstructure:"cosign-key"`
 	Arch                      string                `yaml:"arch,omitempty" mapstructure:"arch"`
 	SquashFsCompressionConfig []string              `yaml:"squash-compression,omitempty" mapstructure:"squash-compression"`
 	SquashFsNoCompression     bool                  `yaml:"squash-no-compression,omitempty" mapstructure:"squash-no-compression"`
 	UkiMaxEntries             int                   `yaml:"uki-max-entries,omitempty" mapstructure:"uki-max-entries"`
+	UkiAllowedCerts           []string              `yaml:"uki-allowed-certs,omitempty" mapstructure:"uki-allowed-certs"`
 	BindPCRs                  []string              `yaml:"bind-pcrs,omitempty" mapstructure:"bind-pcrs"`
 	BindPublicPCRs            []string              `yaml:"bind-public-pcrs,omitempty" mapstructure:"bind-public-pcrs"`
+	NoEfivars                 bool                  `yaml:"no-efivars,omitempty" mapstructure:"no-efivars"`
+	ImagePolicy               *v1.ImagePolicy       `yaml:"image-policy,omitempty" mapstructure:"image-policy"`
+	Referrers                 *v1.Referrers         `yaml:"referrers,omitempty" mapstructure:"referrers"`
+	ConfigSources             []ConfigSource        `yaml:"config_sources,omitempty" mapstructure:"config_sources"`
+	ConfigSigning             *ConfigSigning        `yaml:"config_signing,omitempty" mapstructure:"config_signing"`
+	WebUI                     *WebUI                `yaml:"webui,omitempty" mapstructure:"webui"`
+	Heartbeat                 *Heartbeat            `yaml:"heartbeat,omitempty" mapstructure:"heartbeat"`
+	Reenroll                  *Reenroll             `yaml:"reenroll,omitempty" mapstructure:"reenroll"`
+	TempDirs                  *TempDirs             `yaml:"temp_dirs,omitempty" mapstructure:"temp_dirs"`
+	Watchdog                  *Watchdog             `yaml:"watchdog,omitempty" mapstructure:"watchdog"`
+	UpgradeApproval           *UpgradeApproval      `yaml:"upgrade_approval,omitempty" mapstructure:"upgrade_approval"`
+	RegistryPinning           *RegistryPinning      `yaml:"registry_pinning,omitempty" mapstructure:"registry_pinning"`
+	Registries                *v1.Registries        `yaml:"registries,omitempty" mapstructure:"registries"`
+	RegistryAuth              *v1.RegistryAuth      `yaml:"registry_auth,omitempty" mapstructure:"registry_auth"`
+	ResetButton               *ResetButton          `yaml:"reset_button,omitempty" mapstructure:"reset_button"`
+	Logs                      *Logs                 `yaml:"logs,omitempty" mapstructure:"logs"`
+	Storage                   *Storage              `yaml:"storage,omitempty" mapstructure:"storage"`
+	Resolver                  *Resolver             `yaml:"resolver,omitempty" mapstructure:"resolver"`
+	Upgrade                   *Upgrade              `yaml:"upgrade,omitempty" mapstructure:"upgrade"`
+	// VerifyDeploy reads back samples of the deployed images from disk before booting into them
+	VerifyDeploy bool      `yaml:"verify-deploy,omitempty" mapstructure:"verify-deploy"`
+	Squashfs     *Squashfs `yaml:"squashfs,omitempty" mapstructure:"squashfs"`
+	// PermissionsAudit scans the deployed system trees for risky permissions before they are packed into images
+	PermissionsAudit *v1.PermissionsAudit `yaml:"permissions_audit,omitempty" mapstructure:"permissions_audit"`
+	// Language of the CLI messages and prompts, like es or de_DE.UTF-8, overriding the one of the environment
+	Language string `yaml:"language,omitempty" mapstructure:"language"`
+	// PullWorkers is how many image layers are downloaded at once while the previous ones are extracted, 1 pulls
+	// them one by one. The layers downloaded ahead are kept in the temporary dir until extracted.
+	PullWorkers int `yaml:"pull-workers,omitempty" mapstructure:"pull-workers"`
+	// SizeWorkers is how many directories are read at once while calculating the size of the dir sources, 1 walks
+	// them one by one
+	SizeWorkers int `yaml:"size-workers,omitempty" mapstructure:"size-workers"`
+	// sourceSizes are the size estimations of the sources already calculated, reused across the specs and the
+	// deployment of the same command
+	sourceSizes *sourceSizeCache
 }
 
 // WriteInstallState writes the state.yaml file to the given state and recovery paths
@@ -168,12 +234,12 @@ func (c Config) WriteInstallState(i *v1.InstallState, statePath, recoveryPath st
 
 	data = append([]byte("# Autogenerated file by elemental client, do not edit\n\n"), data...)
 
-	err = c.Fs.WriteFile(statePath, data, constants.ConfigPerm)
+	err = fsutils.AtomicWriteFile(c.Fs, statePath, data, constants.ConfigPerm)
 	if err != nil {
 		return err
 	}
 
-	err = c.Fs.WriteFile(recoveryPath, data, constants.ConfigPerm)
+	err = fsutils.AtomicWriteFile(c.Fs, recoveryPath, data, constants.ConfigPerm)
 	if err != nil {
 		return err
 	}
@@ -329,6 +395,12 @@ func WithImageExtractor(extractor v1.ImageExtractor) func(r *Config) {
 	}
 }
 
+func WithProgress(progress v1.ProgressReporter) func(r *Config) {
+	return func(r *Config) {
+		r.Progress = progress
+	}
+}
+
 type Bundles []Bundle
 
 type Bundle struct {
@@ -339,6 +411,279 @@ type Bundle struct {
 	Targets    []string `yaml:"targets,omitempty"`
 }
 
+// Verify holds the cosign verification constraints applied when cosign is enabled
+type Verify struct {
+	CertificateIdentityRegexp   string `yaml:"certificate-identity-regexp,omitempty" mapstructure:"certificate-identity-regexp"`
+	CertificateOIDCIssuerRegexp string `yaml:"certificate-oidc-issuer-regexp,omitempty" mapstructure:"certificate-oidc-issuer-regexp"`
+	Offline                     bool   `yaml:"offline,omitempty" mapstructure:"offline"`
+	TrustedRoot                 string `yaml:"trusted-root,omitempty" mapstructure:"trusted-root"`
+	CacheDir                    string `yaml:"cache-dir,omitempty" mapstructure:"cache-dir"`
+	// Signatures are the detached signatures the file sources must have: `cosign`, a `.sig` verified with the
+	// cosign-key, and `gpg`, a `.asc` verified with the GPG keyrings. None are required by default
+	Signatures []string `yaml:"signatures,omitempty" mapstructure:"signatures"`
+	// GPGKeyring is the GPG keyring file, or dir of keyrings, constants.GPGKeyringsDir by default
+	GPGKeyring string `yaml:"gpg-keyring,omitempty" mapstructure:"gpg-keyring"`
+}
+
+// UnmarshalYAML keeps accepting the former boolean `verify` key, which carries no options
+func (v *Verify) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		var enabled bool
+		return value.Decode(&enabled)
+	}
+	type verify Verify
+	return value.Decode((*verify)(v))
+}
+
+// ResetButton is a hardware button that, held down, triggers a factory reset from the running agent.
+// Either an input event Device, like the ones created by gpio-keys, or a GPIO sysfs value file is watched.
+type ResetButton struct {
+	Device string `yaml:"device,omitempty" mapstructure:"device"`
+	// Key is the key code reported by Device, KEY_RESTART (408) by default
+	Key       uint16 `yaml:"key,omitempty" mapstructure:"key"`
+	GPIO      string `yaml:"gpio,omitempty" mapstructure:"gpio"`
+	ActiveLow bool   `yaml:"active-low,omitempty" mapstructure:"active-low"`
+	// Hold is how long the button must be held down, 10s by default
+	Hold time.Duration `yaml:"hold,omitempty" mapstructure:"hold"`
+	// Countdown is shown on the console before rebooting into reset, pressing the button again cancels it. 10s by default
+	Countdown time.Duration `yaml:"countdown,omitempty" mapstructure:"countdown"`
+}
+
+// Storage sets up additional disks of the installed system
+type Storage struct {
+	DataDisk *DataDisk `yaml:"data_disk,omitempty" mapstructure:"data_disk"`
+	VarLib   *VarLib   `yaml:"var_lib,omitempty" mapstructure:"var_lib"`
+}
+
+// VarLib declares the persistence class of the /var/lib subpaths, the paths are relative to /var/lib. The install
+// generates the bind and ephemeral mounts of them, so they don't need to be listed in install.bind_mounts and
+// install.ephemeral_mounts. The paths not declared keep the class of the image.
+type VarLib struct {
+	// Persistent paths are bind mounted from the persistent partition, they are kept across reboots and upgrades
+	Persistent []string `yaml:"persistent,omitempty" mapstructure:"persistent"`
+	// Ephemeral paths are overlaid with a tmpfs, they are reset on every boot
+	Ephemeral []string `yaml:"ephemeral,omitempty" mapstructure:"ephemeral"`
+}
+
+// Classes returns the persistence class of every declared path, by absolute path. It fails on paths out of
+// /var/lib, on paths declared twice and on paths nested in a path of the other class, as the order the mounts
+// are applied in would decide which class they get.
+func (v *VarLib) Classes() (map[string]string, error) {
+	classes := map[string]string{}
+	for class, paths := range map[string][]string{constants.VarLibPersistent: v.Persistent, constants.VarLibEphemeral: v.Ephemeral} {
+		for _, p := range paths {
+			abs := filepath.Clean("/" + p)
+			if !strings.HasPrefix(abs, constants.VarLibDir+"/") {
+				abs = filepath.Join(constants.VarLibDir, abs)
+			}
+			if abs == constants.VarLibDir || strings.Contains(p, "..") {
+				return nil, fmt.Errorf("invalid %s path %q, it must be a subpath of %s", class, p, constants.VarLibDir)
+			}
+			if other, ok := classes[abs]; ok {
+				return nil, fmt.Errorf("%s is declared %s and %s", abs, other, class)
+			}
+			classes[abs] = class
+		}
+	}
+	for path, class := range classes {
+		for other, otherClass := range classes {
+			if class != otherClass && strings.HasPrefix(path, other+"/") {
+				return nil, fmt.Errorf("the %s path %s is nested in the %s path %s", class, path, otherClass, other)
+			}
+		}
+	}
+	return classes, nil
+}
+
+// Mounts returns the bind and ephemeral mounts of the declared paths, sorted
+func (v *VarLib) Mounts() (bind []string, ephemeral []string, err error) {
+	classes, err := v.Classes()
+	if err != nil {
+		return nil, nil, err
+	}
+	for path, class := range classes {
+		if class == constants.VarLibPersistent {
+			bind = append(bind, path)
+		} else {
+			ephemeral = append(ephemeral, path)
+		}
+	}
+	sort.Strings(bind)
+	sort.Strings(ephemeral)
+	return bind, ephemeral, nil
+}
+
+// DataDisk is an additional disk mounted on every boot. It is formatted on first boot only if it has no
+// filesystem nor partition table yet, an existing filesystem and its data are kept.
+type DataDisk struct {
+	Device string `yaml:"device,omitempty" mapstructure:"device"`
+	// MountPoint is where the disk is mounted, /var/lib/data by default
+	MountPoint string `yaml:"mountpoint,omitempty" mapstructure:"mountpoint"`
+	// FS is the filesystem the disk is formatted with, ext4 by default
+	FS string `yaml:"fs,omitempty" mapstructure:"fs"`
+	// Label is the filesystem label set when formatting, KAIROS_DATA by default
+	Label   string   `yaml:"label,omitempty" mapstructure:"label"`
+	Options []string `yaml:"options,omitempty" mapstructure:"options"`
+}
+
+// validateVarLib checks the declared classes and that the install mounts don't give a declared path the other class
+func validateVarLib(v *VarLib, install *Install) error {
+	classes, err := v.Classes()
+	if err != nil {
+		return err
+	}
+	if install == nil {
+		return nil
+	}
+	for class, mounts := range map[string][]string{constants.VarLibPersistent: install.BindMounts, constants.VarLibEphemeral: install.EphemeralMounts} {
+		for _, m := range mounts {
+			if declared, ok := classes[filepath.Clean(m)]; ok && declared != class {
+				return fmt.Errorf("%s is declared %s but it is %s in the install mounts", m, declared, class)
+			}
+		}
+	}
+	return nil
+}
+
+// Heartbeat makes the agent periodically report the node status to a fleet backend
+type Heartbeat struct {
+	// URL is the endpoint the status document is POSTed to
+	URL string `yaml:"url,omitempty" mapstructure:"url"`
+	// Interval is the time between reports, 5m by default. Failed reports are retried sooner, with backoff.
+	Interval time.Duration `yaml:"interval,omitempty" mapstructure:"interval"`
+	// SigningKey is the PEM encoded private key the status document is signed with. The base64 encoded signature
+	// is sent in the X-Kairos-Signature header, in the same format `cosign sign-blob` uses.
+	SigningKey string `yaml:"signing-key,omitempty" mapstructure:"signing-key"`
+	// Token is sent as bearer token, if set
+	Token string `yaml:"token,omitempty" mapstructure:"token"`
+}
+
+// Reenroll makes the node rejoin its fleet manager after a successful reset. The credentials are read before
+// resetting, so they survive resetting the OEM partition.
+type Reenroll struct {
+	// URL is the webhook the reset state is POSTed to, with the credentials as bearer token
+	URL string `yaml:"url,omitempty" mapstructure:"url"`
+	// Command is run with sh, with the reset state as JSON in KAIROS_RESET_STATE and the credentials in
+	// KAIROS_REENROLL_CREDENTIALS
+	Command string `yaml:"command,omitempty" mapstructure:"command"`
+	// Credentials is the file the credentials are read from, constants.ReenrollCredentialsFile by default
+	Credentials string `yaml:"credentials,omitempty" mapstructure:"credentials"`
+	// Timeout bounds the webhook and the command, 2m by default
+	Timeout time.Duration `yaml:"timeout,omitempty" mapstructure:"timeout"`
+}
+
+// Watchdog remediates an upgraded system which never reports healthy. Health is reported by the upgrade smoke tests
+// passing or by running `kairos-agent watchdog healthy`, i.e. from a service of the workload.
+type Watchdog struct {
+	// MaxBoots is the number of boots of the upgraded system without reporting healthy before remediating, 3 by default
+	MaxBoots int `yaml:"max-boots,omitempty" mapstructure:"max-boots"`
+	// Timeout is how long after the upgrade the system has to report healthy, no limit if 0
+	Timeout time.Duration `yaml:"timeout,omitempty" mapstructure:"timeout"`
+	// Action is the remediation: fallback (default) boots the passive system, reset resets the system from
+	// recovery and none only sends the alert
+	Action string `yaml:"action,omitempty" mapstructure:"action"`
+	// Webhook is POSTed the watchdog state as JSON when remediating
+	Webhook string `yaml:"webhook,omitempty" mapstructure:"webhook"`
+}
+
+// UpgradeApproval gates the upgrades on an external endpoint approving them, i.e. to roll them out in waves.
+// Forced upgrades skip the approval.
+type UpgradeApproval struct {
+	// URL is POSTed the node identity and the upgrade target as JSON, the upgrade goes ahead if it answers
+	// with a 2xx status and "approved": true
+	URL string `yaml:"url,omitempty" mapstructure:"url"`
+	// Token is sent as bearer token
+	Token string `yaml:"token,omitempty" mapstructure:"token"`
+	// Timeout bounds the request, 30s by default
+	Timeout time.Duration `yaml:"timeout,omitempty" mapstructure:"timeout"`
+	// Cache is how long the decision for a target is reused without asking again, decisions are not cached if 0
+	Cache time.Duration `yaml:"cache,omitempty" mapstructure:"cache"`
+	// Offline is the decision when the endpoint can't be reached and there is no cached one: deny (default) or allow
+	Offline string `yaml:"offline,omitempty" mapstructure:"offline"`
+}
+
+// TempDirs limits the temporary dirs the agent works in, like the ones images are built or ISOs are mounted at
+type TempDirs struct {
+	// Quota is the size in MiB a single temporary dir can grow to before the operation using it fails, no limit if 0
+	Quota uint `yaml:"quota,omitempty" mapstructure:"quota"`
+}
+
+// Squashfs configures how the squashfs images, like the recovery one, are created. It takes precedence over
+// squash-compression and squash-no-compression.
+type Squashfs struct {
+	// Compression is the mksquashfs compressor with an optional level, e.g. `zstd:19`, `xz` or `gzip:9`
+	Compression string `yaml:"compression,omitempty" mapstructure:"compression"`
+	// BlockSize is the mksquashfs block size, e.g. `1M` or `131072`
+	BlockSize string `yaml:"block-size,omitempty" mapstructure:"block-size"`
+	// Processors limits the threads mksquashfs compresses with, all the CPUs by default
+	Processors int `yaml:"processors,omitempty" mapstructure:"processors"`
+}
+
+// squashfsLevels are the compression levels of the compressors taking them, lz4 only takes hc for high compression
+var squashfsLevels = map[string][2]int{"gzip": {1, 9}, "lzo": {1, 9}, "zstd": {1, 22}}
+
+// Validate checks the compressor, level and block size are ones mksquashfs takes, so a typo does not fail the image
+// creation once the source has been pulled. Whether the installed mksquashfs was built with the compressor is only
+// known when creating the image.
+func (s *Squashfs) Validate() error {
+	if s.Compression != "" {
+		comp, level, hasLevel := strings.Cut(s.Compression, ":")
+		switch comp {
+		case "gzip", "lzo", "lz4", "xz", "zstd", "lzma":
+		default:
+			return fmt.Errorf("unknown compression %q, it must be one of gzip, lzo, lz4, xz, zstd or lzma", comp)
+		}
+		if bounds, ok := squashfsLevels[comp]; ok && hasLevel {
+			l, err := strconv.Atoi(level)
+			if err != nil || l < bounds[0] || l > bounds[1] {
+				return fmt.Errorf("invalid %s compression level %q, it must be between %d and %d", comp, level, bounds[0], bounds[1])
+			}
+		}
+	}
+	if s.BlockSize != "" {
+		size, err := parseSquashfsBlockSize(s.BlockSize)
+		if err != nil {
+			return err
+		}
+		if size < 4096 || size > 1024*1024 || size&(size-1) != 0 {
+			return fmt.Errorf("invalid block size %s, it must be a power of two between 4K and 1M", s.BlockSize)
+		}
+	}
+	if s.Processors < 0 {
+		return fmt.Errorf("the processors can't be negative")
+	}
+	return nil
+}
+
+// parseSquashfsBlockSize parses the block size in bytes, with an optional K or M suffix like mksquashfs takes
+func parseSquashfsBlockSize(value string) (int, error) {
+	number, unit := value, 1
+	switch {
+	case strings.HasSuffix(strings.ToUpper(value), "K"):
+		number, unit = value[:len(value)-1], 1024
+	case strings.HasSuffix(strings.ToUpper(value), "M"):
+		number, unit = value[:len(value)-1], 1024*1024
+	}
+	size, err := strconv.Atoi(number)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid block size %s", value)
+	}
+	return size * unit, nil
+}
+
+// Logs configures what the logs command collects into the support bundle
+type Logs struct {
+	// JournalArgs are passed to journalctl to narrow down the collected journal, e.g. `--since 24h` or `-n 5000`
+	JournalArgs []string `yaml:"journal_args,omitempty" mapstructure:"journal_args"`
+	// Units are the systemd units whose journal is collected, on top of the default Kairos ones
+	Units []string `yaml:"units,omitempty" mapstructure:"units"`
+	// Files are extra file globs to collect, on top of the default Kairos log files
+	Files []string `yaml:"files,omitempty" mapstructure:"files"`
+	// MaxFileSize caps each collected file and journal, in bytes, keeping its head and its tail. 0 uses the default
+	// and a negative value disables the cap.
+	MaxFileSize int64 `yaml:"max_file_size,omitempty" mapstructure:"max_file_size"`
+}
+
 const DefaultHeader = "#cloud-config"
 
 func HasHeader(userdata, head string) (bool, string) {
@@ -415,11 +760,27 @@ func scan(result *Config, opts ...collector.Option) (c *Config, err error) {
 		return result, err
 	}
 
+	err = sealConfigDirs(result, o)
+	if err != nil {
+		return result, err
+	}
+	signing := result.ConfigSigning
+
 	genericConfig, err := collector.Scan(o, FilterKeys)
 	if err != nil {
 		return result, err
 	}
 
+	genericConfig, err = mergeConfigSources(result, genericConfig)
+	if err != nil {
+		return result, err
+	}
+
+	err = mergeConfigOverrides(result.hostFs(), genericConfig)
+	if err != nil {
+		return result, err
+	}
+
 	result.Config = *genericConfig
 	configStr, err := genericConfig.String()
 	if err != nil {
@@ -431,6 +792,89 @@ func scan(result *Config, opts ...collector.Option) (c *Config, err error) {
 		return result, err
 	}
 
+	// Config signing is only taken from the image configs, the OEM ones cannot change it
+	result.ConfigSigning = signing
+
+	if viper.GetBool(NoEfivarsKey) {
+		result.NoEfivars = true
+	}
+
+	err = loadImagePolicyFile(result)
+	if err != nil {
+		return result, err
+	}
+
+	if result.Resolver != nil {
+		if _, err = result.Resolver.HostsTable(); err != nil {
+			return result, fmt.Errorf("resolver: %w", err)
+		}
+	}
+	if result.Squashfs != nil {
+		if err = result.Squashfs.Validate(); err != nil {
+			return result, fmt.Errorf("squashfs: %w", err)
+		}
+	}
+	if result.Upgrade != nil && result.Upgrade.Window != nil {
+		if err = result.Upgrade.Window.Validate(); err != nil {
+			return result, fmt.Errorf("upgrade window: %w", err)
+		}
+	}
+	if result.Storage != nil && result.Storage.VarLib != nil {
+		if err = validateVarLib(result.Storage.VarLib, result.Install); err != nil {
+			return result, fmt.Errorf("storage var_lib: %w", err)
+		}
+	}
+	if result.Install != nil && result.Install.Accelerators != nil {
+		if err = result.Install.Accelerators.Validate(); err != nil {
+			return result, fmt.Errorf("install accelerators: %w", err)
+		}
+	}
+	if result.Language != "" {
+		if err = i18n.SetLanguage(result.Language); err != nil {
+			return result, fmt.Errorf("language: %w", err)
+		}
+	}
+	if result.PullWorkers < 0 {
+		return result, fmt.Errorf("pull-workers: must be 1 or more, got %d", result.PullWorkers)
+	}
+	if extractor, ok := result.ImageExtractor.(v1.OCIImageExtractor); ok && result.PullWorkers > 0 {
+		extractor.Workers = result.PullWorkers
+		result.ImageExtractor = extractor
+	}
+	if result.SizeWorkers < 0 {
+		return result, fmt.Errorf("size-workers: must be 1 or more, got %d", result.SizeWorkers)
+	}
+	if transport := result.RegistryTransport(); transport != nil {
+		if extractor, ok := result.ImageExtractor.(v1.OCIImageExtractor); ok {
+			extractor.Transport = transport
+			result.ImageExtractor = extractor
+		}
+	}
+	if result.Registries != nil {
+		if err = result.Registries.Validate(); err != nil {
+			return result, fmt.Errorf("registries: %w", err)
+		}
+		if extractor, ok := result.ImageExtractor.(v1.OCIImageExtractor); ok {
+			extractor.Registries = result.Registries
+			extractor.MirrorFailed = result.mirrorFailed
+			result.ImageExtractor = extractor
+		}
+	}
+	if result.RegistryAuth != nil {
+		if err = result.RegistryAuth.Validate(); err != nil {
+			return result, fmt.Errorf("registry_auth: %w", err)
+		}
+		if extractor, ok := result.ImageExtractor.(v1.OCIImageExtractor); ok {
+			extractor.Auth = result.RegistryAuth
+			result.ImageExtractor = extractor
+		}
+	}
+	if transport := result.HTTPTransport(); transport != nil {
+		if client, ok := result.Client.(*http.Client); ok {
+			client.SetTransport(transport)
+		}
+	}
+
 	kc, err := schema.NewConfigFromYAML(configStr, schema.RootSchema{})
 	if err != nil {
 		if !o.NoLogs && !o.StrictValidation {
@@ -504,6 +948,54 @@ func scan(result *Config, opts ...collector.Option) (c *Config, err error) {
 	return result, nil
 }
 
+// hostFs returns the filesystem of the host, which is not Fs when operating on a system mounted at an alternative
+// root. Files passed in the command line, like the config overrides, are host files.
+func (c *Config) hostFs() v1.FS {
+	if constants.HasRoot() {
+		return vfs.OSFS
+	}
+	return c.Fs
+}
+
+// mergeConfigOverrides merges the config files passed with the `--config` flag on top of the scanned config.
+// They have the highest priority and only apply to the current invocation, they are never written anywhere.
+func mergeConfigOverrides(fs v1.FS, c *collector.Config) error {
+	for _, f := range viper.GetStringSlice(ConfigOverridesKey) {
+		data, err := fs.ReadFile(f)
+		if err != nil {
+			return fmt.Errorf("reading config override %s: %w", f, err)
+		}
+		values := collector.ConfigValues{}
+		if err = yaml.Unmarshal(data, &values); err != nil {
+			return fmt.Errorf("parsing config override %s: %w", f, err)
+		}
+		err = c.MergeConfig(&collector.Config{Sources: []string{f}, Values: values})
+		if err != nil {
+			return fmt.Errorf("merging config override %s: %w", f, err)
+		}
+	}
+	return nil
+}
+
+// loadImagePolicyFile sets the image policy passed with the `--policy-file` flag, which takes
+// precedence over the one in the cloud config
+func loadImagePolicyFile(c *Config) error {
+	f := viper.GetString(ImagePolicyFileKey)
+	if f == "" {
+		return nil
+	}
+	data, err := c.hostFs().ReadFile(f)
+	if err != nil {
+		return fmt.Errorf("reading image policy %s: %w", f, err)
+	}
+	policy := &v1.ImagePolicy{}
+	if err = yaml.Unmarshal(data, policy); err != nil {
+		return fmt.Errorf("parsing image policy %s: %w", f, err)
+	}
+	c.ImagePolicy = policy
+	return nil
+}
+
 type Stage string
 
 const (
@@ -520,7 +1012,7 @@ func SaveCloudConfig(name Stage, yc yip.YipConfig) error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(filepath.Join("usr", "local", "cloud-config", fmt.Sprintf("100_%s.yaml", name)), dnsYAML, 0700)
+	return fsutils.AtomicWriteFile(vfs.OSFS, filepath.Join("usr", "local", "cloud-config", fmt.Sprintf("100_%s.yaml", name)), dnsYAML, 0700)
 }
 
 func FromString(s string, o interface{}) error {
@@ -560,6 +1052,10 @@ func golangArchToArch(arch string) (string, error) {
 		return constants.Archx86, nil
 	case constants.ArchArm64:
 		return constants.ArchArm64, nil
+	case constants.ArchS390x:
+		return constants.ArchS390x, nil
+	case constants.ArchPpc64:
+		return constants.ArchPpc64, nil
 	default:
 		return "", errInvalidArch
 	}
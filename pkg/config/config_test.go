@@ -16,24 +16,39 @@
 package config_test
 
 import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
 	"fmt"
 	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
+	"time"
 
+	"github.com/kairos-io/kairos-agent/v2/internal/i18n"
 	pkgConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
 	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
 	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
 	v1mocks "github.com/kairos-io/kairos-agent/v2/tests/mocks"
+	"github.com/mudler/yip/pkg/console"
+	"github.com/mudler/yip/pkg/executor"
+	"github.com/spf13/viper"
 	"github.com/twpayne/go-vfs/v5"
 	"github.com/twpayne/go-vfs/v5/vfst"
 	"gopkg.in/yaml.v3"
 
 	. "github.com/kairos-io/kairos-agent/v2/pkg/config"
 	"github.com/kairos-io/kairos-sdk/collector"
-	. "github.com/kairos-io/kairos-sdk/schema"
+	sdkSchema "github.com/kairos-io/kairos-sdk/schema"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 )
@@ -68,9 +83,13 @@ func structContainsField(f, t string, str interface{}) bool {
 			return true
 		} else {
 			if types.Field(j).Type.Kind() == reflect.Struct {
+				// Embedded schemas, like the SDK RootSchema, hold fields of the schema embedding them
+				if types.Field(j).Anonymous && structContainsField(f, t, values.Field(j).Interface()) {
+					return true
+				}
 				if types.Field(j).Type.Name() != "" {
 					model := reflect.New(types.Field(j).Type)
-					if instance, ok := model.Interface().(OneOfModel); ok {
+					if instance, ok := model.Interface().(sdkSchema.OneOfModel); ok {
 						for _, childSchema := range instance.JSONSchemaOneOf() {
 							if structContainsField(f, t, childSchema) {
 								return true
@@ -108,13 +127,31 @@ func structFieldsContainedInOtherStruct(left, right interface{}) {
 var _ = Describe("Schema", func() {
 	Context("NewConfigFromYAML", func() {
 		Context("While the new Schema is not the single source of truth", func() {
-			structFieldsContainedInOtherStruct(Config{}, RootSchema{})
+			structFieldsContainedInOtherStruct(Config{}, Schema{})
 		})
 		Context("While the new InstallSchema is not the single source of truth", func() {
 			structFieldsContainedInOtherStruct(Install{}, InstallSchema{})
 		})
 		Context("While the new BundleSchema is not the single source of truth", func() {
-			structFieldsContainedInOtherStruct(Bundle{}, BundleSchema{})
+			structFieldsContainedInOtherStruct(Bundle{}, sdkSchema.BundleSchema{})
+		})
+	})
+
+	Describe("ValidateSchema", func() {
+		users := "users:\n- name: kairos\n  passwd: kairos\n"
+		It("validates the settings of the SDK schema and of the agent", func() {
+			Expect(ValidateSchema("#cloud-config\n" + users + "no-efivars: true\ninstall:\n  device: /dev/sda\n")).To(Succeed())
+			Expect(ValidateSchema("#cloud-config\n" + users + "install:\n  device: sda\n")).To(MatchError(ContainSubstring("/install/device")))
+			Expect(ValidateSchema("#cloud-config\n" + users + "no-efivars: 3\n")).To(MatchError(ContainSubstring("/no-efivars")))
+			Expect(ValidateSchema("#cloud-config\n" + users + "install:\n  media-tuning: always\n")).To(MatchError(ContainSubstring("/install/media-tuning")))
+			Expect(ValidateSchema("#cloud-config\n" + users + "install:\n  accelerators:\n    catalog:\n    - vendor: matrox\n      bundle:\n        targets: [run://drivers]\n")).To(MatchError(ContainSubstring("/install/accelerators/catalog/0/vendor")))
+			Expect(ValidateSchema(users)).To(MatchError(ContainSubstring("missing #cloud-config header")))
+		})
+		It("prints the schema with the agent settings", func() {
+			s, err := JSONSchema("v3.0.0")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(s).To(ContainSubstring("https://kairos.io/v3.0.0/cloud-config.json"))
+			Expect(s).To(ContainSubstring(`"no-efivars"`))
 		})
 	})
 
@@ -232,6 +269,386 @@ var _ = Describe("Schema", func() {
 			Expect(err).ShouldNot(HaveOccurred())
 			Expect(c.UkiMaxEntries).To(Equal(34))
 		})
+		It("Scan merges the config overrides with the highest priority", func() {
+			dir, err := os.MkdirTemp("", "config-overrides")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer os.RemoveAll(dir)
+			override := filepath.Join(dir, "override.yaml")
+			Expect(os.WriteFile(override, []byte("#cloud-config\nuki-max-entries: 3\n"), 0644)).To(Succeed())
+
+			viper.Set(ConfigOverridesKey, []string{override})
+			defer viper.Set(ConfigOverridesKey, nil)
+			c, err := ScanNoLogs(collector.Readers(strings.NewReader(`uki-max-entries: 34`)))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(c.UkiMaxEntries).To(Equal(3))
+
+			viper.Set(ConfigOverridesKey, []string{filepath.Join(dir, "missing.yaml")})
+			_, err = ScanNoLogs(collector.Readers(strings.NewReader(`uki-max-entries: 34`)))
+			Expect(err).Should(HaveOccurred())
+		})
+		It("Scan disables the EFI variables with the no-efivars flag", func() {
+			c, err := ScanNoLogs(collector.Readers(strings.NewReader(`uki-max-entries: 34`)))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(c.NoEfivars).To(BeFalse())
+
+			viper.Set(NoEfivarsKey, true)
+			defer viper.Set(NoEfivarsKey, false)
+			c, err = ScanNoLogs(collector.Readers(strings.NewReader(`no-efivars: false`)))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(c.NoEfivars).To(BeTrue())
+		})
+		It("Scan operates on the system mounted at the alternative root", func() {
+			root, err := os.MkdirTemp("", "root")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer os.RemoveAll(root)
+			Expect(os.MkdirAll(filepath.Join(root, "oem"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(root, "oem", "90_custom.yaml"), []byte("#cloud-config\nuki-max-entries: 5\n"), 0644)).To(Succeed())
+
+			constants.SetRoot(root)
+			defer constants.SetRoot("")
+			c, err := ScanNoLogs(collector.Directories(constants.GetUserConfigDirs()...))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(c.UkiMaxEntries).To(Equal(5))
+			data, err := c.Fs.ReadFile("/oem/90_custom.yaml")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring("uki-max-entries"))
+		})
+		It("Scan loads the image policy file over the image-policy config", func() {
+			dir, err := os.MkdirTemp("", "image-policy")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer os.RemoveAll(dir)
+			policy := filepath.Join(dir, "policy.yaml")
+			Expect(os.WriteFile(policy, []byte("allowed-registries:\n- quay.io/kairos\nmax-age: 720h\n"), 0644)).To(Succeed())
+
+			c, err := ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\nimage-policy:\n  max-age: 24h\n")))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(c.ImagePolicy.MaxAge).To(Equal("24h"))
+
+			viper.Set(ImagePolicyFileKey, policy)
+			defer viper.Set(ImagePolicyFileKey, "")
+			c, err = ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\nimage-policy:\n  max-age: 24h\n")))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(c.ImagePolicy.MaxAge).To(Equal("720h"))
+			Expect(c.ImagePolicy.AllowedRegistries).To(Equal([]string{"quay.io/kairos"}))
+		})
+		It("Scan merges the verified config sources below the local config and falls back to the cache", func() {
+			dir, err := os.MkdirTemp("", "config-sources")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer os.RemoveAll(dir)
+			cacheDir := ConfigSourcesCacheDir
+			ConfigSourcesCacheDir = dir
+			defer func() { ConfigSourcesCacheDir = cacheDir }()
+
+			site := []byte("#cloud-config\nuki-max-entries: 5\nstrict: true\n")
+			sum := sha256.Sum256(site)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write(site)
+			}))
+			cfg := fmt.Sprintf(`#cloud-config
+uki-max-entries: 34
+config_sources:
+- url: %s/site.yaml
+  sha256: %s
+`, srv.URL, hex.EncodeToString(sum[:]))
+
+			c, err := ScanNoLogs(collector.Readers(strings.NewReader(cfg)))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(c.UkiMaxEntries).To(Equal(34))
+			Expect(c.Strict).To(BeTrue())
+
+			// Offline, the verified copy from the cache is used
+			srv.Close()
+			c, err = ScanNoLogs(collector.Readers(strings.NewReader(cfg)))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(c.Strict).To(BeTrue())
+
+			// A source not matching its checksum is skipped
+			c, err = ScanNoLogs(collector.Readers(strings.NewReader(strings.Replace(cfg, hex.EncodeToString(sum[:]), strings.Repeat("0", 64), 1))))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(c.Strict).To(BeFalse())
+			Expect(c.UkiMaxEntries).To(Equal(34))
+		})
+		It("Scan only uses the signed configs of the writable dirs when config signing is enforced", func() {
+			dir, err := os.MkdirTemp("", "config-signing")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer os.RemoveAll(dir)
+			sealedDirs, trustedDirs := SealedConfigDirs, TrustedConfigDirs
+			oem, local := filepath.Join(dir, "oem"), filepath.Join(dir, "cloud-config")
+			image := filepath.Join(dir, "etc")
+			SealedConfigDirs, TrustedConfigDirs = []string{oem, local}, []string{image}
+			defer func() { SealedConfigDirs, TrustedConfigDirs = sealedDirs, trustedDirs }()
+
+			pub, priv, err := ed25519.GenerateKey(nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			der, err := x509.MarshalPKIXPublicKey(pub)
+			Expect(err).ShouldNot(HaveOccurred())
+			key := filepath.Join(dir, "config-signing.pem")
+			Expect(os.WriteFile(key, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)).To(Succeed())
+
+			Expect(os.MkdirAll(image, 0755)).To(Succeed())
+			Expect(os.MkdirAll(oem, 0755)).To(Succeed())
+			Expect(os.MkdirAll(local, 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(image, "config.yaml"), []byte(fmt.Sprintf("#cloud-config\nconfig_signing:\n  enforce: true\n  public-key: %s\n", key)), 0644)).To(Succeed())
+			signed := []byte("#cloud-config\nuki-max-entries: 5\n")
+			Expect(os.WriteFile(filepath.Join(oem, "10_signed.yaml"), signed, 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(oem, "10_signed.yaml.sig"), []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, signed))), 0644)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(oem, "20_unsigned.yaml"), []byte("#cloud-config\nstrict: true\nconfig_signing:\n  enforce: false\n"), 0644)).To(Succeed())
+			// The other writable dirs are sealed too, and can't lift the enforcement either
+			Expect(os.WriteFile(filepath.Join(local, "30_unsigned.yaml"), []byte("#cloud-config\nstrict: true\nconfig_signing:\n  enforce: false\n"), 0644)).To(Succeed())
+
+			c, err := ScanNoLogs(collector.Directories(image, local, oem))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(c.SealedConfig()).To(BeTrue())
+			Expect(c.UkiMaxEntries).To(Equal(5))
+			Expect(c.Strict).To(BeFalse())
+			files, err := c.SealedConfigFiles(oem)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(files).To(Equal([]string{filepath.Join(oem, "10_signed.yaml")}))
+			files, err = c.SealedConfigFiles(local)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(files).To(BeEmpty())
+
+			// Config signing is not read from the dirs other than the image ones
+			TrustedConfigDirs = []string{}
+			Expect(os.WriteFile(filepath.Join(local, "config.yaml"), []byte(fmt.Sprintf("#cloud-config\nconfig_signing:\n  enforce: true\n  public-key: %s\n", key)), 0644)).To(Succeed())
+			c, err = ScanNoLogs(collector.Directories(local))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(c.ConfigSigning).To(BeNil())
+			TrustedConfigDirs = []string{image}
+
+			// A tampered config is refused as well
+			Expect(os.WriteFile(filepath.Join(oem, "10_signed.yaml"), []byte("#cloud-config\nuki-max-entries: 50\n"), 0644)).To(Succeed())
+			c, err = ScanNoLogs(collector.Directories(image, oem))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(c.UkiMaxEntries).ToNot(Equal(50))
+		})
+		It("Scan reads the webui listeners on top of the agent config", func() {
+			c, err := ScanNoLogs(collector.Readers(strings.NewReader(`#cloud-config
+webui:
+  socket: /run/kairos/webui.sock
+  socket_mode: "0600"
+  socket_group: kairos
+`)))
+			Expect(err).ShouldNot(HaveOccurred())
+			webUI := WebUI{ListenAddress: "127.0.0.1:9090", SocketMode: "0640"}.Override(c.WebUI)
+			Expect(webUI.Address()).To(Equal("127.0.0.1:9090"))
+			Expect(webUI.Socket).To(Equal("/run/kairos/webui.sock"))
+			Expect(webUI.SocketGroup).To(Equal("kairos"))
+			Expect(webUI.Mode()).To(Equal(uint32(0600)))
+
+			// Only the socket is used if no address is set, the default address otherwise
+			Expect(WebUI{Socket: "/run/kairos/webui.sock"}.Address()).To(BeEmpty())
+			Expect(WebUI{}.Address()).To(Equal(DefaultWebUIListenAddress))
+			_, err = WebUI{SocketMode: "rw"}.Mode()
+			Expect(err).To(HaveOccurred())
+		})
+		It("Resolves the agent clients names with the resolver overrides", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			defer server.Close()
+			_, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+
+			c, err := ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\nresolver:\n  hosts:\n  - 127.0.0.1 registry.segment.invalid # lab registry\n")))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(c.ImageExtractor.(v1.OCIImageExtractor).Transport).ToNot(BeNil())
+			client := &http.Client{Transport: c.RegistryTransport()}
+			_, err = client.Get(fmt.Sprintf("http://registry.segment.invalid:%s/v2/", port))
+			Expect(err).ShouldNot(HaveOccurred())
+			client = &http.Client{Transport: c.HTTPTransport()}
+			_, err = client.Get(fmt.Sprintf("http://REGISTRY.segment.invalid.:%s/", port))
+			Expect(err).ShouldNot(HaveOccurred())
+
+			_, err = ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\nresolver:\n  hosts:\n  - registry.segment.invalid\n")))
+			Expect(err).To(MatchError(ContainSubstring("invalid hosts entry")))
+			Expect((&Config{}).HTTPTransport()).To(BeNil())
+		})
+		It("Reads the upgrade window and when it is open", func() {
+			c, err := ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\nupgrade:\n  window:\n    schedule: \"30 2 * * 6,7\"\n    duration: 4h\n")))
+			Expect(err).ShouldNot(HaveOccurred())
+			window := c.Upgrade.Window
+			Expect(window.Duration).To(Equal(4 * time.Hour))
+			Expect(window.CheckInterval).To(Equal(15 * time.Minute))
+
+			// Friday
+			open, next, err := window.Open(time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(open).To(BeFalse())
+			Expect(next).To(Equal(time.Date(2026, 10, 17, 2, 30, 0, 0, time.UTC)))
+			// Sunday, as 7
+			open, next, err = window.Open(time.Date(2026, 10, 18, 6, 0, 0, 0, time.UTC))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(open).To(BeTrue())
+			Expect(next).To(Equal(time.Date(2026, 10, 18, 6, 30, 0, 0, time.UTC)))
+
+			schedule, err := ParseCronSchedule("0 */6 1-7 * *")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(schedule.Next(time.Date(2026, 10, 7, 19, 0, 0, 0, time.UTC))).To(Equal(time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)))
+			schedule, err = ParseCronSchedule("0 0 30 2 *")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(schedule.Next(time.Now()).IsZero()).To(BeTrue())
+
+			_, err = ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\nupgrade:\n  window:\n    schedule: \"0 25 * * *\"\n")))
+			Expect(err).To(MatchError(ContainSubstring("invalid hour")))
+		})
+		It("Validates the squashfs compression and block size", func() {
+			c, err := ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\nsquashfs:\n  compression: zstd:19\n  block-size: 256K\n")))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(c.Squashfs.Compression).To(Equal("zstd:19"))
+			Expect((&Squashfs{Compression: "lz4:hc", BlockSize: "1M"}).Validate()).To(Succeed())
+			Expect((&Squashfs{BlockSize: "131072"}).Validate()).To(Succeed())
+
+			_, err = ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\nsquashfs:\n  compression: zstandard\n")))
+			Expect(err).To(MatchError(ContainSubstring("unknown compression")))
+			Expect((&Squashfs{Compression: "zstd:23"}).Validate()).To(MatchError(ContainSubstring("between 1 and 22")))
+			Expect((&Squashfs{BlockSize: "2M"}).Validate()).To(MatchError(ContainSubstring("power of two")))
+			Expect((&Squashfs{BlockSize: "100000"}).Validate()).To(MatchError(ContainSubstring("power of two")))
+			Expect((&Squashfs{BlockSize: "big"}).Validate()).To(MatchError(ContainSubstring("invalid block size")))
+		})
+		It("Sets the image layers pulled at once", func() {
+			c, err := ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\n")))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(c.ImageExtractor.(v1.OCIImageExtractor).Workers).To(Equal(constants.PullWorkers))
+			c, err = ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\npull-workers: 8\n")))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(c.ImageExtractor.(v1.OCIImageExtractor).Workers).To(Equal(8))
+
+			_, err = ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\npull-workers: -1\n")))
+			Expect(err).To(MatchError(ContainSubstring("pull-workers")))
+		})
+		It("Sets the directories read at once while sizing the dir sources", func() {
+			c, err := ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\n")))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(c.SizeWorkers).To(Equal(constants.SizeWorkers))
+			c, err = ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\nsize-workers: 1\n")))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(c.SizeWorkers).To(Equal(1))
+
+			_, err = ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\nsize-workers: -1\n")))
+			Expect(err).To(MatchError(ContainSubstring("size-workers")))
+		})
+		It("Reads the accelerators catalog", func() {
+			c, err := ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\ninstall:\n  accelerators:\n    catalog:\n    - vendor: nvidia\n      devices: [\"10de:22*\"]\n      bundle:\n        targets: [run://quay.io/example/nvidia:550]\n")))
+			Expect(err).ShouldNot(HaveOccurred())
+			bundle := c.Install.Accelerators.Match("nvidia", "10DE:2204")
+			Expect(bundle).ToNot(BeNil())
+			Expect(bundle.String()).To(Equal("run://quay.io/example/nvidia:550"))
+			Expect(c.Install.Accelerators.Match("nvidia", "10de:1eb8")).To(BeNil())
+			Expect(c.Install.Accelerators.Match("intel", "8086:46a6")).To(BeNil())
+
+			_, err = ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\ninstall:\n  accelerators:\n    catalog:\n    - vendor: qualcomm\n      bundle:\n        targets: [run://x]\n")))
+			Expect(err).To(MatchError(ContainSubstring("unknown vendor")))
+			_, err = ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\ninstall:\n  accelerators:\n    catalog:\n    - vendor: arm\n")))
+			Expect(err).To(MatchError(ContainSubstring("no bundle targets")))
+		})
+		It("Sets the registry credentials of the image pulls", func() {
+			c, err := ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\nregistry_auth:\n  credentials:\n    registry.example.com:\n      username: user\n      password: secret\n")))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(c.ImageExtractor.(v1.OCIImageExtractor).Auth).To(Equal(c.RegistryAuth))
+			auth, err := c.RegistryAuth.AuthConfig("registry.example.com/kairos/ubuntu:latest")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(auth.Username).To(Equal("user"))
+			Expect(c.CraneOptions()).To(HaveLen(1))
+
+			_, err = ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\nregistry_auth:\n  credentials:\n    registry.example.com:\n      password: secret\n")))
+			Expect(err).To(MatchError(ContainSubstring("registry_auth: credentials of registry registry.example.com")))
+		})
+		It("Sets the registry mirrors of the image extractor", func() {
+			c, err := ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\nregistries:\n  mirrors:\n    docker.io:\n    - mirror.local:5000/dockerhub\n")))
+			Expect(err).ShouldNot(HaveOccurred())
+			extractor := c.ImageExtractor.(v1.OCIImageExtractor)
+			Expect(extractor.Registries.References("alpine:3.19")).To(Equal([]string{"mirror.local:5000/dockerhub/library/alpine:3.19"}))
+			Expect(extractor.MirrorFailed).ToNot(BeNil())
+
+			_, err = ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\nregistries:\n  mirrors:\n    docker.io: []\n")))
+			Expect(err).To(MatchError(ContainSubstring("registries: mirrors")))
+		})
+		It("Declares the persistence classes of /var/lib", func() {
+			c, err := ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\nstorage:\n  var_lib:\n    persistent:\n    - containerd\n    - /var/lib/rancher\n    ephemeral:\n    - rancher-cache\n")))
+			Expect(err).ShouldNot(HaveOccurred())
+			bind, ephemeral, err := c.Storage.VarLib.Mounts()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(bind).To(Equal([]string{"/var/lib/containerd", "/var/lib/rancher"}))
+			Expect(ephemeral).To(Equal([]string{"/var/lib/rancher-cache"}))
+
+			_, err = (&VarLib{Persistent: []string{"rancher"}, Ephemeral: []string{"rancher/cache"}}).Classes()
+			Expect(err).To(MatchError(ContainSubstring("nested in the persistent path /var/lib/rancher")))
+			_, err = (&VarLib{Persistent: []string{"rancher"}, Ephemeral: []string{"/var/lib/rancher"}}).Classes()
+			Expect(err).To(MatchError(ContainSubstring("declared")))
+			_, err = (&VarLib{Ephemeral: []string{"../../etc"}}).Classes()
+			Expect(err).To(MatchError(ContainSubstring("subpath of /var/lib")))
+			_, err = ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\ninstall:\n  ephemeral_mounts:\n  - /var/lib/containerd\nstorage:\n  var_lib:\n    persistent:\n    - containerd\n")))
+			Expect(err).To(MatchError(ContainSubstring("in the install mounts")))
+		})
+		It("Sets the language of the messages", func() {
+			defer i18n.SetLanguage(i18n.DefaultLanguage) //nolint:errcheck
+			c, err := ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\nlanguage: es_ES.UTF-8\n")))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(c.Language).To(Equal("es_ES.UTF-8"))
+			Expect(i18n.Language()).To(Equal("es"))
+
+			_, err = ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\nlanguage: tlh\n")))
+			Expect(err).To(MatchError(ContainSubstring("unsupported language")))
+		})
+		It("Pins the registry certificates on first use", func() {
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			defer server.Close()
+			other := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			defer other.Close()
+			registry := strings.TrimPrefix(server.URL, "https://")
+			Expect(fsutils.MkdirAll(fs, filepath.Dir(constants.RegistryPinsFile), constants.DirPerm)).To(Succeed())
+
+			c, err := ScanNoLogs(collector.Readers(strings.NewReader(fmt.Sprintf("#cloud-config\nregistry_pinning:\n  registries:\n  - %s\n", registry))))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(c.ImageExtractor.(v1.OCIImageExtractor).Transport).ToNot(BeNil())
+			config.RegistryPinning = c.RegistryPinning
+			client := &http.Client{Transport: config.RegistryTransport()}
+
+			// The self-signed certificate is trusted and pinned on first use
+			_, err = client.Get(server.URL)
+			Expect(err).ShouldNot(HaveOccurred())
+			pins, err := ReadRegistryPins(fs)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(pins).To(HaveLen(1))
+			Expect(pins[0].Registry).To(Equal(registry))
+			Expect(pins[0].Fingerprint).To(Equal(CertificateFingerprint(server.Certificate().Raw)))
+			// The pins don't stop the OEM cloud-configs from loading on boot
+			_, err = executor.NewExecutor().Graph("boot", fs, console.NewStandardConsole(), "/oem")
+			Expect(err).ShouldNot(HaveOccurred())
+			client.CloseIdleConnections()
+			_, err = client.Get(server.URL)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			// Registries not listed are verified as usual
+			_, err = client.Get(other.URL)
+			Expect(err).To(MatchError(ContainSubstring("certificate")))
+
+			// A different certificate is refused
+			pins[0].Fingerprint = CertificateFingerprint([]byte("renewed certificate"))
+			data, _ := yaml.Marshal(pins)
+			Expect(fs.WriteFile(constants.RegistryPinsFile, data, constants.FilePerm)).To(Succeed())
+			client.CloseIdleConnections()
+			_, err = client.Get(server.URL)
+			Expect(err).To(MatchError(ContainSubstring("does not match the pinned one")))
+
+			Expect(RemoveRegistryPin(fs, registry)).To(Succeed())
+			Expect(ReadRegistryPins(fs)).To(BeEmpty())
+			Expect(RemoveRegistryPin(fs, registry)).ToNot(Succeed())
+		})
+		It("Scan reads the verify block and the former boolean verify key", func() {
+			c, err := ScanNoLogs(collector.Readers(strings.NewReader(`#cloud-config
+verify:
+  certificate-identity-regexp: "^https://github.com/kairos-io/"
+  offline: true
+  cache-dir: /usr/local/.kairos/cosign-cache
+`)))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(c.Verify.CertificateIdentityRegexp).To(Equal("^https://github.com/kairos-io/"))
+			Expect(c.Verify.Offline).To(BeTrue())
+			Expect(c.Verify.CacheDir).To(Equal("/usr/local/.kairos/cosign-cache"))
+
+			c, err = ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\nverify: true\n")))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(c.Verify).To(Equal(Verify{}))
+		})
 		It("Writes and loads an installation data", func() {
 			err = config.WriteInstallState(installState, statePath, recoveryPath)
 			Expect(err).ShouldNot(HaveOccurred())
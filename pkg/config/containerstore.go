@@ -0,0 +1,52 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// containerStoreUnits are the binary units ctr lists the image sizes with
+var containerStoreUnits = map[string]float64{
+	"B":   1,
+	"KiB": 1 << 10,
+	"MiB": 1 << 20,
+	"GiB": 1 << 30,
+	"TiB": 1 << 40,
+}
+
+// containerStoreImageSize returns the size of an image in the local container runtime store and the factor to
+// apply to it. containerd lists the compressed size of the content, like the registries, podman the unpacked one.
+func containerStoreImageSize(config *Config, source *v1.ImageSource) (int64, float64, error) {
+	switch source.ContainerRuntime() {
+	case "podman":
+		out, err := config.Runner.Run("podman", "image", "inspect", "--format", "{{.Size}}", source.Value())
+		if err != nil {
+			return 0, 0, fmt.Errorf("inspecting %s in the podman store: %s: %w", source.Value(), strings.TrimSpace(string(out)), err)
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+		return size, 1, err
+	case "containerd":
+		out, err := config.Runner.Run("ctr", "images", "ls", "name=="+source.Value())
+		if err != nil {
+			return 0, 0, fmt.Errorf("listing %s in the containerd store: %s: %w", source.Value(), strings.TrimSpace(string(out)), err)
+		}
+		// REF TYPE DIGEST SIZE PLATFORMS LABELS, with a human readable size like `301.2 MiB`
+		for _, line := range strings.Split(string(out), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 5 || fields[0] != source.Value() {
+				continue
+			}
+			unit, ok := containerStoreUnits[fields[4]]
+			value, err := strconv.ParseFloat(fields[3], 64)
+			if !ok || err != nil {
+				return 0, 0, fmt.Errorf("unexpected size %s %s of %s in the containerd store", fields[3], fields[4], source.Value())
+			}
+			return int64(value * unit), ociSizeFactor, nil
+		}
+		return 0, 0, fmt.Errorf("image %s not found in the containerd store", source.Value())
+	}
+	return 0, 0, fmt.Errorf("%s is not a container runtime store source", source.String())
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+)
+
+// VerifyGPGSignature checks the detached GPG signature of file, armored or binary, with gpgv. keyring is a
+// keyring file or a dir of them, as exported by `gpg --export`, constants.GPGKeyringsDir by default.
+func (c *Config) VerifyGPGSignature(keyring, file, sig string) error {
+	keyrings, err := gpgKeyrings(c, keyring)
+	if err != nil {
+		return err
+	}
+	var args []string
+	for _, k := range keyrings {
+		args = append(args, "--keyring", k)
+	}
+	out, err := c.Runner.Run("gpgv", append(args, sig, file)...)
+	if err != nil {
+		return fmt.Errorf("verifying the GPG signature of %s: %s: %w", file, strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+// gpgKeyrings returns the keyring files in keyring
+func gpgKeyrings(c *Config, keyring string) ([]string, error) {
+	if keyring == "" {
+		keyring = constants.GPGKeyringsDir
+	}
+	if dir, _ := fsutils.IsDir(c.Fs, keyring); !dir {
+		if _, err := c.Fs.Stat(keyring); err != nil {
+			return nil, fmt.Errorf("reading GPG keyring: %w", err)
+		}
+		return []string{keyring}, nil
+	}
+	var keyrings []string
+	for _, pattern := range []string{"*.gpg", "*.kbx"} {
+		matches, err := fsutils.GlobFs(c.Fs, filepath.Join(keyring, pattern))
+		if err != nil {
+			return nil, err
+		}
+		keyrings = append(keyrings, matches...)
+	}
+	if len(keyrings) == 0 {
+		return nil, fmt.Errorf("no GPG keyrings found in %s", keyring)
+	}
+	return keyrings, nil
+}
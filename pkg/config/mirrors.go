@@ -0,0 +1,21 @@
+package config
+
+import (
+	"github.com/google/go-containerregistry/pkg/crane"
+)
+
+// mirrorFailed warns about a registry mirror which failed to serve an image, which is then pulled from the next
+// mirror or from its registry
+func (c *Config) mirrorFailed(ref string, err error) {
+	c.Logger.Warnf("Could not pull %s from the mirror, falling back: %s", ref, err)
+}
+
+// craneManifest fetches the manifest of the image from the first of the registry mirrors which has it, or from its
+// registry
+func (c *Config) craneManifest(imageRef string) (manifest []byte, err error) {
+	err = c.Registries.Resolve(imageRef, c.mirrorFailed, func(ref string) error {
+		manifest, err = crane.Manifest(ref, c.CraneOptions()...)
+		return err
+	})
+	return manifest, err
+}
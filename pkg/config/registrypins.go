@@ -0,0 +1,189 @@
+package config
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	"gopkg.in/yaml.v3"
+)
+
+// RegistryPinning pins the TLS certificate of self-hosted registries on first use (TOFU), as an alternative to
+// distributing their CA to the nodes. The first certificate a listed registry presents is trusted and stored on
+// the OEM partition, later connections fail if the registry presents a different one.
+type RegistryPinning struct {
+	// Registries are the registry hosts whose certificate is pinned, with the port if they are not on 443
+	Registries []string `yaml:"registries,omitempty" mapstructure:"registries"`
+}
+
+// RegistryPin is the certificate pinned for a registry
+type RegistryPin struct {
+	Registry string `yaml:"registry" json:"registry"`
+	// Fingerprint is the sha256 digest of the DER encoded certificate, `sha256:<hex>`
+	Fingerprint string `yaml:"fingerprint" json:"fingerprint"`
+	Subject     string `yaml:"subject,omitempty" json:"subject,omitempty"`
+	Date        string `yaml:"date" json:"date"`
+}
+
+// ReadRegistryPins returns the pinned registry certificates
+func ReadRegistryPins(fs v1.FS) ([]RegistryPin, error) {
+	if exists, _ := fsutils.Exists(fs, constants.RegistryPinsFile); !exists {
+		return nil, nil
+	}
+	data, err := fs.ReadFile(constants.RegistryPinsFile)
+	if err != nil {
+		return nil, err
+	}
+	var pins []RegistryPin
+	if err = yaml.Unmarshal(data, &pins); err != nil {
+		return nil, fmt.Errorf("parsing registry pins file %s: %w", constants.RegistryPinsFile, err)
+	}
+	return pins, nil
+}
+
+func writeRegistryPins(fs v1.FS, pins []RegistryPin) error {
+	data, err := yaml.Marshal(pins)
+	if err != nil {
+		return err
+	}
+	if err = fsutils.MkdirAll(fs, filepath.Dir(constants.RegistryPinsFile), constants.DirPerm); err != nil {
+		return err
+	}
+	return fsutils.AtomicWriteFile(fs, constants.RegistryPinsFile, data, constants.ConfigPerm)
+}
+
+// RemoveRegistryPin removes the pinned certificate of a registry, the next certificate it presents is pinned instead
+func RemoveRegistryPin(fs v1.FS, registry string) error {
+	pins, err := ReadRegistryPins(fs)
+	if err != nil {
+		return err
+	}
+	for i, pin := range pins {
+		if pin.Registry == registry {
+			return writeRegistryPins(fs, append(pins[:i], pins[i+1:]...))
+		}
+	}
+	return fmt.Errorf("no certificate pinned for registry %s", registry)
+}
+
+// CertificateFingerprint returns the fingerprint pinned for a certificate
+func CertificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// RegistryTransport returns the transport to reach the registries with, pinning the certificates of the
+// registries set in the registry pinning and resolving the names with the resolver overrides. It returns nil if
+// there are none, so the default one is used.
+func (c *Config) RegistryTransport() http.RoundTripper {
+	if c.RegistryPinning == nil || len(c.RegistryPinning.Registries) == 0 {
+		return c.HTTPTransport()
+	}
+	t := &pinningTransport{
+		base:   c.baseTransport(),
+		pinned: map[string]http.RoundTripper{},
+	}
+	for _, registry := range c.RegistryPinning.Registries {
+		pinned := c.baseTransport()
+		pinned.TLSClientConfig = &tls.Config{
+			// The certificate is checked against the pin instead of the system CAs
+			InsecureSkipVerify: true, // nolint:gosec
+			VerifyConnection: func(cs tls.ConnectionState) error {
+				return t.checkPin(c, registry, cs)
+			},
+		}
+		t.pinned[registry] = pinned
+	}
+	return t
+}
+
+// CraneOptions returns the options for crane to reach the registries with the registry transport and the registry
+// credentials
+func (c *Config) CraneOptions() []crane.Option {
+	var opts []crane.Option
+	if transport := c.RegistryTransport(); transport != nil {
+		opts = append(opts, crane.WithTransport(transport))
+	}
+	if c.RegistryAuth != nil {
+		opts = append(opts, crane.WithAuthFromKeychain(c.RegistryAuth))
+	}
+	return opts
+}
+
+// pinningTransport sends the requests to the pinned registries through their pinning transport
+type pinningTransport struct {
+	base   http.RoundTripper
+	pinned map[string]http.RoundTripper
+	// mu serializes the pin checks, so parallel connections on first use pin a single certificate
+	mu sync.Mutex
+}
+
+func (t *pinningTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if req.URL.Port() == "443" {
+		host = req.URL.Hostname()
+	}
+	if pinned, ok := t.pinned[host]; ok && req.URL.Scheme == "https" {
+		return pinned.RoundTrip(req)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// CloseIdleConnections closes the idle connections of the pinned registries and of the rest
+func (t *pinningTransport) CloseIdleConnections() {
+	closeIdle := func(rt http.RoundTripper) {
+		if c, ok := rt.(interface{ CloseIdleConnections() }); ok {
+			c.CloseIdleConnections()
+		}
+	}
+	closeIdle(t.base)
+	for _, rt := range t.pinned {
+		closeIdle(rt)
+	}
+}
+
+func (t *pinningTransport) checkPin(c *Config, registry string, cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("registry %s presented no certificate", registry)
+	}
+	cert := cs.PeerCertificates[0]
+	fingerprint := CertificateFingerprint(cert.Raw)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pins, err := ReadRegistryPins(c.Fs)
+	if err != nil {
+		return err
+	}
+	for _, pin := range pins {
+		if pin.Registry != registry {
+			continue
+		}
+		if pin.Fingerprint != fingerprint {
+			return fmt.Errorf("certificate of registry %s does not match the pinned one: got %s, pinned %s on %s. "+
+				"If the certificate was renewed, remove the pin with `kairos-agent registry-pins remove %s`",
+				registry, fingerprint, pin.Fingerprint, pin.Date, registry)
+		}
+		return nil
+	}
+	pin := RegistryPin{
+		Registry:    registry,
+		Fingerprint: fingerprint,
+		Subject:     cert.Subject.String(),
+		Date:        time.Now().UTC().Format(time.RFC3339),
+	}
+	if err = writeRegistryPins(c.Fs, append(pins, pin)); err != nil {
+		return fmt.Errorf("pinning the certificate of registry %s: %w", registry, err)
+	}
+	c.Logger.Warnf("Pinned the certificate of registry %s on first use: %s %s", registry, pin.Subject, fingerprint)
+	return nil
+}
@@ -0,0 +1,122 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Resolver overrides the name resolution of the agent's own HTTP and registry clients, i.e. to reach registries
+// only resolvable on a segmented network. The resolution of the rest of the system is not changed.
+type Resolver struct {
+	// Hosts are /etc/hosts style entries, an address followed by the host names resolving to it. They take
+	// precedence over the nameservers.
+	Hosts []string `yaml:"hosts,omitempty" mapstructure:"hosts"`
+	// Nameservers are the DNS servers queried instead of the system ones, as address or address:port
+	Nameservers []string `yaml:"nameservers,omitempty" mapstructure:"nameservers"`
+}
+
+// resolverDialTimeout bounds the connections to the overridden addresses and nameservers
+const resolverDialTimeout = 10 * time.Second
+
+// HostsTable parses the hosts entries into the addresses of each host name
+func (r *Resolver) HostsTable() (map[string][]string, error) {
+	table := map[string][]string{}
+	for _, entry := range r.Hosts {
+		if i := strings.Index(entry, "#"); i >= 0 {
+			entry = entry[:i]
+		}
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+			return nil, fmt.Errorf("invalid hosts entry %q, expected an address followed by host names", entry)
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			table[name] = append(table[name], fields[0])
+		}
+	}
+	return table, nil
+}
+
+// Dialer returns the dial function connecting through the overrides, or nil if there are none or they are not valid
+func (r *Resolver) Dialer() func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if r == nil || (len(r.Hosts) == 0 && len(r.Nameservers) == 0) {
+		return nil
+	}
+	hosts, err := r.HostsTable()
+	if err != nil {
+		return nil
+	}
+	dialer := &net.Dialer{Timeout: resolverDialTimeout, KeepAlive: 30 * time.Second}
+	if len(r.Nameservers) > 0 {
+		nameservers := make([]string, 0, len(r.Nameservers))
+		for _, ns := range r.Nameservers {
+			if _, _, err := net.SplitHostPort(ns); err != nil {
+				ns = net.JoinHostPort(ns, "53")
+			}
+			nameservers = append(nameservers, ns)
+		}
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			// The system nameserver being dialed is replaced by the configured ones, tried in order
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				d := net.Dialer{Timeout: resolverDialTimeout}
+				var lastErr error
+				for _, ns := range nameservers {
+					conn, err := d.DialContext(ctx, network, ns)
+					if err == nil {
+						return conn, nil
+					}
+					lastErr = err
+				}
+				return nil, lastErr
+			},
+		}
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		addresses, ok := hosts[strings.ToLower(strings.TrimSuffix(host, "."))]
+		if !ok {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		var lastErr error
+		for _, a := range addresses {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(a, port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+		return nil, lastErr
+	}
+}
+
+// HTTPTransport returns the transport for the agent's own HTTP clients, resolving the names with the resolver
+// overrides. It returns nil if there are none, so the default one is used.
+func (c *Config) HTTPTransport() http.RoundTripper {
+	dial := c.Resolver.Dialer()
+	if dial == nil {
+		return nil
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = dial
+	return t
+}
+
+// baseTransport is the HTTP transport with the resolver overrides, the default one if there are none
+func (c *Config) baseTransport() *http.Transport {
+	if t, ok := c.HTTPTransport().(*http.Transport); ok {
+		return t
+	}
+	return http.DefaultTransport.(*http.Transport).Clone()
+}
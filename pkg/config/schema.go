@@ -0,0 +1,287 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/kairos-io/kairos-sdk/schema"
+)
+
+// Schema is the cloud config schema of the agent, the RootSchema of the SDK along with the settings only the agent
+// reads. The configs are validated and the JSON schema is printed with it.
+type Schema struct {
+	_ struct{} `title:"Kairos Schema" description:"Defines all valid Kairos configuration attributes."`
+	schema.RootSchema
+	NoEfivars        bool                    `json:"no-efivars,omitempty" description:"Do not read or write EFI variables, for firmwares that lock them"`
+	ImagePolicy      *ImagePolicySchema      `json:"image-policy,omitempty" description:"Requirements the OCI images of the sources must meet"`
+	ConfigSources    []ConfigSourceSchema    `json:"config_sources,omitempty" description:"Remote cloud configs fetched and verified before being merged"`
+	ResetButton      *ResetButtonSchema      `json:"reset_button,omitempty" description:"Hardware button triggering a factory reset when held down"`
+	Logs             *LogsSchema             `json:"logs,omitempty" description:"What the logs command collects"`
+	VerifyDeploy     bool                    `json:"verify-deploy,omitempty" description:"Read back samples of the deployed images from disk before booting into them"`
+	Squashfs         *SquashfsSchema         `json:"squashfs,omitempty" description:"How the squashfs images are built"`
+	UkiAllowedCerts  []string                `json:"uki-allowed-certs,omitempty" description:"PEM certificate files the UKIs must be signed with, instead of checking them against the firmware db"`
+	ConfigSigning    *ConfigSigningSchema    `json:"config_signing,omitempty" description:"Only use the OEM cloud configs with a valid signature, read from the image configs only"`
+	WebUI            *WebUISchema            `json:"webui,omitempty" description:"Where the webui installer listens"`
+	Heartbeat        *HeartbeatSchema        `json:"heartbeat,omitempty" description:"Periodic status reports of the node to a fleet backend"`
+	RegistryPinning  *RegistryPinningSchema  `json:"registry_pinning,omitempty" description:"Registries whose certificate is pinned on first use"`
+	PermissionsAudit *PermissionsAuditSchema `json:"permissions_audit,omitempty" description:"Audit of the risky permissions of the deployed system trees"`
+	Reenroll         *ReenrollSchema         `json:"reenroll,omitempty" description:"Re-enrollment of the node into its fleet manager after a reset"`
+	TempDirs         *TempDirsSchema         `json:"temp_dirs,omitempty" description:"Limits of the temporary dirs of the agent"`
+	Watchdog         *WatchdogSchema         `json:"watchdog,omitempty" description:"Remediation of upgraded systems which do not report healthy"`
+	UpgradeApproval  *UpgradeApprovalSchema  `json:"upgrade_approval,omitempty" description:"External endpoint approving the upgrades before they start"`
+	Referrers        *ReferrersSchema        `json:"referrers,omitempty" description:"Stores the artifacts referring to the installed images, like SBOMs and attestations"`
+	Install          InstallSchema           `json:"install,omitempty"`
+	Storage          *StorageSchema          `json:"storage,omitempty" description:"Additional disks of the installed system"`
+	Resolver         *ResolverSchema         `json:"resolver,omitempty" description:"Name resolution overrides of the agent's own HTTP and registry clients"`
+	Upgrade          *UpgradeSchema          `json:"upgrade,omitempty" description:"Upgrade settings"`
+	Language         string                  `json:"language,omitempty" description:"Language of the CLI messages and prompts, overriding the one of the environment" examples:"[\"es\",\"de_DE.UTF-8\"]"`
+	PullWorkers      int                     `json:"pull-workers,omitempty" minimum:"0" description:"How many image layers are downloaded at once while the previous ones are extracted, 1 pulls them one by one, 4 by default"`
+	Registries       *RegistriesSchema       `json:"registries,omitempty" description:"How the image registries are reached"`
+	RegistryAuth     *RegistryAuthSchema     `json:"registry_auth,omitempty" description:"Credentials to pull the images of private registries with"`
+	SizeWorkers      int                     `json:"size-workers,omitempty" minimum:"0" description:"How many directories are read at once while calculating the size of the dir sources, 1 walks them one by one, 4 by default"`
+}
+
+// ImagePolicySchema represents the image-policy block, the requirements the OCI images of the sources must meet
+type ImagePolicySchema struct {
+	RequiredLabels       map[string]string `json:"required-labels,omitempty" description:"Labels the image must have, an empty value only requires the label"`
+	AllowedRegistries    []string          `json:"allowed-registries,omitempty" description:"Registries, or registry/repository prefixes, images can be pulled from"`
+	MaxAge               string            `json:"max-age,omitempty" description:"Maximum age of the image, as a duration" examples:"[\"720h\"]"`
+	RequiredAttestations []string          `json:"required-attestations,omitempty" description:"Artifact types, or kinds like sbom, vuln-scan, attestation or signature, the image must have a referrer of"`
+}
+
+// ConfigSourceSchema represents an entry of config_sources, a remote cloud config verified before it is merged
+type ConfigSourceSchema struct {
+	URL          string `json:"url" required:"true" description:"URL the cloud config is fetched from"`
+	Sha256       string `json:"sha256,omitempty" pattern:"^[a-fA-F0-9]{64}$" description:"Expected sha256 checksum of the cloud config"`
+	Signature    string `json:"signature,omitempty" description:"Base64 encoded signature of the cloud config, or an http(s) URL to fetch it from"`
+	PublicKey    string `json:"public-key,omitempty" description:"Path of the PEM encoded public key the signature is verified with"`
+	GPGSignature string `json:"gpg-signature,omitempty" description:"http(s) URL of the detached GPG signature of the cloud config"`
+	GPGKeyring   string `json:"gpg-keyring,omitempty" description:"GPG keyring file, or dir of keyrings, the GPG signature is verified with"`
+}
+
+// ResetButtonSchema represents the reset_button block, the input device key or GPIO line watched for a factory reset
+type ResetButtonSchema struct {
+	Device    string `json:"device,omitempty" description:"Input device reporting the button key" examples:"[\"/dev/input/event0\"]"`
+	Key       uint16 `json:"key,omitempty" description:"Key code reported by the device, KEY_RESTART (408) by default"`
+	GPIO      string `json:"gpio,omitempty" description:"GPIO sysfs value file of the button" examples:"[\"/sys/class/gpio/gpio17/value\"]"`
+	ActiveLow bool   `json:"active-low,omitempty" description:"The GPIO line reads low while the button is pressed"`
+	Hold      string `json:"hold,omitempty" description:"How long the button must be held down, 10s by default" examples:"[\"10s\"]"`
+	Countdown string `json:"countdown,omitempty" description:"Countdown shown before rebooting into reset, 10s by default" examples:"[\"10s\"]"`
+}
+
+// LogsSchema represents the logs block, narrowing down and extending what the logs command collects
+type LogsSchema struct {
+	JournalArgs []string `json:"journal_args,omitempty" description:"Arguments passed to journalctl" examples:"[[\"--since\",\"24h\"]]"`
+	Units       []string `json:"units,omitempty" description:"Systemd units whose journal is collected, on top of the Kairos ones"`
+	Files       []string `json:"files,omitempty" description:"File globs collected, on top of the Kairos log files"`
+	MaxFileSize int64    `json:"max_file_size,omitempty" description:"Size cap in bytes of each collected file and journal, a negative value disables it"`
+}
+
+// SquashfsSchema represents the squashfs block, the mksquashfs settings the squashfs images are built with
+type SquashfsSchema struct {
+	Compression string `json:"compression,omitempty" pattern:"^(gzip|lzo|lz4|xz|zstd|lzma)(:.+)?$" description:"Compressor with an optional level or mode" examples:"[\"zstd:19\",\"xz\",\"gzip:9\"]"`
+	BlockSize   string `json:"block-size,omitempty" description:"Block size, a power of two between 4K and 1M" examples:"[\"1M\",\"131072\"]"`
+	Processors  int    `json:"processors,omitempty" minimum:"0" description:"Threads mksquashfs compresses with, all the CPUs by default"`
+}
+
+// ConfigSigningSchema represents the config_signing block, sealing the writable cloud config dirs
+type ConfigSigningSchema struct {
+	Enforce    bool   `json:"enforce,omitempty" description:"Only use the configs of the writable dirs with a valid detached signature"`
+	PublicKey  string `json:"public-key,omitempty" description:"PEM encoded public key file the signatures are verified with"`
+	TPMNVIndex string `json:"tpm-nv-index,omitempty" description:"TPM NV index the public key is read from instead" examples:"[\"0x1500016\"]"`
+}
+
+// WebUISchema represents the webui block, where the webui installer listens
+type WebUISchema struct {
+	Disable       bool   `json:"disable,omitempty" description:"Do not start the webui installer"`
+	ListenAddress string `json:"listen_address,omitempty" description:"TCP address to listen on, :8080 if neither it nor socket are set" examples:"[\":8080\",\"127.0.0.1:8080\"]"`
+	Socket        string `json:"socket,omitempty" description:"Path of a unix socket to listen on, instead of or next to the TCP address"`
+	SocketMode    string `json:"socket_mode,omitempty" pattern:"^0?[0-7]{1,3}$" description:"Octal permissions of the socket" examples:"[\"0660\"]"`
+	SocketGroup   string `json:"socket_group,omitempty" description:"Group owning the socket, so its members can reach the webui without root"`
+}
+
+// HeartbeatSchema represents the heartbeat block, the periodic status reports of the node to a fleet backend
+type HeartbeatSchema struct {
+	URL        string `json:"url" required:"true" description:"Endpoint the status document is POSTed to"`
+	Interval   string `json:"interval,omitempty" description:"Time between reports, 5m by default" examples:"[\"5m\"]"`
+	SigningKey string `json:"signing-key,omitempty" description:"PEM encoded private key file the status document is signed with"`
+	Token      string `json:"token,omitempty" description:"Bearer token sent along with the reports"`
+}
+
+// RegistryPinningSchema represents the registry_pinning block, the self-hosted registries pinned on first use
+type RegistryPinningSchema struct {
+	Registries []string `json:"registries,omitempty" description:"Registry hosts whose certificate is pinned, with the port if not on 443" examples:"[[\"registry.local:5000\"]]"`
+}
+
+// PermissionsAuditSchema represents the permissions_audit block, the audit of the deployed system trees
+type PermissionsAuditSchema struct {
+	SetuidAllowlist []string `json:"setuid-allowlist,omitempty" description:"Setuid and setgid binaries allowed on top of the default ones"`
+	Strict          bool     `json:"strict,omitempty" description:"Fail the deployment if there are findings instead of only reporting them"`
+}
+
+// ReenrollSchema represents the reenroll block, how the node enrolls again into its fleet manager after a reset
+type ReenrollSchema struct {
+	URL         string `json:"url,omitempty" description:"Webhook the reset state is POSTed to, with the credentials as bearer token"`
+	Command     string `json:"command,omitempty" description:"Command run with the reset state in KAIROS_RESET_STATE and the credentials in KAIROS_REENROLL_CREDENTIALS"`
+	Credentials string `json:"credentials,omitempty" description:"File the credentials are read from"`
+	Timeout     string `json:"timeout,omitempty" description:"Timeout of the webhook and the command, 2m by default" examples:"[\"2m\"]"`
+}
+
+// TempDirsSchema represents the temp_dirs block, the limits of the temporary dirs of the agent
+type TempDirsSchema struct {
+	Quota uint `json:"quota,omitempty" description:"Size in MiB a temporary dir can grow to before the operation using it fails, no limit if 0"`
+}
+
+// WatchdogSchema represents the watchdog block, remediating the upgraded systems which do not report healthy
+type WatchdogSchema struct {
+	MaxBoots int    `json:"max-boots,omitempty" minimum:"0" description:"Boots of the upgraded system without reporting healthy before remediating, 3 by default"`
+	Timeout  string `json:"timeout,omitempty" description:"How long after the upgrade the system has to report healthy, no limit if not set" examples:"[\"1h\"]"`
+	Action   string `json:"action,omitempty" enum:"fallback,reset,none" description:"Remediation: fallback boots the passive system, reset resets the system from recovery and none only alerts"`
+	Webhook  string `json:"webhook,omitempty" description:"URL POSTed the watchdog state as JSON once remediated"`
+}
+
+// UpgradeApprovalSchema represents the upgrade_approval block, the endpoint approving the upgrades
+type UpgradeApprovalSchema struct {
+	URL     string `json:"url" required:"true" description:"Endpoint POSTed the node identity and the upgrade target, approving it with a 2xx status and \"approved\": true"`
+	Token   string `json:"token,omitempty" description:"Bearer token sent along with the requests"`
+	Timeout string `json:"timeout,omitempty" description:"Timeout of the request, 30s by default" examples:"[\"30s\"]"`
+	Cache   string `json:"cache,omitempty" description:"How long the decision for a target is reused, decisions are not cached if not set" examples:"[\"1h\"]"`
+	Offline string `json:"offline,omitempty" enum:"deny,allow" description:"Decision when the endpoint can't be reached and there is no cached one, deny by default"`
+}
+
+// ReferrersSchema represents the referrers block, where the artifacts referring to the installed images are stored
+type ReferrersSchema struct {
+	Dir           string   `json:"dir,omitempty" description:"Directory the referrer artifacts are stored in"`
+	ArtifactTypes []string `json:"artifact-types,omitempty" description:"Artifact types, or kinds like sbom, the stored artifacts are limited to, all if empty"`
+}
+
+// InstallSchema is the install block of the SDK along with the install settings only the agent reads
+type InstallSchema struct {
+	_ struct{} `title:"Kairos Schema: Install block" description:"The install block is to drive automatic installations without user interaction."`
+	schema.InstallSchema
+	MediaTuning  string              `json:"media-tuning,omitempty" enum:"auto,off" description:"Reduce the wear of SD card and eMMC targets, auto by default"`
+	Accelerators *AcceleratorsSchema `json:"accelerators,omitempty" description:"Driver bundles offered for the GPUs and accelerators detected on install"`
+}
+
+// StorageSchema represents the storage block, the additional disks of the installed system
+type StorageSchema struct {
+	DataDisk *DataDiskSchema `json:"data_disk,omitempty" description:"Additional disk mounted on every boot, formatted on first boot if it has no filesystem nor partition table yet"`
+	VarLib   *VarLibSchema   `json:"var_lib,omitempty" description:"Persistence class of the /var/lib subpaths, the paths not declared keep the class of the image"`
+}
+
+// DataDiskSchema represents the storage.data_disk block
+type DataDiskSchema struct {
+	Device     string   `json:"device,omitempty" description:"Device of the disk, the data disk is not set up if empty" examples:"[\"/dev/sdb\"]"`
+	MountPoint string   `json:"mountpoint,omitempty" description:"Where the disk is mounted, /var/lib/data by default"`
+	FS         string   `json:"fs,omitempty" description:"Filesystem the disk is formatted with, ext4 by default"`
+	Label      string   `json:"label,omitempty" description:"Filesystem label set when formatting, KAIROS_DATA by default"`
+	Options    []string `json:"options,omitempty" description:"Mount options of the disk"`
+}
+
+// ResolverSchema represents the resolver block, overriding the name resolution of the agent's own clients
+type ResolverSchema struct {
+	Hosts       []string `json:"hosts,omitempty" description:"/etc/hosts style entries, an address followed by the host names resolving to it" examples:"[[\"10.0.0.5 registry.lan\"]]"`
+	Nameservers []string `json:"nameservers,omitempty" description:"DNS servers queried instead of the system ones, as address or address:port"`
+}
+
+// UpgradeSchema represents the agent settings of the upgrade block
+type UpgradeSchema struct {
+	Window *UpgradeWindowSchema `json:"window,omitempty" description:"Maintenance window the agent upgrades the system in, once it finds a newer release"`
+}
+
+// UpgradeWindowSchema represents the upgrade.window block
+type UpgradeWindowSchema struct {
+	Schedule      string `json:"schedule" required:"true" description:"When the window opens, as a cron expression: minute hour day-of-month month day-of-week" examples:"[\"0 2 * * 6\"]"`
+	Duration      string `json:"duration,omitempty" description:"How long the window stays open, 1h by default"`
+	CheckInterval string `json:"check-interval,omitempty" description:"Time between the checks for newer releases while the window is open, 15m by default"`
+	Reboot        bool   `json:"reboot,omitempty" description:"Reboot into the upgraded system before the window closes"`
+	PreReleases   bool   `json:"pre-releases,omitempty" description:"Upgrade to pre-releases too"`
+}
+
+// VarLibSchema represents the storage.var_lib block, the paths are relative to /var/lib
+type VarLibSchema struct {
+	Persistent []string `json:"persistent,omitempty" description:"Paths bind mounted from the persistent partition, kept across reboots and upgrades"`
+	Ephemeral  []string `json:"ephemeral,omitempty" description:"Paths overlaid with a tmpfs, reset on every boot"`
+}
+
+// RegistriesSchema represents the registries block
+type RegistriesSchema struct {
+	Mirrors map[string][]string `json:"mirrors,omitempty" description:"Mirrors of each registry host, tried in order before the registry itself. A mirror is a registry host with an optional path the repositories are under" examples:"[{\"docker.io\":[\"mirror.local:5000/docker\"]}]"`
+}
+
+// AcceleratorsSchema represents the install.accelerators block
+type AcceleratorsSchema struct {
+	Auto    bool                      `json:"auto,omitempty" description:"Install the matching bundles without asking"`
+	Catalog []AcceleratorBundleSchema `json:"catalog,omitempty" description:"Driver bundles available, the first one matching an accelerator is offered for it"`
+}
+
+// AcceleratorBundleSchema represents a driver bundle of the accelerators catalog
+type AcceleratorBundleSchema struct {
+	Name    string              `json:"name,omitempty" description:"Name the bundle is offered and recorded with, its targets if empty"`
+	Vendor  string              `json:"vendor" required:"true" enum:"nvidia,intel,amd,arm" description:"Vendor of the accelerators the bundle is for"`
+	Devices []string            `json:"devices,omitempty" description:"PCI vendor:device ids or device tree compatibles, which can be glob patterns, the bundle is narrowed to. All the devices of the vendor if empty" examples:"[[\"10de:22*\"]]"`
+	Bundle  schema.BundleSchema `json:"bundle" required:"true" description:"Driver bundle installed"`
+}
+
+// RegistryAuthSchema represents the registry_auth block, the registries not set are pulled with the docker config
+// credentials of the root user
+type RegistryAuthSchema struct {
+	DockerConfigJSON string                               `json:"dockerconfigjson,omitempty" description:"Path of a docker config.json, or of a kubernetes dockerconfigjson secret, with the credentials of the registries in its auths"`
+	Credentials      map[string]RegistryCredentialsSchema `json:"credentials,omitempty" description:"Credentials of each registry host, taking precedence over the docker config ones"`
+}
+
+// RegistryCredentialsSchema represents the credentials of a registry
+type RegistryCredentialsSchema struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	Auth          string `json:"auth,omitempty" description:"Base64 encoded username:password, as in the docker config"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// JSONSchema returns the JSON schema of the cloud config for the given version
+func JSONSchema(version string) (string, error) {
+	return schema.GenerateSchema(Schema{}, fmt.Sprintf("https://kairos.io/%s/cloud-config.json", version))
+}
+
+// ValidateSchema checks the given cloud config, a local file, an URL or the config itself, against the Schema
+func ValidateSchema(source string) error {
+	var data string
+	switch {
+	case strings.HasPrefix(source, "http"):
+		resp, err := http.Get(source)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		data = string(body)
+	default:
+		dat, err := os.ReadFile(source)
+		switch {
+		case err == nil:
+			data = string(dat)
+		case os.IsNotExist(err) || strings.Contains(err.Error(), "file name too long"):
+			data = source
+		default:
+			return err
+		}
+	}
+
+	kc, err := schema.NewConfigFromYAML(data, Schema{})
+	if err != nil {
+		return err
+	}
+	if !kc.HasHeader() {
+		return fmt.Errorf("missing #cloud-config header")
+	}
+	if !kc.IsValid() {
+		return kc.ValidationError
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	"github.com/kairos-io/kairos-sdk/collector"
+	"gopkg.in/yaml.v3"
+)
+
+// SealedConfigDirs are the writable dirs of the cloud configs that need to be signed when config signing is enforced
+var SealedConfigDirs = []string{constants.OEMPath, filepath.Join(constants.UsrLocalPath, "cloud-config")}
+
+// TrustedConfigDirs are the image config dirs config signing is read from, the only ones not writable on the node
+var TrustedConfigDirs = []string{"/etc/kairos", "/etc/elemental"}
+
+// ConfigSigning seals the writable cloud config dirs, /oem and /usr/local/cloud-config: with Enforce set, only the
+// configs with a valid detached signature (the file plus `.sig`, base64 encoded as `cosign sign-blob` writes it) are
+// used by the agent and by the stages.
+// It's only read from the image configs, i.e. /etc/kairos, as no other config dir can be trusted to set it.
+// Note the configs the agent writes to the OEM partition itself, like the install cloud config without a
+// signature or the scheduled recovery jobs, are refused as well.
+type ConfigSigning struct {
+	Enforce bool `yaml:"enforce,omitempty" mapstructure:"enforce"`
+	// PublicKey is the PEM encoded public key built into the image, constants.ConfigSigningKeyFile by default
+	PublicKey string `yaml:"public-key,omitempty" mapstructure:"public-key"`
+	// TPMNVIndex is the TPM NV index the PEM encoded public key is read from instead, i.e. 0x1500016
+	TPMNVIndex string `yaml:"tpm-nv-index,omitempty" mapstructure:"tpm-nv-index"`
+}
+
+// SealedConfig returns true if only signed configs are to be used from the writable config dirs
+func (c *Config) SealedConfig() bool {
+	return c.ConfigSigning != nil && c.ConfigSigning.Enforce
+}
+
+// VerifyConfigSignature checks the detached signature of a cloud config with the config signing key
+func (c *Config) VerifyConfigSignature(data, sig []byte) error {
+	signing := c.ConfigSigning
+	if signing == nil {
+		signing = &ConfigSigning{}
+	}
+	var keyData []byte
+	var err error
+	keyName := signing.PublicKey
+	if signing.TPMNVIndex != "" {
+		keyName = fmt.Sprintf("TPM NV index %s", signing.TPMNVIndex)
+		keyData, err = c.Runner.Run("tpm2_nvread", "-C", "o", signing.TPMNVIndex)
+		if err != nil {
+			return fmt.Errorf("reading public key from %s: %s: %w", keyName, strings.TrimSpace(string(keyData)), err)
+		}
+	} else {
+		if keyName == "" {
+			keyName = constants.ConfigSigningKeyFile
+		}
+		keyData, err = c.Fs.ReadFile(keyName)
+		if err != nil {
+			return fmt.Errorf("reading public key: %w", err)
+		}
+	}
+	return verifySignature(keyName, keyData, data, sig)
+}
+
+// SealedConfigFiles returns the cloud configs in dir with a valid signature. The unsigned ones or the ones
+// failing verification are refused, they are logged and left out.
+func (c *Config) SealedConfigFiles(dir string) ([]string, error) {
+	var files []string
+	err := walkConfigFiles(c, dir, func(path string) {
+		data, err := c.Fs.ReadFile(path)
+		if err == nil {
+			var sig []byte
+			sig, err = c.Fs.ReadFile(path + constants.SignatureExt)
+			if err != nil {
+				err = fmt.Errorf("config is not signed")
+			} else {
+				err = c.VerifyConfigSignature(data, sig)
+			}
+		}
+		if err != nil {
+			c.Logger.Warnf("Refusing cloud config %s as config signing is enforced: %s", path, err)
+			return
+		}
+		files = append(files, path)
+	})
+	return files, err
+}
+
+// walkConfigFiles calls fn for every yaml file under dir, the same files the collector and yip read
+func walkConfigFiles(c *Config, dir string, fn func(path string)) error {
+	if _, err := c.Fs.Stat(dir); err != nil {
+		return nil
+	}
+	return fsutils.WalkDirFs(c.Fs, dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" {
+			fn(path)
+		}
+		return nil
+	})
+}
+
+// IsSealedConfigDir returns true if dir is one of the sealed config dirs, either under the root the agent operates
+// on or in the running system, as the stages run on the latter
+func IsSealedConfigDir(dir string) bool {
+	for _, d := range SealedConfigDirs {
+		if filepath.Clean(dir) == filepath.Clean(d) {
+			return true
+		}
+	}
+	return inConfigDirs(dir, SealedConfigDirs)
+}
+
+// inConfigDirs returns true if dir is one of dirs under the root the agent operates on
+func inConfigDirs(dir string, dirs []string) bool {
+	for _, d := range dirs {
+		if filepath.Clean(dir) == constants.InRoot(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// trustedConfigSigning returns the config signing settings from the scanned image config dirs
+func trustedConfigSigning(o *collector.Options) (*ConfigSigning, error) {
+	trusted := &collector.Options{NoLogs: true}
+	for _, d := range o.ScanDir {
+		if inConfigDirs(d, TrustedConfigDirs) {
+			trusted.ScanDir = append(trusted.ScanDir, d)
+		}
+	}
+	if len(trusted.ScanDir) == 0 {
+		return nil, nil
+	}
+	cfg, err := collector.Scan(trusted, FilterKeys)
+	if err != nil {
+		return nil, err
+	}
+	raw, ok := cfg.Values["config_signing"]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	data, err := yaml.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	signing := &ConfigSigning{}
+	if err = yaml.Unmarshal(data, signing); err != nil {
+		return nil, fmt.Errorf("parsing config_signing: %w", err)
+	}
+	return signing, nil
+}
+
+// sealConfigDirs replaces the sealed dirs in the scanned dirs by their signed configs when config signing is enforced
+func sealConfigDirs(c *Config, o *collector.Options) error {
+	signing, err := trustedConfigSigning(o)
+	if err != nil {
+		return err
+	}
+	c.ConfigSigning = signing
+	if !c.SealedConfig() {
+		return nil
+	}
+
+	var dirs, files []string
+	for _, d := range o.ScanDir {
+		if !IsSealedConfigDir(d) {
+			dirs = append(dirs, d)
+			continue
+		}
+		signed, err := c.SealedConfigFiles(d)
+		if err != nil {
+			return err
+		}
+		files = append(files, signed...)
+	}
+	o.ScanDir = dirs
+	// The sealed dirs are the last ones scanned, their configs go before any other reader
+	var readers []io.Reader
+	for _, f := range files {
+		data, err := c.Fs.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		if !collector.HasValidHeader(string(data)) {
+			continue
+		}
+		readers = append(readers, strings.NewReader(string(data)))
+	}
+	o.Readers = append(readers, o.Readers...)
+	return nil
+}
@@ -0,0 +1,261 @@
+package config
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	"github.com/kairos-io/kairos-sdk/collector"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigSourcesCacheDir is where the verified config sources are kept, to be used when they cannot be fetched
+var ConfigSourcesCacheDir = "/usr/local/.kairos/config-sources"
+
+// ConfigSource is a remote cloud config merged as a layer below the local configuration.
+// It is only used if it matches all of its sha256, signature and GPG signature that are set.
+type ConfigSource struct {
+	URL    string `yaml:"url" mapstructure:"url"`
+	Sha256 string `yaml:"sha256,omitempty" mapstructure:"sha256"`
+	// Signature is the base64 encoded signature of the config, or an http(s) URL to fetch it from.
+	// ECDSA signatures are expected over the sha256 digest of the config, as `cosign sign-blob` does.
+	Signature string `yaml:"signature,omitempty" mapstructure:"signature"`
+	// PublicKey is the path to the PEM encoded public key the signature is verified with
+	PublicKey string `yaml:"public-key,omitempty" mapstructure:"public-key"`
+	// GPGSignature is the http(s) URL of the detached GPG signature of the config, armored or binary
+	GPGSignature string `yaml:"gpg-signature,omitempty" mapstructure:"gpg-signature"`
+	// GPGKeyring is the GPG keyring file, or dir of keyrings, constants.GPGKeyringsDir by default
+	GPGKeyring string `yaml:"gpg-keyring,omitempty" mapstructure:"gpg-keyring"`
+}
+
+// mergeConfigSources fetches the config sources listed in the local configuration and returns them merged,
+// in order, with the local configuration on top. A source that cannot be fetched falls back to the last
+// verified copy in the cache. Sources that fail verification or are not available at all are skipped.
+func mergeConfigSources(c *Config, local *collector.Config) (*collector.Config, error) {
+	raw, ok := local.Values["config_sources"]
+	if !ok || raw == nil {
+		return local, nil
+	}
+	data, err := yaml.Marshal(raw)
+	if err != nil {
+		return local, err
+	}
+	var sources []ConfigSource
+	if err = yaml.Unmarshal(data, &sources); err != nil {
+		return local, fmt.Errorf("parsing config_sources: %w", err)
+	}
+
+	merged := &collector.Config{Values: collector.ConfigValues{}}
+	for _, s := range sources {
+		data, err := loadConfigSource(c, s)
+		if err != nil {
+			c.Logger.Warnf("Skipping config source %s: %s", s.URL, err)
+			continue
+		}
+		values := collector.ConfigValues{}
+		if err = yaml.Unmarshal(data, &values); err != nil {
+			c.Logger.Warnf("Skipping config source %s: %s", s.URL, err)
+			continue
+		}
+		// Sources are a single level, a source cannot pull further sources
+		delete(values, "config_sources")
+		if err = merged.MergeConfig(&collector.Config{Sources: []string{s.URL}, Values: values}); err != nil {
+			return local, fmt.Errorf("merging config source %s: %w", s.URL, err)
+		}
+	}
+	if err = merged.MergeConfig(local); err != nil {
+		return local, err
+	}
+	return merged, nil
+}
+
+// loadConfigSource returns the verified contents of the config source, from its URL or, failing that, from the cache
+func loadConfigSource(c *Config, s ConfigSource) ([]byte, error) {
+	if s.URL == "" {
+		return nil, fmt.Errorf("config source without url")
+	}
+	if s.Sha256 == "" && s.Signature == "" && s.GPGSignature == "" {
+		return nil, fmt.Errorf("config source has neither sha256, signature nor gpg-signature")
+	}
+	if s.Signature != "" && s.PublicKey == "" {
+		return nil, fmt.Errorf("config source signature set without a public-key")
+	}
+
+	key := sha256.Sum256([]byte(s.URL))
+	cached := filepath.Join(ConfigSourcesCacheDir, hex.EncodeToString(key[:]))
+
+	data, sig, gpgSig, err := fetchConfigSource(c, s)
+	if err == nil {
+		if err = verifyConfigSource(c, s, data, sig, gpgSig); err != nil {
+			return nil, err
+		}
+		if err = cacheConfigSource(c, cached, data, sig, gpgSig); err != nil {
+			c.Logger.Warnf("Could not cache config source %s: %s", s.URL, err)
+		}
+		return data, nil
+	}
+
+	c.Logger.Warnf("Could not fetch config source %s, using the cached copy: %s", s.URL, err)
+	data, cacheErr := c.Fs.ReadFile(cached)
+	if cacheErr != nil {
+		return nil, fmt.Errorf("fetching %s: %w, and no cached copy is available", s.URL, err)
+	}
+	sig, _ = c.Fs.ReadFile(cached + constants.SignatureExt)
+	gpgSig, _ = c.Fs.ReadFile(cached + constants.GPGSignatureExt)
+	if err = verifyConfigSource(c, s, data, sig, gpgSig); err != nil {
+		return nil, fmt.Errorf("cached copy: %w", err)
+	}
+	return data, nil
+}
+
+// fetchConfigSource downloads the config source, its signature if it is given as a URL and its GPG signature
+func fetchConfigSource(c *Config, s ConfigSource) (data, sig, gpgSig []byte, err error) {
+	tmp, err := fsutils.NamespacedTempDir(c.Fs, "", "config-source", 0)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer func() { _ = fsutils.RemoveTempDir(c.Fs, tmp) }()
+
+	dest := filepath.Join(tmp, "config")
+	if err = c.Client.GetURL(c.Logger, s.URL, dest); err != nil {
+		return nil, nil, nil, err
+	}
+	if data, err = c.Fs.ReadFile(dest); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if strings.HasPrefix(s.Signature, "http://") || strings.HasPrefix(s.Signature, "https://") {
+		dest = filepath.Join(tmp, "signature")
+		if err = c.Client.GetURL(c.Logger, s.Signature, dest); err != nil {
+			return nil, nil, nil, fmt.Errorf("fetching signature: %w", err)
+		}
+		if sig, err = c.Fs.ReadFile(dest); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if s.GPGSignature != "" {
+		dest = filepath.Join(tmp, "gpg-signature")
+		if err = c.Client.GetURL(c.Logger, s.GPGSignature, dest); err != nil {
+			return nil, nil, nil, fmt.Errorf("fetching GPG signature: %w", err)
+		}
+		if gpgSig, err = c.Fs.ReadFile(dest); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return data, sig, gpgSig, nil
+}
+
+// verifyConfigSource checks the config source data against its sha256, its signature and its GPG signature.
+// sig is the fetched signature when the source signature is a URL.
+func verifyConfigSource(c *Config, s ConfigSource, data, sig, gpgSig []byte) error {
+	digest := sha256.Sum256(data)
+	if s.Sha256 != "" {
+		expected := strings.ToLower(strings.TrimPrefix(s.Sha256, "sha256:"))
+		if got := hex.EncodeToString(digest[:]); got != expected {
+			return fmt.Errorf("sha256 mismatch, expected %s got %s", expected, got)
+		}
+	}
+	if s.GPGSignature != "" {
+		if err := verifyConfigSourceGPG(c, s, data, gpgSig); err != nil {
+			return err
+		}
+	}
+	if s.Signature == "" {
+		return nil
+	}
+
+	if sig == nil {
+		sig = []byte(s.Signature)
+	}
+	keyData, err := c.Fs.ReadFile(s.PublicKey)
+	if err != nil {
+		return fmt.Errorf("reading public key: %w", err)
+	}
+	return verifySignature(s.PublicKey, keyData, data, sig)
+}
+
+// verifyConfigSourceGPG checks the GPG signature of the config source, gpgv needs both on disk
+func verifyConfigSourceGPG(c *Config, s ConfigSource, data, gpgSig []byte) error {
+	if gpgSig == nil {
+		return fmt.Errorf("no GPG signature available")
+	}
+	tmp, err := fsutils.NamespacedTempDir(c.Fs, "", "config-source-gpg", 0)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = fsutils.RemoveTempDir(c.Fs, tmp) }()
+	file, sig := filepath.Join(tmp, "config"), filepath.Join(tmp, "config"+constants.GPGSignatureExt)
+	if err = c.Fs.WriteFile(file, data, constants.FilePerm); err != nil {
+		return err
+	}
+	if err = c.Fs.WriteFile(sig, gpgSig, constants.FilePerm); err != nil {
+		return err
+	}
+	return c.VerifyGPGSignature(s.GPGKeyring, file, sig)
+}
+
+// verifySignature checks the base64 encoded signature of data with the given PEM encoded public key.
+// ECDSA and RSA signatures are expected over the sha256 digest of the data, as `cosign sign-blob` does.
+func verifySignature(keyName string, keyData, data, sig []byte) error {
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil {
+		return fmt.Errorf("decoding signature: %w", err)
+	}
+	block, _ := pem.Decode(keyData)
+	if block == nil {
+		return fmt.Errorf("no PEM data found in %s", keyName)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("parsing public key %s: %w", keyName, err)
+	}
+	digest := sha256.Sum256(data)
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, digest[:], signature) {
+			return fmt.Errorf("invalid signature")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, data, signature) {
+			return fmt.Errorf("invalid signature")
+		}
+	case *rsa.PublicKey:
+		if err = rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature); err != nil {
+			return fmt.Errorf("invalid signature: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+	return nil
+}
+
+// cacheConfigSource keeps a verified config source, and its fetched signatures if any, for offline use
+func cacheConfigSource(c *Config, cached string, data, sig, gpgSig []byte) error {
+	if err := fsutils.MkdirAll(c.Fs, ConfigSourcesCacheDir, constants.DirPerm); err != nil {
+		return err
+	}
+	if err := fsutils.AtomicWriteFile(c.Fs, cached, data, constants.ConfigPerm); err != nil {
+		return err
+	}
+	for ext, s := range map[string][]byte{constants.SignatureExt: sig, constants.GPGSignatureExt: gpgSig} {
+		if s == nil {
+			_ = c.Fs.Remove(cached + ext)
+			continue
+		}
+		if err := fsutils.AtomicWriteFile(c.Fs, cached+ext, s, constants.ConfigPerm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
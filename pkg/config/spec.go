@@ -23,6 +23,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 
 	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
@@ -33,11 +34,9 @@ import (
 	"github.com/kairos-io/kairos-sdk/ghw"
 	"github.com/kairos-io/kairos-sdk/types"
 
-	"github.com/google/go-containerregistry/pkg/crane"
 	"github.com/mitchellh/mapstructure"
 	"github.com/sanity-io/litter"
 	"github.com/spf13/viper"
-	"golang.org/x/sys/unix"
 )
 
 const (
@@ -90,11 +89,7 @@ func NewInstallSpec(cfg *Config) (*v1.InstallSpec, error) {
 	// Check the default ISO recovery installation media is available)
 	recoveryExists, _ := fsutils.Exists(cfg.Fs, recoveryImgFile)
 
-	if efiExists {
-		firmware = v1.EFI
-	} else {
-		firmware = v1.BIOS
-	}
+	firmware = v1.FirmwareForArch(cfg.Arch, efiExists)
 
 	// Resolve the install target
 	dev, err := resolveTarget(cfg.Install.Device)
@@ -155,6 +150,7 @@ func NewInstallSpec(cfg *Config) (*v1.InstallSpec, error) {
 		Recovery:  recoveryImg,
 		Passive:   passiveImg,
 		NoFormat:  cfg.Install.NoFormat,
+		Arch:      cfg.Arch,
 	}
 
 	// Get the actual source size to calculate the image size and partitions size
@@ -182,9 +178,34 @@ func NewInstallSpec(cfg *Config) (*v1.InstallSpec, error) {
 	// Calculate the partitions afterwards so they use the image sizes for the final partition sizes
 	spec.Partitions = NewInstallElementalPartitions(cfg.Logger, spec)
 
+	// Adjust the install to reduce the wear of SD cards and eMMC devices
+	spec.Media = nil
+	if spec.MediaTuning != v1.MediaTuningOff {
+		spec.Media = flashMediaDecisions(cfg, spec)
+	}
+
 	return spec, nil
 }
 
+// flashMediaDecisions detects whether the install target is flash media and logs the decisions taken for it
+func flashMediaDecisions(cfg *Config, spec *v1.InstallSpec) *v1.FlashMedia {
+	media := v1.DetectFlashMedia(cfg.Fs, spec.Target)
+	if media == nil {
+		return nil
+	}
+	media.SingleSync = true
+	media.VolatileJournal = true
+	cfg.Logger.Infof("Target %s is %s flash media, syncing once after formatting and keeping the journald logs in memory", spec.Target, media.Kind)
+	if spec.Partitions.Persistent.FS != v1.FlashPersistentFS {
+		media.SuggestedPersistentFS = v1.FlashPersistentFS
+		cfg.Logger.Infof("Consider %s for the persistent partition on flash media, by setting install.partitions.persistent.fs", v1.FlashPersistentFS)
+	}
+	for _, w := range media.Warnings() {
+		cfg.Logger.Warn(w)
+	}
+	return media
+}
+
 func NewInstallElementalPartitions(log types.KairosLogger, spec *v1.InstallSpec) v1.ElementalPartitions {
 	pt := v1.ElementalPartitions{}
 	var oemSize uint
@@ -266,10 +287,28 @@ func NewInstallElementalPartitions(log types.KairosLogger, spec *v1.InstallSpec)
 		MountPoint:      constants.PersistentDir,
 		Flags:           []string{},
 	}
+	// f2fs is the only other filesystem supported for persistent, as suggested for flash media
+	if spec.Partitions.Persistent != nil && spec.Partitions.Persistent.FS == v1.FlashPersistentFS {
+		pt.Persistent.FS = v1.FlashPersistentFS
+	}
 	log.Infof("Setting persistent partition size to %dMb", persistentSize)
+
+	// Keep the partition GUIDs and flags, i.e. GPT types and attributes, set by the user
+	keepUserPartitionSettings(spec.Partitions.OEM, pt.OEM)
+	keepUserPartitionSettings(spec.Partitions.Recovery, pt.Recovery)
+	keepUserPartitionSettings(spec.Partitions.State, pt.State)
+	keepUserPartitionSettings(spec.Partitions.Persistent, pt.Persistent)
 	return pt
 }
 
+func keepUserPartitionSettings(user, part *types.Partition) {
+	if user == nil {
+		return
+	}
+	part.UUID = user.UUID
+	part.Flags = append(part.Flags, user.Flags...)
+}
+
 // NewUpgradeSpec returns an UpgradeSpec struct all based on defaults and current host state
 func NewUpgradeSpec(cfg *Config) (*v1.UpgradeSpec, error) {
 	var recLabel, recFs, recMnt string
@@ -393,23 +432,53 @@ func NewUpgradeSpec(cfg *Config) (*v1.UpgradeSpec, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed unmarshalling the full spec: %w", err)
 	}
-	err = setUpgradeSourceSize(cfg, spec)
+	err = setUpgradeSource(cfg, spec)
 	if err != nil {
-		return nil, fmt.Errorf("failed calculating size: %w", err)
+		return nil, err
+	}
+
+	return spec, nil
+}
+
+// setUpgradeSource picks the first upgrade source that can be reached and sizes the upgraded image for it.
+// The sources after it are kept as fallbacks in case deploying the image fails.
+func setUpgradeSource(cfg *Config, spec *v1.UpgradeSpec) error {
+	candidates := spec.SourceCandidates()
+	if len(candidates) == 0 {
+		return checkUpgradeSource(cfg, spec)
+	}
+	var err error
+	for i, src := range candidates {
+		spec.TargetImage().Source = src
+		spec.Sources = candidates[i+1:]
+		if err = checkUpgradeSource(cfg, spec); err == nil {
+			return nil
+		}
+		if i < len(candidates)-1 {
+			cfg.Logger.Warnf("Upgrade source %s is not usable, trying the next one: %s", src.String(), err.Error())
+		}
+	}
+	return err
+}
+
+// checkUpgradeSource sizes the upgraded image for its source and checks OCI sources exist
+func checkUpgradeSource(cfg *Config, spec *v1.UpgradeSpec) error {
+	err := setUpgradeSourceSize(cfg, spec)
+	if err != nil {
+		return fmt.Errorf("failed calculating size: %w", err)
 	}
 
 	if spec.Active.Source.IsDocker() {
                 cfg.Logger.Infof("Checking if OCI image %s exists", spec.Active.Source.Value())
-		_, err := crane.Manifest(spec.Active.Source.Value())
+		_, err := cfg.craneManifest(spec.Active.Source.Value())
 		if err != nil {
 			if strings.Contains(err.Error(), "MANIFEST_UNKNOWN") {
-				return nil, fmt.Errorf("oci image %s does not exist", spec.Active.Source.Value())
+				return fmt.Errorf("oci image %s does not exist", spec.Active.Source.Value())
 			}
-			return nil, err
+			return err
 		}
 	}
-
-	return spec, nil
+	return nil
 }
 
 func setUpgradeSourceSize(cfg *Config, spec *v1.UpgradeSpec) error {
@@ -657,11 +726,12 @@ func ReadInstallSpecFromConfig(c *Config) (*v1.InstallSpec, error) {
 	}
 	installSpec := sp.(*v1.InstallSpec)
 
-	if (installSpec.Target == "" || installSpec.Target == "auto") && !installSpec.NoFormat {
-		installSpec.Target = detectLargestDevice()
+	// Network disks are attached at install time, which sets the target device
+	if !installSpec.NoFormat && installSpec.NetworkDisk == nil {
+		installSpec.Target, err = selectTargetDevice(c, installSpec.Target)
 	}
 
-	return installSpec, nil
+	return installSpec, err
 }
 
 // ReadUkiResetSpecFromConfig will return a proper v1.ResetUkiSpec based on an agent Config
@@ -696,6 +766,7 @@ func NewUkiInstallSpec(cfg *Config) (*v1.InstallUkiSpec, error) {
 	spec := &v1.InstallUkiSpec{
 		Target: cfg.Install.Device,
 		Active: activeImg,
+		Arch:   cfg.Arch,
 	}
 
 	// Calculate the partitions afterwards so they use the image sizes for the final partition sizes
@@ -752,11 +823,11 @@ func ReadUkiInstallSpecFromConfig(c *Config) (*v1.InstallUkiSpec, error) {
 	}
 	installSpec := sp.(*v1.InstallUkiSpec)
 
-	if (installSpec.Target == "" || installSpec.Target == "auto") && !installSpec.NoFormat {
-		installSpec.Target = detectLargestDevice()
+	if !installSpec.NoFormat {
+		installSpec.Target, err = selectTargetDevice(c, installSpec.Target)
 	}
 
-	return installSpec, nil
+	return installSpec, err
 }
 
 func NewUkiUpgradeSpec(cfg *Config) (*v1.UpgradeUkiSpec, error) {
@@ -765,9 +836,9 @@ func NewUkiUpgradeSpec(cfg *Config) (*v1.UpgradeUkiSpec, error) {
 		return nil, fmt.Errorf("failed unmarshalling full spec: %w", err)
 	}
 	// TODO: Use this everywhere?
-	cfg.Logger.Infof("Checking if OCI image %s exists", spec.Active.Source.Value())
 	if spec.Active.Source.IsDocker() {
-		_, err := crane.Manifest(spec.Active.Source.Value())
+		cfg.Logger.Infof("Checking if OCI image %s exists", spec.Active.Source.Value())
+		_, err := cfg.craneManifest(spec.Active.Source.Value())
 		if err != nil {
 			if strings.Contains(err.Error(), "MANIFEST_UNKNOWN") {
 				return nil, fmt.Errorf("oci image %s does not exist", spec.Active.Source.Value())
@@ -792,16 +863,7 @@ func NewUkiUpgradeSpec(cfg *Config) (*v1.UpgradeUkiSpec, error) {
 		return spec, fmt.Errorf("could not read host partitions")
 	}
 
-	// Get free size of partition
-	var stat unix.Statfs_t
-	_ = unix.Statfs(spec.EfiPartition.MountPoint, &stat)
-	freeSize := stat.Bfree * uint64(stat.Bsize) / 1000 / 1000
-	cfg.Logger.Debugf("Partition on mountpoint %s has %dMb free", spec.EfiPartition.MountPoint, freeSize)
-	// Check if the source is over the free size
-	if spec.Active.Size > uint(freeSize) {
-		return spec, fmt.Errorf("source size(%d) is bigger than the free space(%d) on the EFI partition(%s)", spec.Active.Size, freeSize, spec.EfiPartition.MountPoint)
-	}
-
+	// The free space of the EFI partition is checked by the upgrade, accounting the entries and extensions it replaces
 	return spec, err
 }
 
@@ -815,10 +877,18 @@ func ReadUkiUpgradeSpecFromConfig(c *Config) (*v1.UpgradeUkiSpec, error) {
 	return upgradeSpec, nil
 }
 
+// sizeCounter adds up the sizes of the files of a dir source, safe to use from the workers walking it
+type sizeCounter struct {
+	mu   sync.Mutex
+	size int64
+	// visited keeps track of the files visited to avoid counting a file more than once if it's a symlink. It could
+	// also be used as a way to filter some files
+	visited map[string]bool
+}
+
 // getSize will calculate the size of a file or symlink and will do nothing with directories
-// fileList: keeps track of the files visited to avoid counting a file more than once if it's a symlink. It could also be used as a way to filter some files
-// size: will be the memory that adds up all the files sizes. Meaning it could be initialized with a value greater than 0 if needed.
-func getSize(vfs v1.FS, size *int64, fileList map[string]bool, path string, d fs.DirEntry, err error) error {
+// counter: adds up all the files sizes. Meaning it could be initialized with a size greater than 0 if needed.
+func getSize(vfs v1.FS, counter *sizeCounter, path string, d fs.DirEntry, err error) error {
 	if err != nil {
 		return err
 	}
@@ -843,28 +913,149 @@ func getSize(vfs v1.FS, size *int64, fileList map[string]bool, path string, d fs
 	}
 
 	fileInfo, err := vfs.Stat(actualFilePath)
-	if os.IsNotExist(err) || fileList[actualFilePath] {
+	if os.IsNotExist(err) {
 		return nil
 	}
 	if err != nil {
 		return err
 	}
 
-	*size += fileInfo.Size()
-	fileList[actualFilePath] = true
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	if counter.visited[actualFilePath] {
+		return nil
+	}
+	counter.size += fileInfo.Size()
+	counter.visited[actualFilePath] = true
 
 	return nil
 }
 
+// ociSizeFactor is applied to the size reported by the registry, which is the compressed size of the layers
+const ociSizeFactor = 2.5
+
+// tarballSizeFactor is applied to the size of the compressed tarball sources, which expand like the image layers
+const tarballSizeFactor = ociSizeFactor
+
+// SourceSize is the size estimation of a source, as used to size the images and by side effect the partitions
+type SourceSize struct {
+	Source string `json:"source" yaml:"source"`
+	// Raw is the size in bytes as reported by the registry or the filesystem
+	Raw int64 `json:"raw" yaml:"raw"`
+	// Factor is applied to the raw size to account for compression
+	Factor float64 `json:"factor" yaml:"factor"`
+	// Size is the adjusted size in Mb, with 100Mb extra for the bootloader files
+	Size int64 `json:"size" yaml:"size"`
+	// Partitions are the partition sizes in Mb an install of the source gets, by filesystem label
+	Partitions map[string]uint `json:"partitions,omitempty" yaml:"partitions,omitempty"`
+}
+
+// sourceSizeCache keeps the size estimations of the sources, so the specs and the deployment of a command don't
+// calculate them again. File and dir sources are keyed by the modification time of their root as well, changes
+// deeper in a dir tree are not noticed.
+type sourceSizeCache struct {
+	mu    sync.Mutex
+	sizes map[string]SourceSize
+}
+
+func (c *sourceSizeCache) get(key string) (*SourceSize, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	estimation, ok := c.sizes[key]
+	if !ok {
+		return nil, false
+	}
+	return &estimation, true
+}
+
+func (c *sourceSizeCache) set(key string, estimation *SourceSize) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sizes == nil {
+		c.sizes = map[string]SourceSize{}
+	}
+	c.sizes[key] = *estimation
+}
+
+// sourceSizeKey returns the identity of the source the size estimations are cached by
+func sourceSizeKey(config *Config, source *v1.ImageSource) string {
+	key := source.String()
+	if config.Platform != nil {
+		key += "|" + config.Platform.String()
+	}
+	if source.IsDir() || source.IsFile() {
+		if info, err := config.Fs.Stat(source.Value()); err == nil {
+			key += fmt.Sprintf("|%d|%d", info.ModTime().UnixNano(), info.Size())
+		}
+	}
+	if source.IsDir() {
+		// The dirs skipped under kubernetes depend on the environment
+		_, underKubernetes := os.LookupEnv("KUBERNETES_SERVICE_HOST")
+		key += fmt.Sprintf("|%t|%s", underKubernetes, k8sutils.GetHostDirForK8s())
+	}
+	return key
+}
+
+// DerivePartitions sets the partition sizes an install with the default partitioning derives from the source size
+func (s *SourceSize) DerivePartitions() {
+	spec := &v1.InstallSpec{
+		Active:   v1.Image{Size: uint(s.Size)},
+		Passive:  v1.Image{Size: uint(s.Size)},
+		Recovery: v1.Image{Size: uint(s.Size)},
+	}
+	parts := NewInstallElementalPartitions(types.NewNullLogger(), spec)
+	s.Partitions = map[string]uint{
+		parts.OEM.FilesystemLabel:        parts.OEM.Size,
+		parts.Recovery.FilesystemLabel:   parts.Recovery.Size,
+		parts.State.FilesystemLabel:      parts.State.Size,
+		parts.Persistent.FilesystemLabel: parts.Persistent.Size,
+	}
+}
+
 // GetSourceSize will try to gather the actual size of the source
 // Useful to create the exact size of images and by side effect the partition size
 // This helps adjust the size to be juuuuust right.
 // It can still be manually override from the cloud config by setting all values manually
 // But by default it should adjust the sizes properly
 func GetSourceSize(config *Config, source *v1.ImageSource) (int64, error) {
+	estimation, err := EstimateSourceSize(config, source)
+	return estimation.Size, err
+}
+
+// remoteSourceSize returns the size of the remote file as reported by the server
+func remoteSourceSize(config *Config, url string) (int64, error) {
+	sizer, ok := config.Client.(interface{ Size(string) (int64, error) })
+	if !ok {
+		return 0, fmt.Errorf("the size of %s can't be fetched with the configured client", url)
+	}
+	return sizer.Size(url)
+}
+
+// EstimateSourceSize returns the raw and adjusted sizes of the source, as GetSourceSize does.
+// This is the entrypoint for the source-size command. The estimations are cached in the config, so estimating the
+// same source again is free.
+func EstimateSourceSize(config *Config, source *v1.ImageSource) (*SourceSize, error) {
+	key := sourceSizeKey(config, source)
+	if estimation, ok := config.sourceSizes.get(key); ok {
+		return estimation, nil
+	}
+	estimation, err := estimateSourceSize(config, source)
+	if err == nil {
+		config.sourceSizes.set(key, estimation)
+	}
+	return estimation, err
+}
+
+func estimateSourceSize(config *Config, source *v1.ImageSource) (*SourceSize, error) {
 	var size int64
 	var err error
-	var filesVisited map[string]bool
+	estimation := &SourceSize{Source: source.String(), Factor: 1}
 
 	switch {
 	case source.IsDocker():
@@ -872,9 +1063,17 @@ func GetSourceSize(config *Config, source *v1.ImageSource) (int64, error) {
 		// Otherwise we would need to READ all the layers uncompressed to calculate the image size which would
 		// double the download size and slow down everything
 		size, err = config.ImageExtractor.GetOCIImageSize(source.Value(), config.Platform.String())
-		size = int64(float64(size) * 2.5)
+		estimation.Raw = size
+		estimation.Factor = ociSizeFactor
+		size = int64(float64(size) * ociSizeFactor)
+	case source.IsContainerStore():
+		size, estimation.Factor, err = containerStoreImageSize(config, source)
+		estimation.Raw = size
+		size = int64(float64(size) * estimation.Factor)
 	case source.IsDir():
-		filesVisited = make(map[string]bool, 30000) // An Ubuntu system has around 27k files. This improves performance by not having to resize the map for every file visited
+		counter := &sizeCounter{
+			visited: make(map[string]bool, 30000), // An Ubuntu system has around 27k files. This improves performance by not having to resize the map for every file visited
+		}
 		// In kubernetes we use the suc script to upgrade (https://github.com/kairos-io/packages/blob/main/packages/system/suc-upgrade/suc-upgrade.sh)
 		// , which mounts the host root into $HOST_DIR
 		// we should skip that dir when calculating the size as we would be doubling the calculated size
@@ -884,7 +1083,8 @@ func GetSourceSize(config *Config, source *v1.ImageSource) (int64, error) {
 		// Try to get the HOST_DIR in case we are not using the default one
 		hostDir := k8sutils.GetHostDirForK8s()
 		config.Logger.Logger.Debug().Bool("status", underKubernetes).Str("hostdir", hostDir).Msg("Kubernetes check")
-		err = fsutils.WalkDirFs(config.Fs, source.Value(), func(path string, d fs.DirEntry, err error) error {
+		// Walked by several workers, dirs with millions of files take too long to be read one by one
+		err = fsutils.WalkDirFsParallel(config.Fs, source.Value(), config.SizeWorkers, func(path string, d fs.DirEntry, err error) error {
 			// If its empty we are just not setting it, so probably out of the k8s upgrade path
 			if hostDir != "" && strings.HasPrefix(path, hostDir) {
 				config.Logger.Logger.Debug().Str("path", path).Str("hostDir", hostDir).Msg("Skipping file as it is a host directory")
@@ -894,25 +1094,39 @@ func GetSourceSize(config *Config, source *v1.ImageSource) (int64, error) {
 				// During install or upgrade outside kubernetes, we dont care about those dirs as they are not expected to be in the source dir
 				config.Logger.Logger.Debug().Str("path", path).Str("hostDir", hostDir).Msg("Skipping dir as it is a runtime directory under kubernetes (/proc, /dev or /run)")
 			} else {
-				v := getSize(config.Fs, &size, filesVisited, path, d, err)
+				v := getSize(config.Fs, counter, path, d, err)
 				return v
 			}
 
 			return nil
 		})
+		size = counter.size
+		estimation.Raw = size
 
 	case source.IsFile():
 		file, err := config.Fs.Stat(source.Value())
 		if err != nil {
-			return size, err
+			return estimation, err
 		}
 		size = file.Size()
+		estimation.Raw = size
+	case source.IsS3():
+		size, err = remoteSourceSize(config, source.String())
+		estimation.Raw = size
+	case source.IsTarball():
+		size, err = remoteSourceSize(config, source.Value())
+		estimation.Raw = size
+		if !strings.HasSuffix(strings.SplitN(source.Value(), "#", 2)[0], ".tar") {
+			estimation.Factor = tarballSizeFactor
+			size = int64(float64(size) * tarballSizeFactor)
+		}
 	}
 	// Normalize size to Mb before returning and add 100Mb to round the size from bytes to mb+extra files like grub stuff
 	if size != 0 {
 		size = (size / 1000 / 1000) + 100
 	}
-	return size, err
+	estimation.Size = size
+	return estimation, err
 }
 
 // ReadUpgradeSpecFromConfig will return a proper v1.UpgradeSpec based on an agent Config
@@ -1015,12 +1229,12 @@ func BootedFrom(runner v1.Runner, label string) bool {
 func hasSquashedRecovery(config *Config, recovery *types.Partition) (squashed bool, err error) {
 	mountPoint := recovery.MountPoint
 	if mnt, _ := isMounted(config, recovery); !mnt {
-		tmpMountDir, err := fsutils.TempDir(config.Fs, "", "elemental")
+		tmpMountDir, err := fsutils.NamespacedTempDir(config.Fs, "", "recovery", 0)
 		if err != nil {
 			config.Logger.Errorf("failed creating temporary dir: %v", err)
 			return false, err
 		}
-		defer config.Fs.RemoveAll(tmpMountDir) // nolint:errcheck
+		defer fsutils.RemoveTempDir(config.Fs, tmpMountDir) // nolint:errcheck
 		err = config.Mounter.Mount(recovery.Path, tmpMountDir, "auto", []string{})
 		if err != nil {
 			config.Logger.Errorf("failed mounting recovery partition: %v", err)
@@ -1075,20 +1289,21 @@ func unmarshallFullSpec(r *Config, subkey string, sp v1.Spec) error {
 	return nil
 }
 
-// detectLargestDevice returns the largest disk found
-func detectLargestDevice() string {
-	preferedDevice := "/dev/sda"
-	maxSize := float64(0)
-
-	for _, disk := range ghw.GetDisks(ghw.NewPaths(""), nil) {
-		size := float64(disk.SizeBytes) / float64(GiB)
-		if size > maxSize {
-			maxSize = size
-			preferedDevice = "/dev/" + disk.Name
+// selectTargetDevice resolves the install device when it is not a path but a device selector expression, like
+// `smallest-ssd` or `>=64GiB,!usb`. An empty device or `auto` pick the largest disk, /dev/sda if there are none.
+func selectTargetDevice(c *Config, target string) (string, error) {
+	if strings.HasPrefix(target, "/") {
+		return target, nil
+	}
+	device, err := partitions.SelectDevice(ghw.NewPaths(""), target, &c.Logger)
+	if err != nil {
+		if target == "" || target == "auto" {
+			return "/dev/sda", nil
 		}
+		return "", fmt.Errorf("selecting the install device: %w", err)
 	}
-
-	return preferedDevice
+	c.Logger.Infof("Selected %s as install device", device)
+	return device, nil
 }
 
 // DetectPreConfiguredDevice returns a disk that has partitions labeled with
@@ -18,9 +18,11 @@ package config_test
 
 import (
 	"bytes"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/kairos-io/kairos-agent/v2/pkg/config"
 	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
@@ -488,6 +490,26 @@ var _ = Describe("Types", Label("types", "config"), func() {
 					// Make the same calculation as the code
 					Expect(spec.Active.Size).To(Equal(uint(f.Size()/1000/1000) + 100))
 				})
+				It("picks the first usable source from the sources list", func() {
+					cfg, err := config.ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\nupgrade:\n  sources:\n  - file:/mnt/missing.img\n  - file:/tmp/waka\n  - dir:/\n")))
+					// Set manually the config collector in the cfg file before unmarshalling the spec
+					c.Config = cfg.Config
+					Expect(c.Fs.Mkdir("/tmp", 0777)).ShouldNot(HaveOccurred())
+					Expect(c.Fs.WriteFile("/tmp/waka", []byte("waka"), 0777)).ShouldNot(HaveOccurred())
+					spec, err := config.NewUpgradeSpec(c)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(spec.Active.Source.String()).To(Equal("file:///tmp/waka"))
+					Expect(spec.Sources).To(HaveLen(1))
+					Expect(spec.Sources[0].String()).To(Equal("dir:///"))
+				})
+				It("fails if none of the sources is usable", func() {
+					cfg, err := config.ScanNoLogs(collector.Readers(strings.NewReader("#cloud-config\nupgrade:\n  system:\n    uri: file:/mnt/missing.img\n  sources:\n  - file:/mnt/other.img\n")))
+					// Set manually the config collector in the cfg file before unmarshalling the spec
+					c.Config = cfg.Config
+					_, err = config.NewUpgradeSpec(c)
+					Expect(err).Should(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("/mnt/other.img"))
+				})
 
 			})
 		})
@@ -517,6 +539,9 @@ install:
   grub-entry-name: "MyCustomOS"
   system:
     size: 666
+  timeouts:
+    download: 10m
+    total: 1h30m
 reset:
   reset-persistent: true
   reset-oem: true
@@ -600,9 +625,58 @@ cloud-init-paths:
 				Expect(installSpec.Target).To(Equal("/some/device"))
 				Expect(installSpec.GrubDefEntry).To(Equal("MyCustomOS"))
 				Expect(installSpec.Active.Size).To(Equal(uint(666)))
+				Expect(installSpec.Timeouts.Download).To(Equal(10 * time.Minute))
+				Expect(installSpec.Timeouts.Deploy).To(BeZero())
+				Expect(installSpec.Timeouts.Total).To(Equal(90 * time.Minute))
 				Expect(cfg.CloudInitPaths).To(ContainElement("/what"))
 
 			})
+			It("Selects the install device from a selector expression", func() {
+				// The mock sizes are in 512 bytes sectors
+				ghwTest.AddDisk(sdkTypes.Disk{Name: "sda", SizeBytes: 500 * 1024 * 1024 * 2})
+				ghwTest.AddDisk(sdkTypes.Disk{Name: "sdb", SizeBytes: 120 * 1024 * 1024 * 2})
+				ghwTest.AddDisk(sdkTypes.Disk{Name: "nvme0n1", SizeBytes: 250 * 1024 * 1024 * 2})
+				ghwTest.AddDisk(sdkTypes.Disk{Name: "sdc", SizeBytes: 32 * 1024 * 1024 * 2})
+				ghwTest.Clean()
+				ghwTest.CreateDevices()
+				for disk, rotational := range map[string]string{"sda": "1", "sdb": "0", "nvme0n1": "0", "sdc": "0"} {
+					queue := filepath.Join(ghwTest.Chroot, "sys", "block", disk, "queue")
+					Expect(os.MkdirAll(queue, constants.DirPerm)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(queue, "rotational"), []byte(rotational+"\n"), constants.FilePerm)).To(Succeed())
+				}
+				Expect(os.WriteFile(filepath.Join(ghwTest.Chroot, "sys", "block", "sdc", "removable"), []byte("1\n"), constants.FilePerm)).To(Succeed())
+
+				for expression, device := range map[string]string{
+					"auto":                    "/dev/sda",
+					"smallest-ssd":            "/dev/sdc",
+					"smallest-ssd,!removable": "/dev/sdb",
+					">=64GiB,<200GiB":         "/dev/sdb",
+					"ssd,largest":             "/dev/nvme0n1",
+					"name=sd*,<=120G,ssd":     "/dev/sdb",
+				} {
+					ccdata := []byte(fmt.Sprintf("#cloud-config\ninstall:\n  device: %q\n", expression))
+					Expect(os.WriteFile(filepath.Join(dir, "cc.yaml"), ccdata, os.ModePerm)).To(Succeed())
+					cfg, err := config.ScanNoLogs(collector.Directories([]string{dir}...), collector.NoLogs)
+					Expect(err).ToNot(HaveOccurred())
+					cfg.Runner = runner
+					cfg.Fs = fs
+					cfg.Mounter = mounter
+					cfg.CloudInitRunner = ci
+					cfg.Logger = logger
+					installSpec, err := config.ReadInstallSpecFromConfig(cfg)
+					Expect(err).ToNot(HaveOccurred(), expression)
+					Expect(installSpec.Target).To(Equal(device), expression)
+				}
+
+				ccdata := []byte("#cloud-config\ninstall:\n  device: \">=1TiB\"\n")
+				Expect(os.WriteFile(filepath.Join(dir, "cc.yaml"), ccdata, os.ModePerm)).To(Succeed())
+				cfg, err := config.ScanNoLogs(collector.Directories([]string{dir}...), collector.NoLogs)
+				Expect(err).ToNot(HaveOccurred())
+				cfg.Fs = fs
+				cfg.Logger = logger
+				_, err = config.ReadInstallSpecFromConfig(cfg)
+				Expect(err).To(MatchError(ContainSubstring("no device matches")))
+			})
 			It("Reads properly the cloud config for reset", func() {
 				bootedFrom = constants.SystemLabel
 				cfg, err := config.ScanNoLogs(collector.Directories([]string{dir}...), collector.NoLogs)
@@ -783,4 +857,77 @@ var _ = Describe("GetSourceSize", Label("GetSourceSize"), func() {
 		Expect(sizeAfter).ToNot(BeZero())
 		Expect(sizeAfter).To(Equal(int64((400 * 1024 * 1024 / 1000 / 1000) + 100)))
 	})
+	It("Calculates the same size walking the dir one by one", func() {
+		Expect(os.MkdirAll(filepath.Join(tempDir, "a", "b"), os.ModePerm)).ToNot(HaveOccurred())
+		Expect(createFileOfSizeInMB(filepath.Join(tempDir, "a", "b", "what.txt"), 10)).ToNot(HaveOccurred())
+		parallel, err := config.EstimateSourceSize(conf, imageSource)
+		Expect(err).ToNot(HaveOccurred())
+
+		sequential := config.NewConfig(config.WithLogger(logger))
+		sequential.SizeWorkers = 1
+		estimation, err := config.EstimateSourceSize(sequential, imageSource)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(estimation.Raw).To(Equal(parallel.Raw))
+		Expect(estimation.Raw).To(Equal(int64(210 * 1024 * 1024)))
+	})
+	It("Reuses the size calculated for the same source", func() {
+		Expect(os.Mkdir(filepath.Join(tempDir, "a"), os.ModePerm)).ToNot(HaveOccurred())
+		sizeBefore, err := config.GetSourceSize(conf, imageSource)
+		Expect(err).ToNot(HaveOccurred())
+
+		// Changes deep in the tree don't change the identity of the source
+		Expect(createFileOfSizeInMB(filepath.Join(tempDir, "a", "what.txt"), 200)).ToNot(HaveOccurred())
+		sizeAfter, err := config.GetSourceSize(conf, imageSource)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sizeAfter).To(Equal(sizeBefore))
+
+		// But a different config calculates it again
+		sizeAfter, err = config.GetSourceSize(config.NewConfig(config.WithLogger(logger)), imageSource)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sizeAfter).ToNot(Equal(sizeBefore))
+	})
+	It("Reports the raw size and the derived partition sizes", func() {
+		estimation, err := config.EstimateSourceSize(conf, imageSource)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(estimation.Raw).To(Equal(int64(200 * 1024 * 1024)))
+		Expect(estimation.Factor).To(Equal(1.0))
+		Expect(estimation.Size).To(Equal(int64((200 * 1024 * 1024 / 1000 / 1000) + 100)))
+
+		estimation.DerivePartitions()
+		size := uint(estimation.Size)
+		Expect(estimation.Partitions).To(HaveKeyWithValue(constants.RecoveryLabel, size*2+200))
+		Expect(estimation.Partitions).To(HaveKeyWithValue(constants.StateLabel, size*3+1000))
+		Expect(estimation.Partitions).To(HaveKeyWithValue(constants.OEMLabel, uint(constants.OEMSize)))
+		Expect(estimation.Partitions).To(HaveKeyWithValue(constants.PersistentLabel, uint(0)))
+	})
+	It("Reports the size of the images in the container runtime stores", func() {
+		runner := v1mock.NewFakeRunner()
+		runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+			if cmd == "ctr" {
+				return []byte("REF                                    TYPE                                                 DIGEST                                                                  SIZE      PLATFORMS   LABELS\n" +
+					"quay.io/kairos/opensuse:v3.2.1         application/vnd.oci.image.index.v1+json              sha256:0e32ea5b5d7e0ffd5bd82a6e63afd2a1f6b8c0a9f0e4d2b0f0e5e7f4d3c2b1a0 512.0 MiB linux/amd64 -\n"), nil
+			}
+			return []byte("1073741824\n"), nil
+		}
+		conf.Runner = runner
+		src, err := v1.NewSrcFromURI("containerd:quay.io/kairos/opensuse:v3.2.1")
+		Expect(err).ToNot(HaveOccurred())
+		estimation, err := config.EstimateSourceSize(conf, src)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(estimation.Raw).To(Equal(int64(512 * 1024 * 1024)))
+		Expect(estimation.Factor).To(Equal(2.5))
+
+		src, err = v1.NewSrcFromURI("podman:quay.io/kairos/opensuse:v3.2.1")
+		Expect(err).ToNot(HaveOccurred())
+		estimation, err = config.EstimateSourceSize(conf, src)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(estimation.Raw).To(Equal(int64(1024 * 1024 * 1024)))
+		Expect(estimation.Factor).To(Equal(1.0))
+		Expect(runner.IncludesCmds([][]string{{"podman", "image", "inspect", "--format", "{{.Size}}", "quay.io/kairos/opensuse:v3.2.1"}})).To(BeNil())
+
+		src, err = v1.NewSrcFromURI("containerd:quay.io/kairos/other:v3.2.1")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = config.EstimateSourceSize(conf, src)
+		Expect(err).To(MatchError(ContainSubstring("not found in the containerd store")))
+	})
 })
@@ -0,0 +1,191 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultUpgradeWindowDuration = time.Hour
+	defaultUpgradeCheckInterval  = 15 * time.Minute
+	// cronSearchLimit bounds the search of the next time a schedule matches, so impossible dates like Feb 30 end
+	cronSearchLimit = 5 * 366 * 24 * time.Hour
+)
+
+// Upgrade are the upgrade settings used by the agent itself. The rest of the upgrade key is read into the upgrade spec.
+type Upgrade struct {
+	Window *UpgradeWindow `yaml:"window,omitempty" mapstructure:"window"`
+}
+
+// UpgradeWindow is the maintenance window the agent upgrades the system in, once it finds a newer release
+type UpgradeWindow struct {
+	// Schedule is when the window opens, as a cron expression: minute hour day-of-month month day-of-week
+	Schedule string `yaml:"schedule,omitempty" mapstructure:"schedule"`
+	// Duration is how long the window stays open, 1h by default
+	Duration time.Duration `yaml:"duration,omitempty" mapstructure:"duration"`
+	// CheckInterval is the time between the checks for newer releases while the window is open, 15m by default
+	CheckInterval time.Duration `yaml:"check-interval,omitempty" mapstructure:"check-interval"`
+	// Reboot reboots into the upgraded system before the window closes
+	Reboot bool `yaml:"reboot,omitempty" mapstructure:"reboot"`
+	// PreReleases upgrades to pre-releases (rc, beta, alpha) too
+	PreReleases bool `yaml:"pre-releases,omitempty" mapstructure:"pre-releases"`
+}
+
+// Validate checks the schedule and sets the defaults
+func (w *UpgradeWindow) Validate() error {
+	if _, err := ParseCronSchedule(w.Schedule); err != nil {
+		return err
+	}
+	if w.Duration < 0 || w.CheckInterval < 0 {
+		return fmt.Errorf("the duration and check-interval can't be negative")
+	}
+	if w.Duration == 0 {
+		w.Duration = defaultUpgradeWindowDuration
+	}
+	if w.CheckInterval == 0 {
+		w.CheckInterval = defaultUpgradeCheckInterval
+	}
+	return nil
+}
+
+// Open returns whether the window is open at the given time and when it closes if so, otherwise when it opens next.
+// The zero time is returned if the schedule never matches again.
+func (w *UpgradeWindow) Open(t time.Time) (bool, time.Time, error) {
+	schedule, err := ParseCronSchedule(w.Schedule)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	duration := w.Duration
+	if duration == 0 {
+		duration = defaultUpgradeWindowDuration
+	}
+	// The last opening is the first one after the time it would have closed by now
+	if start := schedule.Next(t.Add(-duration)); !start.IsZero() && !start.After(t) {
+		return true, start.Add(duration), nil
+	}
+	return false, schedule.Next(t), nil
+}
+
+// CronSchedule is a parsed cron expression, with the minutes, hours, days of month, months and days of week it
+// matches as bit sets
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// With both days restricted, either of them matches like in cron
+	domAny, dowAny bool
+}
+
+// cronFields are the bounds of each of the fields of a cron expression
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// ParseCronSchedule parses a 5 fields cron expression. The fields take *, values, ranges, steps and comma separated
+// lists of them, i.e. "30 2 * * 6,0" or "0 */6 1-7 * *". Sunday is both 0 and 7.
+func ParseCronSchedule(expr string) (*CronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("invalid schedule %q, expected 5 fields: minute hour day-of-month month day-of-week", expr)
+	}
+	sets := make([]uint64, len(fields))
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s in schedule %q: %w", cronFields[i].name, expr, err)
+		}
+		sets[i] = set
+	}
+	s := &CronSchedule{minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4]}
+	// Sunday
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domAny = fields[2] == "*"
+	s.dowAny = fields[4] == "*"
+	return s, nil
+}
+
+// parseCronField returns the set of values of a single field
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rng = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+		from, to := min, max
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			bounds := strings.SplitN(rng, "-", 2)
+			var err1, err2 error
+			from, err1 = strconv.Atoi(bounds[0])
+			to, err2 = strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+		default:
+			v, err := strconv.Atoi(rng)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", rng)
+			}
+			from = v
+			// A single value with a step runs up to the max, like cron does
+			if step == 1 {
+				to = v
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("%q is out of the %d-%d range", part, min, max)
+		}
+		for v := from; v <= to; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// matchesDay returns whether the schedule matches the day of the given time
+func (s *CronSchedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first minute after the given time the schedule matches, or the zero time if there is none in
+// the next years
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	limit := t.Add(cronSearchLimit)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// DefaultWebUISocketMode is the permissions of the webui unix socket if none are set
+const DefaultWebUISocketMode = 0660
+
+// WebUI sets where the webui installer listens. It's read from the agent config, /etc/kairos/agent.yaml, and
+// from the `webui` block of the cloud config, which takes precedence.
+type WebUI struct {
+	Disable bool `yaml:"disable,omitempty" mapstructure:"disable"`
+	// ListenAddress is the TCP address to listen on, DefaultWebUIListenAddress if neither it nor Socket are set
+	ListenAddress string `yaml:"listen_address,omitempty" mapstructure:"listen_address"`
+	// Socket is the path of a unix socket to listen on, instead of or next to the TCP address
+	Socket string `yaml:"socket,omitempty" mapstructure:"socket"`
+	// SocketMode is the octal permissions of the socket, DefaultWebUISocketMode if not set
+	SocketMode string `yaml:"socket_mode,omitempty" mapstructure:"socket_mode"`
+	// SocketGroup is the group owning the socket, so its members can reach the webui without root
+	SocketGroup string `yaml:"socket_group,omitempty" mapstructure:"socket_group"`
+}
+
+// HasAddress returns true if a TCP address is set
+func (w WebUI) HasAddress() bool {
+	return w.ListenAddress != ""
+}
+
+// Address returns the TCP address to listen on, empty if only the unix socket is to be used
+func (w WebUI) Address() string {
+	if w.ListenAddress == "" && w.Socket == "" {
+		return DefaultWebUIListenAddress
+	}
+	return w.ListenAddress
+}
+
+// Mode returns the permissions of the unix socket
+func (w WebUI) Mode() (uint32, error) {
+	if w.SocketMode == "" {
+		return DefaultWebUISocketMode, nil
+	}
+	mode, err := strconv.ParseUint(w.SocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid webui socket_mode %q, it has to be octal permissions like 0660", w.SocketMode)
+	}
+	return uint32(mode), nil
+}
+
+// Override returns the webui settings with the ones set in o on top
+func (w WebUI) Override(o *WebUI) WebUI {
+	if o == nil {
+		return w
+	}
+	w.Disable = w.Disable || o.Disable
+	if o.ListenAddress != "" {
+		w.ListenAddress = o.ListenAddress
+	}
+	if o.Socket != "" {
+		w.Socket = o.Socket
+	}
+	if o.SocketMode != "" {
+		w.SocketMode = o.SocketMode
+	}
+	if o.SocketGroup != "" {
+		w.SocketGroup = o.SocketGroup
+	}
+	return w
+}
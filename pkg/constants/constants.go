@@ -19,11 +19,20 @@ package constants
 import (
 	"errors"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/gofrs/uuid"
 )
 
+// OEMRecordsDir keeps the agent records needed on every boot. They are not named .yaml, as the OEM partition is
+// walked for cloud-configs and a record which is not a valid one stops the boot stages from loading.
+const OEMRecordsDir = "/oem/.kairos"
+
+// SpareLabelSuffix is appended to the filesystem labels of a cloned disk, so they don't clash with the source disk
+// ones. It's short enough for the longest labels to still fit in a vfat or ext4 label.
+const SpareLabelSuffix = "_S"
+
 const (
 	GrubConf                     = "/etc/cos/grub.cfg"
 	GrubOEMEnv                   = "grub_oem_env"
@@ -40,12 +49,58 @@ const (
 	StateLabel                   = "COS_STATE"
 	StatePartName                = "state"
 	InstallStateFile             = "state.yaml"
+	PinFile                      = OEMRecordsDir + "/pin.state"
+	RegistryPinsFile             = OEMRecordsDir + "/registry-pins.state"
+	ReenrollCredentialsFile      = "/oem/.kairos-reenroll-credentials"
+	GPGKeyringsDir               = "/oem/keyrings"
+	GPGSignatureExt              = ".asc"
+	SignatureCosign              = "cosign"
+	SignatureGPG                 = "gpg"
+	OEMBackupFile                = "/usr/local/.kairos/oem-backup.tar.gz"
+	RecoveryJobFile              = "/usr/local/.kairos/recovery-job.yaml"
+	RecoveryJobStageFile         = "/oem/91_kairos-recovery-job.yaml"
+	SmokeTestsFile               = "/usr/local/.kairos/smoke-tests.yaml"
+	SmokeTestsStageFile          = "/oem/91_kairos-smoke-tests.yaml"
+	PermissionsAuditFile         = "/usr/local/.kairos/permissions-audit.yaml"
+	LayoutBackupDir              = "/usr/local/.kairos/layout-backup"
+	SysextStoreDir               = "/var/lib/kairos/extensions"
+	SysextsCarryOver             = "carry-over"
+	SysextsNone                  = "none"
+	HardwareCheckWarn            = "warn"
+	HardwareCheckStrict          = "strict"
+	HardwareCheckOff             = "off"
+	WatchdogFile                 = OEMRecordsDir + "/watchdog.state"
+	WatchdogStageFile            = "/oem/91_kairos-watchdog.yaml"
+	UpgradeTransactionFile       = OEMRecordsDir + "/upgrade-transaction.state"
+	UpgradeTransactionStageFile  = "/oem/91_kairos-upgrade-transaction.yaml"
+	WatchdogActionFallback       = "fallback"
+	WatchdogActionReset          = "reset"
+	WatchdogActionNone           = "none"
+	WatchdogDefaultMaxBoots      = 3
+	ImmucoreLogDir               = "/run/immucore"
+	UpgradeApprovalCacheFile     = "/usr/local/.kairos/upgrade-approval.yaml"
+	ReleasesCacheFile            = "/usr/local/.kairos/releases-cache.yaml"
+	ReferrersDir                 = "/usr/local/.kairos/referrers"
+	ReferrersFile                = "referrers.yaml"
+	UpgradeApprovalOfflineDeny   = "deny"
+	UpgradeApprovalOfflineAllow  = "allow"
 	PersistentLabel              = "COS_PERSISTENT"
 	PersistentPartName           = "persistent"
 	OEMLabel                     = "COS_OEM"
 	OEMPartName                  = "oem"
 	MountBinary                  = "/usr/bin/mount"
 	EfiDevice                    = "/sys/firmware/efi"
+	EfivarsDir                   = "/sys/firmware/efi/efivars"
+	LoaderEntryDefaultEfivar     = "LoaderEntryDefault-4a67b082-0a4c-41cf-b6c7-440b29bb8c4f"
+	CgroupRoot                   = "/sys/fs/cgroup"
+	UpgradeCgroup                = "kairos-upgrade"
+	UnitProcsCgroup              = "kairos-unit"
+	IOClassIdle                  = "idle"
+	IOClassBestEffort            = "best-effort"
+	IOClassRealtime              = "realtime"
+	LowMemoryThreshold           = 2048
+	LowTmpThreshold              = 3072
+	LowMemoryGCPercent           = 20
 	LinuxFs                      = "ext4"
 	LinuxImgFs                   = "ext2"
 	SquashFs                     = "squashfs"
@@ -56,6 +111,20 @@ const (
 	BiosSize                     = uint(1)
 	ImgSize                      = uint(3072)
 	HTTPTimeout                  = 60
+	HTTPRetries                  = 3
+	PartialDownloadSuffix        = ".part"
+	FlashMediaConfigFile         = "80_flash_media.yaml"
+	InstallPlanFile              = ".kairos-install-plan.cloud-config"
+	ScheduleFile                 = OEMRecordsDir + "/schedule.state"
+	ScheduleStageFile            = "/oem/91_kairos-schedule.yaml"
+	HistoryFile                  = "kairos-history.jsonl"
+	DataDiskMountPoint           = "/var/lib/data"
+	DataDiskLabel                = "KAIROS_DATA"
+	VarLibDir                    = "/var/lib"
+	VarLibFile                   = OEMRecordsDir + "/var-lib.state"
+	VarLibPersistent             = "persistent"
+	VarLibEphemeral              = "ephemeral"
+	AcceleratorsFile             = OEMRecordsDir + "/accelerators.state"
 	LiveDir                      = "/run/initramfs/live"
 	RecoveryDir                  = "/run/cos/recovery"
 	StateDir                     = "/run/cos/state"
@@ -110,6 +179,8 @@ const (
 	ArchAmd64  = "amd64"
 	Archx86    = "x86_64"
 	ArchArm64  = "arm64"
+	ArchS390x  = "s390x"
+	ArchPpc64  = "ppc64le"
 	SignedShim = "shim.efi"
 	SignedGrub = "grub.efi"
 	Rsync      = "rsync"
@@ -120,6 +191,33 @@ const (
 	UkiEfiDiskByLabel = `/dev/disk/by-label/` + EfiLabel
 	UkiMaxEntries     = 3
 
+	// PullWorkers is how many image layers are downloaded at once by default
+	PullWorkers = 4
+	// SizeWorkers is how many directories are read at once by default while calculating the size of a dir source
+	SizeWorkers = 4
+
+	// Kernel based bootloaders of the archs without grub
+	ZiplDir          = "zipl"
+	ZiplConf         = "zipl.conf"
+	ZiplConsole      = "ttysclp0"
+	PetitbootDir     = "petitboot"
+	PetitbootConf    = "kboot.conf"
+	PetitbootConsole = "hvc0"
+
+	// Network disks
+	NetworkDiskISCSI   = "iscsi"
+	NetworkDiskNVMeoF  = "nvmeof"
+	ISCSIDefaultPort   = "3260"
+	NVMeoFDefaultPort  = "4420"
+	ISCSIInitiatorFile = "/etc/iscsi/initiatorname.iscsi"
+	NVMeHostNQNFile    = "/etc/nvme/hostnqn"
+	// NetworkDiskCredentialsConf is the dracut config adding the network disk credentials to the initramfs
+	NetworkDiskCredentialsConf = "/etc/dracut.conf.d/90-kairos-network-disk.conf"
+
+	// Config signing
+	ConfigSigningKeyFile = "/etc/kairos/config-signing.pem"
+	SignatureExt         = ".sig"
+
 	// Boot labeling
 	PassiveBootSuffix    = " (fallback)"
 	RecoveryBootSuffix   = " recovery"
@@ -139,6 +237,13 @@ func UkiDefaultSkipEntries() []string {
 	return []string{"interactive-install", "install-mode-interactive"}
 }
 
+// GetInstallMediaConfigDirs returns the directories where the install media might carry user
+// configuration, like the live media root or the /oem dir where datasources (e.g. NoCloud seeds) are written
+// to. They are in the same priority order as GetUserConfigDirs so later files override earlier ones.
+func GetInstallMediaConfigDirs() []string {
+	return []string{LiveDir, OEMPath}
+}
+
 func GetCloudInitPaths() []string {
 	return []string{"/system/oem", "/oem/", "/usr/local/cloud-config/"}
 }
@@ -175,7 +280,7 @@ func GetGrubModules() []string {
 // live. These include the directories were we store our system overlay files:
 // https://github.com/kairos-io/packages/tree/main/packages/static/kairos-overlay-files/files/system/oem
 func GetYipConfigDirs() []string {
-	return append(GetUserConfigDirs(), "/system/oem")
+	return append(GetUserConfigDirs(), InRoot("/system/oem"))
 }
 
 // GetUserConfigDirs returns all the directories that might have configuration
@@ -183,14 +288,55 @@ func GetYipConfigDirs() []string {
 // baked-in configuration (e.g. in livecd, under /run/initramfs/live) with
 // configuration coming from datasource (e.g. a datasource cdrom, written under /oem).
 // That's why writable paths are last.
+// They are under the root set with SetRoot, if any.
 func GetUserConfigDirs() []string {
-	return []string{
+	dirs := []string{
 		"/run/initramfs/live",
 		"/etc/kairos",    // Default system configuration file https://github.com/kairos-io/kairos/issues/2221
 		"/etc/elemental", // for backwards compatibility
 		"/usr/local/cloud-config",
 		"/oem",
 	}
+	for i, d := range dirs {
+		dirs[i] = InRoot(d)
+	}
+	return dirs
+}
+
+// root is where the system the agent operates on is mounted, / unless set with the --root flag
+var root = "/"
+
+// SetRoot sets where the system the agent operates on is mounted, i.e. /mnt when running from a rescue environment
+func SetRoot(dir string) {
+	if dir == "" {
+		dir = "/"
+	}
+	root = filepath.Clean(dir)
+}
+
+// GetRoot returns where the system the agent operates on is mounted
+func GetRoot() string {
+	return root
+}
+
+// HasRoot reports if the agent operates on a system mounted at an alternative root
+func HasRoot() bool {
+	return root != "/"
+}
+
+// InRoot returns the host path of the given path of the system the agent operates on
+func InRoot(path string) string {
+	return filepath.Join(root, path)
+}
+
+// FromRoot returns the path in the system the agent operates on of the given host path, false if it's not under
+// the root
+func FromRoot(path string) (string, bool) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return path, false
+	}
+	return filepath.Join("/", rel), true
 }
 
 func BaseBootTitle(title string) string {
@@ -23,3 +23,33 @@ var _ = Describe("Replace title", func() {
 		Entry("When setting to recovery with a recovery title", "recovery", "My awesome OS recovery", "My awesome OS recovery"),
 	)
 })
+
+var _ = Describe("Alternative root", func() {
+	AfterEach(func() {
+		constants.SetRoot("")
+	})
+	It("has the paths under the root", func() {
+		Expect(constants.HasRoot()).To(BeFalse())
+		Expect(constants.GetUserConfigDirs()).To(ContainElement("/oem"))
+
+		constants.SetRoot("/mnt/")
+		Expect(constants.HasRoot()).To(BeTrue())
+		Expect(constants.GetRoot()).To(Equal("/mnt"))
+		Expect(constants.GetUserConfigDirs()).To(ContainElement("/mnt/oem"))
+		Expect(constants.GetYipConfigDirs()).To(ContainElement("/mnt/system/oem"))
+		Expect(constants.InRoot("/etc/kairos")).To(Equal("/mnt/etc/kairos"))
+	})
+	It("maps host paths to the system ones", func() {
+		constants.SetRoot("/mnt")
+		path, ok := constants.FromRoot("/mnt/efi")
+		Expect(ok).To(BeTrue())
+		Expect(path).To(Equal("/efi"))
+		path, ok = constants.FromRoot("/mnt")
+		Expect(ok).To(BeTrue())
+		Expect(path).To(Equal("/"))
+		_, ok = constants.FromRoot("/mntx/efi")
+		Expect(ok).To(BeFalse())
+		_, ok = constants.FromRoot("/boot/efi")
+		Expect(ok).To(BeFalse())
+	})
+})
@@ -17,12 +17,21 @@ limitations under the License.
 package elemental
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/kairos-io/kairos-sdk/types"
+	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	diskfs "github.com/diskfs/go-diskfs/disk"
 	"github.com/diskfs/go-diskfs/partition/gpt"
@@ -33,17 +42,88 @@ import (
 	"github.com/kairos-io/kairos-agent/v2/pkg/utils"
 	"github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
 	"github.com/kairos-io/kairos-agent/v2/pkg/utils/loop"
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// deployVerifySamples chunks of deployVerifySampleSize bytes are compared when verifying a deployed image
+	deployVerifySamples    = 16
+	deployVerifySampleSize = 1024 * 1024
 )
 
 // Elemental is the struct meant to self-contain most utils and actions related to Elemental, like installing or applying selinux
 type Elemental struct {
-	config *agentConfig.Config
+	config          *agentConfig.Config
+	downloadTimeout time.Duration
+	ctx             context.Context
+	checkBootable   bool
+	delta           *deltaBase
+	singleSync      bool
+}
+
+// deltaBase is the image file the OCI images are deployed over in delta mode and the layers it was deployed from
+type deltaBase struct {
+	file   string
+	layers []string
 }
 
 func NewElemental(config *agentConfig.Config) *Elemental {
 	return &Elemental{
 		config: config,
+		ctx:    context.Background(),
+	}
+}
+
+// SetContext sets the context long running external commands, like the squashfs image creation, are bound to
+func (e *Elemental) SetContext(ctx context.Context) {
+	e.ctx = ctx
+}
+
+// WithContext returns a copy bound to ctx, so the image pulls and long running commands it starts stop once ctx is
+// done. The actions use it to stop the deployments of the phases which timed out.
+func (e *Elemental) WithContext(ctx context.Context) *Elemental {
+	c := *e
+	c.ctx = ctx
+	return &c
+}
+
+// imageExtractor returns the image extractor of the config, bound to the context and creating its temporary dirs
+// with NewTempDir if it can be
+func (e *Elemental) imageExtractor() v1.ImageExtractor {
+	extractor := e.config.ImageExtractor
+	if withTempDir, ok := extractor.(v1.TempDirImageExtractor); ok {
+		extractor = withTempDir.WithTempDir(func(namespace string) (string, func() error, error) {
+			dir, err := utils.NewTempDir(e.config, namespace)
+			return dir, func() error { return fsutils.RemoveTempDir(e.config.Fs, dir) }, err
+		})
+	}
+	if withContext, ok := extractor.(v1.ContextImageExtractor); ok {
+		extractor = withContext.WithContext(e.ctx)
 	}
+	return extractor
+}
+
+// SetDownloadTimeout bounds the pull of OCI images done by DumpSource, zero means no timeout
+func (e *Elemental) SetDownloadTimeout(timeout time.Duration) {
+	e.downloadTimeout = timeout
+}
+
+// SetBootableCheck enables checking that system images deployed by DeployImage look like a bootable Kairos system
+func (e *Elemental) SetBootableCheck(enabled bool) {
+	e.checkBootable = enabled
+}
+
+// SetDeltaBase deploys the OCI images which are built over the given layers as a delta, by applying only the
+// layers they add over a copy of file. The images not built over them are deployed in full.
+func (e *Elemental) SetDeltaBase(file string, layers []string) {
+	e.delta = &deltaBase{file: file, layers: layers}
+}
+
+// SetSingleSync syncs once after formatting all the partitions in PartitionAndFormatDevice instead of after each of
+// them, to spare writes on flash media
+func (e *Elemental) SetSingleSync(enabled bool) {
+	e.singleSync = enabled
 }
 
 // FormatPartition will format an already existing partition
@@ -52,6 +132,15 @@ func (e *Elemental) FormatPartition(part *types.Partition, opts ...string) error
 	return partitioner.FormatDevice(e.config.Runner, part.Path, part.FS, part.FilesystemLabel, opts...)
 }
 
+// FormatTunedPartition formats an already existing partition with the given filesystem tuning, if any
+func (e *Elemental) FormatTunedPartition(part *types.Partition, tuning *v1.FilesystemTuning) error {
+	err := e.FormatPartition(part, tuning.MkfsOptions(part.FS)...)
+	if err != nil {
+		return err
+	}
+	return partitioner.TuneDevice(e.config.Runner, part.Path, part.FS, tuning)
+}
+
 // PartitionAndFormatDevice creates a new empty partition table on target disk
 // and applies the configured disk layout by creating and formatting all
 // required partitions
@@ -61,7 +150,7 @@ func (e *Elemental) PartitionAndFormatDevice(i v1.SharedInstallSpec) error {
 		return fmt.Errorf("disk %s does not exist", i.GetTarget())
 	}
 
-	disk, err := partitioner.NewDisk(i.GetTarget(), partitioner.WithLogger(e.config.Logger))
+	disk, err := partitioner.NewDisk(i.GetTarget(), partitioner.WithLogger(e.config.Logger), partitioner.WithArch(i.GetArch()))
 	if err != nil {
 		return err
 	}
@@ -121,15 +210,26 @@ func (e *Elemental) PartitionAndFormatDevice(i v1.SharedInstallSpec) error {
 				if err != nil {
 					e.config.Logger.Errorf("Failed finding partition %s by partition label: %s", configPart.FilesystemLabel, err)
 				}
-				err = partitioner.FormatDevice(e.config.Runner, device, configPart.FS, configPart.FilesystemLabel)
+				tuning := i.GetPartitionTuning()[configPart.Name]
+				err = partitioner.FormatDevice(e.config.Runner, device, configPart.FS, configPart.FilesystemLabel, tuning.MkfsOptions(configPart.FS)...)
 				if err != nil {
 					e.config.Logger.Errorf("Failed formatting partition: %s", err)
 					return err
 				}
-				syscall.Sync()
+				err = partitioner.TuneDevice(e.config.Runner, device, configPart.FS, tuning)
+				if err != nil {
+					e.config.Logger.Errorf("Failed tuning partition: %s", err)
+					return err
+				}
+				if !e.singleSync {
+					syscall.Sync()
+				}
 			}
 		}
 	}
+	if e.singleSync {
+		syscall.Sync()
+	}
 	return nil
 }
 
@@ -297,8 +397,11 @@ func (e Elemental) CreateFileSystemImage(img *v1.Image) error {
 		return err
 	}
 
-	mkfs := partitioner.NewMkfsCall(img.File, img.FS, img.Label, e.config.Runner)
+	mkfs := partitioner.NewMkfsCall(img.File, img.FS, img.Label, e.config.Runner, img.Tuning.MkfsOptions(img.FS)...)
 	_, err = mkfs.Apply()
+	if err == nil {
+		err = partitioner.TuneDevice(e.config.Runner, img.File, img.FS, img.Tuning)
+	}
 	if err != nil {
 		_ = e.config.Fs.RemoveAll(img.File)
 		return err
@@ -325,35 +428,68 @@ func (e *Elemental) DeployImageNodirs(img *v1.Image, leaveMounted bool) (info in
 // Set createDirStructure to create the directory structure in the target, which creates the expected dirs
 // for a running system. This is so we can reuse this method for creating random images, not only system ones
 func (e *Elemental) deployImage(img *v1.Image, leaveMounted, createDirStructure bool) (info interface{}, err error) {
+	// Directory sources are checked before deploying anything, OCI images once extracted
+	checkBootable := e.checkBootable && createDirStructure
+	if checkBootable && img.Source.IsDir() {
+		if err = e.CheckBootable(img.Source.Value()); err != nil {
+			return nil, err
+		}
+	}
 	target := img.MountPoint
-	if !img.Source.IsFile() {
+	delta := false
+	// S3 sources are image files too, downloaded instead of copied
+	fileSource := img.Source.IsFile() || img.Source.IsS3()
+	if !fileSource {
 		if img.FS != cnst.SquashFs {
-			err = e.CreateFileSystemImage(img)
+			info, delta, err = e.deployDelta(img)
 			if err != nil {
 				return nil, err
 			}
+			if !delta {
+				err = e.CreateFileSystemImage(img)
+				if err != nil {
+					return nil, err
+				}
 
-			err = e.MountImage(img, "rw")
-			if err != nil {
-				return nil, err
+				err = e.MountImage(img, "rw")
+				if err != nil {
+					return nil, err
+				}
 			}
 		} else {
-			target = utils.GetTempDir(e.config, "")
-			err := fsutils.MkdirAll(e.config.Fs, target, cnst.DirPerm)
+			target, err = utils.NewTempDir(e.config, "deploy")
 			if err != nil {
 				return nil, err
 			}
-			defer e.config.Fs.RemoveAll(target) // nolint:errcheck
+			defer fsutils.RemoveTempDir(e.config.Fs, target) // nolint:errcheck
 		}
 	} else {
 		target = img.File
 	}
-	info, err = e.DumpSource(target, img.Source)
-	if err != nil {
+	if !delta {
+		info, err = e.DumpSource(target, img.Source)
+		if err != nil {
+			_ = e.UnmountImage(img)
+			return nil, err
+		}
+	}
+	if err = fsutils.CheckTempDirQuota(e.config.Fs, target); err != nil {
 		_ = e.UnmountImage(img)
 		return nil, err
 	}
-	if !img.Source.IsFile() {
+	if checkBootable && (img.Source.IsDocker() || img.Source.IsTarball()) {
+		if err = e.CheckBootable(target); err != nil {
+			_ = e.UnmountImage(img)
+			return nil, err
+		}
+	}
+	if e.config.PermissionsAudit != nil && !fileSource {
+		if err = e.AuditPermissions(img, target); err != nil {
+			_ = e.UnmountImage(img)
+			return nil, err
+		}
+	}
+	if !fileSource {
 		if createDirStructure {
 			err = utils.CreateDirStructure(e.config.Fs, target)
 			if err != nil {
@@ -361,8 +497,13 @@ func (e *Elemental) deployImage(img *v1.Image, leaveMounted, createDirStructure
 			}
 		}
 		if img.FS == cnst.SquashFs {
-			squashOptions := append(cnst.GetDefaultSquashfsOptions(), e.config.SquashFsCompressionConfig...)
-			err = utils.CreateSquashFS(e.config.Runner, e.config.Logger, target, img.File, squashOptions)
+			e.config.Logger.Infof("Creating squashfs image %s", img.File)
+			err = utils.CreateSquashFSWithProgress(e.ctx, e.config.Runner, e.config.Logger, target, img.File, utils.SquashfsOptions(e.config), func(pct int) {
+				// Avoid flooding the logs, the progress changes on every percent
+				if pct%10 == 0 {
+					e.config.Logger.Infof("Creating squashfs image %s: %d%%", img.File, pct)
+				}
+			})
 			if err != nil {
 				return nil, err
 			}
@@ -375,7 +516,7 @@ func (e *Elemental) deployImage(img *v1.Image, leaveMounted, createDirStructure
 			return nil, err
 		}
 	}
-	if leaveMounted && img.Source.IsFile() {
+	if leaveMounted && fileSource {
 		err = e.MountImage(img, "rw")
 		if err != nil {
 			return nil, err
@@ -386,38 +527,390 @@ func (e *Elemental) deployImage(img *v1.Image, leaveMounted, createDirStructure
 		if err != nil {
 			return nil, err
 		}
+		if err = e.SyncImage(img); err != nil {
+			return nil, err
+		}
 	}
 	return info, nil
 }
 
+// SyncImage flushes the deployed image file to disk, so a power cut right after switching to it does not leave
+// a corrupted image behind. With verify-deploy enabled, sampled chunks of the image are read back from the disk
+// once flushed and compared with the written data.
+func (e *Elemental) SyncImage(img *v1.Image) error {
+	var written [][]byte
+	var err error
+	if e.config.VerifyDeploy {
+		// The written data is still in the page cache, sample it before it is evicted
+		written, err = e.sampleImage(img.File)
+		if err != nil {
+			return fmt.Errorf("sampling %s: %w", img.File, err)
+		}
+	}
+	if err = fsutils.SyncFile(e.config.Fs, img.File); err != nil {
+		return fmt.Errorf("syncing %s: %w", img.File, err)
+	}
+	if !e.config.VerifyDeploy {
+		return nil
+	}
+
+	f, err := e.config.Fs.OpenFile(img.File, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	// Drop the now clean pages from the cache so the samples are read back from the disk
+	err = unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+	_ = f.Close()
+	if err != nil {
+		e.config.Logger.Warnf("Could not drop %s from the page cache, verifying it from the cache: %s", img.File, err)
+	}
+	read, err := e.sampleImage(img.File)
+	if err != nil {
+		return fmt.Errorf("reading back %s: %w", img.File, err)
+	}
+	for i := range written {
+		if i >= len(read) || !bytes.Equal(written[i], read[i]) {
+			return fmt.Errorf("verification of %s failed, the data read back from disk does not match the written data", img.File)
+		}
+	}
+	e.config.Logger.Infof("Verified %d samples of %s", len(written), img.File)
+	return nil
+}
+
+// sampleImage returns the sha256 of deployVerifySamples chunks evenly spread over the given file
+func (e *Elemental) sampleImage(file string) ([][]byte, error) {
+	f, err := e.config.Fs.OpenFile(file, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var sums [][]byte
+	buf := make([]byte, deployVerifySampleSize)
+	step := info.Size() / deployVerifySamples
+	for i := int64(0); i < deployVerifySamples; i++ {
+		n, err := f.ReadAt(buf, i*step)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		sum := sha256.Sum256(buf[:n])
+		sums = append(sums, sum[:])
+		if step == 0 {
+			break
+		}
+	}
+	return sums, nil
+}
+
+// AuditPermissions runs the permissions audit over the system tree of the image being deployed. The findings are
+// logged and the report is kept in constants.PermissionsAuditFile for `kairos-agent doctor`, keyed by the image label.
+// In strict mode any finding fails the deployment.
+func (e *Elemental) AuditPermissions(img *v1.Image, root string) error {
+	e.config.Logger.Infof("Auditing the permissions of %s", img.Source.Value())
+	report, err := e.config.PermissionsAudit.Audit(e.config.Fs, root)
+	if err != nil {
+		return fmt.Errorf("auditing the permissions of %s: %w", img.Source.Value(), err)
+	}
+	report.Root = img.Source.Value()
+	for _, f := range report.Findings {
+		e.config.Logger.Warnf("Permissions audit: %s (%s): %s", f.Path, f.Mode, f.Detail)
+	}
+
+	name := img.Label
+	if name == "" {
+		name = filepath.Base(img.File)
+	}
+	reports := map[string]*v1.PermissionsReport{}
+	if data, err := e.config.Fs.ReadFile(cnst.PermissionsAuditFile); err == nil {
+		_ = yaml.Unmarshal(data, &reports)
+	}
+	reports[name] = report
+	data, err := yaml.Marshal(reports)
+	if err == nil {
+		err = fsutils.MkdirAll(e.config.Fs, filepath.Dir(cnst.PermissionsAuditFile), cnst.DirPerm)
+	}
+	if err == nil {
+		err = fsutils.AtomicWriteFile(e.config.Fs, cnst.PermissionsAuditFile, data, cnst.FilePerm)
+	}
+	if err != nil {
+		e.config.Logger.Warnf("Could not store the permissions audit report: %s", err)
+	}
+
+	if e.config.PermissionsAudit.Strict && len(report.Findings) > 0 {
+		return fmt.Errorf("the permissions audit of %s has %d findings", img.Source.Value(), len(report.Findings))
+	}
+	return nil
+}
+
+// CheckImagePolicy evaluates the configured image policy against the given image metadata
+func (e *Elemental) CheckImagePolicy(imageRef string) error {
+	e.config.Logger.Infof("Checking image policy for %s", imageRef)
+	// Check the registry first, so no request is sent to a registry that is not allowed
+	err := e.config.ImagePolicy.CheckRegistry(imageRef)
+	if err != nil {
+		return err
+	}
+	meta, err := e.config.ImageExtractor.GetOCIImageMetadata(imageRef, e.config.Platform.String())
+	if err != nil {
+		return fmt.Errorf("getting image metadata for the image policy: %w", err)
+	}
+	// Referrers are another request to the registry, only done if the policy needs them
+	if len(e.config.ImagePolicy.RequiredAttestations) > 0 {
+		if extractor, ok := e.config.ImageExtractor.(v1.ReferrersImageExtractor); ok {
+			_, meta.Referrers, err = extractor.GetOCIImageReferrers(imageRef, e.config.Platform.String())
+			if err != nil {
+				return fmt.Errorf("getting image referrers for the image policy: %w", err)
+			}
+		}
+	}
+	return e.config.ImagePolicy.Check(imageRef, *meta, time.Now())
+}
+
+// referrersRecord is the record of the artifacts stored for an image
+type referrersRecord struct {
+	Image     string           `yaml:"image"`
+	Digest    string           `yaml:"digest"`
+	Fetched   time.Time        `yaml:"fetched"`
+	Referrers []v1.OCIReferrer `yaml:"referrers,omitempty"`
+}
+
+// StoreReferrers pulls the artifacts referring to the image, like SBOMs or attestations, into the referrers dir
+// under the image digest, next to a record listing them
+func (e *Elemental) StoreReferrers(imageRef string) error {
+	extractor, ok := e.config.ImageExtractor.(v1.ReferrersImageExtractor)
+	if !ok {
+		return fmt.Errorf("the image extractor can't find referrers")
+	}
+	digest, referrers, err := extractor.GetOCIImageReferrers(imageRef, e.config.Platform.String())
+	if err != nil {
+		return err
+	}
+	dir := e.config.Referrers.Dir
+	if dir == "" {
+		dir = cnst.ReferrersDir
+	}
+	dir = filepath.Join(dir, strings.ReplaceAll(digest, ":", "-"))
+	if err = fsutils.MkdirAll(e.config.Fs, dir, cnst.DirPerm); err != nil {
+		return err
+	}
+
+	record := referrersRecord{Image: imageRef, Digest: digest, Fetched: time.Now()}
+	for _, r := range referrers {
+		if len(e.config.Referrers.ArtifactTypes) > 0 && !slices.ContainsFunc(e.config.Referrers.ArtifactTypes, r.MatchesArtifactType) {
+			continue
+		}
+		blobs, err := extractor.GetOCIReferrerBlobs(imageRef, r)
+		if err != nil {
+			return fmt.Errorf("pulling referrer %s: %w", r.Digest, err)
+		}
+		for i, blob := range blobs {
+			file := fmt.Sprintf("%s.%d", strings.ReplaceAll(r.Digest, ":", "-"), i)
+			if err = e.config.Fs.WriteFile(filepath.Join(dir, file), blob, cnst.FilePerm); err != nil {
+				return err
+			}
+			r.Files = append(r.Files, file)
+		}
+		e.config.Logger.Infof("Stored the %s referrer %s of %s", r.ArtifactType, r.Digest, imageRef)
+		record.Referrers = append(record.Referrers, r)
+	}
+	data, err := yaml.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return e.config.Fs.WriteFile(filepath.Join(dir, cnst.ReferrersFile), data, cnst.FilePerm)
+}
+
+// bootableChecks are the parts a bootable system tree has, found if any of the paths matches
+var bootableChecks = []struct {
+	name  string
+	globs []string
+}{
+	{"kernel", []string{"boot/vmlinuz*", "boot/Image*", "boot/vmlinux*"}},
+	{"initrd", []string{"boot/initrd*", "boot/initramfs*"}},
+	{"init system", []string{"sbin/init", "usr/sbin/init", "usr/lib/systemd/systemd", "lib/systemd/systemd"}},
+}
+
+// CheckBootable inspects a system tree before deploying it, failing if it has no kernel, initrd or init system,
+// which catches sources pointing to application containers instead of Kairos images. Trees without
+// /etc/kairos-release are only warned about, as they can still boot.
+func (e *Elemental) CheckBootable(root string) error {
+	var missing []string
+	for _, check := range bootableChecks {
+		found := false
+		for _, glob := range check.globs {
+			if matches, _ := fsutils.GlobFs(e.config.Fs, filepath.Join(root, glob)); len(matches) > 0 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, check.name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the source does not look like a bootable Kairos image, no %s found. Use --force to deploy it anyway", strings.Join(missing, ", "))
+	}
+	if ok, _ := fsutils.Exists(e.config.Fs, filepath.Join(root, "etc/kairos-release")); !ok {
+		e.config.Logger.Warnf("The source has no /etc/kairos-release, it might not be a Kairos image")
+	}
+	return nil
+}
+
+// verifyDockerSource checks the OCI source against the image policy and its cosign signature, if enabled,
+// and stores its referrers if configured to
+func (e *Elemental) verifyDockerSource(imgSrc *v1.ImageSource) error {
+	if e.config.ImagePolicy != nil {
+		if err := e.CheckImagePolicy(imgSrc.Value()); err != nil {
+			return err
+		}
+	}
+	if e.config.Cosign {
+		e.config.Logger.Infof("Running cosign verification for %s", imgSrc.Value())
+		out, err := utils.CosignVerifyWithOptions(
+			e.config.Fs, e.config.Runner, imgSrc.Value(),
+			utils.CosignOptions{
+				PublicKey:                   e.config.CosignPubKey,
+				CertificateIdentityRegexp:   e.config.Verify.CertificateIdentityRegexp,
+				CertificateOIDCIssuerRegexp: e.config.Verify.CertificateOIDCIssuerRegexp,
+				Offline:                     e.config.Verify.Offline,
+				TrustedRoot:                 e.config.Verify.TrustedRoot,
+				CacheDir:                    e.config.Verify.CacheDir,
+			},
+		)
+		if err != nil {
+			e.config.Logger.Errorf("Cosign verification failed: %s", out)
+			return err
+		}
+	}
+	if e.config.Referrers != nil {
+		if err := e.StoreReferrers(imgSrc.Value()); err != nil {
+			e.config.Logger.Warnf("Could not store the referrers of %s: %s", imgSrc.Value(), err)
+		}
+	}
+	return nil
+}
+
+// deployDelta deploys an OCI image built over the layers of the delta base by copying the base image file and
+// applying only the layers the image adds. The image is left mounted at its mount point. It returns false, leaving
+// nothing behind, when the image can't be deployed as a delta and has to be deployed in full.
+// Changes done to the base image after it was deployed, like a regenerated initrd, are kept unless the new layers
+// replace them.
+func (e *Elemental) deployDelta(img *v1.Image) (info interface{}, delta bool, err error) {
+	if e.delta == nil || !img.Source.IsDocker() {
+		return nil, false, nil
+	}
+	extractor, ok := e.imageExtractor().(v1.LayeredImageExtractor)
+	if !ok {
+		return nil, false, nil
+	}
+	fallback := func(reason string, args ...interface{}) (interface{}, bool, error) {
+		e.config.Logger.Warnf("Not deploying %s as a delta, pulling the whole image: %s", img.Source.Value(), fmt.Sprintf(reason, args...))
+		_ = e.UnmountImage(img)
+		_ = e.config.Fs.RemoveAll(img.File)
+		return nil, false, nil
+	}
+
+	if err = e.verifyDockerSource(img.Source); err != nil {
+		return nil, false, err
+	}
+	meta, err := extractor.GetOCIImageLayers(img.Source.Value(), e.config.Platform.String())
+	if err != nil || meta == nil {
+		return fallback("could not get its layers: %v", err)
+	}
+	base := e.delta.layers
+	if len(base) == 0 || len(base) > len(meta.Layers) || !slices.Equal(base, meta.Layers[:len(base)]) {
+		return fallback("it is not built over the layers of %s", e.delta.file)
+	}
+	e.config.Logger.Infof("Deploying %s as a delta over %s, %d of its %d layers are new", img.Source.Value(), e.delta.file, len(meta.Layers)-len(base), len(meta.Layers))
+
+	if err = fsutils.MkdirAll(e.config.Fs, filepath.Dir(img.File), cnst.DirPerm); err != nil {
+		return fallback("%s", err)
+	}
+	if err = utils.CopyFile(e.config.Fs, e.delta.file, img.File); err != nil {
+		return fallback("copying %s: %s", e.delta.file, err)
+	}
+	// The target image might need more room than the base one
+	if st, err := e.config.Fs.Stat(img.File); err == nil && st.Size() < int64(img.Size*1024*1024) {
+		if err = e.config.Fs.Truncate(img.File, int64(img.Size*1024*1024)); err != nil {
+			return fallback("%s", err)
+		}
+		if out, err := e.config.Runner.Run("e2fsck", "-fy", img.File); err != nil {
+			return fallback("checking %s: %s", img.File, out)
+		}
+		if out, err := e.config.Runner.Run("resize2fs", img.File); err != nil {
+			return fallback("resizing %s: %s", img.File, out)
+		}
+	}
+	if img.Label != "" {
+		if out, err := e.config.Runner.Run("tune2fs", "-L", img.Label, img.File); err != nil {
+			return fallback("labeling %s: %s", img.File, out)
+		}
+	}
+	if err = e.MountImage(img, "rw"); err != nil {
+		return fallback("%s", err)
+	}
+	err = utils.NewDeadline(0).WithContext(e.ctx).Run(fmt.Sprintf("downloading %s", img.Source.Value()), e.downloadTimeout, func(ctx context.Context) error {
+		extractor, _ := e.WithContext(ctx).imageExtractor().(v1.LayeredImageExtractor)
+		return extractor.ExtractImageLayers(img.Source.Value(), img.MountPoint, e.config.Platform.String(), len(base))
+	})
+	if err != nil {
+		return fallback("%s", err)
+	}
+	return meta, true, nil
+}
+
 // DumpSource sets the image data according to the image source type
 func (e *Elemental) DumpSource(target string, imgSrc *v1.ImageSource) (info interface{}, err error) { // nolint:gocyclo
 	e.config.Logger.Infof("Copying %s source to %s", imgSrc.Value(), target)
 
 	if imgSrc.IsDocker() {
-		if e.config.Cosign {
-			e.config.Logger.Infof("Running cosign verification for %s", imgSrc.Value())
-			out, err := utils.CosignVerify(
-				e.config.Fs, e.config.Runner, imgSrc.Value(),
-				e.config.CosignPubKey,
-			)
+		if err = e.verifyDockerSource(imgSrc); err != nil {
+			return nil, err
+		}
+		err = utils.NewDeadline(0).WithContext(e.ctx).Run(fmt.Sprintf("downloading %s", imgSrc.Value()), e.downloadTimeout, func(ctx context.Context) error {
+			return e.WithContext(ctx).imageExtractor().ExtractImage(imgSrc.Value(), target, e.config.Platform.String())
+		})
+		if err != nil {
+			return nil, err
+		}
+		if digest := imgSrc.Digest(); digest != "" {
+			e.config.Logger.Infof("Deployed %s, verified to be the image pinned to %s", imgSrc.Value(), digest)
+		}
+		// Keep the layers of the image, they are the base of the next delta upgrade
+		if extractor, ok := e.config.ImageExtractor.(v1.LayeredImageExtractor); ok {
+			meta, err := extractor.GetOCIImageLayers(imgSrc.Value(), e.config.Platform.String())
 			if err != nil {
-				e.config.Logger.Errorf("Cosign verification failed: %s", out)
-				return nil, err
+				e.config.Logger.Debugf("Could not get the layers of %s: %s", imgSrc.Value(), err)
+			} else if meta != nil {
+				info = meta
 			}
 		}
-		err = e.config.ImageExtractor.ExtractImage(imgSrc.Value(), target, e.config.Platform.String())
+	} else if imgSrc.IsContainerStore() {
+		if e.config.Cosign {
+			return nil, fmt.Errorf("images from the local %s store cannot be verified with cosign", imgSrc.ContainerRuntime())
+		}
+		err = utils.NewDeadline(0).WithContext(e.ctx).Run(fmt.Sprintf("exporting %s", imgSrc.Value()), e.downloadTimeout, func(context.Context) error {
+			return utils.ExtractContainerStoreImage(e.config, imgSrc, target)
+		})
 		if err != nil {
 			return nil, err
 		}
 	} else if imgSrc.IsDir() {
 		excludes := []string{"/mnt", "/proc", "/sys", "/dev", "/tmp", "/host", "/run"}
-		err = utils.SyncData(e.config.Logger, e.config.Runner, e.config.Fs, imgSrc.Value(), target, excludes...)
+		err = utils.SyncDataContext(e.ctx, e.config.Logger, e.config.Runner, e.config.Fs, imgSrc.Value(), target, excludes...)
 		if err != nil {
 			return nil, err
 		}
 	} else if imgSrc.IsFile() {
-		err := fsutils.MkdirAll(e.config.Fs, filepath.Dir(target), cnst.DirPerm)
+		err := e.VerifyFileSource(imgSrc.Value())
+		if err != nil {
+			return nil, err
+		}
+		err = fsutils.MkdirAll(e.config.Fs, filepath.Dir(target), cnst.DirPerm)
 		if err != nil {
 			return nil, err
 		}
@@ -425,6 +918,20 @@ func (e *Elemental) DumpSource(target string, imgSrc *v1.ImageSource) (info inte
 		if err != nil {
 			return nil, err
 		}
+	} else if imgSrc.IsS3() {
+		err = utils.NewDeadline(0).WithContext(e.ctx).Run(fmt.Sprintf("downloading %s", imgSrc.String()), e.downloadTimeout, func(context.Context) error {
+			return e.downloadRemoteSource(imgSrc.String(), target)
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else if imgSrc.IsTarball() {
+		err = utils.NewDeadline(0).WithContext(e.ctx).Run(fmt.Sprintf("downloading %s", imgSrc.Value()), e.downloadTimeout, func(ctx context.Context) error {
+			return e.WithContext(ctx).extractTarballSource(imgSrc.Value(), target)
+		})
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		return nil, fmt.Errorf("unknown image source type")
 	}
@@ -432,25 +939,231 @@ func (e *Elemental) DumpSource(target string, imgSrc *v1.ImageSource) (info inte
 	return info, nil
 }
 
+// downloadRemoteSource downloads the remote file to target, along with the signatures the verify config requires,
+// which are checked as the ones of file sources
+func (e *Elemental) downloadRemoteSource(source, target string) error {
+	if err := utils.GetSource(e.config, source, target); err != nil {
+		return err
+	}
+	// The signatures are next to the file, the checksum fragment only applies to it
+	file, _, _ := strings.Cut(source, "#")
+	for _, signature := range e.config.Verify.Signatures {
+		ext := cnst.SignatureExt
+		if signature == cnst.SignatureGPG {
+			ext = cnst.GPGSignatureExt
+		}
+		defer func() { _ = e.config.Fs.Remove(target + ext) }()
+		if err := utils.GetSource(e.config, file+ext, target+ext); err != nil {
+			return fmt.Errorf("fetching the %s signature of %s: %w", signature, source, err)
+		}
+	}
+	if err := e.VerifyFileSource(target); err != nil {
+		_ = e.config.Fs.Remove(target)
+		return err
+	}
+	return nil
+}
+
+// extractTarballSource downloads the tarball to a temporary dir, checking its checksum and signatures, and extracts
+// it into target
+func (e *Elemental) extractTarballSource(source, target string) error {
+	tmp, err := utils.NewTempDir(e.config, "tarball")
+	if err != nil {
+		return err
+	}
+	defer fsutils.RemoveTempDir(e.config.Fs, tmp) // nolint:errcheck
+	tarball := filepath.Join(tmp, "source.tar")
+	if err = e.downloadRemoteSource(source, tarball); err != nil {
+		return err
+	}
+	rawTarball, err := e.config.Fs.RawPath(tarball)
+	if err != nil {
+		return err
+	}
+	rawTarget, err := e.config.Fs.RawPath(target)
+	if err != nil {
+		return err
+	}
+	e.config.Logger.Infof("Extracting %s into %s", source, target)
+	if err = v1.ExtractTarball(e.ctx, rawTarball, rawTarget); err != nil {
+		return fmt.Errorf("extracting %s: %w", source, err)
+	}
+	return nil
+}
+
+// VerifyFileSource checks the detached signatures next to a file source that the verify config requires:
+// a cosign `.sig` verified with the cosign key and/or a GPG `.asc` verified with the GPG keyrings
+func (e *Elemental) VerifyFileSource(file string) error {
+	for _, signature := range e.config.Verify.Signatures {
+		switch signature {
+		case cnst.SignatureCosign:
+			if e.config.CosignPubKey == "" {
+				return fmt.Errorf("verifying the cosign signature of %s needs a cosign-key", file)
+			}
+			args := []string{"verify-blob", "--key", e.config.CosignPubKey, "--signature", file + cnst.SignatureExt}
+			if e.config.Verify.Offline {
+				args = append(args, "--offline")
+			}
+			out, err := e.config.Runner.Run("cosign", append(args, file)...)
+			if err != nil {
+				return fmt.Errorf("verifying the cosign signature of %s: %s: %w", file, strings.TrimSpace(string(out)), err)
+			}
+		case cnst.SignatureGPG:
+			err := e.config.VerifyGPGSignature(e.config.Verify.GPGKeyring, file, file+cnst.GPGSignatureExt)
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown signature %s in the verify signatures, expected %s or %s", signature, cnst.SignatureCosign, cnst.SignatureGPG)
+		}
+		e.config.Logger.Infof("Verified the %s signature of %s", signature, file)
+	}
+	return nil
+}
+
 // CopyCloudConfig will check if there is a cloud init in the config and store it on the target
 func (e *Elemental) CopyCloudConfig(cloudInit []string) (err error) {
 	e.config.Logger.Infof("List of cloud inits to copy: %+v\n", cloudInit)
 	for i, ci := range cloudInit {
 		customConfig := filepath.Join(cnst.OEMDir, fmt.Sprintf("9%d_custom.yaml", i))
 		e.config.Logger.Infof("Starting copying cloud config file %s to %s", ci, customConfig)
-		err = utils.GetSource(e.config, ci, customConfig)
-		if err != nil {
+		if err = e.copyCloudConfig(ci, customConfig); err != nil {
 			return err
 		}
-		if err = e.config.Fs.Chmod(customConfig, cnst.ConfigPerm); err != nil {
-			e.config.Logger.Debugf("Error on chmod %s: %s\n", customConfig, err.Error())
+		e.config.Logger.Infof("Finished copying cloud config file %s to %s", ci, customConfig)
+	}
+	return nil
+}
+
+// CopyMediaCloudConfigs looks for user cloud configs carried by the install media in the given dirs and stores all
+// of them on the target OEM partition. Files are copied under a single prefix followed by a counter, padded to the
+// width of the number of files, that keeps the order they were found in, so the installed system applies them in the
+// same order as the install media did. Keys set to different values by
+// more than one file are reported, as the latest file will win on the installed system.
+func (e *Elemental) CopyMediaCloudConfigs(dirs []string) error {
+	var found []string
+	for _, dir := range dirs {
+		files, err := e.config.Fs.ReadDir(dir)
+		if err != nil {
+			e.config.Logger.Debugf("Skipping media config dir %s: %s", dir, err.Error())
+			continue
+		}
+		// ReadDir returns the entries sorted by filename, which is the order yip uses to apply them
+		for _, f := range files {
+			if f.IsDir() || !isMediaCloudConfig(f.Name()) {
+				continue
+			}
+			path := filepath.Join(dir, f.Name())
+			data, err := e.config.Fs.ReadFile(path)
+			if err != nil {
+				e.config.Logger.Warnf("Could not read media config %s: %s", path, err.Error())
+				continue
+			}
+			if ok, _ := agentConfig.HasHeader(string(data), ""); !ok {
+				e.config.Logger.Debugf("Skipping %s as it does not look like a cloud config", path)
+				continue
+			}
+			found = append(found, path)
+		}
+	}
+
+	e.config.Logger.Infof("List of media cloud configs to copy: %+v", found)
+	seen := map[string]mediaConfigValue{}
+	width := len(strconv.Itoa(len(found)))
+	for i, src := range found {
+		data, _ := e.config.Fs.ReadFile(src)
+		content := map[string]interface{}{}
+		if err := yaml.Unmarshal(data, &content); err != nil {
+			e.config.Logger.Warnf("Could not parse media config %s, conflicts wont be checked for it: %s", src, err.Error())
+		}
+		for key, value := range flattenConfigKeys("", content) {
+			if prev, ok := seen[key]; ok && prev.value != value {
+				e.config.Logger.Warnf("Config key '%s' set in %s overrides the value set in %s", key, src, prev.file)
+			}
+			seen[key] = mediaConfigValue{file: src, value: value}
+		}
+
+		target := filepath.Join(cnst.OEMDir, fmt.Sprintf("80_media_%0*d_%s", width, i, filepath.Base(src)))
+		if filepath.Ext(target) != ".yaml" && filepath.Ext(target) != ".yml" {
+			target = target + ".yaml"
+		}
+		e.config.Logger.Infof("Copying media cloud config file %s to %s", src, target)
+		if err := e.copyCloudConfig(src, target); err != nil {
 			return err
 		}
-		e.config.Logger.Infof("Finished copying cloud config file %s to %s", ci, customConfig)
 	}
 	return nil
 }
 
+// copyCloudConfig fetches the cloud config from source and writes it atomically to target, so a power loss
+// never leaves a partial cloud config in the OEM partition
+func (e *Elemental) copyCloudConfig(source, target string) error {
+	download := target + ".download"
+	defer func() { _ = e.config.Fs.Remove(download) }()
+	if err := utils.GetSource(e.config, source, download); err != nil {
+		return err
+	}
+	data, err := e.config.Fs.ReadFile(download)
+	if err != nil {
+		return err
+	}
+	// Sealed systems only use signed OEM configs, copy the signature along after checking it
+	if e.config.SealedConfig() {
+		sigDownload := download + cnst.SignatureExt
+		defer func() { _ = e.config.Fs.Remove(sigDownload) }()
+		if err = utils.GetSource(e.config, source+cnst.SignatureExt, sigDownload); err != nil {
+			return fmt.Errorf("config signing is enforced and the signature of %s could not be fetched: %w", source, err)
+		}
+		sig, err := e.config.Fs.ReadFile(sigDownload)
+		if err != nil {
+			return err
+		}
+		if err = e.config.VerifyConfigSignature(data, sig); err != nil {
+			return fmt.Errorf("verifying the signature of %s: %w", source, err)
+		}
+		if err = fsutils.AtomicWriteFile(e.config.Fs, target+cnst.SignatureExt, sig, cnst.ConfigPerm); err != nil {
+			return err
+		}
+	}
+	return fsutils.AtomicWriteFile(e.config.Fs, target, data, cnst.ConfigPerm)
+}
+
+// mediaConfigValue tracks which file set a given config key, used to report conflicts between media configs
+type mediaConfigValue struct {
+	file  string
+	value string
+}
+
+// isMediaCloudConfig returns true for file names that can hold a cloud config on the install media.
+// NoCloud seeds use a plain "user-data" file without extension.
+func isMediaCloudConfig(name string) bool {
+	switch filepath.Ext(name) {
+	case ".yaml", ".yml":
+		return true
+	}
+	return name == "user-data" || name == "userdata"
+}
+
+// flattenConfigKeys returns a map of dotted key paths to their printed values for all the leaf values of a config.
+// Lists are treated as leaf values.
+func flattenConfigKeys(prefix string, content map[string]interface{}) map[string]string {
+	result := map[string]string{}
+	for k, v := range content {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		if nested, ok := v.(map[string]interface{}); ok {
+			for nk, nv := range flattenConfigKeys(key, nested) {
+				result[nk] = nv
+			}
+			continue
+		}
+		result[key] = fmt.Sprintf("%v", v)
+	}
+	return result
+}
+
 // SelinuxRelabel will relabel the system if it finds the binary and the context
 func (e *Elemental) SelinuxRelabel(rootDir string, raiseError bool) error {
 	policyFile, err := utils.FindFileWithPrefix(e.config.Fs, filepath.Join(rootDir, cnst.SELinuxTargetedPolicyPath), "policy.")
@@ -495,13 +1208,13 @@ func (e *Elemental) CheckActiveDeployment(labels []string) bool {
 // in cnst.DownloadedIsoMnt
 func (e *Elemental) GetIso(iso string) (tmpDir string, err error) {
 	//TODO support ISO download in persistent storage?
-	tmpDir, err = fsutils.TempDir(e.config.Fs, "", "elemental")
+	tmpDir, err = utils.NewTempDir(e.config, "iso")
 	if err != nil {
 		return "", err
 	}
 	defer func() {
 		if err != nil {
-			_ = e.config.Fs.RemoveAll(tmpDir)
+			_ = fsutils.RemoveTempDir(e.config.Fs, tmpDir)
 		}
 	}()
 
@@ -513,6 +1226,9 @@ func (e *Elemental) GetIso(iso string) (tmpDir string, err error) {
 	if err != nil {
 		return "", err
 	}
+	if err = fsutils.CheckTempDirQuota(e.config.Fs, tmpDir); err != nil {
+		return "", err
+	}
 	err = fsutils.MkdirAll(e.config.Fs, isoMnt, cnst.DirPerm)
 	if err != nil {
 		return "", err
@@ -610,6 +1326,76 @@ func (e Elemental) FindKernelInitrd(rootDir string) (kernel string, initrd strin
 	return kernel, initrd, nil
 }
 
+// RegenerateInitrd regenerates the initramfs inside the given root tree path using the dracut or mkinitrd binaries
+// shipped in the tree. The existing initrd file found by FindKernelInitrd is overwritten.
+func (e Elemental) RegenerateInitrd(rootDir string) error {
+	kernel, initrd, err := e.FindKernelInitrd(rootDir)
+	if err != nil {
+		return err
+	}
+
+	kernelVersion, err := e.kernelVersion(rootDir, kernel)
+	if err != nil {
+		return err
+	}
+
+	// Paths as seen from inside the chroot
+	kernel = filepath.Join("/", strings.TrimPrefix(kernel, rootDir))
+	initrd = filepath.Join("/", strings.TrimPrefix(initrd, rootDir))
+
+	var cmd string
+	var args []string
+	switch {
+	case utils.CommandExistsIn(e.config.Fs, rootDir, "dracut"):
+		cmd = "dracut"
+		args = []string{"-f", initrd, kernelVersion}
+	case utils.CommandExistsIn(e.config.Fs, rootDir, "mkinitrd"):
+		cmd = "mkinitrd"
+		args = []string{"-k", kernel, "-i", initrd}
+	default:
+		return fmt.Errorf("no dracut or mkinitrd binary found in %s", rootDir)
+	}
+
+	e.config.Logger.Infof("Regenerating initrd %s for kernel %s", initrd, kernelVersion)
+	out, err := utils.NewChroot(rootDir, e.config).Run(cmd, args...)
+	if err != nil {
+		e.config.Logger.Errorf("Failed regenerating initrd: %s", string(out))
+		return fmt.Errorf("failed regenerating initrd with %s: %w", cmd, err)
+	}
+	return nil
+}
+
+// kernelVersion returns the lib/modules version of the given kernel file of the root tree. The version is taken from
+// the kernel file name suffix, an unversioned kernel is only accepted if the tree ships a single modules dir.
+func (e Elemental) kernelVersion(rootDir, kernel string) (string, error) {
+	modulesDir := filepath.Join(rootDir, "lib/modules")
+	modules, err := e.config.Fs.ReadDir(modulesDir)
+	if err != nil {
+		return "", fmt.Errorf("failed reading kernel modules dir: %w", err)
+	}
+	var versions []string
+	var version string
+	for _, m := range modules {
+		if !m.IsDir() {
+			continue
+		}
+		versions = append(versions, m.Name())
+		if strings.HasSuffix(filepath.Base(kernel), "-"+m.Name()) && len(m.Name()) > len(version) {
+			version = m.Name()
+		}
+	}
+	switch {
+	case version != "":
+		return version, nil
+	case len(versions) == 1:
+		return versions[0], nil
+	case len(versions) == 0:
+		return "", fmt.Errorf("could not find the kernel version in %s", modulesDir)
+	default:
+		return "", fmt.Errorf("could not match kernel %s with any of the versions in %s: %v", kernel, modulesDir, versions)
+	}
+}
+
 // DeactivateDevice deactivates unmounted the block devices present within the system.
 // Useful to deactivate LVM volumes, if any, related to the target device.
 func (e Elemental) DeactivateDevices() error {
@@ -620,3 +1406,179 @@ func (e Elemental) DeactivateDevices() error {
 	e.config.Logger.Debugf("blkdeactivate command output: %s", string(out))
 	return err
 }
+
+// CloneDisk copies the whole source disk into the target disk, so the target ends up with the very same partition
+// layout, images and bootloader and can be used as a cold-standby boot disk. The source disk must not be in use.
+// For GPT disks the backup header is moved to the end of the target and the disk and partition GUIDs are randomized.
+// The filesystem labels of the target get the spare suffix, so the disks can stay attached together without the
+// system finding its partitions on the spare. The spare gets a copy of the ESP and bootloader, but the bootloader
+// finds the partitions by label, so the spare does not boot on its own until PromoteSpareDisk restores them.
+func (e Elemental) CloneDisk(source, target string) error {
+	if source == "" || target == "" {
+		return fmt.Errorf("both source and target devices are required to clone a disk")
+	}
+	if filepath.Clean(source) == filepath.Clean(target) {
+		return fmt.Errorf("cannot clone device %s into itself", source)
+	}
+	for _, dev := range []string{source, target} {
+		if _, err := e.config.Fs.Stat(dev); err != nil {
+			return fmt.Errorf("device %s not found: %w", dev, err)
+		}
+	}
+
+	sourceSize, err := e.deviceSize(source)
+	if err != nil {
+		return err
+	}
+	targetSize, err := e.deviceSize(target)
+	if err != nil {
+		return err
+	}
+	if targetSize < sourceSize {
+		return fmt.Errorf("target device %s (%d bytes) is smaller than source device %s (%d bytes)", target, targetSize, source, sourceSize)
+	}
+
+	e.config.Logger.Infof("Cloning device %s into %s", source, target)
+	out, err := e.config.Runner.Run("dd", fmt.Sprintf("if=%s", source), fmt.Sprintf("of=%s", target), "bs=4M", "conv=fsync", "status=none")
+	if err != nil {
+		e.config.Logger.Errorf("Failed cloning device %s into %s: %s", source, target, string(out))
+		return err
+	}
+
+	out, _ = e.config.Runner.Run("blkid", "-p", "-s", "PTTYPE", "-o", "value", target)
+	if strings.TrimSpace(string(out)) == cnst.GPT {
+		// Move the backup GPT header to the end of the target disk, which might be bigger than the source
+		out, err = e.config.Runner.Run("sgdisk", "-e", target)
+		if err != nil {
+			e.config.Logger.Errorf("Failed relocating GPT backup header on %s: %s", target, string(out))
+			return err
+		}
+		// Avoid clashing disk and partition GUIDs with the source disk
+		out, err = e.config.Runner.Run("sgdisk", "-G", target)
+		if err != nil {
+			e.config.Logger.Errorf("Failed randomizing GUIDs on %s: %s", target, string(out))
+			return err
+		}
+	}
+	// Let the kernel pick up the cloned partitions before relabeling them
+	_, _ = e.config.Runner.Run("partprobe", target)
+	_, _ = e.config.Runner.Run("udevadm", "settle")
+	err = e.relabelDisk(target, func(label string) (string, bool) {
+		return label + cnst.SpareLabelSuffix, label != "" && !strings.HasSuffix(label, cnst.SpareLabelSuffix)
+	})
+	if err != nil {
+		return err
+	}
+	e.config.Logger.Infof("Device %s is a spare of %s, promote it to boot from it once %s is detached", target, source, source)
+	return nil
+}
+
+// PromoteSpareDisk drops the spare suffix CloneDisk adds to the filesystem labels of the device, so the system
+// boots from it. It fails if any of the restored labels is still in use by another disk.
+func (e Elemental) PromoteSpareDisk(device string) error {
+	parts, err := e.diskFilesystems(device)
+	if err != nil {
+		return err
+	}
+	own := map[string]bool{}
+	for _, p := range parts {
+		own[p.Name] = true
+	}
+	for _, p := range parts {
+		if !strings.HasSuffix(p.Label, cnst.SpareLabelSuffix) {
+			continue
+		}
+		label := strings.TrimSuffix(p.Label, cnst.SpareLabelSuffix)
+		// blkid exits non zero if no filesystem has the label
+		out, _ := e.config.Runner.Run("blkid", "-L", label)
+		if inUse := strings.TrimSpace(string(out)); inUse != "" && !own[inUse] {
+			return fmt.Errorf("label %s is still in use by %s, detach its disk before promoting %s", label, inUse, device)
+		}
+	}
+	err = e.relabelDisk(device, func(label string) (string, bool) {
+		return strings.TrimSuffix(label, cnst.SpareLabelSuffix), strings.HasSuffix(label, cnst.SpareLabelSuffix)
+	})
+	if err != nil {
+		return err
+	}
+	_, _ = e.config.Runner.Run("udevadm", "settle")
+	return nil
+}
+
+// diskFilesystem is a partition of a disk in the lsblk JSON output
+type diskFilesystem struct {
+	Name   string `json:"name"`
+	FSType string `json:"fstype"`
+	Label  string `json:"label"`
+}
+
+// diskFilesystems returns the partitions of the disk
+func (e Elemental) diskFilesystems(device string) ([]diskFilesystem, error) {
+	out, err := e.config.Runner.Run("lsblk", "-p", "-J", "-o", "NAME,FSTYPE,LABEL", device)
+	if err != nil {
+		return nil, fmt.Errorf("listing the partitions of %s: %s: %w", device, strings.TrimSpace(string(out)), err)
+	}
+	var disks struct {
+		BlockDevices []struct {
+			Children []diskFilesystem `json:"children"`
+		} `json:"blockdevices"`
+	}
+	if err = json.Unmarshal(out, &disks); err != nil {
+		return nil, fmt.Errorf("parsing the partitions of %s: %w", device, err)
+	}
+	var parts []diskFilesystem
+	for _, disk := range disks.BlockDevices {
+		parts = append(parts, disk.Children...)
+	}
+	return parts, nil
+}
+
+// relabelDisk sets the filesystem labels of the partitions of the device to the ones rename returns, skipping the
+// partitions it returns false for
+func (e Elemental) relabelDisk(device string, rename func(label string) (string, bool)) error {
+	parts, err := e.diskFilesystems(device)
+	if err != nil {
+		return err
+	}
+	for _, p := range parts {
+		label, ok := rename(p.Label)
+		if !ok {
+			continue
+		}
+		var cmd []string
+		var max int
+		switch p.FSType {
+		case "ext2", "ext3", "ext4":
+			cmd, max = []string{"tune2fs", "-L", label, p.Name}, 16
+		case "vfat":
+			cmd, max = []string{"fatlabel", p.Name, label}, 11
+		case "xfs":
+			cmd, max = []string{"xfs_admin", "-L", label, p.Name}, 12
+		case "btrfs":
+			cmd, max = []string{"btrfs", "filesystem", "label", p.Name, label}, 255
+		default:
+			return fmt.Errorf("cannot relabel the %s filesystem %s of %s", p.FSType, p.Label, p.Name)
+		}
+		if len(label) > max {
+			return fmt.Errorf("label %s is too long for the %s filesystem of %s", label, p.FSType, p.Name)
+		}
+		e.config.Logger.Debugf("Relabeling %s from %s to %s", p.Name, p.Label, label)
+		if out, err := e.config.Runner.Run(cmd[0], cmd[1:]...); err != nil {
+			return fmt.Errorf("relabeling %s to %s: %s: %w", p.Name, label, strings.TrimSpace(string(out)), err)
+		}
+	}
+	return nil
+}
+
+// deviceSize returns the size in bytes of the given block device
+func (e Elemental) deviceSize(device string) (uint64, error) {
+	out, err := e.config.Runner.Run("blockdev", "--getsize64", device)
+	if err != nil {
+		return 0, fmt.Errorf("failed getting size of device %s: %w", device, err)
+	}
+	size, err := strconv.ParseUint(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed parsing size of device %s: %w", device, err)
+	}
+	return size, nil
+}
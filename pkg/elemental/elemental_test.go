@@ -17,7 +17,14 @@
 package elemental_test
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"golang.org/x/sys/unix"
@@ -348,6 +355,21 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			}
 			Expect(el.FormatPartition(part)).To(BeNil())
 		})
+		It("Reformats a partition with the tuning options", func() {
+			el := elemental.NewElemental(config)
+			part := &sdkTypes.Partition{
+				Path:            "/dev/device1",
+				FS:              "ext4",
+				FilesystemLabel: "MY_LABEL",
+			}
+			reserved := 0.0
+			tuning := &v1.FilesystemTuning{ReservedBlocks: &reserved, InodeRatio: 4096, Journal: v1.JournalWriteback}
+			Expect(el.FormatTunedPartition(part, tuning)).To(BeNil())
+			Expect(runner.CmdsMatch([][]string{
+				{"mkfs.ext4", "-L", "MY_LABEL", "-m", "0", "-i", "4096", "/dev/device1"},
+				{"tune2fs", "-o", "journal_data_writeback", "/dev/device1"},
+			})).To(BeNil())
+		})
 
 	})
 	Describe("PartitionAndFormatDevice", Label("PartitionAndFormatDevice", "partition", "format"), func() {
@@ -442,6 +464,64 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 				Expect(partition.Type).To(Equal(gpt.LinuxFilesystem))
 			}
 		})
+		It("Sets the GPT types, attributes and GUIDs from the partition spec", func() {
+			install.PartTable = v1.GPT
+			install.Firmware = v1.EFI
+			Expect(install.Partitions.SetFirmwarePartitions(v1.EFI, v1.GPT)).To(BeNil())
+			install.Partitions.Persistent.UUID = "3b8f8425-20e0-4f3b-907f-1a25a76f98e9"
+			install.Partitions.Persistent.Flags = []string{"type=linux-srv", "attr=no-auto,grow-fs,48"}
+			install.Partitions.OEM.Flags = []string{"type=933ac7e1-2eb4-4f13-b844-0e14e2aef915"}
+			Expect(el.PartitionAndFormatDevice(install)).To(BeNil())
+			disk, err := diskfs.Open(filepath.Join(tmpDir, "/test.img"), diskfs.WithOpenMode(diskfs.ReadOnly))
+			defer disk.Close()
+			Expect(err).ToNot(HaveOccurred())
+			parts := disk.Table.GetPartitions()
+			oem := parts[1].(*gpt.Partition)
+			Expect(oem.Type).To(Equal(gpt.LinuxHome))
+			Expect(oem.Attributes).To(BeZero())
+			persistent := parts[4].(*gpt.Partition)
+			Expect(persistent.Type).To(Equal(gpt.LinuxServerData))
+			Expect(persistent.Attributes).To(Equal(uint64(1<<63 | 1<<59 | 1<<48)))
+			Expect(strings.ToLower(persistent.UUID())).To(Equal("3b8f8425-20e0-4f3b-907f-1a25a76f98e9"))
+			// The EFI partition keeps its defaults
+			efi := parts[0].(*gpt.Partition)
+			Expect(efi.Type).To(Equal(gpt.EFISystemPartition))
+			Expect(efi.Attributes).To(Equal(uint64(0x1)))
+		})
+		It("Sets the root partition type of the arch of the installed image", func() {
+			install.PartTable = v1.GPT
+			install.Firmware = v1.EFI
+			Expect(install.Partitions.SetFirmwarePartitions(v1.EFI, v1.GPT)).To(BeNil())
+			install.Partitions.Persistent.Flags = []string{"type=linux-root"}
+			// The arch comes from the config, not from the running agent
+			Expect(install.Arch).To(Equal(config.Arch))
+			install.Arch = ""
+			Expect(el.PartitionAndFormatDevice(install)).To(MatchError(ContainSubstring("needs the arch of the installed image")))
+
+			install.Arch = "arm64"
+			Expect(el.PartitionAndFormatDevice(install)).To(BeNil())
+			disk, err := diskfs.Open(filepath.Join(tmpDir, "/test.img"), diskfs.WithOpenMode(diskfs.ReadOnly))
+			defer disk.Close()
+			Expect(err).ToNot(HaveOccurred())
+			parts := disk.Table.GetPartitions()
+			Expect(parts[4].(*gpt.Partition).Type).To(Equal(gpt.LinuxRootArm64))
+			// The partitions holding the images keep the generic Linux type
+			for _, part := range parts[1:4] {
+				Expect(part.(*gpt.Partition).Type).To(Equal(gpt.LinuxFilesystem))
+				Expect(part.(*gpt.Partition).Attributes).To(BeZero())
+			}
+		})
+		It("Fails on invalid GPT settings before partitioning", func() {
+			install.PartTable = v1.GPT
+			install.Firmware = v1.EFI
+			Expect(install.Partitions.SetFirmwarePartitions(v1.EFI, v1.GPT)).To(BeNil())
+			install.Partitions.State.Flags = []string{"attr=64"}
+			err := el.PartitionAndFormatDevice(install)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("invalid partition attribute 64"))
+			install.Partitions.State.Flags = []string{"type=not-a-type"}
+			Expect(el.PartitionAndFormatDevice(install)).ToNot(Succeed())
+		})
 	})
 	Describe("DeployImage", Label("DeployImage"), func() {
 		var el *elemental.Elemental
@@ -479,6 +559,14 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 		It("Deploys an image from a directory and leaves it unmounted", func() {
 			Expect(el.DeployImage(img, false)).To(BeNil())
 		})
+		It("Reads back the deployed image with verify-deploy", func() {
+			config.VerifyDeploy = true
+			Expect(el.DeployImage(img, false)).To(BeNil())
+			Expect(memLog.String()).To(ContainSubstring("Verified 16 samples of " + img.File))
+		})
+		It("Fails syncing an image that was not written", func() {
+			Expect(el.SyncImage(&v1.Image{File: "/nonexistent/image.img"})).ToNot(Succeed())
+		})
 		It("Deploys an squashfs image from a directory", func() {
 			img.FS = cnst.SquashFs
 			Expect(el.DeployImage(img, true)).To(BeNil())
@@ -550,6 +638,66 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			_, err := el.DeployImage(img, false)
 			Expect(err).NotTo(BeNil())
 		})
+		It("Fails to deploy a source that does not look bootable", func() {
+			el.SetBootableCheck(true)
+			_, err := el.DeployImage(img, false)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("no kernel, initrd, init system found"))
+			// Nothing got deployed
+			Expect(runner.IncludesCmds([][]string{{"mkfs.ext2"}})).ToNot(Succeed())
+		})
+		It("Deploys a bootable source with the bootable check", func() {
+			el.SetBootableCheck(true)
+			for _, f := range []string{"boot/vmlinuz-6.1", "boot/initrd", "sbin/init"} {
+				path := filepath.Join(img.Source.Value(), f)
+				Expect(fsutils.MkdirAll(fs, filepath.Dir(path), cnst.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile(path, []byte{}, cnst.FilePerm)).To(Succeed())
+			}
+			Expect(el.DeployImage(img, false)).To(BeNil())
+			Expect(memLog.String()).To(ContainSubstring("The source has no /etc/kairos-release"))
+		})
+		It("Checks OCI images once extracted", func() {
+			el.SetBootableCheck(true)
+			img.Source = v1.NewDockerSrc("docker.io/library/nginx:latest")
+			_, err := el.DeployImage(img, false)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("does not look like a bootable Kairos image"))
+		})
+		It("Deploys an OCI image as a delta over the base image", Label("delta"), func() {
+			Expect(fs.WriteFile("/active.img", []byte("base"), cnst.FilePerm)).To(Succeed())
+			el.SetDeltaBase("/active.img", []string{"sha256:a", "sha256:b"})
+			extractor.Layers = []string{"sha256:a", "sha256:b", "sha256:c"}
+			from := -1
+			extractor.LayersSideEffect = func(_, _, _ string, f int) error {
+				from = f
+				return nil
+			}
+			img.Source = v1.NewDockerSrc("quay.io/kairos/ubuntu:v3.2.0")
+			info, err := el.DeployImage(img, false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(from).To(Equal(2))
+			Expect(info).To(Equal(&v1.DockerImageMeta{Digest: "sha256:fake", Layers: extractor.Layers}))
+			// The base image was copied and grown instead of formatting a new one
+			Expect(runner.IncludesCmds([][]string{{"mkfs.ext2"}})).ToNot(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"resize2fs", img.File}, {"tune2fs", "-L", "some_label", img.File}})).To(Succeed())
+			st, err := fs.Stat(img.File)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(st.Size()).To(Equal(int64(16 * 1024 * 1024)))
+		})
+		It("Deploys the whole OCI image if it's not built over the base image", Label("delta"), func() {
+			Expect(fs.WriteFile("/active.img", []byte("base"), cnst.FilePerm)).To(Succeed())
+			el.SetDeltaBase("/active.img", []string{"sha256:a", "sha256:old"})
+			extractor.Layers = []string{"sha256:a", "sha256:b", "sha256:c"}
+			extractor.LayersSideEffect = func(_, _, _ string, _ int) error {
+				return errors.New("should not extract layers")
+			}
+			img.Source = v1.NewDockerSrc("quay.io/kairos/ubuntu:v3.2.0")
+			info, err := el.DeployImage(img, false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info).To(Equal(&v1.DockerImageMeta{Digest: "sha256:fake", Layers: extractor.Layers}))
+			Expect(runner.IncludesCmds([][]string{{"mkfs.ext2"}})).To(Succeed())
+			Expect(memLog.String()).To(ContainSubstring("Not deploying quay.io/kairos/ubuntu:v3.2.0 as a delta"))
+		})
 	})
 	Describe("DumpSource", Label("dump"), func() {
 		var e *elemental.Elemental
@@ -596,6 +744,58 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			Expect(err).NotTo(BeNil())
 			Expect(runner.CmdsMatch([][]string{{"cosign", "verify", "docker/image:latest"}}))
 		})
+		It("Checks the image policy before unpacking a docker image", Label("docker", "policy"), func() {
+			config.ImagePolicy = &v1.ImagePolicy{
+				RequiredLabels:    map[string]string{"io.kairos.version": "v3.2.1"},
+				AllowedRegistries: []string{"quay.io/kairos"},
+			}
+			extractor.Metadata = &v1.OCIImageMetadata{Labels: map[string]string{"io.kairos.version": "v3.2.1"}}
+			_, err := e.DumpSource(destDir, v1.NewDockerSrc("quay.io/kairos/image:latest"))
+			Expect(err).To(BeNil())
+
+			extracted := false
+			extractor.SideEffect = func(_, _, _ string) error {
+				extracted = true
+				return nil
+			}
+			_, err = e.DumpSource(destDir, v1.NewDockerSrc("docker.io/other/image:latest"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("allowed registries"))
+
+			extractor.Metadata = &v1.OCIImageMetadata{Labels: map[string]string{"io.kairos.version": "v3.0.0"}}
+			_, err = e.DumpSource(destDir, v1.NewDockerSrc("quay.io/kairos/image:latest"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("io.kairos.version"))
+			Expect(extracted).To(BeFalse())
+		})
+		It("Refuses images lacking the attestations required by the policy", Label("docker", "policy"), func() {
+			config.ImagePolicy = &v1.ImagePolicy{RequiredAttestations: []string{"sbom"}}
+			_, err := e.DumpSource(destDir, v1.NewDockerSrc("quay.io/kairos/image:latest"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("required attestation sbom is missing"))
+
+			extractor.Referrers = []v1.OCIReferrer{{ArtifactType: "application/spdx+json", Digest: "sha256:sbom"}}
+			_, err = e.DumpSource(destDir, v1.NewDockerSrc("quay.io/kairos/image:latest"))
+			Expect(err).ToNot(HaveOccurred())
+		})
+		It("Stores the referrers of a docker image", Label("docker", "referrers"), func() {
+			config.Referrers = &v1.Referrers{Dir: "/referrers", ArtifactTypes: []string{"sbom"}}
+			extractor.Referrers = []v1.OCIReferrer{
+				{ArtifactType: "application/spdx+json", Digest: "sha256:sbom"},
+				{ArtifactType: "application/vnd.dev.cosign.artifact.sig.v1+json", Digest: "sha256:sig"},
+			}
+			extractor.ReferrerBlobs = map[string][][]byte{"sha256:sbom": {[]byte(`{"spdxVersion": "SPDX-2.3"}`)}}
+			_, err := e.DumpSource(destDir, v1.NewDockerSrc("quay.io/kairos/image:latest"))
+			Expect(err).ToNot(HaveOccurred())
+
+			sbom, err := fs.ReadFile("/referrers/sha256-fake/sha256-sbom.0")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(sbom)).To(ContainSubstring("SPDX-2.3"))
+			record, err := fs.ReadFile(filepath.Join("/referrers/sha256-fake", cnst.ReferrersFile))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(record)).To(ContainSubstring("image: quay.io/kairos/image:latest"))
+			Expect(string(record)).ToNot(ContainSubstring("sha256:sig"))
+		})
 		It("Copies image file to target", func() {
 			sourceImg := "/source.img"
 			destFile := filepath.Join(destDir, "active.img")
@@ -609,6 +809,71 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			_, err := e.DumpSource("whatever", v1.NewFileSrc("/source.img"))
 			Expect(err).NotTo(BeNil())
 		})
+		It("Verifies the cosign and GPG signatures of an image file", Label("cosign", "gpg"), func() {
+			sourceImg := "/source.img"
+			destFile := filepath.Join(destDir, "active.img")
+			_, err := fs.Create(sourceImg)
+			Expect(err).To(BeNil())
+			Expect(fsutils.MkdirAll(fs, cnst.GPGKeyringsDir, cnst.DirPerm)).To(Succeed())
+			_, err = fs.Create(filepath.Join(cnst.GPGKeyringsDir, "org.gpg"))
+			Expect(err).To(BeNil())
+			config.Verify.Signatures = []string{cnst.SignatureCosign, cnst.SignatureGPG}
+			config.CosignPubKey = "/oem/cosign.pub"
+
+			_, err = e.DumpSource(destFile, v1.NewFileSrc(sourceImg))
+			Expect(err).To(BeNil())
+			Expect(runner.CmdsMatch([][]string{
+				{"cosign", "verify-blob", "--key", "/oem/cosign.pub", "--signature", sourceImg + cnst.SignatureExt, sourceImg},
+				{"gpgv", "--keyring", filepath.Join(cnst.GPGKeyringsDir, "org.gpg"), sourceImg + cnst.GPGSignatureExt, sourceImg},
+			})).To(Succeed())
+			Expect(fsutils.Exists(fs, destFile)).To(BeTrue())
+		})
+		It("Fails to copy an image file with a bad GPG signature", Label("gpg"), func() {
+			sourceImg := "/source.img"
+			_, err := fs.Create(sourceImg)
+			Expect(err).To(BeNil())
+			config.Verify.Signatures = []string{cnst.SignatureGPG}
+			config.Verify.GPGKeyring = "/oem/org.gpg"
+			Expect(fsutils.MkdirAll(fs, "/oem", cnst.DirPerm)).To(Succeed())
+			_, err = fs.Create("/oem/org.gpg")
+			Expect(err).To(BeNil())
+			runner.ReturnError = errors.New("BAD signature")
+
+			destFile := filepath.Join(destDir, "active.img")
+			_, err = e.DumpSource(destFile, v1.NewFileSrc(sourceImg))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("GPG signature"))
+			Expect(fsutils.Exists(fs, destFile)).To(BeFalse())
+		})
+		It("Extracts a tarball source checking its checksum", Label("tarball"), func() {
+			buf := &bytes.Buffer{}
+			gz := gzip.NewWriter(buf)
+			tw := tar.NewWriter(gz)
+			for name, content := range map[string]string{"etc/os-release": "ID=kairos\n", "usr/bin/kairos": "#!/bin/sh\n"} {
+				Expect(tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(content)), Typeflag: tar.TypeReg})).To(Succeed())
+				_, err := tw.Write([]byte(content))
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(tw.Close()).To(Succeed())
+			Expect(gz.Close()).To(Succeed())
+			config.Client = &tarballClient{fs: fs, data: buf.Bytes()}
+			sum := sha256.Sum256(buf.Bytes())
+
+			src, err := v1.NewSrcFromURI(fmt.Sprintf("https://server/rootfs.tar.gz#sha256=%x", sum))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(src.IsTarball()).To(BeTrue())
+			_, err = e.DumpSource(destDir, src)
+			Expect(err).ToNot(HaveOccurred())
+			release, err := fs.ReadFile(filepath.Join(destDir, "etc/os-release"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(release)).To(Equal("ID=kairos\n"))
+			Expect(fsutils.Exists(fs, filepath.Join(destDir, "usr/bin/kairos"))).To(BeTrue())
+
+			src, err = v1.NewSrcFromURI("https://server/rootfs.tar.gz#sha256=" + strings.Repeat("0", 64))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = e.DumpSource(GinkgoT().TempDir(), src)
+			Expect(err).To(MatchError(ContainSubstring("checksum mismatch")))
+		})
 	})
 	Describe("CheckActiveDeployment", Label("check"), func() {
 		It("deployment found", func() {
@@ -835,10 +1100,75 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			Expect(int(stat.Mode().Perm())).To(Equal(cnst.ConfigPerm))
 
 		})
+		It("Copies the signature of the cloud config when config signing is enforced", func() {
+			pub, priv, err := ed25519.GenerateKey(nil)
+			Expect(err).To(BeNil())
+			der, err := x509.MarshalPKIXPublicKey(pub)
+			Expect(err).To(BeNil())
+			Expect(fsutils.MkdirAll(fs, filepath.Dir(cnst.ConfigSigningKeyFile), cnst.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile(cnst.ConfigSigningKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), cnst.FilePerm)).To(Succeed())
+			config.ConfigSigning = &agentConfig.ConfigSigning{Enforce: true}
+
+			data := []byte("#cloud-config\ndebug: true\n")
+			Expect(fs.WriteFile("/config.yaml", data, cnst.FilePerm)).To(Succeed())
+			Expect(e.CopyCloudConfig([]string{"/config.yaml"})).To(MatchError(ContainSubstring("could not be fetched")))
+
+			sig := []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, data)))
+			Expect(fs.WriteFile("/config.yaml.sig", sig, cnst.FilePerm)).To(Succeed())
+			Expect(e.CopyCloudConfig([]string{"/config.yaml"})).To(Succeed())
+			copied, err := fs.ReadFile(filepath.Join(cnst.OEMDir, "90_custom.yaml.sig"))
+			Expect(err).To(BeNil())
+			Expect(copied).To(Equal(sig))
+
+			Expect(fs.WriteFile("/config.yaml", []byte("#cloud-config\ndebug: false\n"), cnst.FilePerm)).To(Succeed())
+			Expect(e.CopyCloudConfig([]string{"/config.yaml"})).To(MatchError(ContainSubstring("invalid signature")))
+		})
 		It("Doesnt do anything if the config file is not set", func() {
 			err := e.CopyCloudConfig([]string{})
 			Expect(err).To(BeNil())
 		})
+		It("Copies all the media cloud configs keeping the order", func() {
+			Expect(fsutils.MkdirAll(fs, "/live", cnst.DirPerm)).To(Succeed())
+			Expect(fsutils.MkdirAll(fs, "/seed", cnst.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/live/b.yaml", []byte("#cloud-config\ndebug: true\n"), cnst.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile("/live/a.yaml", []byte("#cloud-config\ninstall:\n  device: /dev/sda\n"), cnst.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile("/live/notes.yaml", []byte("not a cloud config"), cnst.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile("/live/rootfs.squashfs", []byte("#cloud-config"), cnst.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile("/seed/user-data", []byte("#cloud-config\ninstall:\n  device: /dev/vda\n"), cnst.FilePerm)).To(Succeed())
+
+			err := e.CopyMediaCloudConfigs([]string{"/live", "/seed", "/nonexisting"})
+			Expect(err).To(BeNil())
+
+			files, err := fs.ReadDir(cnst.OEMDir)
+			Expect(err).To(BeNil())
+			var names []string
+			for _, f := range files {
+				names = append(names, f.Name())
+			}
+			Expect(names).To(Equal([]string{"80_media_0_a.yaml", "80_media_1_b.yaml", "80_media_2_user-data.yaml"}))
+			copied, err := fs.ReadFile(filepath.Join(cnst.OEMDir, "80_media_2_user-data.yaml"))
+			Expect(err).To(BeNil())
+			Expect(string(copied)).To(ContainSubstring("/dev/vda"))
+			Expect(memLog.String()).To(ContainSubstring("Config key 'install.device' set in /seed/user-data overrides the value set in /live/a.yaml"))
+		})
+		It("Keeps the order of more than a hundred media cloud configs", func() {
+			Expect(fsutils.MkdirAll(fs, "/live", cnst.DirPerm)).To(Succeed())
+			var sources []string
+			for i := 0; i < 120; i++ {
+				name := fmt.Sprintf("%03d.yaml", i)
+				sources = append(sources, name)
+				Expect(fs.WriteFile(filepath.Join("/live", name), []byte(fmt.Sprintf("#cloud-config\nhostname: host%d\n", i)), cnst.FilePerm)).To(Succeed())
+			}
+
+			Expect(e.CopyMediaCloudConfigs([]string{"/live"})).To(Succeed())
+
+			files, err := fs.ReadDir(cnst.OEMDir)
+			Expect(err).To(BeNil())
+			Expect(files).To(HaveLen(len(sources)))
+			for i, f := range files {
+				Expect(f.Name()).To(Equal(fmt.Sprintf("80_media_%03d_%s", i, sources[i])))
+			}
+		})
 	})
 	Describe("SetDefaultGrubEntry", Label("SetDefaultGrubEntry", "grub"), func() {
 		It("Sets the default grub entry without issues", func() {
@@ -913,6 +1243,57 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			Expect(err).Should(HaveOccurred())
 		})
 	})
+	Describe("RegenerateInitrd", Label("initrd"), func() {
+		var el *elemental.Elemental
+		BeforeEach(func() {
+			Expect(fsutils.MkdirAll(fs, "/path/boot", cnst.DirPerm)).To(Succeed())
+			Expect(fsutils.MkdirAll(fs, "/path/lib/modules/6.1.0-kairos", cnst.DirPerm)).To(Succeed())
+			Expect(fsutils.MkdirAll(fs, "/path/usr/bin", cnst.DirPerm)).To(Succeed())
+			_, err := fs.Create("/path/boot/vmlinuz")
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = fs.Create("/path/boot/initrd")
+			Expect(err).ShouldNot(HaveOccurred())
+			el = elemental.NewElemental(config)
+		})
+		It("regenerates the initrd with dracut", func() {
+			_, err := fs.Create("/path/usr/bin/dracut")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(el.RegenerateInitrd("/path")).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"dracut", "-f", "/boot/initrd", "6.1.0-kairos"}})).To(BeNil())
+		})
+		It("falls back to mkinitrd", func() {
+			_, err := fs.Create("/path/usr/bin/mkinitrd")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(el.RegenerateInitrd("/path")).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"mkinitrd", "-k", "/boot/vmlinuz", "-i", "/boot/initrd"}})).To(BeNil())
+		})
+		It("uses the modules version of the kernel that was found", func() {
+			Expect(fs.Remove("/path/boot/vmlinuz")).To(Succeed())
+			_, err := fs.Create("/path/boot/vmlinuz-6.1.0-kairos")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(fsutils.MkdirAll(fs, "/path/lib/modules/6.9.0-kairos", cnst.DirPerm)).To(Succeed())
+			_, err = fs.Create("/path/usr/bin/dracut")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(el.RegenerateInitrd("/path")).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"dracut", "-f", "/boot/initrd", "6.1.0-kairos"}})).To(BeNil())
+		})
+		It("fails if an unversioned kernel matches several modules dirs", func() {
+			Expect(fsutils.MkdirAll(fs, "/path/lib/modules/6.9.0-kairos", cnst.DirPerm)).To(Succeed())
+			_, err := fs.Create("/path/usr/bin/dracut")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(el.RegenerateInitrd("/path")).NotTo(Succeed())
+			Expect(runner.CmdsMatch([][]string{})).To(Succeed())
+		})
+		It("fails if there is no initrd generator", func() {
+			Expect(el.RegenerateInitrd("/path")).NotTo(Succeed())
+		})
+		It("fails if the generator fails", func() {
+			_, err := fs.Create("/path/usr/bin/dracut")
+			Expect(err).ShouldNot(HaveOccurred())
+			runner.ReturnError = fmt.Errorf("dracut failed")
+			Expect(el.RegenerateInitrd("/path")).NotTo(Succeed())
+		})
+	})
 	Describe("DeactivateDevices", Label("blkdeactivate"), func() {
 		It("calls blkdeactivat", func() {
 			el := elemental.NewElemental(config)
@@ -924,4 +1305,76 @@ var _ = Describe("Elemental", Label("elemental"), func() {
 			}})).To(BeNil())
 		})
 	})
+	Describe("CloneDisk", Label("clone"), func() {
+		var el *elemental.Elemental
+		var sizes, lsblk, labels map[string]string
+		BeforeEach(func() {
+			Expect(fsutils.MkdirAll(fs, "/dev", cnst.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/dev/sda", []byte{}, cnst.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile("/dev/sdb", []byte{}, cnst.FilePerm)).To(Succeed())
+			sizes = map[string]string{"/dev/sda": "1000", "/dev/sdb": "2000"}
+			lsblk = map[string]string{"/dev/sdb": `{"blockdevices": [{"name": "/dev/sdb", "fstype": null, "label": null, "children": [
+				{"name": "/dev/sdb1", "fstype": null, "label": null},
+				{"name": "/dev/sdb2", "fstype": "vfat", "label": "COS_GRUB"},
+				{"name": "/dev/sdb3", "fstype": "ext4", "label": "COS_STATE"}]}]}`}
+			labels = map[string]string{}
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				switch cmd {
+				case "blockdev":
+					return []byte(sizes[args[len(args)-1]]), nil
+				case "blkid":
+					if args[0] == "-L" {
+						return []byte(labels[args[1]]), nil
+					}
+					return []byte("gpt\n"), nil
+				case "lsblk":
+					return []byte(lsblk[args[len(args)-1]]), nil
+				}
+				return []byte{}, nil
+			}
+			el = elemental.NewElemental(config)
+		})
+		It("clones the disk, randomizes the GPT GUIDs and marks the labels as spare", func() {
+			Expect(el.CloneDisk("/dev/sda", "/dev/sdb")).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{
+				{"dd", "if=/dev/sda", "of=/dev/sdb", "bs=4M", "conv=fsync", "status=none"},
+				{"sgdisk", "-e", "/dev/sdb"},
+				{"sgdisk", "-G", "/dev/sdb"},
+				{"fatlabel", "/dev/sdb2", "COS_GRUB_S"},
+				{"tune2fs", "-L", "COS_STATE_S", "/dev/sdb3"},
+			})).To(BeNil())
+		})
+		It("fails if the target device is smaller than the source", func() {
+			sizes["/dev/sdb"] = "500"
+			Expect(el.CloneDisk("/dev/sda", "/dev/sdb")).ToNot(Succeed())
+			Expect(runner.IncludesCmds([][]string{{"dd"}})).ToNot(BeNil())
+		})
+		It("fails if the devices are the same or missing", func() {
+			Expect(el.CloneDisk("/dev/sda", "/dev/sda")).ToNot(Succeed())
+			Expect(el.CloneDisk("/dev/sda", "/dev/sdc")).ToNot(Succeed())
+		})
+		It("promotes the spare only once the labels are free", func() {
+			lsblk["/dev/sdb"] = strings.NewReplacer(`"COS_GRUB"`, `"COS_GRUB_S"`, `"COS_STATE"`, `"COS_STATE_S"`).Replace(lsblk["/dev/sdb"])
+			labels[cnst.StateLabel] = "/dev/sda3"
+			Expect(el.PromoteSpareDisk("/dev/sdb")).To(MatchError(ContainSubstring("still in use by /dev/sda3")))
+			Expect(runner.IncludesCmds([][]string{{"tune2fs"}})).ToNot(BeNil())
+
+			delete(labels, cnst.StateLabel)
+			Expect(el.PromoteSpareDisk("/dev/sdb")).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{
+				{"fatlabel", "/dev/sdb2", "COS_GRUB"},
+				{"tune2fs", "-L", "COS_STATE", "/dev/sdb3"},
+			})).To(BeNil())
+		})
+	})
 })
+
+// tarballClient serves the same data for every download, writing it to the test filesystem
+type tarballClient struct {
+	fs   v1.FS
+	data []byte
+}
+
+func (c *tarballClient) GetURL(_ sdkTypes.KairosLogger, _ string, destination string) error {
+	return c.fs.WriteFile(destination, c.data, cnst.FilePerm)
+}
@@ -17,31 +17,221 @@ limitations under the License.
 package http
 
 import (
-	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	neturl "net/url"
+	"os"
+	"path"
+	"path/filepath"
 	"time"
 
 	"github.com/cavaliergopher/grab/v3"
 	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
 )
 
+// errResumeRefused is returned when the server answers a range request with the whole file
+var errResumeRefused = errors.New("the server did not resume the download")
+
 type Client struct {
 	client *grab.Client
+	// Retries is how many attempts in a row without any progress are made before giving up
+	Retries int
+	// Backoff is the wait before the first retry, doubled on every retry without progress
+	Backoff time.Duration
 }
 
 func NewClient() *Client {
 	client := grab.NewClient()
 	client.UserAgent = "Mozilla/5.0 (X11; Linux i686; rv:109.0) Gecko/20100101 Firefox/117.0"
 	client.HTTPClient = &http.Client{Timeout: time.Second * constants.HTTPTimeout}
-	return &Client{client: client}
+	return &Client{client: client, Retries: constants.HTTPRetries, Backoff: time.Second}
+}
+
+// SetTransport sets the transport the downloads are made with
+func (c *Client) SetTransport(transport http.RoundTripper) {
+	c.client.HTTPClient.(*http.Client).Transport = transport
+}
+
+// markerFile is the file the marker of the partial download is stored in
+func markerFile(partial string) string {
+	return partial + ".json"
+}
+
+// partialMarker is stored next to a partial download to resume it only if the remote file did not change
+type partialMarker struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Size         int64  `json:"size"`
 }
 
-// GetURL attempts to download the contents of the given URL to the given destination
+// GetURL attempts to download the contents of the given URL to the given destination. The file is downloaded
+// next to the destination with the .part suffix and moved into place once complete. Interrupted downloads are
+// resumed from it with range requests, both on the retries and on later calls, as long as its marker shows it's
+// a part of the same remote file. s3://bucket/key URLs are downloaded from S3, signed with the AWS credentials of
+// the environment.
 func (c Client) GetURL(log sdkTypes.KairosLogger, url string, destination string) error { // nolint:revive
+	if IsS3URI(url) {
+		s3, s3URL, err := c.s3Client(url)
+		if err != nil {
+			log.Errorf("Failed creating a request to '%s'", url)
+			return err
+		}
+		return s3.GetURL(log, s3URL, destination)
+	}
+	if st, err := os.Stat(destination); err == nil && st.IsDir() {
+		u, err := neturl.Parse(url)
+		if err != nil {
+			log.Errorf("Failed creating a request to '%s'", url)
+			return err
+		}
+		name := path.Base(u.Path)
+		if name == "." || name == "/" {
+			// The name is only known from the response, nothing to resume
+			_, err = c.download(log, url, destination)
+			return err
+		}
+		destination = filepath.Join(destination, name)
+	}
+
+	if _, err := grab.NewRequest(destination, url); err != nil {
+		log.Errorf("Failed creating a request to '%s'", url)
+		return err
+	}
+
+	partial := destination + constants.PartialDownloadSuffix
+	backoff := c.Backoff
+	failures := 0
+	for {
+		c.discardStalePartial(log, url, partial)
+		progress, err := c.download(log, url, partial)
+		if err == nil {
+			break
+		}
+		if errors.Is(err, errResumeRefused) || errors.Is(err, grab.ErrBadLength) {
+			// Start over, the partial file can't be resumed
+			_ = os.Remove(partial)
+			_ = os.Remove(markerFile(partial))
+		} else if !retryable(err) {
+			log.Errorf("Download failed: %v\n", err)
+			return err
+		}
+		if progress > 0 {
+			failures, backoff = 0, c.Backoff
+		}
+		failures++
+		if failures > c.Retries {
+			log.Errorf("Download failed: %v\n", err)
+			return err
+		}
+		log.Warnf("Download of %s interrupted: %s. Resuming in %s", url, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	if err := os.Rename(partial, destination); err != nil {
+		return err
+	}
+	_ = os.Remove(markerFile(partial))
+	log.Debugf("Download saved to ./%v \n", destination)
+	return nil
+}
+
+// Size returns the size of the file at url, as reported by the server
+func (c Client) Size(url string) (int64, error) {
+	if IsS3URI(url) {
+		s3, s3URL, err := c.s3Client(url)
+		if err != nil {
+			return 0, err
+		}
+		return s3.Size(s3URL)
+	}
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", c.client.UserAgent)
+	resp, err := c.client.HTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("getting the size of %s: %s", url, resp.Status)
+	}
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("the server did not report the size of %s", url)
+	}
+	return resp.ContentLength, nil
+}
+
+// discardStalePartial removes the partial download unless its marker shows it's a part of the file at url
+func (c Client) discardStalePartial(log sdkTypes.KairosLogger, url, partial string) {
+	if _, err := os.Stat(partial); err != nil {
+		return
+	}
+	marker := partialMarker{}
+	data, err := os.ReadFile(markerFile(partial))
+	if err == nil {
+		err = json.Unmarshal(data, &marker)
+	}
+	stale := err != nil || marker.URL != url
+	if !stale && (marker.ETag != "" || marker.LastModified != "") {
+		req, err := http.NewRequest(http.MethodHead, url, nil)
+		if err != nil {
+			return
+		}
+		resp, err := c.client.HTTPClient.Do(req)
+		if err != nil {
+			// Let the download fail and be retried
+			return
+		}
+		resp.Body.Close()
+		stale = resp.StatusCode == http.StatusOK &&
+			(resp.Header.Get("ETag") != marker.ETag || resp.Header.Get("Last-Modified") != marker.LastModified)
+	}
+	if stale {
+		log.Infof("Discarding the partial download %s, it's not a part of %s", partial, url)
+		_ = os.Remove(partial)
+		_ = os.Remove(markerFile(partial))
+	}
+}
+
+// download runs one attempt of downloading url into destination, resuming it if it exists.
+// It returns how many bytes were transferred.
+func (c Client) download(log sdkTypes.KairosLogger, url string, destination string) (int64, error) {
 	req, err := grab.NewRequest(destination, url)
 	if err != nil {
 		log.Errorf("Failed creating a request to '%s'", url)
-		return err
+		return 0, err
+	}
+	var start int64
+	if st, err := os.Stat(destination); err == nil && !st.IsDir() {
+		start = st.Size()
+	}
+	req.BeforeCopy = func(resp *grab.Response) error {
+		if resp.DidResume && resp.HTTPResponse.StatusCode != http.StatusPartialContent {
+			return errResumeRefused
+		}
+		if resp.DidResume {
+			log.Infof("Resuming the download of %v from %d bytes", req.URL(), resp.BytesComplete())
+			return nil
+		}
+		marker, err := json.Marshal(partialMarker{
+			URL:          url,
+			ETag:         resp.HTTPResponse.Header.Get("ETag"),
+			LastModified: resp.HTTPResponse.Header.Get("Last-Modified"),
+			Size:         resp.Size(),
+		})
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(markerFile(resp.Filename), marker, constants.FilePerm)
 	}
 
 	// start download
@@ -67,12 +257,30 @@ Loop:
 		}
 	}
 
-	// check for errors
-	if err := resp.Err(); err != nil {
-		log.Errorf("Download failed: %v\n", err)
-		return err
+	if !resp.DidResume {
+		start = 0
 	}
+	return resp.BytesComplete() - start, resp.Err()
+}
 
-	log.Debugf("Download saved to ./%v \n", resp.Filename)
-	return nil
+// retryable is true for the errors a new attempt might not hit, like a dropped connection or a server error
+func retryable(err error) bool {
+	var status grab.StatusCodeError
+	if errors.As(err, &status) {
+		return int(status) >= 500 || int(status) == http.StatusTooManyRequests || int(status) == http.StatusRequestTimeout
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	// url errors are net errors themselves, look at what failed
+	var urlErr *neturl.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
 }
@@ -17,9 +17,15 @@ limitations under the License.
 package http_test
 
 import (
-	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	"fmt"
+	nethttp "net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
+
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
 
 	"github.com/kairos-io/kairos-agent/v2/pkg/http"
 	. "github.com/onsi/ginkgo/v2"
@@ -64,4 +70,105 @@ var _ = Describe("HTTPClient", Label("http"), func() {
 		source := "scp://23412342341234.wqer.234|@#~ł€@¶|@~#"
 		Expect(client.GetURL(log, source, destDir)).NotTo(BeNil())
 	})
+	Describe("resuming downloads", func() {
+		var server *httptest.Server
+		var content string
+		var etag string
+		var ranges []string
+		var drops int
+
+		BeforeEach(func() {
+			content = strings.Repeat("kairos", 10000)
+			etag = `"v1"`
+			ranges = nil
+			drops = 0
+			client.Backoff = time.Millisecond
+			server = httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+				w.Header().Set("ETag", etag)
+				w.Header().Set("Accept-Ranges", "bytes")
+				if r.Method == nethttp.MethodHead {
+					w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+					return
+				}
+				ranges = append(ranges, r.Header.Get("Range"))
+				start := 0
+				if rng := r.Header.Get("Range"); rng != "" {
+					_, _ = fmt.Sscanf(rng, "bytes=%d-", &start)
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(content)-1, len(content)))
+					w.Header().Set("Content-Length", fmt.Sprint(len(content)-start))
+					w.WriteHeader(nethttp.StatusPartialContent)
+				} else {
+					w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+				}
+				body := content[start:]
+				if drops > 0 {
+					// Send a part and drop the connection
+					drops--
+					_, _ = w.Write([]byte(body[:len(body)/2]))
+					w.(nethttp.Flusher).Flush()
+					conn, _, _ := w.(nethttp.Hijacker).Hijack()
+					conn.Close()
+					return
+				}
+				_, _ = w.Write([]byte(body))
+			}))
+		})
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("resumes a dropped download with range requests", func() {
+			drops = 2
+			dest := filepath.Join(destDir, "image.iso")
+			Expect(client.GetURL(log, server.URL+"/image.iso", dest)).To(Succeed())
+			data, err := os.ReadFile(dest)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal(content))
+			Expect(ranges).To(HaveLen(3))
+			Expect(ranges[0]).To(BeEmpty())
+			Expect(ranges[1]).To(HavePrefix("bytes="))
+			Expect(ranges[2]).To(HavePrefix("bytes="))
+			_, err = os.Stat(dest + ".part")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("resumes a partial download left by a previous run of the same file only", func() {
+			drops = 100
+			client.Retries = 1
+			dest := filepath.Join(destDir, "image.iso")
+			Expect(client.GetURL(log, server.URL+"/image.iso", dest)).ToNot(Succeed())
+			_, err := os.Stat(dest + ".part")
+			Expect(err).ToNot(HaveOccurred())
+
+			drops, ranges = 0, nil
+			Expect(client.GetURL(log, server.URL+"/image.iso", dest)).To(Succeed())
+			Expect(ranges).To(HaveLen(1))
+			Expect(ranges[0]).To(HavePrefix("bytes="))
+			data, err := os.ReadFile(dest)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal(content))
+
+			// The remote file changed, the partial download is discarded
+			Expect(os.Remove(dest)).To(Succeed())
+			drops = 1
+			client.Retries = 0
+			Expect(client.GetURL(log, server.URL+"/image.iso", dest)).ToNot(Succeed())
+			content, etag, drops, ranges = strings.Repeat("updated", 10000), `"v2"`, 0, nil
+			Expect(client.GetURL(log, server.URL+"/image.iso", dest)).To(Succeed())
+			Expect(ranges).To(Equal([]string{""}))
+			data, err = os.ReadFile(dest)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal(content))
+		})
+
+		It("does not retry client errors", func() {
+			requests := 0
+			server.Config.Handler = nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+				requests++
+				nethttp.NotFound(w, r)
+			})
+			Expect(client.GetURL(log, server.URL+"/missing", filepath.Join(destDir, "missing"))).ToNot(Succeed())
+			Expect(requests).To(Equal(1))
+		})
+	})
 })
@@ -0,0 +1,360 @@
+package http
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// S3Scheme is the scheme of the s3://bucket/key sources
+	S3Scheme = "s3"
+	// s3DefaultRegion is the region of the buckets when none is configured
+	s3DefaultRegion = "us-east-1"
+	// s3EmptyPayload is the hash of the empty body of the GET and HEAD requests
+	s3EmptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3Algorithm    = "AWS4-HMAC-SHA256"
+	// imdsEndpoint is the EC2 instance metadata service, holding the credentials of the instance role
+	imdsEndpoint = "http://169.254.169.254"
+	imdsTimeout  = 2 * time.Second
+)
+
+// IsS3URI returns true for the s3://bucket/key URIs
+func IsS3URI(uri string) bool {
+	return strings.HasPrefix(uri, S3Scheme+"://")
+}
+
+// S3Credentials are the AWS credentials the S3 requests are signed with
+type S3Credentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"Token,omitempty"`
+}
+
+// S3Signer signs the requests to S3, or to an S3 compatible endpoint, with AWS signature version 4.
+// Without credentials the requests are sent anonymously, which is enough for public buckets.
+type S3Signer struct {
+	Region string
+	// Endpoint is the URL of an S3 compatible service, the buckets are addressed in the path of it. The AWS endpoint
+	// of the region is used if empty.
+	Endpoint    string
+	Credentials *S3Credentials
+}
+
+// NewS3Signer resolves the region, endpoint and credentials like the AWS tools do: from the AWS_* environment
+// variables, then from the profile of the shared config and credentials files and last from the instance metadata
+// service, for the nodes running in EC2 with an instance role.
+func NewS3Signer() *S3Signer {
+	profile := envOr("AWS_PROFILE", "default")
+	home, _ := os.UserHomeDir()
+	config := readAWSProfile(envOr("AWS_CONFIG_FILE", filepath.Join(home, ".aws", "config")), "profile "+profile, profile)
+	shared := readAWSProfile(envOr("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(home, ".aws", "credentials")), profile)
+
+	s := &S3Signer{
+		Region:   firstNonEmpty(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), config["region"]),
+		Endpoint: firstNonEmpty(os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL"), config["endpoint_url"]),
+	}
+	switch {
+	case os.Getenv("AWS_ACCESS_KEY_ID") != "" && os.Getenv("AWS_SECRET_ACCESS_KEY") != "":
+		s.Credentials = &S3Credentials{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+	case shared["aws_access_key_id"] != "" && shared["aws_secret_access_key"] != "":
+		s.Credentials = &S3Credentials{
+			AccessKeyID:     shared["aws_access_key_id"],
+			SecretAccessKey: shared["aws_secret_access_key"],
+			SessionToken:    shared["aws_session_token"],
+		}
+	case config["aws_access_key_id"] != "" && config["aws_secret_access_key"] != "":
+		s.Credentials = &S3Credentials{
+			AccessKeyID:     config["aws_access_key_id"],
+			SecretAccessKey: config["aws_secret_access_key"],
+			SessionToken:    config["aws_session_token"],
+		}
+	case !strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true"):
+		imds := newIMDS(envOr("AWS_EC2_METADATA_SERVICE_ENDPOINT", imdsEndpoint))
+		s.Credentials = imds.credentials()
+		if s.Region == "" && s.Credentials != nil {
+			s.Region = imds.get("/latest/meta-data/placement/region")
+		}
+	}
+	if s.Region == "" {
+		s.Region = s3DefaultRegion
+	}
+	return s
+}
+
+// URL returns the HTTPS URL of the s3://bucket/key URI
+func (s *S3Signer) URL(uri string) (string, error) {
+	u, err := neturl.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != S3Scheme || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return "", fmt.Errorf("invalid S3 URI %s, expected s3://bucket/key", uri)
+	}
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if s.Endpoint != "" {
+		return strings.TrimSuffix(s.Endpoint, "/") + "/" + bucket + "/" + key, nil
+	}
+	host := "s3.amazonaws.com"
+	if s.Region != s3DefaultRegion {
+		host = fmt.Sprintf("s3.%s.amazonaws.com", s.Region)
+	}
+	// The virtual host of buckets with dots does not match the certificate of the endpoint
+	if strings.Contains(bucket, ".") {
+		return fmt.Sprintf("https://%s/%s/%s", host, bucket, key), nil
+	}
+	return fmt.Sprintf("https://%s.%s/%s", bucket, host, key), nil
+}
+
+// Sign adds the signature version 4 headers to the request, which has no body
+func (s *S3Signer) Sign(req *http.Request) {
+	s.SignAt(req, time.Now())
+}
+
+// SignAt signs the request as sent at the given time
+func (s *S3Signer) SignAt(req *http.Request, at time.Time) {
+	if s.Credentials == nil {
+		return
+	}
+	t := at.UTC()
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", s3EmptyPayload)
+	if s.Credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.Credentials.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		s3EmptyPayload,
+	}, "\n")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.Region)
+	stringToSign := strings.Join([]string{s3Algorithm, t.Format("20060102T150405Z"), scope, sha256Hex(canonicalRequest)}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.Credentials.SecretAccessKey), date)
+	for _, part := range []string{s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.Credentials.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// s3Transport signs the requests sent through it
+type s3Transport struct {
+	base   http.RoundTripper
+	signer *S3Signer
+}
+
+func (t *s3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the request
+	req = req.Clone(req.Context())
+	t.signer.Sign(req)
+	return t.base.RoundTrip(req)
+}
+
+// s3Client returns a copy of the client signing its requests for S3, and the HTTPS URL of the s3:// URI
+func (c Client) s3Client(uri string) (Client, string, error) {
+	signer := NewS3Signer()
+	url, err := signer.URL(uri)
+	if err != nil {
+		return c, "", err
+	}
+	grabClient := *c.client
+	httpClient := *grabClient.HTTPClient.(*http.Client)
+	base := httpClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	httpClient.Transport = &s3Transport{base: base, signer: signer}
+	grabClient.HTTPClient = &httpClient
+	c.client = &grabClient
+	return c, url, nil
+}
+
+// s3EscapePath encodes every segment of the path as S3 expects in the canonical request
+func s3EscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		segments[i] = s3Escape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3CanonicalQuery(query neturl.Values) string {
+	var params []string
+	for k, values := range query {
+		for _, v := range values {
+			params = append(params, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// s3Escape percent encodes all but the unreserved characters of RFC 3986
+func s3Escape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// readAWSProfile returns the keys of the first of the given sections found in the AWS ini file
+func readAWSProfile(file string, sections ...string) map[string]string {
+	f, err := os.Open(file)
+	if err != nil {
+		return map[string]string{}
+	}
+	defer f.Close()
+	all := map[string]map[string]string{}
+	current := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			current = strings.TrimSpace(strings.Trim(line, "[]"))
+			if all[current] == nil {
+				all[current] = map[string]string{}
+			}
+		default:
+			if k, v, ok := strings.Cut(line, "="); ok && current != "" {
+				all[current][strings.TrimSpace(k)] = strings.TrimSpace(v)
+			}
+		}
+	}
+	for _, s := range sections {
+		if keys, ok := all[s]; ok {
+			return keys
+		}
+	}
+	return map[string]string{}
+}
+
+// imds is a client of the instance metadata service, using the session tokens of IMDSv2
+type imds struct {
+	endpoint string
+	client   *http.Client
+	token    string
+}
+
+func newIMDS(endpoint string) *imds {
+	i := &imds{endpoint: strings.TrimSuffix(endpoint, "/"), client: &http.Client{Timeout: imdsTimeout}}
+	req, err := http.NewRequest(http.MethodPut, i.endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return i
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	if resp, err := i.client.Do(req); err == nil {
+		defer resp.Body.Close()
+		if data, err := io.ReadAll(resp.Body); err == nil && resp.StatusCode == http.StatusOK {
+			i.token = string(data)
+		}
+	}
+	return i
+}
+
+// get returns the metadata at path, empty if it can't be read
+func (i *imds) get(path string) string {
+	req, err := http.NewRequest(http.MethodGet, i.endpoint+path, nil)
+	if err != nil {
+		return ""
+	}
+	if i.token != "" {
+		req.Header.Set("X-aws-ec2-metadata-token", i.token)
+	}
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// credentials returns the temporary credentials of the instance role, nil without one
+func (i *imds) credentials() *S3Credentials {
+	role := strings.SplitN(i.get("/latest/meta-data/iam/security-credentials/"), "\n", 2)[0]
+	if role == "" {
+		return nil
+	}
+	creds := &S3Credentials{}
+	if json.Unmarshal([]byte(i.get("/latest/meta-data/iam/security-credentials/"+role)), creds) != nil || creds.AccessKeyID == "" {
+		return nil
+	}
+	return creds
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,93 @@
+package http
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// throttleSlices is how many reads a second of throttled bandwidth is split in at most, so the transfer is smooth
+// instead of bursting and then waiting
+const throttleSlices = 10
+
+// bandwidthLimiter spaces the reads of all the bodies sharing it so together they don't exceed the rate
+type bandwidthLimiter struct {
+	mu   sync.Mutex
+	rate int64
+	next time.Time
+}
+
+// wait blocks for the time reading n bytes takes at the rate, after the reads before it
+func (l *bandwidthLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	// Unused bandwidth is not accumulated for later bursts
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	d := l.next.Sub(now)
+	l.mu.Unlock()
+	time.Sleep(d)
+}
+
+// chunk is the largest read allowed at once
+func (l *bandwidthLimiter) chunk() int {
+	if c := l.rate / throttleSlices; c > 0 {
+		return int(c)
+	}
+	return 1
+}
+
+type throttledTransport struct {
+	base    http.RoundTripper
+	limiter *bandwidthLimiter
+}
+
+// NewThrottledTransport returns a transport limiting the bandwidth of the response bodies of base, the default
+// transport if nil, to the given bytes per second. The limit is shared by all the requests made with it.
+func NewThrottledTransport(base http.RoundTripper, bytesPerSecond int64) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &throttledTransport{base: base, limiter: &bandwidthLimiter{rate: bytesPerSecond}}
+}
+
+func (t *throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.Body == nil {
+		return resp, err
+	}
+	resp.Body = &throttledBody{ReadCloser: resp.Body, limiter: t.limiter}
+	return resp, nil
+}
+
+// CloseIdleConnections closes the idle connections of the base transport
+func (t *throttledTransport) CloseIdleConnections() {
+	if c, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+type throttledBody struct {
+	io.ReadCloser
+	limiter *bandwidthLimiter
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	if len(p) > b.limiter.chunk() {
+		p = p[:b.limiter.chunk()]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.limiter.wait(n)
+	}
+	return n, err
+}
+
+// SetMaxBandwidth limits the bandwidth of the downloads to the given bytes per second
+func (c *Client) SetMaxBandwidth(bytesPerSecond int64) {
+	client := c.client.HTTPClient.(*http.Client)
+	client.Transport = NewThrottledTransport(client.Transport, bytesPerSecond)
+}
@@ -0,0 +1,39 @@
+package http_test
+
+import (
+	"io"
+	nethttp "net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/http"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ThrottledTransport", Label("http", "throttle"), func() {
+	It("limits the bandwidth shared by all the responses", func() {
+		server := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, _ *nethttp.Request) {
+			_, _ = w.Write(make([]byte, 10000))
+		}))
+		defer server.Close()
+
+		client := &nethttp.Client{Transport: http.NewThrottledTransport(nil, 40000)}
+		start := time.Now()
+		done := make(chan int64, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				defer GinkgoRecover()
+				resp, err := client.Get(server.URL)
+				Expect(err).ToNot(HaveOccurred())
+				defer resp.Body.Close()
+				n, err := io.Copy(io.Discard, resp.Body)
+				Expect(err).ToNot(HaveOccurred())
+				done <- n
+			}()
+		}
+		Expect(<-done + <-done).To(Equal(int64(20000)))
+		// 20000 bytes at 40000 B/s
+		Expect(time.Since(start)).To(BeNumerically(">=", 450*time.Millisecond))
+	})
+})
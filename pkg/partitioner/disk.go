@@ -16,6 +16,8 @@ import (
 type Disk struct {
 	*disk.Disk
 	logger sdkTypes.KairosLogger
+	// arch is the arch of the installed image, used for the arch specific partition types
+	arch string
 }
 
 func (d *Disk) NewPartitionTable(partType string, parts sdkTypes.PartitionList) error {
@@ -23,10 +25,14 @@ func (d *Disk) NewPartitionTable(partType string, parts sdkTypes.PartitionList)
 	var table partition.Table
 	switch partType {
 	case v1.GPT:
+		partitions, err := kairosPartsToDiskfsGPTParts(parts, d.Size, d.LogicalBlocksize, d.arch)
+		if err != nil {
+			return err
+		}
 		table = &gpt.Table{
 			ProtectiveMBR:      true,
 			GUID:               cnst.DiskUUID, // Set know predictable UUID
-			Partitions:         kairosPartsToDiskfsGPTParts(parts, d.Size, d.LogicalBlocksize),
+			Partitions:         partitions,
 			LogicalSectorSize:  int(d.LogicalBlocksize),
 			PhysicalSectorSize: int(d.PhysicalBlocksize),
 		}
@@ -45,7 +51,7 @@ func getSectorEndFromSize(start, size uint64, sectorSize int64) uint64 {
 	return (size / uint64(sectorSize)) + start - 1
 }
 
-func kairosPartsToDiskfsGPTParts(parts sdkTypes.PartitionList, diskSize int64, sectorSize int64) []*gpt.Partition {
+func kairosPartsToDiskfsGPTParts(parts sdkTypes.PartitionList, diskSize int64, sectorSize int64, arch string) ([]*gpt.Partition, error) {
 	var partitions []*gpt.Partition
 	for index, part := range parts {
 		var start uint64
@@ -82,41 +88,50 @@ func kairosPartsToDiskfsGPTParts(parts sdkTypes.PartitionList, diskSize int64, s
 
 		end = getSectorEndFromSize(start, size, sectorSize)
 
-		if part.Name == cnst.EfiPartName && part.FS == cnst.EfiFs {
+		var partType gpt.Type
+		var attributes uint64
+		switch {
+		case part.Name == cnst.EfiPartName && part.FS == cnst.EfiFs:
 			// EFI boot partition
-			partitions = append(partitions, &gpt.Partition{
-				Start:      start,
-				End:        end,
-				Type:       gpt.EFISystemPartition,
-				Size:       size,                                                         // partition size in bytes
-				GUID:       uuid.NewV5(uuid.NamespaceURL, part.FilesystemLabel).String(), // set know predictable UUID
-				Name:       part.Name,
-				Attributes: 0x1, // system partition flag
-			})
-		} else if part.Name == cnst.BiosPartName {
+			partType = gpt.EFISystemPartition
+			attributes = 0x1 // system partition flag
+		case part.Name == cnst.BiosPartName:
 			// Non-EFI boot partition
-			partitions = append(partitions, &gpt.Partition{
-				Start:      start,
-				End:        end,
-				Type:       gpt.BIOSBoot,
-				Size:       size,                                                         // partition size in bytes
-				GUID:       uuid.NewV5(uuid.NamespaceURL, part.FilesystemLabel).String(), // set know predictable UUID
-				Name:       part.Name,
-				Attributes: 0x4, // legacy bios bootable flag
-			})
-		} else {
+			partType = gpt.BIOSBoot
+			attributes = 0x4 // legacy bios bootable flag
+		default:
 			// Other partitions
-			partitions = append(partitions, &gpt.Partition{
-				Start: start,
-				End:   end,
-				Type:  gpt.LinuxFilesystem,
-				Size:  size,
-				GUID:  uuid.NewV5(uuid.NamespaceURL, part.FilesystemLabel).String(),
-				Name:  part.Name,
-			})
+			partType = gpt.LinuxFilesystem
+		}
+		settings, err := gptSettingsFromFlags(part.Flags, arch)
+		if err != nil {
+			return nil, fmt.Errorf("partition %s: %w", part.Name, err)
+		}
+		if settings.partType != "" {
+			partType = settings.partType
+		}
+		attributes |= settings.attributes
+
+		guid := uuid.NewV5(uuid.NamespaceURL, part.FilesystemLabel).String() // set know predictable UUID
+		if part.UUID != "" {
+			u, err := uuid.FromString(part.UUID)
+			if err != nil {
+				return nil, fmt.Errorf("partition %s: invalid uuid %s: %w", part.Name, part.UUID, err)
+			}
+			guid = u.String()
 		}
+
+		partitions = append(partitions, &gpt.Partition{
+			Start:      start,
+			End:        end,
+			Type:       partType,
+			Size:       size, // partition size in bytes
+			GUID:       guid,
+			Name:       part.Name,
+			Attributes: attributes,
+		})
 	}
-	return partitions
+	return partitions, nil
 }
 
 type DiskOptions func(d *Disk) error
@@ -128,12 +143,20 @@ func WithLogger(logger sdkTypes.KairosLogger) func(d *Disk) error {
 	}
 }
 
+// WithArch sets the arch of the installed image
+func WithArch(arch string) func(d *Disk) error {
+	return func(d *Disk) error {
+		d.arch = arch
+		return nil
+	}
+}
+
 func NewDisk(device string, opts ...DiskOptions) (*Disk, error) {
 	d, err := diskfs.Open(device)
 	if err != nil {
 		return nil, err
 	}
-	dev := &Disk{d, sdkTypes.NewKairosLogger("partitioner", "info", false)}
+	dev := &Disk{Disk: d, logger: sdkTypes.NewKairosLogger("partitioner", "info", false)}
 
 	for _, opt := range opts {
 		if err := opt(dev); err != nil {
@@ -0,0 +1,117 @@
+package partitioner
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/gofrs/uuid"
+)
+
+// Partition flags setting the GPT partition type and attributes, i.e. flags: ["type=linux-home", "attr=no-auto"].
+// Other flags are left alone.
+const (
+	TypeFlagPrefix = "type="
+	AttrFlagPrefix = "attr="
+)
+
+// gptTypeAliases are the partition types that can be set by name instead of by GUID
+var gptTypeAliases = map[string]gpt.Type{
+	"esp":              gpt.EFISystemPartition,
+	"bios-boot":        gpt.BIOSBoot,
+	"linux":            gpt.LinuxFilesystem,
+	"linux-swap":       gpt.LinuxSwap,
+	"linux-home":       gpt.LinuxHome,
+	"linux-srv":        gpt.LinuxServerData,
+	"linux-lvm":        gpt.LinuxLVM,
+	"linux-raid":       gpt.LinuxRAID,
+	"linux-luks":       gpt.LinuxLUKS,
+	"linux-xbootldr":   gpt.LinuxExtendedBoot,
+	"linux-root-x86":   gpt.LinuxRootX86,
+	"linux-root-amd64": gpt.LinuxRootX86_64,
+	"linux-root-arm":   gpt.LinuxRootArm,
+	"linux-root-arm64": gpt.LinuxRootArm64,
+}
+
+// dpsRootAlias is the partition type alias resolved to the root partition type of the arch of the installed image
+const dpsRootAlias = "linux-root"
+
+// dpsRootTypes are the root partition types of the discoverable partitions specification for each arch
+var dpsRootTypes = map[string]gpt.Type{
+	"amd64":   gpt.LinuxRootX86_64,
+	"x86_64":  gpt.LinuxRootX86_64,
+	"386":     gpt.LinuxRootX86,
+	"arm64":   gpt.LinuxRootArm64,
+	"arm":     gpt.LinuxRootArm,
+	"riscv64": "72EC70A6-CF74-40E6-BD49-4BDA08E8F224",
+	"ppc64le": "C31C45E6-3F39-412E-80FB-4809C4980599",
+	"s390x":   "5EEAD9A9-FE09-4A1E-A1D7-520D00531306",
+}
+
+// DPSRootType returns the discoverable partitions specification root partition type for the given arch, falling
+// back to the generic linux data type for arches without one
+func DPSRootType(arch string) gpt.Type {
+	if t, ok := dpsRootTypes[strings.ToLower(arch)]; ok {
+		return t
+	}
+	return gpt.LinuxFilesystem
+}
+
+// gptAttributeBits are the GPT attribute bits that can be set by name, as defined by the UEFI spec and the
+// discoverable partitions specification. Any bit can also be set by number, i.e. attr=48.
+var gptAttributeBits = map[string]uint{
+	"required":    0,
+	"no-block-io": 1,
+	"legacy-boot": 2,
+	"grow-fs":     59,
+	"read-only":   60,
+	"hidden":      62,
+	"no-auto":     63,
+}
+
+// gptSettings holds the GPT settings of a partition parsed from its flags
+type gptSettings struct {
+	partType   gpt.Type
+	attributes uint64
+}
+
+// gptSettingsFromFlags parses the type= and attr= partition flags, arch is the arch of the installed image
+func gptSettingsFromFlags(flags []string, arch string) (gptSettings, error) {
+	var settings gptSettings
+	for _, flag := range flags {
+		switch {
+		case strings.HasPrefix(flag, TypeFlagPrefix):
+			value := strings.TrimPrefix(flag, TypeFlagPrefix)
+			if strings.EqualFold(value, dpsRootAlias) {
+				if arch == "" {
+					return settings, fmt.Errorf("partition type %s needs the arch of the installed image", value)
+				}
+				settings.partType = DPSRootType(arch)
+				continue
+			}
+			if t, ok := gptTypeAliases[strings.ToLower(value)]; ok {
+				settings.partType = t
+				continue
+			}
+			u, err := uuid.FromString(value)
+			if err != nil {
+				return settings, fmt.Errorf("invalid partition type %s: not a known type nor a GUID", value)
+			}
+			settings.partType = gpt.Type(strings.ToUpper(u.String()))
+		case strings.HasPrefix(flag, AttrFlagPrefix):
+			for _, attr := range strings.Split(strings.TrimPrefix(flag, AttrFlagPrefix), ",") {
+				bit, ok := gptAttributeBits[strings.ToLower(attr)]
+				if !ok {
+					n, err := strconv.ParseUint(attr, 10, 8)
+					if err != nil || n > 63 {
+						return settings, fmt.Errorf("invalid partition attribute %s: not a known attribute nor a bit number from 0 to 63", attr)
+					}
+					bit = uint(n)
+				}
+				settings.attributes |= 1 << bit
+			}
+		}
+	}
+	return settings, nil
+}
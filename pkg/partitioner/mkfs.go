@@ -19,6 +19,7 @@ package partitioner
 import (
 	"fmt"
 	"regexp"
+	"strings"
 
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
 )
@@ -40,6 +41,7 @@ func (mkfs MkfsCall) buildOptions() ([]string, error) {
 
 	linuxFS, _ := regexp.MatchString("ext[2-4]|xfs", mkfs.fileSystem)
 	fatFS, _ := regexp.MatchString("fat|vfat", mkfs.fileSystem)
+	f2FS := mkfs.fileSystem == "f2fs"
 
 	switch {
 	case linuxFS:
@@ -51,6 +53,15 @@ func (mkfs MkfsCall) buildOptions() ([]string, error) {
 			opts = append(opts, mkfs.customOpts...)
 		}
 		opts = append(opts, mkfs.dev)
+	case f2FS:
+		if mkfs.label != "" {
+			opts = append(opts, "-l")
+			opts = append(opts, mkfs.label)
+		}
+		if len(mkfs.customOpts) > 0 {
+			opts = append(opts, mkfs.customOpts...)
+		}
+		opts = append(opts, mkfs.dev)
 	case fatFS:
 		if mkfs.label != "" {
 			opts = append(opts, "-n")
@@ -85,3 +96,16 @@ func FormatDevice(runner v1.Runner, device string, fileSystem string, label stri
 	}
 	return err
 }
+
+// TuneDevice applies the tuning options mkfs can't set to the filesystem in device, if any
+func TuneDevice(runner v1.Runner, device string, fileSystem string, tuning *v1.FilesystemTuning) error {
+	opts := tuning.Tune2fsOptions(fileSystem)
+	if len(opts) == 0 {
+		return nil
+	}
+	out, err := runner.Run("tune2fs", append(opts, device)...)
+	if err != nil {
+		return fmt.Errorf("tuning the filesystem of %s: %s: %w", device, strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
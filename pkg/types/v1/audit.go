@@ -0,0 +1,162 @@
+/*
+Copyright © 2022 - 2023 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	FindingWorldWritable = "world-writable"
+	FindingSetuid        = "setuid"
+	FindingPermissions   = "permissions"
+)
+
+// DefaultSetuidAllowlist are the setuid and setgid binaries a Kairos image usually ships
+var DefaultSetuidAllowlist = []string{
+	"/usr/bin/su", "/bin/su",
+	"/usr/bin/sudo",
+	"/usr/bin/passwd", "/usr/bin/chsh", "/usr/bin/chfn", "/usr/bin/gpasswd", "/usr/bin/newgrp",
+	"/usr/bin/mount", "/bin/mount", "/usr/bin/umount", "/bin/umount",
+	"/usr/bin/newuidmap", "/usr/bin/newgidmap",
+	"/usr/bin/expiry", "/usr/bin/chage", "/usr/sbin/unix_chkpwd", "/sbin/unix_chkpwd",
+	"/usr/bin/pkexec", "/usr/lib/polkit-1/polkit-agent-helper-1",
+	"/usr/lib/dbus-1.0/dbus-daemon-launch-helper",
+	"/usr/bin/wall", "/usr/bin/write", "/usr/bin/crontab", "/usr/bin/ssh-agent",
+	"/usr/lib/openssh/ssh-keysign", "/usr/libexec/openssh/ssh-keysign",
+	"/usr/bin/fusermount", "/usr/bin/fusermount3",
+}
+
+// criticalPermissions are the paths whose permissions must not have the forbidden bits set, or must have the
+// required ones. Missing paths are not reported.
+var criticalPermissions = []struct {
+	path      string
+	forbidden fs.FileMode
+	required  fs.FileMode
+}{
+	{path: "/etc/shadow", forbidden: 0007},
+	{path: "/etc/gshadow", forbidden: 0007},
+	{path: "/etc/passwd", forbidden: 0022},
+	{path: "/etc/group", forbidden: 0022},
+	{path: "/etc/sudoers", forbidden: 0027},
+	{path: "/root", forbidden: 0007},
+	{path: "/tmp", required: fs.ModeSticky},
+	{path: "/var/tmp", required: fs.ModeSticky},
+}
+
+// PermissionsAudit scans the deployed images for world-writable files, setuid binaries not allowed and critical
+// files with wrong permissions
+type PermissionsAudit struct {
+	// SetuidAllowlist are the setuid and setgid binaries allowed on top of DefaultSetuidAllowlist
+	SetuidAllowlist []string `yaml:"setuid-allowlist,omitempty" mapstructure:"setuid-allowlist"`
+	// Strict fails the deployment if there are findings, they are only reported otherwise
+	Strict bool `yaml:"strict,omitempty" mapstructure:"strict"`
+}
+
+// PermissionsFinding is a file flagged by the permissions audit
+type PermissionsFinding struct {
+	Path   string `json:"path" yaml:"path"`
+	Mode   string `json:"mode" yaml:"mode"`
+	Kind   string `json:"kind" yaml:"kind"`
+	Detail string `json:"detail" yaml:"detail"`
+}
+
+// PermissionsReport is the result of a permissions audit of a system tree
+type PermissionsReport struct {
+	Root     string               `json:"root" yaml:"root"`
+	Time     time.Time            `json:"time" yaml:"time"`
+	Findings []PermissionsFinding `json:"findings" yaml:"findings"`
+}
+
+// Audit walks the system tree at root and reports the files that break the audit rules. The excluded paths,
+// relative to root, are checked themselves but not descended into, as for the pseudo filesystems of a running system.
+func (p PermissionsAudit) Audit(vfs FS, root string, excluded ...string) (*PermissionsReport, error) {
+	allowed := map[string]bool{}
+	for _, path := range append(append([]string{}, DefaultSetuidAllowlist...), p.SetuidAllowlist...) {
+		allowed[filepath.Clean("/"+path)] = true
+	}
+	skip := map[string]bool{}
+	for _, path := range excluded {
+		skip[filepath.Clean("/"+path)] = true
+	}
+
+	report := &PermissionsReport{Root: root, Time: time.Now(), Findings: []PermissionsFinding{}}
+	err := auditDir(vfs, root, "/", func(path string, info fs.FileInfo) bool {
+		mode := info.Mode()
+		switch {
+		case mode&fs.ModeSymlink != 0:
+		case mode.IsDir() && mode&0002 != 0 && mode&fs.ModeSticky == 0:
+			report.add(path, mode, FindingWorldWritable, "directory is world-writable without the sticky bit")
+		case mode.IsRegular() && mode&0002 != 0:
+			report.add(path, mode, FindingWorldWritable, "file is world-writable")
+		}
+		if mode.IsRegular() && mode&(fs.ModeSetuid|fs.ModeSetgid) != 0 && !allowed[path] {
+			report.add(path, mode, FindingSetuid, "setuid or setgid binary not in the allowlist")
+		}
+		return !skip[path]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range criticalPermissions {
+		info, err := vfs.Lstat(filepath.Join(root, c.path))
+		if err != nil {
+			continue
+		}
+		mode := info.Mode()
+		if mode&c.forbidden != 0 {
+			report.add(c.path, mode, FindingPermissions, fmt.Sprintf("must not have the %s permissions", c.forbidden.Perm()))
+		}
+		if mode&c.required != c.required {
+			report.add(c.path, mode, FindingPermissions, "must have the sticky bit")
+		}
+	}
+	return report, nil
+}
+
+func (r *PermissionsReport) add(path string, mode fs.FileMode, kind, detail string) {
+	r.Findings = append(r.Findings, PermissionsFinding{Path: path, Mode: mode.String(), Kind: kind, Detail: detail})
+}
+
+// auditDir calls check for every entry under the dir path of the tree at root, descending into the
+// directories check returns true for
+func auditDir(vfs FS, root, path string, check func(path string, info fs.FileInfo) bool) error {
+	entries, err := vfs.ReadDir(filepath.Join(root, path))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		entryPath := filepath.Join(path, entry.Name())
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if check(entryPath, info) && info.IsDir() {
+			if err = auditDir(vfs, root, entryPath, check); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+/*
+Copyright © 2022 - 2023 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1_test
+
+import (
+	"io/fs"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v5/vfst"
+)
+
+var _ = Describe("PermissionsAudit", Label("types", "audit"), func() {
+	var tfs *vfst.TestFS
+	var cleanup func()
+	BeforeEach(func() {
+		var err error
+		tfs, cleanup, err = vfst.NewTestFS(map[string]interface{}{
+			"/root/etc/shadow":      "",
+			"/root/etc/passwd":      "",
+			"/root/usr/bin/sudo":    "",
+			"/root/usr/bin/tool":    "",
+			"/root/usr/bin/ls":      "",
+			"/root/var/log/open":    "",
+			"/root/tmp/scratch":     "",
+			"/root/proc/1/writable": "",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		for path, mode := range map[string]fs.FileMode{
+			"/root/etc/shadow":      0640,
+			"/root/etc/passwd":      0644,
+			"/root/usr/bin/sudo":    0755 | fs.ModeSetuid,
+			"/root/usr/bin/tool":    0755 | fs.ModeSetuid,
+			"/root/usr/bin/ls":      0755,
+			"/root/var/log/open":    0666,
+			"/root/tmp":             0777 | fs.ModeSticky,
+			"/root/tmp/scratch":     0644,
+			"/root/proc/1/writable": 0666,
+		} {
+			Expect(tfs.Chmod(path, mode)).To(Succeed())
+		}
+	})
+	AfterEach(func() { cleanup() })
+
+	It("accepts a tree without risky permissions", func() {
+		Expect(tfs.Chmod("/root/usr/bin/tool", 0755)).To(Succeed())
+		Expect(tfs.Chmod("/root/var/log/open", 0644)).To(Succeed())
+		report, err := v1.PermissionsAudit{}.Audit(tfs, "/root", "/proc")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(report.Findings).To(BeEmpty())
+	})
+	It("flags world-writable files, setuid binaries not allowed and critical files with wrong permissions", func() {
+		Expect(tfs.Chmod("/root/etc/shadow", 0644)).To(Succeed())
+		Expect(tfs.Chmod("/root/tmp", 0777)).To(Succeed())
+		report, err := v1.PermissionsAudit{}.Audit(tfs, "/root", "/proc")
+		Expect(err).ToNot(HaveOccurred())
+
+		findings := map[string]string{}
+		for _, f := range report.Findings {
+			findings[f.Path] = f.Kind
+		}
+		Expect(findings).To(Equal(map[string]string{
+			"/var/log/open": v1.FindingWorldWritable,
+			"/usr/bin/tool": v1.FindingSetuid,
+			"/etc/shadow":   v1.FindingPermissions,
+			"/tmp":          v1.FindingPermissions,
+		}))
+	})
+	It("allows the setuid binaries in the allowlist", func() {
+		report, err := v1.PermissionsAudit{SetuidAllowlist: []string{"usr/bin/tool"}}.Audit(tfs, "/root", "/proc")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(report.Findings).To(HaveLen(1))
+		Expect(report.Findings[0].Path).To(Equal("/var/log/open"))
+	})
+})
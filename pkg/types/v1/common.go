@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"net/url"
 	"path/filepath"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 
@@ -31,6 +32,14 @@ const (
 	oci    = "oci"
 	file   = "file"
 	dir    = "dir"
+	// containerd and podman sources are images exported from the local container runtime store
+	containerd = "containerd"
+	podman     = "podman"
+	// s3 sources are files in an S3 bucket, like s3://bucket/key
+	s3 = "s3"
+	// http and https sources are tarballs of the system tree, the source is the whole URL
+	httpScheme  = "http"
+	httpsScheme = "https"
 )
 
 // ImageSource represents the source from where an image is created for easy identification
@@ -55,6 +64,45 @@ func (i ImageSource) IsFile() bool {
 	return i.srcType == file
 }
 
+// IsS3 returns true if the image is a file in an S3 bucket
+func (i ImageSource) IsS3() bool {
+	return i.srcType == s3
+}
+
+// IsTarball returns true if the image is a tarball of the system tree downloaded over HTTP(S)
+func (i ImageSource) IsTarball() bool {
+	return i.srcType == httpScheme || i.srcType == httpsScheme
+}
+
+// IsContainerStore returns true if the image is exported from the local containerd or podman store
+func (i ImageSource) IsContainerStore() bool {
+	return i.srcType == containerd || i.srcType == podman
+}
+
+// ContainerRuntime returns the container runtime whose store holds the image, empty for other sources
+func (i ImageSource) ContainerRuntime() string {
+	if i.IsContainerStore() {
+		return i.srcType
+	}
+	return ""
+}
+
+// Digest returns the digest the image is pinned to, like `sha256:...` for `oci:repo/image@sha256:...`, empty for
+// the images referenced by tag and the other sources
+func (i ImageSource) Digest() string {
+	if !i.IsDocker() {
+		return ""
+	}
+	n, err := reference.ParseNormalizedNamed(i.source)
+	if err != nil {
+		return ""
+	}
+	if digested, ok := n.(reference.Digested); ok {
+		return digested.Digest().String()
+	}
+	return ""
+}
+
 func (i ImageSource) IsEmpty() bool {
 	if i.srcType == "" {
 		return true
@@ -69,6 +117,9 @@ func (i ImageSource) String() string {
 	if i.IsEmpty() {
 		return ""
 	}
+	if i.IsTarball() {
+		return i.source
+	}
 	return fmt.Sprintf("%s://%s", i.srcType, i.source)
 }
 
@@ -108,6 +159,26 @@ func (i *ImageSource) updateFromURI(uri string) error {
 	case file:
 		i.srcType = file
 		i.source = value
+	case s3:
+		if u.Host == "" || strings.Trim(u.Path, "/") == "" {
+			return fmt.Errorf("invalid S3 source %s, expected s3://bucket/key", uri)
+		}
+		i.srcType = s3
+		i.source = value
+	case httpScheme, httpsScheme:
+		if u.Host == "" {
+			return fmt.Errorf("invalid tarball source %s", uri)
+		}
+		i.srcType = scheme
+		i.source = uri
+	case containerd, podman:
+		// The runtimes store the images with their fully qualified names
+		n, err := reference.ParseNormalizedNamed(value)
+		if err != nil {
+			return fmt.Errorf("invalid image reference %s", value)
+		}
+		i.srcType = scheme
+		i.source = reference.TagNameOnly(n).String()
 	default:
 		return i.parseImageReference(uri)
 	}
@@ -144,6 +215,10 @@ func NewFileSrc(src string) *ImageSource {
 	return &ImageSource{source: src, srcType: file}
 }
 
+func NewS3Src(src string) *ImageSource {
+	return &ImageSource{source: src, srcType: s3}
+}
+
 func NewDirSrc(src string) *ImageSource {
 	return &ImageSource{source: src, srcType: dir}
 }
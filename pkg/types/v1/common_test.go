@@ -23,6 +23,7 @@ import (
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"gopkg.in/yaml.v3"
+	"strings"
 )
 
 var _ = Describe("Types", Label("types", "common"), func() {
@@ -50,6 +51,62 @@ var _ = Describe("Types", Label("types", "common"), func() {
 			Expect(err).ShouldNot(HaveOccurred())
 			Expect(o.Value()).To(Equal("registry.company.org/image:tag"))
 		})
+		It("parses the container runtime store sources", func() {
+			o, err := v1.NewSrcFromURI("containerd:quay.io/kairos/opensuse:v3.2.1")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(o.IsContainerStore()).To(BeTrue())
+			Expect(o.IsDocker()).To(BeFalse())
+			Expect(o.ContainerRuntime()).To(Equal("containerd"))
+			Expect(o.Value()).To(Equal("quay.io/kairos/opensuse:v3.2.1"))
+			// The stores hold fully qualified names
+			o, err = v1.NewSrcFromURI("podman://kairos")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(o.ContainerRuntime()).To(Equal("podman"))
+			Expect(o.Value()).To(Equal("docker.io/library/kairos:latest"))
+			o, err = v1.NewSrcFromURI(o.String())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(o.String()).To(Equal("podman://docker.io/library/kairos:latest"))
+			_, err = v1.NewSrcFromURI("containerd:Invalid:Ref:")
+			Expect(err).Should(HaveOccurred())
+			Expect(v1.NewDockerSrc("image").ContainerRuntime()).To(BeEmpty())
+		})
+		It("parses the images pinned by digest", func() {
+			digest := "sha256:" + strings.Repeat("ab", 32)
+			o, err := v1.NewSrcFromURI("oci:quay.io/kairos/opensuse@" + digest)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(o.IsDocker()).To(BeTrue())
+			Expect(o.Value()).To(Equal("quay.io/kairos/opensuse@" + digest))
+			Expect(o.Digest()).To(Equal(digest))
+			o, err = v1.NewSrcFromURI("oci://quay.io/kairos/opensuse:v3.2.1@" + digest)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(o.Digest()).To(Equal(digest))
+			Expect(v1.NewDockerSrc("quay.io/kairos/opensuse:v3.2.1").Digest()).To(BeEmpty())
+			Expect(v1.NewDirSrc("/some/dir").Digest()).To(BeEmpty())
+			_, err = v1.NewSrcFromURI("oci:quay.io/kairos/opensuse@sha256:short")
+			Expect(err).Should(HaveOccurred())
+		})
+		It("parses the S3 sources", func() {
+			o, err := v1.NewSrcFromURI("s3://kairos-images/releases/kairos-v3.2.1.tar")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(o.IsS3()).To(BeTrue())
+			Expect(o.IsFile()).To(BeFalse())
+			Expect(o.Value()).To(Equal("kairos-images/releases/kairos-v3.2.1.tar"))
+			Expect(o.String()).To(Equal("s3://kairos-images/releases/kairos-v3.2.1.tar"))
+			_, err = v1.NewSrcFromURI("s3://kairos-images")
+			Expect(err).Should(HaveOccurred())
+		})
+		It("parses the tarball sources", func() {
+			uri := "https://server/images/rootfs.tar.zst?arch=amd64#sha256=abcd"
+			o, err := v1.NewSrcFromURI(uri)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(o.IsTarball()).To(BeTrue())
+			Expect(o.IsDocker()).To(BeFalse())
+			Expect(o.Value()).To(Equal(uri))
+			Expect(o.String()).To(Equal(uri))
+			o, err = v1.NewSrcFromURI("http://server/rootfs.tar")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(o.IsTarball()).To(BeTrue())
+		})
 		It("unmarshals each type as expected", func() {
 			o := v1.NewEmptySrc()
 			_, err := o.CustomUnmarshal("docker://some/image")
@@ -156,6 +213,15 @@ var _ = Describe("Types", Label("types", "common"), func() {
 			Expect(platform.Arch).To(Equal(constants.Archx86))
 			Expect(platform.GolangArch).To(Equal(constants.ArchAmd64))
 
+			platform, err = v1.NewPlatformFromArch(constants.ArchS390x)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(platform.Arch).To(Equal(constants.ArchS390x))
+			Expect(platform.GolangArch).To(Equal(constants.ArchS390x))
+
+			platform, err = v1.NewPlatformFromArch(constants.ArchPpc64)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(platform.Arch).To(Equal(constants.ArchPpc64))
+			Expect(platform.GolangArch).To(Equal(constants.ArchPpc64))
 		})
 		It("Parses the platform from a string", func() {
 			platform, err := v1.ParsePlatform(fmt.Sprintf("jojo/%s", constants.ArchArm64))
@@ -18,8 +18,11 @@ package v1
 
 import (
 	"fmt"
+	"net"
 	"path/filepath"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
 	"github.com/kairos-io/kairos-sdk/ghw"
@@ -35,6 +38,11 @@ const (
 	esp   = "esp"
 	bios  = "bios_grub"
 	boot  = "boot"
+
+	// ZIPL is the s390x firmware, booting through the zipl boot record
+	ZIPL = "zipl"
+	// PETITBOOT is the ppc64le OPAL firmware, its petitboot loader finds the kernels on the partitions
+	PETITBOOT = "petitboot"
 )
 
 type Spec interface {
@@ -49,11 +57,14 @@ type SharedInstallSpec interface {
 	GetTarget() string
 	GetPartitions() ElementalPartitions
 	GetExtraPartitions() types.PartitionList
+	GetPartitionTuning() map[string]*FilesystemTuning
+	GetArch() string
 }
 
 // InstallSpec struct represents all the installation action details
 type InstallSpec struct {
 	Target          string              `yaml:"device,omitempty" mapstructure:"device"`
+	MirrorDevice    string              `yaml:"mirror-device,omitempty" mapstructure:"mirror-device"` // Spare copy of Target, it boots once promoted with clone-to --promote
 	Firmware        string              `yaml:"firmware,omitempty" mapstructure:"firmware"`
 	PartTable       string              `yaml:"part-table,omitempty" mapstructure:"part-table"`
 	Partitions      ElementalPartitions `yaml:"partitions,omitempty" mapstructure:"partitions"`
@@ -61,6 +72,11 @@ type InstallSpec struct {
 	NoFormat        bool                `yaml:"no-format,omitempty" mapstructure:"no-format"`
 	Force           bool                `yaml:"force,omitempty" mapstructure:"force"`
 	CloudInit       []string            `yaml:"cloud-init,omitempty" mapstructure:"cloud-init"`
+	MediaConfigs    bool                `yaml:"copy-media-configs,omitempty" mapstructure:"copy-media-configs"`
+	PrintPlan       bool                `yaml:"print-plan,omitempty" mapstructure:"print-plan"`
+	ReserveNetwork  bool                `yaml:"reserve-network,omitempty" mapstructure:"reserve-network"`
+	NetworkDisk     *NetworkDisk        `yaml:"network-disk,omitempty" mapstructure:"network-disk"`
+	Timeouts        Timeouts            `yaml:"timeouts,omitempty" mapstructure:"timeouts"`
 	Iso             string              `yaml:"iso,omitempty" mapstructure:"iso"`
 	GrubDefEntry    string              `yaml:"grub-entry-name,omitempty" mapstructure:"grub-entry-name"`
 	Tty             string              `yaml:"tty,omitempty" mapstructure:"tty"`
@@ -71,6 +87,18 @@ type InstallSpec struct {
 	Recovery        Image               `yaml:"recovery-system,omitempty" mapstructure:"recovery-system"`
 	Passive         Image
 	GrubConf        string
+	// HardwareCheck sets what happens when the host has storage, network or display devices without drivers in
+	// the system image: warn (default) only reports them, strict fails the installation unless forced and off skips the check
+	HardwareCheck string `yaml:"hardware-check,omitempty" mapstructure:"hardware-check"`
+	// PartitionTuning are the filesystem options of the partitions, by partition name, i.e. persistent
+	PartitionTuning map[string]*FilesystemTuning `yaml:"partition-tuning,omitempty" mapstructure:"partition-tuning"`
+	// MediaTuning sets whether the install is adjusted to reduce the wear when the target is an SD card or eMMC
+	// device: auto (default) detects the media, off installs as on any other disk
+	MediaTuning string `yaml:"media-tuning,omitempty" mapstructure:"media-tuning"`
+	// Media is the detected flash media of the target and the decisions taken for it, nil for any other disk
+	Media *FlashMedia `yaml:"media,omitempty" mapstructure:"-"`
+	// Arch is the arch of the installed image, it sets the arch specific partition types, i.e. type=linux-root
+	Arch string `yaml:"-" mapstructure:"-"`
 }
 
 // Sanitize checks the consistency of the struct, returns error
@@ -88,9 +116,32 @@ func (i *InstallSpec) Sanitize() error {
 		}
 	}
 
+	if i.MirrorDevice != "" && i.MirrorDevice == i.Target {
+		return fmt.Errorf("mirror device %s cannot be the same as the target device", i.MirrorDevice)
+	}
+
+	if i.NetworkDisk != nil {
+		if err := i.NetworkDisk.Sanitize(); err != nil {
+			return err
+		}
+	}
+
 	if i.Active.Source.IsEmpty() && i.Iso == "" {
 		return fmt.Errorf("undefined system source to install")
 	}
+	switch i.HardwareCheck {
+	case "", constants.HardwareCheckWarn, constants.HardwareCheckStrict, constants.HardwareCheckOff:
+	default:
+		return fmt.Errorf("invalid hardware check mode %s, valid ones are %s, %s and %s", i.HardwareCheck, constants.HardwareCheckWarn, constants.HardwareCheckStrict, constants.HardwareCheckOff)
+	}
+	switch i.MediaTuning {
+	case "", MediaTuningAuto, MediaTuningOff:
+	default:
+		return fmt.Errorf("invalid media tuning %s, valid ones are %s and %s", i.MediaTuning, MediaTuningAuto, MediaTuningOff)
+	}
+	if err := validateTuning(i.PartitionTuning, i.Active, i.Recovery); err != nil {
+		return err
+	}
 	if i.Partitions.State == nil || i.Partitions.State.MountPoint == "" {
 		return fmt.Errorf("undefined state partition")
 	}
@@ -134,6 +185,86 @@ func (i *InstallSpec) GetTarget() string                       { return i.Target
 func (i *InstallSpec) GetPartTable() string                    { return i.PartTable }
 func (i *InstallSpec) GetPartitions() ElementalPartitions      { return i.Partitions }
 func (i *InstallSpec) GetExtraPartitions() types.PartitionList { return i.ExtraPartitions }
+func (i *InstallSpec) GetPartitionTuning() map[string]*FilesystemTuning {
+	return i.PartitionTuning
+}
+func (i *InstallSpec) GetArch() string { return i.Arch }
+
+// validateTuning checks the filesystem tuning of the given partitions and images
+func validateTuning(partitions map[string]*FilesystemTuning, images ...Image) error {
+	for name, t := range partitions {
+		if err := t.Validate(); err != nil {
+			return fmt.Errorf("tuning of partition %s: %w", name, err)
+		}
+	}
+	for _, img := range images {
+		if err := img.Tuning.Validate(); err != nil {
+			return fmt.Errorf("tuning of image %s: %w", img.Label, err)
+		}
+	}
+	return nil
+}
+
+// NetworkDisk is a target device attached over the network at install time, through iSCSI or NVMe over fabrics.
+// The installed system attaches it again from the initramfs to boot from it.
+type NetworkDisk struct {
+	// Protocol is either iscsi or nvmeof
+	Protocol string `yaml:"protocol,omitempty" mapstructure:"protocol"`
+	// Portal is the address of the iSCSI portal or NVMe-oF target, with an optional port
+	Portal string `yaml:"portal,omitempty" mapstructure:"portal"`
+	// Target is the IQN of the iSCSI target or the NQN of the NVMe-oF subsystem
+	Target string `yaml:"target,omitempty" mapstructure:"target"`
+	// Lun is the iSCSI LUN of the disk
+	Lun int `yaml:"lun,omitempty" mapstructure:"lun"`
+	// Transport is the NVMe-oF transport, tcp by default
+	Transport string `yaml:"transport,omitempty" mapstructure:"transport"`
+	// Initiator is the iSCSI initiator name or NVMe host NQN the target grants access to, the system one if empty
+	Initiator string `yaml:"initiator,omitempty" mapstructure:"initiator"`
+	// Username and Password are the iSCSI CHAP credentials, if the target requires them. The installed system keeps
+	// them in its initramfs, which requires dracut in the image.
+	Username string `yaml:"username,omitempty" mapstructure:"username"`
+	Password string `yaml:"password,omitempty" mapstructure:"password"`
+}
+
+// Sanitize checks the network disk settings and sets the defaults
+func (d *NetworkDisk) Sanitize() error {
+	d.Protocol = strings.ToLower(d.Protocol)
+	switch d.Protocol {
+	case constants.NetworkDiskISCSI:
+		if d.Transport != "" {
+			return fmt.Errorf("network disk transport is only supported for %s", constants.NetworkDiskNVMeoF)
+		}
+	case constants.NetworkDiskNVMeoF:
+		if d.Transport == "" {
+			d.Transport = "tcp"
+		}
+		if d.Username != "" || d.Password != "" {
+			return fmt.Errorf("network disk credentials are only supported for %s", constants.NetworkDiskISCSI)
+		}
+	default:
+		return fmt.Errorf("invalid network disk protocol %q, must be %s or %s", d.Protocol, constants.NetworkDiskISCSI, constants.NetworkDiskNVMeoF)
+	}
+	if d.Portal == "" || d.Target == "" {
+		return fmt.Errorf("network disk requires a portal and a target")
+	}
+	if (d.Username == "") != (d.Password == "") {
+		return fmt.Errorf("network disk requires both username and password for CHAP authentication")
+	}
+	return nil
+}
+
+// Address returns the host and port of the portal, with the default port of the protocol if not set
+func (d NetworkDisk) Address() (string, string) {
+	host, port, err := net.SplitHostPort(d.Portal)
+	if err != nil {
+		host = strings.Trim(d.Portal, "[]")
+		port = constants.ISCSIDefaultPort
+		if d.Protocol == constants.NetworkDiskNVMeoF {
+			port = constants.NVMeoFDefaultPort
+		}
+	}
+	return host, port
+}
 
 // ResetSpec struct represents all the reset action details
 type ResetSpec struct {
@@ -145,12 +276,19 @@ type ResetSpec struct {
 	Tty              string   `yaml:"tty,omitempty" mapstructure:"tty"`
 	ExtraDirsRootfs  []string `yaml:"extra-dirs-rootfs,omitempty" mapstructure:"extra-dirs-rootfs"`
 	Active           Image    `yaml:"system,omitempty" mapstructure:"system"`
-	Passive          Image
-	Partitions       ElementalPartitions
-	Target           string
-	Efi              bool
-	GrubConf         string
-	State            *InstallState
+	Timeouts         Timeouts `yaml:"timeouts,omitempty" mapstructure:"timeouts"`
+	// RestoreOEMBackup is an OEM backup file, as created by `kairos-agent oem backup`, restored on the OEM partition
+	RestoreOEMBackup string `yaml:"restore-oem-backup,omitempty" mapstructure:"restore-oem-backup"`
+	// OEMBackupKey is the key file the OEM backup was encrypted with, if any
+	OEMBackupKey string `yaml:"oem-backup-key,omitempty" mapstructure:"oem-backup-key"`
+	// PartitionTuning are the filesystem options the persistent and OEM partitions are formatted with, by partition name
+	PartitionTuning map[string]*FilesystemTuning `yaml:"partition-tuning,omitempty" mapstructure:"partition-tuning"`
+	Passive         Image
+	Partitions      ElementalPartitions
+	Target          string
+	Efi             bool
+	GrubConf        string
+	State           *InstallState
 }
 
 // Sanitize checks the consistency of the struct, returns error
@@ -162,29 +300,99 @@ func (r *ResetSpec) Sanitize() error {
 	if r.Partitions.State == nil || r.Partitions.State.MountPoint == "" {
 		return fmt.Errorf("undefined state partition")
 	}
-	return nil
+	return validateTuning(r.PartitionTuning, r.Active)
 }
 
 func (r *ResetSpec) ShouldReboot() bool   { return r.Reboot }
 func (r *ResetSpec) ShouldShutdown() bool { return r.PowerOff }
 
 type UpgradeSpec struct {
-	Entry           string   `yaml:"entry,omitempty" mapstructure:"entry"`
-	Active          Image    `yaml:"system,omitempty" mapstructure:"system"`
-	Recovery        Image    `yaml:"recovery-system,omitempty" mapstructure:"recovery-system"`
-	GrubDefEntry    string   `yaml:"grub-entry-name,omitempty" mapstructure:"grub-entry-name"`
-	Reboot          bool     `yaml:"reboot,omitempty" mapstructure:"reboot"`
-	PowerOff        bool     `yaml:"poweroff,omitempty" mapstructure:"poweroff"`
-	ExtraDirsRootfs []string `yaml:"extra-dirs-rootfs,omitempty" mapstructure:"extra-dirs-rootfs"`
-	Passive         Image
-	Partitions      ElementalPartitions
-	State           *InstallState
+	Entry            string   `yaml:"entry,omitempty" mapstructure:"entry"`
+	Active           Image    `yaml:"system,omitempty" mapstructure:"system"`
+	Recovery         Image    `yaml:"recovery-system,omitempty" mapstructure:"recovery-system"`
+	GrubDefEntry     string   `yaml:"grub-entry-name,omitempty" mapstructure:"grub-entry-name"`
+	Reboot           bool     `yaml:"reboot,omitempty" mapstructure:"reboot"`
+	PowerOff         bool     `yaml:"poweroff,omitempty" mapstructure:"poweroff"`
+	ExtraDirsRootfs  []string `yaml:"extra-dirs-rootfs,omitempty" mapstructure:"extra-dirs-rootfs"`
+	RegenerateInitrd bool     `yaml:"regenerate_initrd,omitempty" mapstructure:"regenerate_initrd"`
+	Timeouts         Timeouts `yaml:"timeouts,omitempty" mapstructure:"timeouts"`
+	IOLimit          IOLimit  `yaml:"io_limit,omitempty" mapstructure:"io_limit"`
+	// MaxBandwidth is the max bandwidth of the image pulls and downloads in KiB/s, no limit if 0
+	MaxBandwidth uint `yaml:"max-bandwidth,omitempty" mapstructure:"max-bandwidth"`
+	// ResourceGuard switches the upgrade to low memory mode when the available memory or temporary space is short
+	ResourceGuard ResourceGuard `yaml:"resource_guard,omitempty" mapstructure:"resource_guard"`
+	// DeferRecovery rebuilds recovery in a throttled background job after the next reboot instead of during the upgrade
+	DeferRecovery bool `yaml:"defer-recovery,omitempty" mapstructure:"defer-recovery"`
+	// Force deploys sources that don't look like bootable Kairos images
+	Force bool `yaml:"force,omitempty" mapstructure:"force"`
+	// SmokeTests are run on the first boot of the upgraded system, rolling back to the previous image if any fails
+	SmokeTests []SmokeTest `yaml:"smoke-tests,omitempty" mapstructure:"smoke-tests"`
+	// Sources are tried in order when the upgrade source can't be reached or deploying it fails
+	Sources []*ImageSource `yaml:"sources,omitempty" mapstructure:"sources"`
+	// Delta pulls only the layers of the OCI source the active image lacks and applies them over a copy of it
+	Delta      bool `yaml:"delta,omitempty" mapstructure:"delta"`
+	Passive    Image
+	Partitions ElementalPartitions
+	State      *InstallState
+}
+
+// SmokeTest is a check of the upgraded system, only one of Unit, URL or Script is expected to be set
+type SmokeTest struct {
+	Name string `yaml:"name,omitempty" mapstructure:"name"`
+	// Unit is a systemd unit that must be active
+	Unit string `yaml:"unit,omitempty" mapstructure:"unit"`
+	// URL is an HTTP endpoint that must answer with a 2xx status
+	URL string `yaml:"url,omitempty" mapstructure:"url"`
+	// Script is a shell command that must exit with 0
+	Script string `yaml:"script,omitempty" mapstructure:"script"`
+	// Timeout is how long the check is retried until it passes
+	Timeout time.Duration `yaml:"timeout,omitempty" mapstructure:"timeout"`
+}
+
+// Kind returns which check the smoke test sets, empty if it sets none or more than one
+func (t SmokeTest) Kind() string {
+	var kinds []string
+	if t.Unit != "" {
+		kinds = append(kinds, "unit")
+	}
+	if t.URL != "" {
+		kinds = append(kinds, "url")
+	}
+	if t.Script != "" {
+		kinds = append(kinds, "script")
+	}
+	if len(kinds) != 1 {
+		return ""
+	}
+	return kinds[0]
 }
 
 func (u *UpgradeSpec) RecoveryUpgrade() bool {
 	return u.Entry == constants.BootEntryRecovery
 }
 
+// TargetImage returns the image being upgraded, recovery or active
+func (u *UpgradeSpec) TargetImage() *Image {
+	if u.RecoveryUpgrade() {
+		return &u.Recovery
+	}
+	return &u.Active
+}
+
+// SourceCandidates returns the source of the upgraded image followed by the fallback sources, without duplicates
+func (u *UpgradeSpec) SourceCandidates() []*ImageSource {
+	var candidates []*ImageSource
+	seen := map[string]bool{}
+	for _, src := range append([]*ImageSource{u.TargetImage().Source}, u.Sources...) {
+		if src == nil || src.IsEmpty() || seen[src.String()] {
+			continue
+		}
+		seen[src.String()] = true
+		candidates = append(candidates, src)
+	}
+	return candidates
+}
+
 // Sanitize checks the consistency of the struct, returns error
 // if unsolvable inconsistencies are found
 func (u *UpgradeSpec) Sanitize() error {
@@ -203,6 +411,19 @@ func (u *UpgradeSpec) Sanitize() error {
 			return fmt.Errorf("undefined state partition")
 		}
 	}
+	switch u.IOLimit.Class {
+	case "", constants.IOClassIdle, constants.IOClassBestEffort, constants.IOClassRealtime:
+	default:
+		return fmt.Errorf("invalid io_limit class %s", u.IOLimit.Class)
+	}
+	if err := validateTuning(nil, u.Active, u.Recovery); err != nil {
+		return err
+	}
+	for i, t := range u.SmokeTests {
+		if t.Kind() == "" {
+			return fmt.Errorf("smoke test %d must set one of unit, url or script", i)
+		}
+	}
 	return nil
 }
 func (u *UpgradeSpec) ShouldReboot() bool   { return u.Reboot }
@@ -228,6 +449,20 @@ type ElementalPartitions struct {
 	Persistent *types.Partition `yaml:"persistent,omitempty" mapstructure:"persistent"`
 }
 
+// FirmwareForArch returns the firmware to install for, s390x and ppc64le don't use EFI nor BIOS
+func FirmwareForArch(arch string, efi bool) string {
+	switch arch {
+	case constants.ArchS390x:
+		return ZIPL
+	case constants.ArchPpc64:
+		return PETITBOOT
+	}
+	if efi {
+		return EFI
+	}
+	return BIOS
+}
+
 // SetFirmwarePartitions sets firmware partitions for a given firmware and partition table type
 func (ep *ElementalPartitions) SetFirmwarePartitions(firmware string, partTable string) error {
 	if firmware == EFI && partTable == GPT {
@@ -250,6 +485,10 @@ func (ep *ElementalPartitions) SetFirmwarePartitions(firmware string, partTable
 			Flags:           []string{bios},
 		}
 		ep.EFI = nil
+	} else if (firmware == ZIPL || firmware == PETITBOOT) && partTable == GPT {
+		// zipl and petitboot load the kernel from the state partition, no firmware partition is needed
+		ep.EFI = nil
+		ep.BIOS = nil
 	} else {
 		if ep.State == nil {
 			return fmt.Errorf("nil state partition")
@@ -392,6 +631,36 @@ func (ep ElementalPartitions) PartitionsByMountPoint(descending bool, excludes .
 	return partitions
 }
 
+// Timeouts bounds the duration of the install, upgrade and reset phases, so stuck network or IO operations
+// fail and get cleaned up instead of hanging forever. Zero values mean no timeout.
+type Timeouts struct {
+	// Download bounds the pull of each OCI image
+	Download time.Duration `yaml:"download,omitempty" mapstructure:"download"`
+	// Deploy bounds the deployment of each image, including its download
+	Deploy time.Duration `yaml:"deploy,omitempty" mapstructure:"deploy"`
+	// Total is the overall deadline of the action
+	Total time.Duration `yaml:"total,omitempty" mapstructure:"total"`
+}
+
+// IOLimit limits the disk IO of an upgrade, so it does not starve the running workloads
+type IOLimit struct {
+	// Bandwidth is the max read and write bandwidth on the target disk in MiB/s, applied with the cgroup v2 io.max
+	Bandwidth uint `yaml:"bandwidth,omitempty" mapstructure:"bandwidth"`
+	// Class is the IO scheduling class (idle, best-effort or realtime), applied like ionice does
+	Class string `yaml:"class,omitempty" mapstructure:"class"`
+}
+
+// ResourceGuard sets the available memory and temporary space below which an upgrade runs in low memory mode:
+// the work dirs move to the persistent partition, fewer threads are used and image layers are streamed
+type ResourceGuard struct {
+	Disable bool `yaml:"disable,omitempty" mapstructure:"disable"`
+	// MinMemory is the available memory in MiB below which the low memory mode is used, constants.LowMemoryThreshold by default
+	MinMemory uint `yaml:"min_memory,omitempty" mapstructure:"min_memory"`
+	// MinTmp is the free space of the temporary dir in MiB below which the work dirs move to the persistent
+	// partition, constants.LowTmpThreshold by default
+	MinTmp uint `yaml:"min_tmp,omitempty" mapstructure:"min_tmp"`
+}
+
 // Image struct represents a file system image with its commonly configurable values, size in MiB
 type Image struct {
 	File       string       `yaml:"-"`
@@ -401,6 +670,8 @@ type Image struct {
 	Source     *ImageSource `yaml:"uri,omitempty" mapstructure:"uri"`
 	MountPoint string       `yaml:"-"`
 	LoopDevice string       `yaml:"-"`
+	// Tuning are the filesystem options the image is created with
+	Tuning *FilesystemTuning `yaml:"tuning,omitempty" mapstructure:"tuning"`
 }
 
 // InstallState tracks the installation data of the whole system
@@ -448,7 +719,7 @@ func (i *ImageState) UnmarshalYAML(value *yaml.Node) error {
 	if srcMeta != nil {
 		d := &DockerImageMeta{}
 		err = srcMeta.Decode(d)
-		if err == nil && (d.Digest != "" || d.Size != 0) {
+		if err == nil && (d.Digest != "" || d.Size != 0 || len(d.Layers) > 0) {
 			i.SourceMetadata = d
 			return nil
 		}
@@ -461,6 +732,8 @@ func (i *ImageState) UnmarshalYAML(value *yaml.Node) error {
 type DockerImageMeta struct {
 	Digest string `yaml:"digest,omitempty"`
 	Size   int64  `yaml:"size,omitempty"`
+	// Layers are the digests of the image layers, bottom layer first, the base of the delta upgrades
+	Layers []string `yaml:"layers,omitempty"`
 }
 
 type InstallUkiSpec struct {
@@ -473,11 +746,14 @@ type InstallUkiSpec struct {
 	NoFormat        bool                `yaml:"no-format,omitempty" mapstructure:"no-format"`
 	CloudInit       []string            `yaml:"cloud-init,omitempty" mapstructure:"cloud-init"`
 	SkipEntries     []string            `yaml:"skip-entries,omitempty" mapstructure:"skip-entries"`
+	// PartitionTuning are the filesystem options of the partitions, by partition name, i.e. persistent
+	PartitionTuning map[string]*FilesystemTuning `yaml:"partition-tuning,omitempty" mapstructure:"partition-tuning"`
+	// Arch is the arch of the installed image, it sets the arch specific partition types, i.e. type=linux-root
+	Arch string `yaml:"-" mapstructure:"-"`
 }
 
 func (i *InstallUkiSpec) Sanitize() error {
-	var err error
-	return err
+	return validateTuning(i.PartitionTuning)
 }
 
 func (i *InstallUkiSpec) ShouldReboot() bool                      { return i.Reboot }
@@ -486,6 +762,10 @@ func (i *InstallUkiSpec) GetTarget() string                       { return i.Tar
 func (i *InstallUkiSpec) GetPartTable() string                    { return "gpt" }
 func (i *InstallUkiSpec) GetPartitions() ElementalPartitions      { return i.Partitions }
 func (i *InstallUkiSpec) GetExtraPartitions() types.PartitionList { return i.ExtraPartitions }
+func (i *InstallUkiSpec) GetPartitionTuning() map[string]*FilesystemTuning {
+	return i.PartitionTuning
+}
+func (i *InstallUkiSpec) GetArch() string { return i.Arch }
 
 type UpgradeUkiSpec struct {
 	Entry        string           `yaml:"entry,omitempty" mapstructure:"entry"`
@@ -493,6 +773,11 @@ type UpgradeUkiSpec struct {
 	Reboot       bool             `yaml:"reboot,omitempty" mapstructure:"reboot"`
 	PowerOff     bool             `yaml:"poweroff,omitempty" mapstructure:"poweroff"`
 	EfiPartition *types.Partition `yaml:"efi-partition,omitempty" mapstructure:"efi-partition"`
+	// Sysexts sets what happens with the sysexts enabled on the active entry when it is upgraded,
+	// carry-over (default) keeps them on the new active entry and none starts it without sysexts
+	Sysexts string `yaml:"sysexts,omitempty" mapstructure:"sysexts"`
+	// MaxBandwidth is the max bandwidth of the image pulls and downloads in KiB/s, no limit if 0
+	MaxBandwidth uint `yaml:"max-bandwidth,omitempty" mapstructure:"max-bandwidth"`
 }
 
 func (i *UpgradeUkiSpec) RecoveryUpgrade() bool {
@@ -500,8 +785,12 @@ func (i *UpgradeUkiSpec) RecoveryUpgrade() bool {
 }
 
 func (i *UpgradeUkiSpec) Sanitize() error {
-	var err error
-	return err
+	switch i.Sysexts {
+	case "", constants.SysextsCarryOver, constants.SysextsNone:
+		return nil
+	default:
+		return fmt.Errorf("invalid upgrade sysexts mode %s, valid ones are %s and %s", i.Sysexts, constants.SysextsCarryOver, constants.SysextsNone)
+	}
 }
 
 func (i *UpgradeUkiSpec) ShouldReboot() bool   { return i.Reboot }
@@ -512,12 +801,13 @@ type ResetUkiSpec struct {
 	FormatOEM        bool `yaml:"reset-oem,omitempty" mapstructure:"reset-oem"`
 	Reboot           bool `yaml:"reboot,omitempty" mapstructure:"reboot"`
 	PowerOff         bool `yaml:"poweroff,omitempty" mapstructure:"poweroff"`
-	Partitions       ElementalPartitions
+	// PartitionTuning are the filesystem options the persistent and OEM partitions are formatted with, by partition name
+	PartitionTuning map[string]*FilesystemTuning `yaml:"partition-tuning,omitempty" mapstructure:"partition-tuning"`
+	Partitions      ElementalPartitions
 }
 
 func (i *ResetUkiSpec) Sanitize() error {
-	var err error
-	return err
+	return validateTuning(i.PartitionTuning)
 }
 
 func (i *ResetUkiSpec) ShouldReboot() bool   { return i.Reboot }
@@ -77,6 +77,19 @@ var _ = Describe("Types", Label("types", "config"), func() {
 			Expect(err).ShouldNot(HaveOccurred())
 			Expect(ep.EFI == nil && ep.BIOS != nil).To(BeTrue())
 		})
+		It("sets no firmware partitions for zipl and petitboot", func() {
+			for _, firmware := range []string{v1.ZIPL, v1.PETITBOOT} {
+				err := ep.SetFirmwarePartitions(firmware, v1.GPT)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(ep.EFI == nil && ep.BIOS == nil).To(BeTrue())
+			}
+		})
+		It("detects the firmware from the arch", func() {
+			Expect(v1.FirmwareForArch(constants.ArchS390x, false)).To(Equal(v1.ZIPL))
+			Expect(v1.FirmwareForArch(constants.ArchPpc64, true)).To(Equal(v1.PETITBOOT))
+			Expect(v1.FirmwareForArch(constants.Archx86, true)).To(Equal(v1.EFI))
+			Expect(v1.FirmwareForArch(constants.ArchArm64, false)).To(Equal(v1.BIOS))
+		})
 		It("sets firmware partitions on msdos", func() {
 			ep.State = &sdkTypes.Partition{}
 			Expect(ep.EFI == nil && ep.BIOS == nil).To(BeTrue())
@@ -268,6 +281,45 @@ var _ = Describe("Types", Label("types", "config"), func() {
 				err := spec.Sanitize()
 				Expect(err).ToNot(HaveOccurred())
 			})
+			It("checks the network disk settings", func() {
+				spec.Active.Source = v1.NewFileSrc("/tmp")
+				spec.Partitions.State = &sdkTypes.Partition{
+					MountPoint: "/tmp",
+				}
+				spec.NetworkDisk = &v1.NetworkDisk{Protocol: "NVMeoF", Portal: "10.0.0.6", Target: "nqn.2024-01.io.kairos:disk1"}
+				Expect(spec.Sanitize()).To(Succeed())
+				Expect(spec.NetworkDisk.Protocol).To(Equal(constants.NetworkDiskNVMeoF))
+				Expect(spec.NetworkDisk.Transport).To(Equal("tcp"))
+				host, port := spec.NetworkDisk.Address()
+				Expect(host).To(Equal("10.0.0.6"))
+				Expect(port).To(Equal(constants.NVMeoFDefaultPort))
+
+				spec.NetworkDisk = &v1.NetworkDisk{Protocol: "fcoe", Portal: "10.0.0.6", Target: "disk1"}
+				Expect(spec.Sanitize()).To(MatchError(ContainSubstring("invalid network disk protocol")))
+				spec.NetworkDisk = &v1.NetworkDisk{Protocol: "iscsi", Portal: "10.0.0.5"}
+				Expect(spec.Sanitize()).To(MatchError(ContainSubstring("requires a portal and a target")))
+				spec.NetworkDisk = &v1.NetworkDisk{Protocol: "iscsi", Portal: "10.0.0.5", Target: "iqn.2024-01.io.kairos:disk1", Username: "kairos"}
+				Expect(spec.Sanitize()).To(MatchError(ContainSubstring("both username and password")))
+			})
+			It("checks the filesystem tuning", func() {
+				spec.Active.Source = v1.NewFileSrc("/tmp")
+				spec.Partitions.State = &sdkTypes.Partition{
+					MountPoint: "/tmp",
+				}
+				reserved := 0.5
+				spec.PartitionTuning = map[string]*v1.FilesystemTuning{
+					constants.PersistentPartName: {ReservedBlocks: &reserved, Journal: v1.JournalNone},
+				}
+				Expect(spec.Sanitize()).To(Succeed())
+				Expect(spec.PartitionTuning[constants.PersistentPartName].MkfsOptions("ext4")).To(Equal([]string{"-m", "0.5", "-O", "^has_journal"}))
+				Expect(spec.PartitionTuning[constants.PersistentPartName].MkfsOptions("xfs")).To(BeEmpty())
+
+				spec.Active.Tuning = &v1.FilesystemTuning{InodeRatio: 512}
+				Expect(spec.Sanitize()).To(MatchError(ContainSubstring("inode-ratio")))
+				spec.Active.Tuning = nil
+				spec.PartitionTuning[constants.OEMPartName] = &v1.FilesystemTuning{Journal: "fast"}
+				Expect(spec.Sanitize()).To(MatchError(ContainSubstring("invalid journal mode")))
+			})
 			It("fills the spec with defaults (BIOS)", func() {
 				spec.Active.Source = v1.NewFileSrc("/tmp")
 				spec.Partitions.State = &sdkTypes.Partition{
@@ -443,6 +495,16 @@ var _ = Describe("Types", Label("types", "config"), func() {
 					err := spec.Sanitize()
 					Expect(err).ToNot(HaveOccurred())
 				})
+				It("fails with smoke tests not setting what to check", func() {
+					spec.Active.Source = v1.NewFileSrc("/tmp")
+					spec.Partitions.State = &sdkTypes.Partition{
+						MountPoint: "/tmp",
+					}
+					spec.SmokeTests = []v1.SmokeTest{{Unit: "k3s.service"}, {Name: "nothing"}}
+					err := spec.Sanitize()
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("smoke test 1 must set one of unit, url or script"))
+				})
 			})
 			Describe("Recovery upgrade", func() {
 				BeforeEach(func() {
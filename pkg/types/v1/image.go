@@ -17,27 +17,546 @@ limitations under the License.
 package v1
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/containerd/containerd/archive"
+	"github.com/containerd/containerd/archive/compression"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	containerv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/daemon"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/kairos-io/kairos-sdk/utils"
 )
 
 type ImageExtractor interface {
 	ExtractImage(imageRef, destination, platformRef string) error
 	GetOCIImageSize(imageRef, platformRef string) (int64, error)
+	GetOCIImageMetadata(imageRef, platformRef string) (*OCIImageMetadata, error)
+}
+
+// LayeredImageExtractor is an ImageExtractor which can also list the layers of an image and apply only the last
+// ones of them, this is what the delta upgrades use to pull only the layers the running image lacks
+type LayeredImageExtractor interface {
+	ImageExtractor
+	GetOCIImageLayers(imageRef, platformRef string) (*DockerImageMeta, error)
+	ExtractImageLayers(imageRef, destination, platformRef string, from int) error
+}
+
+// ContextImageExtractor is an ImageExtractor which can be bound to a context, the pulls and extractions of the
+// returned extractor stop once the context is done
+type ContextImageExtractor interface {
+	ImageExtractor
+	WithContext(ctx context.Context) ImageExtractor
+}
+
+// TempDirFunc creates a temporary dir for the given namespace, returning it along with the function removing it
+type TempDirFunc func(namespace string) (dir string, remove func() error, err error)
+
+// TempDirImageExtractor is an ImageExtractor which can be told where to create its temporary dirs, so they are
+// bound to the temp dirs quota and cleaned up with the rest of them
+type TempDirImageExtractor interface {
+	ImageExtractor
+	WithTempDir(tempDir TempDirFunc) ImageExtractor
+}
+
+// ReferrersImageExtractor is an ImageExtractor which can also find the artifacts referring to an image in its registry
+type ReferrersImageExtractor interface {
+	ImageExtractor
+	// GetOCIImageReferrers returns the digest of the image and the artifacts referring to it or to its index
+	GetOCIImageReferrers(imageRef, platformRef string) (string, []OCIReferrer, error)
+	// GetOCIReferrerBlobs returns the contents of the layers of a referrer artifact
+	GetOCIReferrerBlobs(imageRef string, referrer OCIReferrer) ([][]byte, error)
+}
+
+// OCIImageExtractor pulls images from the local docker daemon or from the registry. With Stream set the images from
+// the docker daemon are read as they are extracted, instead of being buffered in memory first.
+type OCIImageExtractor struct {
+	Stream bool
+	// Transport reaches the registries, the default transport if nil
+	Transport http.RoundTripper
+	// Workers is how many layers are downloaded at once while the previous ones are extracted, the layers are
+	// downloaded and extracted one by one if 0 or 1. The layers downloaded ahead are kept in the temporary dir.
+	Workers int
+	// Registries are the mirrors the images are pulled from before their registry, if any
+	Registries *Registries
+	// MirrorFailed is told about the mirrors which failed to serve an image, before falling back to the next one
+	MirrorFailed func(ref string, err error)
+	// Auth are the credentials of the registries, the default keychain is used if nil
+	Auth *RegistryAuth
+	// ctx stops the pulls and extractions once done, set with WithContext
+	ctx context.Context
+	// tempDir creates the dir the layers downloaded ahead are kept in, set with WithTempDir
+	tempDir TempDirFunc
+}
+
+var _ LayeredImageExtractor = OCIImageExtractor{}
+var _ ReferrersImageExtractor = OCIImageExtractor{}
+var _ ContextImageExtractor = OCIImageExtractor{}
+var _ TempDirImageExtractor = OCIImageExtractor{}
+
+// WithContext returns a copy of the extractor whose pulls and extractions stop once ctx is done
+func (e OCIImageExtractor) WithContext(ctx context.Context) ImageExtractor {
+	e.ctx = ctx
+	return e
 }
 
-type OCIImageExtractor struct{}
+// WithTempDir returns a copy of the extractor keeping the layers downloaded ahead in the dirs tempDir creates
+func (e OCIImageExtractor) WithTempDir(tempDir TempDirFunc) ImageExtractor {
+	e.tempDir = tempDir
+	return e
+}
 
-var _ ImageExtractor = OCIImageExtractor{}
+// newTempDir creates a temporary dir with tempDir, in the default temporary dir if none
+func (e OCIImageExtractor) newTempDir(namespace string) (string, func() error, error) {
+	if e.tempDir != nil {
+		return e.tempDir(namespace)
+	}
+	dir, err := os.MkdirTemp("", fmt.Sprintf("kairos-%s-", namespace))
+	return dir, func() error { return os.RemoveAll(dir) }, err
+}
+
+// context returns the context the extractor is bound to, the background one if none
+func (e OCIImageExtractor) context() context.Context {
+	if e.ctx == nil {
+		return context.Background()
+	}
+	return e.ctx
+}
 
 func (e OCIImageExtractor) ExtractImage(imageRef, destination, platformRef string) error {
-	img, err := utils.GetImage(imageRef, utils.GetCurrentPlatform(), nil, nil)
+	img, streamed, err := e.image(imageRef)
+	if err != nil {
+		return err
+	}
+	if streamed || e.Workers <= 1 {
+		rc := mutate.Extract(img)
+		defer rc.Close()
+		_, err = archive.Apply(e.context(), destination, contextReader{ctx: e.context(), r: rc})
+		return err
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	return e.extractLayers(layers, destination)
+}
+
+// image returns the image, and whether it is streamed from the docker daemon, which reads every layer from the
+// image tarball so they are only read one by one
+func (e OCIImageExtractor) image(imageRef string) (containerv1.Image, bool, error) {
+	// The images pinned by digest are always pulled from the registry, the docker daemon ones have other digests
+	if _, pinned := pinnedDigest(imageRef); e.Stream && !pinned {
+		ref, err := name.ParseReference(imageRef)
+		if err != nil {
+			return nil, false, err
+		}
+		if img, err := daemon.Image(ref, daemon.WithUnbufferedOpener()); err == nil {
+			return img, true, nil
+		}
+	}
+	// Registry layers are always streamed, from the first mirror which has the image
+	img, err := e.getImage(imageRef, utils.GetCurrentPlatform())
+	return img, false, err
+}
+
+// getImage resolves the image from its mirrors or its registry. Only the manifest is fetched, the layers are
+// pulled later from the same mirror, so a mirror failing halfway through a pull is not fallen back from.
+// Images pinned by digest are verified to be the pinned image, or the image of the pinned index for the platform.
+func (e OCIImageExtractor) getImage(imageRef, platformRef string) (img containerv1.Image, err error) {
+	err = e.Registries.Resolve(imageRef, e.MirrorFailed, func(ref string) error {
+		img, err = e.pullImage(ref, platformRef)
+		return err
+	})
+	return img, err
+}
+
+// pullImage gets the image for the platform from the docker daemon or the registry, the images pinned by digest
+// only from the registry
+func (e OCIImageExtractor) pullImage(imageRef, platformRef string) (containerv1.Image, error) {
+	if digest, ok := pinnedDigest(imageRef); ok {
+		return e.getPinnedImage(digest, platformRef)
+	}
+	auth, err := e.Auth.AuthConfig(imageRef)
+	if err != nil {
+		return nil, err
+	}
+	return utils.GetImage(imageRef, platformRef, auth, e.Transport)
+}
+
+// pinnedDigest returns the digest reference of the images pinned by digest, like repo/image@sha256:...
+func pinnedDigest(imageRef string) (name.Digest, bool) {
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		return name.Digest{}, false
+	}
+	digest, ok := ref.(name.Digest)
+	return digest, ok
+}
+
+// getPinnedImage pulls the image for the platform from the registry and checks it resolves to the pinned digest
+func (e OCIImageExtractor) getPinnedImage(ref name.Digest, platformRef string) (containerv1.Image, error) {
+	opts := e.remoteOptions()
+	if platformRef != "" {
+		platform, err := containerv1.ParsePlatform(platformRef)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, remote.WithPlatform(*platform))
+	}
+	img, err := remote.Image(ref, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err = e.verifyDigest(ref, img); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// verifyDigest checks the image is the one pinned by the reference: either its manifest has the pinned digest or,
+// for multi arch images, it is listed in the index with the pinned digest
+func (e OCIImageExtractor) verifyDigest(ref name.Digest, img containerv1.Image) error {
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	if digest.String() == ref.DigestStr() {
+		return nil
+	}
+	index, err := remote.Index(ref, e.remoteOptions()...)
+	if err != nil {
+		return fmt.Errorf("verifying the digest of %s: %w", ref.String(), err)
+	}
+	if d, err := index.Digest(); err == nil && d.String() == ref.DigestStr() {
+		if manifest, err := index.IndexManifest(); err == nil {
+			for _, m := range manifest.Manifests {
+				if m.Digest == digest {
+					return nil
+				}
+			}
+		}
+	}
+	return fmt.Errorf("digest mismatch: %s resolved to %s, which is not the pinned image", ref.String(), digest.String())
+}
+
+func (e OCIImageExtractor) GetOCIImageSize(imageRef, platformRef string) (size int64, err error) {
+	err = e.Registries.Resolve(imageRef, e.MirrorFailed, func(ref string) error {
+		auth, err := e.Auth.AuthConfig(ref)
+		if err != nil {
+			return err
+		}
+		size, err = utils.GetOCIImageSize(ref, platformRef, auth, e.Transport)
+		return err
+	})
+	return size, err
+}
+
+func (e OCIImageExtractor) GetOCIImageMetadata(imageRef, platformRef string) (*OCIImageMetadata, error) {
+	img, err := e.getImage(imageRef, platformRef)
+	if err != nil {
+		return nil, err
+	}
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	return &OCIImageMetadata{
+		Labels:      configFile.Config.Labels,
+		Annotations: manifest.Annotations,
+		Created:     configFile.Created.Time,
+	}, nil
+}
+
+// GetOCIImageLayers returns the digest of the image and the digests of its layers, bottom layer first
+func (e OCIImageExtractor) GetOCIImageLayers(imageRef, platformRef string) (*DockerImageMeta, error) {
+	img, _, err := e.image(imageRef)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	meta := &DockerImageMeta{Digest: digest.String()}
+	for _, l := range layers {
+		d, err := l.Digest()
+		if err != nil {
+			return nil, err
+		}
+		meta.Layers = append(meta.Layers, d.String())
+	}
+	return meta, nil
+}
+
+// ExtractImageLayers applies the layers of the image from the given index on over destination, which is expected
+// to hold the layers below it already. Only those layers are downloaded, their whiteouts remove the files of the
+// layers below as when extracting the whole image.
+func (e OCIImageExtractor) ExtractImageLayers(imageRef, destination, platformRef string, from int) error {
+	img, streamed, err := e.image(imageRef)
+	if err != nil {
+		return err
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	if from < 0 || from > len(layers) {
+		return fmt.Errorf("image %s has %d layers, can't extract from layer %d", imageRef, len(layers), from)
+	}
+	if streamed {
+		e.Workers = 1
+	}
+	return e.extractLayers(layers[from:], destination)
+}
+
+// layerDownload is a layer downloaded ahead of its extraction
+type layerDownload struct {
+	path string
+	err  error
+}
+
+// extractLayers applies the layers over destination in order, as the whiteouts of a layer remove the files of the
+// ones below. With several workers the next layers are downloaded while the previous ones are extracted, up to
+// Workers layers at once counting the one being extracted, so the temporary space is bound to those.
+func (e OCIImageExtractor) extractLayers(layers []containerv1.Layer, destination string) error {
+	if e.Workers <= 1 || len(layers) <= 1 {
+		for _, l := range layers {
+			if err := applyLayer(e.context(), l, destination); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tmp, removeTmp, err := e.newTempDir("layers")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = removeTmp() }()
+
+	// The downloads still in flight are cancelled and waited for before the dir is removed, so they don't keep
+	// writing into it
+	ctx, cancel := context.WithCancel(e.context())
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	slots := make(chan struct{}, e.Workers)
+	downloads := make([]chan layerDownload, len(layers))
+	for i := range downloads {
+		downloads[i] = make(chan layerDownload, 1)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i, l := range layers {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			wg.Add(1)
+			go func(i int, l containerv1.Layer) {
+				defer wg.Done()
+				path := filepath.Join(tmp, fmt.Sprintf("layer-%d", i))
+				downloads[i] <- layerDownload{path: path, err: downloadLayer(ctx, l, path)}
+			}(i, l)
+		}
+	}()
+
+	for i := range layers {
+		var d layerDownload
+		select {
+		case d = <-downloads[i]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if d.err != nil {
+			return fmt.Errorf("downloading layer %d: %w", i, d.err)
+		}
+		err = applyLayerFile(e.context(), d.path, destination)
+		_ = os.Remove(d.path)
+		<-slots
+		if err != nil {
+			return fmt.Errorf("extracting layer %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// downloadLayer writes the compressed layer to path, its digest is verified as it's read
+func downloadLayer(ctx context.Context, layer containerv1.Layer, path string) error {
+	rc, err := layer.Compressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, contextReader{ctx: ctx, r: rc}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ExtractTarball extracts the tarball at path into destination, either plain or compressed with gzip, bzip2, xz or
+// zstd. It is extracted like an image layer, so whiteout files remove the paths they hide. The extraction stops
+// once ctx is done.
+func ExtractTarball(ctx context.Context, path, destination string) error {
+	return applyLayerFile(ctx, path, destination)
+}
+
+// applyLayerFile applies the downloaded layer, compressed with any of the compressions of the image layers
+func applyLayerFile(ctx context.Context, path, destination string) error {
+	f, err := os.Open(path)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
+	rc, err := compression.DecompressStream(f)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = archive.Apply(ctx, destination, contextReader{ctx: ctx, r: rc})
+	return err
+}
+
+func applyLayer(ctx context.Context, layer containerv1.Layer, destination string) error {
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = archive.Apply(ctx, destination, contextReader{ctx: ctx, r: rc})
+	return err
+}
+
+// contextReader fails the reads once ctx is done, so a transfer in the middle of a large file stops as well
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+func (e OCIImageExtractor) remoteOptions() []remote.Option {
+	opts := []remote.Option{remote.WithAuthFromKeychain(e.Auth), remote.WithContext(e.context())}
+	if e.Transport != nil {
+		opts = append(opts, remote.WithTransport(e.Transport))
+	}
+	return opts
+}
 
-	return utils.ExtractOCIImage(img, destination)
+// GetOCIImageReferrers asks the registry for the referrers of the image for the platform and, for multi arch
+// images, of their index, as the artifacts can be attached to either. Mirrors without the referrers API are fallen
+// back from as any other failing mirror.
+func (e OCIImageExtractor) GetOCIImageReferrers(imageRef, platformRef string) (digest string, referrers []OCIReferrer, err error) {
+	err = e.Registries.Resolve(imageRef, e.MirrorFailed, func(ref string) error {
+		digest, referrers, err = e.getReferrers(ref, platformRef)
+		return err
+	})
+	return digest, referrers, err
 }
 
-func (e OCIImageExtractor) GetOCIImageSize(imageRef, platformRef string) (int64, error) {
-	return utils.GetOCIImageSize(imageRef, platformRef, nil, nil)
+func (e OCIImageExtractor) getReferrers(imageRef, platformRef string) (string, []OCIReferrer, error) {
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		return "", nil, err
+	}
+	img, err := e.pullImage(imageRef, platformRef)
+	if err != nil {
+		return "", nil, err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return "", nil, err
+	}
+	digests := []string{digest.String()}
+	if desc, err := remote.Head(ref, e.remoteOptions()...); err == nil && desc.Digest != digest {
+		digests = append(digests, desc.Digest.String())
+	}
+
+	var referrers []OCIReferrer
+	for _, d := range digests {
+		index, err := remote.Referrers(ref.Context().Digest(d), e.remoteOptions()...)
+		if err != nil {
+			return "", nil, err
+		}
+		manifest, err := index.IndexManifest()
+		if err != nil {
+			return "", nil, err
+		}
+		for _, m := range manifest.Manifests {
+			referrers = append(referrers, OCIReferrer{
+				ArtifactType: m.ArtifactType,
+				Digest:       m.Digest.String(),
+				Annotations:  m.Annotations,
+			})
+		}
+	}
+	return digest.String(), referrers, nil
+}
+
+// GetOCIReferrerBlobs pulls the layers of the referrer artifact from the repository of the image
+func (e OCIImageExtractor) GetOCIReferrerBlobs(imageRef string, referrer OCIReferrer) (blobs [][]byte, err error) {
+	err = e.Registries.Resolve(imageRef, e.MirrorFailed, func(ref string) error {
+		blobs, err = e.getReferrerBlobs(ref, referrer)
+		return err
+	})
+	return blobs, err
+}
+
+func (e OCIImageExtractor) getReferrerBlobs(imageRef string, referrer OCIReferrer) ([][]byte, error) {
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		return nil, err
+	}
+	artifact, err := remote.Image(ref.Context().Digest(referrer.Digest), e.remoteOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	layers, err := artifact.Layers()
+	if err != nil {
+		return nil, err
+	}
+	var blobs [][]byte
+	for _, l := range layers {
+		rc, err := l.Compressed()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, data)
+	}
+	return blobs, nil
 }
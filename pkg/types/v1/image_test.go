@@ -0,0 +1,281 @@
+/*
+Copyright © 2022 - 2023 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	containerv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// tarLayer returns a layer with the given files, by path
+func tarLayer(files map[string]string) containerv1.Layer {
+	buf := &bytes.Buffer{}
+	w := tar.NewWriter(buf)
+	for path, content := range files {
+		Expect(w.WriteHeader(&tar.Header{Name: path, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})).To(Succeed())
+		_, err := w.Write([]byte(content))
+		Expect(err).ToNot(HaveOccurred())
+	}
+	Expect(w.Close()).To(Succeed())
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	Expect(err).ToNot(HaveOccurred())
+	return layer
+}
+
+var _ = Describe("OCIImageExtractor", Label("types", "image"), func() {
+	var server *httptest.Server
+	var imageRef string
+
+	BeforeEach(func() {
+		server = httptest.NewServer(registry.New())
+		imageRef = fmt.Sprintf("%s/kairos/test:latest", strings.TrimPrefix(server.URL, "http://"))
+		img, err := mutate.AppendLayers(empty.Image,
+			tarLayer(map[string]string{"etc/a": "a", "etc/b": "b", "usr/big": strings.Repeat("x", 1<<20)}),
+			tarLayer(map[string]string{"etc/.wh.a": "", "usr/c": "c"}),
+			tarLayer(map[string]string{"etc/b": "new b"}),
+			tarLayer(map[string]string{"usr/d": "d"}),
+		)
+		Expect(err).ToNot(HaveOccurred())
+		ref, err := name.ParseReference(imageRef)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(remote.Write(ref, img)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	extracted := func(dir string) map[string]string {
+		files := map[string]string{}
+		Expect(filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			data, err := os.ReadFile(path)
+			rel, _ := filepath.Rel(dir, path)
+			files[rel] = string(data)
+			return err
+		})).To(Succeed())
+		return files
+	}
+
+	It("downloads the layers in parallel and extracts them in order", func() {
+		sequential := GinkgoT().TempDir()
+		Expect(v1.OCIImageExtractor{}.ExtractImage(imageRef, sequential, "")).To(Succeed())
+		parallel := GinkgoT().TempDir()
+		Expect(v1.OCIImageExtractor{Workers: 3}.ExtractImage(imageRef, parallel, "")).To(Succeed())
+
+		files := extracted(parallel)
+		Expect(files).To(Equal(extracted(sequential)))
+		Expect(files).ToNot(HaveKey("etc/a"))
+		Expect(files).To(HaveKeyWithValue("etc/b", "new b"))
+		Expect(files).To(HaveKeyWithValue("usr/c", "c"))
+		Expect(files).To(HaveKeyWithValue("usr/d", "d"))
+	})
+
+	It("stops extracting once its context is done", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		for _, workers := range []int{0, 3} {
+			dir := GinkgoT().TempDir()
+			extractor := v1.OCIImageExtractor{Workers: workers}.WithContext(ctx)
+			Expect(extractor.ExtractImage(imageRef, dir, "")).To(MatchError(ContainSubstring(context.Canceled.Error())))
+			Expect(extracted(dir)).To(BeEmpty())
+		}
+	})
+
+	It("keeps the layers downloaded ahead in the temp dir it's given and removes it", func() {
+		tmp := filepath.Join(GinkgoT().TempDir(), "layers")
+		var namespaces []string
+		removed := false
+		extractor := v1.OCIImageExtractor{Workers: 3}.WithTempDir(func(namespace string) (string, func() error, error) {
+			namespaces = append(namespaces, namespace)
+			return tmp, func() error { removed = true; return os.RemoveAll(tmp) }, os.MkdirAll(tmp, 0755)
+		})
+		Expect(extractor.ExtractImage(imageRef, GinkgoT().TempDir(), "")).To(Succeed())
+		Expect(namespaces).To(Equal([]string{"layers"}))
+		Expect(removed).To(BeTrue())
+		Expect(tmp).ToNot(BeADirectory())
+	})
+
+	It("applies the last layers in parallel over the ones below", func() {
+		dir := GinkgoT().TempDir()
+		extractor := v1.OCIImageExtractor{Workers: 2}
+		Expect(os.MkdirAll(filepath.Join(dir, "etc"), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "etc", "b"), []byte("b"), 0644)).To(Succeed())
+		Expect(extractor.ExtractImageLayers(imageRef, dir, "", 2)).To(Succeed())
+		files := extracted(dir)
+		Expect(files).To(Equal(map[string]string{"etc/b": "new b", "usr/d": "d"}))
+
+		Expect(extractor.ExtractImageLayers(imageRef, dir, "", 5)).To(MatchError(ContainSubstring("has 4 layers")))
+	})
+
+	It("pulls from the registries with credentials", func() {
+		registryHandler := registry.New()
+		private := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "secret" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			registryHandler.ServeHTTP(w, r)
+		}))
+		defer private.Close()
+		host := strings.TrimPrefix(private.URL, "http://")
+		ref, err := name.ParseReference(host + "/kairos/private:latest")
+		Expect(err).ToNot(HaveOccurred())
+		img, err := mutate.AppendLayers(empty.Image, tarLayer(map[string]string{"etc/private": "yes"}))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(remote.Write(ref, img, remote.WithAuth(&authn.Basic{Username: "user", Password: "secret"}))).To(Succeed())
+
+		GinkgoT().Setenv("DOCKER_CONFIG", GinkgoT().TempDir())
+		Expect(v1.OCIImageExtractor{}.ExtractImage(ref.String(), GinkgoT().TempDir(), "")).ToNot(Succeed())
+		extractor := v1.OCIImageExtractor{Auth: &v1.RegistryAuth{Credentials: map[string]v1.RegistryCredentials{
+			host: {Username: "user", Password: "secret"},
+		}}}
+		dir := GinkgoT().TempDir()
+		Expect(extractor.ExtractImage(ref.String(), dir, "")).To(Succeed())
+		Expect(extracted(dir)).To(Equal(map[string]string{"etc/private": "yes"}))
+	})
+
+	It("pulls the images pinned by digest", func() {
+		ref, err := name.ParseReference(imageRef)
+		Expect(err).ToNot(HaveOccurred())
+		desc, err := remote.Get(ref)
+		Expect(err).ToNot(HaveOccurred())
+		pinned := ref.Context().Digest(desc.Digest.String()).String()
+		dir := GinkgoT().TempDir()
+		Expect(v1.OCIImageExtractor{Workers: 2}.ExtractImage(pinned, dir, "")).To(Succeed())
+		Expect(extracted(dir)).To(HaveKeyWithValue("etc/b", "new b"))
+
+		// Multi arch images are pinned by the digest of their index
+		img, err := remote.Image(ref)
+		Expect(err).ToNot(HaveOccurred())
+		index := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: containerv1.Descriptor{Platform: &containerv1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}},
+		})
+		indexRef := ref.Context().Tag("multiarch")
+		Expect(remote.WriteIndex(indexRef, index)).To(Succeed())
+		indexDigest, err := index.Digest()
+		Expect(err).ToNot(HaveOccurred())
+		dir = GinkgoT().TempDir()
+		Expect(v1.OCIImageExtractor{}.ExtractImage(ref.Context().Digest(indexDigest.String()).String(), dir, "")).To(Succeed())
+		Expect(extracted(dir)).To(HaveKeyWithValue("usr/d", "d"))
+
+		missing := ref.Context().Digest("sha256:" + strings.Repeat("0", 64)).String()
+		Expect(v1.OCIImageExtractor{}.ExtractImage(missing, GinkgoT().TempDir(), "")).ToNot(Succeed())
+	})
+
+	It("fails if the registry serves another image for the pinned digest", func() {
+		ref, err := name.ParseReference(imageRef)
+		Expect(err).ToNot(HaveOccurred())
+		desc, err := remote.Get(ref)
+		Expect(err).ToNot(HaveOccurred())
+		other, err := mutate.AppendLayers(empty.Image, tarLayer(map[string]string{"etc/tampered": "yes"}))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(remote.Write(ref.Context().Tag("other"), other)).To(Succeed())
+
+		registryHandler := registry.New()
+		tampering := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.URL.Path = strings.Replace(r.URL.Path, "/manifests/"+desc.Digest.String(), "/manifests/other", 1)
+			registryHandler.ServeHTTP(w, r)
+		}))
+		defer tampering.Close()
+		host := strings.TrimPrefix(tampering.URL, "http://")
+		tamperedRef, err := name.ParseReference(host + "/kairos/test:other")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(remote.Write(tamperedRef, other)).To(Succeed())
+
+		dir := GinkgoT().TempDir()
+		pinned := tamperedRef.Context().Digest(desc.Digest.String()).String()
+		Expect(v1.OCIImageExtractor{}.ExtractImage(pinned, dir, "")).ToNot(Succeed())
+		Expect(extracted(dir)).To(BeEmpty())
+	})
+
+	Context("with registry mirrors", func() {
+		var mirror *httptest.Server
+		var extractor v1.OCIImageExtractor
+		var failed []string
+
+		BeforeEach(func() {
+			mirror = httptest.NewServer(registry.New())
+			failed = nil
+			upstream := strings.TrimPrefix(server.URL, "http://")
+			extractor = v1.OCIImageExtractor{
+				Registries: &v1.Registries{Mirrors: map[string][]string{
+					upstream: {strings.TrimPrefix(mirror.URL, "http://") + "/upstream"},
+				}},
+				MirrorFailed: func(ref string, err error) { failed = append(failed, ref) },
+			}
+		})
+
+		AfterEach(func() {
+			mirror.Close()
+		})
+
+		It("pulls the image from the mirror", func() {
+			img, err := mutate.AppendLayers(empty.Image, tarLayer(map[string]string{"etc/mirrored": "yes"}))
+			Expect(err).ToNot(HaveOccurred())
+			ref, err := name.ParseReference(strings.TrimPrefix(mirror.URL, "http://") + "/upstream/kairos/test:latest")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(remote.Write(ref, img)).To(Succeed())
+
+			dir := GinkgoT().TempDir()
+			Expect(extractor.ExtractImage(imageRef, dir, "")).To(Succeed())
+			Expect(extracted(dir)).To(Equal(map[string]string{"etc/mirrored": "yes"}))
+			Expect(failed).To(BeEmpty())
+		})
+
+		It("falls back to the registry if the mirror lacks the image", func() {
+			dir := GinkgoT().TempDir()
+			Expect(extractor.ExtractImage(imageRef, dir, "")).To(Succeed())
+			Expect(extracted(dir)).To(HaveKeyWithValue("etc/b", "new b"))
+			Expect(failed).To(Equal([]string{strings.TrimPrefix(mirror.URL, "http://") + "/upstream/kairos/test:latest"}))
+
+			mirror.Close()
+			failed = nil
+			_, err := extractor.GetOCIImageMetadata(imageRef, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(failed).To(HaveLen(1))
+		})
+	})
+})
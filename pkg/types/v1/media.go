@@ -0,0 +1,114 @@
+/*
+Copyright © 2022 - 2023 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Kinds of FlashMedia
+const (
+	MediaEMMC = "emmc"
+	MediaSD   = "sd"
+)
+
+// Values of the media tuning of the install spec
+const (
+	MediaTuningAuto = "auto"
+	MediaTuningOff  = "off"
+)
+
+// FlashPersistentFS is the filesystem suggested for the persistent partition on flash media
+const FlashPersistentFS = "f2fs"
+
+// mmcDevice matches the mmc disks and their partitions, i.e. mmcblk0p2, but not the eMMC boot and rpmb areas
+var mmcDevice = regexp.MustCompile(`^(mmcblk\d+)(p\d+)?$`)
+
+// FlashMedia is an SD card or eMMC device, its wear and the install decisions taken to reduce it
+type FlashMedia struct {
+	Device string `json:"device" yaml:"device"`
+	Kind   string `json:"kind" yaml:"kind"`
+	// LifeTimeUsed is the upper bound of the estimated percentage of the lifetime used, as reported by eMMC devices.
+	// Zero if the device doesn't report it, over 100 once the estimated lifetime was exceeded.
+	LifeTimeUsed int `json:"life-time-used,omitempty" yaml:"life-time-used,omitempty"`
+	// PreEOL is the state of the reserved blocks reported by eMMC devices: normal, warning or urgent
+	PreEOL string `json:"pre-eol,omitempty" yaml:"pre-eol,omitempty"`
+	// SingleSync syncs once after formatting all the partitions instead of after each of them
+	SingleSync bool `json:"single-sync,omitempty" yaml:"single-sync,omitempty"`
+	// VolatileJournal keeps the journald logs in memory on the installed system
+	VolatileJournal bool `json:"volatile-journal,omitempty" yaml:"volatile-journal,omitempty"`
+	// SuggestedPersistentFS is the filesystem recommended for the persistent partition, if not the configured one
+	SuggestedPersistentFS string `json:"suggested-persistent-fs,omitempty" yaml:"suggested-persistent-fs,omitempty"`
+}
+
+// DetectFlashMedia returns the flash media the given device or partition is on, nil if it is not an SD card nor an
+// eMMC device. The media is identified by the mmc subsystem in sysfs. No install decision is set.
+func DetectFlashMedia(fs FS, device string) *FlashMedia {
+	m := mmcDevice.FindStringSubmatch(filepath.Base(device))
+	if m == nil {
+		return nil
+	}
+	name := m[1]
+	sysDir := filepath.Join("/sys/block", name, "device")
+	if _, err := fs.Stat(filepath.Join("/sys/block", name)); err != nil {
+		return nil
+	}
+	media := &FlashMedia{Device: "/dev/" + name, Kind: MediaSD}
+	// The type is not there on old kernels, those are treated as SD cards which are the less durable of both
+	if data, err := fs.ReadFile(filepath.Join(sysDir, "type")); err == nil && strings.TrimSpace(string(data)) == "MMC" {
+		media.Kind = MediaEMMC
+	}
+	if data, err := fs.ReadFile(filepath.Join(sysDir, "life_time")); err == nil {
+		// Type A and type B estimates, in steps of 10%
+		for _, f := range strings.Fields(string(data)) {
+			if v, err := strconv.ParseInt(f, 0, 0); err == nil && int(v)*10 > media.LifeTimeUsed {
+				media.LifeTimeUsed = int(v) * 10
+			}
+		}
+	}
+	if data, err := fs.ReadFile(filepath.Join(sysDir, "pre_eol_info")); err == nil {
+		if v, err := strconv.ParseInt(strings.TrimSpace(string(data)), 0, 0); err == nil {
+			media.PreEOL = map[int64]string{1: "normal", 2: "warning", 3: "urgent"}[v]
+		}
+	}
+	return media
+}
+
+// Warnings returns the problems with the expected lifetime of the media
+func (m *FlashMedia) Warnings() []string {
+	var warnings []string
+	switch {
+	case m.LifeTimeUsed > 100:
+		warnings = append(warnings, fmt.Sprintf("%s has exceeded its estimated lifetime, replace it", m.Device))
+	case m.LifeTimeUsed >= 80:
+		warnings = append(warnings, fmt.Sprintf("%s has used up to %d%% of its estimated lifetime", m.Device, m.LifeTimeUsed))
+	}
+	switch m.PreEOL {
+	case "warning":
+		warnings = append(warnings, fmt.Sprintf("%s has consumed 80%% of its reserved blocks", m.Device))
+	case "urgent":
+		warnings = append(warnings, fmt.Sprintf("%s has consumed 90%% of its reserved blocks, replace it", m.Device))
+	}
+	if m.Kind == MediaSD {
+		warnings = append(warnings, fmt.Sprintf("%s is an SD card, which doesn't report its wear and is expected to last less than eMMC storage under constant writes", m.Device))
+	}
+	return warnings
+}
@@ -0,0 +1,58 @@
+/*
+Copyright © 2022 - 2023 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1_test
+
+import (
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/twpayne/go-vfs/v5/vfst"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DetectFlashMedia", Label("types", "media"), func() {
+	var fs v1.FS
+	BeforeEach(func() {
+		var cleanup func()
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{
+			"/sys/block/sda/device/type":             "0",
+			"/sys/block/mmcblk0/device/type":         "MMC\n",
+			"/sys/block/mmcblk0/device/life_time":    "0x02 0x09\n",
+			"/sys/block/mmcblk0/device/pre_eol_info": "0x02\n",
+			"/sys/block/mmcblk0boot0/device/type":    "MMC\n",
+			"/sys/block/mmcblk1/device/type":         "SD\n",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(cleanup)
+	})
+	It("detects the wear of eMMC devices from their partitions", func() {
+		media := v1.DetectFlashMedia(fs, "/dev/mmcblk0p3")
+		Expect(media).To(Equal(&v1.FlashMedia{Device: "/dev/mmcblk0", Kind: v1.MediaEMMC, LifeTimeUsed: 90, PreEOL: "warning"}))
+		Expect(media.Warnings()).To(HaveLen(2))
+	})
+	It("detects SD cards", func() {
+		media := v1.DetectFlashMedia(fs, "/dev/mmcblk1")
+		Expect(media.Kind).To(Equal(v1.MediaSD))
+		Expect(media.Warnings()).To(HaveLen(1))
+	})
+	It("ignores other disks and the eMMC boot areas", func() {
+		Expect(v1.DetectFlashMedia(fs, "/dev/sda")).To(BeNil())
+		Expect(v1.DetectFlashMedia(fs, "/dev/mmcblk0boot0")).To(BeNil())
+		Expect(v1.DetectFlashMedia(fs, "/dev/mmcblk2")).To(BeNil())
+	})
+})
@@ -0,0 +1,99 @@
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// Registries configures how the image registries are reached
+type Registries struct {
+	// Mirrors are the mirrors of each registry host, like `docker.io` or `quay.io`, tried in order before the
+	// registry itself. A mirror is a registry host with an optional path the repositories are under, like
+	// `mirror.local:5000/quay`.
+	Mirrors map[string][]string `yaml:"mirrors,omitempty" mapstructure:"mirrors"`
+}
+
+// Validate checks the registries and mirrors are valid registry names
+func (r *Registries) Validate() error {
+	registries := make([]string, 0, len(r.Mirrors))
+	for registry := range r.Mirrors {
+		registries = append(registries, registry)
+	}
+	sort.Strings(registries)
+	for _, registry := range registries {
+		if _, err := name.NewRegistry(registry, name.StrictValidation); err != nil {
+			return fmt.Errorf("mirrors: invalid registry %q: %w", registry, err)
+		}
+		if len(r.Mirrors[registry]) == 0 {
+			return fmt.Errorf("mirrors: no mirror set for registry %s", registry)
+		}
+		for _, mirror := range r.Mirrors[registry] {
+			if _, err := mirrorRepository(mirror, "library/image"); err != nil {
+				return fmt.Errorf("mirrors: invalid mirror %q of registry %s: %w", mirror, registry, err)
+			}
+		}
+	}
+	return nil
+}
+
+// References returns the references to pull the image from its mirrors with, in order. It returns none if the
+// registry of the image has no mirrors or the reference can't be parsed, the image is pulled from the registry.
+func (r *Registries) References(imageRef string) []string {
+	if r == nil || len(r.Mirrors) == 0 {
+		return nil
+	}
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		return nil
+	}
+	var mirrors []string
+	for registry, m := range r.Mirrors {
+		// Normalized, so docker.io matches the index.docker.io of the references with no registry
+		if reg, err := name.NewRegistry(registry); err == nil && reg.RegistryStr() == ref.Context().RegistryStr() {
+			mirrors = m
+			break
+		}
+	}
+	var refs []string
+	for _, mirror := range mirrors {
+		repo, err := mirrorRepository(mirror, ref.Context().RepositoryStr())
+		if err != nil {
+			continue
+		}
+		separator := ":"
+		if _, ok := ref.(name.Digest); ok {
+			separator = "@"
+		}
+		refs = append(refs, repo.Name()+separator+ref.Identifier())
+	}
+	return refs
+}
+
+// mirrorRepository returns the repository in the mirror for the repository of the mirrored registry
+func mirrorRepository(mirror, repository string) (name.Repository, error) {
+	mirror = strings.TrimSuffix(mirror, "/")
+	if mirror == "" || strings.Contains(mirror, "://") {
+		return name.Repository{}, errors.New("expected a registry host with an optional path")
+	}
+	return name.NewRepository(mirror+"/"+repository, name.StrictValidation)
+}
+
+// Resolve calls pull with the mirror references of imageRef in order and then with imageRef itself, until one of
+// them succeeds. The failed mirrors are reported to failed, which can be nil. If the registry fails as well its
+// error is returned.
+func (r *Registries) Resolve(imageRef string, failed func(ref string, err error), pull func(ref string) error) error {
+	for _, ref := range r.References(imageRef) {
+		err := pull(ref)
+		if err == nil {
+			return nil
+		}
+		if failed != nil {
+			failed(ref, err)
+		}
+	}
+	return pull(imageRef)
+}
@@ -0,0 +1,56 @@
+package v1_test
+
+import (
+	"errors"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Registries", Label("types", "mirrors"), func() {
+	registries := &v1.Registries{Mirrors: map[string][]string{
+		"docker.io": {"mirror.local:5000/dockerhub", "backup.local/"},
+		"quay.io":   {"mirror.local:5000"},
+	}}
+
+	It("rewrites the references to the mirrors of their registry", func() {
+		Expect(registries.References("alpine:3.19")).To(Equal([]string{
+			"mirror.local:5000/dockerhub/library/alpine:3.19",
+			"backup.local/library/alpine:3.19",
+		}))
+		Expect(registries.References("quay.io/kairos/ubuntu@sha256:0123456789012345678901234567890123456789012345678901234567890123")).To(Equal([]string{
+			"mirror.local:5000/kairos/ubuntu@sha256:0123456789012345678901234567890123456789012345678901234567890123",
+		}))
+		Expect(registries.References("ghcr.io/kairos/ubuntu:latest")).To(BeEmpty())
+		Expect((*v1.Registries)(nil).References("alpine")).To(BeEmpty())
+	})
+
+	It("falls back to the next mirror and to the registry", func() {
+		var tried, failed []string
+		err := registries.Resolve("quay.io/kairos/ubuntu:latest", func(ref string, err error) {
+			failed = append(failed, ref)
+		}, func(ref string) error {
+			tried = append(tried, ref)
+			if ref == "quay.io/kairos/ubuntu:latest" {
+				return nil
+			}
+			return errors.New("not found")
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tried).To(Equal([]string{"mirror.local:5000/kairos/ubuntu:latest", "quay.io/kairos/ubuntu:latest"}))
+		Expect(failed).To(Equal([]string{"mirror.local:5000/kairos/ubuntu:latest"}))
+
+		err = registries.Resolve("quay.io/kairos/ubuntu:latest", nil, func(ref string) error {
+			return errors.New(ref)
+		})
+		Expect(err).To(MatchError("quay.io/kairos/ubuntu:latest"))
+	})
+
+	It("validates the mirrors", func() {
+		Expect(registries.Validate()).To(Succeed())
+		Expect((&v1.Registries{Mirrors: map[string][]string{"quay.io": nil}}).Validate()).To(MatchError(ContainSubstring("no mirror")))
+		Expect((&v1.Registries{Mirrors: map[string][]string{"quay.io": {"https://mirror.local"}}}).Validate()).To(MatchError(ContainSubstring("invalid mirror")))
+		Expect((&v1.Registries{Mirrors: map[string][]string{"Quay.io/kairos": {"mirror.local"}}}).Validate()).To(MatchError(ContainSubstring("invalid registry")))
+	})
+})
@@ -115,6 +115,10 @@ func archToGolangArch(arch string) (string, error) {
 		return constants.ArchAmd64, nil
 	case constants.ArchArm64:
 		return constants.ArchArm64, nil
+	case constants.ArchS390x:
+		return constants.ArchS390x, nil
+	case constants.ArchPpc64:
+		return constants.ArchPpc64, nil
 	default:
 		return "", errInvalidArch
 	}
@@ -128,6 +132,10 @@ func golangArchToArch(arch string) (string, error) {
 		return constants.Archx86, nil
 	case constants.ArchArm64:
 		return constants.ArchArm64, nil
+	case constants.ArchS390x:
+		return constants.ArchS390x, nil
+	case constants.ArchPpc64:
+		return constants.ArchPpc64, nil
 	default:
 		return "", errInvalidArch
 	}
@@ -0,0 +1,179 @@
+/*
+Copyright © 2022 - 2023 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// OCIImageMetadata is the image metadata an ImagePolicy is evaluated against
+type OCIImageMetadata struct {
+	Labels      map[string]string
+	Annotations map[string]string
+	Created     time.Time
+	// Referrers are the artifacts referring to the image, only fetched if the policy requires attestations
+	Referrers []OCIReferrer
+}
+
+// OCIReferrer is an artifact referring to an image in its registry, like an SBOM, a vulnerability scan or an attestation
+type OCIReferrer struct {
+	ArtifactType string            `json:"artifact_type" yaml:"artifact_type"`
+	Digest       string            `json:"digest" yaml:"digest"`
+	Annotations  map[string]string `json:"annotations,omitempty" yaml:"annotations,omitempty"`
+	// Files are the names the artifact blobs are stored with, next to the referrers record
+	Files []string `json:"files,omitempty" yaml:"files,omitempty"`
+}
+
+// Referrers stores the artifacts referring to the deployed OCI images, in the given dir by image digest
+type Referrers struct {
+	Dir string `yaml:"dir,omitempty" mapstructure:"dir"`
+	// ArtifactTypes limits the stored artifacts to the given types or kinds (see AttestationKinds), all if empty
+	ArtifactTypes []string `yaml:"artifact-types,omitempty" mapstructure:"artifact-types"`
+}
+
+// AttestationKinds are the short names of the artifact types usually attached to images
+var AttestationKinds = map[string][]string{
+	"sbom":        {"application/spdx+json", "application/vnd.cyclonedx+json", "application/vnd.syft+json"},
+	"vuln-scan":   {"application/sarif+json", "application/vnd.aquasec.trivy.report+json", "application/vnd.grype.report+json"},
+	"attestation": {"application/vnd.in-toto+json", "application/vnd.dev.sigstore.bundle.v0.3+json", "application/vnd.dev.sigstore.bundle+json;version=0.3"},
+	"signature":   {"application/vnd.dev.cosign.artifact.sig.v1+json", "application/vnd.cncf.notary.signature"},
+}
+
+// MatchesArtifactType is true if the referrer is of the given artifact type or kind
+func (r OCIReferrer) MatchesArtifactType(want string) bool {
+	if r.ArtifactType == want {
+		return true
+	}
+	for _, t := range AttestationKinds[want] {
+		if r.ArtifactType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// ImagePolicy is a set of constraints an OCI image must satisfy before it is installed or upgraded to
+type ImagePolicy struct {
+	// RequiredLabels maps the labels (or manifest annotations) the image must have to their expected value.
+	// An empty value only requires the label to be present.
+	RequiredLabels map[string]string `yaml:"required-labels,omitempty" mapstructure:"required-labels"`
+	// AllowedRegistries lists the registries, or registry/repository prefixes, images can be pulled from
+	AllowedRegistries []string `yaml:"allowed-registries,omitempty" mapstructure:"allowed-registries"`
+	// MaxAge is the maximum age of the image, as a duration (e.g. 720h), based on its creation date
+	MaxAge string `yaml:"max-age,omitempty" mapstructure:"max-age"`
+	// RequiredAttestations lists the artifact types, or kinds like sbom, the image must have a referrer of
+	RequiredAttestations []string `yaml:"required-attestations,omitempty" mapstructure:"required-attestations"`
+}
+
+// PolicyViolationError lists all the policy rules an image does not comply with
+type PolicyViolationError struct {
+	Image      string
+	Violations []string
+}
+
+func (e *PolicyViolationError) Error() string {
+	return fmt.Sprintf("image %s violates the image policy:\n - %s", e.Image, strings.Join(e.Violations, "\n - "))
+}
+
+// CheckRegistry evaluates the allowed registries rule, which needs no image metadata
+func (p ImagePolicy) CheckRegistry(imageRef string) error {
+	if len(p.AllowedRegistries) == 0 {
+		return nil
+	}
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		return err
+	}
+	repo := ref.Context().Name()
+	for _, allowed := range p.AllowedRegistries {
+		allowed = strings.TrimSuffix(allowed, "/")
+		if repo == allowed || strings.HasPrefix(repo, allowed+"/") {
+			return nil
+		}
+	}
+	return &PolicyViolationError{
+		Image:      imageRef,
+		Violations: []string{fmt.Sprintf("repository %s is not in the allowed registries %v", repo, p.AllowedRegistries)},
+	}
+}
+
+// Check evaluates the whole policy for the given image and its metadata, reporting all the violations at once
+func (p ImagePolicy) Check(imageRef string, meta OCIImageMetadata, now time.Time) error {
+	var violations []string
+
+	if err := p.CheckRegistry(imageRef); err != nil {
+		policyErr, ok := err.(*PolicyViolationError)
+		if !ok {
+			return err
+		}
+		violations = append(violations, policyErr.Violations...)
+	}
+
+	keys := make([]string, 0, len(p.RequiredLabels))
+	for k := range p.RequiredLabels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		value, ok := meta.Labels[k]
+		if !ok {
+			value, ok = meta.Annotations[k]
+		}
+		if !ok {
+			violations = append(violations, fmt.Sprintf("required label %s is missing", k))
+			continue
+		}
+		if expected := p.RequiredLabels[k]; expected != "" && value != expected {
+			violations = append(violations, fmt.Sprintf("label %s is %q, expected %q", k, value, expected))
+		}
+	}
+
+	if p.MaxAge != "" {
+		maxAge, err := time.ParseDuration(p.MaxAge)
+		if err != nil {
+			return fmt.Errorf("invalid image policy max-age %s: %w", p.MaxAge, err)
+		}
+		if meta.Created.IsZero() {
+			violations = append(violations, "image has no creation date, its age cannot be checked")
+		} else if age := now.Sub(meta.Created); age > maxAge {
+			violations = append(violations, fmt.Sprintf("image is %s old, older than the max age %s", age.Round(time.Second), maxAge))
+		}
+	}
+
+	for _, want := range p.RequiredAttestations {
+		found := false
+		for _, r := range meta.Referrers {
+			if r.MatchesArtifactType(want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			violations = append(violations, fmt.Sprintf("required attestation %s is missing", want))
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PolicyViolationError{Image: imageRef, Violations: violations}
+	}
+	return nil
+}
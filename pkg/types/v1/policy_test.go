@@ -0,0 +1,89 @@
+/*
+Copyright © 2022 - 2023 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1_test
+
+import (
+	"errors"
+	"time"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ImagePolicy", Label("types", "policy"), func() {
+	var now time.Time
+	var meta v1.OCIImageMetadata
+	BeforeEach(func() {
+		now = time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+		meta = v1.OCIImageMetadata{
+			Labels:      map[string]string{"io.kairos.flavor": "ubuntu"},
+			Annotations: map[string]string{"org.opencontainers.image.version": "v3.2.1"},
+			Created:     now.Add(-24 * time.Hour),
+		}
+	})
+	It("accepts an image complying with all the rules", func() {
+		p := v1.ImagePolicy{
+			RequiredLabels: map[string]string{
+				"io.kairos.flavor":                 "ubuntu",
+				"org.opencontainers.image.version": "",
+			},
+			AllowedRegistries: []string{"quay.io/kairos/"},
+			MaxAge:            "720h",
+		}
+		Expect(p.Check("quay.io/kairos/ubuntu:latest", meta, now)).To(Succeed())
+	})
+	It("reports all the violations at once", func() {
+		p := v1.ImagePolicy{
+			RequiredLabels:    map[string]string{"io.kairos.flavor": "alpine", "io.kairos.model": ""},
+			AllowedRegistries: []string{"quay.io/kairos"},
+			MaxAge:            "1h",
+		}
+		err := p.Check("quay.io/kairosfake/ubuntu:latest", meta, now)
+		Expect(err).To(HaveOccurred())
+		var policyErr *v1.PolicyViolationError
+		Expect(errors.As(err, &policyErr)).To(BeTrue())
+		Expect(policyErr.Violations).To(HaveLen(4))
+		Expect(err.Error()).To(ContainSubstring("quay.io/kairosfake/ubuntu"))
+		Expect(err.Error()).To(ContainSubstring("io.kairos.model is missing"))
+		Expect(err.Error()).To(ContainSubstring("older than the max age"))
+	})
+	It("matches docker hub images with their canonical name", func() {
+		p := v1.ImagePolicy{AllowedRegistries: []string{"index.docker.io/library"}}
+		Expect(p.CheckRegistry("alpine:latest")).To(Succeed())
+		Expect(p.CheckRegistry("quay.io/library/alpine:latest")).NotTo(Succeed())
+	})
+	It("fails on images without creation date when max age is set", func() {
+		p := v1.ImagePolicy{MaxAge: "720h"}
+		meta.Created = time.Time{}
+		Expect(p.Check("quay.io/kairos/ubuntu:latest", meta, now)).NotTo(Succeed())
+		p.MaxAge = "a month"
+		Expect(p.Check("quay.io/kairos/ubuntu:latest", meta, now)).NotTo(Succeed())
+	})
+	It("requires attestations by artifact type or kind", func() {
+		p := v1.ImagePolicy{RequiredAttestations: []string{"sbom", "application/vnd.in-toto+json"}}
+		meta.Referrers = []v1.OCIReferrer{{ArtifactType: "application/vnd.cyclonedx+json", Digest: "sha256:1"}}
+		err := p.Check("quay.io/kairos/ubuntu:latest", meta, now)
+		Expect(err).To(HaveOccurred())
+		var policyErr *v1.PolicyViolationError
+		Expect(errors.As(err, &policyErr)).To(BeTrue())
+		Expect(policyErr.Violations).To(Equal([]string{"required attestation application/vnd.in-toto+json is missing"}))
+
+		meta.Referrers = append(meta.Referrers, v1.OCIReferrer{ArtifactType: "application/vnd.in-toto+json", Digest: "sha256:2"})
+		Expect(p.Check("quay.io/kairos/ubuntu:latest", meta, now)).To(Succeed())
+	})
+})
@@ -0,0 +1,96 @@
+package v1
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProgressRecord is a status update of a long running action, like install, upgrade or reset
+type ProgressRecord struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	Phase   string    `json:"phase"`
+	Percent int       `json:"percent"`
+	// Bytes are the bytes downloaded so far by the action, if known
+	Bytes   int64  `json:"bytes,omitempty"`
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ProgressReporter receives the progress of the running action
+type ProgressReporter interface {
+	Report(record ProgressRecord)
+}
+
+// NullProgress discards the progress records, it's the default reporter
+type NullProgress struct{}
+
+func (NullProgress) Report(ProgressRecord) {}
+
+// JSONProgress writes the progress records as newline delimited JSON, one record per line, for management agents
+// wrapping the agent to follow the action without parsing its logs
+type JSONProgress struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewJSONProgress(w io.Writer) *JSONProgress {
+	return &JSONProgress{w: w}
+}
+
+func (p *JSONProgress) Report(record ProgressRecord) {
+	if record.Time.IsZero() {
+		record.Time = time.Now().UTC()
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, _ = p.w.Write(append(data, '\n'))
+}
+
+// DownloadCounter is a transport counting the bytes read from the response bodies of the wrapped transport, so the
+// progress of the image pulls can be reported
+type DownloadCounter struct {
+	base  http.RoundTripper
+	bytes atomic.Int64
+}
+
+// NewDownloadCounter wraps the given transport, the default one if nil
+func NewDownloadCounter(base http.RoundTripper) *DownloadCounter {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &DownloadCounter{base: base}
+}
+
+func (c *DownloadCounter) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := c.base.RoundTrip(req)
+	if err != nil || resp.Body == nil {
+		return resp, err
+	}
+	resp.Body = &countingBody{ReadCloser: resp.Body, counter: &c.bytes}
+	return resp, nil
+}
+
+// Bytes returns the bytes downloaded so far
+func (c *DownloadCounter) Bytes() int64 {
+	return c.bytes.Load()
+}
+
+type countingBody struct {
+	io.ReadCloser
+	counter *atomic.Int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.counter.Add(int64(n))
+	return n, err
+}
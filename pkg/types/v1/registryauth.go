@@ -0,0 +1,153 @@
+package v1
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	registrytypes "github.com/docker/docker/api/types/registry"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// RegistryAuth are the credentials to pull the images of private registries with. The registries not set here are
+// pulled with the credentials of the docker config of the root user, if any.
+type RegistryAuth struct {
+	// DockerConfigJSON is the path of a docker config.json, or of a kubernetes dockerconfigjson secret, with the
+	// credentials of the registries in its auths. Credential helpers are not supported.
+	DockerConfigJSON string `yaml:"dockerconfigjson,omitempty" mapstructure:"dockerconfigjson"`
+	// Credentials are the credentials of each registry host, taking precedence over the docker config ones
+	Credentials map[string]RegistryCredentials `yaml:"credentials,omitempty" mapstructure:"credentials"`
+}
+
+// RegistryCredentials are the credentials of a registry: a username and password, a base64 encoded
+// `username:password` auth as in the docker config, or an identity token
+type RegistryCredentials struct {
+	Username      string `yaml:"username,omitempty" mapstructure:"username" json:"username,omitempty"`
+	Password      string `yaml:"password,omitempty" mapstructure:"password" json:"password,omitempty"`
+	Auth          string `yaml:"auth,omitempty" mapstructure:"auth" json:"auth,omitempty"`
+	IdentityToken string `yaml:"identitytoken,omitempty" mapstructure:"identitytoken" json:"identitytoken,omitempty"`
+}
+
+var _ authn.Keychain = &RegistryAuth{}
+
+// Validate checks the registries are valid registry hosts and have credentials set
+func (a *RegistryAuth) Validate() error {
+	registries := make([]string, 0, len(a.Credentials))
+	for registry := range a.Credentials {
+		registries = append(registries, registry)
+	}
+	sort.Strings(registries)
+	for _, registry := range registries {
+		if _, err := name.NewRegistry(registry, name.StrictValidation); err != nil {
+			return fmt.Errorf("credentials: invalid registry %q: %w", registry, err)
+		}
+		if _, err := a.Credentials[registry].authConfig(); err != nil {
+			return fmt.Errorf("credentials of registry %s: %w", registry, err)
+		}
+	}
+	return nil
+}
+
+// Resolve returns the authenticator for the registry of the resource: its credentials, the ones of the docker
+// config.json or the ones of the default keychain, in that order
+func (a *RegistryAuth) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	if a == nil {
+		return authn.DefaultKeychain.Resolve(target)
+	}
+	if creds, ok := registryCredentials(a.Credentials, target.RegistryStr()); ok {
+		cfg, err := creds.authConfig()
+		if err != nil {
+			return nil, err
+		}
+		return authn.FromConfig(cfg), nil
+	}
+	if a.DockerConfigJSON != "" {
+		data, err := os.ReadFile(a.DockerConfigJSON)
+		if err != nil {
+			return nil, fmt.Errorf("reading the registry credentials: %w", err)
+		}
+		var config struct {
+			Auths map[string]RegistryCredentials `json:"auths"`
+		}
+		if err = json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("parsing the registry credentials %s: %w", a.DockerConfigJSON, err)
+		}
+		if creds, ok := registryCredentials(config.Auths, target.RegistryStr()); ok {
+			cfg, err := creds.authConfig()
+			if err != nil {
+				return nil, fmt.Errorf("credentials of registry %s in %s: %w", target.RegistryStr(), a.DockerConfigJSON, err)
+			}
+			return authn.FromConfig(cfg), nil
+		}
+	}
+	return authn.DefaultKeychain.Resolve(target)
+}
+
+// AuthConfig returns the credentials for the registry of the image, nil for the ones without credentials, which
+// are pulled anonymously or with the default keychain
+func (a *RegistryAuth) AuthConfig(imageRef string) (*registrytypes.AuthConfig, error) {
+	if a == nil {
+		return nil, nil
+	}
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := a.Resolve(ref.Context())
+	if err != nil {
+		return nil, err
+	}
+	if auth == authn.Anonymous {
+		return nil, nil
+	}
+	cfg, err := auth.Authorization()
+	if err != nil {
+		return nil, err
+	}
+	return &registrytypes.AuthConfig{
+		Username:      cfg.Username,
+		Password:      cfg.Password,
+		Auth:          cfg.Auth,
+		IdentityToken: cfg.IdentityToken,
+		RegistryToken: cfg.RegistryToken,
+	}, nil
+}
+
+// registryCredentials returns the credentials of the registry, the keys being registry hosts or, as in the docker
+// config, URLs like https://index.docker.io/v1/
+func registryCredentials(credentials map[string]RegistryCredentials, registry string) (RegistryCredentials, bool) {
+	for key, creds := range credentials {
+		host := key
+		if i := strings.Index(host, "://"); i >= 0 {
+			host = host[i+3:]
+		}
+		host, _, _ = strings.Cut(host, "/")
+		// Normalized, so docker.io matches the index.docker.io of the references with no registry
+		if reg, err := name.NewRegistry(host); err == nil && reg.RegistryStr() == registry {
+			return creds, true
+		}
+	}
+	return RegistryCredentials{}, false
+}
+
+func (c RegistryCredentials) authConfig() (authn.AuthConfig, error) {
+	cfg := authn.AuthConfig{Username: c.Username, Password: c.Password, IdentityToken: c.IdentityToken}
+	if c.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(c.Auth)
+		if err != nil {
+			return cfg, fmt.Errorf("auth is not base64 encoded: %w", err)
+		}
+		var ok bool
+		if cfg.Username, cfg.Password, ok = strings.Cut(string(decoded), ":"); !ok {
+			return cfg, fmt.Errorf("auth is not a base64 encoded username:password")
+		}
+	}
+	if cfg.Username == "" && cfg.IdentityToken == "" {
+		return cfg, fmt.Errorf("no username, auth or identitytoken set")
+	}
+	return cfg, nil
+}
@@ -0,0 +1,80 @@
+package v1_test
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RegistryAuth", Label("types", "registry-auth"), func() {
+	var auth *v1.RegistryAuth
+
+	resolve := func(registry string) authn.AuthConfig {
+		reg, err := name.NewRegistry(registry)
+		Expect(err).ToNot(HaveOccurred())
+		a, err := auth.Resolve(reg)
+		Expect(err).ToNot(HaveOccurred())
+		cfg, err := a.Authorization()
+		Expect(err).ToNot(HaveOccurred())
+		return *cfg
+	}
+
+	BeforeEach(func() {
+		// Keep the docker config of the user running the tests out of them
+		GinkgoT().Setenv("DOCKER_CONFIG", GinkgoT().TempDir())
+		config := filepath.Join(GinkgoT().TempDir(), "config.json")
+		Expect(os.WriteFile(config, []byte(`{"auths": {
+			"https://index.docker.io/v1/": {"auth": "aHViOnNlY3JldA=="},
+			"registry.example.com": {"username": "config", "password": "pass"},
+			"ghcr.io": {"identitytoken": "token"}
+		}}`), 0600)).To(Succeed())
+		auth = &v1.RegistryAuth{
+			DockerConfigJSON: config,
+			Credentials: map[string]v1.RegistryCredentials{
+				"registry.example.com": {Username: "user", Password: "secret"},
+			},
+		}
+	})
+
+	It("resolves the credentials of each registry", func() {
+		Expect(resolve("registry.example.com")).To(Equal(authn.AuthConfig{Username: "user", Password: "secret"}))
+		Expect(resolve("docker.io")).To(Equal(authn.AuthConfig{Username: "hub", Password: "secret"}))
+		Expect(resolve("ghcr.io")).To(Equal(authn.AuthConfig{IdentityToken: "token"}))
+		Expect(resolve("quay.io")).To(Equal(authn.AuthConfig{}))
+
+		cfg, err := auth.AuthConfig("alpine:3.19")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cfg.Username).To(Equal("hub"))
+		cfg, err = auth.AuthConfig("quay.io/kairos/ubuntu:latest")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cfg).To(BeNil())
+		cfg, err = (*v1.RegistryAuth)(nil).AuthConfig("quay.io/kairos/ubuntu:latest")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cfg).To(BeNil())
+	})
+
+	It("fails if the docker config can't be read", func() {
+		auth.DockerConfigJSON = "/does/not/exist.json"
+		_, err := auth.AuthConfig("quay.io/kairos/ubuntu:latest")
+		Expect(err).To(MatchError(ContainSubstring("reading the registry credentials")))
+		// The registries set in the config don't need it
+		_, err = auth.AuthConfig("registry.example.com/kairos/ubuntu:latest")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("validates the credentials", func() {
+		Expect(auth.Validate()).To(Succeed())
+		auth.Credentials["quay.io"] = v1.RegistryCredentials{Password: "secret"}
+		Expect(auth.Validate()).To(MatchError(ContainSubstring("no username")))
+		auth.Credentials["quay.io"] = v1.RegistryCredentials{Auth: "bm9jb2xvbg=="}
+		Expect(auth.Validate()).To(MatchError(ContainSubstring("username:password")))
+		delete(auth.Credentials, "quay.io")
+		auth.Credentials["https://quay.io"] = v1.RegistryCredentials{Username: "user"}
+		Expect(auth.Validate()).To(MatchError(ContainSubstring("invalid registry")))
+	})
+})
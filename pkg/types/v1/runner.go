@@ -17,13 +17,18 @@ limitations under the License.
 package v1
 
 import (
+	"bytes"
+	"context"
 	sdkTypes "github.com/kairos-io/kairos-sdk/types"
 	"os/exec"
 	"strings"
+	"time"
 )
 
 type Runner interface {
 	InitCmd(string, ...string) *exec.Cmd
+	// InitCmdContext is InitCmd for a command that is killed if ctx is done before it finishes
+	InitCmdContext(context.Context, string, ...string) *exec.Cmd
 	Run(string, ...string) ([]byte, error)
 	RunCmd(cmd *exec.Cmd) ([]byte, error)
 	GetLogger() *sdkTypes.KairosLogger
@@ -38,8 +43,25 @@ func (r RealRunner) InitCmd(command string, args ...string) *exec.Cmd {
 	return exec.Command(command, args...)
 }
 
+func (r RealRunner) InitCmdContext(ctx context.Context, command string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, command, args...)
+	// Children of a killed command could keep its output pipes open, don't wait for them forever
+	cmd.WaitDelay = 5 * time.Second
+	return cmd
+}
+
+// RunCmd runs the command and returns its combined output. If the command stdout is already set, i.e. to
+// stream it, only the stderr is returned.
 func (r RealRunner) RunCmd(cmd *exec.Cmd) ([]byte, error) {
-	return cmd.CombinedOutput()
+	if cmd.Stdout == nil {
+		return cmd.CombinedOutput()
+	}
+	var stderr bytes.Buffer
+	if cmd.Stderr == nil {
+		cmd.Stderr = &stderr
+	}
+	err := cmd.Run()
+	return stderr.Bytes(), err
 }
 
 func (r RealRunner) Run(command string, args ...string) ([]byte, error) {
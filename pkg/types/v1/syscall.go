@@ -17,6 +17,7 @@ limitations under the License.
 package v1
 
 import (
+	"path/filepath"
 	"syscall"
 )
 
@@ -43,3 +44,29 @@ func (r *RealSyscall) Mount(source string, target string, fstype string, flags u
 func (r *RealSyscall) Syscall(trap, a1, a2, a3 uintptr) (r1, r2 uintptr, err syscall.Errno) {
 	return syscall.Syscall(trap, a1, a2, a3)
 }
+
+// RootedSyscall runs the syscalls on paths of a system mounted at Root instead of the host ones, see the --root flag.
+// Relative paths and mount sources, devices of the host, are left alone.
+type RootedSyscall struct {
+	SyscallInterface
+	Root string
+}
+
+func (r *RootedSyscall) Chroot(path string) error {
+	return r.SyscallInterface.Chroot(r.inRoot(path))
+}
+
+func (r *RootedSyscall) Chdir(path string) error {
+	return r.SyscallInterface.Chdir(r.inRoot(path))
+}
+
+func (r *RootedSyscall) Mount(source string, target string, fstype string, flags uintptr, data string) error {
+	return r.SyscallInterface.Mount(source, r.inRoot(target), fstype, flags, data)
+}
+
+func (r *RootedSyscall) inRoot(path string) string {
+	if !filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(r.Root, path)
+}
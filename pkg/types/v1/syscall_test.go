@@ -49,6 +49,16 @@ var _ = Describe("Syscall", Label("types", "syscall"), func() {
 		err := r.Mount("source", "target", "fstype", 0, "data")
 		Expect(err).To(BeNil())
 	})
+	It("Calling the rooted syscall runs it on the paths under the root", func() {
+		f := &v1mock.FakeSyscall{}
+		r := v1.RootedSyscall{SyscallInterface: f, Root: "/mnt"}
+		Expect(r.Chroot("/run/cos/active")).To(Succeed())
+		Expect(f.WasChrootCalledWith("/mnt/run/cos/active")).To(BeTrue())
+		Expect(r.Chroot(".")).To(Succeed())
+		Expect(f.WasChrootCalledWith(".")).To(BeTrue())
+		Expect(r.Mount("/dev/sda1", "/efi", "vfat", 0, "")).To(Succeed())
+		Expect(f.WasMountCalledWith("/dev/sda1", "/mnt/efi", "vfat", 0, "")).To(BeTrue())
+	})
 	It("Calling mount on the real syscall fail (wrong args)", func() {
 		r := v1.RealSyscall{}
 		err := r.Mount("source", "target", "fstype", 0, "data")
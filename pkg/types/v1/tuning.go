@@ -0,0 +1,98 @@
+/*
+Copyright © 2022 - 2023 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Journaling modes of FilesystemTuning
+const (
+	JournalNone      = "none"
+	JournalOrdered   = "ordered"
+	JournalWriteback = "writeback"
+	JournalData      = "journal"
+)
+
+// FilesystemTuning are the ext filesystem options an image or partition is created with. They are ignored for
+// other filesystems.
+type FilesystemTuning struct {
+	// ReservedBlocks is the percentage of blocks reserved for root, 5 by default in mkfs. Data partitions on small
+	// devices can set it to 0
+	ReservedBlocks *float64 `yaml:"reserved-blocks,omitempty" mapstructure:"reserved-blocks"`
+	// InodeRatio is the bytes per inode, lower it for filesystems holding lots of small files
+	InodeRatio uint `yaml:"inode-ratio,omitempty" mapstructure:"inode-ratio"`
+	// Journal is the default journaling mode: ordered, writeback or journal. none creates the filesystem without
+	// a journal
+	Journal string `yaml:"journal,omitempty" mapstructure:"journal"`
+}
+
+// Validate checks the tuning options are in range
+func (t *FilesystemTuning) Validate() error {
+	if t == nil {
+		return nil
+	}
+	if t.ReservedBlocks != nil && (*t.ReservedBlocks < 0 || *t.ReservedBlocks > 50) {
+		return fmt.Errorf("reserved-blocks must be a percentage between 0 and 50, got %g", *t.ReservedBlocks)
+	}
+	if t.InodeRatio != 0 && (t.InodeRatio < 1024 || t.InodeRatio > 67108864) {
+		return fmt.Errorf("inode-ratio must be between 1024 and 67108864 bytes, got %d", t.InodeRatio)
+	}
+	switch t.Journal {
+	case "", JournalNone, JournalOrdered, JournalWriteback, JournalData:
+	default:
+		return fmt.Errorf("invalid journal mode %q, expected none, ordered, writeback or journal", t.Journal)
+	}
+	return nil
+}
+
+// MkfsOptions returns the mkfs arguments of the tuning for the given filesystem
+func (t *FilesystemTuning) MkfsOptions(fs string) []string {
+	if t == nil || !strings.HasPrefix(fs, "ext") {
+		return nil
+	}
+	var opts []string
+	if t.ReservedBlocks != nil {
+		opts = append(opts, "-m", strconv.FormatFloat(*t.ReservedBlocks, 'g', -1, 64))
+	}
+	if t.InodeRatio != 0 {
+		opts = append(opts, "-i", strconv.Itoa(int(t.InodeRatio)))
+	}
+	if t.Journal == JournalNone && fs != "ext2" {
+		opts = append(opts, "-O", "^has_journal")
+	}
+	return opts
+}
+
+// Tune2fsOptions returns the tune2fs arguments to apply the tuning once the filesystem is created, if any
+func (t *FilesystemTuning) Tune2fsOptions(fs string) []string {
+	if t == nil || fs == "ext2" || !strings.HasPrefix(fs, "ext") {
+		return nil
+	}
+	// The journaling mode is a default mount option, mkfs can't set it
+	switch t.Journal {
+	case JournalOrdered:
+		return []string{"-o", "journal_data_ordered"}
+	case JournalWriteback:
+		return []string{"-o", "journal_data_writeback"}
+	case JournalData:
+		return []string{"-o", "journal_data"}
+	}
+	return nil
+}
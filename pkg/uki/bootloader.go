@@ -0,0 +1,349 @@
+package uki
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/action"
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	"github.com/kairos-io/kairos-agent/v2/pkg/elemental"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	"github.com/kairos-io/kairos-agent/v2/pkg/utils/partitions"
+	"github.com/kairos-io/kairos-sdk/signatures"
+	"github.com/kairos-io/kairos-sdk/state"
+	"gopkg.in/yaml.v3"
+)
+
+// bootloaderBackupSuffix is appended to the bootloader binaries replaced by UpgradeBootloader
+const bootloaderBackupSuffix = ".bak"
+
+// bootloaderAddedSuffix was appended to the markers of the added binaries before the upgrades were recorded, the
+// stale ones are removed on upgrade
+const bootloaderAddedSuffix = ".new"
+
+// bootloaderUpgradeFile records the last bootloader upgrade, relative to the EFI partition
+var bootloaderUpgradeFile = filepath.Join("EFI", "kairos", "bootloader-upgrade.yaml")
+
+// Bootloader upgrade statuses
+const (
+	// BootloaderUpgradePending is an upgrade that did not boot the active entry yet
+	BootloaderUpgradePending = "pending"
+	// BootloaderUpgradeGood is an upgrade that booted the active entry
+	BootloaderUpgradeGood = "good"
+	// BootloaderUpgradeRolledBack is an upgrade rolled back as the active entry failed its boot assessment
+	BootloaderUpgradeRolledBack = "rolled-back"
+)
+
+// BootloaderUpgrade is the record of the last bootloader upgrade, so only the binaries it touched are rolled back
+type BootloaderUpgrade struct {
+	Status string    `yaml:"status" json:"status"`
+	Time   time.Time `yaml:"time" json:"time"`
+	// Replaced are the binaries, relative to the EFI partition, backed up before being replaced
+	Replaced []string `yaml:"replaced,omitempty" json:"replaced,omitempty"`
+	// Added are the binaries, relative to the EFI partition, the upgrade added
+	Added []string `yaml:"added,omitempty" json:"added,omitempty"`
+}
+
+// checkBootloaderSignature verifies the bootloader binaries against the machine db/dbx keys
+var checkBootloaderSignature = signatures.CheckArtifactSignatureIsValid
+
+// bootloaderDirs are the ESP dirs holding the bootloader binaries, the removable media fallback path
+// (shim, grub or systemd-boot as bootx64.efi) and the systemd-boot own dir
+func bootloaderDirs() []string {
+	return []string{filepath.Join("EFI", "BOOT"), filepath.Join("EFI", "systemd")}
+}
+
+// UpgradeBootloaderFromSource replaces the bootloader binaries (systemd-boot, shim, grub) in the EFI partition
+// with the ones found in the given source, like `bootctl update` does.
+// This is the entrypoint for the bootloader upgrade command
+func UpgradeBootloaderFromSource(cfg *config.Config, source string) error {
+	src, err := v1.NewSrcFromURI(source)
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := utils.NewTempDir(cfg, "bootloader")
+	if err != nil {
+		return err
+	}
+	defer fsutils.RemoveTempDir(cfg.Fs, tmpDir) //nolint:errcheck
+
+	e := elemental.NewElemental(cfg)
+	_, err = e.DumpSource(tmpDir, src)
+	if err != nil {
+		cfg.Logger.Errorf("dumping the source: %s", err.Error())
+		return err
+	}
+
+	efiDir, umount, err := mountEfiRW(cfg)
+	if err != nil {
+		return err
+	}
+	defer umount() //nolint:errcheck
+
+	return UpgradeBootloader(cfg, efiDir, tmpDir)
+}
+
+// RollbackBootloaderFromESP restores the bootloader binaries saved by the last bootloader upgrade
+// This is the entrypoint for the bootloader rollback command
+func RollbackBootloaderFromESP(cfg *config.Config) error {
+	efiDir, umount, err := mountEfiRW(cfg)
+	if err != nil {
+		return err
+	}
+	defer umount() //nolint:errcheck
+
+	return RollbackBootloader(cfg, efiDir)
+}
+
+// AssessBootloaderUpgradeFromESP assesses the pending bootloader upgrade, if any, with the current boot. It returns
+// the assessed upgrade, nil if there was nothing to assess. Only trusted boot systems count boots.
+func AssessBootloaderUpgradeFromESP(cfg *config.Config) (*BootloaderUpgrade, error) {
+	if !utils.IsUkiWithFs(cfg.Fs) {
+		return nil, nil
+	}
+	efiPartition, err := partitions.GetEfiPartition(&cfg.Logger)
+	if err != nil {
+		return nil, err
+	}
+	if efiPartition.MountPoint == "" {
+		efiPartition.MountPoint = constants.EfiDir
+	}
+	upgrade, err := readBootloaderUpgrade(cfg, efiPartition.MountPoint)
+	if err != nil || upgrade == nil || upgrade.Status != BootloaderUpgradePending {
+		return nil, err
+	}
+	boot, err := state.DetectBootWithVFS(cfg.Fs)
+	if err != nil {
+		return nil, fmt.Errorf("detecting current boot: %w", err)
+	}
+	assessments, err := action.ReadBootAssessments(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	efiDir, umount, err := mountEfiRW(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer umount() //nolint:errcheck
+	return AssessBootloaderUpgrade(cfg, efiDir, boot, assessments)
+}
+
+// AssessBootloaderUpgrade marks the pending bootloader upgrade good once it boots the active entry, and rolls it back
+// if the active entry failed its boot assessment since. Booting passive or recovery while the active entry is still
+// good, i.e. by hand, leaves the upgrade pending.
+func AssessBootloaderUpgrade(cfg *config.Config, efiDir string, boot state.Boot, assessments []action.BootAssessment) (*BootloaderUpgrade, error) {
+	upgrade, err := readBootloaderUpgrade(cfg, efiDir)
+	if err != nil || upgrade == nil || upgrade.Status != BootloaderUpgradePending {
+		return nil, err
+	}
+	if boot == state.Active {
+		cfg.Logger.Infof("The upgraded bootloader booted the active entry, marking it good")
+		upgrade.Status = BootloaderUpgradeGood
+		return upgrade, writeBootloaderUpgrade(cfg, efiDir, upgrade)
+	}
+	for _, a := range assessments {
+		if a.Entry == "active" && a.Bad() {
+			cfg.Logger.Warnf("The active entry failed its boot assessment after a bootloader upgrade, rolling back the bootloader")
+			if err = RollbackBootloader(cfg, efiDir); err != nil {
+				return nil, err
+			}
+			upgrade.Status = BootloaderUpgradeRolledBack
+			return upgrade, nil
+		}
+	}
+	return nil, nil
+}
+
+// UpgradeBootloader copies the bootloader binaries found in sourceDir into efiDir. All the binaries are checked
+// for a valid signature before touching the EFI partition. Replaced binaries are kept as backup and the upgrade is
+// recorded, so RollbackBootloader restores only what it touched. Touched binaries are restored right away if any
+// of the copies fails. The upgrade is pending until it is assessed on boot, see AssessBootloaderUpgrade.
+func UpgradeBootloader(cfg *config.Config, efiDir, sourceDir string) error {
+	var files []string
+	for _, dir := range bootloaderDirs() {
+		entries, err := cfg.Fs.ReadDir(filepath.Join(sourceDir, dir))
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && strings.EqualFold(filepath.Ext(entry.Name()), ".efi") {
+				files = append(files, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no bootloader binaries found in source")
+	}
+
+	for _, f := range files {
+		if cfg.NoEfivars {
+			cfg.Logger.Warnf("EFI variables are disabled, not checking the signature of %s against the firmware db", f)
+			continue
+		}
+		err := checkBootloaderSignature(cfg.Fs, filepath.Join(sourceDir, f), cfg.Logger)
+		if err != nil {
+			return fmt.Errorf("bootloader binary %s signature is not valid: %w", f, err)
+		}
+	}
+
+	last, err := readBootloaderUpgrade(cfg, efiDir)
+	if err != nil {
+		return err
+	}
+	if last != nil && last.Status == BootloaderUpgradePending {
+		return fmt.Errorf("the last bootloader upgrade did not boot the active entry yet, reboot or roll it back first")
+	}
+	// The backups of the previous upgrade are dropped, a rollback only reverts this one
+	if err = clearBootloaderUpgrade(cfg, efiDir, last); err != nil {
+		return err
+	}
+
+	upgrade := &BootloaderUpgrade{Status: BootloaderUpgradePending, Time: time.Now()}
+	for _, f := range files {
+		target := filepath.Join(efiDir, f)
+		cfg.Logger.Infof("Upgrading bootloader binary %s", target)
+		existed, touched, err := installBootloaderFile(cfg, filepath.Join(sourceDir, f), target)
+		switch {
+		case touched && existed:
+			upgrade.Replaced = append(upgrade.Replaced, f)
+		case touched:
+			upgrade.Added = append(upgrade.Added, f)
+		}
+		if err != nil {
+			cfg.Logger.Errorf("upgrading bootloader binary %s: %s", target, err)
+			if rErr := restoreBootloaderUpgrade(cfg, efiDir, upgrade); rErr != nil {
+				cfg.Logger.Errorf("restoring the bootloader binaries: %s", rErr)
+			}
+			return err
+		}
+	}
+	return writeBootloaderUpgrade(cfg, efiDir, upgrade)
+}
+
+// RollbackBootloader restores the binaries the last bootloader upgrade replaced and removes the ones it added
+func RollbackBootloader(cfg *config.Config, efiDir string) error {
+	upgrade, err := readBootloaderUpgrade(cfg, efiDir)
+	if err != nil {
+		return err
+	}
+	if upgrade == nil {
+		return fmt.Errorf("no bootloader upgrade to roll back")
+	}
+	if err = restoreBootloaderUpgrade(cfg, efiDir, upgrade); err != nil {
+		return err
+	}
+	return cfg.Fs.Remove(filepath.Join(efiDir, bootloaderUpgradeFile))
+}
+
+// installBootloaderFile copies source into target keeping a backup of target. It reports whether target existed
+// and whether it was modified, so it needs to be restored on failures.
+func installBootloaderFile(cfg *config.Config, source, target string) (existed bool, touched bool, err error) {
+	existed, _ = fsutils.Exists(cfg.Fs, target)
+	if existed {
+		if err = fsutils.Copy(cfg.Fs, target, target+bootloaderBackupSuffix); err != nil {
+			return existed, false, err
+		}
+	}
+	if err = fsutils.MkdirAll(cfg.Fs, filepath.Dir(target), constants.DirPerm); err != nil {
+		return existed, false, err
+	}
+	return existed, true, fsutils.Copy(cfg.Fs, source, target)
+}
+
+// restoreBootloaderUpgrade puts back the backups of the replaced binaries and removes the added ones
+func restoreBootloaderUpgrade(cfg *config.Config, efiDir string, upgrade *BootloaderUpgrade) error {
+	for _, f := range upgrade.Replaced {
+		target := filepath.Join(efiDir, f)
+		cfg.Logger.Infof("Restoring bootloader binary %s", target)
+		if exists, _ := fsutils.Exists(cfg.Fs, target+bootloaderBackupSuffix); !exists {
+			return fmt.Errorf("the backup of %s is missing", target)
+		}
+		if err := cfg.Fs.Rename(target+bootloaderBackupSuffix, target); err != nil {
+			return err
+		}
+	}
+	for _, f := range upgrade.Added {
+		target := filepath.Join(efiDir, f)
+		cfg.Logger.Infof("Removing bootloader binary %s", target)
+		if err := cfg.Fs.Remove(target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearBootloaderUpgrade removes the backups of the given upgrade, the stale backups and markers left in the
+// bootloader dirs and the upgrade record
+func clearBootloaderUpgrade(cfg *config.Config, efiDir string, upgrade *BootloaderUpgrade) error {
+	var stale []string
+	if upgrade != nil {
+		for _, f := range upgrade.Replaced {
+			stale = append(stale, filepath.Join(efiDir, f)+bootloaderBackupSuffix)
+		}
+	}
+	for _, dir := range bootloaderDirs() {
+		for _, suffix := range []string{bootloaderBackupSuffix, bootloaderAddedSuffix} {
+			files, _ := fsutils.GlobFs(cfg.Fs, filepath.Join(efiDir, dir, "*.[eE][fF][iI]"+suffix))
+			stale = append(stale, files...)
+		}
+	}
+	stale = append(stale, filepath.Join(efiDir, bootloaderUpgradeFile))
+	for _, f := range stale {
+		if err := cfg.Fs.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBootloaderUpgrade returns the record of the last bootloader upgrade, nil if there is none
+func readBootloaderUpgrade(cfg *config.Config, efiDir string) (*BootloaderUpgrade, error) {
+	data, err := cfg.Fs.ReadFile(filepath.Join(efiDir, bootloaderUpgradeFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	upgrade := &BootloaderUpgrade{}
+	if err = yaml.Unmarshal(data, upgrade); err != nil {
+		return nil, fmt.Errorf("parsing the bootloader upgrade record: %w", err)
+	}
+	return upgrade, nil
+}
+
+func writeBootloaderUpgrade(cfg *config.Config, efiDir string, upgrade *BootloaderUpgrade) error {
+	data, err := yaml.Marshal(upgrade)
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(efiDir, bootloaderUpgradeFile)
+	if err = fsutils.MkdirAll(cfg.Fs, filepath.Dir(file), constants.DirPerm); err != nil {
+		return err
+	}
+	return fsutils.AtomicWriteFile(cfg.Fs, file, data, constants.FilePerm)
+}
+
+// mountEfiRW mounts the EFI partition as RW and returns its mountpoint
+func mountEfiRW(cfg *config.Config) (string, func() error, error) {
+	efiPartition, err := partitions.GetEfiPartition(&cfg.Logger)
+	if err != nil {
+		return "", nil, err
+	}
+	if efiPartition.MountPoint == "" {
+		efiPartition.MountPoint = constants.EfiDir
+	}
+	umount, err := elemental.NewElemental(cfg).MountRWPartition(efiPartition)
+	if err != nil {
+		return "", nil, err
+	}
+	return efiPartition.MountPoint, umount, nil
+}
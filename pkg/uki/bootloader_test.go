@@ -0,0 +1,149 @@
+package uki
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/action"
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	"github.com/kairos-io/kairos-sdk/signatures"
+	"github.com/kairos-io/kairos-sdk/state"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v5"
+	"github.com/twpayne/go-vfs/v5/vfst"
+)
+
+var _ = Describe("Bootloader upgrade", Label("bootloader"), func() {
+	var fs vfs.FS
+	var cleanup func()
+	var cfg *config.Config
+	var checked []string
+
+	BeforeEach(func() {
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{
+			"/efi/EFI/BOOT/BOOTX64.EFI":               "old shim",
+			"/source/EFI/BOOT/BOOTX64.EFI":            "new shim",
+			"/source/EFI/BOOT/grubx64.efi":            "new grub",
+			"/source/EFI/systemd/systemd-bootx64.efi": "new systemd-boot",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		cfg = config.NewConfig(config.WithFs(fs), config.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})))
+		checked = []string{}
+		checkBootloaderSignature = func(_ sdkTypes.KairosFS, artifact string, _ sdkTypes.KairosLogger) error {
+			checked = append(checked, artifact)
+			return nil
+		}
+	})
+	AfterEach(func() {
+		checkBootloaderSignature = signatures.CheckArtifactSignatureIsValid
+		cleanup()
+	})
+
+	It("upgrades the bootloader binaries keeping a backup and rolls them back", func() {
+		Expect(UpgradeBootloader(cfg, "/efi", "/source")).To(Succeed())
+		Expect(checked).To(HaveLen(3))
+
+		data, err := fs.ReadFile("/efi/EFI/BOOT/BOOTX64.EFI")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("new shim"))
+		data, err = fs.ReadFile("/efi/EFI/BOOT/BOOTX64.EFI.bak")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("old shim"))
+		exists, _ := fsutils.Exists(fs, "/efi/EFI/systemd/systemd-bootx64.efi")
+		Expect(exists).To(BeTrue())
+
+		Expect(RollbackBootloader(cfg, "/efi")).To(Succeed())
+		data, err = fs.ReadFile("/efi/EFI/BOOT/BOOTX64.EFI")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("old shim"))
+		// The binaries the upgrade added are removed
+		for _, f := range []string{"/efi/EFI/BOOT/grubx64.efi", "/efi/EFI/systemd/systemd-bootx64.efi", "/efi/EFI/systemd/systemd-bootx64.efi.new"} {
+			exists, _ = fsutils.Exists(fs, f)
+			Expect(exists).To(BeFalse(), f)
+		}
+		Expect(RollbackBootloader(cfg, "/efi")).ToNot(Succeed())
+	})
+	It("only rolls back the binaries the last upgrade touched", func() {
+		// Left by an earlier upgrade of a binary the new one does not ship
+		Expect(fs.WriteFile("/efi/EFI/BOOT/fbx64.efi", []byte("current fallback"), os.ModePerm)).To(Succeed())
+		Expect(fs.WriteFile("/efi/EFI/BOOT/fbx64.efi.bak", []byte("old fallback"), os.ModePerm)).To(Succeed())
+		Expect(fs.WriteFile("/efi/EFI/BOOT/mmx64.efi.new", []byte{}, os.ModePerm)).To(Succeed())
+
+		Expect(UpgradeBootloader(cfg, "/efi", "/source")).To(Succeed())
+		for _, f := range []string{"/efi/EFI/BOOT/fbx64.efi.bak", "/efi/EFI/BOOT/mmx64.efi.new"} {
+			exists, _ := fsutils.Exists(fs, f)
+			Expect(exists).To(BeFalse(), f)
+		}
+		Expect(RollbackBootloader(cfg, "/efi")).To(Succeed())
+		data, err := fs.ReadFile("/efi/EFI/BOOT/fbx64.efi")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("current fallback"))
+		data, err = fs.ReadFile("/efi/EFI/BOOT/BOOTX64.EFI")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("old shim"))
+	})
+	It("assesses the upgrade on boot", func() {
+		good := []action.BootAssessment{{Entry: "active", Counting: true, Left: 2, Done: 1}, {Entry: "passive"}}
+		bad := []action.BootAssessment{{Entry: "active", Counting: true, Left: 0, Done: 3}, {Entry: "passive"}}
+
+		Expect(UpgradeBootloader(cfg, "/efi", "/source")).To(Succeed())
+		// A pending upgrade is not replaced by a new one
+		Expect(UpgradeBootloader(cfg, "/efi", "/source")).To(MatchError(ContainSubstring("did not boot the active entry yet")))
+
+		// Booting passive by hand leaves it pending
+		upgrade, err := AssessBootloaderUpgrade(cfg, "/efi", state.Passive, good)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(upgrade).To(BeNil())
+
+		upgrade, err = AssessBootloaderUpgrade(cfg, "/efi", state.Active, good)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(upgrade.Status).To(Equal(BootloaderUpgradeGood))
+		// Nothing left to assess, a good upgrade is not rolled back automatically
+		upgrade, err = AssessBootloaderUpgrade(cfg, "/efi", state.Passive, bad)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(upgrade).To(BeNil())
+		data, err := fs.ReadFile("/efi/EFI/BOOT/BOOTX64.EFI")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("new shim"))
+
+		// The next upgrade is rolled back when the active entry fails
+		Expect(fs.WriteFile("/source/EFI/BOOT/BOOTX64.EFI", []byte("newer shim"), os.ModePerm)).To(Succeed())
+		Expect(UpgradeBootloader(cfg, "/efi", "/source")).To(Succeed())
+		upgrade, err = AssessBootloaderUpgrade(cfg, "/efi", state.Passive, bad)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(upgrade.Status).To(Equal(BootloaderUpgradeRolledBack))
+		data, err = fs.ReadFile("/efi/EFI/BOOT/BOOTX64.EFI")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("new shim"))
+	})
+	It("does not touch the EFI partition if any signature is not valid", func() {
+		checkBootloaderSignature = func(_ sdkTypes.KairosFS, artifact string, _ sdkTypes.KairosLogger) error {
+			return fmt.Errorf("not signed")
+		}
+		Expect(UpgradeBootloader(cfg, "/efi", "/source")).ToNot(Succeed())
+		data, err := fs.ReadFile("/efi/EFI/BOOT/BOOTX64.EFI")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("old shim"))
+		exists, _ := fsutils.Exists(fs, "/efi/EFI/BOOT/BOOTX64.EFI.bak")
+		Expect(exists).To(BeFalse())
+	})
+	It("does not check the signatures against the firmware db with the EFI variables disabled", func() {
+		cfg.NoEfivars = true
+		Expect(UpgradeBootloader(cfg, "/efi", "/source")).To(Succeed())
+		Expect(checked).To(BeEmpty())
+		data, err := fs.ReadFile("/efi/EFI/BOOT/BOOTX64.EFI")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("new shim"))
+	})
+	It("fails if the source has no bootloader binaries", func() {
+		Expect(fs.RemoveAll("/source/EFI")).To(Succeed())
+		Expect(fsutils.MkdirAll(fs, "/source/EFI/kairos", os.ModePerm)).To(Succeed())
+		Expect(UpgradeBootloader(cfg, "/efi", "/source")).ToNot(Succeed())
+	})
+})
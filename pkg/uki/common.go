@@ -14,6 +14,7 @@ import (
 	sdkTypes "github.com/kairos-io/kairos-sdk/types"
 	sdkutils "github.com/kairos-io/kairos-sdk/utils"
 	"github.com/sanity-io/litter"
+	"github.com/twpayne/go-vfs/v5"
 )
 
 const UnassignedArtifactRole = "norole"
@@ -111,7 +112,7 @@ func replaceRoleInKey(path, key, oldRole, newRole string, logger sdkTypes.Kairos
 	}
 	logger.Debugf("Conf file %s new values %v", path, litter.Sdump(conf))
 
-	return os.WriteFile(path, []byte(newContents), os.ModePerm)
+	return fsutils.AtomicWriteFile(vfs.OSFS, path, []byte(newContents), os.ModePerm)
 }
 
 func replaceConfTitle(path, role string) error {
@@ -135,7 +136,7 @@ func replaceConfTitle(path, role string) error {
 		newContents = fmt.Sprintf("%s%s %s\n", newContents, k, v)
 	}
 
-	return os.WriteFile(path, []byte(newContents), os.ModePerm)
+	return fsutils.AtomicWriteFile(vfs.OSFS, path, []byte(newContents), os.ModePerm)
 }
 
 func copyFile(src, dst string) error {
@@ -204,7 +205,7 @@ func AddSystemdConfSortKey(fs v1.FS, artifactDir string, log sdkTypes.KairosLogg
 			}
 			log.Logger.Trace().Str("contents", litter.Sdump(conf)).Str("path", path).Msg("Final values for conf file")
 
-			return os.WriteFile(path, []byte(newContents), 0600)
+			return fsutils.AtomicWriteFile(vfs.OSFS, path, []byte(newContents), 0600)
 		}
 
 		return nil
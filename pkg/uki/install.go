@@ -116,6 +116,12 @@ func (i *InstallAction) Run() (err error) {
 		return err
 	}
 
+	// Fail before installing anything that would not boot with Secure Boot
+	if err = checkUkiSignatures(i.cfg, i.spec.Partitions.EFI.MountPoint); err != nil {
+		i.cfg.Logger.Errorf("checking the UKI signatures: %s", err.Error())
+		return err
+	}
+
 	// Remove entries
 	// Read all confs
 	i.cfg.Logger.Debugf("Parsing efi partition files (skip SkipEntries, replace placeholders etc)")
@@ -46,7 +46,7 @@ func (r *ResetAction) Run() (err error) {
 	if r.spec.FormatPersistent {
 		persistent := r.spec.Partitions.Persistent
 		if persistent != nil {
-			err = e.FormatPartition(persistent)
+			err = e.FormatTunedPartition(persistent, r.spec.PartitionTuning[constants.PersistentPartName])
 			if err != nil {
 				r.cfg.Logger.Errorf("formatting persistent partition: %s", err.Error())
 				return err
@@ -58,7 +58,7 @@ func (r *ResetAction) Run() (err error) {
 	if r.spec.FormatOEM {
 		oem := r.spec.Partitions.OEM
 		if oem != nil {
-			err = e.FormatPartition(oem)
+			err = e.FormatTunedPartition(oem, r.spec.PartitionTuning[constants.OEMPartName])
 			if err != nil {
 				r.cfg.Logger.Errorf("formatting OEM partition: %s", err.Error())
 				return err
@@ -0,0 +1,119 @@
+package uki
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/action"
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	elementalUtils "github.com/kairos-io/kairos-agent/v2/pkg/utils"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+)
+
+// Rollback is the passive entry being promoted to active after the active entry failed its boot assessment
+type Rollback struct {
+	// FailedEntry is the entry which exhausted its boot tries and got replaced
+	FailedEntry string `json:"failed-entry" yaml:"failed-entry"`
+	// FailedBoots is the number of boots of the failed entry that were not marked good
+	FailedBoots int `json:"failed-boots" yaml:"failed-boots"`
+	// PromotedEntry is the entry now installed as active
+	PromotedEntry string    `json:"promoted-entry" yaml:"promoted-entry"`
+	Time          time.Time `json:"time" yaml:"time"`
+}
+
+// failedActive returns the active entry if it exhausted its boot tries and passive can replace it
+func failedActive(assessments []action.BootAssessment) *action.BootAssessment {
+	var active *action.BootAssessment
+	passiveGood := false
+	for i, a := range assessments {
+		switch a.Entry {
+		case "active":
+			active = &assessments[i]
+		case "passive":
+			passiveGood = !a.Bad()
+		}
+	}
+	if active == nil || !active.Bad() || !passiveGood {
+		return nil
+	}
+	return active
+}
+
+// RollbackFailedActive promotes passive to active when the active entry exhausted its boot tries, so the system
+// keeps booting the previous image by default instead of trying the failed one first on every boot.
+// It returns nil if there was nothing to roll back. Only trusted boot systems count boots.
+func RollbackFailedActive(cfg *config.Config) (*Rollback, error) {
+	if !elementalUtils.IsUkiWithFs(cfg.Fs) {
+		return nil, nil
+	}
+	assessments, err := action.ReadBootAssessments(cfg)
+	if err != nil {
+		return nil, err
+	}
+	active := failedActive(assessments)
+	if active == nil {
+		return nil, nil
+	}
+	cfg.Logger.Warnf("The active entry failed %d boots, promoting passive to active", active.Done)
+
+	efiDir := filepath.Dir(filepath.Dir(filepath.Dir(active.File)))
+	if err = promotePassive(cfg, efiDir); err != nil {
+		return nil, fmt.Errorf("promoting passive to active: %w", err)
+	}
+	if err = action.SelectBootEntry(cfg, "cos"); err != nil {
+		return nil, fmt.Errorf("selecting the promoted active entry: %w", err)
+	}
+	return &Rollback{FailedEntry: active.Entry, FailedBoots: active.Done, PromotedEntry: "passive", Time: time.Now()}, nil
+}
+
+// promotePassive installs the passive artifacts and sysexts as the active ones
+func promotePassive(cfg *config.Config, efiDir string) error {
+	err := cfg.Syscall.Mount("", efiDir, "", syscall.MS_REMOUNT, "")
+	if err != nil {
+		cfg.Logger.Errorf("could not remount EFI partition: %s", err)
+		return err
+	}
+	defer func() {
+		if err := cfg.Syscall.Mount("", efiDir, "", syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			cfg.Logger.Errorf("could not remount EFI partition as RO: %s", err)
+		}
+	}()
+
+	if err = overwriteArtifactSetRole(cfg.Fs, efiDir, "passive", "active", cfg.Logger); err != nil {
+		return err
+	}
+	return promoteSysexts(cfg, efiDir)
+}
+
+// promoteSysexts replaces the active sysexts with the passive ones, the ones the promoted image was running with
+func promoteSysexts(cfg *config.Config, efiDir string) error {
+	active := elementalUtils.SysextDir(efiDir, "active")
+	passive := elementalUtils.SysextDir(efiDir, "passive")
+
+	if err := cfg.Fs.RemoveAll(active); err != nil {
+		return err
+	}
+	entries, err := cfg.Fs.ReadDir(passive)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err = fsutils.MkdirAll(cfg.Fs, active, constants.DirPerm); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if err = fsutils.Copy(cfg.Fs, filepath.Join(passive, e.Name()), filepath.Join(active, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package uki
+
+import (
+	"bytes"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/action"
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v5/vfst"
+)
+
+var _ = Describe("Rollback of a failed active entry", Label("rollback"), func() {
+	It("only rolls back an active entry without tries left to a good passive", func() {
+		bad := action.BootAssessment{Entry: "active", Counting: true, Left: 0, Done: 3}
+		counting := action.BootAssessment{Entry: "active", Counting: true, Left: 1, Done: 2}
+		passive := action.BootAssessment{Entry: "passive"}
+		badPassive := action.BootAssessment{Entry: "passive", Counting: true, Left: 0, Done: 3}
+		recovery := action.BootAssessment{Entry: "recovery"}
+
+		Expect(failedActive([]action.BootAssessment{bad, passive, recovery})).To(Equal(&bad))
+		Expect(failedActive([]action.BootAssessment{counting, passive, recovery})).To(BeNil())
+		Expect(failedActive([]action.BootAssessment{bad, badPassive, recovery})).To(BeNil())
+		Expect(failedActive([]action.BootAssessment{bad, recovery})).To(BeNil())
+	})
+
+	It("gives the active entry the passive sysexts", func() {
+		fs, cleanup, err := vfst.NewTestFS(map[string]interface{}{
+			"/efi/EFI/kairos/active.efi.extra.d/new.sysext.raw":  "new",
+			"/efi/EFI/kairos/passive.efi.extra.d/k3s.sysext.raw": "k3s",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(cleanup)
+		cfg := config.NewConfig(config.WithFs(fs), config.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})))
+
+		Expect(promoteSysexts(cfg, "/efi")).To(Succeed())
+		exists, _ := fsutils.Exists(fs, "/efi/EFI/kairos/active.efi.extra.d/k3s.sysext.raw")
+		Expect(exists).To(BeTrue())
+		exists, _ = fsutils.Exists(fs, "/efi/EFI/kairos/active.efi.extra.d/new.sysext.raw")
+		Expect(exists).To(BeFalse())
+		exists, _ = fsutils.Exists(fs, "/efi/EFI/kairos/passive.efi.extra.d/k3s.sysext.raw")
+		Expect(exists).To(BeTrue())
+	})
+})
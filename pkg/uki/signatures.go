@@ -0,0 +1,129 @@
+package uki
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/go-uefi/efi"
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	"github.com/kairos-io/kairos-sdk/signatures"
+)
+
+// checkFirmwareSignature verifies an artifact against the machine db/dbx keys
+var checkFirmwareSignature = signatures.CheckArtifactSignatureIsValid
+
+// setupMode reports if the firmware is in Secure Boot setup mode, where the db is empty until the keys are enrolled
+var setupMode = efi.GetSetupMode
+
+// checkUkiSignature checks the efi artifact is signed with a certificate that allows it to boot with Secure Boot.
+// With uki-allowed-certs configured it must be signed by one of them, otherwise it's checked against the firmware
+// db and dbx. The firmware check is skipped in setup mode, as the keys are only enrolled on the first boot, and
+// with no-efivars, as the db and dbx are EFI variables.
+func checkUkiSignature(cfg *config.Config, artifact string) error {
+	if len(cfg.UkiAllowedCerts) > 0 {
+		certs, err := loadAllowedCerts(cfg.Fs, cfg.UkiAllowedCerts)
+		if err != nil {
+			return fmt.Errorf("loading the allowed certificates: %w", err)
+		}
+		return checkSignatureWithCerts(cfg, artifact, certs)
+	}
+	if cfg.NoEfivars {
+		cfg.Logger.Warnf("EFI variables are disabled, not checking the signature of %s against the firmware db", artifact)
+		return nil
+	}
+	if setupMode() {
+		cfg.Logger.Warnf("Secure Boot is in setup mode, not checking the signature of %s against the firmware db", artifact)
+		return nil
+	}
+	return checkFirmwareSignature(cfg.Fs, artifact, cfg.Logger)
+}
+
+// checkUkiSignatures checks the signature of all the UKIs in the EFI/kairos dir under root
+func checkUkiSignatures(cfg *config.Config, root string) error {
+	ukis, err := cfg.Fs.ReadDir(filepath.Join(root, "EFI", "kairos"))
+	if err != nil {
+		return err
+	}
+	for _, uki := range ukis {
+		if uki.IsDir() || !strings.EqualFold(filepath.Ext(uki.Name()), ".efi") {
+			continue
+		}
+		if err = checkUkiSignature(cfg, filepath.Join(root, "EFI", "kairos", uki.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSignatureWithCerts checks the artifact Authenticode signature was made by one of the given certificates
+func checkSignatureWithCerts(cfg *config.Config, artifact string, certs []*x509.Certificate) error {
+	data, err := cfg.Fs.ReadFile(artifact)
+	if err != nil {
+		return err
+	}
+	binary, err := authenticode.Parse(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("%s: %w", artifact, err)
+	}
+	if binary.Datadir.Size == 0 {
+		return fmt.Errorf("no signatures in the file %s", artifact)
+	}
+	for _, cert := range certs {
+		if ok, _ := binary.Verify(cert); ok {
+			cfg.Logger.Infof("%s is signed by the allowed certificate %s", artifact, cert.Subject.CommonName)
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not signed by any of the allowed certificates", artifact)
+}
+
+// loadAllowedCerts parses the given certificates, either inline PEM data or paths to PEM or DER encoded files
+func loadAllowedCerts(fs v1.FS, allowed []string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for _, c := range allowed {
+		data := []byte(c)
+		if !strings.HasPrefix(strings.TrimSpace(c), "-----BEGIN") {
+			var err error
+			if data, err = fs.ReadFile(c); err != nil {
+				return nil, err
+			}
+		}
+		parsed, err := parseCerts(data)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, parsed...)
+	}
+	return certs, nil
+}
+
+// parseCerts parses all the certificates in PEM data, falling back to DER
+func parseCerts(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) > 0 {
+		return certs, nil
+	}
+	return x509.ParseCertificates(data)
+}
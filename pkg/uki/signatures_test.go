@@ -0,0 +1,121 @@
+package uki
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+
+	"github.com/foxboron/go-uefi/efi"
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-sdk/signatures"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v5"
+	"github.com/twpayne/go-vfs/v5/vfst"
+)
+
+var _ = Describe("UKI signatures", Label("signatures"), func() {
+	var fs vfs.FS
+	var cleanup func()
+	var cfg *config.Config
+	var firmwareChecked []string
+
+	// dbCertsPEM returns the certificates of an efivars db dump as PEM
+	dbCertsPEM := func(path string) string {
+		data, err := os.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		// Skip the efivar attributes
+		db, err := signature.ReadSignatureDatabase(bytes.NewReader(data[4:]))
+		Expect(err).ToNot(HaveOccurred())
+		var out bytes.Buffer
+		for _, cert := range signatures.ExtractCertsFromSignatureDatabase(&db) {
+			Expect(pem.Encode(&out, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})).To(Succeed())
+		}
+		return out.String()
+	}
+
+	BeforeEach(func() {
+		signed, err := os.ReadFile("tests/fbx64.signed.efi")
+		Expect(err).ToNot(HaveOccurred())
+		unsigned, err := os.ReadFile("tests/fbx64.efi")
+		Expect(err).ToNot(HaveOccurred())
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{
+			"/efi/EFI/kairos/norole.efi":                        signed,
+			"/efi/EFI/kairos/unsigned.efi":                      unsigned,
+			"/efi/EFI/kairos/norole.efi.extra.d/k3s.sysext.raw": "k3s",
+			"/keys/db.pem":                                      dbCertsPEM("tests/db"),
+			"/keys/db-wrong.pem":                                dbCertsPEM("tests/db-wrong"),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		cfg = config.NewConfig(config.WithFs(fs), config.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})))
+		firmwareChecked = []string{}
+		checkFirmwareSignature = func(_ sdkTypes.KairosFS, artifact string, _ sdkTypes.KairosLogger) error {
+			firmwareChecked = append(firmwareChecked, artifact)
+			return nil
+		}
+		setupMode = func() bool { return false }
+	})
+	AfterEach(func() {
+		checkFirmwareSignature = signatures.CheckArtifactSignatureIsValid
+		setupMode = efi.GetSetupMode
+		cleanup()
+	})
+
+	It("checks the UKIs against the firmware db", func() {
+		Expect(checkUkiSignatures(cfg, "/efi")).To(Succeed())
+		Expect(firmwareChecked).To(ConsistOf("/efi/EFI/kairos/norole.efi", "/efi/EFI/kairos/unsigned.efi"))
+	})
+	It("fails if any of the UKIs is not signed with the firmware keys", func() {
+		checkFirmwareSignature = func(_ sdkTypes.KairosFS, _ string, _ sdkTypes.KairosLogger) error {
+			return errors.New("could not find a signature in EFIVars DB that matches the artifact")
+		}
+		Expect(checkUkiSignatures(cfg, "/efi")).ToNot(Succeed())
+	})
+	It("does not check against the firmware db in setup mode", func() {
+		setupMode = func() bool { return true }
+		Expect(checkUkiSignatures(cfg, "/efi")).To(Succeed())
+		Expect(firmwareChecked).To(BeEmpty())
+	})
+	It("does not check against the firmware db with the EFI variables disabled", func() {
+		cfg.NoEfivars = true
+		setupMode = func() bool {
+			Fail("setup mode read from the EFI variables")
+			return false
+		}
+		Expect(checkUkiSignatures(cfg, "/efi")).To(Succeed())
+		Expect(firmwareChecked).To(BeEmpty())
+
+		// The allowed certificates are still checked
+		cfg.UkiAllowedCerts = []string{"/keys/db.pem"}
+		Expect(checkUkiSignature(cfg, "/efi/EFI/kairos/unsigned.efi")).To(MatchError(ContainSubstring("no signatures")))
+	})
+	It("checks against the allowed certificates instead of the firmware db", func() {
+		cfg.UkiAllowedCerts = []string{"/keys/db-wrong.pem", "/keys/db.pem"}
+		Expect(checkUkiSignature(cfg, "/efi/EFI/kairos/norole.efi")).To(Succeed())
+		Expect(checkUkiSignature(cfg, "/efi/EFI/kairos/unsigned.efi")).To(MatchError(ContainSubstring("no signatures")))
+		Expect(firmwareChecked).To(BeEmpty())
+	})
+	It("accepts inline PEM certificates", func() {
+		cfg.UkiAllowedCerts = []string{dbCertsPEM("tests/db")}
+		Expect(checkUkiSignature(cfg, "/efi/EFI/kairos/norole.efi")).To(Succeed())
+	})
+	It("fails if the UKI is not signed by any of the allowed certificates", func() {
+		cfg.UkiAllowedCerts = []string{"/keys/db-wrong.pem"}
+		Expect(checkUkiSignature(cfg, "/efi/EFI/kairos/norole.efi")).To(MatchError(ContainSubstring("not signed by any of the allowed certificates")))
+	})
+	It("parses DER certificates", func() {
+		block, _ := pem.Decode([]byte(dbCertsPEM("tests/db")))
+		Expect(block).ToNot(BeNil())
+		certs, err := parseCerts(block.Bytes)
+		Expect(err).ToNot(HaveOccurred())
+		expected, err := x509.ParseCertificate(block.Bytes)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(certs).To(HaveLen(1))
+		Expect(certs[0].Equal(expected)).To(BeTrue())
+	})
+})
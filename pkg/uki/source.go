@@ -0,0 +1,157 @@
+package uki
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	"github.com/kairos-io/kairos-agent/v2/pkg/elemental"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+)
+
+// ukiSourceDirs are the dirs of an upgrade source holding the UKI artifacts, the same layout the UKI images have
+var ukiSourceDirs = []string{"EFI", "loader"}
+
+// dumpUkiSource copies the UKI artifacts of the upgrade source into target. Local sources, a dir or a tarball
+// file, usually from a USB drive on air-gapped machines, only get the prebuilt UKIs and loader entries copied,
+// as target is the EFI partition and does not support the permissions a full sync would set.
+func dumpUkiSource(cfg *config.Config, target string, src *v1.ImageSource) error {
+	var err error
+	switch {
+	case src.IsDir():
+		cfg.Logger.Infof("Copying the UKI artifacts from %s to %s", src.Value(), target)
+		err = copyUkiDir(cfg.Fs, src.Value(), target)
+	case src.IsFile():
+		if err = elemental.NewElemental(cfg).VerifyFileSource(src.Value()); err != nil {
+			return err
+		}
+		cfg.Logger.Infof("Extracting the UKI artifacts from %s to %s", src.Value(), target)
+		err = extractUkiTarball(cfg.Fs, src.Value(), target)
+	default:
+		_, err = elemental.NewElemental(cfg).DumpSource(target, src)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, artifact := range []string{
+		filepath.Join("EFI", "kairos", UnassignedArtifactRole+".efi"),
+		filepath.Join("loader", "entries", UnassignedArtifactRole+".conf"),
+	} {
+		if ok, _ := fsutils.Exists(cfg.Fs, filepath.Join(target, artifact)); !ok {
+			return fmt.Errorf("upgrade source %s does not contain %s", src.Value(), artifact)
+		}
+	}
+	return nil
+}
+
+// copyUkiDir copies the UKI artifacts dirs from the src dir into target
+func copyUkiDir(vfs v1.FS, src, target string) error {
+	for _, dir := range ukiSourceDirs {
+		root := filepath.Join(src, dir)
+		if ok, _ := fsutils.IsDir(vfs, root); !ok {
+			continue
+		}
+		err := fsutils.WalkDirFs(vfs, root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(src, path)
+			if err != nil {
+				return err
+			}
+			dst := filepath.Join(target, rel)
+			if d.IsDir() {
+				return fsutils.MkdirAll(vfs, dst, constants.DirPerm)
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			return fsutils.Copy(vfs, path, dst)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractUkiTarball extracts the UKI artifacts dirs from the src tarball, optionally gzipped, into target
+func extractUkiTarball(vfs v1.FS, src, target string) error {
+	f, err := vfs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var reader io.Reader = r
+	if magic, _ := r.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("invalid upgrade source %s: %w", src, err)
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid upgrade source %s: %w", src, err)
+		}
+		name := filepath.Clean(filepath.FromSlash(strings.TrimPrefix(hdr.Name, "/")))
+		if name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid upgrade source %s: entry %s is outside of the archive root", src, hdr.Name)
+		}
+		if !inUkiSourceDirs(name) {
+			continue
+		}
+		dst := filepath.Join(target, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = fsutils.MkdirAll(vfs, dst, constants.DirPerm); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err = fsutils.MkdirAll(vfs, filepath.Dir(dst), constants.DirPerm); err != nil {
+				return err
+			}
+			out, err := vfs.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, constants.FilePerm)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			out.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// inUkiSourceDirs checks if the relative path is within one of the UKI artifacts dirs
+func inUkiSourceDirs(path string) bool {
+	for _, dir := range ukiSourceDirs {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
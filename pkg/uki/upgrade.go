@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/kairos-io/kairos-agent/v2/pkg/action"
 	"github.com/kairos-io/kairos-agent/v2/pkg/config"
@@ -11,8 +12,8 @@ import (
 	"github.com/kairos-io/kairos-agent/v2/pkg/elemental"
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
 	elementalUtils "github.com/kairos-io/kairos-agent/v2/pkg/utils"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
 	events "github.com/kairos-io/kairos-sdk/bus"
-	"github.com/kairos-io/kairos-sdk/signatures"
 	"github.com/kairos-io/kairos-sdk/utils"
 )
 
@@ -38,6 +39,8 @@ func (i *UpgradeAction) Run() (err error) {
 		i.cfg.Logger.Errorf("running kairos-uki-upgrade.pre hook script: %s", err.Error())
 	}
 
+	elementalUtils.LimitDownloadBandwidth(i.cfg, i.spec.MaxBandwidth)
+
 	// REMOUNT /efi as RW (its RO by default)
 	umount, err := e.MountRWPartition(i.spec.EfiPartition)
 	if err != nil {
@@ -46,10 +49,14 @@ func (i *UpgradeAction) Run() (err error) {
 	}
 	cleanup.Push(umount)
 
-	// TODO: Get the size of the efi partition and decide if the images can fit
-	// before trying the upgrade.
-	// If we decide to first copy and then rotate, we need ~4 times the size of
-	// the artifact set [TBD]
+	// Check the new entries fit along the current ones and their extensions while they are rotated
+	space, err := action.NewEfiSpace(i.cfg, constants.UkiEfiDir, i.spec)
+	if err != nil {
+		i.cfg.Logger.Warnf("could not account the space of the EFI partition, upgrading without checking it: %s", err)
+	} else if err = space.Check(); err != nil {
+		i.cfg.Logger.Errorf("checking the space of the EFI partition: %s", err.Error())
+		return err
+	}
 
 	// When upgrading recovery or single entries, we don't want to replace loader.conf or any other
 	// files, thus we take a simpler approach and only install the new efi file
@@ -66,14 +73,18 @@ func (i *UpgradeAction) Run() (err error) {
 
 	i.cfg.Logger.Infof("installing entry: active")
 	// Dump artifact to efi dir
-	_, err = e.DumpSource(constants.UkiEfiDir, i.spec.Active.Source)
+	err = dumpUkiSource(i.cfg, constants.UkiEfiDir, i.spec.Active.Source)
 	if err != nil {
 		i.cfg.Logger.Errorf("dumping the source: %s", err.Error())
+		// Do not leave a partial artifact set around
+		cleanup.Push(func() error {
+			return removeArtifactSetWithRole(i.cfg.Fs, constants.UkiEfiDir, UnassignedArtifactRole)
+		})
 		return err
 	}
 
 	// Check if the upgrade artifact contains the proper signature before copying
-	err = signatures.CheckArtifactSignatureIsValid(i.cfg.Fs, filepath.Join(constants.UkiEfiDir, "EFI", "Kairos", fmt.Sprintf("%s.efi", UnassignedArtifactRole)), i.cfg.Logger)
+	err = checkUkiSignature(i.cfg, filepath.Join(constants.UkiEfiDir, "EFI", "Kairos", fmt.Sprintf("%s.efi", UnassignedArtifactRole)))
 	if err != nil {
 		i.cfg.Logger.Logger.Error().Err(err).Msg("Checking signature before upgrading")
 		// Remove efi file to not occupy space and leave stuff around
@@ -99,6 +110,11 @@ func (i *UpgradeAction) Run() (err error) {
 		return fmt.Errorf("installing the new artifacts as active: %w", err)
 	}
 
+	if err = rotateSysexts(i.cfg, constants.UkiEfiDir, i.spec.Sysexts); err != nil {
+		i.cfg.Logger.Errorf("rotating sysexts: %s", err.Error())
+		return fmt.Errorf("rotating sysexts: %w", err)
+	}
+
 	loaderConfPath := filepath.Join(constants.UkiEfiDir, "loader", "loader.conf")
 	if err = replaceRoleInKey(loaderConfPath, "default", UnassignedArtifactRole, "active", i.cfg.Logger); err != nil {
 		i.cfg.Logger.Errorf("replacing role in key: %s", err.Error())
@@ -129,6 +145,12 @@ func (i *UpgradeAction) Run() (err error) {
 		return err
 	}
 
+	if !i.spec.RecoveryUpgrade() {
+		if err = action.ArmWatchdog(i.cfg); err != nil {
+			i.cfg.Logger.Warnf("could not arm the watchdog, the upgraded system will not be remediated: %s", err)
+		}
+	}
+
 	if err = elementalUtils.RunStage(i.cfg, "kairos-uki-upgrade.after"); err != nil {
 		i.cfg.Logger.Errorf("running kairos-uki-upgrade.after stage: %s", err.Error())
 	}
@@ -146,22 +168,28 @@ func (i *UpgradeAction) installEntry(entry string) error {
 		return fmt.Errorf("could not stat target efi file for entry %s: %s", entry, err)
 	}
 
-	tmpDir, err := os.MkdirTemp("", "")
+	tmpDir, err := elementalUtils.NewTempDir(i.cfg, "uki-upgrade")
 	if err != nil {
 		i.cfg.Logger.Errorf("creating a tmp dir: %s", err.Error())
 		return fmt.Errorf("creating a tmp dir: %w", err)
 	}
-	defer os.RemoveAll(tmpDir)
+	defer func() { _ = fsutils.RemoveTempDir(i.cfg.Fs, tmpDir) }()
 
 	// Dump artifact to tmp dir
-	e := elemental.NewElemental(i.cfg)
-	_, err = e.DumpSource(tmpDir, i.spec.Active.Source)
+	err = dumpUkiSource(i.cfg, tmpDir, i.spec.Active.Source)
 	if err != nil {
 		i.cfg.Logger.Errorf("dumping the source to the tmp dir: %s", err.Error())
 		return err
 	}
 
-	err = copyFile(filepath.Join(tmpDir, "EFI", "kairos", UnassignedArtifactRole+".efi"), targetEntryFile)
+	// Check the artifact is signed with an enrolled key before replacing the entry with it
+	sourceEntryFile := filepath.Join(tmpDir, "EFI", "kairos", UnassignedArtifactRole+".efi")
+	if err = checkUkiSignature(i.cfg, sourceEntryFile); err != nil {
+		i.cfg.Logger.Errorf("checking signature before upgrading entry %s: %s", entry, err.Error())
+		return err
+	}
+
+	err = copyFile(sourceEntryFile, targetEntryFile)
 	if err != nil {
 		i.cfg.Logger.Errorf("copying efi files: %s", err.Error())
 		return err
@@ -200,3 +228,43 @@ func (i *UpgradeAction) installRecovery() error {
 
 	return nil
 }
+
+// rotateSysexts gives the passive entry, which is the former active one, the sysexts that were enabled on it.
+// The new active entry keeps them too, unless the mode is none.
+func rotateSysexts(cfg *config.Config, efiDir, mode string) error {
+	active := elementalUtils.SysextDir(efiDir, "active")
+	passive := elementalUtils.SysextDir(efiDir, "passive")
+
+	if err := cfg.Fs.RemoveAll(passive); err != nil {
+		return err
+	}
+	entries, err := cfg.Fs.ReadDir(active)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err = fsutils.MkdirAll(cfg.Fs, passive, constants.DirPerm); err != nil {
+		return err
+	}
+	sysexts := 0
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(e.Name(), elementalUtils.SysextSuffix) {
+			sysexts++
+		}
+		if err = fsutils.Copy(cfg.Fs, filepath.Join(active, e.Name()), filepath.Join(passive, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	if mode == constants.SysextsNone {
+		cfg.Logger.Infof("Not carrying over the sysexts to the new active entry")
+		return cfg.Fs.RemoveAll(active)
+	}
+	cfg.Logger.Infof("Carried over %d sysexts to the new active entry", sysexts)
+	return nil
+}
@@ -0,0 +1,139 @@
+package uki
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/twpayne/go-vfs/v5"
+	"github.com/twpayne/go-vfs/v5/vfst"
+)
+
+var _ = Describe("Sysexts on upgrade", Label("sysext"), func() {
+	var fs vfs.FS
+	var cleanup func()
+	var cfg *config.Config
+
+	BeforeEach(func() {
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{
+			"/efi/EFI/kairos/active.efi.extra.d/k3s.sysext.raw":      "k3s",
+			"/efi/EFI/kairos/active.efi.extra.d/.kairos-sysext.yaml": "k3s.sysext.raw:\n  source: oci://quay.io/kairos/k3s\n",
+			"/efi/EFI/kairos/passive.efi.extra.d/old.sysext.raw":     "old",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		cfg = config.NewConfig(config.WithFs(fs), config.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})))
+	})
+
+	AfterEach(func() {
+		cleanup()
+	})
+
+	It("gives the passive entry the former active sysexts and carries them over", func() {
+		Expect(rotateSysexts(cfg, "/efi", "")).To(Succeed())
+
+		for _, entry := range []string{"active", "passive"} {
+			exists, _ := fsutils.Exists(fs, "/efi/EFI/kairos/"+entry+".efi.extra.d/k3s.sysext.raw")
+			Expect(exists).To(BeTrue())
+			exists, _ = fsutils.Exists(fs, "/efi/EFI/kairos/"+entry+".efi.extra.d/.kairos-sysext.yaml")
+			Expect(exists).To(BeTrue())
+		}
+		exists, _ := fsutils.Exists(fs, "/efi/EFI/kairos/passive.efi.extra.d/old.sysext.raw")
+		Expect(exists).To(BeFalse())
+	})
+	It("starts the new active entry without sysexts with the none mode", func() {
+		Expect(rotateSysexts(cfg, "/efi", cnst.SysextsNone)).To(Succeed())
+
+		exists, _ := fsutils.Exists(fs, "/efi/EFI/kairos/passive.efi.extra.d/k3s.sysext.raw")
+		Expect(exists).To(BeTrue())
+		exists, _ = fsutils.Exists(fs, "/efi/EFI/kairos/active.efi.extra.d")
+		Expect(exists).To(BeFalse())
+	})
+})
+
+var _ = Describe("Local upgrade sources", Label("source"), func() {
+	var fs vfs.FS
+	var cleanup func()
+	var cfg *config.Config
+
+	writeTarball := func(path string, files map[string]string) {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		for name, content := range files {
+			Expect(tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})).To(Succeed())
+			_, err := tw.Write([]byte(content))
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(tw.Close()).To(Succeed())
+		Expect(gz.Close()).To(Succeed())
+		Expect(fs.WriteFile(path, buf.Bytes(), 0644)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		fs, cleanup, err = vfst.NewTestFS(map[string]interface{}{
+			"/usb/uki/EFI/kairos/norole.efi":           "uki",
+			"/usb/uki/loader/entries/norole.conf":      "title Kairos\nefi /EFI/kairos/norole.efi\n",
+			"/usb/uki/usr/lib/os-release":              "ID=kairos",
+			"/usb/incomplete/EFI/kairos/norole.efi":    "uki",
+			"/efi/loader/entries/active.conf":          "title Kairos\n",
+			"/efi/EFI/kairos/active.efi":               "active",
+			"/efi/EFI/kairos/active.efi.extra.d/.keep": "",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		cfg = config.NewConfig(config.WithFs(fs), config.WithLogger(sdkTypes.NewBufferLogger(&bytes.Buffer{})))
+	})
+
+	AfterEach(func() {
+		cleanup()
+	})
+
+	It("copies only the UKI artifacts from a dir source", func() {
+		src := v1.NewDirSrc("/usb/uki")
+		Expect(dumpUkiSource(cfg, "/efi", src)).To(Succeed())
+
+		content, err := fs.ReadFile("/efi/EFI/kairos/norole.efi")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(content)).To(Equal("uki"))
+		exists, _ := fsutils.Exists(fs, "/efi/loader/entries/norole.conf")
+		Expect(exists).To(BeTrue())
+		exists, _ = fsutils.Exists(fs, "/efi/usr")
+		Expect(exists).To(BeFalse())
+		exists, _ = fsutils.Exists(fs, "/efi/EFI/kairos/active.efi")
+		Expect(exists).To(BeTrue())
+	})
+	It("extracts only the UKI artifacts from a tarball source", func() {
+		writeTarball("/usb/uki.tar.gz", map[string]string{
+			"EFI/kairos/norole.efi":        "uki",
+			"./loader/entries/norole.conf": "title Kairos\n",
+			"usr/lib/os-release":           "ID=kairos",
+		})
+		Expect(dumpUkiSource(cfg, "/efi", v1.NewFileSrc("/usb/uki.tar.gz"))).To(Succeed())
+
+		content, err := fs.ReadFile("/efi/EFI/kairos/norole.efi")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(content)).To(Equal("uki"))
+		exists, _ := fsutils.Exists(fs, "/efi/loader/entries/norole.conf")
+		Expect(exists).To(BeTrue())
+		exists, _ = fsutils.Exists(fs, "/efi/usr")
+		Expect(exists).To(BeFalse())
+	})
+	It("fails if the source does not contain the loader entry", func() {
+		err := dumpUkiSource(cfg, "/efi", v1.NewDirSrc("/usb/incomplete"))
+		Expect(err).To(MatchError(ContainSubstring("does not contain loader/entries/norole.conf")))
+	})
+	It("fails with tarball entries outside of the archive root", func() {
+		writeTarball("/usb/evil.tar.gz", map[string]string{"../EFI/kairos/norole.efi": "evil"})
+		err := dumpUkiSource(cfg, "/efi", v1.NewFileSrc("/usb/evil.tar.gz"))
+		Expect(err).To(MatchError(ContainSubstring("outside of the archive root")))
+	})
+})
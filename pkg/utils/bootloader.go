@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+)
+
+// Bootloader installs the bootloader of the installed system into the target device
+type Bootloader interface {
+	Install(target, rootDir, bootDir, grubConf, tty string, efi bool, stateLabel string) error
+}
+
+// NewBootloader returns the bootloader for the given firmware, grub unless the firmware boots without it
+func NewBootloader(config *agentConfig.Config, firmware string) Bootloader {
+	switch firmware {
+	case v1.ZIPL:
+		return NewZipl(config)
+	case v1.PETITBOOT:
+		return NewPetitboot(config)
+	default:
+		return NewGrub(config)
+	}
+}
+
+// kernelEntry is a boot entry of the kernel based bootloaders
+type kernelEntry struct {
+	Name    string
+	Kernel  string
+	Initrd  string
+	Cmdline string
+}
+
+// copyKernel copies the kernel and initrd of the installed system into dir under the boot dir, so the
+// bootloader can load them without understanding the images. It returns the boot entries using them.
+func copyKernel(config *agentConfig.Config, rootDir, bootDir, dir, console, stateLabel string) ([]kernelEntry, error) {
+	kernel, err := FindFileWithPrefix(config.Fs, filepath.Join(rootDir, "boot"), "vmlinuz", "vmlinux", "image", "Image")
+	if err != nil {
+		return nil, fmt.Errorf("could not find the kernel: %w", err)
+	}
+	initrd, err := FindFileWithPrefix(config.Fs, filepath.Join(rootDir, "boot"), "initrd")
+	if err != nil {
+		return nil, fmt.Errorf("could not find the initrd: %w", err)
+	}
+	target := filepath.Join(bootDir, dir)
+	if err = fsutils.MkdirAll(config.Fs, target, cnst.DirPerm); err != nil {
+		return nil, err
+	}
+	for src, name := range map[string]string{kernel: "vmlinuz", initrd: "initrd"} {
+		config.Logger.Debugf("Copying %s to %s", src, filepath.Join(target, name))
+		if err = CopyFile(config.Fs, src, filepath.Join(target, name)); err != nil {
+			return nil, err
+		}
+	}
+
+	base := fmt.Sprintf("console=%s panic=5 rd.neednet=0 rd.cos.oemlabel=%s", console, cnst.OEMLabel)
+	entry := func(name, label, img string) kernelEntry {
+		return kernelEntry{
+			Name:    name,
+			Kernel:  filepath.Join(target, "vmlinuz"),
+			Initrd:  filepath.Join(target, "initrd"),
+			Cmdline: fmt.Sprintf("%s root=LABEL=%s cos-img/filename=/cOS/%s", base, label, img),
+		}
+	}
+	return []kernelEntry{
+		entry("active", stateLabel, cnst.ActiveImgFile),
+		entry("passive", stateLabel, cnst.PassiveImgFile),
+		entry("recovery", cnst.RecoveryLabel, cnst.RecoveryImgFile),
+	}, nil
+}
+
+// bootConsole returns the console for the kernel cmdline, the tty given to the install or the arch default
+func bootConsole(tty, def string) string {
+	if tty == "" || tty == "console" || tty == cnst.DefaultTty {
+		return def
+	}
+	return tty
+}
+
+// Zipl installs the s390x boot record with zipl. The passive and recovery entries boot the kernel of
+// the active system, zipl has to be installed again to boot a kernel shipped by an upgrade.
+type Zipl struct {
+	config *agentConfig.Config
+}
+
+func NewZipl(config *agentConfig.Config) *Zipl {
+	return &Zipl{config: config}
+}
+
+// Install copies the kernel to the state partition, writes the zipl menu and installs the boot record
+func (z Zipl) Install(target, rootDir, bootDir, _, tty string, _ bool, stateLabel string) error {
+	z.config.Logger.Info("Installing zipl..")
+	entries, err := copyKernel(z.config, rootDir, bootDir, cnst.ZiplDir, bootConsole(tty, cnst.ZiplConsole), stateLabel)
+	if err != nil {
+		return err
+	}
+	ziplDir := filepath.Join(bootDir, cnst.ZiplDir)
+	conf := filepath.Join(ziplDir, cnst.ZiplConf)
+	if err = z.config.Fs.WriteFile(conf, []byte(ziplConfig(ziplDir, entries)), cnst.FilePerm); err != nil {
+		return err
+	}
+	out, err := z.config.Runner.Run("zipl", "--config", conf)
+	if err != nil {
+		z.config.Logger.Errorf(string(out))
+		return err
+	}
+	z.config.Logger.Infof("Zipl install to device %s complete", target)
+	return nil
+}
+
+// ziplConfig renders a zipl.conf with a menu booting the first entry by default
+func ziplConfig(target string, entries []kernelEntry) string {
+	var b strings.Builder
+	b.WriteString("[defaultboot]\ndefaultmenu = menu\n\n")
+	for _, e := range entries {
+		fmt.Fprintf(&b, "[%s]\ntarget = %s\nimage = %s\nramdisk = %s\nparameters = \"%s\"\n\n", e.Name, target, e.Kernel, e.Initrd, e.Cmdline)
+	}
+	fmt.Fprintf(&b, ":menu\ntarget = %s\ntimeout = 5\ndefault = 1\nprompt = 1\n", target)
+	for i, e := range entries {
+		fmt.Fprintf(&b, "%d = %s\n", i+1, e.Name)
+	}
+	return b.String()
+}
+
+// Petitboot writes a kboot.conf on the state partition for the ppc64le petitboot loader. Petitboot
+// scans the partitions on every boot so there is nothing to install on the device. As with zipl
+// the passive and recovery entries boot the kernel of the active system.
+type Petitboot struct {
+	config *agentConfig.Config
+}
+
+func NewPetitboot(config *agentConfig.Config) *Petitboot {
+	return &Petitboot{config: config}
+}
+
+// Install copies the kernel to the state partition and writes the kboot.conf next to it
+func (p Petitboot) Install(target, rootDir, bootDir, _, tty string, _ bool, stateLabel string) error {
+	p.config.Logger.Info("Writing the petitboot config..")
+	entries, err := copyKernel(p.config, rootDir, bootDir, cnst.PetitbootDir, bootConsole(tty, cnst.PetitbootConsole), stateLabel)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "default=%s\n", entries[0].Name)
+	for _, e := range entries {
+		// Petitboot reads the paths relative to the partition the config is found on
+		kernel := "/" + strings.TrimPrefix(e.Kernel, bootDir+"/")
+		initrd := "/" + strings.TrimPrefix(e.Initrd, bootDir+"/")
+		fmt.Fprintf(&b, "%s='%s initrd=%s %s'\n", e.Name, kernel, initrd, e.Cmdline)
+	}
+	conf := filepath.Join(bootDir, cnst.PetitbootConf)
+	if err = p.config.Fs.WriteFile(conf, []byte(b.String()), cnst.FilePerm); err != nil {
+		return err
+	}
+	p.config.Logger.Infof("Petitboot config for device %s written to %s", target, conf)
+	return nil
+}
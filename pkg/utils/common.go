@@ -18,7 +18,10 @@ package utils
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -54,6 +57,16 @@ func CommandExists(command string) bool {
 	return err == nil
 }
 
+// CommandExistsIn checks if the given command is available in the usual binary paths of the given root tree
+func CommandExistsIn(fs v1.FS, rootDir, command string) bool {
+	for _, dir := range []string{"/usr/bin", "/usr/sbin", "/bin", "/sbin"} {
+		if exists, _ := fsutils.Exists(fs, filepath.Join(rootDir, dir, command)); exists {
+			return true
+		}
+	}
+	return false
+}
+
 // GetDeviceByLabel will try to return the device that matches the given label.
 // attempts value sets the number of attempts to find the device, it
 // waits a second between attempts.
@@ -152,6 +165,11 @@ func CreateDirStructure(fs v1.FS, target string) error {
 // SyncData rsync's source folder contents to a target folder content,
 // both are expected to exist beforehand.
 func SyncData(log sdkTypes.KairosLogger, runner v1.Runner, fs v1.FS, source string, target string, excludes ...string) error {
+	return SyncDataContext(context.Background(), log, runner, fs, source, target, excludes...)
+}
+
+// SyncDataContext is SyncData with the rsync killed if ctx is done before it finishes
+func SyncDataContext(ctx context.Context, log sdkTypes.KairosLogger, runner v1.Runner, fs v1.FS, source string, target string, excludes ...string) error {
 	if fs != nil {
 		if s, err := fs.RawPath(source); err == nil {
 			source = s
@@ -188,7 +206,7 @@ func SyncData(log sdkTypes.KairosLogger, runner v1.Runner, fs v1.FS, source stri
 
 	done := displayProgress(log, 5*time.Second, "Syncing data...")
 
-	out, err := runner.Run(cnst.Rsync, args...)
+	out, err := runner.RunCmd(runner.InitCmdContext(ctx, cnst.Rsync, args...))
 
 	close(done)
 	if err != nil {
@@ -233,39 +251,180 @@ func Shutdown(runner v1.Runner, delay time.Duration) error {
 	return err
 }
 
+// CosignOptions are the options of a cosign verification
+type CosignOptions struct {
+	PublicKey string
+	// CertificateIdentityRegexp and CertificateOIDCIssuerRegexp constrain the signer of keyless signatures
+	CertificateIdentityRegexp   string
+	CertificateOIDCIssuerRegexp string
+	// Offline verifies the signature against the Rekor proof bundled with it, without reaching the transparency log
+	Offline bool
+	// TrustedRoot is a local trusted root file, so no TUF update is needed on air-gapped sites
+	TrustedRoot string
+	// CacheDir keeps the successful verifications of images referenced by digest, empty disables the cache
+	CacheDir string
+}
+
 // CosignVerify runs a cosign validation for the give image and given public key. If no
 // key is provided then it attempts a keyless validation (experimental feature).
 func CosignVerify(fs v1.FS, runner v1.Runner, image string, publicKey string) (string, error) {
+	return CosignVerifyWithOptions(fs, runner, image, CosignOptions{PublicKey: publicKey})
+}
+
+// CosignVerifyWithOptions runs a cosign validation for the given image with the given options.
+// The environment is set per command, so several verifications can run in parallel.
+func CosignVerifyWithOptions(fs v1.FS, runner v1.Runner, image string, opts CosignOptions) (string, error) {
+	cacheFile := cosignCacheFile(image, opts)
+	if cacheFile != "" {
+		if ok, _ := fsutils.Exists(fs, cacheFile); ok {
+			return fmt.Sprintf("%s verification result found in cache", image), nil
+		}
+	}
+
 	args := []string{}
+	env := []string{}
 
-	if publicKey != "" {
-		args = append(args, "-key", publicKey)
+	if opts.PublicKey != "" {
+		args = append(args, "-key", opts.PublicKey)
 	} else {
-		os.Setenv("COSIGN_EXPERIMENTAL", "1")
-		defer os.Unsetenv("COSIGN_EXPERIMENTAL")
+		env = append(env, "COSIGN_EXPERIMENTAL=1")
+		if opts.CertificateIdentityRegexp != "" {
+			args = append(args, "--certificate-identity-regexp", opts.CertificateIdentityRegexp)
+		}
+		if opts.CertificateOIDCIssuerRegexp != "" {
+			args = append(args, "--certificate-oidc-issuer-regexp", opts.CertificateOIDCIssuerRegexp)
+		}
+	}
+	if opts.Offline {
+		args = append(args, "--offline")
+	}
+	if opts.TrustedRoot != "" {
+		args = append(args, "--trusted-root", opts.TrustedRoot)
 	}
 	args = append(args, image)
 
 	// Give each cosign its own tuf dir so it doesnt collide with others accessing the same files at the same time
-	tmpDir, err := fsutils.TempDir(fs, "", "cosign-tuf-")
+	tmpDir, err := fsutils.NamespacedTempDir(fs, "", "cosign-tuf", 0)
 	if err != nil {
 		return "", err
 	}
-	_ = os.Setenv("TUF_ROOT", tmpDir)
 	defer func(fs v1.FS, path string) {
-		_ = fs.RemoveAll(path)
+		_ = fsutils.RemoveTempDir(fs, path)
 	}(fs, tmpDir)
-	defer func() {
-		_ = os.Unsetenv("TUF_ROOT")
-	}()
+	env = append(env, fmt.Sprintf("TUF_ROOT=%s", tmpDir))
+
+	cmd := runner.InitCmd("cosign", args...)
+	if cmd != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	out, err := runner.RunCmd(cmd)
+	if err != nil || cacheFile == "" {
+		return string(out), err
+	}
+
+	// A failure to cache the result is not a verification failure
+	_ = writeCosignCache(fs, cacheFile, image)
+	return string(out), nil
+}
 
-	out, err := runner.Run("cosign", args...)
-	return string(out), err
+// cosignCacheFile returns the cache file for the verification of the given image and options.
+// Only images referenced by digest are cached, as tags are mutable.
+func cosignCacheFile(image string, opts CosignOptions) string {
+	if opts.CacheDir == "" || !strings.Contains(image, "@sha256:") {
+		return ""
+	}
+	key := strings.Join([]string{
+		image, opts.PublicKey, opts.CertificateIdentityRegexp, opts.CertificateOIDCIssuerRegexp,
+		strconv.FormatBool(opts.Offline), opts.TrustedRoot,
+	}, "\n")
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(opts.CacheDir, hex.EncodeToString(sum[:]))
+}
+
+// writeCosignCache stores a successful verification, renaming a temporary file so parallel
+// verifications never read a partial entry
+func writeCosignCache(fs v1.FS, cacheFile, image string) error {
+	err := fsutils.MkdirAll(fs, filepath.Dir(cacheFile), cnst.DirPerm)
+	if err != nil {
+		return err
+	}
+	return fsutils.AtomicWriteFile(fs, cacheFile, []byte(image+"\n"), cnst.FilePerm)
+}
+
+// SquashfsOptions returns the mksquashfs options to create images with. If the squashfs compression and block size
+// are configured they are used, the compressor being checked against the ones mksquashfs supports, otherwise the
+// default block size with the squash-compression options is used.
+func SquashfsOptions(cfg *agentConfig.Config) []string {
+	options := squashfsCompressionOptions(cfg)
+	if cfg.Squashfs != nil && cfg.Squashfs.Processors > 0 {
+		options = append(options, "-processors", strconv.Itoa(cfg.Squashfs.Processors))
+	}
+	return options
+}
+
+func squashfsCompressionOptions(cfg *agentConfig.Config) []string {
+	if cfg.Squashfs == nil {
+		return append(cnst.GetDefaultSquashfsOptions(), cfg.SquashFsCompressionConfig...)
+	}
+
+	options := cnst.GetDefaultSquashfsOptions()
+	if cfg.Squashfs.BlockSize != "" {
+		options = []string{"-b", cfg.Squashfs.BlockSize}
+	}
+	if cfg.Squashfs.Compression == "" {
+		return append(options, cfg.SquashFsCompressionConfig...)
+	}
+
+	comp, level, _ := strings.Cut(cfg.Squashfs.Compression, ":")
+	if !squashfsCompressorAvailable(cfg.Runner, comp) {
+		cfg.Logger.Warnf("mksquashfs does not support %s compression, using gzip", comp)
+		comp, level = "gzip", ""
+	}
+	options = append(options, "-comp", comp)
+	if level == "" {
+		return options
+	}
+	switch comp {
+	case "gzip", "zstd", "lzo":
+		options = append(options, "-Xcompression-level", level)
+	case "lz4":
+		// lz4 has no levels, just the high compression mode
+		options = append(options, "-Xhc")
+	default:
+		cfg.Logger.Warnf("Ignoring the compression level %s, %s compression has no levels", level, comp)
+	}
+	return options
+}
+
+// squashfsCompressorAvailable checks the compressors listed in the mksquashfs help. If they cannot be listed
+// the compressor is assumed to be available and mksquashfs will fail later on if it is not.
+func squashfsCompressorAvailable(runner v1.Runner, comp string) bool {
+	// mksquashfs exits with an error when printing the help on some versions, the output is what matters
+	out, _ := runner.Run("mksquashfs", "-help")
+	help := string(out)
+	i := strings.Index(help, "Compressors available")
+	if i < 0 {
+		return true
+	}
+	for _, line := range strings.Split(help[i:], "\n")[1:] {
+		fields := strings.Fields(line)
+		// Compressors are listed indented by a single tab, their options by more
+		if len(fields) > 0 && strings.HasPrefix(line, "\t") && !strings.HasPrefix(line, "\t\t") && fields[0] == comp {
+			return true
+		}
+	}
+	return false
 }
 
 // CreateSquashFS creates a squash file at destination from a source, with options
 // TODO: Check validity of source maybe?
 func CreateSquashFS(runner v1.Runner, logger sdkTypes.KairosLogger, source string, destination string, options []string) error {
+	return CreateSquashFSWithProgress(context.Background(), runner, logger, source, destination, options, nil)
+}
+
+// CreateSquashFSWithProgress is CreateSquashFS reporting the mksquashfs progress, in percent, to the progress
+// function if not nil. mksquashfs is killed if ctx is done before it finishes.
+func CreateSquashFSWithProgress(ctx context.Context, runner v1.Runner, logger sdkTypes.KairosLogger, source string, destination string, options []string, progress func(int)) error {
 	// create args
 	args := []string{source, destination}
 	// append options passed to args in order to have the correct order
@@ -275,7 +434,19 @@ func CreateSquashFS(runner v1.Runner, logger sdkTypes.KairosLogger, source strin
 		optionsExpanded = append(optionsExpanded, strings.Split(op, " ")...)
 	}
 	args = append(args, optionsExpanded...)
-	out, err := runner.Run("mksquashfs", args...)
+	if progress != nil {
+		// Print the progress bar even if the output is not a terminal
+		args = append(args, "-progress")
+	}
+	cmd := runner.InitCmdContext(ctx, "mksquashfs", args...)
+	if cmd != nil && progress != nil {
+		cmd.Stdout = &squashfsProgress{report: progress, last: -1}
+	}
+	out, err := runner.RunCmd(cmd)
+	if ctx.Err() != nil {
+		logger.Errorf("Squashfs creation from %s to %s cancelled", source, destination)
+		return ctx.Err()
+	}
 	if err != nil {
 		logger.Debugf("Error running squashfs creation, stdout: %s", out)
 		logger.Errorf("Error while creating squashfs from %s to %s: %s", source, destination, err)
@@ -284,6 +455,34 @@ func CreateSquashFS(runner v1.Runner, logger sdkTypes.KairosLogger, source strin
 	return nil
 }
 
+// squashfsProgressRegexp matches the percentage at the end of the mksquashfs progress bar
+var squashfsProgressRegexp = regexp.MustCompile(`(\d+)%\s*$`)
+
+// squashfsProgress parses the mksquashfs progress bar, which is redrawn with carriage returns, and reports
+// every change of the percentage
+type squashfsProgress struct {
+	report  func(int)
+	last    int
+	pending []byte
+}
+
+func (p *squashfsProgress) Write(b []byte) (int, error) {
+	p.pending = append(p.pending, b...)
+	for {
+		i := bytes.IndexAny(p.pending, "\r\n")
+		if i < 0 {
+			return len(b), nil
+		}
+		if m := squashfsProgressRegexp.FindSubmatch(p.pending[:i]); m != nil {
+			if pct, err := strconv.Atoi(string(m[1])); err == nil && pct != p.last {
+				p.last = pct
+				p.report(pct)
+			}
+		}
+		p.pending = p.pending[i+1:]
+	}
+}
+
 // LoadEnvFile will try to parse the file given and return a map with the kye/values
 func LoadEnvFile(fs v1.FS, file string) (map[string]string, error) {
 	var envMap map[string]string
@@ -324,22 +523,53 @@ func IsMounted(config *agentConfig.Config, part *types.Partition) (bool, error)
 // It will respect TMPDIR and use that if exists, fallback to try the persistent partition if its mounted
 // and finally the default /tmp/ dir
 // suffix is what is appended to the dir name elemental-suffix. If empty it will randomly generate a number
+// Prefer NewTempDir, which creates the dir and takes care of removing it
 func GetTempDir(config *agentConfig.Config, suffix string) string {
 	// if we got a TMPDIR var, respect and use that
 	if suffix == "" {
 		random.Seed(time.Now().UnixNano())
 		suffix = strconv.Itoa(int(random.Uint32()))
 	}
-	elementalTmpDir := fmt.Sprintf("elemental-%s", suffix)
+	return filepath.Join(tempBaseDir(config), fmt.Sprintf("elemental-%s", suffix))
+}
+
+// NewTempDir creates a temp dir for the given operation namespace, i.e. `deploy` or `iso`, in the same place
+// GetTempDir picks. The dir is limited to the temp_dirs quota and removed on exit if the caller did not
+// remove it with fsutils.RemoveTempDir before.
+func NewTempDir(config *agentConfig.Config, namespace string) (string, error) {
+	var quota uint64
+	if config.TempDirs != nil {
+		quota = uint64(config.TempDirs.Quota) << 20
+	}
+	return fsutils.NamespacedTempDir(config.Fs, tempBaseDir(config), namespace, quota)
+}
+
+// CleanStaleTempDirs removes the temp dirs left behind by agent processes which did not exit cleanly
+func CleanStaleTempDirs(config *agentConfig.Config) {
+	bases := []string{filepath.Join("/", "tmp")}
+	if base := tempBaseDir(config); base != bases[0] {
+		bases = append(bases, base)
+	}
+	removed, err := fsutils.CleanStaleTempDirs(config.Fs, bases...)
+	for _, dir := range removed {
+		config.Logger.Debugf("Removed stale temporary dir %s", dir)
+	}
+	if err != nil {
+		config.Logger.Debugf("Could not remove all the stale temporary dirs: %s", err)
+	}
+}
+
+// tempBaseDir returns where the temporary dirs go: TMPDIR, the persistent partition if mounted or /tmp
+func tempBaseDir(config *agentConfig.Config) string {
 	dir := os.Getenv("TMPDIR")
 	if dir != "" {
 		config.Logger.Debugf("Got tmpdir from TMPDIR var: %s", dir)
-		return filepath.Join(dir, elementalTmpDir)
+		return dir
 	}
 	parts, err := partitions.GetAllPartitions(&config.Logger)
 	if err != nil {
 		config.Logger.Debug("Could not get partitions, defaulting to /tmp")
-		return filepath.Join("/", "tmp", elementalTmpDir)
+		return filepath.Join("/", "tmp")
 	}
 	// Check persistent and if its mounted
 	ep := v1.NewElementalPartitionsFromList(parts)
@@ -347,11 +577,11 @@ func GetTempDir(config *agentConfig.Config, suffix string) string {
 	if persistent != nil {
 		if mnt, _ := IsMounted(config, persistent); mnt {
 			config.Logger.Debugf("Using tmpdir on persistent volume: %s", persistent.MountPoint)
-			return filepath.Join(persistent.MountPoint, "tmp", elementalTmpDir)
+			return filepath.Join(persistent.MountPoint, "tmp")
 		}
 	}
 	config.Logger.Debug("Could not get any valid tmpdir, defaulting to /tmp")
-	return filepath.Join("/", "tmp", elementalTmpDir)
+	return filepath.Join("/", "tmp")
 }
 
 // IsLocalURI returns true if the uri has "file" scheme or no scheme and URI is
@@ -390,12 +620,17 @@ func IsHTTPURI(uri string) (bool, error) {
 
 // GetSource copies given source to destination, if source is a local path it simply
 // copies files, if source is a remote URL it tries to download URL to destination.
+// A `#sha256=<checksum>` fragment in the source is checked against the copied file.
 func GetSource(config *agentConfig.Config, source string, destination string) error {
 	local, err := IsLocalURI(source)
 	if err != nil {
 		config.Logger.Errorf("Not a valid url: %s", source)
 		return err
 	}
+	source, checksum, err := splitSourceChecksum(source)
+	if err != nil {
+		return err
+	}
 
 	err = vfs.MkdirAll(config.Fs, filepath.Dir(destination), cnst.DirPerm)
 	if err != nil {
@@ -419,9 +654,37 @@ func GetSource(config *agentConfig.Config, source string, destination string) er
 			return err
 		}
 	}
+	if checksum != "" {
+		sum, err := CalcFileChecksum(config.Fs, destination)
+		if err != nil {
+			return err
+		}
+		if sum != checksum {
+			_ = config.Fs.Remove(destination)
+			return fmt.Errorf("checksum mismatch for %s: expected sha256 %s, got %s", source, checksum, sum)
+		}
+		config.Logger.Debugf("Checksum of %s verified", source)
+	}
 	return nil
 }
 
+// splitSourceChecksum returns the source without the checksum fragment and the sha256 checksum in it, if any
+func splitSourceChecksum(source string) (string, string, error) {
+	base, fragment, found := strings.Cut(source, "#")
+	algo, sum, isChecksum := strings.Cut(fragment, "=")
+	if !found || !isChecksum {
+		return source, "", nil
+	}
+	sum = strings.ToLower(sum)
+	if algo != "sha256" {
+		return "", "", fmt.Errorf("unsupported checksum %q in %s, only sha256 is supported", algo, source)
+	}
+	if _, err := hex.DecodeString(sum); err != nil || len(sum) != sha256.Size*2 {
+		return "", "", fmt.Errorf("invalid sha256 checksum %q in %s", sum, source)
+	}
+	return base, sum, nil
+}
+
 // ValidContainerReferece returns true if the given string matches
 // a container registry reference, false otherwise
 func ValidContainerReference(ref string) bool {
@@ -581,27 +844,16 @@ func SystemdBootConfReader(vfs v1.FS, filePath string) (map[string]string, error
 // SystemdBootConfWriter writes a map to a systemd-boot conf file
 // TODO: Move this to the sdk with the FS interface
 func SystemdBootConfWriter(fs v1.FS, filePath string, conf map[string]string) error {
-	file, err := fs.Create(filePath)
-	if err != nil {
-		return err
-	}
-	defer func(file *os.File) {
-		_ = file.Close()
-	}(file)
-
-	writer := bufio.NewWriter(file)
+	var b bytes.Buffer
 	for k, v := range conf {
 		if v == "" {
-			_, err = writer.WriteString(fmt.Sprintf("%s \n", k))
+			b.WriteString(fmt.Sprintf("%s \n", k))
 		} else {
-			_, err = writer.WriteString(fmt.Sprintf("%s %s\n", k, v))
-		}
-		if err != nil {
-			return err
+			b.WriteString(fmt.Sprintf("%s %s\n", k, v))
 		}
 	}
 
-	return writer.Flush()
+	return fsutils.AtomicWriteFile(fs, filePath, b.Bytes(), cnst.FilePerm)
 }
 
 // CheckFailedInstallation checks if the state file if present, and if it is, it will return true and the error with the file content indicating why we should abort the installation
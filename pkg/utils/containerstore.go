@@ -0,0 +1,98 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	containerv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	sdkUtils "github.com/kairos-io/kairos-sdk/utils"
+)
+
+// ExtractContainerStoreImage exports the image of a containerd or podman source from the local container runtime
+// store and extracts it into target, without reaching the network. ctr uses the CONTAINERD_ADDRESS and
+// CONTAINERD_NAMESPACE environment variables to pick the store, i.e. the k3s one. The image policy, if any, is
+// checked against the exported image.
+func ExtractContainerStoreImage(cfg *agentConfig.Config, src *v1.ImageSource, target string) error {
+	if cfg.ImagePolicy != nil {
+		if err := cfg.ImagePolicy.CheckRegistry(src.Value()); err != nil {
+			return err
+		}
+	}
+	tmpDir, err := NewTempDir(cfg, "image-export")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = fsutils.RemoveTempDir(cfg.Fs, tmpDir) }()
+	archive, err := cfg.Fs.RawPath(filepath.Join(tmpDir, "image.tar"))
+	if err != nil {
+		return err
+	}
+
+	var out []byte
+	switch src.ContainerRuntime() {
+	case "containerd":
+		args := []string{"images", "export"}
+		if platform := cfg.Platform.String(); platform != "" {
+			args = append(args, "--platform", platform)
+		}
+		out, err = cfg.Runner.Run("ctr", append(args, archive, src.Value())...)
+	case "podman":
+		out, err = cfg.Runner.Run("podman", "save", "--format", "docker-archive", "-o", archive, src.Value())
+	default:
+		return fmt.Errorf("%s is not a container runtime store source", src.String())
+	}
+	if err != nil {
+		return fmt.Errorf("exporting %s from the %s store: %s: %w", src.Value(), src.ContainerRuntime(), strings.TrimSpace(string(out)), err)
+	}
+
+	// Both archives have the docker manifest.json listing the exported image
+	img, err := tarball.ImageFromPath(archive, nil)
+	if err != nil {
+		return fmt.Errorf("reading the image exported from the %s store: %w", src.ContainerRuntime(), err)
+	}
+	if cfg.ImagePolicy != nil {
+		if err = checkExportedImagePolicy(cfg.ImagePolicy, src.Value(), img); err != nil {
+			return err
+		}
+	}
+	return sdkUtils.ExtractOCIImage(img, target)
+}
+
+func checkExportedImagePolicy(policy *v1.ImagePolicy, ref string, img containerv1.Image) error {
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return err
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return err
+	}
+	meta := v1.OCIImageMetadata{
+		Labels:      configFile.Config.Labels,
+		Annotations: manifest.Annotations,
+		Created:     configFile.Created.Time,
+	}
+	return policy.Check(ref, meta, time.Now())
+}
@@ -0,0 +1,133 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DefaultStopGrace is how long a phase that timed out is waited for to stop once its context is canceled
+const DefaultStopGrace = 10 * time.Second
+
+// TimeoutError is returned when a phase of an action does not finish in time
+type TimeoutError struct {
+	Phase   string
+	Timeout time.Duration
+	// Total is set when the overall deadline of the action was hit instead of the phase timeout
+	Total bool
+	// Running is set when the phase did not stop within the grace period after its context was canceled
+	Running bool
+}
+
+func (e *TimeoutError) Error() string {
+	msg := fmt.Sprintf("%s: timed out after %s", e.Phase, e.Timeout)
+	if e.Total {
+		msg = fmt.Sprintf("%s: overall deadline of %s exceeded", e.Phase, e.Timeout)
+	}
+	if e.Running {
+		msg += ", it did not stop and was left running"
+	}
+	return msg
+}
+
+// Deadline tracks the overall timeout of an action and bounds the timeouts of its phases with it.
+// A zero total means no overall deadline.
+type Deadline struct {
+	total     time.Duration
+	end       time.Time
+	ctx       context.Context
+	stopGrace time.Duration
+}
+
+// NewDeadline returns a Deadline expiring after total
+func NewDeadline(total time.Duration) *Deadline {
+	d := &Deadline{total: total, ctx: context.Background(), stopGrace: DefaultStopGrace}
+	if total > 0 {
+		d.end = time.Now().Add(total)
+	}
+	return d
+}
+
+// WithContext sets the context the contexts of the phases derive from, so they are done along with it
+func (d *Deadline) WithContext(ctx context.Context) *Deadline {
+	d.ctx = ctx
+	return d
+}
+
+// WithStopGrace sets how long the phases that timed out are waited for to stop
+func (d *Deadline) WithStopGrace(grace time.Duration) *Deadline {
+	d.stopGrace = grace
+	return d
+}
+
+// Run runs f as the given phase and returns a TimeoutError if it does not finish within timeout or before
+// the overall deadline, whatever happens first. A zero timeout is only bounded by the overall deadline.
+// On timeout the context given to f is canceled and f is waited for up to the stop grace period, so the callers
+// can clean up what f was working on. f is expected to stop its commands and transfers once its context is done,
+// the phases that can't, i.e. the hooks, are left running once the grace period is over so Run does not block.
+func (d *Deadline) Run(phase string, timeout time.Duration, f func(ctx context.Context) error) error {
+	parent := context.Background()
+	total := false
+	grace := DefaultStopGrace
+	if d != nil {
+		if d.ctx != nil {
+			parent = d.ctx
+		}
+		grace = d.stopGrace
+		if !d.end.IsZero() {
+			remaining := time.Until(d.end)
+			if remaining <= 0 {
+				return &TimeoutError{Phase: phase, Timeout: d.total, Total: true}
+			}
+			if timeout <= 0 || remaining < timeout {
+				timeout = remaining
+				total = true
+			}
+		}
+	}
+	if timeout <= 0 {
+		return f(parent)
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- f(ctx) }()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		cancel()
+		timeoutErr := &TimeoutError{Phase: phase, Timeout: timeout}
+		if total {
+			timeoutErr = &TimeoutError{Phase: phase, Timeout: d.total, Total: true}
+		}
+		graceTimer := time.NewTimer(grace)
+		defer graceTimer.Stop()
+		select {
+		case <-done:
+		case <-graceTimer.C:
+			timeoutErr.Running = true
+		}
+		return timeoutErr
+	}
+}
@@ -21,6 +21,7 @@ package fsutils
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
@@ -200,12 +201,132 @@ func WalkDirFs(fs v1.FS, root string, fn fs.WalkDirFunc) error {
 	} else {
 		err = walkDir(fs, root, &statDirEntry{info}, fn)
 	}
-	if errors.Is(err, filepath.SkipDir) {
+	if errors.Is(err, filepath.SkipDir) || errors.Is(err, filepath.SkipAll) {
 		return nil
 	}
 	return err
 }
 
+// walkItem is a directory pending to be read by WalkDirFsParallel
+type walkItem struct {
+	path string
+	d    fs.DirEntry
+}
+
+// parallelWalk is the queue of the directories pending to be read by the workers of WalkDirFsParallel
+type parallelWalk struct {
+	fs v1.FS
+	fn fs.WalkDirFunc
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	dirs []walkItem
+	// pending are the directories queued or being read, the walk is done once there are none
+	pending int
+	done    bool
+	err     error
+}
+
+// WalkDirFsParallel walks the tree at root as WalkDirFs does, reading up to workers directories at once, which
+// speeds up walking trees with millions of files. fn is called from several goroutines, so it must be safe for
+// concurrent use, and the entries are not visited in lexical order, only the entries of a directory are visited in
+// order. Returning filepath.SkipDir from fn skips the directory, or the rest of the entries of the directory of a
+// file, as in WalkDirFs. Returning filepath.SkipAll or an error stops the walk early, the directories pending are
+// not read. With 1 worker or less the tree is walked by WalkDirFs.
+func WalkDirFsParallel(vfs v1.FS, root string, workers int, fn fs.WalkDirFunc) error {
+	if workers <= 1 {
+		return WalkDirFs(vfs, root, fn)
+	}
+	info, err := vfs.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else if err = fn(root, &statDirEntry{info}, nil); err == nil && info.IsDir() {
+		w := &parallelWalk{fs: vfs, fn: fn, dirs: []walkItem{{root, &statDirEntry{info}}}, pending: 1}
+		w.cond = sync.NewCond(&w.mu)
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w.work()
+			}()
+		}
+		wg.Wait()
+		err = w.err
+	}
+	if errors.Is(err, filepath.SkipDir) || errors.Is(err, filepath.SkipAll) {
+		return nil
+	}
+	return err
+}
+
+// work reads the queued directories until the walk is done or stopped
+func (w *parallelWalk) work() {
+	for {
+		w.mu.Lock()
+		for len(w.dirs) == 0 && !w.done {
+			w.cond.Wait()
+		}
+		if w.done {
+			w.mu.Unlock()
+			return
+		}
+		// Last in first out, the walk goes depth first which keeps the queue short on wide trees
+		item := w.dirs[len(w.dirs)-1]
+		w.dirs = w.dirs[:len(w.dirs)-1]
+		w.mu.Unlock()
+
+		dirs, err := w.readDir(item)
+
+		w.mu.Lock()
+		if err != nil && !w.done {
+			w.err = err
+			w.done = true
+		}
+		if !w.done {
+			w.dirs = append(w.dirs, dirs...)
+			w.pending += len(dirs)
+		}
+		w.pending--
+		if w.pending == 0 {
+			w.done = true
+		}
+		w.cond.Broadcast()
+		w.mu.Unlock()
+	}
+}
+
+// readDir calls fn on the entries of the directory, returning the subdirectories to walk
+func (w *parallelWalk) readDir(item walkItem) ([]walkItem, error) {
+	entries, err := readDir(w.fs, item.path)
+	if err != nil {
+		// Second call, to report ReadDir error.
+		if err = w.fn(item.path, item.d, err); err != nil {
+			if errors.Is(err, filepath.SkipDir) {
+				err = nil
+			}
+			return nil, err
+		}
+	}
+	var dirs []walkItem
+	for _, d := range entries {
+		path := filepath.Join(item.path, d.Name())
+		if err := w.fn(path, d, nil); err != nil {
+			if !errors.Is(err, filepath.SkipDir) {
+				return nil, err
+			}
+			if d.IsDir() {
+				continue
+			}
+			break
+		}
+		if d.IsDir() {
+			dirs = append(dirs, walkItem{path, d})
+		}
+	}
+	return dirs, nil
+}
+
 func walkDir(fs v1.FS, path string, d fs.DirEntry, walkDirFn fs.WalkDirFunc) error {
 	if err := walkDirFn(path, d, nil); err != nil || !d.IsDir() {
 		if err == filepath.SkipDir && d.IsDir() {
@@ -308,3 +429,67 @@ func GlobFs(fs v1.FS, pattern string) ([]string, error) {
 
 	return matches, nil
 }
+
+// AtomicWriteFile writes data to filename so that, even on a power loss, filename either keeps its previous
+// contents or has the new ones, never a partial or empty file. Data is written to a temporary file in the same
+// directory, synced, renamed over filename and finally the directory is synced to persist the rename.
+func AtomicWriteFile(fs v1.FS, filename string, data []byte, perm os.FileMode) (err error) {
+	dir := filepath.Dir(filename)
+	tmp := filepath.Join(dir, fmt.Sprintf(".%s.%d.tmp", filepath.Base(filename), os.Getpid()))
+	f, err := fs.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = fs.Remove(tmp)
+		}
+	}()
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	// OpenFile permissions are subject to the umask
+	if err = fs.Chmod(tmp, perm); err != nil {
+		return err
+	}
+	if err = fs.Rename(tmp, filename); err != nil {
+		return err
+	}
+	return syncDir(fs, dir)
+}
+
+// SyncFile flushes the contents of the given file and its directory entry to disk
+func SyncFile(fs v1.FS, path string) error {
+	f, err := fs.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+	return syncDir(fs, filepath.Dir(path))
+}
+
+// syncDir flushes the directory entries of dir to disk. Filesystems that do not support syncing
+// directories are ignored, there is nothing else to do for them.
+func syncDir(fs v1.FS, dir string) error {
+	d, err := fs.OpenFile(dir, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err = d.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) && !errors.Is(err, syscall.ENOTSUP) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsutils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+const (
+	// TempDirPrefix is the prefix of the temp dirs created by NamespacedTempDir
+	TempDirPrefix = "kairos-"
+	// TempDirOwnerSuffix is the suffix of the marker file created next to each temp dir, holding the pid of its owner.
+	// It lives outside the dir so it never ends up in the data stored there
+	TempDirOwnerSuffix = ".owner"
+)
+
+// tempDirs are the temp dirs created by this process, with their quota in bytes
+var tempDirs = struct {
+	sync.Mutex
+	quotas map[string]uint64
+}{quotas: map[string]uint64{}}
+
+// NamespacedTempDir creates a temp dir for the namespace of an operation in base, or the default temp dir if empty.
+// Each call gets its own dir, so concurrent operations in the same namespace never collide. The dir is tracked for
+// CleanupTempDirs, and an owner marker next to it lets CleanStaleTempDirs remove it if the process dies before.
+// quota is the size in bytes CheckTempDirQuota allows the dir to grow to, 0 means no limit.
+func NamespacedTempDir(fs v1.FS, base, namespace string, quota uint64) (string, error) {
+	if base == "" {
+		base = os.TempDir()
+	}
+	err := MkdirAll(fs, base, 0755)
+	if err != nil {
+		return "", err
+	}
+	dir, err := TempDir(fs, base, fmt.Sprintf("%s%s-", TempDirPrefix, namespace))
+	if err != nil {
+		return "", err
+	}
+	err = fs.WriteFile(dir+TempDirOwnerSuffix, []byte(strconv.Itoa(os.Getpid())), 0600)
+	if err != nil {
+		_ = fs.RemoveAll(dir)
+		return "", err
+	}
+
+	tempDirs.Lock()
+	tempDirs.quotas[dir] = quota
+	tempDirs.Unlock()
+	return dir, nil
+}
+
+// RemoveTempDir removes a temp dir created by NamespacedTempDir along with its owner marker
+func RemoveTempDir(fs v1.FS, dir string) error {
+	tempDirs.Lock()
+	delete(tempDirs.quotas, dir)
+	tempDirs.Unlock()
+	return errors.Join(fs.RemoveAll(dir), fs.RemoveAll(dir+TempDirOwnerSuffix))
+}
+
+// CleanupTempDirs removes all the temp dirs created by this process which are still around, meant to run on exit
+func CleanupTempDirs(fs v1.FS) error {
+	tempDirs.Lock()
+	dirs := make([]string, 0, len(tempDirs.quotas))
+	for dir := range tempDirs.quotas {
+		dirs = append(dirs, dir)
+	}
+	tempDirs.Unlock()
+
+	var errs []error
+	for _, dir := range dirs {
+		errs = append(errs, RemoveTempDir(fs, dir))
+	}
+	return errors.Join(errs...)
+}
+
+// CheckTempDirQuota returns an error if the temp dir grew beyond the quota it was created with
+func CheckTempDirQuota(fs v1.FS, dir string) error {
+	tempDirs.Lock()
+	quota := tempDirs.quotas[dir]
+	tempDirs.Unlock()
+	if quota == 0 {
+		return nil
+	}
+	size, err := DirSize(fs, dir)
+	if err != nil {
+		return err
+	}
+	if uint64(size) > quota {
+		return fmt.Errorf("temporary dir %s takes %d MiB, over its quota of %d MiB", dir, size>>20, quota>>20)
+	}
+	return nil
+}
+
+// CleanStaleTempDirs removes the temp dirs in the given bases whose owner process is gone, i.e. left behind by a crash.
+// The removed dirs are returned.
+func CleanStaleTempDirs(fs v1.FS, bases ...string) ([]string, error) {
+	var removed []string
+	var errs []error
+	for _, base := range bases {
+		entries, err := fs.ReadDir(base)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if !strings.HasPrefix(name, TempDirPrefix) || !strings.HasSuffix(name, TempDirOwnerSuffix) {
+				continue
+			}
+			marker := filepath.Join(base, name)
+			data, err := fs.ReadFile(marker)
+			if err != nil {
+				continue
+			}
+			if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && pidAlive(fs, pid) {
+				continue
+			}
+			dir := strings.TrimSuffix(marker, TempDirOwnerSuffix)
+			if err = errors.Join(fs.RemoveAll(dir), fs.RemoveAll(marker)); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			removed = append(removed, dir)
+		}
+	}
+	return removed, errors.Join(errs...)
+}
+
+func pidAlive(fs v1.FS, pid int) bool {
+	if pid == os.Getpid() {
+		return true
+	}
+	ok, _ := Exists(fs, filepath.Join("/proc", strconv.Itoa(pid)))
+	return ok
+}
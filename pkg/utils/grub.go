@@ -18,15 +18,19 @@ package utils
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
 	"github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
 	"github.com/kairos-io/kairos-sdk/utils"
 	"io/fs"
+	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
 	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
@@ -257,30 +261,36 @@ func (g Grub) Install(target, rootDir, bootDir, grubConf, tty string, efi bool,
 	return nil
 }
 
-// SetPersistentVariables sets the given vars into the given grubEnvFile for grub to read them
+// SetPersistentVariables sets the given vars into the given grubEnvFile for grub to read them. The vars already
+// in the file are kept, vars set to an empty value are removed. The file is locked while it is updated, so concurrent
+// writers in the agent do not lose each other changes, and replaced atomically, so readers like grub2-editenv never
+// see a partial block.
 func SetPersistentVariables(grubEnvFile string, vars map[string]string, fs v1.FS) error {
-	var b bytes.Buffer
-	b.WriteString("# GRUB Environment Block\n")
-
-	keys := make([]string, 0, len(vars))
-	for k := range vars {
-		keys = append(keys, k)
+	unlock, err := lockGrubEnv(grubEnvFile, fs)
+	if err != nil {
+		return err
 	}
-	sort.Strings(keys)
+	defer unlock()
 
-	for _, k := range keys {
-		if len(vars[k]) > 0 {
-			b.WriteString(fmt.Sprintf("%s=%s\n", k, vars[k]))
+	current, err := readGrubEnv(grubEnvFile, fs)
+	if errors.Is(err, os.ErrNotExist) {
+		current = map[string]string{}
+	} else if err != nil {
+		return err
+	}
+	for k, v := range vars {
+		if len(v) > 0 {
+			current[k] = v
+		} else {
+			delete(current, k)
 		}
 	}
 
-	// https://www.gnu.org/software/grub/manual/grub/html_node/Environment-block.html
-	// It has to be exactly 1024bytes, if its not it has to be filled with #
-	toBeFilled := 1024 - b.Len()%1024
-	for i := 0; i < toBeFilled; i++ {
-		b.WriteByte('#')
+	block, err := encodeGrubEnv(current)
+	if err != nil {
+		return fmt.Errorf("%s: %w", grubEnvFile, err)
 	}
-	return fs.WriteFile(grubEnvFile, b.Bytes(), cnst.FilePerm)
+	return fsutils.AtomicWriteFile(fs, grubEnvFile, block, cnst.FilePerm)
 }
 
 // copyGrubFonts will try to finds and copy the needed grub fonts into the system
@@ -398,22 +408,151 @@ func (g Grub) copyGrub() error {
 
 // ReadPersistentVariables will read a grub env file and parse the values
 func ReadPersistentVariables(grubEnvFile string, fs v1.FS) (map[string]string, error) {
-	vars := make(map[string]string)
-	f, err := fs.ReadFile(grubEnvFile)
+	return readGrubEnv(grubEnvFile, fs)
+}
+
+// grubEnvHeader and grubEnvBlockSize define the environment block format, as grub2-editenv writes it
+// https://www.gnu.org/software/grub/manual/grub/html_node/Environment-block.html
+const (
+	grubEnvHeader    = "# GRUB Environment Block\n"
+	grubEnvBlockSize = 1024
+)
+
+// grubEnvRetries is how many times a grub env file which is not a valid block is read again, as grub2-editenv
+// rewrites the file in place and it might be caught half written
+var grubEnvRetries = 3
+
+// grubEnvRetryInterval is the time between reads of a grub env file which is not a valid block
+var grubEnvRetryInterval = 100 * time.Millisecond
+
+// readGrubEnv reads and parses the grub env file, retrying if it is not a valid environment block. Files which are
+// still not a block after the retries, i.e. written by hand or by other tools, are parsed line by line.
+func readGrubEnv(grubEnvFile string, fs v1.FS) (map[string]string, error) {
+	var data []byte
+	var err error
+	for i := 0; i <= grubEnvRetries; i++ {
+		if i > 0 {
+			time.Sleep(grubEnvRetryInterval)
+		}
+		data, err = fs.ReadFile(grubEnvFile)
+		if err != nil {
+			return nil, err
+		}
+		// Empty files are the ones just created by lockGrubEnv
+		if len(data) == 0 || isGrubEnvBlock(data) {
+			break
+		}
+	}
+	return decodeGrubEnv(data), nil
+}
+
+// isGrubEnvBlock returns true if data has the header and the size of an environment block
+func isGrubEnvBlock(data []byte) bool {
+	return len(data) > 0 && len(data)%grubEnvBlockSize == 0 && bytes.HasPrefix(data, []byte(grubEnvHeader))
+}
+
+// decodeGrubEnv parses an environment block. As grub does, lines starting with # and lines without a = are skipped
+// and a backslash escapes the next character, so values can hold newlines.
+func decodeGrubEnv(data []byte) map[string]string {
+	vars := map[string]string{}
+	var line strings.Builder
+	escaped := false
+	parseLine := func() {
+		l := line.String()
+		line.Reset()
+		if strings.HasPrefix(l, "#") {
+			return
+		}
+		if k, v, found := strings.Cut(l, "="); found && k != "" {
+			vars[k] = v
+		}
+	}
+	// The header is a comment line, skipped like any other
+	for _, c := range data {
+		switch {
+		case escaped:
+			line.WriteByte(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '\n':
+			parseLine()
+		default:
+			line.WriteByte(c)
+		}
+	}
+	// The padding after the last var has no trailing newline
+	parseLine()
+	return vars
+}
+
+// encodeGrubEnv returns the environment block with the given vars, sorted by name. It fails if they don't fit
+// in a single block, grub2-editenv and the grub save_env command only handle blocks of that size.
+func encodeGrubEnv(vars map[string]string) ([]byte, error) {
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		if k == "" || strings.ContainsAny(k, "=\n\\#") {
+			return nil, fmt.Errorf("invalid grub environment variable name %q", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	b.WriteString(grubEnvHeader)
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte('=')
+		for _, c := range []byte(vars[k]) {
+			if c == '\\' || c == '\n' {
+				b.WriteByte('\\')
+			}
+			b.WriteByte(c)
+		}
+		b.WriteByte('\n')
+	}
+	if b.Len() > grubEnvBlockSize {
+		return nil, fmt.Errorf("grub environment variables take %d bytes, more than the %d bytes block", b.Len(), grubEnvBlockSize)
+	}
+	b.Write(bytes.Repeat([]byte{'#'}, grubEnvBlockSize-b.Len()))
+	return b.Bytes(), nil
+}
+
+// lockGrubEnv takes an exclusive lock on the grub env file for updating it, creating it if missing. As the file is
+// replaced on every update, the lock is taken again if the file was replaced while waiting for it. A file created
+// for locking it and left empty, i.e. as the update failed, is removed on unlock. grub2-editenv does not take the
+// lock, but as the file is replaced atomically it never sees a partial block.
+func lockGrubEnv(grubEnvFile string, fs v1.FS) (func(), error) {
+	raw, err := fs.RawPath(grubEnvFile)
 	if err != nil {
 		return nil, err
 	}
-	for _, a := range strings.Split(string(f), "\n") {
-		// comment or fillup, so skip
-		if strings.HasPrefix(a, "#") {
-			continue
+	for {
+		_, err = os.Stat(raw)
+		created := errors.Is(err, os.ErrNotExist)
+		f, err := os.OpenFile(raw, os.O_CREATE|os.O_RDWR, cnst.FilePerm)
+		if err != nil {
+			return nil, fmt.Errorf("locking %s: %w", grubEnvFile, err)
 		}
-		splitted := strings.Split(a, "=")
-		if len(splitted) == 2 {
-			vars[splitted[0]] = splitted[1]
-		} else {
-			return nil, fmt.Errorf("invalid format for %s", a)
+		if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("locking %s: %w", grubEnvFile, err)
+		}
+		locked, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("locking %s: %w", grubEnvFile, err)
+		}
+		if current, err := os.Stat(raw); err == nil && os.SameFile(locked, current) {
+			return func() {
+				if current, err := os.Stat(raw); created && err == nil && os.SameFile(locked, current) && current.Size() == 0 {
+					_ = os.Remove(raw)
+				}
+				_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+				_ = f.Close()
+			}, nil
 		}
+		// Replaced by the previous holder of the lock
+		_ = f.Close()
 	}
-	return vars, nil
 }
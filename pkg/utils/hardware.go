@@ -0,0 +1,277 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+)
+
+// PCIDevicesDir is where the host PCI devices are listed
+var PCIDevicesDir = "/sys/bus/pci/devices"
+
+// hardwareClasses maps the PCI base class of the devices the hardware report checks to their name
+var hardwareClasses = map[string]string{
+	"0x01": "storage",
+	"0x02": "network",
+	"0x03": "display",
+}
+
+// HardwareDevice is a host device checked by the hardware report
+type HardwareDevice struct {
+	Address string `json:"address" yaml:"address"`
+	Class   string `json:"class" yaml:"class"`
+	Vendor  string `json:"vendor" yaml:"vendor"`
+	Device  string `json:"device" yaml:"device"`
+	// Driver is the driver bound to the device in the host, if any
+	Driver string `json:"driver,omitempty" yaml:"driver,omitempty"`
+	// Modules are the modules of the target image that handle the device, builtin ones included
+	Modules []string `json:"modules" yaml:"modules"`
+}
+
+// HardwareReport cross-checks the host devices against the modules of a system tree
+type HardwareReport struct {
+	Devices []HardwareDevice `json:"devices" yaml:"devices"`
+}
+
+// Missing returns the devices without modules in the target image
+func (r HardwareReport) Missing() []HardwareDevice {
+	var missing []HardwareDevice
+	for _, d := range r.Devices {
+		if len(d.Modules) == 0 {
+			missing = append(missing, d)
+		}
+	}
+	return missing
+}
+
+// NewHardwareReport lists the host storage controllers, NICs and GPUs and looks up the modules handling them in the
+// modules.alias and modules.builtin.alias files of the kernels in the system tree at root
+func NewHardwareReport(fs v1.FS, root string) (*HardwareReport, error) {
+	aliases, err := readModuleAliases(fs, root)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fs.ReadDir(PCIDevicesDir)
+	if err != nil {
+		// No PCI bus, i.e. some ARM boards, nothing to check
+		return &HardwareReport{Devices: []HardwareDevice{}}, nil
+	}
+
+	report := &HardwareReport{Devices: []HardwareDevice{}}
+	for _, entry := range entries {
+		dir := filepath.Join(PCIDevicesDir, entry.Name())
+		class := readSysValue(fs, filepath.Join(dir, "class"))
+		if len(class) < 4 {
+			continue
+		}
+		className, ok := hardwareClasses[class[:4]]
+		if !ok {
+			continue
+		}
+		modalias := readSysValue(fs, filepath.Join(dir, "modalias"))
+		device := HardwareDevice{
+			Address: entry.Name(),
+			Class:   className,
+			Vendor:  readSysValue(fs, filepath.Join(dir, "vendor")),
+			Device:  readSysValue(fs, filepath.Join(dir, "device")),
+			Modules: []string{},
+		}
+		if driver, err := fs.Readlink(filepath.Join(dir, "driver")); err == nil {
+			device.Driver = filepath.Base(driver)
+		}
+		for _, a := range aliases {
+			if ok, _ := filepath.Match(a.pattern, modalias); ok && !contains(device.Modules, a.module) {
+				device.Modules = append(device.Modules, a.module)
+			}
+		}
+		sort.Strings(device.Modules)
+		report.Devices = append(report.Devices, device)
+	}
+	return report, nil
+}
+
+type moduleAlias struct {
+	pattern string
+	module  string
+}
+
+// readModuleAliases parses the module aliases of all the kernels in the system tree at root
+func readModuleAliases(fs v1.FS, root string) ([]moduleAlias, error) {
+	var files []string
+	for _, modulesDir := range []string{"lib/modules", "usr/lib/modules"} {
+		kernels, err := fs.ReadDir(filepath.Join(root, modulesDir))
+		if err != nil {
+			continue
+		}
+		for _, kernel := range kernels {
+			for _, name := range []string{"modules.alias", "modules.builtin.alias"} {
+				file := filepath.Join(root, modulesDir, kernel.Name(), name)
+				if ok, _ := fsutils.Exists(fs, file); ok {
+					files = append(files, file)
+				}
+			}
+		}
+	}
+
+	var aliases []moduleAlias
+	for _, file := range files {
+		data, err := fs.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 3 && fields[0] == "alias" && strings.HasPrefix(fields[1], "pci:") {
+				aliases = append(aliases, moduleAlias{pattern: fields[1], module: fields[2]})
+			}
+		}
+	}
+	return aliases, nil
+}
+
+func readSysValue(fs v1.FS, path string) string {
+	data, err := fs.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// PlatformDevicesDir is where the host platform devices are listed, the SoC GPUs and NPUs not on the PCI bus
+var PlatformDevicesDir = "/sys/bus/platform/devices"
+
+// acceleratorClasses are the PCI classes of the GPUs and accelerators: display controllers, processing accelerators
+// and co-processors
+var acceleratorClasses = []string{"0x03", "0x12", "0x0b40"}
+
+// acceleratorVendors maps the PCI vendor ids of the GPUs and accelerators to the vendors of the driver catalog. The
+// emulated GPUs of the hypervisors and the BMC ones are left out, they need no drivers.
+var acceleratorVendors = map[string]string{
+	"0x10de": "nvidia",
+	"0x8086": "intel",
+	"0x1002": "amd",
+}
+
+// platformAccelerators maps the device tree compatible prefixes of the SoC GPUs and NPUs to their vendor
+var platformAccelerators = []struct {
+	prefix string
+	vendor string
+}{
+	{"arm,mali", "arm"},
+	{"arm,ethos", "arm"},
+	{"nvidia,gk20a", "nvidia"},
+	{"nvidia,gm20b", "nvidia"},
+	{"nvidia,gp10b", "nvidia"},
+	{"nvidia,gv11b", "nvidia"},
+	{"nvidia,ga10b", "nvidia"},
+}
+
+// Accelerator is a GPU or accelerator of the host the driver bundles are offered for
+type Accelerator struct {
+	Address string `json:"address" yaml:"address"`
+	// Vendor is nvidia, intel, amd or arm
+	Vendor string `json:"vendor" yaml:"vendor"`
+	// Device is the PCI `vendor:device` id, i.e. 10de:2204, or the device tree compatible of the SoC devices
+	Device string `json:"device" yaml:"device"`
+	// Driver is the driver bound to the device in the host, if any
+	Driver string `json:"driver,omitempty" yaml:"driver,omitempty"`
+}
+
+func (a Accelerator) String() string {
+	return fmt.Sprintf("%s %s (%s)", a.Vendor, a.Device, a.Address)
+}
+
+// DetectAccelerators lists the GPUs and accelerators of the host from the known vendors, the PCI ones and the
+// ones of the SoC in the device tree
+func DetectAccelerators(fs v1.FS) []Accelerator {
+	accelerators := []Accelerator{}
+	entries, _ := fs.ReadDir(PCIDevicesDir)
+	for _, entry := range entries {
+		dir := filepath.Join(PCIDevicesDir, entry.Name())
+		class := readSysValue(fs, filepath.Join(dir, "class"))
+		vendor, ok := acceleratorVendors[readSysValue(fs, filepath.Join(dir, "vendor"))]
+		if !ok || !hasAnyPrefix(class, acceleratorClasses) {
+			continue
+		}
+		a := Accelerator{
+			Address: entry.Name(),
+			Vendor:  vendor,
+			Device: strings.TrimPrefix(readSysValue(fs, filepath.Join(dir, "vendor")), "0x") + ":" +
+				strings.TrimPrefix(readSysValue(fs, filepath.Join(dir, "device")), "0x"),
+		}
+		if driver, err := fs.Readlink(filepath.Join(dir, "driver")); err == nil {
+			a.Driver = filepath.Base(driver)
+		}
+		accelerators = append(accelerators, a)
+	}
+
+	entries, _ = fs.ReadDir(PlatformDevicesDir)
+	for _, entry := range entries {
+		dir := filepath.Join(PlatformDevicesDir, entry.Name())
+		// The compatibles are NUL separated, the SoC specific ones first, i.e. rockchip,rk3399-mali then arm,mali-t860
+		compatibles := strings.Split(readSysValue(fs, filepath.Join(dir, "of_node", "compatible")), "\x00")
+		vendor, compatible := platformAccelerator(compatibles)
+		if vendor == "" {
+			continue
+		}
+		a := Accelerator{Address: entry.Name(), Vendor: vendor, Device: compatible}
+		if driver, err := fs.Readlink(filepath.Join(dir, "driver")); err == nil {
+			a.Driver = filepath.Base(driver)
+		}
+		accelerators = append(accelerators, a)
+	}
+	return accelerators
+}
+
+// platformAccelerator returns the vendor and the compatible of the first known accelerator in the compatibles
+func platformAccelerator(compatibles []string) (string, string) {
+	for _, compatible := range compatibles {
+		for _, p := range platformAccelerators {
+			if strings.HasPrefix(compatible, p.prefix) {
+				return p.vendor, compatible
+			}
+		}
+	}
+	return "", ""
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,226 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/hashicorp/go-multierror"
+	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	agenthttp "github.com/kairos-io/kairos-agent/v2/pkg/http"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+)
+
+// ioClasses maps the IO scheduling classes to the ionice class numbers
+var ioClasses = map[string]string{
+	cnst.IOClassRealtime:   "1",
+	cnst.IOClassBestEffort: "2",
+	cnst.IOClassIdle:       "3",
+}
+
+// ApplyIOLimit limits the disk IO of the running process, and of the commands it runs, as set in limit.
+// The bandwidth limit applies to the disk holding device. It returns a function restoring the previous limits.
+func ApplyIOLimit(cfg *agentConfig.Config, limit v1.IOLimit, device string) (restore func() error, err error) {
+	cleanup := NewCleanStack()
+	restore = func() error { return cleanup.Cleanup(nil) }
+	defer func() {
+		if err != nil {
+			_ = restore()
+		}
+	}()
+
+	if limit.Class != "" {
+		err = setIOClass(cfg, limit.Class)
+		if err != nil {
+			return restore, err
+		}
+		// Threads inherit the class, so there is no previous one to restore other than the default
+		cleanup.Push(func() error { return setIOClass(cfg, "") })
+	}
+
+	if limit.Bandwidth > 0 {
+		var undo func() error
+		undo, err = setIOBandwidth(cfg, limit.Bandwidth, device)
+		if err != nil {
+			return restore, err
+		}
+		cleanup.Push(undo)
+	}
+	return restore, nil
+}
+
+// setIOClass sets the IO scheduling class of all the threads of the running process, an empty class
+// sets the default one
+func setIOClass(cfg *agentConfig.Config, class string) error {
+	classNum := "0"
+	if class != "" {
+		var ok bool
+		classNum, ok = ioClasses[class]
+		if !ok {
+			return fmt.Errorf("invalid IO class %s", class)
+		}
+	}
+	tasks, err := cfg.Fs.ReadDir(fmt.Sprintf("/proc/%d/task", os.Getpid()))
+	if err != nil {
+		return fmt.Errorf("listing process threads: %w", err)
+	}
+	var errs error
+	for _, t := range tasks {
+		out, err := cfg.Runner.Run("ionice", "-c", classNum, "-p", t.Name())
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("setting IO class of thread %s: %s: %w", t.Name(), strings.TrimSpace(string(out)), err))
+		}
+	}
+	return errs
+}
+
+// setIOBandwidth limits the read and write bandwidth of the running process on the disk holding device with a child
+// cgroup of its unit, so it stays accounted and stopped along with it. cgroup v2 only enables controllers for the
+// children of cgroups without processes, so the processes of the unit are moved into a sibling child cgroup first.
+// The memory controller is enabled along with io, buffered writes are only throttled with both.
+// It returns a function moving the processes back into the unit cgroup.
+func setIOBandwidth(cfg *agentConfig.Config, bandwidth uint, device string) (restore func() error, err error) {
+	data, err := cfg.Fs.ReadFile(fmt.Sprintf("/proc/%d/cgroup", os.Getpid()))
+	if err != nil {
+		return nil, err
+	}
+	original := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			original = strings.TrimPrefix(line, "0::")
+		}
+	}
+	if original == "" {
+		return nil, fmt.Errorf("could not find the current cgroup v2 of the process")
+	}
+	if original == "/" {
+		return nil, fmt.Errorf("the process runs in the root cgroup, not in a unit")
+	}
+	unitDir := filepath.Join(cnst.CgroupRoot, original)
+	controllers, err := cfg.Fs.ReadFile(filepath.Join(unitDir, "cgroup.controllers"))
+	if err != nil {
+		return nil, fmt.Errorf("cgroup v2 is not available: %w", err)
+	}
+	for _, controller := range []string{"io", "memory"} {
+		if !strings.Contains(" "+strings.TrimSpace(string(controllers))+" ", " "+controller+" ") {
+			return nil, fmt.Errorf("cgroup %s controller is not available in %s", controller, original)
+		}
+	}
+
+	disk := device
+	out, err := cfg.Runner.Run("lsblk", "-no", "PKNAME", device)
+	if err == nil && strings.TrimSpace(string(out)) != "" {
+		disk = filepath.Join("/dev", strings.Fields(string(out))[0])
+	}
+	out, err = cfg.Runner.Run("lsblk", "-dno", "MAJ:MIN", disk)
+	if err != nil {
+		return nil, fmt.Errorf("getting device numbers of %s: %s: %w", disk, strings.TrimSpace(string(out)), err)
+	}
+	devNum := strings.TrimSpace(string(out))
+
+	procsDir := filepath.Join(unitDir, cnst.UnitProcsCgroup)
+	limitDir := filepath.Join(unitDir, cnst.UpgradeCgroup)
+	cleanup := NewCleanStack()
+	restore = func() error { return cleanup.Cleanup(nil) }
+	defer func() {
+		if err != nil {
+			_ = restore()
+		}
+	}()
+
+	for _, dir := range []string{procsDir, limitDir} {
+		if err = fsutils.MkdirAll(cfg.Fs, dir, cnst.DirPerm); err != nil {
+			return restore, err
+		}
+		// RemoveAll starts with rmdir, all it takes to remove a cgroup without processes
+		cleanup.Push(func() error { return cfg.Fs.RemoveAll(dir) })
+	}
+	// Processes go back to the unit once the controllers are disabled again, so they are pushed before them
+	cleanup.Push(func() error {
+		return moveCgroupProcs(cfg, []string{limitDir, procsDir}, unitDir)
+	})
+	if err = moveCgroupProcs(cfg, []string{unitDir}, procsDir); err != nil {
+		return restore, fmt.Errorf("moving the processes of %s into a child cgroup: %w", original, err)
+	}
+	err = cfg.Fs.WriteFile(filepath.Join(unitDir, "cgroup.subtree_control"), []byte("+io +memory"), cnst.FilePerm)
+	if err != nil {
+		return restore, fmt.Errorf("enabling the io and memory controllers in %s: %w", original, err)
+	}
+	cleanup.Push(func() error {
+		return cfg.Fs.WriteFile(filepath.Join(unitDir, "cgroup.subtree_control"), []byte("-io -memory"), cnst.FilePerm)
+	})
+
+	bps := uint64(bandwidth) * 1024 * 1024
+	ioMax := fmt.Sprintf("%s rbps=%d wbps=%d", devNum, bps, bps)
+	if err = cfg.Fs.WriteFile(filepath.Join(limitDir, "io.max"), []byte(ioMax), cnst.FilePerm); err != nil {
+		return restore, fmt.Errorf("setting io.max: %w", err)
+	}
+	pid := []byte(strconv.Itoa(os.Getpid()))
+	if err = cfg.Fs.WriteFile(filepath.Join(limitDir, "cgroup.procs"), pid, cnst.FilePerm); err != nil {
+		return restore, fmt.Errorf("moving process into the %s cgroup: %w", cnst.UpgradeCgroup, err)
+	}
+	cfg.Logger.Infof("Limited IO bandwidth on %s to %dMiB/s", disk, bandwidth)
+	return restore, nil
+}
+
+// moveCgroupProcs moves all the processes of the from cgroups into the to cgroup
+func moveCgroupProcs(cfg *agentConfig.Config, from []string, to string) error {
+	var errs error
+	for _, dir := range from {
+		data, err := cfg.Fs.ReadFile(filepath.Join(dir, "cgroup.procs"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		for _, pid := range strings.Fields(string(data)) {
+			// Processes may exit meanwhile, these can't be moved anymore
+			err = cfg.Fs.WriteFile(filepath.Join(to, "cgroup.procs"), []byte(pid), cnst.FilePerm)
+			if err != nil && !errors.Is(err, syscall.ESRCH) {
+				errs = multierror.Append(errs, fmt.Errorf("moving process %s: %w", pid, err))
+			}
+		}
+	}
+	return errs
+}
+
+// LimitDownloadBandwidth caps the bandwidth of the image pulls and of the sources downloaded with GetSource to the
+// given KiB/s, so the downloads don't saturate an uplink shared with the running workloads. Zero means no limit.
+func LimitDownloadBandwidth(cfg *agentConfig.Config, kib uint) {
+	if kib == 0 {
+		return
+	}
+	bytesPerSecond := int64(kib) * 1024
+	if extractor, ok := cfg.ImageExtractor.(v1.OCIImageExtractor); ok {
+		extractor.Transport = agenthttp.NewThrottledTransport(extractor.Transport, bytesPerSecond)
+		cfg.ImageExtractor = extractor
+	}
+	if client, ok := cfg.Client.(*agenthttp.Client); ok {
+		client.SetMaxBandwidth(bytesPerSecond)
+	}
+	cfg.Logger.Infof("Downloads limited to %d KiB/s", kib)
+}
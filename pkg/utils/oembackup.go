@@ -0,0 +1,372 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	"golang.org/x/crypto/scrypt"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	oemBackupMetadataFile = ".kairos-oem-backup.yaml"
+	// oemBackupEncryptedMagic prefixes the encrypted backups, followed by the scrypt salt, the AES-GCM nonce
+	// and the sealed archive
+	oemBackupEncryptedMagic = "KAIROS-OEM-SCRYPT-AES256GCM\n"
+	oemBackupSaltSize       = 16
+	// scrypt cost parameters, as recommended for interactive logins
+	oemBackupScryptN = 1 << 15
+	oemBackupScryptR = 8
+	oemBackupScryptP = 1
+)
+
+// OEMBackupMetadata describes an OEM backup, it is stored as the first entry of the archive
+type OEMBackupMetadata struct {
+	Created  time.Time `yaml:"created"`
+	Hostname string    `yaml:"hostname,omitempty"`
+	Source   string    `yaml:"source"`
+	Files    int       `yaml:"files"`
+	Size     int64     `yaml:"size"`
+}
+
+// BackupOEM archives the contents of the src directory, usually the OEM partition mountpoint, into the dest
+// file as a gzipped tarball. If key is not empty the archive is encrypted with AES-256-GCM, using a key
+// derived from it with scrypt and a random salt stored in the backup header.
+func BackupOEM(cfg *config.Config, src, dest string, key []byte) (*OEMBackupMetadata, error) {
+	hostname, _ := os.Hostname()
+	meta := &OEMBackupMetadata{Created: time.Now().UTC(), Hostname: hostname, Source: src}
+
+	type entry struct {
+		path string
+		info fs.FileInfo
+	}
+	var entries []entry
+	err := fsutils.WalkDirFs(cfg.Fs, src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == src {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{path: path, info: info})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", src, err)
+	}
+
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gz)
+
+	// Files are counted beforehand so the metadata can go first and be read without going through the archive
+	for _, e := range entries {
+		if e.info.Mode().IsRegular() {
+			meta.Files++
+			meta.Size += e.info.Size()
+		}
+	}
+	metaData, err := yaml.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	err = tw.WriteHeader(&tar.Header{Name: oemBackupMetadataFile, Mode: 0600, Size: int64(len(metaData)), ModTime: meta.Created})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = tw.Write(metaData); err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		rel, err := filepath.Rel(src, e.path)
+		if err != nil {
+			return nil, err
+		}
+		link := ""
+		if e.info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = cfg.Fs.Readlink(e.path); err != nil {
+				return nil, err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(e.info, link)
+		if err != nil {
+			return nil, err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if e.info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if !e.info.Mode().IsRegular() {
+			continue
+		}
+		data, err := cfg.Fs.ReadFile(e.path)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = tw.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	if err = gz.Close(); err != nil {
+		return nil, err
+	}
+
+	data := archive.Bytes()
+	if len(key) > 0 {
+		if data, err = sealOEMBackup(data, key); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = fsutils.MkdirAll(cfg.Fs, filepath.Dir(dest), constants.DirPerm); err != nil {
+		return nil, err
+	}
+	if err = fsutils.AtomicWriteFile(cfg.Fs, dest, data, 0600); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// ReadOEMBackup reads the OEM backup file in memory, decrypting it with key if it is encrypted.
+// This allows restoring it once the partition holding the file has been reformatted.
+func ReadOEMBackup(cfg *config.Config, file string, key []byte) ([]byte, error) {
+	data, err := cfg.Fs.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, []byte(oemBackupEncryptedMagic)) {
+		return data, nil
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("OEM backup %s is encrypted, a key is required", file)
+	}
+	return openOEMBackup(data, key)
+}
+
+// RestoreOEM replaces the contents of the dest directory, usually the OEM partition mountpoint, with the
+// given backup archive as returned by ReadOEMBackup
+func RestoreOEM(cfg *config.Config, archive []byte, dest string) (*OEMBackupMetadata, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, fmt.Errorf("invalid OEM backup: %w", err)
+	}
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != oemBackupMetadataFile {
+		return nil, fmt.Errorf("invalid OEM backup: metadata not found")
+	}
+	meta := &OEMBackupMetadata{}
+	metaData, err := io.ReadAll(tr)
+	if err != nil {
+		return nil, err
+	}
+	if err = yaml.Unmarshal(metaData, meta); err != nil {
+		return nil, fmt.Errorf("invalid OEM backup metadata: %w", err)
+	}
+
+	// The whole archive is checked before touching dest, so a rejected backup keeps the current contents
+	entries, err := readOEMBackupEntries(tr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the contents are removed, dest is usually a mountpoint
+	current, err := cfg.Fs.ReadDir(dest)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, e := range current {
+		if err = cfg.Fs.RemoveAll(filepath.Join(dest, e.Name())); err != nil {
+			return nil, err
+		}
+	}
+	if err = fsutils.MkdirAll(cfg.Fs, dest, constants.DirPerm); err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		target := filepath.Join(dest, e.name)
+		mode := fs.FileMode(e.hdr.Mode).Perm()
+		switch e.hdr.Typeflag {
+		case tar.TypeDir:
+			if err = fsutils.MkdirAll(cfg.Fs, target, constants.DirPerm); err != nil {
+				return nil, err
+			}
+		case tar.TypeReg:
+			if err = fsutils.MkdirAll(cfg.Fs, filepath.Dir(target), constants.DirPerm); err != nil {
+				return nil, err
+			}
+			if err = cfg.Fs.WriteFile(target, e.data, mode); err != nil {
+				return nil, err
+			}
+		case tar.TypeSymlink:
+			raw, err := cfg.Fs.RawPath(target)
+			if err != nil {
+				return nil, err
+			}
+			if err = os.Symlink(e.hdr.Linkname, raw); err != nil {
+				return nil, err
+			}
+			continue
+		default:
+			cfg.Logger.Warnf("Skipping unsupported entry %s in the OEM backup", e.hdr.Name)
+			continue
+		}
+		if err = cfg.Fs.Chmod(target, mode); err != nil {
+			return nil, err
+		}
+		// Ownership is best effort, it requires privileges
+		if raw, err := cfg.Fs.RawPath(target); err == nil {
+			_ = os.Lchown(raw, e.hdr.Uid, e.hdr.Gid)
+		}
+	}
+	return meta, nil
+}
+
+// oemBackupEntry is an entry of an OEM backup archive, name is the cleaned path relative to the backup root
+type oemBackupEntry struct {
+	hdr  *tar.Header
+	name string
+	data []byte
+}
+
+// readOEMBackupEntries reads the remaining entries of the archive. It fails if any entry or link target is
+// outside of the backup root, or if an entry would be written through a link restored before.
+func readOEMBackupEntries(tr *tar.Reader) ([]oemBackupEntry, error) {
+	var entries []oemBackupEntry
+	links := map[string]bool{}
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid OEM backup: %w", err)
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if isOutsideRoot(name) {
+			return nil, fmt.Errorf("invalid OEM backup: entry %s is outside of the backup root", hdr.Name)
+		}
+		// Entries are never written through a symlink restored before, which could point anywhere
+		path := ""
+		for _, part := range strings.Split(name, string(filepath.Separator)) {
+			path = filepath.Join(path, part)
+			if links[path] {
+				return nil, fmt.Errorf("invalid OEM backup: entry %s: %s is a symlink", hdr.Name, path)
+			}
+		}
+
+		entry := oemBackupEntry{hdr: hdr, name: name}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			if entry.data, err = io.ReadAll(tr); err != nil {
+				return nil, err
+			}
+		case tar.TypeSymlink:
+			if filepath.IsAbs(hdr.Linkname) || isOutsideRoot(filepath.Join(filepath.Dir(name), filepath.FromSlash(hdr.Linkname))) {
+				return nil, fmt.Errorf("invalid OEM backup: link %s points outside of the backup root", hdr.Name)
+			}
+			links[name] = true
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// isOutsideRoot returns whether the relative path escapes the directory it is relative to
+func isOutsideRoot(name string) bool {
+	name = filepath.Clean(name)
+	return filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator))
+}
+
+func oemBackupCipher(key, salt []byte) (cipher.AEAD, error) {
+	k, err := scrypt.Key(key, salt, oemBackupScryptN, oemBackupScryptR, oemBackupScryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealOEMBackup(data, key []byte) ([]byte, error) {
+	salt := make([]byte, oemBackupSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	gcm, err := oemBackupCipher(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header := append([]byte(oemBackupEncryptedMagic), salt...)
+	out := append(append([]byte{}, header...), nonce...)
+	return gcm.Seal(out, nonce, data, header), nil
+}
+
+func openOEMBackup(data, key []byte) ([]byte, error) {
+	if len(data) < len(oemBackupEncryptedMagic)+oemBackupSaltSize {
+		return nil, fmt.Errorf("invalid encrypted OEM backup")
+	}
+	header := data[:len(oemBackupEncryptedMagic)+oemBackupSaltSize]
+	gcm, err := oemBackupCipher(key, header[len(oemBackupEncryptedMagic):])
+	if err != nil {
+		return nil, err
+	}
+	data = data[len(header):]
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("invalid encrypted OEM backup")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], header)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting OEM backup, wrong key?: %w", err)
+	}
+	return plain, nil
+}
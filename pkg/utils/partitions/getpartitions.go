@@ -238,5 +238,13 @@ func GetEfiPartition(logger *types.KairosLogger) (*types.Partition, error) {
 	if efiPartition == nil {
 		return efiPartition, fmt.Errorf("could not find EFI partition")
 	}
+	// When operating on a system mounted at an alternative root its paths are relative to it
+	if constants.HasRoot() && efiPartition.MountPoint != "" {
+		mountPoint, ok := constants.FromRoot(efiPartition.MountPoint)
+		if !ok {
+			return efiPartition, fmt.Errorf("EFI partition is mounted at %s, out of %s", efiPartition.MountPoint, constants.GetRoot())
+		}
+		efiPartition.MountPoint = mountPoint
+	}
 	return efiPartition, nil
 }
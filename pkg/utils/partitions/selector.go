@@ -0,0 +1,290 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package partitions
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kairos-io/kairos-sdk/ghw"
+	"github.com/kairos-io/kairos-sdk/types"
+)
+
+// Device classes a selector expression can require, or exclude with a `!` prefix
+const (
+	DeviceClassSSD       = "ssd"
+	DeviceClassHDD       = "hdd"
+	DeviceClassNVMe      = "nvme"
+	DeviceClassUSB       = "usb"
+	DeviceClassRemovable = "removable"
+)
+
+// Orders of the devices matching a selector expression, the first one is picked
+const (
+	DeviceOrderLargest  = "largest"
+	DeviceOrderSmallest = "smallest"
+)
+
+// ignoredDevices are the block devices never picked by a selector, as they cannot be installed to
+var ignoredDevices = []string{"loop", "ram", "zram", "sr", "fd", "dm-", "md", "nbd"}
+
+var sizeTerm = regexp.MustCompile(`^(>=|<=|>|<|=)(\d+(?:\.\d+)?)\s*([KMGT]i?B?)?$`)
+
+// SelectedDevice is a block device as seen by the device selector
+type SelectedDevice struct {
+	Name      string
+	SizeBytes uint64
+	Model     string
+	Serial    string
+	Bus       string
+	// Rotational is true for spinning disks
+	Rotational bool
+	Removable  bool
+	// Labels are the filesystem labels of the device partitions
+	Labels []string
+}
+
+// HasClass returns whether the device belongs to the given class
+func (d SelectedDevice) HasClass(class string) bool {
+	switch class {
+	case DeviceClassSSD:
+		return !d.Rotational
+	case DeviceClassHDD:
+		return d.Rotational
+	case DeviceClassNVMe:
+		return strings.HasPrefix(d.Name, "nvme")
+	case DeviceClassUSB:
+		return d.Bus == "usb"
+	case DeviceClassRemovable:
+		return d.Removable
+	}
+	return false
+}
+
+// deviceFilter matches a device against a single selector term
+type deviceFilter func(d SelectedDevice) bool
+
+// SelectDevice picks the install target from a selector expression, a comma separated list of terms all of which
+// the device has to match:
+//   - an order, `largest` (default) or `smallest`, optionally joined to a class, e.g. `smallest-ssd`
+//   - a class, `ssd`, `hdd`, `nvme`, `usb` or `removable`, negated with a `!` prefix, e.g. `!usb`
+//   - a size comparison, e.g. `>=64GiB` or `<2TB`. Sizes without unit are in MiB
+//   - a `serial=`, `model=`, `name=` or `label=` matcher, shell patterns are allowed, e.g. `model=Samsung*`.
+//     `label` matches the filesystem label of any partition in the device
+//
+// `auto` is the same as `largest`. The /dev path of the first device in order is returned.
+func SelectDevice(paths *ghw.Paths, expression string, logger *types.KairosLogger) (string, error) {
+	order, filters, err := parseSelector(expression)
+	if err != nil {
+		return "", err
+	}
+
+	var matches []SelectedDevice
+	for _, d := range ListDevices(paths, logger) {
+		matched := true
+		for _, f := range filters {
+			if !f(d) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			matches = append(matches, d)
+		}
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no device matches the selector %q", expression)
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if order == DeviceOrderSmallest {
+			return matches[i].SizeBytes < matches[j].SizeBytes
+		}
+		return matches[i].SizeBytes > matches[j].SizeBytes
+	})
+	return filepath.Join("/dev", matches[0].Name), nil
+}
+
+// ListDevices returns the block devices the selector considers, leaving out virtual and optical ones
+func ListDevices(paths *ghw.Paths, logger *types.KairosLogger) []SelectedDevice {
+	if logger == nil {
+		l := types.NewKairosLogger("ghw", "info", false)
+		logger = &l
+	}
+	var devices []SelectedDevice
+	for _, disk := range ghw.GetDisks(paths, logger) {
+		ignored := false
+		for _, prefix := range ignoredDevices {
+			if strings.HasPrefix(disk.Name, prefix) {
+				ignored = true
+				break
+			}
+		}
+		if ignored || disk.SizeBytes == 0 {
+			continue
+		}
+
+		sysDir := filepath.Join(paths.SysBlock, disk.Name)
+		d := SelectedDevice{
+			Name:       disk.Name,
+			SizeBytes:  disk.SizeBytes,
+			Model:      readSysAttr(filepath.Join(sysDir, "device", "model")),
+			Serial:     readSysAttr(filepath.Join(sysDir, "device", "serial")),
+			Rotational: readSysAttr(filepath.Join(sysDir, "queue", "rotational")) == "1",
+			Removable:  readSysAttr(filepath.Join(sysDir, "removable")) == "1",
+		}
+		if udev, err := ghw.UdevInfo(paths, readSysAttr(filepath.Join(sysDir, "dev")), logger); err == nil {
+			d.Bus = udev["ID_BUS"]
+			if d.Serial == "" {
+				d.Serial = udev["ID_SERIAL_SHORT"]
+			}
+			if d.Model == "" {
+				d.Model = udev["ID_MODEL"]
+			}
+		}
+		for _, p := range disk.Partitions {
+			if p.FilesystemLabel != "" {
+				d.Labels = append(d.Labels, p.FilesystemLabel)
+			}
+		}
+		devices = append(devices, d)
+	}
+	return devices
+}
+
+// parseSelector turns a selector expression into the device order and the filters of its terms
+func parseSelector(expression string) (string, []deviceFilter, error) {
+	order := DeviceOrderLargest
+	var filters []deviceFilter
+	for _, term := range strings.Split(expression, ",") {
+		term = strings.TrimSpace(term)
+		switch {
+		case term == "" || term == "auto":
+		case term == DeviceOrderLargest || term == DeviceOrderSmallest:
+			order = term
+		case strings.HasPrefix(term, DeviceOrderLargest+"-") || strings.HasPrefix(term, DeviceOrderSmallest+"-"):
+			prefix, class, _ := strings.Cut(term, "-")
+			f, err := classFilter(class)
+			if err != nil {
+				return "", nil, err
+			}
+			order = prefix
+			filters = append(filters, f)
+		case sizeTerm.MatchString(term):
+			f, err := sizeFilter(term)
+			if err != nil {
+				return "", nil, err
+			}
+			filters = append(filters, f)
+		case strings.Contains(term, "="):
+			f, err := matchFilter(term)
+			if err != nil {
+				return "", nil, err
+			}
+			filters = append(filters, f)
+		default:
+			f, err := classFilter(term)
+			if err != nil {
+				return "", nil, err
+			}
+			filters = append(filters, f)
+		}
+	}
+	return order, filters, nil
+}
+
+func classFilter(term string) (deviceFilter, error) {
+	class := strings.TrimPrefix(term, "!")
+	switch class {
+	case DeviceClassSSD, DeviceClassHDD, DeviceClassNVMe, DeviceClassUSB, DeviceClassRemovable:
+	default:
+		return nil, fmt.Errorf("unknown device selector term %q", term)
+	}
+	negated := strings.HasPrefix(term, "!")
+	return func(d SelectedDevice) bool { return d.HasClass(class) != negated }, nil
+}
+
+func sizeFilter(term string) (deviceFilter, error) {
+	m := sizeTerm.FindStringSubmatch(term)
+	value, err := strconv.ParseFloat(m[2], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid size in device selector term %q: %w", term, err)
+	}
+	unit := strings.TrimSuffix(m[3], "B")
+	multiplier := map[string]float64{
+		"": 1 << 20, "K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40,
+		"Ki": 1 << 10, "Mi": 1 << 20, "Gi": 1 << 30, "Ti": 1 << 40,
+	}[unit]
+	// Units like GB are decimal, as disks are sold
+	if m[3] != "" && strings.HasSuffix(m[3], "B") && !strings.Contains(m[3], "i") {
+		multiplier = map[string]float64{"K": 1e3, "M": 1e6, "G": 1e9, "T": 1e12}[unit]
+	}
+	size := uint64(value * multiplier)
+	return func(d SelectedDevice) bool {
+		switch m[1] {
+		case ">=":
+			return d.SizeBytes >= size
+		case "<=":
+			return d.SizeBytes <= size
+		case ">":
+			return d.SizeBytes > size
+		case "<":
+			return d.SizeBytes < size
+		default:
+			return d.SizeBytes == size
+		}
+	}, nil
+}
+
+func matchFilter(term string) (deviceFilter, error) {
+	key, pattern, _ := strings.Cut(term, "=")
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern in device selector term %q: %w", term, err)
+	}
+	match := func(values ...string) bool {
+		for _, v := range values {
+			if ok, _ := filepath.Match(pattern, v); ok {
+				return true
+			}
+		}
+		return false
+	}
+	switch key {
+	case "serial":
+		return func(d SelectedDevice) bool { return match(d.Serial) }, nil
+	case "model":
+		return func(d SelectedDevice) bool { return match(d.Model) }, nil
+	case "name":
+		return func(d SelectedDevice) bool { return match(d.Name, filepath.Join("/dev", d.Name)) }, nil
+	case "label":
+		return func(d SelectedDevice) bool { return match(d.Labels...) }, nil
+	}
+	return nil, fmt.Errorf("unknown device selector matcher %q, expected serial, model, name or label", key)
+}
+
+func readSysAttr(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
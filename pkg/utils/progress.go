@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"github.com/kairos-io/kairos-agent/v2/pkg/config"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// Progress phases shared by all the actions
+const (
+	ProgressStart  = "start"
+	ProgressDone   = "done"
+	ProgressFailed = "failed"
+)
+
+// Progress reports the phases of an action to the config progress reporter, i.e. the --json-progress stream.
+// Each phase is reported with the percent of the action done when it starts.
+type Progress struct {
+	reporter v1.ProgressReporter
+	action   string
+	phase    string
+	percent  int
+}
+
+// NewProgress returns the progress of the given action and reports its start
+func NewProgress(cfg *config.Config, action string) *Progress {
+	p := &Progress{reporter: cfg.Progress, action: action}
+	if p.reporter == nil {
+		p.reporter = v1.NullProgress{}
+	}
+	p.Phase(ProgressStart, 0, "")
+	return p
+}
+
+// Phase reports the action entered the given phase
+func (p *Progress) Phase(phase string, percent int, message string) {
+	p.phase = phase
+	p.percent = percent
+	p.reporter.Report(v1.ProgressRecord{Action: p.action, Phase: phase, Percent: percent, Message: message})
+}
+
+// Done reports the action finished, or failed with the given error. The failure is reported with the phase and
+// percent it failed at.
+func (p *Progress) Done(err error) {
+	if err != nil {
+		p.reporter.Report(v1.ProgressRecord{Action: p.action, Phase: ProgressFailed, Percent: p.percent, Message: p.phase, Error: err.Error()})
+		return
+	}
+	p.Phase(ProgressDone, 100, "")
+}
@@ -0,0 +1,156 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"syscall"
+
+	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
+	cnst "github.com/kairos-io/kairos-agent/v2/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+)
+
+// tmpfsMagic is the statfs type of tmpfs, whose files take up memory
+const tmpfsMagic = 0x01021994
+
+// ApplyResourceGuard checks the available memory and the free space of the temporary dir against the guard
+// thresholds. When they are short the work dirs move to persistentTmp, if set, and when memory is short the
+// process runs with a single thread, collects garbage more often, mksquashfs uses one processor and the images
+// are streamed one layer at a time. It returns a function restoring the previous settings.
+func ApplyResourceGuard(cfg *agentConfig.Config, guard v1.ResourceGuard, persistentTmp string) (restore func() error, err error) {
+	cleanup := NewCleanStack()
+	restore = func() error { return cleanup.Cleanup(nil) }
+	if guard.Disable {
+		return restore, nil
+	}
+	minMemory := uint64(guard.MinMemory)
+	if minMemory == 0 {
+		minMemory = cnst.LowMemoryThreshold
+	}
+	minTmp := uint64(guard.MinTmp)
+	if minTmp == 0 {
+		minTmp = cnst.LowTmpThreshold
+	}
+
+	memory, err := availableMemory(cfg.Fs)
+	if err != nil {
+		return restore, fmt.Errorf("reading the available memory: %w", err)
+	}
+	lowMemory := memory < minMemory
+	lowTmp := false
+	tmpDir := os.TempDir()
+	if free, tmpfs, err := freeSpace(cfg.Fs, tmpDir); err != nil {
+		cfg.Logger.Debugf("Could not check the free space of %s: %s", tmpDir, err)
+	} else {
+		// A tmpfs takes up the memory which is already short
+		lowTmp = free < minTmp || (lowMemory && tmpfs)
+	}
+
+	if lowTmp {
+		if persistentTmp == "" {
+			cfg.Logger.Warnf("Temporary dir %s is short of space and there is no persistent partition to use instead", tmpDir)
+		} else {
+			err = fsutils.MkdirAll(cfg.Fs, persistentTmp, cnst.DirPerm)
+			if err != nil {
+				return restore, err
+			}
+			previous, set := os.LookupEnv("TMPDIR")
+			if err = os.Setenv("TMPDIR", persistentTmp); err != nil {
+				return restore, err
+			}
+			cleanup.Push(func() error {
+				if set {
+					return os.Setenv("TMPDIR", previous)
+				}
+				return os.Unsetenv("TMPDIR")
+			})
+			cfg.Logger.Infof("Using %s as temporary dir, %s is short of space", persistentTmp, tmpDir)
+		}
+	}
+
+	if !lowMemory {
+		return restore, nil
+	}
+	cfg.Logger.Infof("Only %dMiB of memory available, upgrading in low memory mode", memory)
+	procs := runtime.GOMAXPROCS(1)
+	cleanup.Push(func() error { runtime.GOMAXPROCS(procs); return nil })
+	gcPercent := debug.SetGCPercent(cnst.LowMemoryGCPercent)
+	cleanup.Push(func() error { debug.SetGCPercent(gcPercent); return nil })
+
+	squashfs := cfg.Squashfs
+	lowSquashfs := agentConfig.Squashfs{}
+	if squashfs != nil {
+		lowSquashfs = *squashfs
+	}
+	if lowSquashfs.Processors == 0 {
+		lowSquashfs.Processors = 1
+	}
+	cfg.Squashfs = &lowSquashfs
+	cleanup.Push(func() error { cfg.Squashfs = squashfs; return nil })
+
+	if extractor, ok := cfg.ImageExtractor.(v1.OCIImageExtractor); ok {
+		streaming := extractor
+		streaming.Stream = true
+		streaming.Workers = 1
+		cfg.ImageExtractor = streaming
+		cleanup.Push(func() error { cfg.ImageExtractor = extractor; return nil })
+	}
+	return restore, nil
+}
+
+// availableMemory returns the memory available for starting new applications in MiB, as the kernel estimates it
+func availableMemory(fs v1.FS) (uint64, error) {
+	data, err := fs.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parsing MemAvailable: %w", err)
+		}
+		return kb / 1024, nil
+	}
+	return 0, fmt.Errorf("no MemAvailable in /proc/meminfo")
+}
+
+// freeSpace returns the space available in dir in MiB and whether it's on a tmpfs
+func freeSpace(fs v1.FS, dir string) (uint64, bool, error) {
+	raw, err := fs.RawPath(dir)
+	if err != nil {
+		return 0, false, err
+	}
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(raw, &st); err != nil {
+		return 0, false, err
+	}
+	return st.Bavail * uint64(st.Bsize) / (1024 * 1024), st.Type == tmpfsMagic, nil
+}
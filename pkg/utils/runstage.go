@@ -18,6 +18,7 @@ package utils
 
 import (
 	"fmt"
+	"github.com/kairos-io/kairos-agent/v2/pkg/cloudinit"
 	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
 	"github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
 	"strings"
@@ -57,17 +58,31 @@ func checkYAMLError(cfg *agentConfig.Config, allErrors, err error) error {
 	return allErrors
 }
 
+// auditor is implemented by the cloud init runners which can report the changes they applied
+type auditor interface {
+	StartAudit()
+	StopAudit() *cloudinit.Audit
+}
+
 // RunstageAnalyze
 func RunStageAnalyze(cfg *agentConfig.Config, stage string) error {
-	return runstage(cfg, stage, true)
+	_, err := runstage(cfg, stage, true)
+	return err
 }
 
 // RunStage will run yip
 func RunStage(cfg *agentConfig.Config, stage string) error {
+	_, err := runstage(cfg, stage, false)
+	return err
+}
+
+// RunStageAudit runs yip like RunStage and returns the changes the stage applied to the node.
+// The audit is nil if the cloud init runner can't report its changes.
+func RunStageAudit(cfg *agentConfig.Config, stage string) (*cloudinit.Audit, error) {
 	return runstage(cfg, stage, false)
 }
 
-func runstage(cfg *agentConfig.Config, stage string, analyze bool) error {
+func runstage(cfg *agentConfig.Config, stage string, analyze bool) (audit *cloudinit.Audit, err error) {
 	var cmdLineYipURI string
 	var allErrors error
 	var cloudInitPaths []string
@@ -86,6 +101,31 @@ func runstage(cfg *agentConfig.Config, stage string, analyze bool) error {
 		}
 	}
 
+	// With config signing enforced only the signed configs of the writable dirs are run
+	if cfg.SealedConfig() {
+		var sealedPaths []string
+		for _, cp := range cloudInitPaths {
+			if !agentConfig.IsSealedConfigDir(cp) {
+				sealedPaths = append(sealedPaths, cp)
+				continue
+			}
+			files, err := cfg.SealedConfigFiles(cp)
+			if err != nil {
+				allErrors = multierror.Append(allErrors, err)
+			}
+			sealedPaths = append(sealedPaths, files...)
+		}
+		cloudInitPaths = sealedPaths
+	}
+
+	if a, ok := cfg.CloudInitRunner.(auditor); ok && !analyze {
+		a.StartAudit()
+		defer func() {
+			audit = a.StopAudit()
+			logAudit(cfg, stage, audit)
+		}()
+	}
+
 	stageBefore := fmt.Sprintf("%s.before", stage)
 	stageAfter := fmt.Sprintf("%s.after", stage)
 
@@ -156,8 +196,29 @@ func runstage(cfg *agentConfig.Config, stage string, analyze bool) error {
 	if allErrors != nil && !cfg.Strict {
 		cfg.Logger.Info("Some errors found but were ignored. Enable --strict mode to fail on those or --debug to see them in the log")
 		cfg.Logger.Warn(allErrors)
-		return nil
+		return nil, nil
 	}
 
-	return allErrors
+	return nil, allErrors
+}
+
+// logAudit summarizes the changes applied by the stage
+func logAudit(cfg *agentConfig.Config, stage string, audit *cloudinit.Audit) {
+	if audit == nil || audit.Empty() {
+		return
+	}
+	cfg.Logger.Infof("Stage %s: %d files created, %d modified, %d removed, %d service changes",
+		stage, len(audit.Created), len(audit.Modified), len(audit.Removed), len(audit.Services))
+	for _, f := range audit.Created {
+		cfg.Logger.Debugf("Stage %s created %s", stage, f)
+	}
+	for _, f := range audit.Modified {
+		cfg.Logger.Debugf("Stage %s modified %s", stage, f)
+	}
+	for _, f := range audit.Removed {
+		cfg.Logger.Debugf("Stage %s removed %s", stage, f)
+	}
+	for _, s := range audit.Services {
+		cfg.Logger.Debugf("Stage %s: %s %s", stage, s.Action, s.Service)
+	}
 }
@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	fsutils "github.com/kairos-io/kairos-agent/v2/pkg/utils/fs"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// SysextMetadataFile is kept in each extra.d directory and records where its sysexts come from
+	SysextMetadataFile = ".kairos-sysext.yaml"
+	SysextSuffix       = ".sysext.raw"
+)
+
+// SysextOrigin is the metadata recorded for an installed sysext
+type SysextOrigin struct {
+	Source    string    `yaml:"source" json:"source"`
+	Digest    string    `yaml:"digest" json:"digest"`
+	Installed time.Time `yaml:"installed" json:"installed"`
+	// Requires lists the sysexts, by name, that must be enabled on the same boot entry
+	Requires []string `yaml:"requires,omitempty" json:"requires,omitempty"`
+	// Conflicts lists the sysexts, by name, that cannot be enabled on the same boot entry
+	Conflicts []string `yaml:"conflicts,omitempty" json:"conflicts,omitempty"`
+}
+
+// SysextDir returns the directory holding the sysexts of the given boot entry under the EFI mountpoint
+func SysextDir(efiDir, bootState string) string {
+	return filepath.Join(efiDir, "EFI/kairos", bootState+".efi.extra.d")
+}
+
+// RecordSysext records the source and digest of the sysext file name, already copied in dir
+func RecordSysext(fs v1.FS, dir, name, source string) error {
+	return RecordSysextOrigin(fs, dir, name, SysextOrigin{Source: source})
+}
+
+// RecordSysextOrigin records the origin of the sysext file name, already copied in dir.
+// The digest and install date are set from the file.
+func RecordSysextOrigin(fs v1.FS, dir, name string, origin SysextOrigin) error {
+	digest, err := SysextDigest(fs, filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	origins, err := ReadSysextMetadata(fs, dir)
+	if err != nil {
+		return err
+	}
+	origin.Digest = digest
+	origin.Installed = time.Now().UTC()
+	origins[name] = origin
+	return WriteSysextMetadata(fs, dir, origins)
+}
+
+// WriteSysextMetadata replaces the recorded origin of the sysexts in dir
+func WriteSysextMetadata(fs v1.FS, dir string, origins map[string]SysextOrigin) error {
+	data, err := yaml.Marshal(origins)
+	if err != nil {
+		return err
+	}
+	return fsutils.AtomicWriteFile(fs, filepath.Join(dir, SysextMetadataFile), data, 0644)
+}
+
+// CheckSysextDependencies validates the requires and conflicts declared by a set of sysexts enabled together,
+// given by name. It reports all the broken declarations at once.
+func CheckSysextDependencies(set map[string]SysextOrigin) error {
+	names := make([]string, 0, len(set))
+	for n := range set {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var problems []string
+	for _, n := range names {
+		for _, r := range set[n].Requires {
+			if _, ok := set[r]; !ok {
+				problems = append(problems, fmt.Sprintf("%s requires %s", n, r))
+			}
+		}
+		for _, c := range set[n].Conflicts {
+			if _, ok := set[c]; ok {
+				problems = append(problems, fmt.Sprintf("%s conflicts with %s", n, c))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("broken sysext dependencies: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// ReadSysextMetadata returns the recorded origin of the sysexts in dir, by file name
+func ReadSysextMetadata(fs v1.FS, dir string) (map[string]SysextOrigin, error) {
+	origins := map[string]SysextOrigin{}
+	data, err := fs.ReadFile(filepath.Join(dir, SysextMetadataFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return origins, nil
+		}
+		return nil, err
+	}
+	if err = yaml.Unmarshal(data, &origins); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", SysextMetadataFile, err)
+	}
+	return origins, nil
+}
+
+// SysextDigest returns the sha256 digest of the sysext file
+func SysextDigest(fs v1.FS, path string) (string, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -17,15 +17,24 @@ limitations under the License.
 package utils_test
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	agentConfig "github.com/kairos-io/kairos-agent/v2/pkg/config"
 	"github.com/kairos-io/kairos-agent/v2/pkg/constants"
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
@@ -51,6 +60,24 @@ func getNamesFromListFiles(list []fs.DirEntry) []string {
 	return names
 }
 
+// parallelWalkPaths walks root with WalkDirFsParallel, returning the paths visited sorted. The result of fn is
+// returned to the walk for each path.
+func parallelWalkPaths(vfs v1.FS, root string, workers int, fn func(path string) error) ([]string, error) {
+	var mu sync.Mutex
+	var paths []string
+	err := fsutils.WalkDirFsParallel(vfs, root, workers, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		paths = append(paths, path)
+		mu.Unlock()
+		return fn(path)
+	})
+	sort.Strings(paths)
+	return paths, err
+}
+
 var _ = Describe("Utils", Label("utils"), func() {
 	var config *agentConfig.Config
 	var runner *v1mock.FakeRunner
@@ -270,6 +297,122 @@ var _ = Describe("Utils", Label("utils"), func() {
 			_, err := utils.CosignVerify(vfs.NewReadOnlyFS(fs), runner, "some/image:latest", "")
 			Expect(err).NotTo(BeNil())
 		})
+		It("runs a keyless verification with identity constraints offline", func() {
+			_, err := utils.CosignVerifyWithOptions(fs, runner, "some/image:latest", utils.CosignOptions{
+				CertificateIdentityRegexp:   "^https://github.com/kairos-io/",
+				CertificateOIDCIssuerRegexp: "token.actions.githubusercontent.com",
+				Offline:                     true,
+				TrustedRoot:                 "/etc/kairos/trusted_root.json",
+			})
+			Expect(err).To(BeNil())
+			Expect(runner.CmdsMatch([][]string{{
+				"cosign", "--certificate-identity-regexp", "^https://github.com/kairos-io/",
+				"--certificate-oidc-issuer-regexp", "token.actions.githubusercontent.com",
+				"--offline", "--trusted-root", "/etc/kairos/trusted_root.json", "some/image:latest",
+			}})).To(BeNil())
+		})
+		It("caches the verification of images referenced by digest", func() {
+			opts := utils.CosignOptions{PublicKey: "https://mykey.pub", CacheDir: "/cosign-cache"}
+			image := "some/image@sha256:3c1ab2ba0d4b8b21ff08b9e1f4d4dd5b4b3e9c7a8b8f0b6b1c7ebd3b7e36b9a1"
+			_, err := utils.CosignVerifyWithOptions(fs, runner, image, opts)
+			Expect(err).To(BeNil())
+			_, err = utils.CosignVerifyWithOptions(fs, runner, image, opts)
+			Expect(err).To(BeNil())
+			Expect(runner.CmdsMatch([][]string{{"cosign", "-key", "https://mykey.pub", image}})).To(BeNil())
+
+			// A different key is not covered by the cached result
+			opts.PublicKey = "https://otherkey.pub"
+			_, err = utils.CosignVerifyWithOptions(fs, runner, image, opts)
+			Expect(err).To(BeNil())
+			Expect(runner.IncludesCmds([][]string{{"cosign", "-key", "https://otherkey.pub", image}})).To(BeNil())
+		})
+		It("does not cache failed verifications nor images referenced by tag", func() {
+			opts := utils.CosignOptions{CacheDir: "/cosign-cache"}
+			image := "some/image@sha256:3c1ab2ba0d4b8b21ff08b9e1f4d4dd5b4b3e9c7a8b8f0b6b1c7ebd3b7e36b9a1"
+			runner.ReturnError = errors.New("no matching signatures")
+			_, err := utils.CosignVerifyWithOptions(fs, runner, image, opts)
+			Expect(err).NotTo(BeNil())
+			runner.ReturnError = nil
+			_, err = utils.CosignVerifyWithOptions(fs, runner, image, opts)
+			Expect(err).To(BeNil())
+			_, err = utils.CosignVerifyWithOptions(fs, runner, "some/image:latest", opts)
+			Expect(err).To(BeNil())
+			_, err = utils.CosignVerifyWithOptions(fs, runner, "some/image:latest", opts)
+			Expect(err).To(BeNil())
+			Expect(runner.CmdsMatch([][]string{
+				{"cosign", image}, {"cosign", image},
+				{"cosign", "some/image:latest"}, {"cosign", "some/image:latest"},
+			})).To(BeNil())
+		})
+	})
+	Describe("Deadline", Label("deadline", "timeout"), func() {
+		It("returns the result of phases finishing in time", func() {
+			d := utils.NewDeadline(time.Minute)
+			Expect(d.Run("fast", time.Second, func(context.Context) error { return nil })).To(Succeed())
+			Expect(d.Run("failing", 0, func(context.Context) error { return errors.New("failed") })).To(MatchError("failed"))
+			Expect(utils.NewDeadline(0).Run("unbounded", 0, func(context.Context) error { return nil })).To(Succeed())
+		})
+		It("fails phases exceeding their timeout once they are stopped", func() {
+			stopped := false
+			err := utils.NewDeadline(time.Minute).Run("slow", 10*time.Millisecond, func(ctx context.Context) error {
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Minute):
+				}
+				time.Sleep(10 * time.Millisecond)
+				stopped = true
+				return ctx.Err()
+			})
+			var timeoutErr *utils.TimeoutError
+			Expect(errors.As(err, &timeoutErr)).To(BeTrue())
+			Expect(timeoutErr.Phase).To(Equal("slow"))
+			Expect(timeoutErr.Total).To(BeFalse())
+			// The phase is done by the time its timeout is returned, nothing is left running
+			Expect(stopped).To(BeTrue())
+			Expect(timeoutErr.Running).To(BeFalse())
+		})
+		It("does not block on phases ignoring their context", func() {
+			release := make(chan struct{})
+			defer close(release)
+			start := time.Now()
+			err := utils.NewDeadline(10*time.Millisecond).WithStopGrace(10*time.Millisecond).Run("hook", 0, func(context.Context) error {
+				<-release
+				return nil
+			})
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+			var timeoutErr *utils.TimeoutError
+			Expect(errors.As(err, &timeoutErr)).To(BeTrue())
+			Expect(timeoutErr.Total).To(BeTrue())
+			Expect(timeoutErr.Running).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("left running"))
+		})
+		It("bounds the phases with the overall deadline", func() {
+			d := utils.NewDeadline(10 * time.Millisecond)
+			err := d.Run("slow", time.Minute, func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			})
+			var timeoutErr *utils.TimeoutError
+			Expect(errors.As(err, &timeoutErr)).To(BeTrue())
+			Expect(timeoutErr.Total).To(BeTrue())
+
+			// Once expired no other phase runs
+			ran := false
+			err = d.Run("next", 0, func(context.Context) error {
+				ran = true
+				return nil
+			})
+			Expect(errors.As(err, &timeoutErr)).To(BeTrue())
+			Expect(ran).To(BeFalse())
+		})
+		It("stops the phases along with its context", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			err := utils.NewDeadline(0).WithContext(ctx).Run("canceled", 0, func(ctx context.Context) error {
+				return ctx.Err()
+			})
+			Expect(err).To(MatchError(context.Canceled))
+		})
 	})
 	Describe("Reboot and shutdown", Label("reboot", "shutdown"), func() {
 		It("reboots", func() {
@@ -287,6 +430,59 @@ var _ = Describe("Utils", Label("utils"), func() {
 			Expect(duration.Seconds() >= 3).To(BeTrue())
 		})
 	})
+	Describe("WalkDirFsParallel", Label("WalkDirFsParallel"), func() {
+		BeforeEach(func() {
+			for _, dir := range []string{"/tree/a/b", "/tree/a/c", "/tree/d"} {
+				Expect(fsutils.MkdirAll(fs, dir, constants.DirPerm)).To(Succeed())
+			}
+			for _, file := range []string{"/tree/file", "/tree/a/b/file1", "/tree/a/b/file2", "/tree/a/c/file", "/tree/d/file"} {
+				Expect(fs.WriteFile(file, []byte(file), constants.FilePerm)).To(Succeed())
+			}
+		})
+		It("visits the whole tree with one or more workers", func() {
+			for _, workers := range []int{1, 4} {
+				paths, err := parallelWalkPaths(fs, "/tree", workers, func(string) error { return nil })
+				Expect(err).ToNot(HaveOccurred())
+				Expect(paths).To(Equal([]string{
+					"/tree", "/tree/a", "/tree/a/b", "/tree/a/b/file1", "/tree/a/b/file2", "/tree/a/c", "/tree/a/c/file",
+					"/tree/d", "/tree/d/file", "/tree/file",
+				}))
+			}
+		})
+		It("skips the dirs returning SkipDir", func() {
+			paths, err := parallelWalkPaths(fs, "/tree", 4, func(path string) error {
+				if path == "/tree/a" {
+					return filepath.SkipDir
+				}
+				return nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(paths).To(Equal([]string{"/tree", "/tree/a", "/tree/d", "/tree/d/file", "/tree/file"}))
+		})
+		It("stops the walk early on SkipAll or an error", func() {
+			paths, err := parallelWalkPaths(fs, "/tree", 4, func(path string) error {
+				if path == "/tree" {
+					return filepath.SkipAll
+				}
+				return nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(paths).To(Equal([]string{"/tree"}))
+
+			paths, err = parallelWalkPaths(fs, "/tree", 4, func(path string) error {
+				if path == "/tree/a" {
+					return errors.New("walk failed")
+				}
+				return nil
+			})
+			Expect(err).To(MatchError("walk failed"))
+			Expect(paths).ToNot(ContainElement("/tree/a/b"))
+		})
+		It("reports a missing root", func() {
+			_, err := parallelWalkPaths(fs, "/missing", 4, func(string) error { return nil })
+			Expect(err).To(HaveOccurred())
+		})
+	})
 	Describe("CopyFile", Label("CopyFile"), func() {
 		It("Copies source file to target file", func() {
 			err := fsutils.MkdirAll(fs, "/some", constants.DirPerm)
@@ -553,6 +749,19 @@ var _ = Describe("Utils", Label("utils"), func() {
 			_, err := fs.Stat("/tmp/dest")
 			Expect(err).To(BeNil())
 		})
+		It("Checks the checksum of the source", func() {
+			Expect(fs.WriteFile("/tmp/file", []byte("kairos"), constants.FilePerm)).To(Succeed())
+			sum := "0d8e3d3ab3ca8a8be8e4b5f2a9e1e4bbbb5e1e70f6b5ecfc1c4c2c1c0b1b4e0a"
+			err := utils.GetSource(config, "file:///tmp/file#sha256="+sum, "/tmp/dest")
+			Expect(err).To(MatchError(ContainSubstring("checksum mismatch")))
+			_, err = fs.Stat("/tmp/dest")
+			Expect(err).NotTo(BeNil())
+
+			sum, err = utils.CalcFileChecksum(fs, "/tmp/file")
+			Expect(err).To(BeNil())
+			Expect(utils.GetSource(config, "file:///tmp/file#sha256="+sum, "/tmp/dest")).To(BeNil())
+			Expect(utils.GetSource(config, "file:///tmp/file#md5=abc", "/tmp/dest")).To(MatchError(ContainSubstring("only sha256")))
+		})
 	})
 	Describe("ValidContainerReference", Label("reference"), func() {
 		It("Returns true on valid references", func() {
@@ -599,6 +808,62 @@ var _ = Describe("Utils", Label("utils"), func() {
 			Expect(size).To(Equal(int64(3072)))
 		})
 	})
+	Describe("AtomicWriteFile", Label("fs"), func() {
+		BeforeEach(func() {
+			Expect(fsutils.MkdirAll(fs, "/folder", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/folder/file", []byte("old contents"), 0644)).To(Succeed())
+		})
+		It("Replaces the file contents and permissions without leaving temporary files", func() {
+			Expect(fsutils.AtomicWriteFile(fs, "/folder/file", []byte("new"), 0600)).To(Succeed())
+			data, err := fs.ReadFile("/folder/file")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(data)).To(Equal("new"))
+			stat, err := fs.Stat("/folder/file")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(stat.Mode().Perm()).To(Equal(os.FileMode(0600)))
+			entries, err := fs.ReadDir("/folder")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+		})
+		It("Removes the temporary file if it cannot be renamed", func() {
+			Expect(fsutils.MkdirAll(fs, "/folder/dir/subdir", constants.DirPerm)).To(Succeed())
+			Expect(fsutils.AtomicWriteFile(fs, "/folder/dir", []byte("new"), 0600)).ToNot(Succeed())
+			entries, err := fs.ReadDir("/folder")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(entries).To(HaveLen(2))
+			isDir, _ := fsutils.IsDir(fs, "/folder/dir")
+			Expect(isDir).To(BeTrue())
+		})
+	})
+	Describe("NamespacedTempDir", Label("fs", "tempdir"), func() {
+		It("Enforces the quota and removes the dir on cleanup", func() {
+			dir, err := fsutils.NamespacedTempDir(fs, "/tmp", "deploy", 1024)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(dir).To(HavePrefix("/tmp/kairos-deploy-"))
+			Expect(fsutils.CheckTempDirQuota(fs, dir)).To(Succeed())
+			Expect(fs.WriteFile(filepath.Join(dir, "file"), make([]byte, 2048), constants.FilePerm)).To(Succeed())
+			Expect(fsutils.CheckTempDirQuota(fs, dir)).To(MatchError(ContainSubstring("over its quota")))
+
+			Expect(fsutils.CleanupTempDirs(fs)).To(Succeed())
+			exists, _ := fsutils.Exists(fs, dir)
+			Expect(exists).To(BeFalse())
+			exists, _ = fsutils.Exists(fs, dir+fsutils.TempDirOwnerSuffix)
+			Expect(exists).To(BeFalse())
+		})
+		It("Removes the stale dirs of dead processes only", func() {
+			dir, err := fsutils.NamespacedTempDir(fs, "/tmp", "iso", 0)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(fsutils.MkdirAll(fs, "/tmp/kairos-deploy-1234/sub", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/tmp/kairos-deploy-1234.owner", []byte("999999999"), constants.FilePerm)).To(Succeed())
+
+			removed, err := fsutils.CleanStaleTempDirs(fs, "/tmp", "/missing")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(removed).To(Equal([]string{"/tmp/kairos-deploy-1234"}))
+			exists, _ := fsutils.Exists(fs, dir)
+			Expect(exists).To(BeTrue())
+			Expect(fsutils.RemoveTempDir(fs, dir)).To(Succeed())
+		})
+	})
 	Describe("FindFileWithPrefix", Label("find"), func() {
 		BeforeEach(func() {
 			err := fsutils.MkdirAll(fs, "/path/inner", constants.DirPerm)
@@ -797,6 +1062,51 @@ var _ = Describe("Utils", Label("utils"), func() {
 				Expect(buf).To(ContainSubstring("Failed reading grub config file"))
 			})
 		})
+		Describe("kernel based bootloaders", func() {
+			var rootDir, bootDir string
+			BeforeEach(func() {
+				rootDir = constants.ActiveDir
+				bootDir = constants.StateDir
+				Expect(fsutils.MkdirAll(fs, filepath.Join(rootDir, "boot"), constants.DirPerm)).To(Succeed())
+				Expect(fsutils.MkdirAll(fs, bootDir, constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile(filepath.Join(rootDir, "boot/vmlinuz-6.1"), []byte("kernel"), constants.FilePerm)).To(Succeed())
+				Expect(fs.Symlink("vmlinuz-6.1", filepath.Join(rootDir, "boot/vmlinuz"))).To(Succeed())
+				Expect(fs.WriteFile(filepath.Join(rootDir, "boot/initrd"), []byte("initrd"), constants.FilePerm)).To(Succeed())
+			})
+			It("picks the bootloader from the firmware", func() {
+				Expect(utils.NewBootloader(config, v1.ZIPL)).To(BeAssignableToTypeOf(&utils.Zipl{}))
+				Expect(utils.NewBootloader(config, v1.PETITBOOT)).To(BeAssignableToTypeOf(&utils.Petitboot{}))
+				Expect(utils.NewBootloader(config, v1.EFI)).To(BeAssignableToTypeOf(&utils.Grub{}))
+			})
+			It("installs zipl with the kernel copied to the state partition", func() {
+				err := utils.NewZipl(config).Install("/dev/dasda", rootDir, bootDir, constants.GrubConf, "", false, constants.StateLabel)
+				Expect(err).ToNot(HaveOccurred())
+				kernel, err := fs.ReadFile(filepath.Join(bootDir, "zipl/vmlinuz"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(kernel)).To(Equal("kernel"))
+				conf, err := fs.ReadFile(filepath.Join(bootDir, "zipl/zipl.conf"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(conf)).To(ContainSubstring("defaultmenu = menu"))
+				Expect(string(conf)).To(ContainSubstring("console=ttysclp0"))
+				Expect(string(conf)).To(ContainSubstring("root=LABEL=COS_STATE cos-img/filename=/cOS/passive.img"))
+				Expect(string(conf)).To(ContainSubstring("3 = recovery"))
+				Expect(runner.IncludesCmds([][]string{{"zipl", "--config", filepath.Join(bootDir, "zipl/zipl.conf")}})).To(Succeed())
+			})
+			It("writes a kboot.conf for petitboot", func() {
+				err := utils.NewPetitboot(config).Install("/dev/sda", rootDir, bootDir, constants.GrubConf, "hvc1", false, constants.StateLabel)
+				Expect(err).ToNot(HaveOccurred())
+				conf, err := fs.ReadFile(filepath.Join(bootDir, "kboot.conf"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(conf)).To(HavePrefix("default=active\n"))
+				Expect(string(conf)).To(ContainSubstring("active='/petitboot/vmlinuz initrd=/petitboot/initrd console=hvc1 "))
+				Expect(runner.CmdsMatch([][]string{})).To(Succeed())
+			})
+			It("fails without a kernel", func() {
+				Expect(fs.RemoveAll(filepath.Join(rootDir, "boot"))).To(Succeed())
+				err := utils.NewZipl(config).Install("/dev/dasda", rootDir, bootDir, constants.GrubConf, "", false, constants.StateLabel)
+				Expect(err).To(MatchError(ContainSubstring("could not find the kernel")))
+			})
+		})
 		Describe("SetPersistentVariables", func() {
 			It("Sets the grub environment file", func() {
 				temp, err := os.CreateTemp("", "grub-*")
@@ -811,6 +1121,72 @@ var _ = Describe("Utils", Label("utils"), func() {
 				Expect(readVars["key1"]).To(Equal("value1"))
 				Expect(readVars["key2"]).To(Equal("value2"))
 			})
+			It("Keeps the variables already set and removes the empty ones", func() {
+				Expect(fsutils.MkdirAll(fs, "/oem", constants.DirPerm)).To(Succeed())
+				Expect(utils.SetPersistentVariables("/oem/grubenv", map[string]string{"next_entry": "fallback", "extra_cmdline": "console=ttyS0 rd.debug"}, fs)).To(Succeed())
+				Expect(utils.SetPersistentVariables("/oem/grubenv", map[string]string{"next_entry": "", "default_menu_entry": "Kairos"}, fs)).To(Succeed())
+				data, err := fs.ReadFile("/oem/grubenv")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(data).To(HaveLen(1024))
+				Expect(string(data)).To(HavePrefix("# GRUB Environment Block\ndefault_menu_entry=Kairos\nextra_cmdline=console=ttyS0 rd.debug\n#"))
+				vars, err := utils.ReadPersistentVariables("/oem/grubenv", fs)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(vars).To(Equal(map[string]string{"default_menu_entry": "Kairos", "extra_cmdline": "console=ttyS0 rd.debug"}))
+			})
+			It("Reads and writes escaped values as grub2-editenv does", func() {
+				Expect(fsutils.MkdirAll(fs, "/oem", constants.DirPerm)).To(Succeed())
+				block := "# GRUB Environment Block\nmulti=line\\\none\npath=C:\\\\boot\n"
+				block += strings.Repeat("#", 1024-len(block))
+				Expect(fs.WriteFile("/oem/grubenv", []byte(block), constants.FilePerm)).To(Succeed())
+				vars, err := utils.ReadPersistentVariables("/oem/grubenv", fs)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(vars).To(Equal(map[string]string{"multi": "line\none", "path": "C:\\boot"}))
+
+				Expect(utils.SetPersistentVariables("/oem/grubenv", map[string]string{"other": "value"}, fs)).To(Succeed())
+				data, err := fs.ReadFile("/oem/grubenv")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(data)).To(HavePrefix("# GRUB Environment Block\nmulti=line\\\none\nother=value\npath=C:\\\\boot\n#"))
+			})
+			It("Reads files which are not environment blocks and refuses variables not fitting in a block", func() {
+				Expect(fsutils.MkdirAll(fs, "/oem", constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile("/oem/grubenv", []byte("next_entry=fallback\nextra_cmdline=console=ttyS0\n"), constants.FilePerm)).To(Succeed())
+				vars, err := utils.ReadPersistentVariables("/oem/grubenv", fs)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(vars).To(Equal(map[string]string{"next_entry": "fallback", "extra_cmdline": "console=ttyS0"}))
+				// It's written back as a block
+				Expect(utils.SetPersistentVariables("/oem/grubenv", map[string]string{"next_entry": ""}, fs)).To(Succeed())
+				data, err := fs.ReadFile("/oem/grubenv")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(data).To(HaveLen(1024))
+				Expect(string(data)).To(HavePrefix("# GRUB Environment Block\nextra_cmdline=console=ttyS0\n#"))
+
+				Expect(fs.Remove("/oem/grubenv")).To(Succeed())
+				Expect(utils.SetPersistentVariables("/oem/grubenv", map[string]string{"extra_cmdline": strings.Repeat("a", 1024)}, fs)).To(MatchError(ContainSubstring("more than the 1024 bytes block")))
+				Expect(utils.SetPersistentVariables("/oem/grubenv", map[string]string{"bad=name": "value"}, fs)).To(MatchError(ContainSubstring("invalid grub environment variable name")))
+				// The file created to lock it is not left behind
+				exists, _ := fsutils.Exists(fs, "/oem/grubenv")
+				Expect(exists).To(BeFalse())
+			})
+			It("Does not lose variables set concurrently", func() {
+				Expect(fsutils.MkdirAll(fs, "/oem", constants.DirPerm)).To(Succeed())
+				var wg sync.WaitGroup
+				for i := 0; i < 10; i++ {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						defer GinkgoRecover()
+						Expect(utils.SetPersistentVariables("/oem/grubenv", map[string]string{fmt.Sprintf("var%d", i): "set"}, fs)).To(Succeed())
+					}(i)
+				}
+				wg.Wait()
+				vars, err := utils.ReadPersistentVariables("/oem/grubenv", fs)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(vars).To(HaveLen(10))
+				// The lock is taken on the file itself
+				entries, err := fs.ReadDir("/oem")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(entries).To(HaveLen(1))
+			})
 			It("Fails setting variables", func() {
 				e := utils.SetPersistentVariables(
 					"badfilenopath", map[string]string{"key1": "value1"},
@@ -845,6 +1221,65 @@ var _ = Describe("Utils", Label("utils"), func() {
 			})).To(BeNil())
 			Expect(err).To(HaveOccurred())
 		})
+		Describe("with progress", func() {
+			var realRunner *v1.RealRunner
+			BeforeEach(func() {
+				// Fake mksquashfs redrawing its progress bar like the real one does
+				bin := GinkgoT().TempDir()
+				script := "#!/bin/sh\n" +
+					"printf 'Parallel mksquashfs: Using 4 processors\\n'\n" +
+					"printf '[====    ] 10/40  25%%\\r[=====   ] 20/40  50%%\\r[=====   ] 20/40  50%%\\r'\n" +
+					"[ -n \"$SLEEP\" ] && exec sleep \"$SLEEP\"\n" +
+					"printf '[========] 40/40 100%%\\n'\n"
+				Expect(os.WriteFile(filepath.Join(bin, "mksquashfs"), []byte(script), 0755)).To(Succeed())
+				GinkgoT().Setenv("PATH", bin+":"+os.Getenv("PATH"))
+				realRunner = &v1.RealRunner{Logger: &logger}
+			})
+			It("reports every progress change", func() {
+				var reported []int
+				err := utils.CreateSquashFSWithProgress(context.Background(), realRunner, logger, "source", "dest", []string{}, func(pct int) {
+					reported = append(reported, pct)
+				})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(reported).To(Equal([]int{25, 50, 100}))
+			})
+			It("stops when the context is cancelled", func() {
+				GinkgoT().Setenv("SLEEP", "10")
+				ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+				defer cancel()
+				start := time.Now()
+				err := utils.CreateSquashFSWithProgress(ctx, realRunner, logger, "source", "dest", []string{}, func(int) {})
+				Expect(err).To(MatchError(context.DeadlineExceeded))
+				Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+			})
+		})
+	})
+	Describe("SquashfsOptions", Label("CreateSquashFS"), func() {
+		BeforeEach(func() {
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "mksquashfs" {
+					return []byte("Compressors available and compressor specific options:\n" +
+						"\tgzip (default)\n\t  -Xcompression-level <compression-level>\n" +
+						"\tzstd\n\t  -Xcompression-level <compression-level>\n" +
+						"\tlz4\n\t  -Xhc\n"), errors.New("exit status 1")
+				}
+				return []byte{}, nil
+			}
+		})
+		It("uses the default options and squash-compression if squashfs is not configured", func() {
+			config.SquashFsCompressionConfig = []string{"-comp", "xz"}
+			Expect(utils.SquashfsOptions(config)).To(Equal([]string{"-b", "1024k", "-comp", "xz"}))
+		})
+		It("uses the configured compression, level and block size", func() {
+			config.Squashfs = &agentConfig.Squashfs{Compression: "zstd:19", BlockSize: "1M"}
+			Expect(utils.SquashfsOptions(config)).To(Equal([]string{"-b", "1M", "-comp", "zstd", "-Xcompression-level", "19"}))
+			config.Squashfs = &agentConfig.Squashfs{Compression: "lz4:hc"}
+			Expect(utils.SquashfsOptions(config)).To(Equal([]string{"-b", "1024k", "-comp", "lz4", "-Xhc"}))
+		})
+		It("falls back to gzip if mksquashfs does not support the compression", func() {
+			config.Squashfs = &agentConfig.Squashfs{Compression: "xz"}
+			Expect(utils.SquashfsOptions(config)).To(Equal([]string{"-b", "1024k", "-comp", "gzip"}))
+		})
 	})
 	Describe("CommandExists", Label("CommandExists"), func() {
 		It("returns false if command does not exists", func() {
@@ -1265,4 +1700,330 @@ var _ = Describe("Utils", Label("utils"), func() {
 		})
 
 	})
+	Describe("ApplyIOLimit", Label("iolimit"), func() {
+		var procDir string
+		var serviceCgroup string
+		var cgroupDir string
+		BeforeEach(func() {
+			procDir = fmt.Sprintf("/proc/%d", os.Getpid())
+			serviceCgroup = filepath.Join(constants.CgroupRoot, "system.slice", "kairos-agent.service")
+			cgroupDir = filepath.Join(serviceCgroup, constants.UpgradeCgroup)
+			Expect(fsutils.MkdirAll(fs, filepath.Join(procDir, "task", "100"), constants.DirPerm)).To(Succeed())
+			Expect(fsutils.MkdirAll(fs, filepath.Join(procDir, "task", "101"), constants.DirPerm)).To(Succeed())
+			Expect(fsutils.MkdirAll(fs, serviceCgroup, constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile(filepath.Join(procDir, "cgroup"), []byte("0::/system.slice/kairos-agent.service\n"), constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile(filepath.Join(serviceCgroup, "cgroup.controllers"), []byte("cpuset cpu io memory pids\n"), constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile(filepath.Join(serviceCgroup, "cgroup.procs"), []byte("4242\n"), constants.FilePerm)).To(Succeed())
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "lsblk" && args[1] == "PKNAME" {
+					return []byte("sda\n"), nil
+				}
+				if cmd == "lsblk" {
+					return []byte("8:0\n"), nil
+				}
+				return []byte{}, nil
+			}
+		})
+		It("sets the IO class of all the process threads", func() {
+			restore, err := utils.ApplyIOLimit(config, v1.IOLimit{Class: constants.IOClassIdle}, "/dev/sda2")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(runner.CmdsMatch([][]string{
+				{"ionice", "-c", "3", "-p", "100"},
+				{"ionice", "-c", "3", "-p", "101"},
+			})).To(BeNil())
+			runner.ClearCmds()
+			Expect(restore()).To(Succeed())
+			Expect(runner.CmdsMatch([][]string{
+				{"ionice", "-c", "0", "-p", "100"},
+				{"ionice", "-c", "0", "-p", "101"},
+			})).To(BeNil())
+		})
+		It("limits the bandwidth on the disk with a child cgroup of the unit", func() {
+			unitProcs := filepath.Join(serviceCgroup, constants.UnitProcsCgroup)
+			restore, err := utils.ApplyIOLimit(config, v1.IOLimit{Bandwidth: 10}, "/dev/sda2")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(runner.IncludesCmds([][]string{{"lsblk", "-dno", "MAJ:MIN", "/dev/sda"}})).To(BeNil())
+			ioMax, err := fs.ReadFile(filepath.Join(cgroupDir, "io.max"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(ioMax)).To(Equal("8:0 rbps=10485760 wbps=10485760"))
+			procs, err := fs.ReadFile(filepath.Join(cgroupDir, "cgroup.procs"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(procs)).To(Equal(fmt.Sprintf("%d", os.Getpid())))
+			procs, err = fs.ReadFile(filepath.Join(unitProcs, "cgroup.procs"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(procs)).To(Equal("4242"))
+			subtree, err := fs.ReadFile(filepath.Join(serviceCgroup, "cgroup.subtree_control"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(subtree)).To(Equal("+io +memory"))
+			exists, _ := fsutils.Exists(fs, filepath.Join(constants.CgroupRoot, constants.UpgradeCgroup))
+			Expect(exists).To(BeFalse())
+
+			Expect(restore()).To(Succeed())
+			subtree, err = fs.ReadFile(filepath.Join(serviceCgroup, "cgroup.subtree_control"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(subtree)).To(Equal("-io -memory"))
+			procs, err = fs.ReadFile(filepath.Join(serviceCgroup, "cgroup.procs"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(procs)).To(Equal("4242"))
+			for _, dir := range []string{cgroupDir, unitProcs} {
+				exists, _ = fsutils.Exists(fs, dir)
+				Expect(exists).To(BeFalse())
+			}
+		})
+		It("does not move processes out of the root cgroup", func() {
+			Expect(fs.WriteFile(filepath.Join(procDir, "cgroup"), []byte("0::/\n"), constants.FilePerm)).To(Succeed())
+			_, err := utils.ApplyIOLimit(config, v1.IOLimit{Bandwidth: 10}, "/dev/sda2")
+			Expect(err).To(MatchError(ContainSubstring("root cgroup")))
+			exists, _ := fsutils.Exists(fs, filepath.Join(constants.CgroupRoot, constants.UnitProcsCgroup))
+			Expect(exists).To(BeFalse())
+		})
+		It("fails without the cgroup io controller and restores the IO class", func() {
+			Expect(fs.WriteFile(filepath.Join(serviceCgroup, "cgroup.controllers"), []byte("cpu memory\n"), constants.FilePerm)).To(Succeed())
+			_, err := utils.ApplyIOLimit(config, v1.IOLimit{Bandwidth: 10, Class: constants.IOClassIdle}, "/dev/sda2")
+			Expect(err).To(HaveOccurred())
+			Expect(runner.IncludesCmds([][]string{{"ionice", "-c", "0", "-p", "100"}})).To(BeNil())
+		})
+	})
+	Describe("ApplyResourceGuard", Label("resources"), func() {
+		var tmpDir string
+		BeforeEach(func() {
+			tmpDir = os.TempDir()
+			Expect(fsutils.MkdirAll(fs, tmpDir, constants.DirPerm)).To(Succeed())
+			Expect(fsutils.MkdirAll(fs, "/proc", constants.DirPerm)).To(Succeed())
+			config.ImageExtractor = v1.OCIImageExtractor{}
+		})
+		It("switches to low memory mode and restores the previous settings", func() {
+			Expect(fs.WriteFile("/proc/meminfo", []byte("MemTotal:        1918332 kB\nMemFree:          201432 kB\nMemAvailable:     786432 kB\n"), constants.FilePerm)).To(Succeed())
+			procs := runtime.GOMAXPROCS(0)
+			previousTmp, tmpSet := os.LookupEnv("TMPDIR")
+			// Force the temporary dir to be short of space
+			restore, err := utils.ApplyResourceGuard(config, v1.ResourceGuard{MinTmp: 1 << 30}, "/usr/local/tmp")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.Getenv("TMPDIR")).To(Equal("/usr/local/tmp"))
+			Expect(fsutils.Exists(fs, "/usr/local/tmp")).To(BeTrue())
+			Expect(runtime.GOMAXPROCS(0)).To(Equal(1))
+			Expect(config.ImageExtractor).To(Equal(v1.OCIImageExtractor{Stream: true, Workers: 1}))
+			Expect(utils.SquashfsOptions(config)).To(ContainElements("-processors", "1"))
+
+			Expect(restore()).To(Succeed())
+			tmp, set := os.LookupEnv("TMPDIR")
+			Expect(set).To(Equal(tmpSet))
+			Expect(tmp).To(Equal(previousTmp))
+			Expect(runtime.GOMAXPROCS(0)).To(Equal(procs))
+			Expect(config.ImageExtractor).To(Equal(v1.OCIImageExtractor{}))
+			Expect(config.Squashfs).To(BeNil())
+		})
+		It("changes nothing with enough memory and temporary space", func() {
+			Expect(fs.WriteFile("/proc/meminfo", []byte("MemTotal:        8018332 kB\nMemAvailable:     6291456 kB\n"), constants.FilePerm)).To(Succeed())
+			_, err := utils.ApplyResourceGuard(config, v1.ResourceGuard{MinTmp: 1}, "/usr/local/tmp")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(config.ImageExtractor).To(Equal(v1.OCIImageExtractor{}))
+			Expect(config.Squashfs).To(BeNil())
+			Expect(fsutils.Exists(fs, "/usr/local/tmp")).To(BeFalse())
+		})
+		It("fails if the available memory cannot be read", func() {
+			Expect(fs.WriteFile("/proc/meminfo", []byte("MemTotal:        8018332 kB\n"), constants.FilePerm)).To(Succeed())
+			_, err := utils.ApplyResourceGuard(config, v1.ResourceGuard{}, "")
+			Expect(err).To(MatchError(ContainSubstring("no MemAvailable")))
+			_, err = utils.ApplyResourceGuard(config, v1.ResourceGuard{Disable: true}, "")
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+	Describe("ExtractContainerStoreImage", Label("containerstore"), func() {
+		var target string
+		var src *v1.ImageSource
+		BeforeEach(func() {
+			var err error
+			target, err = os.MkdirTemp("", "containerstore")
+			Expect(err).ToNot(HaveOccurred())
+			src, err = v1.NewSrcFromURI("podman:quay.io/kairos/opensuse:v3.2.1")
+			Expect(err).ToNot(HaveOccurred())
+			img, err := random.Image(512, 2)
+			Expect(err).ToNot(HaveOccurred())
+			tag, err := name.NewTag(src.Value())
+			Expect(err).ToNot(HaveOccurred())
+			runner.SideEffect = func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "podman" {
+					return []byte{}, tarball.WriteToFile(args[4], tag, img)
+				}
+				return []byte("ctr: image \"quay.io/kairos/opensuse:v3.2.1\": not found"), errors.New("exit status 1")
+			}
+		})
+		AfterEach(func() {
+			os.RemoveAll(target)
+		})
+		It("exports the image from the podman store and extracts it", func() {
+			Expect(utils.ExtractContainerStoreImage(config, src, target)).To(Succeed())
+			Expect(runner.CmdsMatch([][]string{{"podman", "save", "--format", "docker-archive", "-o"}})).To(BeNil())
+			files, err := os.ReadDir(target)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(HaveLen(2))
+		})
+		It("checks the image policy against the exported image", func() {
+			config.ImagePolicy = &v1.ImagePolicy{RequiredLabels: map[string]string{"io.kairos.version": ""}}
+			err := utils.ExtractContainerStoreImage(config, src, target)
+			Expect(err).To(MatchError(ContainSubstring("io.kairos.version")))
+			files, _ := os.ReadDir(target)
+			Expect(files).To(BeEmpty())
+		})
+		It("fails if the image is not in the containerd store", func() {
+			src, _ = v1.NewSrcFromURI("containerd:quay.io/kairos/opensuse:v3.2.1")
+			err := utils.ExtractContainerStoreImage(config, src, target)
+			Expect(err).To(MatchError(ContainSubstring("not found")))
+			Expect(runner.IncludesCmds([][]string{{"ctr", "images", "export"}})).To(BeNil())
+		})
+	})
+	Describe("NewHardwareReport", Label("hardware"), func() {
+		BeforeEach(func() {
+			devices := map[string]map[string]string{
+				"0000:00:1f.2": {"class": "0x010601", "vendor": "0x8086", "device": "0x2922", "modalias": "pci:v00008086d00002922sv00001AF4sd00001100bc01sc06i01"},
+				"0000:01:00.0": {"class": "0x020000", "vendor": "0x14e4", "device": "0x16d8", "modalias": "pci:v000014E4d000016D8sv00001028sd00001F5Bbc02sc00i00"},
+				"0000:00:02.0": {"class": "0x060000", "vendor": "0x8086", "device": "0x29c0", "modalias": "pci:v00008086d000029C0sv00001AF4sd00001100bc06sc00i00"},
+			}
+			for addr, files := range devices {
+				dir := filepath.Join(utils.PCIDevicesDir, addr)
+				Expect(fsutils.MkdirAll(fs, dir, constants.DirPerm)).To(Succeed())
+				for name, value := range files {
+					Expect(fs.WriteFile(filepath.Join(dir, name), []byte(value+"\n"), constants.FilePerm)).To(Succeed())
+				}
+			}
+			Expect(fs.Symlink("../../../bus/pci/drivers/ahci", filepath.Join(utils.PCIDevicesDir, "0000:00:1f.2", "driver"))).To(Succeed())
+			Expect(fs.Symlink("../../../bus/pci/drivers/tg3", filepath.Join(utils.PCIDevicesDir, "0000:01:00.0", "driver"))).To(Succeed())
+
+			Expect(fsutils.MkdirAll(fs, "/image/usr/lib/modules/6.6.0", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/image/usr/lib/modules/6.6.0/modules.builtin.alias", []byte(
+				"alias pci:v*d*sv*sd*bc01sc06i01* ahci\n",
+			), constants.FilePerm)).To(Succeed())
+			Expect(fs.WriteFile("/image/usr/lib/modules/6.6.0/modules.alias", []byte(
+				"# Aliases extracted from modules themselves.\nalias pci:v00008086d000010D3sv*sd*bc*sc*i* e1000e\nalias usb:v0BDAp8153d*dc*dsc*dp*ic*isc*ip*in* r8152\n",
+			), constants.FilePerm)).To(Succeed())
+		})
+		It("reports the host devices without modules in the image", func() {
+			report, err := utils.NewHardwareReport(fs, "/image")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(report.Devices).To(HaveLen(2))
+			missing := report.Missing()
+			Expect(missing).To(HaveLen(1))
+			Expect(missing[0].Address).To(Equal("0000:01:00.0"))
+			Expect(missing[0].Class).To(Equal("network"))
+			Expect(missing[0].Driver).To(Equal("tg3"))
+		})
+		It("finds the modules of the devices", func() {
+			Expect(fs.WriteFile("/image/usr/lib/modules/6.6.0/modules.alias", []byte(
+				"alias pci:v000014E4d000016D8sv*sd*bc*sc*i* tg3\n",
+			), constants.FilePerm)).To(Succeed())
+			report, err := utils.NewHardwareReport(fs, "/image")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(report.Missing()).To(BeEmpty())
+			for _, d := range report.Devices {
+				Expect(d.Modules).To(ContainElement(d.Driver))
+			}
+		})
+	})
+	Describe("DetectAccelerators", Label("hardware"), func() {
+		It("lists the GPUs and accelerators of the known vendors", func() {
+			devices := map[string]map[string]string{
+				"0000:01:00.0": {"class": "0x030000", "vendor": "0x10de", "device": "0x2204"},
+				"0000:00:02.0": {"class": "0x030000", "vendor": "0x8086", "device": "0x46a6"},
+				"0000:02:00.0": {"class": "0x120000", "vendor": "0x1002", "device": "0x74a1"},
+				"0000:00:01.0": {"class": "0x030000", "vendor": "0x1234", "device": "0x1111"},
+				"0000:00:1f.2": {"class": "0x010601", "vendor": "0x8086", "device": "0x2922"},
+			}
+			for addr, files := range devices {
+				dir := filepath.Join(utils.PCIDevicesDir, addr)
+				Expect(fsutils.MkdirAll(fs, dir, constants.DirPerm)).To(Succeed())
+				for name, value := range files {
+					Expect(fs.WriteFile(filepath.Join(dir, name), []byte(value+"\n"), constants.FilePerm)).To(Succeed())
+				}
+			}
+			Expect(fs.Symlink("../../../bus/pci/drivers/nouveau", filepath.Join(utils.PCIDevicesDir, "0000:01:00.0", "driver"))).To(Succeed())
+			for dev, compatible := range map[string]string{
+				"ff9a0000.gpu": "rockchip,rk3399-mali\x00arm,mali-t860\x00",
+				"ff100000.usb": "rockchip,rk3399-usb\x00",
+			} {
+				dir := filepath.Join(utils.PlatformDevicesDir, dev, "of_node")
+				Expect(fsutils.MkdirAll(fs, dir, constants.DirPerm)).To(Succeed())
+				Expect(fs.WriteFile(filepath.Join(dir, "compatible"), []byte(compatible), constants.FilePerm)).To(Succeed())
+			}
+
+			Expect(utils.DetectAccelerators(fs)).To(Equal([]utils.Accelerator{
+				{Address: "0000:00:02.0", Vendor: "intel", Device: "8086:46a6"},
+				{Address: "0000:01:00.0", Vendor: "nvidia", Device: "10de:2204", Driver: "nouveau"},
+				{Address: "0000:02:00.0", Vendor: "amd", Device: "1002:74a1"},
+				{Address: "ff9a0000.gpu", Vendor: "arm", Device: "arm,mali-t860"},
+			}))
+		})
+		It("finds none without the device buses", func() {
+			Expect(utils.DetectAccelerators(fs)).To(BeEmpty())
+		})
+	})
+	Describe("RestoreOEM", Label("oembackup"), func() {
+		// oemArchive returns a backup archive with the given entries after the metadata
+		oemArchive := func(entries ...*tar.Header) []byte {
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			tw := tar.NewWriter(gz)
+			meta := []byte("source: /oem\n")
+			Expect(tw.WriteHeader(&tar.Header{Name: ".kairos-oem-backup.yaml", Typeflag: tar.TypeReg, Mode: 0600, Size: int64(len(meta))})).To(Succeed())
+			_, err := tw.Write(meta)
+			Expect(err).ToNot(HaveOccurred())
+			for _, hdr := range entries {
+				Expect(tw.WriteHeader(hdr)).To(Succeed())
+				if hdr.Typeflag == tar.TypeReg {
+					_, err = tw.Write(make([]byte, hdr.Size))
+					Expect(err).ToNot(HaveOccurred())
+				}
+			}
+			Expect(tw.Close()).To(Succeed())
+			Expect(gz.Close()).To(Succeed())
+			return buf.Bytes()
+		}
+		BeforeEach(func() {
+			Expect(fsutils.MkdirAll(fs, "/oem", constants.DirPerm)).To(Succeed())
+			Expect(fs.WriteFile("/oem/99_current.yaml", []byte("#cloud-config\n"), constants.FilePerm)).To(Succeed())
+		})
+		It("restores the links within the backup", func() {
+			archive := oemArchive(
+				&tar.Header{Name: "90_custom.yaml", Typeflag: tar.TypeReg, Mode: 0600, Size: 4},
+				&tar.Header{Name: "custom.yaml", Typeflag: tar.TypeSymlink, Linkname: "90_custom.yaml"},
+			)
+			_, err := utils.RestoreOEM(config, archive, "/oem")
+			Expect(err).ToNot(HaveOccurred())
+			link, err := fs.Readlink("/oem/custom.yaml")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(link).To(Equal("90_custom.yaml"))
+			exists, _ := fsutils.Exists(fs, "/oem/99_current.yaml")
+			Expect(exists).To(BeFalse())
+		})
+		It("refuses links pointing outside of the backup", func() {
+			_, err := utils.RestoreOEM(config, oemArchive(&tar.Header{Name: "x", Typeflag: tar.TypeSymlink, Linkname: "/etc"}), "/oem")
+			Expect(err).To(MatchError(ContainSubstring("outside of the backup root")))
+			_, err = utils.RestoreOEM(config, oemArchive(&tar.Header{Name: "dir/x", Typeflag: tar.TypeSymlink, Linkname: "../../etc"}), "/oem")
+			Expect(err).To(MatchError(ContainSubstring("outside of the backup root")))
+		})
+		It("refuses entries written through a restored link", func() {
+			archive := oemArchive(
+				&tar.Header{Name: "dir", Typeflag: tar.TypeDir, Mode: 0700},
+				&tar.Header{Name: "x", Typeflag: tar.TypeSymlink, Linkname: "dir"},
+				&tar.Header{Name: "x/shadow", Typeflag: tar.TypeReg, Mode: 0600, Size: 4},
+			)
+			_, err := utils.RestoreOEM(config, archive, "/oem")
+			Expect(err).To(MatchError(ContainSubstring("is a symlink")))
+			exists, _ := fsutils.Exists(fs, "/oem/dir/shadow")
+			Expect(exists).To(BeFalse())
+		})
+		It("keeps the current contents when the backup is refused", func() {
+			archive := oemArchive(
+				&tar.Header{Name: "90_custom.yaml", Typeflag: tar.TypeReg, Mode: 0600, Size: 4},
+				&tar.Header{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0600, Size: 4},
+			)
+			_, err := utils.RestoreOEM(config, archive, "/oem")
+			Expect(err).To(MatchError(ContainSubstring("outside of the backup root")))
+			data, err := fs.ReadFile("/oem/99_current.yaml")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal("#cloud-config\n"))
+			exists, _ := fsutils.Exists(fs, "/oem/90_custom.yaml")
+			Expect(exists).To(BeFalse())
+		})
+	})
 })
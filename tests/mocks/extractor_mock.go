@@ -17,6 +17,8 @@ limitations under the License.
 package mocks
 
 import (
+	"context"
+
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
 	sdkTypes "github.com/kairos-io/kairos-sdk/types"
 )
@@ -24,13 +26,53 @@ import (
 type FakeImageExtractor struct {
 	Logger     sdkTypes.KairosLogger
 	SideEffect func(imageRef, destination, platformRef string) error
+	Metadata   *v1.OCIImageMetadata
+	// Layers are the layer digests of every image, GetOCIImageLayers returns no metadata if unset
+	Layers []string
+	// LayersSideEffect is run when extracting some layers of the image
+	LayersSideEffect func(imageRef, destination, platformRef string, from int) error
+	// Referrers are the referrers of every image and ReferrerBlobs their blobs by referrer digest
+	Referrers     []v1.OCIReferrer
+	ReferrerBlobs map[string][][]byte
+	// ctx is the context set with WithContext, the side effects are given up once it's done
+	ctx context.Context
+}
+
+// WithContext returns a copy of the extractor whose extractions fail once ctx is done, like the real one
+func (f FakeImageExtractor) WithContext(ctx context.Context) v1.ImageExtractor {
+	f.ctx = ctx
+	return f
+}
+
+// run runs the side effect until it returns or the context is done, whatever happens first
+func (f FakeImageExtractor) run(sideEffect func() error) error {
+	if f.ctx == nil {
+		return sideEffect()
+	}
+	done := make(chan error, 1)
+	go func() { done <- sideEffect() }()
+	select {
+	case err := <-done:
+		return err
+	case <-f.ctx.Done():
+		return f.ctx.Err()
+	}
 }
 
 func (f FakeImageExtractor) GetOCIImageSize(imageRef, platformRef string) (int64, error) {
 	return 0, nil
 }
 
-var _ v1.ImageExtractor = FakeImageExtractor{}
+func (f FakeImageExtractor) GetOCIImageMetadata(imageRef, platformRef string) (*v1.OCIImageMetadata, error) {
+	if f.Metadata != nil {
+		return f.Metadata, nil
+	}
+	return &v1.OCIImageMetadata{}, nil
+}
+
+var _ v1.LayeredImageExtractor = FakeImageExtractor{}
+var _ v1.ReferrersImageExtractor = FakeImageExtractor{}
+var _ v1.ContextImageExtractor = FakeImageExtractor{}
 
 func NewFakeImageExtractor(logger sdkTypes.KairosLogger) *FakeImageExtractor {
 	l := logger
@@ -46,8 +88,31 @@ func (f FakeImageExtractor) ExtractImage(imageRef, destination, platformRef stri
 	f.Logger.Debugf("extracting %s to %s in platform %s", imageRef, destination, platformRef)
 	if f.SideEffect != nil {
 		f.Logger.Debugf("running side effect")
-		return f.SideEffect(imageRef, destination, platformRef)
+		return f.run(func() error { return f.SideEffect(imageRef, destination, platformRef) })
 	}
 
 	return nil
 }
+
+func (f FakeImageExtractor) GetOCIImageLayers(imageRef, platformRef string) (*v1.DockerImageMeta, error) {
+	if f.Layers == nil {
+		return nil, nil
+	}
+	return &v1.DockerImageMeta{Digest: "sha256:fake", Layers: f.Layers}, nil
+}
+
+func (f FakeImageExtractor) ExtractImageLayers(imageRef, destination, platformRef string, from int) error {
+	f.Logger.Debugf("extracting %s layers from %d to %s in platform %s", imageRef, from, destination, platformRef)
+	if f.LayersSideEffect != nil {
+		return f.run(func() error { return f.LayersSideEffect(imageRef, destination, platformRef, from) })
+	}
+	return nil
+}
+
+func (f FakeImageExtractor) GetOCIImageReferrers(imageRef, platformRef string) (string, []v1.OCIReferrer, error) {
+	return "sha256:fake", f.Referrers, nil
+}
+
+func (f FakeImageExtractor) GetOCIReferrerBlobs(imageRef string, referrer v1.OCIReferrer) ([][]byte, error) {
+	return f.ReferrerBlobs[referrer.Digest], nil
+}
@@ -18,14 +18,19 @@ package mocks
 
 import (
 	"errors"
+
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
 	sdkTypes "github.com/kairos-io/kairos-sdk/types"
 )
 
 // FakeHTTPClient is an implementation of HTTPClient interface used for testing
-// It stores Get calls into ClientCalls for easy checking of what was called
+// It stores Get calls into ClientCalls for easy checking of what was called.
+// If Fs is set, Data is written to the destination of every call.
 type FakeHTTPClient struct {
 	ClientCalls []string
 	Error       bool
+	Fs          v1.FS
+	Data        []byte
 }
 
 // GetURL will return a FakeHttpBody and store the url call into ClientCalls
@@ -35,6 +40,9 @@ func (m *FakeHTTPClient) GetURL(log sdkTypes.KairosLogger, url string, destinati
 	if m.Error {
 		return errors.New("fake http error")
 	}
+	if m.Fs != nil {
+		return m.Fs.WriteFile(destination, m.Data, 0644)
+	}
 	return nil
 }
 
@@ -17,6 +17,7 @@ limitations under the License.
 package mocks
 
 import (
+	"context"
 	"fmt"
 	sdkTypes "github.com/kairos-io/kairos-sdk/types"
 	"os/exec"
@@ -55,6 +56,10 @@ func (r *FakeRunner) InitCmd(command string, args ...string) *exec.Cmd {
 	return nil
 }
 
+func (r *FakeRunner) InitCmdContext(_ context.Context, command string, args ...string) *exec.Cmd {
+	return r.InitCmd(command, args...)
+}
+
 func (r *FakeRunner) ClearCmds() {
 	r.cmds = [][]string{}
 }